@@ -0,0 +1,130 @@
+package fishes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// adminAccess decides which client addresses may reach the admin portal.
+// A deny match always wins; an empty allow list lets everyone else in.
+type adminAccess struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func parseAdminAccess(allow, deny []string) (*adminAccess, error) {
+	a := &adminAccess{}
+	for _, entry := range allow {
+		ipnet, err := parseIPNet(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin_allow entry '%s': %s", entry, err)
+		}
+		a.allow = append(a.allow, ipnet)
+	}
+	for _, entry := range deny {
+		ipnet, err := parseIPNet(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin_deny entry '%s': %s", entry, err)
+		}
+		a.deny = append(a.deny, ipnet)
+	}
+	return a, nil
+}
+
+// permits reports whether ip may use the portal. Peers without an address,
+// on a Unix socket, are local and always let in.
+func (a *adminAccess) permits(ip net.IP) bool {
+	if ip == nil {
+		return true
+	}
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// reachable answers 403 unless the client address passes admin_allow and
+// admin_deny. It runs before authentication so refused addresses never get
+// to try a password.
+func (a *adminPortal) reachable(w http.ResponseWriter, r *http.Request) bool {
+	cfg := a.fishes.config()
+	access, err := parseAdminAccess(cfg.AdminAllow, cfg.AdminDeny)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return false
+	}
+	if access.permits(hostIP(r.RemoteAddr)) {
+		return true
+	}
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(fmt.Sprintf("the admin portal is not available from %s", clientIP(r))))
+	return false
+}
+
+type adminAccessLists struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// access shows admin_allow and admin_deny on GET and replaces them on PUT.
+// Changes apply right away and last until the next reload or restart, so
+// make them in the config file as well to keep them.
+func (a *adminPortal) access(w http.ResponseWriter, r *http.Request) {
+	h := a.fishes
+	switch r.Method {
+	case "GET":
+		cfg := h.config()
+		writeJSON(w, http.StatusOK, adminAccessLists{Allow: nonNil(cfg.AdminAllow), Deny: nonNil(cfg.AdminDeny)})
+	case "PUT":
+		body, ok := readJSONBody(w, r)
+		if !ok {
+			return
+		}
+		var lists adminAccessLists
+		if err := json.Unmarshal(body, &lists); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		access, err := parseAdminAccess(lists.Allow, lists.Deny)
+		if err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if !access.permits(hostIP(r.RemoteAddr)) {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(fmt.Sprintf("these lists would lock out %s, the address making this change", clientIP(r))))
+			return
+		}
+
+		next := *h.config()
+		next.AdminAllow = lists.Allow
+		next.AdminDeny = lists.Deny
+		h.settings.Store(&next)
+		writeJSON(w, http.StatusOK, adminAccessLists{Allow: nonNil(next.AdminAllow), Deny: nonNil(next.AdminDeny)})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+	}
+}
+
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
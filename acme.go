@@ -0,0 +1,469 @@
+package fishes
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	letsEncryptDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+	acmeChallengePrefix  = "/.well-known/acme-challenge/"
+	acmeRenewBefore      = 30 * 24 * time.Hour
+	acmeCheckInterval    = 12 * time.Hour
+	acmePollInterval     = 2 * time.Second
+	acmePollAttempts     = 60
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type acmeOrder struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+type acmeChallenge struct {
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Status string `json:"status"`
+}
+
+type acmeAuthorization struct {
+	Status     string          `json:"status"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+// acmeManager obtains and renews a certificate for one domain using the
+// ACME HTTP-01 challenge and writes it where certs picks it up.
+type acmeManager struct {
+	sync.Mutex
+	domain    string
+	email     string
+	dirURL    string
+	cacheDir  string
+	certs     *certReloader
+	client    *http.Client
+	key       *ecdsa.PrivateKey
+	dir       acmeDirectory
+	kid       string
+	nonce     string
+	tokens    map[string]string
+	tokensMux sync.RWMutex
+}
+
+func newACMEManager(domain, email, dirURL, cacheDir string) (*acmeManager, error) {
+	if err := os.MkdirAll(cacheDir, 0o700); err != nil {
+		return nil, err
+	}
+
+	m := &acmeManager{
+		domain:   domain,
+		email:    email,
+		dirURL:   dirURL,
+		cacheDir: cacheDir,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		tokens:   map[string]string{},
+	}
+	m.certs = &certReloader{
+		certPath: filepath.Join(cacheDir, domain+".crt"),
+		keyPath:  filepath.Join(cacheDir, domain+".key"),
+	}
+	if err := m.certs.load(); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := m.certs.getCertificate(hello)
+	if cert == nil && err == nil {
+		err = errors.New("acme: certificate not yet issued")
+	}
+	return cert, err
+}
+
+// challengeHandler answers HTTP-01 challenges and hands every other request
+// to next.
+func (m *acmeManager) challengeHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, acmeChallengePrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		m.tokensMux.RLock()
+		keyAuth, ok := m.tokens[strings.TrimPrefix(r.URL.Path, acmeChallengePrefix)]
+		m.tokensMux.RUnlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("content-type", "text/plain")
+		w.Write([]byte(keyAuth))
+	})
+}
+
+func (m *acmeManager) run() {
+	for {
+		if err := m.ensureCertificate(); err != nil {
+			log.Printf("acme: %s", err)
+		}
+		time.Sleep(acmeCheckInterval)
+	}
+}
+
+func (m *acmeManager) needsRenewal() bool {
+	m.certs.RLock()
+	cert := m.certs.cert
+	m.certs.RUnlock()
+	if cert == nil || len(cert.Certificate) == 0 {
+		return true
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return true
+	}
+	return time.Until(leaf.NotAfter) < acmeRenewBefore
+}
+
+func (m *acmeManager) ensureCertificate() error {
+	if !m.needsRenewal() {
+		return nil
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	log.Printf("acme: requesting certificate for %s", m.domain)
+	if err := m.register(); err != nil {
+		return err
+	}
+
+	certPEM, keyPEM, err := m.obtain()
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(m.certs.keyPath, keyPEM); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(m.certs.certPath, certPEM); err != nil {
+		return err
+	}
+	if err := m.certs.load(); err != nil {
+		return err
+	}
+	log.Printf("acme: installed certificate for %s", m.domain)
+	return nil
+}
+
+func loadOrCreateECKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM data", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (m *acmeManager) jwk() map[string]string {
+	size := (m.key.Curve.Params().BitSize + 7) / 8
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   b64(padBytes(m.key.X.Bytes(), size)),
+		"y":   b64(padBytes(m.key.Y.Bytes(), size)),
+	}
+}
+
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// thumbprint is the RFC 7638 JWK thumbprint of the account key.
+func (m *acmeManager) thumbprint() string {
+	jwk := m.jwk()
+	canonical := fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`, jwk["crv"], jwk["kty"], jwk["x"], jwk["y"])
+	sum := sha256.Sum256([]byte(canonical))
+	return b64(sum[:])
+}
+
+func (m *acmeManager) register() error {
+	if m.kid != "" {
+		return nil
+	}
+
+	key, err := loadOrCreateECKey(filepath.Join(m.cacheDir, "account.key"))
+	if err != nil {
+		return err
+	}
+	m.key = key
+
+	resp, err := m.client.Get(m.dirURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&m.dir); err != nil {
+		return fmt.Errorf("reading directory: %s", err)
+	}
+
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if m.email != "" {
+		account["contact"] = []string{"mailto:" + m.email}
+	}
+	resp, _, err = m.post(m.dir.NewAccount, account, nil)
+	if err != nil {
+		return fmt.Errorf("registering account: %s", err)
+	}
+	m.kid = resp.Header.Get("Location")
+	return nil
+}
+
+func (m *acmeManager) fetchNonce() (string, error) {
+	if m.nonce != "" {
+		nonce := m.nonce
+		m.nonce = ""
+		return nonce, nil
+	}
+	resp, err := m.client.Head(m.dir.NewNonce)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("Replay-Nonce"), nil
+}
+
+func (m *acmeManager) sign(url string, payload interface{}) ([]byte, error) {
+	nonce, err := m.fetchNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	protected := map[string]interface{}{"alg": "ES256", "nonce": nonce, "url": url}
+	if m.kid != "" {
+		protected["kid"] = m.kid
+	} else {
+		protected["jwk"] = m.jwk()
+	}
+	protectedBytes, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+
+	var payloadB64 string
+	if payload != nil {
+		payloadBytes, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		payloadB64 = b64(payloadBytes)
+	}
+
+	signingInput := b64(protectedBytes) + "." + payloadB64
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, m.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := append(padBytes(r.Bytes(), 32), padBytes(s.Bytes(), 32)...)
+
+	return json.Marshal(map[string]string{
+		"protected": b64(protectedBytes),
+		"payload":   payloadB64,
+		"signature": b64(signature),
+	})
+}
+
+// post sends a signed request; a nil payload makes it a POST-as-GET. The
+// response body is decoded into out when given and returned as bytes.
+func (m *acmeManager) post(url string, payload, out interface{}) (*http.Response, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		body, err := m.sign(url, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		resp, err := m.client.Post(url, "application/jose+json", bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		m.nonce = resp.Header.Get("Replay-Nonce")
+
+		if resp.StatusCode >= 400 {
+			var problem acmeProblem
+			json.Unmarshal(respBody, &problem)
+			if problem.Type == "urn:ietf:params:acme:error:badNonce" && attempt < 3 {
+				continue
+			}
+			return nil, nil, fmt.Errorf("%s: %d %s %s", url, resp.StatusCode, problem.Type, problem.Detail)
+		}
+
+		if out != nil {
+			if err := json.Unmarshal(respBody, out); err != nil {
+				return nil, nil, err
+			}
+		}
+		return resp, respBody, nil
+	}
+}
+
+func (m *acmeManager) obtain() ([]byte, []byte, error) {
+	var order acmeOrder
+	resp, _, err := m.post(m.dir.NewOrder, map[string]interface{}{
+		"identifiers": []map[string]string{{"type": "dns", "value": m.domain}},
+	}, &order)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating order: %s", err)
+	}
+	orderURL := resp.Header.Get("Location")
+
+	for _, authzURL := range order.Authorizations {
+		if err := m.authorize(authzURL); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.domain},
+		DNSNames: []string{m.domain},
+	}, certKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, _, err := m.post(order.Finalize, map[string]string{"csr": b64(csr)}, &order); err != nil {
+		return nil, nil, fmt.Errorf("finalizing order: %s", err)
+	}
+
+	for i := 0; order.Status != "valid"; i++ {
+		if order.Status == "invalid" || i >= acmePollAttempts {
+			return nil, nil, fmt.Errorf("order ended in status '%s'", order.Status)
+		}
+		time.Sleep(acmePollInterval)
+		if _, _, err := m.post(orderURL, nil, &order); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	_, certPEM, err := m.post(order.Certificate, nil, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("downloading certificate: %s", err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	return certPEM, keyPEM, nil
+}
+
+func (m *acmeManager) authorize(authzURL string) error {
+	var authz acmeAuthorization
+	if _, _, err := m.post(authzURL, nil, &authz); err != nil {
+		return fmt.Errorf("fetching authorization: %s", err)
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+
+	var challenge *acmeChallenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == "http-01" {
+			challenge = &authz.Challenges[i]
+		}
+	}
+	if challenge == nil {
+		return errors.New("no http-01 challenge offered")
+	}
+
+	m.tokensMux.Lock()
+	m.tokens[challenge.Token] = challenge.Token + "." + m.thumbprint()
+	m.tokensMux.Unlock()
+	defer func() {
+		m.tokensMux.Lock()
+		delete(m.tokens, challenge.Token)
+		m.tokensMux.Unlock()
+	}()
+
+	if _, _, err := m.post(challenge.URL, struct{}{}, nil); err != nil {
+		return fmt.Errorf("accepting challenge: %s", err)
+	}
+
+	for i := 0; authz.Status != "valid"; i++ {
+		if authz.Status == "invalid" || i >= acmePollAttempts {
+			return fmt.Errorf("authorization for %s ended in status '%s'", m.domain, authz.Status)
+		}
+		time.Sleep(acmePollInterval)
+		if _, _, err := m.post(authzURL, nil, &authz); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,388 @@
+package fishes
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	archiveDirName       = "archive"
+	archiveSegmentPrefix = "segment-"
+	archiveSegmentSuffix = ".json.gz"
+)
+
+// archive is the cold tier: fishes nobody has read or written for a while
+// are written to gzipped segments on disk and dropped from memory. They are
+// brought back on the next access by id; lists read them from their
+// segments, leaving them archived.
+// Its state is guarded by the handler lock.
+type archive struct {
+	dir string
+	// index maps archived ids to the segment holding them and is saved with
+	// the snapshot.
+	index      map[string]string
+	segments   map[string]int
+	lastAccess map[string]time.Time
+	keys       *keyring
+
+	rehydrated   uint64
+	lastSweep    time.Time
+	lastArchived int
+}
+
+type archiveStats struct {
+	After        string     `json:"after"`
+	Dir          string     `json:"dir"`
+	Hot          int        `json:"hot"`
+	Archived     int        `json:"archived"`
+	Segments     int        `json:"segments"`
+	SegmentBytes int64      `json:"segment_bytes"`
+	Rehydrated   uint64     `json:"rehydrated"`
+	LastSweep    *time.Time `json:"last_sweep,omitempty"`
+	LastArchived int        `json:"last_archived"`
+}
+
+func newArchive(dataDir string, keys *keyring) *archive {
+	return &archive{
+		dir:        filepath.Join(dataDir, archiveDirName),
+		keys:       keys,
+		index:      map[string]string{},
+		segments:   map[string]int{},
+		lastAccess: map[string]time.Time{},
+	}
+}
+
+func (a *archive) touch(id string, now time.Time) {
+	a.lastAccess[id] = now
+}
+
+// reindex replaces the index, dropping ids that are hot again, and removes
+// segments nothing points to anymore.
+func (a *archive) reindex(index map[string]string, db map[string]Fish) {
+	a.index = map[string]string{}
+	a.segments = map[string]int{}
+	for id, segment := range index {
+		if _, hot := db[id]; hot {
+			continue
+		}
+		a.index[id] = segment
+		a.segments[segment]++
+	}
+
+	entries, err := ioutil.ReadDir(a.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, archiveSegmentPrefix) || a.segments[name] > 0 {
+			continue
+		}
+		if err := os.Remove(filepath.Join(a.dir, name)); err != nil {
+			log.Printf("removing unused archive segment %s failed: %s", name, err)
+		}
+	}
+}
+
+func (a *archive) readSegment(segment string) ([]Fish, error) {
+	data, err := ioutil.ReadFile(filepath.Join(a.dir, segment))
+	if err != nil {
+		return nil, err
+	}
+	if data, err = a.keys.open(data); err != nil {
+		return nil, fmt.Errorf("%s: %s", segment, err)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", segment, err)
+	}
+	var fishes []Fish
+	if err := json.NewDecoder(gz).Decode(&fishes); err != nil {
+		return nil, fmt.Errorf("%s: %s", segment, err)
+	}
+	if err := a.keys.openFishes(fishes); err != nil {
+		return nil, fmt.Errorf("%s: %s", segment, err)
+	}
+	return fishes, nil
+}
+
+func (a *archive) writeSegment(segment string, fishes []Fish) error {
+	if err := os.MkdirAll(a.dir, 0o755); err != nil {
+		return err
+	}
+	fishes, err := a.keys.sealFishes(fishes)
+	if err != nil {
+		return err
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	gz := gzip.NewWriter(buf)
+	if err := json.NewEncoder(gz).Encode(fishes); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	data, err := a.keys.seal(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(a.dir, segment), data)
+}
+
+// reseal writes every segment again under the current key.
+func (a *archive) reseal() error {
+	for segment := range a.segments {
+		fishes, err := a.readSegment(segment)
+		if err == nil {
+			err = a.writeSegment(segment, fishes)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fishes reads every archived fish back from its segment.
+func (a *archive) fishes() ([]Fish, error) {
+	var archived []Fish
+	for segment := range a.segments {
+		fishes, err := a.readSegment(segment)
+		if err != nil {
+			return nil, err
+		}
+		for _, fish := range fishes {
+			if a.index[fish.ID] == segment {
+				archived = append(archived, fish)
+			}
+		}
+	}
+	return archived, nil
+}
+
+// archivedFishes gives the archived fishes for a list or a count, nil
+// without an archive. Callers must hold the lock.
+func (h *fishesHandler) archivedFishes() ([]Fish, error) {
+	if h.archive == nil || len(h.archive.index) == 0 {
+		return nil, nil
+	}
+	return h.archive.fishes()
+}
+
+// archiveCold moves fishes idle since before cutoff to a new segment. Fishes
+// with an expiry stay hot so the expiry sweep still sees them. Callers must
+// hold the lock.
+func (h *fishesHandler) archiveCold(cutoff, now time.Time) (int, error) {
+	a := h.archive
+	var cold []Fish
+	for id, fish := range h.db {
+		last, ok := a.lastAccess[id]
+		if !ok {
+			a.touch(id, now)
+			continue
+		}
+		if fish.ExpiresAt == nil && last.Before(cutoff) {
+			cold = append(cold, fish)
+		}
+	}
+	a.lastSweep = now
+	a.lastArchived = len(cold)
+	return len(cold), h.archiveFishes(cold, now)
+}
+
+// archiveColdest moves the fishes read or written least recently to a new
+// segment until those left in memory take less than target bytes. As with
+// archiveCold, fishes with an expiry stay hot. Callers must hold the lock.
+func (h *fishesHandler) archiveColdest(target int64, now time.Time) (int, error) {
+	a := h.archive
+	var hot []Fish
+	for _, fish := range h.db {
+		if fish.ExpiresAt == nil {
+			hot = append(hot, fish)
+		}
+	}
+	sort.Slice(hot, func(i, j int) bool {
+		return a.lastAccess[hot[i].ID].Before(a.lastAccess[hot[j].ID])
+	})
+
+	var cold []Fish
+	left := h.memoryBytes
+	for _, fish := range hot {
+		if left < target {
+			break
+		}
+		cold = append(cold, fish)
+		left -= int64(len(h.encoded[fish.ID].json))
+	}
+	return len(cold), h.archiveFishes(cold, now)
+}
+
+// archiveFishes writes cold to a new segment and drops them from memory.
+// Callers must hold the lock.
+func (h *fishesHandler) archiveFishes(cold []Fish, now time.Time) error {
+	if len(cold) == 0 {
+		return nil
+	}
+	a := h.archive
+	sortFishes(cold, "id")
+	segment := archiveSegmentPrefix + now.UTC().Format(backupTimeLayout) + archiveSegmentSuffix
+	for a.segments[segment] > 0 {
+		now = now.Add(time.Millisecond)
+		segment = archiveSegmentPrefix + now.UTC().Format(backupTimeLayout) + archiveSegmentSuffix
+	}
+	if err := a.writeSegment(segment, cold); err != nil {
+		return err
+	}
+	for _, fish := range cold {
+		delete(h.db, fish.ID)
+		h.setEncoded(fish.ID, nil)
+		delete(a.lastAccess, fish.ID)
+		a.index[fish.ID] = segment
+	}
+	a.segments[segment] = len(cold)
+	h.bumpVersion()
+	h.dirty = true
+	h.cache.invalidate("fishes")
+	return nil
+}
+
+// rehydrate brings an archived fish back into memory. It is a no-op for
+// fishes that are not archived. Callers must hold the lock.
+func (h *fishesHandler) rehydrate(id string) error {
+	a := h.archive
+	if a == nil {
+		return nil
+	}
+	segment, ok := a.index[id]
+	if !ok {
+		return nil
+	}
+
+	fishes, err := a.readSegment(segment)
+	if err != nil {
+		return err
+	}
+	for _, fish := range fishes {
+		if fish.ID != id {
+			continue
+		}
+		enc, err := encodeFish(fish)
+		if err != nil {
+			return err
+		}
+		h.db[id] = fish
+		h.setEncoded(id, enc)
+		break
+	}
+	if _, ok := h.db[id]; !ok {
+		return fmt.Errorf("fish %s is missing from archive segment %s", id, segment)
+	}
+
+	delete(a.index, id)
+	a.touch(id, h.clock.Now())
+	a.rehydrated++
+	if a.segments[segment]--; a.segments[segment] <= 0 {
+		delete(a.segments, segment)
+		if err := os.Remove(filepath.Join(a.dir, segment)); err != nil {
+			log.Printf("removing archive segment %s failed: %s", segment, err)
+		}
+	}
+	h.bumpVersion()
+	h.dirty = true
+	h.cache.invalidate("fishes")
+	return nil
+}
+
+// fullSnapshot is snapshot with the archived fishes read back in, for
+// everything that must see the whole dataset. Callers must hold the lock.
+func (h *fishesHandler) fullSnapshot() (*snapshot, error) {
+	snap := h.snapshot()
+	if h.archive == nil || len(h.archive.index) == 0 {
+		return snap, nil
+	}
+	archived, err := h.archive.fishes()
+	if err != nil {
+		return nil, err
+	}
+	snap.Fishes = append(snap.Fishes, archived...)
+	snap.Archived = nil
+	sortFishes(snap.Fishes, "id")
+	return snap, nil
+}
+
+// archiveSweepInterval checks at least hourly, and more often when
+// archive_after is shorter than that.
+func (h *fishesHandler) archiveSweepInterval() time.Duration {
+	if after := h.config().ArchiveAfter; after > 0 && after < time.Hour {
+		return after
+	}
+	return time.Hour
+}
+
+func (h *fishesHandler) archiveColdNow() error {
+	after := h.config().ArchiveAfter
+	if after == 0 {
+		return nil
+	}
+	now := h.clock.Now()
+	h.Lock()
+	n, err := h.archiveCold(now.Add(-after), now)
+	h.Unlock()
+	if n > 0 {
+		log.Printf("archived %d cold fishes", n)
+	}
+	return err
+}
+
+func (h *fishesHandler) archiveStats() archiveStats {
+	h.Lock()
+	defer h.Unlock()
+
+	a := h.archive
+	stats := archiveStats{
+		After:        h.config().ArchiveAfter.String(),
+		Dir:          a.dir,
+		Hot:          len(h.db),
+		Archived:     len(a.index),
+		Segments:     len(a.segments),
+		Rehydrated:   a.rehydrated,
+		LastArchived: a.lastArchived,
+	}
+	if !a.lastSweep.IsZero() {
+		lastSweep := a.lastSweep.UTC()
+		stats.LastSweep = &lastSweep
+	}
+	for segment := range a.segments {
+		if info, err := os.Stat(filepath.Join(a.dir, segment)); err == nil {
+			stats.SegmentBytes += info.Size()
+		}
+	}
+	return stats
+}
+
+func (a *adminPortal) archive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	if a.fishes.archive == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("the archive lives in data_dir, set it to enable archiving"))
+		return
+	}
+	writeJSON(w, http.StatusOK, a.fishes.archiveStats())
+}
@@ -0,0 +1,70 @@
+package fishes
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Archived fishes, whether idle for archive_after or evicted for the memory
+// budget, stay in the lists, their counts and the random picks.
+func TestArchivedFishesAreListed(t *testing.T) {
+	tests := []struct {
+		name    string
+		archive func(h *fishesHandler, now time.Time) (int, error)
+	}{
+		{"idle", func(h *fishesHandler, now time.Time) (int, error) {
+			// The first sweep notes the fishes it has not seen yet as used now.
+			first, err := h.archiveCold(now, now)
+			if err != nil {
+				return first, err
+			}
+			second, err := h.archiveCold(now.Add(time.Hour), now.Add(time.Hour))
+			return first + second, err
+		}},
+		{"evicted", func(h *fishesHandler, now time.Time) (int, error) {
+			return h.archiveColdest(1, now)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestFishes(t, systemClock{}, systemRand{})
+			h.archive = newArchive(t.TempDir(), h.keys)
+			mux := testRoutes(h)
+			for _, body := range []string{`{"name":"Nemo","environment":"saltwater"}`, `{"name":"Dory","environment":"saltwater"}`} {
+				if res := serveTest(mux, "POST", "/fishes", "application/json", []byte(body)); res.Code != http.StatusCreated {
+					t.Fatalf("creating: %d %s", res.Code, res.Body)
+				}
+			}
+			h.Lock()
+			n, err := test.archive(h, time.Now())
+			hot := len(h.db)
+			h.Unlock()
+			if err != nil || n != 2 || hot != 0 {
+				t.Fatalf("archived %d, %d left hot, err %v; want all of them archived", n, hot, err)
+			}
+
+			res := serveTest(mux, "GET", "/fishes", "", nil)
+			if res.Code != http.StatusOK || res.Header().Get("X-Total-Count") != "2" {
+				t.Fatalf("GET /fishes: %d, X-Total-Count %q, want 2", res.Code, res.Header().Get("X-Total-Count"))
+			}
+			res = serveTest(mux, "GET", "/fishes?name=Dory", "", nil)
+			var found []Fish
+			if err := json.Unmarshal(res.Body.Bytes(), &found); err != nil || len(found) != 1 || found[0].Name != "Dory" {
+				t.Errorf("GET /fishes?name=Dory: %s", res.Body)
+			}
+			res = serveTest(mux, "GET", "/fishes/random", "", nil)
+			if res.Code != http.StatusFound || !strings.HasPrefix(res.Header().Get("Location"), "/fishes/") {
+				t.Errorf("GET /fishes/random: %d, Location %q", res.Code, res.Header().Get("Location"))
+			}
+			h.Lock()
+			hot = len(h.db)
+			h.Unlock()
+			if hot != 0 {
+				t.Errorf("listing brought %d fishes back into memory", hot)
+			}
+		})
+	}
+}
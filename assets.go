@@ -0,0 +1,99 @@
+package fishes
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"time"
+)
+
+// assetFiles are the stylesheets and scripts of the admin pages and the
+// API explorer, served under /assets/.
+//
+//go:embed assets/*.css assets/*.js
+var assetFiles embed.FS
+
+type asset struct {
+	contentType string
+	// as is the kind of a preload link to the asset.
+	as   string
+	body []byte
+	etag string
+}
+
+var assetTypes = map[string]asset{
+	".css": {contentType: "text/css; charset=utf-8", as: "style"},
+	".js":  {contentType: "text/javascript; charset=utf-8", as: "script"},
+}
+
+var assets = loadAssets()
+
+func loadAssets() map[string]asset {
+	loaded := map[string]asset{}
+	err := fs.WalkDir(assetFiles, "assets", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		a := assetTypes[path.Ext(name)]
+		if a.body, err = assetFiles.ReadFile(name); err != nil {
+			return err
+		}
+		a.etag = contentETag(a.body)
+		loaded["/"+name] = a
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return loaded
+}
+
+// adminPageAssets are the assets each admin page links to.
+var adminPageAssets = map[string][]string{
+	"cluster-status": {"/assets/admin.css"},
+	"slo":            {"/assets/admin.css"},
+	"explorer":       {"/assets/admin.css"},
+	"docs":           {"/assets/docs.css", "/assets/docs.js"},
+}
+
+// sendEarlyHints answers 103 Early Hints with preload links to the assets
+// of the admin page name, so the browser fetches them while the page is
+// put together. The links stay on the page too. HTTP/1.0 clients cannot
+// take informational responses and get none.
+func sendEarlyHints(w http.ResponseWriter, r *http.Request, page string) {
+	if len(adminPageAssets[page]) == 0 || !r.ProtoAtLeast(1, 1) {
+		return
+	}
+	for _, name := range adminPageAssets[page] {
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=preload; as=%s", name, assets[name].as))
+	}
+	w.WriteHeader(http.StatusEarlyHints)
+}
+
+// informational reports whether status is a 1xx sent ahead of the response,
+// which response writers pass on without taking it for the final status.
+// 101 Switching Protocols is final.
+func informational(status int) bool {
+	return status >= 100 && status < 200 && status != http.StatusSwitchingProtocols
+}
+
+func serveAsset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	a, ok := assets[r.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("there is no asset '%s'", path.Base(r.URL.Path))))
+		return
+	}
+	if checkNotModified(w, r, a.etag, time.Time{}) {
+		return
+	}
+	w.Header().Set("Content-Type", a.contentType)
+	w.Write(a.body)
+}
@@ -0,0 +1,135 @@
+(function () {
+  var spec;
+  var methods = ["get", "post", "put", "patch", "delete"];
+
+  function el(tag, attrs, children) {
+    var node = document.createElement(tag);
+    Object.keys(attrs || {}).forEach(function (k) { node.setAttribute(k, attrs[k]); });
+    (children || []).forEach(function (c) {
+      node.appendChild(typeof c === "string" ? document.createTextNode(c) : c);
+    });
+    return node;
+  }
+
+  function resolve(schema) {
+    while (schema && schema.$ref) {
+      schema = spec.components.schemas[schema.$ref.split("/").pop()];
+    }
+    return schema || {};
+  }
+
+  // example builds a value of the schema to start a request body from.
+  function example(schema, depth) {
+    schema = resolve(schema);
+    if (depth > 4) { return null; }
+    if (schema.oneOf) { return example(schema.oneOf[0], depth); }
+    if (schema.enum) { return schema.enum[0]; }
+    switch (schema.type) {
+    case "object":
+      var out = {};
+      // The server sets these, and a timestamp is rarely wanted as it is.
+      Object.keys(schema.properties || {}).forEach(function (name) {
+        var prop = resolve(schema.properties[name]);
+        if (name !== "id" && name !== "slug" && name !== "version" && prop.format !== "date-time") {
+          out[name] = example(prop, depth + 1);
+        }
+      });
+      return out;
+    case "array": return [example(schema.items, depth + 1)];
+    case "integer": case "number": return 0;
+    case "boolean": return false;
+    case "string": return schema.format === "date-time" ? new Date().toISOString() : "";
+    }
+    return null;
+  }
+
+  function show(pre, resp, text) {
+    var lines = [resp.status + " " + resp.statusText];
+    ["content-type", "etag", "location", "retry-after", "x-fish-consistency-token"].forEach(function (h) {
+      if (resp.headers.get(h)) { lines.push(h + ": " + resp.headers.get(h)); }
+    });
+    try { text = JSON.stringify(JSON.parse(text), null, 2); } catch (e) {}
+    pre.textContent = lines.join("\n") + "\n\n" + text;
+  }
+
+  function operation(path, method, op) {
+    var form = el("form");
+    var inputs = [];
+    (op.parameters || []).forEach(function (p) {
+      var input = el("input", {name: p.name, placeholder: p.schema && p.schema.default !== undefined ? String(p.schema.default) : (p.schema && p.schema.enum ? p.schema.enum.join("|") : p.schema ? p.schema.type : "")});
+      inputs.push({param: p, input: input});
+      form.appendChild(el("label", {}, [p.name + (p.in === "path" ? " (path)" : ""), input]));
+    });
+    var ifMatch;
+    if (method === "put" || method === "patch" || method === "delete") {
+      ifMatch = el("input", {placeholder: "ETag from a GET"});
+      form.appendChild(el("label", {}, ["If-Match", ifMatch]));
+    }
+    var body, mediaType;
+    if (op.requestBody) {
+      mediaType = Object.keys(op.requestBody.content)[0];
+      if (/json/.test(mediaType) || /^text\//.test(mediaType)) {
+        body = el("textarea");
+        var schema = op.requestBody.content[mediaType].schema;
+        body.value = /json/.test(mediaType) ? JSON.stringify(example(schema, 0), null, 2) : "";
+      } else {
+        body = el("input", {type: "file"});
+      }
+      form.appendChild(el("label", {}, [mediaType, body]));
+    }
+    var send = el("button", {type: "submit"}, ["Send"]);
+    var result = el("pre");
+    form.appendChild(send);
+    form.appendChild(result);
+
+    form.addEventListener("submit", function (e) {
+      e.preventDefault();
+      var url = path, query = [];
+      inputs.forEach(function (i) {
+        var v = i.input.value;
+        if (i.param.in === "path") {
+          url = url.replace("{" + i.param.name + "}", encodeURIComponent(v));
+        } else if (v !== "") {
+          query.push(encodeURIComponent(i.param.name) + "=" + encodeURIComponent(v));
+        }
+      });
+      if (query.length) { url += "?" + query.join("&"); }
+      var headers = {"Accept": "application/json"};
+      var password = document.getElementById("password").value;
+      if (op.security && password) { headers["Authorization"] = "Basic " + btoa("admin:" + password); }
+      if (ifMatch && ifMatch.value) { headers["If-Match"] = ifMatch.value; }
+      var init = {method: method.toUpperCase(), headers: headers};
+      if (body) {
+        headers["Content-Type"] = mediaType;
+        init.body = body.type === "file" ? body.files[0] : body.value;
+      }
+      result.textContent = "...";
+      fetch(url, init).then(function (resp) {
+        return resp.text().then(function (text) { show(result, resp, text); });
+      }).catch(function (err) { result.textContent = String(err); });
+    });
+    return el("details", {}, [
+      el("summary", {}, [el("span", {"class": "method " + method}, [method.toUpperCase()]), path,
+        el("span", {"class": "summary"}, [op.summary || ""]), op.security ? el("span", {"class": "lock"}, ["\u{1F512}"]) : ""]),
+      form
+    ]);
+  }
+
+  fetch("/openapi.json").then(function (r) { return r.json(); }).then(function (doc) {
+    spec = doc;
+    document.getElementById("title").textContent = doc.info.title + " explorer";
+    document.getElementById("subtitle").textContent = "Version " + doc.info.version + ", from /openapi.json";
+    var container = document.getElementById("paths");
+    Object.keys(doc.paths).sort().forEach(function (path) {
+      var item = doc.paths[path];
+      methods.forEach(function (m) {
+        if (item[m]) { container.appendChild(operation(path, m, item[m])); }
+      });
+      if (item.description) {
+        container.appendChild(el("p", {}, [el("code", {}, [path]), " " + item.description]));
+      }
+    });
+  }).catch(function (err) {
+    document.getElementById("subtitle").textContent = "Could not load /openapi.json: " + err;
+  });
+})();
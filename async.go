@@ -0,0 +1,271 @@
+package fishes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jobPending   = "pending"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// jobResponse collects what a handler run by a worker writes.
+type jobResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (res *jobResponse) Header() http.Header {
+	return res.header
+}
+
+func (res *jobResponse) WriteHeader(status int) {
+	if res.status == 0 && !informational(status) {
+		res.status = status
+	}
+}
+
+func (res *jobResponse) Write(b []byte) (int, error) {
+	if res.status == 0 {
+		res.status = http.StatusOK
+	}
+	return res.body.Write(b)
+}
+
+type asyncResult struct {
+	Status   int             `json:"status"`
+	Location string          `json:"location,omitempty"`
+	Body     json.RawMessage `json:"body,omitempty"`
+	Message  string          `json:"message,omitempty"`
+}
+
+type asyncJob struct {
+	ID          string       `json:"id"`
+	Status      string       `json:"status"`
+	Method      string       `json:"method"`
+	Path        string       `json:"path"`
+	SubmittedAt time.Time    `json:"submitted_at"`
+	FinishedAt  *time.Time   `json:"finished_at,omitempty"`
+	Result      *asyncResult `json:"result,omitempty"`
+	Links       struct {
+		Self   string `json:"self"`
+		Result string `json:"result,omitempty"`
+	} `json:"links"`
+
+	req  *http.Request
+	next http.Handler
+}
+
+// asyncWrites runs mutations sent with "Prefer: respond-async" on a pool of
+// workers, each with the handler of the store it was sent to. The client
+// gets 202 and a /jobs/{id} link right away; finished jobs are kept for ttl
+// so their outcome can be fetched.
+type asyncWrites struct {
+	sync.Mutex
+	clock Clock
+	ids   IDGenerator
+	queue chan *asyncJob
+	jobs  map[string]*asyncJob
+	ttl   func() time.Duration
+	flags *featureFlags
+	// closed is set once drain starts; workers is waited on for the queued
+	// jobs to finish.
+	closed  bool
+	workers sync.WaitGroup
+}
+
+func newAsyncWrites(clock Clock, workers, queue int, ttl func() time.Duration) *asyncWrites {
+	a := &asyncWrites{
+		clock: clock,
+		ids:   uuidGenerator{random: systemRand{}},
+		queue: make(chan *asyncJob, queue),
+		jobs:  map[string]*asyncJob{},
+		ttl:   ttl,
+	}
+	a.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go a.work()
+	}
+	return a
+}
+
+func wantsAsync(r *http.Request) bool {
+	for _, pref := range strings.Split(r.Header.Get("Prefer"), ",") {
+		if strings.TrimSpace(pref) == "respond-async" {
+			return true
+		}
+	}
+	return false
+}
+
+// wrap hands async mutations of /fishes resources to the workers and serves
+// everything else directly.
+func (a *asyncWrites) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" || !wantsAsync(r) ||
+			(r.URL.Path != "/fishes" && !strings.HasPrefix(r.URL.Path, "/fishes/")) ||
+			!a.flags.enabled(r, "async_writes") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		// The job keeps the API version and the path prefix, such as
+		// /t/{tenant}, the request was sent with.
+		ctx := context.WithValue(context.Background(), pathPrefixKey, clientPath(r, ""))
+		if version, ok := r.Context().Value(apiVersionKey).(int); ok {
+			ctx = context.WithValue(ctx, apiVersionKey, version)
+		}
+		req := r.Clone(ctx)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.Header.Del("Prefer")
+		// Results are readable by anyone holding the job id, so they never
+		// show sensitive fields.
+		req.Header.Del("Authorization")
+
+		job := &asyncJob{
+			ID:          a.ids.NewID(),
+			Status:      jobPending,
+			Method:      r.Method,
+			Path:        clientPath(r, r.URL.RequestURI()),
+			SubmittedAt: a.clock.Now().UTC(),
+			req:         req,
+			next:        next,
+		}
+		job.Links.Self = clientPath(r, "/jobs/"+job.ID)
+
+		a.Lock()
+		if a.closed {
+			a.Unlock()
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("server is shutting down"))
+			return
+		}
+		select {
+		case a.queue <- job:
+			a.jobs[job.ID] = job
+		default:
+			a.Unlock()
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("the async write queue is full, retry later"))
+			return
+		}
+		body, _ = json.Marshal(job)
+		a.Unlock()
+
+		w.Header().Set("Location", "/jobs/"+job.ID)
+		w.Header().Set("Preference-Applied", "respond-async")
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(body)
+	})
+}
+
+func (a *asyncWrites) work() {
+	defer a.workers.Done()
+	for job := range a.queue {
+		a.Lock()
+		job.Status = jobRunning
+		a.Unlock()
+
+		res := &jobResponse{header: http.Header{}}
+		job.next.ServeHTTP(res, job.req)
+
+		result := &asyncResult{Status: res.status, Location: res.header.Get("Location")}
+		if strings.HasPrefix(result.Location, "/") {
+			result.Location = clientPath(job.req, result.Location)
+		}
+		if json.Valid(res.body.Bytes()) {
+			result.Body = json.RawMessage(res.body.Bytes())
+		} else if res.body.Len() > 0 {
+			result.Message = res.body.String()
+		}
+
+		now := a.clock.Now().UTC()
+		a.Lock()
+		job.req, job.next = nil, nil
+		job.Result = result
+		job.FinishedAt = &now
+		job.Status = jobSucceeded
+		if res.status >= 400 {
+			job.Status = jobFailed
+		}
+		switch {
+		case result.Location != "":
+			job.Links.Result = result.Location
+		case job.Status == jobSucceeded && job.Method != "DELETE":
+			job.Links.Result = strings.SplitN(job.Path, "?", 2)[0]
+		}
+		a.Unlock()
+	}
+}
+
+// drain stops accepting async writes and waits for the queued ones.
+func (a *asyncWrites) drain() error {
+	a.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+	a.Unlock()
+	a.workers.Wait()
+	return nil
+}
+
+// expire forgets jobs that finished more than ttl ago.
+func (a *asyncWrites) expire() error {
+	cutoff := a.clock.Now().Add(-a.ttl())
+	a.Lock()
+	for id, job := range a.jobs {
+		if job.FinishedAt != nil && job.FinishedAt.Before(cutoff) {
+			delete(a.jobs, id)
+		}
+	}
+	a.Unlock()
+	return nil
+}
+
+func (a *asyncWrites) status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+
+	a.Lock()
+	job, ok := a.jobs[strings.TrimPrefix(r.URL.Path, "/jobs/")]
+	var body []byte
+	if ok {
+		body, _ = json.Marshal(job)
+	}
+	a.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("Cache-Control", cacheControlRevalidate)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
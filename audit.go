@@ -0,0 +1,173 @@
+package fishes
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const maxAuthEvents = 10000
+
+var authAttempts = newCounterVec("fishes_auth_attempts_total", "Authentication attempts with admin credentials by outcome.", "outcome")
+
+var authAuditParams = []paramSpec{
+	{name: "ip", kind: paramString},
+	{name: "principal", kind: paramString},
+	{name: "outcome", kind: paramEnum, values: []string{"success", "failure"}},
+	{name: "since", kind: paramString},
+	{name: "limit", kind: paramInt, min: 1, max: maxAuthEvents, def: "100"},
+}
+
+type authEvent struct {
+	At        time.Time `json:"at"`
+	Principal string    `json:"principal"`
+	IP        string    `json:"ip"`
+	Success   bool      `json:"success"`
+	Path      string    `json:"path"`
+}
+
+type authAlert struct {
+	Alert    string    `json:"alert"`
+	IP       string    `json:"ip"`
+	Failures int       `json:"failures"`
+	Window   string    `json:"window"`
+	At       time.Time `json:"at"`
+}
+
+// authAudit keeps the authentication events of the last auth_audit_window
+// in memory and raises an alert when one address fails too often.
+type authAudit struct {
+	sync.Mutex
+	events  []authEvent
+	alerted map[string]time.Time
+	client  *http.Client
+}
+
+func newAuthAudit() *authAudit {
+	return &authAudit{alerted: map[string]time.Time{}, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// record logs an attempt with credentials. Requests without any are not
+// attempts and are not recorded.
+func (a *authAudit) record(cfg *Config, r *http.Request, principal string, success bool, at time.Time) {
+	ev := authEvent{At: at.UTC(), Principal: principal, IP: clientIP(r), Success: success, Path: r.URL.Path}
+	outcome := "failure"
+	if success {
+		outcome = "success"
+	}
+	log.Printf("auth %s for %q from %s on %s", outcome, ev.Principal, ev.IP, ev.Path)
+	authAttempts.inc(outcome)
+
+	a.Lock()
+	a.events = append(a.events, ev)
+	a.trim(ev.At.Add(-cfg.AuthAuditWindow))
+	alert := a.check(cfg, ev)
+	a.Unlock()
+
+	if alert != nil {
+		log.Printf("ALERT: %d failed logins from %s in the last %s", alert.Failures, alert.IP, alert.Window)
+		if cfg.AuthAlertWebhook != "" {
+			go a.notify(cfg.AuthAlertWebhook, alert)
+		}
+	}
+}
+
+// trim drops events older than cutoff and past maxAuthEvents. Callers must
+// hold the lock.
+func (a *authAudit) trim(cutoff time.Time) {
+	drop := 0
+	for drop < len(a.events) && (a.events[drop].At.Before(cutoff) || len(a.events)-drop > maxAuthEvents) {
+		drop++
+	}
+	if drop > 0 {
+		a.events = append(a.events[:0], a.events[drop:]...)
+	}
+	for ip, at := range a.alerted {
+		if at.Before(cutoff) {
+			delete(a.alerted, ip)
+		}
+	}
+}
+
+// check returns an alert when ev pushed the failures from its address over
+// auth_alert_threshold. An address alerts at most once per window. Callers
+// must hold the lock.
+func (a *authAudit) check(cfg *Config, ev authEvent) *authAlert {
+	if ev.Success || cfg.AuthAlertThreshold == 0 {
+		return nil
+	}
+	since := ev.At.Add(-cfg.AuthAlertWindow)
+	if last, ok := a.alerted[ev.IP]; ok && last.After(since) {
+		return nil
+	}
+
+	failures := 0
+	for i := len(a.events) - 1; i >= 0 && !a.events[i].At.Before(since); i-- {
+		if !a.events[i].Success && a.events[i].IP == ev.IP {
+			failures++
+		}
+	}
+	if failures < cfg.AuthAlertThreshold {
+		return nil
+	}
+	a.alerted[ev.IP] = ev.At
+	return &authAlert{Alert: "auth_failures", IP: ev.IP, Failures: failures, Window: cfg.AuthAlertWindow.String(), At: ev.At}
+}
+
+func (a *authAudit) notify(url string, alert *authAlert) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		log.Printf("auth alert webhook failed: %s", err)
+		return
+	}
+	resp, err := a.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("auth alert webhook failed: %s", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("auth alert webhook answered %s", resp.Status)
+	}
+}
+
+// auditAuth lists recorded authentication events, newest first.
+func (a *adminPortal) auditAuth(w http.ResponseWriter, r *http.Request, q queryValues) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+
+	var since time.Time
+	if raw := q.str("since"); raw != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, raw); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("parameter 'since' must be an RFC 3339 time"))
+			return
+		}
+	}
+
+	audit := a.fishes.audit
+	audit.Lock()
+	events := []authEvent{}
+	for i := len(audit.events) - 1; i >= 0 && len(events) < q.int("limit"); i-- {
+		ev := audit.events[i]
+		if ev.At.Before(since) {
+			break
+		}
+		if (q.str("ip") != "" && ev.IP != q.str("ip")) ||
+			(q.str("principal") != "" && ev.Principal != q.str("principal")) ||
+			(q.str("outcome") != "" && ev.Success != (q.str("outcome") == "success")) {
+			continue
+		}
+		events = append(events, ev)
+	}
+	audit.Unlock()
+
+	writeJSON(w, http.StatusOK, events)
+}
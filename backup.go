@@ -0,0 +1,250 @@
+package fishes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	backupPrefix     = "fishes-backup-"
+	backupSuffix     = ".tar.gz"
+	backupTimeLayout = "20060102T150405.000Z"
+)
+
+type backupInfo struct {
+	Name      string    `json:"name"`
+	Bytes     int64     `json:"bytes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type backupStatus struct {
+	Dir        string       `json:"dir"`
+	Interval   string       `json:"interval"`
+	Retain     int          `json:"retain"`
+	MaxAge     string       `json:"max_age,omitempty"`
+	LastRun    *time.Time   `json:"last_run,omitempty"`
+	LastBackup *backupInfo  `json:"last_backup,omitempty"`
+	LastError  string       `json:"last_error,omitempty"`
+	Remote     string       `json:"remote,omitempty"`
+	LastUpload *backupInfo  `json:"last_upload,omitempty"`
+	UploadErr  string       `json:"last_upload_error,omitempty"`
+	Backups    []backupInfo `json:"backups"`
+}
+
+// backupScheduler periodically writes the export archive to dir and prunes
+// old archives so that only the retain newest, and none older than maxAge,
+// are kept. When remote is set every new archive is also pushed there.
+type backupScheduler struct {
+	sync.Mutex
+	dir      string
+	interval time.Duration
+	retain   int
+	maxAge   time.Duration
+	h        *fishesHandler
+	remote   *s3Uploader
+
+	lastRun    time.Time
+	lastBackup *backupInfo
+	lastErr    error
+	lastUpload *backupInfo
+	uploadErr  error
+}
+
+func newBackupScheduler(cfg *Config, h *fishesHandler) (*backupScheduler, error) {
+	if err := os.MkdirAll(cfg.BackupDir, 0o755); err != nil {
+		return nil, err
+	}
+	b := &backupScheduler{
+		dir:      cfg.BackupDir,
+		interval: cfg.BackupInterval,
+		retain:   cfg.BackupRetain,
+		maxAge:   cfg.BackupMaxAge,
+		h:        h,
+	}
+	if cfg.BackupS3Endpoint != "" {
+		remote, err := newS3Uploader(cfg)
+		if err != nil {
+			return nil, err
+		}
+		b.remote = remote
+	}
+	return b, nil
+}
+
+func (b *backupScheduler) write(now time.Time) (*backupInfo, []byte, error) {
+	sections, version, err := b.h.exportSections()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := writeExportArchive(&buf, sections, version, now); err != nil {
+		return nil, nil, err
+	}
+
+	name := backupPrefix + now.Format(backupTimeLayout) + backupSuffix
+	if err := writeFileAtomic(filepath.Join(b.dir, name), buf.Bytes()); err != nil {
+		return nil, nil, err
+	}
+	return &backupInfo{Name: name, Bytes: int64(buf.Len()), CreatedAt: now}, buf.Bytes(), nil
+}
+
+// list returns the backups in dir, newest first. Files that do not look like
+// backups are left alone.
+func (b *backupScheduler) list() ([]backupInfo, error) {
+	entries, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []backupInfo{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+		created, err := time.Parse(backupTimeLayout, strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix))
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backupInfo{Name: name, Bytes: entry.Size(), CreatedAt: created})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt.After(backups[j].CreatedAt) })
+	return backups, nil
+}
+
+func (b *backupScheduler) prune(now time.Time) error {
+	backups, err := b.list()
+	if err != nil {
+		return err
+	}
+	for i, backup := range backups {
+		if i < b.retain && (b.maxAge == 0 || now.Sub(backup.CreatedAt) <= b.maxAge) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(b.dir, backup.Name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// backup writes a new archive, pushes it to the remote and prunes old local
+// ones. Concurrent calls are serialized so a manual backup never races the
+// scheduled one. A failed push is reported in the status but does not fail
+// the backup, which is still safe on disk; ctx, the request of a manual
+// backup, cancels the push.
+func (b *backupScheduler) backup(ctx context.Context) (*backupInfo, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	info, data, err := b.write(now)
+	if err == nil && b.remote != nil {
+		b.uploadErr = b.remote.upload(ctx, info.Name, data)
+		if b.uploadErr != nil {
+			log.Printf("backup push to %s failed: %s", b.remote, b.uploadErr)
+		} else {
+			b.lastUpload = info
+		}
+	}
+	if err == nil {
+		err = b.prune(now)
+	}
+
+	b.lastRun = now
+	b.lastErr = err
+	if info != nil {
+		b.lastBackup = info
+	}
+	return info, err
+}
+
+func (b *backupScheduler) status() (*backupStatus, error) {
+	backups, err := b.list()
+	if err != nil {
+		return nil, err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	status := &backupStatus{
+		Dir:        b.dir,
+		Interval:   b.interval.String(),
+		Retain:     b.retain,
+		LastBackup: b.lastBackup,
+		Backups:    backups,
+	}
+	if b.maxAge > 0 {
+		status.MaxAge = b.maxAge.String()
+	}
+	if !b.lastRun.IsZero() {
+		lastRun := b.lastRun
+		status.LastRun = &lastRun
+	}
+	if b.lastErr != nil {
+		status.LastError = b.lastErr.Error()
+	}
+	if b.remote != nil {
+		status.Remote = b.remote.String()
+		status.LastUpload = b.lastUpload
+		if b.uploadErr != nil {
+			status.UploadErr = b.uploadErr.Error()
+		}
+	}
+	return status, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// backups reports the backup status on GET and takes a backup right away on
+// POST.
+func (a *adminPortal) backups(w http.ResponseWriter, r *http.Request) {
+	if a.backupScheduler == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("backups are disabled, set backup_dir to enable them"))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		status, err := a.backupScheduler.status()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	case "POST":
+		info, err := a.backupScheduler.backup(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		writeJSON(w, http.StatusCreated, info)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+	}
+}
@@ -0,0 +1,97 @@
+package fishes
+
+// Benchmarks of the fish routes, run against the handlers in process:
+//
+//	go test -run '^$' -bench . -benchmem
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// benchHandlers are what the benchmarks run against: the server as
+// NewHandler assembles it, middleware and data_dir included, and the bare
+// fish routes as a baseline, so the cost of the chain shows as the
+// difference.
+var benchHandlers = []struct {
+	name string
+	new  func(b *testing.B) http.Handler
+}{
+	{"server", func(b *testing.B) http.Handler { return newTestServer(b, false, nil) }},
+	{"bare", func(b *testing.B) http.Handler { return newTestHandler(b, systemClock{}, systemRand{}) }},
+}
+
+// fillBenchHandler adds n fishes to h, giving the path of the first.
+func fillBenchHandler(b *testing.B, h http.Handler, n int) string {
+	var first string
+	for i := 0; i < n; i++ {
+		res := serveTest(h, "POST", "/fishes", "application/json", []byte(fmt.Sprintf(`{"name":"Fish %d","environment":"saltwater","max_length_cm":%d}`, i, i%100+1)))
+		if res.Code != http.StatusCreated {
+			b.Fatalf("creating fish %d: %d %s", i, res.Code, res.Body)
+		}
+		if first == "" {
+			first = res.Header().Get("Location")
+		}
+	}
+	if first == "" {
+		b.Fatal("the first fish has no Location")
+	}
+	return first
+}
+
+func BenchmarkListFishes(b *testing.B) {
+	for _, bh := range benchHandlers {
+		b.Run(bh.name, func(b *testing.B) {
+			h := bh.new(b)
+			fillBenchHandler(b, h, 1000)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				res := serveTest(h, "GET", "/fishes?limit=100", "", nil)
+				if res.Code != http.StatusOK {
+					b.Fatalf("GET /fishes: %d %s", res.Code, res.Body)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCreateFish(b *testing.B) {
+	for _, bh := range benchHandlers {
+		b.Run(bh.name, func(b *testing.B) {
+			h := bh.new(b)
+			// Names of their own keep the slugs from colliding, which costs
+			// more the more fishes share the name.
+			bodies := make([][]byte, b.N)
+			for i := range bodies {
+				bodies[i] = []byte(fmt.Sprintf(`{"name":"Fish %d","environment":"saltwater","max_length_cm":11}`, i))
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				res := serveTest(h, "POST", "/fishes", "application/json", bodies[i])
+				if res.Code != http.StatusCreated {
+					b.Fatalf("POST /fishes: %d %s", res.Code, res.Body)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetFish(b *testing.B) {
+	for _, bh := range benchHandlers {
+		b.Run(bh.name, func(b *testing.B) {
+			h := bh.new(b)
+			path := fillBenchHandler(b, h, 1000)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				res := serveTest(h, "GET", path, "", nil)
+				if res.Code != http.StatusOK {
+					b.Fatalf("GET %s: %d %s", path, res.Code, res.Body)
+				}
+			}
+		})
+	}
+}
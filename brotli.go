@@ -0,0 +1,469 @@
+package fishes
+
+import (
+	"io"
+	"math/bits"
+	"sort"
+)
+
+// brotliWriter compresses to a Brotli stream (RFC 7932). Each meta-block
+// has one block type per category and one prefix code each for literals,
+// insert-and-copy lengths and distances; a meta-block that would not
+// shrink is stored instead.
+type brotliWriter struct {
+	w   io.Writer
+	buf []byte
+	bw  bitWriter
+	err error
+}
+
+const (
+	brotliBlockSize = 1 << 17
+	// brotliWindowBits is the WBITS of the stream header, a 4 MiB window.
+	brotliWindowBits = 22
+
+	brotliLiteralBits  = 8
+	brotliCommandBits  = 10
+	brotliDistanceBits = 6
+	brotliCommands     = 704
+	brotliDistances    = 64
+)
+
+var (
+	brotliInsertBaselines = []uint32{
+		0, 1, 2, 3, 4, 5, 6, 8, 10, 14, 18, 26, 34, 50, 66, 98,
+		130, 194, 322, 578, 1090, 2114, 6210, 22594,
+	}
+	brotliInsertBits = []uint{
+		0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5,
+		6, 7, 8, 9, 10, 12, 14, 24,
+	}
+	brotliCopyBaselines = []uint32{
+		2, 3, 4, 5, 6, 7, 8, 9, 10, 12, 14, 18, 22, 30, 38, 54,
+		70, 102, 134, 198, 326, 582, 1094, 2118,
+	}
+	brotliCopyBits = []uint{
+		0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4,
+		5, 5, 6, 7, 8, 9, 10, 24,
+	}
+	// brotliCommandCells are the first insert-and-copy codes of each pair
+	// of insert and copy code ranges, by range, for commands that send
+	// their distance.
+	brotliCommandCells = [3][3]int{{128, 192, 384}, {256, 320, 512}, {448, 576, 640}}
+
+	brotliCodeLengthOrder = []int{1, 2, 3, 4, 0, 5, 17, 6, 16, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	// The code lengths of the code length code are sent with this fixed
+	// code, by length.
+	brotliCodeLengthCodes = []uint32{0, 7, 3, 2, 1, 15}
+	brotliCodeLengthSizes = []uint{2, 4, 3, 2, 2, 4}
+)
+
+func newBrotliWriter(w io.Writer) *brotliWriter {
+	b := &brotliWriter{w: w}
+	b.bw.write(1|(brotliWindowBits-17)<<1, 4)
+	return b
+}
+
+func (b *brotliWriter) Write(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	b.buf = append(b.buf, p...)
+	for len(b.buf) > brotliBlockSize {
+		b.metaBlock(b.buf[:brotliBlockSize])
+		b.buf = append(b.buf[:0], b.buf[brotliBlockSize:]...)
+	}
+	return len(p), b.err
+}
+
+// Close writes what is left and the empty last meta-block ending the stream.
+func (b *brotliWriter) Close() error {
+	if b.err != nil {
+		return b.err
+	}
+	if len(b.buf) > 0 {
+		b.metaBlock(b.buf)
+		b.buf = nil
+	}
+	if b.err == nil {
+		b.bw.write(3, 2)
+		_, b.err = b.w.Write(b.bw.close())
+	}
+	return b.err
+}
+
+func (b *brotliWriter) metaBlock(src []byte) {
+	compressed := bitWriter{acc: b.bw.acc, used: b.bw.used}
+	brotliMetaBlockHeader(&compressed, len(src), false)
+	brotliCompress(&compressed, src)
+	if len(compressed.out) < len(src) {
+		b.bw = compressed
+	} else {
+		brotliMetaBlockHeader(&b.bw, len(src), true)
+		b.bw.close()
+		b.bw.out = append(b.bw.out, src...)
+	}
+	_, b.err = b.w.Write(b.bw.out)
+	b.bw.out = b.bw.out[:0]
+}
+
+func brotliMetaBlockHeader(bw *bitWriter, n int, uncompressed bool) {
+	nibbles := uint(4)
+	for n-1 >= 1<<(4*nibbles) {
+		nibbles++
+	}
+	bw.write(0, 1)
+	bw.write(uint32(nibbles-4), 2)
+	bw.write(uint32(n-1), 4*nibbles)
+	if uncompressed {
+		bw.write(1, 1)
+		return
+	}
+	bw.write(0, 1)
+	// One block type each for literals, commands and distances, no postfix
+	// or direct distance codes, and one prefix code each.
+	bw.write(0, 3)
+	bw.write(0, 6)
+	bw.write(0, 2)
+	bw.write(0, 2)
+}
+
+// brotliCommand inserts the literals before a match and copies it; the
+// last one of a meta-block may insert only.
+type brotliCommand struct {
+	insert, copy extraCode
+	code         int
+	distance     extraCode
+}
+
+// brotliDistanceCode codes a distance with no postfix or direct codes.
+func brotliDistanceCode(distance int) extraCode {
+	v := uint32(distance + 3)
+	n := uint(bits.Len32(v) - 2)
+	high := (v >> n) & 1
+	return extraCode{symbol: uint8(16 + 2*(n-1) + uint(high)), extra: v - (2+high)<<n, extraBits: n}
+}
+
+func newBrotliCommand(insert, copy int) brotliCommand {
+	c := brotliCommand{
+		insert: lengthCode(uint32(insert), brotliInsertBaselines, brotliInsertBits),
+		copy:   lengthCode(uint32(copy), brotliCopyBaselines, brotliCopyBits),
+	}
+	c.code = brotliCommandCells[c.insert.symbol>>3][c.copy.symbol>>3] | int(c.insert.symbol&7)<<3 | int(c.copy.symbol&7)
+	return c
+}
+
+func brotliCompress(bw *bitWriter, src []byte) {
+	seqs := lzParse(src, brotliBlockSize, brotliBlockSize)
+	commands := make([]brotliCommand, 0, len(seqs)+1)
+	literalCounts := make([]uint32, 1<<brotliLiteralBits)
+	commandCounts := make([]uint32, brotliCommands)
+	distanceCounts := make([]uint32, brotliDistances)
+	pos := 0
+	for _, s := range seqs {
+		c := newBrotliCommand(s.litLen, s.matchLen)
+		c.distance = brotliDistanceCode(s.offset)
+		distanceCounts[c.distance.symbol]++
+		commands = append(commands, c)
+		pos += s.litLen + s.matchLen
+	}
+	if pos < len(src) {
+		commands = append(commands, newBrotliCommand(len(src)-pos, 2))
+	}
+	for _, c := range commands {
+		commandCounts[c.code]++
+	}
+	pos = 0
+	for _, s := range seqs {
+		for _, lit := range src[pos : pos+s.litLen] {
+			literalCounts[lit]++
+		}
+		pos += s.litLen + s.matchLen
+	}
+	for _, lit := range src[pos:] {
+		literalCounts[lit]++
+	}
+
+	literals := brotliPrefixCode(bw, literalCounts, brotliLiteralBits)
+	cmds := brotliPrefixCode(bw, commandCounts, brotliCommandBits)
+	distances := brotliPrefixCode(bw, distanceCounts, brotliDistanceBits)
+
+	pos = 0
+	for i, c := range commands {
+		cmds.write(bw, c.code)
+		bw.write(c.insert.extra, c.insert.extraBits)
+		bw.write(c.copy.extra, c.copy.extraBits)
+		insert := len(src) - pos
+		if i < len(seqs) {
+			insert = seqs[i].litLen
+		}
+		for _, lit := range src[pos : pos+insert] {
+			literals.write(bw, int(lit))
+		}
+		pos += insert
+		if i < len(seqs) {
+			distances.write(bw, int(c.distance.symbol))
+			bw.write(c.distance.extra, c.distance.extraBits)
+			pos += seqs[i].matchLen
+		}
+	}
+}
+
+// prefixCode is a canonical prefix code, its codes bit reversed to be
+// written from their most significant bit.
+type prefixCode struct {
+	lengths []uint8
+	codes   []uint32
+}
+
+func (p prefixCode) write(bw *bitWriter, symbol int) {
+	bw.write(p.codes[symbol], uint(p.lengths[symbol]))
+}
+
+func newPrefixCode(lengths []uint8) prefixCode {
+	var count, next [16]uint32
+	for _, l := range lengths {
+		if l > 0 {
+			count[l]++
+		}
+	}
+	code := uint32(0)
+	for l := 1; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	p := prefixCode{lengths: lengths, codes: make([]uint32, len(lengths))}
+	for s, l := range lengths {
+		if l > 0 {
+			p.codes[s] = bits.Reverse32(next[l]) >> (32 - l)
+			next[l]++
+		}
+	}
+	return p
+}
+
+// huffmanLengths gives the code lengths of a Huffman code for counts, none
+// longer than maxBits: the smallest counts are raised until the tree is
+// shallow enough. A single symbol still gets one bit.
+func huffmanLengths(counts []uint32, maxBits uint8) []uint8 {
+	type node struct {
+		count       uint32
+		left, right int
+		symbol      int
+	}
+	lengths := make([]uint8, len(counts))
+	for floor := uint32(1); ; floor *= 2 {
+		var nodes []node
+		for s, c := range counts {
+			if c > 0 {
+				if c < floor {
+					c = floor
+				}
+				nodes = append(nodes, node{count: c, left: -1, right: -1, symbol: s})
+			}
+		}
+		switch len(nodes) {
+		case 0:
+			return lengths
+		case 1:
+			lengths[nodes[0].symbol] = 1
+			return lengths
+		}
+		sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].count < nodes[j].count })
+
+		leaves := len(nodes)
+		leaf, inner := 0, leaves
+		smallest := func() int {
+			if leaf < leaves && (inner >= len(nodes) || nodes[leaf].count <= nodes[inner].count) {
+				leaf++
+				return leaf - 1
+			}
+			inner++
+			return inner - 1
+		}
+		for i := 1; i < leaves; i++ {
+			a := smallest()
+			b := smallest()
+			nodes = append(nodes, node{count: nodes[a].count + nodes[b].count, left: a, right: b})
+		}
+
+		depths := make([]uint8, len(nodes))
+		deepest := uint8(0)
+		for i := len(nodes) - 1; i >= 0; i-- {
+			if n := nodes[i]; n.left >= 0 {
+				depths[n.left], depths[n.right] = depths[i]+1, depths[i]+1
+			} else {
+				lengths[n.symbol] = depths[i]
+				if depths[i] > deepest {
+					deepest = depths[i]
+				}
+			}
+		}
+		if deepest <= maxBits {
+			return lengths
+		}
+	}
+}
+
+// brotliPrefixCode writes the prefix code of counts, in the simple form for
+// up to four symbols and as run-length coded code lengths otherwise.
+func brotliPrefixCode(bw *bitWriter, counts []uint32, alphabetBits uint) prefixCode {
+	var used []int
+	for s, c := range counts {
+		if c > 0 {
+			used = append(used, s)
+		}
+	}
+	if len(used) == 0 {
+		used = []int{0}
+	}
+	lengths := huffmanLengths(counts, 15)
+
+	if len(used) <= 4 {
+		if len(used) == 1 {
+			lengths[used[0]] = 0
+		}
+		sort.SliceStable(used, func(i, j int) bool { return lengths[used[i]] < lengths[used[j]] })
+		bw.write(1, 2)
+		bw.write(uint32(len(used)-1), 2)
+		for _, s := range used {
+			bw.write(uint32(s), alphabetBits)
+		}
+		if len(used) == 4 {
+			if lengths[used[0]] == 1 {
+				bw.write(1, 1)
+			} else {
+				bw.write(0, 1)
+			}
+		}
+		return newPrefixCode(lengths)
+	}
+
+	end := len(lengths)
+	for lengths[end-1] == 0 {
+		end--
+	}
+	var tokens []brotliToken
+	previous := uint8(8)
+	for i := 0; i < end; {
+		value, reps := lengths[i], 1
+		for i+reps < end && lengths[i+reps] == value {
+			reps++
+		}
+		if value == 0 {
+			tokens = brotliZeroRun(tokens, reps)
+		} else {
+			tokens = brotliLengthRun(tokens, previous, value, reps)
+			previous = value
+		}
+		i += reps
+	}
+
+	tokenCounts := make([]uint32, 18)
+	for _, t := range tokens {
+		tokenCounts[t.symbol]++
+	}
+	tokenLengths := huffmanLengths(tokenCounts, 5)
+	distinct := 0
+	for _, c := range tokenCounts {
+		if c > 0 {
+			distinct++
+		}
+	}
+
+	stored := len(brotliCodeLengthOrder)
+	for distinct > 1 && tokenLengths[brotliCodeLengthOrder[stored-1]] == 0 {
+		stored--
+	}
+	skip := 0
+	if tokenLengths[brotliCodeLengthOrder[0]] == 0 && tokenLengths[brotliCodeLengthOrder[1]] == 0 {
+		skip = 2
+		if tokenLengths[brotliCodeLengthOrder[2]] == 0 {
+			skip = 3
+		}
+	}
+	bw.write(uint32(skip), 2)
+	for _, symbol := range brotliCodeLengthOrder[skip:stored] {
+		l := tokenLengths[symbol]
+		bw.write(brotliCodeLengthCodes[l], brotliCodeLengthSizes[l])
+	}
+	// A code length code of a single symbol takes no bits to read it.
+	if distinct == 1 {
+		for s := range tokenLengths {
+			tokenLengths[s] = 0
+		}
+	}
+
+	tokenCode := newPrefixCode(tokenLengths)
+	for _, t := range tokens {
+		tokenCode.write(bw, int(t.symbol))
+		switch t.symbol {
+		case 16:
+			bw.write(t.extra, 2)
+		case 17:
+			bw.write(t.extra, 3)
+		}
+	}
+	return newPrefixCode(lengths)
+}
+
+// brotliToken is one code length, or 16 repeating the previous non-zero
+// one and 17 repeating zero, which multiply when they follow each other.
+type brotliToken struct {
+	symbol uint8
+	extra  uint32
+}
+
+func brotliZeroRun(tokens []brotliToken, reps int) []brotliToken {
+	if reps == 11 {
+		tokens = append(tokens, brotliToken{})
+		reps--
+	}
+	if reps < 3 {
+		for ; reps > 0; reps-- {
+			tokens = append(tokens, brotliToken{})
+		}
+		return tokens
+	}
+	start := len(tokens)
+	for reps -= 3; ; reps-- {
+		tokens = append(tokens, brotliToken{symbol: 17, extra: uint32(reps & 7)})
+		if reps >>= 3; reps == 0 {
+			break
+		}
+	}
+	reverseTokens(tokens[start:])
+	return tokens
+}
+
+func brotliLengthRun(tokens []brotliToken, previous, value uint8, reps int) []brotliToken {
+	if previous != value {
+		tokens = append(tokens, brotliToken{symbol: value})
+		reps--
+	}
+	if reps == 7 {
+		tokens = append(tokens, brotliToken{symbol: value})
+		reps--
+	}
+	if reps < 3 {
+		for ; reps > 0; reps-- {
+			tokens = append(tokens, brotliToken{symbol: value})
+		}
+		return tokens
+	}
+	start := len(tokens)
+	for reps -= 3; ; reps-- {
+		tokens = append(tokens, brotliToken{symbol: 16, extra: uint32(reps & 3)})
+		if reps >>= 2; reps == 0 {
+			break
+		}
+	}
+	reverseTokens(tokens[start:])
+	return tokens
+}
+
+func reverseTokens(tokens []brotliToken) {
+	for i, j := 0, len(tokens)-1; i < j; i, j = i+1, j-1 {
+		tokens[i], tokens[j] = tokens[j], tokens[i]
+	}
+}
@@ -0,0 +1,174 @@
+package fishes
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxCachedResponsesPerResource = 1000
+
+var defaultCacheTTLs = map[string]time.Duration{
+	"/fishes":       5 * time.Second,
+	"/fishes/{id}":  0,
+	"/environments": time.Hour,
+}
+
+var cacheRequests = newCounterVec("fishes_response_cache_requests_total", "Response cache lookups by route and result.", "route", "result")
+
+type cachedResponse struct {
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+type responseCache struct {
+	sync.Mutex
+	entries     map[string]map[string]*cachedResponse
+	generations map[string]uint64
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{
+		entries:     map[string]map[string]*cachedResponse{},
+		generations: map[string]uint64{},
+	}
+}
+
+func (c *responseCache) invalidate(resource string) {
+	c.Lock()
+	delete(c.entries, resource)
+	c.generations[resource]++
+	c.Unlock()
+}
+
+func (c *responseCache) generation(resource string) uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.generations[resource]
+}
+
+func (c *responseCache) get(resource, key string, now time.Time) (*cachedResponse, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	entry, ok := c.entries[resource][key]
+	if !ok {
+		return nil, false
+	}
+	if now.After(entry.expires) {
+		delete(c.entries[resource], key)
+		return nil, false
+	}
+	return entry, true
+}
+
+// set stores entry unless resource was invalidated since generation was read.
+func (c *responseCache) set(resource, key string, generation uint64, entry *cachedResponse) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.generations[resource] != generation {
+		return
+	}
+
+	entries, ok := c.entries[resource]
+	if !ok {
+		entries = map[string]*cachedResponse{}
+		c.entries[resource] = entries
+	}
+	if len(entries) >= maxCachedResponsesPerResource {
+		return
+	}
+	entries[key] = entry
+}
+
+// wrap caches successful GET responses of next under resource, keyed by
+// path, query, Accept header and language. A ttl of zero disables caching for the route.
+func (c *responseCache) wrap(route, resource string, ttl time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	if ttl <= 0 {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Authorized requests may see sensitive fields, keep them out, and
+		// ranges are answered from the whole list.
+		if r.Method != "GET" || r.Header.Get("Authorization") != "" || r.Header.Get("Range") != "" {
+			next(w, r)
+			return
+		}
+
+		key := clientPath(r, r.URL.Path) + "?" + r.URL.RawQuery + "|" + r.Header.Get("Accept") + "|" + localeOf(r).language()
+		now := time.Now()
+
+		if entry, ok := c.get(resource, key, now); ok {
+			cacheRequests.inc(route, "hit")
+			for name, values := range entry.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("X-Cache", "HIT")
+
+			inm, etag := r.Header.Get("If-None-Match"), entry.header.Get("ETag")
+			modified, _ := http.ParseTime(entry.header.Get("Last-Modified"))
+			if inm != "" && etag != "" && etagMatches(inm, etag, true) || notModifiedSince(r, modified) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write(entry.body)
+			return
+		}
+
+		cacheRequests.inc(route, "miss")
+		generation := c.generation(resource)
+		// Headers set before next runs, such as the quota ones, belong to
+		// this request and not to the response.
+		outer := w.Header().Clone()
+		w.Header().Set("X-Cache", "MISS")
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		if rec.status == http.StatusOK {
+			header := w.Header().Clone()
+			header.Del("X-Cache")
+			for name := range outer {
+				header.Del(name)
+			}
+			c.set(resource, key, generation, &cachedResponse{
+				header:  header,
+				body:    append([]byte(nil), rec.body.Bytes()...),
+				expires: now.Add(ttl),
+			})
+		}
+	}
+}
+
+// parseCacheTTLs overrides the default TTLs from a "route=duration,..." list.
+func parseCacheTTLs(spec string) (map[string]time.Duration, error) {
+	ttls := map[string]time.Duration{}
+	for route, ttl := range defaultCacheTTLs {
+		ttls[route] = ttl
+	}
+
+	if strings.TrimSpace(spec) == "" {
+		return ttls, nil
+	}
+
+	for _, part := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid cache ttl '%s', expected route=duration", part)
+		}
+		if _, ok := defaultCacheTTLs[kv[0]]; !ok {
+			return nil, fmt.Errorf("unknown cacheable route '%s'", kv[0])
+		}
+		ttl, err := time.ParseDuration(kv[1])
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid cache ttl for '%s': %s", kv[0], kv[1])
+		}
+		ttls[kv[0]] = ttl
+	}
+	return ttls, nil
+}
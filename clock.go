@@ -0,0 +1,42 @@
+package fishes
+
+import (
+	"crypto/rand"
+	mathrand "math/rand"
+	"net/http"
+	"time"
+)
+
+// Clock tells the handler and the ID generator the time.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// RandSource picks the fish /fishes/random redirects to and the bytes of
+// uuids.
+type RandSource interface {
+	Intn(n int) int
+	Read(p []byte) (int, error)
+}
+
+type systemRand struct{}
+
+func (systemRand) Intn(n int) int {
+	return mathrand.Intn(n)
+}
+
+func (systemRand) Read(p []byte) (int, error) {
+	return rand.Read(p)
+}
+
+// testControls is deterministicControls in a server built with the
+// fishestest tag. It returns the clock and the random source to use instead
+// of the system ones, and the handler of /admin/test/ through which tests
+// set them.
+var testControls func() (Clock, RandSource, http.HandlerFunc)
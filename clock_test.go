@@ -0,0 +1,64 @@
+package fishes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// What a deterministic server stamps with a time, it stamps with its own
+// clock: the operation log, async jobs, the integrity report and the auth
+// audit.
+func TestDeterministicTimestamps(t *testing.T) {
+	h := newTestServer(t, true, nil)
+	epoch := `"2020-01-01T00:00:00Z"`
+
+	res := serveTest(h, "POST", "/fishes", "application/json", []byte(`{"name":"Nemo","environment":"saltwater"}`))
+	if res.Code != http.StatusCreated {
+		t.Fatalf("creating the fish: %d %s", res.Code, res.Body)
+	}
+	var nemo Fish
+	json.Unmarshal(res.Body.Bytes(), &nemo)
+
+	req := httptest.NewRequest("PATCH", "http://fishes/fishes/"+nemo.ID, strings.NewReader(`{"max_length_cm":11}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("Prefer", "respond-async")
+	async := httptest.NewRecorder()
+	h.ServeHTTP(async, req)
+	if async.Code != http.StatusAccepted {
+		t.Fatalf("async update: %d %s", async.Code, async.Body)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var job asyncJob
+		json.Unmarshal(serveTest(h, "GET", async.Header().Get("Location"), "", nil).Body.Bytes(), &job)
+		if job.FinishedAt != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the job did not finish: %+v", job)
+		}
+	}
+
+	for _, tc := range []struct {
+		name, target string
+		admin        bool
+		want         string
+	}{
+		{"revision", "/fishes/" + nemo.ID + "/revisions/1", false, `"at":` + epoch},
+		{"job submitted", async.Header().Get("Location"), false, `"submitted_at":` + epoch},
+		{"job finished", async.Header().Get("Location"), false, `"finished_at":` + epoch},
+		{"integrity check", "/admin/integrity", true, `"checked_at":` + epoch},
+		{"auth audit", "/admin/audit/auth", true, `"at":` + epoch},
+	} {
+		res := serveTest(h, "GET", tc.target, "", nil)
+		if tc.admin {
+			res = serveAdmin(h, "GET", tc.target, "", nil)
+		}
+		if !strings.Contains(res.Body.String(), tc.want) {
+			t.Errorf("%s: GET %s: %d %s, want %s", tc.name, tc.target, res.Code, res.Body, tc.want)
+		}
+	}
+}
@@ -0,0 +1,520 @@
+package fishes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const clusterStateFileName = "cluster.json"
+
+const (
+	roleFollower  = "follower"
+	roleCandidate = "candidate"
+	roleLeader    = "leader"
+)
+
+// clusterState is what a node must not forget across restarts: a node that
+// voted in a term cannot vote again in it.
+type clusterState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for,omitempty"`
+}
+
+type voteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+}
+
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type heartbeat struct {
+	Term   uint64 `json:"term"`
+	Leader string `json:"leader"`
+}
+
+type heartbeatResponse struct {
+	Term uint64 `json:"term"`
+	OK   bool   `json:"ok"`
+}
+
+type clusterStatus struct {
+	Self        string     `json:"self"`
+	Role        string     `json:"role"`
+	Term        uint64     `json:"term"`
+	Leader      string     `json:"leader,omitempty"`
+	Peers       []string   `json:"peers"`
+	Applied     uint64     `json:"applied"`
+	LeaseUntil  *time.Time `json:"lease_until,omitempty"`
+	LastHeardAt *time.Time `json:"last_heard_at,omitempty"`
+}
+
+// clusterNode elects one leader among advertise_url and peers. Terms only
+// grow and each node votes once per term, so a term has at most one leader.
+// The leader holds a lease while a majority answers its heartbeats, and a
+// node that heard from a leader within election_timeout refuses to vote, so
+// a new leader cannot be elected while the old lease may still run. Only the
+// leader accepts writes; followers redirect them to it and replicate its
+// operation log.
+type clusterNode struct {
+	self      string
+	peers     []string
+	members   *membership
+	fishes    *fishesHandler
+	follow    *replica
+	client    *http.Client
+	statePath string
+
+	sync.Mutex
+	clusterState
+	role       string
+	leader     string
+	heardAt    time.Time
+	leaseUntil time.Time
+}
+
+func newClusterNode(h *fishesHandler) (*clusterNode, error) {
+	cfg := h.config()
+	c := &clusterNode{
+		self:      strings.TrimSuffix(cfg.AdvertiseURL, "/"),
+		fishes:    h,
+		follow:    newReplica(h, ""),
+		client:    &http.Client{Timeout: cfg.ElectionTimeout / 2},
+		statePath: filepath.Join(cfg.DataDir, clusterStateFileName),
+		role:      roleFollower,
+		heardAt:   time.Now(),
+	}
+	for _, peer := range cfg.Peers {
+		if peer = strings.TrimSuffix(peer, "/"); peer != c.self {
+			c.peers = append(c.peers, peer)
+		}
+	}
+
+	c.follow.term = func() uint64 {
+		term, _, _ := c.state()
+		return term
+	}
+
+	data, err := ioutil.ReadFile(c.statePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &c.clusterState); err != nil {
+			return nil, fmt.Errorf("%s: %s", c.statePath, err)
+		}
+	}
+	return c, nil
+}
+
+// saveState persists the term and vote. Callers must hold the lock.
+func (c *clusterNode) saveState() error {
+	data, err := json.Marshal(c.clusterState)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.statePath, data)
+}
+
+// peerList is the static peers and those found by gossip.
+func (c *clusterNode) peerList() []string {
+	if c.members == nil {
+		return c.peers
+	}
+	return unionPeers(c.peers, c.members.peers(clusterModeElection))
+}
+
+// discovering is true while a node joining through seeds has not found any
+// other member yet, electing itself then would split the cluster. A node
+// without seeds starts the cluster alone, but only once the members it may
+// have had before had time to find it.
+func (c *clusterNode) discovering() bool {
+	if c.members == nil || len(c.peerList()) > 0 {
+		return false
+	}
+	return len(c.members.seeds) > 0 || time.Since(c.members.started) < 2*c.fishes.config().MemberTimeout
+}
+
+func unionPeers(static, found []string) []string {
+	seen := map[string]bool{}
+	var peers []string
+	for _, peer := range append(append([]string{}, static...), found...) {
+		if !seen[peer] {
+			seen[peer] = true
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// majority of the cluster made of this node and peers.
+func majority(peers []string) int {
+	return (len(peers)+1)/2 + 1
+}
+
+func (c *clusterNode) state() (term uint64, leader, role string) {
+	c.Lock()
+	defer c.Unlock()
+	return c.Term, c.leader, c.role
+}
+
+// isLeader is true while this node leads under a running lease.
+func (c *clusterNode) isLeader() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.role == roleLeader && time.Now().Before(c.leaseUntil)
+}
+
+// observeTerm steps down when a peer knows of a later term. Callers must
+// hold the lock.
+func (c *clusterNode) observeTerm(term uint64) {
+	if term <= c.Term {
+		return
+	}
+	if c.role == roleLeader {
+		log.Printf("cluster: stepping down, term %d has started", term)
+	}
+	c.Term = term
+	c.VotedFor = ""
+	c.role = roleFollower
+	c.leader = ""
+	if err := c.saveState(); err != nil {
+		log.Printf("cluster: saving state failed: %s", err)
+	}
+}
+
+// run drives heartbeats and elections until the process exits.
+func (c *clusterNode) run() {
+	timeout := c.fishes.config().ElectionTimeout
+	tick := time.NewTicker(timeout / 4)
+	defer tick.Stop()
+	// Nodes that time out at the same moment would split the vote forever,
+	// so each waits a random extra part of the timeout.
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	wait := timeout + time.Duration(rnd.Int63n(int64(timeout)))
+	for range tick.C {
+		c.Lock()
+		role, heardAt := c.role, c.heardAt
+		c.Unlock()
+
+		if role == roleLeader {
+			c.sendHeartbeats(timeout)
+			continue
+		}
+		if time.Since(heardAt) > wait && !c.discovering() {
+			c.campaign(timeout)
+			wait = timeout + time.Duration(rnd.Int63n(int64(timeout)))
+		}
+	}
+}
+
+func (c *clusterNode) post(peer, path string, msg, out interface{}) error {
+	return postPeer(context.Background(), c.client, c.fishes.config().ReplicationKey, peer, path, msg, out)
+}
+
+// postPeer signs and sends a message to a peer under ctx and decodes the
+// answer.
+func postPeer(ctx context.Context, client *http.Client, key, peer, path string, msg, out interface{}) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", peer+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := signPeerRequest(req, key, body); err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	answer, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s: %s", peer, resp.Status, strings.TrimSpace(string(answer)))
+	}
+	return json.Unmarshal(answer, out)
+}
+
+// broadcast calls send for every peer at once and returns once they all
+// answered, which the client timeout bounds.
+func broadcast(peers []string, send func(peer string)) {
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			send(peer)
+		}(peer)
+	}
+	wg.Wait()
+}
+
+func (c *clusterNode) campaign(timeout time.Duration) {
+	started := time.Now()
+	c.Lock()
+	c.Term++
+	c.VotedFor = c.self
+	c.role = roleCandidate
+	c.leader = ""
+	term := c.Term
+	if err := c.saveState(); err != nil {
+		c.Unlock()
+		log.Printf("cluster: saving state failed: %s", err)
+		return
+	}
+	c.Unlock()
+	c.follow.setPrimary("")
+
+	peers := c.peerList()
+	var mu sync.Mutex
+	votes := 1
+	broadcast(peers, func(peer string) {
+		var resp voteResponse
+		if err := c.post(peer, "/admin/cluster/vote", voteRequest{Term: term, Candidate: c.self}, &resp); err != nil {
+			return
+		}
+		c.Lock()
+		c.observeTerm(resp.Term)
+		c.Unlock()
+		if resp.Granted {
+			mu.Lock()
+			votes++
+			mu.Unlock()
+		}
+	})
+
+	c.Lock()
+	defer c.Unlock()
+	if c.role != roleCandidate || c.Term != term {
+		return
+	}
+	if votes < majority(peers) {
+		c.role = roleFollower
+		c.heardAt = time.Now()
+		return
+	}
+	log.Printf("cluster: elected leader for term %d with %d of %d votes", term, votes, len(peers)+1)
+	c.role = roleLeader
+	c.leader = c.self
+	c.leaseUntil = started.Add(leaseFor(timeout))
+	go c.sendHeartbeats(timeout)
+}
+
+// leaseFor keeps the lease a little shorter than the election timeout, as
+// clocks do not all run at exactly the same rate.
+func leaseFor(timeout time.Duration) time.Duration {
+	return timeout * 9 / 10
+}
+
+// sendHeartbeats asserts the leadership and renews the lease when a majority
+// answers. A leader that loses its majority steps down once the lease ends.
+func (c *clusterNode) sendHeartbeats(timeout time.Duration) {
+	started := time.Now()
+	c.Lock()
+	term := c.Term
+	c.Unlock()
+
+	peers := c.peerList()
+	var mu sync.Mutex
+	acks := 1
+	broadcast(peers, func(peer string) {
+		var resp heartbeatResponse
+		if err := c.post(peer, "/admin/cluster/heartbeat", heartbeat{Term: term, Leader: c.self}, &resp); err != nil {
+			return
+		}
+		c.Lock()
+		c.observeTerm(resp.Term)
+		c.Unlock()
+		if resp.OK {
+			mu.Lock()
+			acks++
+			mu.Unlock()
+		}
+	})
+
+	c.Lock()
+	defer c.Unlock()
+	if c.role != roleLeader || c.Term != term {
+		return
+	}
+	if acks >= majority(peers) {
+		c.leaseUntil = started.Add(leaseFor(timeout))
+		return
+	}
+	if time.Now().After(c.leaseUntil) {
+		log.Printf("cluster: stepping down, only %d of %d nodes answered", acks, len(peers)+1)
+		c.role = roleFollower
+		c.leader = ""
+		c.heardAt = time.Now()
+	}
+}
+
+// vote answers a candidate's vote request.
+func (c *clusterNode) vote(w http.ResponseWriter, r *http.Request) {
+	var req voteRequest
+	if !readMessage(w, r, &req) {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	timeout := c.fishes.config().ElectionTimeout
+	// A node following a live leader, or leading itself, keeps it.
+	if (c.leader != "" && c.leader != req.Candidate && now.Sub(c.heardAt) < timeout) || (c.role == roleLeader && now.Before(c.leaseUntil)) {
+		writeJSON(w, http.StatusOK, voteResponse{Term: c.Term})
+		return
+	}
+	c.observeTerm(req.Term)
+	granted := req.Term == c.Term && (c.VotedFor == "" || c.VotedFor == req.Candidate)
+	if granted {
+		c.VotedFor = req.Candidate
+		c.heardAt = now
+		if err := c.saveState(); err != nil {
+			log.Printf("cluster: saving state failed: %s", err)
+			granted = false
+		}
+	}
+	writeJSON(w, http.StatusOK, voteResponse{Term: c.Term, Granted: granted})
+}
+
+// heartbeat accepts the leader of the current or a later term.
+func (c *clusterNode) heartbeat(w http.ResponseWriter, r *http.Request) {
+	var req heartbeat
+	if !readMessage(w, r, &req) {
+		return
+	}
+
+	c.Lock()
+	c.observeTerm(req.Term)
+	if req.Term < c.Term {
+		c.Unlock()
+		writeJSON(w, http.StatusOK, heartbeatResponse{Term: c.Term})
+		return
+	}
+	if c.leader != req.Leader {
+		log.Printf("cluster: following %s in term %d", req.Leader, req.Term)
+	}
+	c.role = roleFollower
+	c.leader = req.Leader
+	c.heardAt = time.Now()
+	term := c.Term
+	c.Unlock()
+
+	c.follow.setPrimary(req.Leader)
+	writeJSON(w, http.StatusOK, heartbeatResponse{Term: term, OK: true})
+}
+
+func readMessage(w http.ResponseWriter, r *http.Request, msg interface{}) bool {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return false
+	}
+	body, ok := readJSONBody(w, r)
+	if !ok {
+		return false
+	}
+	if err := json.Unmarshal(body, msg); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return false
+	}
+	return true
+}
+
+// status shows this node's view of the cluster.
+func (c *clusterNode) status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	writeJSON(w, http.StatusOK, c.localStatus())
+}
+
+// localStatus is this node's view of the cluster. Applied is the last
+// sequence of the leader's log, or of the log it follows.
+func (c *clusterNode) localStatus() clusterStatus {
+	peers := c.peerList()
+	c.Lock()
+	status := clusterStatus{Self: c.self, Role: c.role, Term: c.Term, Leader: c.leader, Peers: peers}
+	if c.role == roleLeader {
+		lease := c.leaseUntil.UTC()
+		status.LeaseUntil = &lease
+	} else if c.leader != "" {
+		heard := c.heardAt.UTC()
+		status.LastHeardAt = &heard
+	}
+	c.Unlock()
+	if status.Role == roleLeader {
+		h := c.fishes
+		h.Lock()
+		status.Applied = h.oplog.seq
+		h.Unlock()
+	} else {
+		c.follow.Lock()
+		status.Applied = c.follow.applied
+		c.follow.Unlock()
+	}
+	return status
+}
+
+// wrap lets only the leader take writes. Followers redirect them, and the
+// status of asynchronous writes, to the leader with 307 so the method and
+// body are kept.
+func (c *clusterNode) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		read := (r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS") && !strings.HasPrefix(r.URL.Path, "/jobs/")
+		if read && !c.isLeader() && !c.follow.awaitToken(w, r) {
+			return
+		}
+		if read || strings.HasPrefix(r.URL.Path, "/admin/cluster/") || r.URL.Path == "/admin/gossip" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if c.isLeader() {
+			next.ServeHTTP(&fencedWriter{ResponseWriter: w, c: c}, r)
+			return
+		}
+		_, leader, _ := c.state()
+		if leader == "" || leader == c.self {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("no leader has been elected, try again shortly"))
+			return
+		}
+		http.Redirect(w, r, leader+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	})
+}
+
+// leaderOnly skips a job on nodes that are not the cluster leader, since
+// they get its results through replication.
+func (c *clusterNode) leaderOnly(job func() error) func() error {
+	return func() error {
+		if c != nil && !c.isLeader() {
+			return nil
+		}
+		return job()
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type operation struct {
+	name   string
+	weight int
+	run    func(c *http.Client, base string, ids *idPool) error
+}
+
+type idPool struct {
+	sync.Mutex
+	ids []string
+}
+
+func (p *idPool) add(id string) {
+	p.Lock()
+	p.ids = append(p.ids, id)
+	p.Unlock()
+}
+
+func (p *idPool) pick() (string, bool) {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.ids) == 0 {
+		return "", false
+	}
+	return p.ids[rand.Intn(len(p.ids))], true
+}
+
+func drain(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+func expect(resp *http.Response, status int) error {
+	if resp.StatusCode != status {
+		return fmt.Errorf("expected %d, got %d", status, resp.StatusCode)
+	}
+	return nil
+}
+
+var environments = []string{"freshwater", "saltwater", "brackish"}
+
+var operations = map[string]operation{
+	"list": {name: "list", run: func(c *http.Client, base string, ids *idPool) error {
+		resp, err := c.Get(base + "/fishes?limit=50")
+		if err != nil {
+			return err
+		}
+		defer drain(resp)
+		return expect(resp, http.StatusOK)
+	}},
+	"create": {name: "create", run: func(c *http.Client, base string, ids *idPool) error {
+		body, _ := json.Marshal(map[string]interface{}{
+			"name":          fmt.Sprintf("bench fish %d", rand.Int63()),
+			"environment":   environments[rand.Intn(len(environments))],
+			"max_length_cm": 1 + rand.Intn(300),
+		})
+		resp, err := c.Post(base+"/fishes", "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer drain(resp)
+		if err := expect(resp, http.StatusCreated); err != nil {
+			return err
+		}
+		if loc := resp.Header.Get("Location"); loc != "" {
+			ids.add(strings.TrimPrefix(loc, "/fishes/"))
+		}
+		return nil
+	}},
+	"get": {name: "get", run: func(c *http.Client, base string, ids *idPool) error {
+		id, ok := ids.pick()
+		if !ok {
+			return nil
+		}
+		resp, err := c.Get(base + "/fishes/" + id)
+		if err != nil {
+			return err
+		}
+		defer drain(resp)
+		return expect(resp, http.StatusOK)
+	}},
+}
+
+func parseMix(mix string) ([]operation, error) {
+	var ops []operation
+	for _, part := range strings.Split(mix, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		op, ok := operations[kv[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown operation '%s'", kv[0])
+		}
+		op.weight = 1
+		if len(kv) == 2 {
+			n, err := strconv.Atoi(kv[1])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid weight for '%s'", kv[0])
+			}
+			op.weight = n
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+func pickOperation(ops []operation, total int) operation {
+	n := rand.Intn(total)
+	for _, op := range ops {
+		if n < op.weight {
+			return op
+		}
+		n -= op.weight
+	}
+	return ops[len(ops)-1]
+}
+
+type result struct {
+	op      string
+	latency time.Duration
+	err     error
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i]
+}
+
+func main() {
+	base := flag.String("url", "http://localhost:8080", "base URL of the server under test")
+	concurrency := flag.Int("c", 10, "number of concurrent workers")
+	duration := flag.Duration("d", 10*time.Second, "how long to run")
+	mix := flag.String("mix", "list=1,create=1,get=8", "weighted operation mix")
+	seed := flag.Int("seed", 20, "fishes to create before measuring")
+	flag.Parse()
+
+	ops, err := parseMix(*mix)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	totalWeight := 0
+	for _, op := range ops {
+		totalWeight += op.weight
+	}
+	if totalWeight == 0 {
+		fmt.Fprintln(os.Stderr, "operation mix has zero total weight")
+		os.Exit(2)
+	}
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: *concurrency,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	ids := &idPool{}
+	for i := 0; i < *seed; i++ {
+		if err := operations["create"].run(client, *base, ids); err != nil {
+			fmt.Fprintf(os.Stderr, "seeding failed: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	results := make(chan result, *concurrency*16)
+	deadline := time.Now().Add(*duration)
+
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				op := pickOperation(ops, totalWeight)
+				start := time.Now()
+				err := op.run(client, *base, ids)
+				results <- result{op: op.name, latency: time.Since(start), err: err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	latencies := map[string][]time.Duration{}
+	failures := map[string]int{}
+	for res := range results {
+		if res.err != nil {
+			failures[res.op]++
+			continue
+		}
+		latencies[res.op] = append(latencies[res.op], res.latency)
+	}
+
+	fmt.Printf("%-8s %8s %8s %10s %10s %10s %10s\n", "op", "count", "errors", "req/s", "p50", "p95", "p99")
+	for _, op := range ops {
+		l := latencies[op.name]
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		fmt.Printf("%-8s %8d %8d %10.1f %10s %10s %10s\n",
+			op.name, len(l), failures[op.name], float64(len(l))/duration.Seconds(),
+			percentile(l, 0.50), percentile(l, 0.95), percentile(l, 0.99))
+	}
+}
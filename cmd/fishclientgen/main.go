@@ -0,0 +1,136 @@
+// Command fishclientgen writes fishclient/fish.go from the Fish struct and
+// the Environment and Extensions types of the server, so the client cannot drift from the
+// API. It runs from the repository root through go generate.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var sources = []string{"server.go", "environment.go", "customfields.go"}
+
+// allowedTypes are the field types the client package can declare without
+// pulling in server internals.
+var allowedTypes = map[string]bool{
+	"string": true, "int": true, "bool": true, "float64": true, "Environment": true, "Extensions": true, "time.Time": true,
+}
+
+func main() {
+	out := flag.String("out", "fishclient/fish.go", "file to write")
+	flag.Parse()
+
+	src, err := generate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fishclientgen:", err)
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(*out, src, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "fishclientgen:", err)
+		os.Exit(1)
+	}
+}
+
+func generate() ([]byte, error) {
+	fset := token.NewFileSet()
+	var fish *ast.StructType
+	var envType, extType *ast.TypeSpec
+	var envConsts *ast.GenDecl
+	for _, name := range sources {
+		file, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					if spec.Name.Name == "Fish" {
+						fish, _ = spec.Type.(*ast.StructType)
+					} else if spec.Name.Name == "Environment" {
+						envType = spec
+					} else if spec.Name.Name == "Extensions" {
+						extType = spec
+					}
+				case *ast.ValueSpec:
+					if gen.Tok == token.CONST && isIdent(spec.Type, "Environment") {
+						envConsts = gen
+					}
+				}
+			}
+		}
+	}
+	if fish == nil || envType == nil || envConsts == nil || extType == nil {
+		return nil, fmt.Errorf("Fish, Environment, Extensions or the environment constants not found in %s", strings.Join(sources, ", "))
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by fishclientgen from " + strings.Join(sources, ", ") + "; DO NOT EDIT.\n\n")
+	buf.WriteString("package fishclient\n\nimport \"time\"\n\n")
+	buf.WriteString("// Fish is the resource served under /fishes.\ntype Fish struct {\n")
+	for _, field := range fish.Fields.List {
+		typ, err := node(fset, field.Type)
+		if err != nil {
+			return nil, err
+		}
+		if !allowedTypes[strings.TrimPrefix(typ, "*")] {
+			return nil, fmt.Errorf("field %s has type %s, which the client cannot declare", field.Names[0].Name, typ)
+		}
+		tag := ""
+		if field.Tag != nil {
+			raw, _ := strconv.Unquote(field.Tag.Value)
+			if json, ok := reflect.StructTag(raw).Lookup("json"); ok {
+				tag = " `json:\"" + json + "\"`"
+			}
+		}
+		for _, name := range field.Names {
+			fmt.Fprintf(&buf, "\t%s %s%s\n", name.Name, typ, tag)
+		}
+	}
+	buf.WriteString("}\n\n")
+
+	typ, err := node(fset, envType.Type)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(&buf, "// Environment is where a fish lives.\ntype Environment %s\n\n", typ)
+	consts, err := node(fset, envConsts)
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteString(consts + "\n\n")
+
+	if typ, err = node(fset, extType.Type); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(&buf, "// Extensions are the values of the custom fields a tenant defines for its\n// fishes, by field name.\ntype Extensions %s\n", typ)
+	return format.Source(buf.Bytes())
+}
+
+func isIdent(expr ast.Expr, name string) bool {
+	ident, ok := expr.(*ast.Ident)
+	return ok && ident.Name == name
+}
+
+func node(fset *token.FileSet, n interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, n); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,380 @@
+// Command fishconform checks that whatever answers at -url keeps the
+// contract of the fishes API: the status codes, headers, pagination and
+// error bodies clients rely on. Run it against the server, a proxy in front
+// of it or another implementation. It creates fishes named after the run and
+// deletes them again at the end.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// response is an answer with its body read.
+type response struct {
+	*http.Response
+	body []byte
+}
+
+type fish struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Slug        string `json:"slug"`
+	Environment string `json:"environment"`
+	MaxLength   int    `json:"max_length_cm"`
+	Version     int    `json:"version"`
+}
+
+type listPage struct {
+	Data []fish `json:"data"`
+	Meta *struct {
+		Total   *int    `json:"total"`
+		Limit   *int    `json:"limit"`
+		Offset  *int    `json:"offset"`
+		Version *uint64 `json:"version"`
+	} `json:"meta"`
+	Links *struct {
+		Next string `json:"next"`
+		Prev string `json:"prev"`
+	} `json:"links"`
+}
+
+// suite is one run: the server, and the fishes the checks created.
+type suite struct {
+	base    string
+	client  *http.Client
+	run     string
+	created []string
+}
+
+// failure ends a check; the checks panic with it through fail.
+type failure string
+
+func fail(format string, args ...interface{}) {
+	panic(failure(fmt.Sprintf(format, args...)))
+}
+
+func (s *suite) do(method, path string, header http.Header, body string) *response {
+	req, err := http.NewRequest(method, s.base+path, strings.NewReader(body))
+	if err != nil {
+		fail("%s", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != "" && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		fail("%s %s: %s", method, path, err)
+	}
+	defer resp.Body.Close()
+	answer, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fail("%s %s: reading the body: %s", method, path, err)
+	}
+	return &response{resp, answer}
+}
+
+func (res *response) expect(status int) *response {
+	if res.StatusCode != status {
+		fail("%s %s: got %d, want %d: %s", res.Request.Method, res.Request.URL.RequestURI(), res.StatusCode, status, bytes.TrimSpace(res.body))
+	}
+	return res
+}
+
+func (res *response) expectJSON(out interface{}) *response {
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		fail("%s %s: Content-Type is %q, want application/json", res.Request.Method, res.Request.URL.RequestURI(), ct)
+	}
+	if err := json.Unmarshal(res.body, out); err != nil {
+		fail("%s %s: body is not the expected JSON: %s", res.Request.Method, res.Request.URL.RequestURI(), err)
+	}
+	return res
+}
+
+// expectError checks a refusal: the status, and a plain text body saying
+// what is wrong.
+func (res *response) expectError(status int) *response {
+	res.expect(status)
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		fail("%s %s: error Content-Type is %q, want text/plain", res.Request.Method, res.Request.URL.RequestURI(), ct)
+	}
+	if len(bytes.TrimSpace(res.body)) == 0 {
+		fail("%s %s: error has an empty body", res.Request.Method, res.Request.URL.RequestURI())
+	}
+	return res
+}
+
+func (res *response) header(name string) string {
+	v := res.Header.Get(name)
+	if v == "" {
+		fail("%s %s: no %s header", res.Request.Method, res.Request.URL.RequestURI(), name)
+	}
+	return v
+}
+
+func (s *suite) create(name, environment string, length int) (fish, string) {
+	body, _ := json.Marshal(map[string]interface{}{"name": name, "environment": environment, "max_length_cm": length})
+	res := s.do("POST", "/fishes?envelope=true", nil, string(body)).expect(http.StatusCreated)
+	var created struct{ Data fish }
+	res.expectJSON(&created)
+	if created.Data.ID == "" {
+		fail("POST /fishes: the created fish has no id")
+	}
+	s.created = append(s.created, created.Data.ID)
+	if loc := res.header("Location"); loc != "/fishes/"+created.Data.ID {
+		fail("POST /fishes: Location is %q, want /fishes/%s", loc, created.Data.ID)
+	}
+	return created.Data, res.header("ETag")
+}
+
+func (s *suite) list(query string) (*listPage, *response) {
+	var page listPage
+	res := s.do("GET", "/fishes?envelope=true&"+query, nil, "").expect(http.StatusOK).expectJSON(&page)
+	if page.Data == nil || page.Meta == nil || page.Links == nil {
+		fail("GET /fishes: the envelope needs data, meta and links")
+	}
+	if page.Meta.Total == nil || page.Meta.Limit == nil || page.Meta.Offset == nil || page.Meta.Version == nil {
+		fail("GET /fishes: meta needs total, limit, offset and version")
+	}
+	return &page, res
+}
+
+type check struct {
+	name string
+	run  func(s *suite)
+}
+
+var checks = []check{
+	{"list/envelope", func(s *suite) {
+		page, res := s.list("")
+		if got := res.header("X-Total-Count"); got != fmt.Sprint(*page.Meta.Total) {
+			fail("X-Total-Count is %s but meta.total is %d", got, *page.Meta.Total)
+		}
+		res.header("ETag")
+	}},
+	{"list/pagination", func(s *suite) {
+		want := map[string]bool{}
+		for i := 0; i < 5; i++ {
+			f, _ := s.create(fmt.Sprintf("%s page %d", s.run, i), "freshwater", 10+i)
+			want[f.ID] = true
+		}
+		seen := map[string]bool{}
+		query := "name=" + url.QueryEscape(s.run+" page") + "&limit=2"
+		for offset, pages := 0, 0; ; pages++ {
+			if pages > 5 {
+				fail("links.next never runs out")
+			}
+			page, _ := s.list(query + fmt.Sprintf("&offset=%d", offset))
+			if *page.Meta.Total != 5 || *page.Meta.Limit != 2 || *page.Meta.Offset != offset {
+				fail("page at offset %d has meta %d/%d/%d, want total 5, limit 2, offset %d", offset, *page.Meta.Total, *page.Meta.Limit, *page.Meta.Offset, offset)
+			}
+			if len(page.Data) > 2 {
+				fail("page at offset %d has %d fishes, over the limit of 2", offset, len(page.Data))
+			}
+			for _, f := range page.Data {
+				if seen[f.ID] {
+					fail("fish %s is on two pages", f.ID)
+				}
+				seen[f.ID] = true
+			}
+			if (offset > 0) != (page.Links.Prev != "") {
+				fail("page at offset %d: links.prev is %q", offset, page.Links.Prev)
+			}
+			if page.Links.Next == "" {
+				if offset+len(page.Data) != 5 {
+					fail("links.next is missing at offset %d with fishes left", offset)
+				}
+				break
+			}
+			next, err := url.Parse(page.Links.Next)
+			if err != nil || next.Query().Get("offset") != fmt.Sprint(offset+2) {
+				fail("links.next %q does not point at offset %d", page.Links.Next, offset+2)
+			}
+			offset += 2
+		}
+		if len(seen) != len(want) {
+			fail("the pages hold %d of the 5 fishes", len(seen))
+		}
+	}},
+	{"list/sort", func(s *suite) {
+		for _, name := range []string{"b", "c", "a"} {
+			s.create(s.run+" sort "+name, "saltwater", 5)
+		}
+		for order, want := range map[string]string{"name": "abc", "-name": "cba"} {
+			page, _ := s.list("name=" + url.QueryEscape(s.run+" sort") + "&sort=" + order)
+			got := ""
+			for _, f := range page.Data {
+				got += strings.TrimPrefix(f.Name, s.run+" sort ")
+			}
+			if got != want {
+				fail("sort=%s gave the fishes in the order %q, want %q", order, got, want)
+			}
+		}
+	}},
+	{"list/invalid-parameters", func(s *suite) {
+		for _, query := range []string{"limit=0", "limit=abc", "offset=-1", "sort=colour", "no_such_parameter=1"} {
+			s.do("GET", "/fishes?"+query, nil, "").expectError(http.StatusBadRequest)
+		}
+	}},
+	{"create", func(s *suite) {
+		f, etag := s.create(s.run+" create", "brackish", 42)
+		if f.Name != s.run+" create" || f.Environment != "brackish" || f.MaxLength != 42 {
+			fail("created fish is %+v, not what was sent", f)
+		}
+		if f.Version != 1 || f.Slug == "" {
+			fail("created fish has version %d and slug %q, want version 1 and a slug", f.Version, f.Slug)
+		}
+		if !strings.HasPrefix(etag, `"`) && !strings.HasPrefix(etag, `W/"`) {
+			fail("ETag %s is not quoted", etag)
+		}
+	}},
+	{"create/invalid", func(s *suite) {
+		s.do("POST", "/fishes", nil, `{"name":`).expectError(http.StatusBadRequest)
+		s.do("POST", "/fishes", http.Header{"Content-Type": {"text/plain"}}, `{"name":"x","environment":"freshwater"}`).expectError(http.StatusUnsupportedMediaType)
+		s.do("POST", "/fishes", nil, `{"name":"x","environment":"lava"}`).expectError(http.StatusUnprocessableEntity)
+	}},
+	{"get", func(s *suite) {
+		f, etag := s.create(s.run+" get", "freshwater", 7)
+		var got struct{ Data fish }
+		res := s.do("GET", "/fishes/"+f.ID+"?envelope=true", nil, "").expect(http.StatusOK).expectJSON(&got)
+		if got.Data != f {
+			fail("GET returned %+v, created %+v", got.Data, f)
+		}
+		if res.header("ETag") != etag {
+			fail("GET ETag %s differs from the one of the create, %s", res.Header.Get("ETag"), etag)
+		}
+		// A slug redirects to the id, which is where the fish is cached.
+		bySlug := s.do("GET", "/fishes/"+f.Slug, nil, "").expect(http.StatusMovedPermanently)
+		if loc := bySlug.header("Location"); loc != "/fishes/"+f.ID {
+			fail("GET by slug %s redirects to %s, want /fishes/%s", f.Slug, loc, f.ID)
+		}
+		s.do("GET", "/fishes/"+f.ID, http.Header{"If-None-Match": {etag}}, "").expect(http.StatusNotModified)
+	}},
+	{"get/missing", func(s *suite) {
+		s.do("GET", "/fishes/"+url.PathEscape(s.run+"-missing"), nil, "").expect(http.StatusNotFound)
+	}},
+	{"update/preconditions", func(s *suite) {
+		f, etag := s.create(s.run+" update", "freshwater", 7)
+		body := fmt.Sprintf(`{"name":%q,"environment":"saltwater","max_length_cm":8}`, f.Name)
+		s.do("PUT", "/fishes/"+f.ID, nil, body).expectError(http.StatusPreconditionRequired)
+		// A 412 answers with the fish as it is, and its ETag to retry with.
+		var current struct{ Data fish }
+		stale := s.do("PUT", "/fishes/"+f.ID+"?envelope=true", http.Header{"If-Match": {`"stale"`}}, body).expect(http.StatusPreconditionFailed).expectJSON(&current)
+		if current.Data != f || stale.header("ETag") != etag {
+			fail("412 answered %+v with ETag %s, want the stored fish with ETag %s", current.Data, stale.Header.Get("ETag"), etag)
+		}
+		var updated struct{ Data fish }
+		res := s.do("PUT", "/fishes/"+f.ID+"?envelope=true", http.Header{"If-Match": {etag}}, body).expect(http.StatusOK).expectJSON(&updated)
+		if updated.Data.Environment != "saltwater" || updated.Data.Version != f.Version+1 {
+			fail("PUT gave %+v, want saltwater at version %d", updated.Data, f.Version+1)
+		}
+		if res.header("ETag") == etag {
+			fail("the ETag did not change with the fish")
+		}
+		s.do("PUT", "/fishes/"+f.ID, http.Header{"If-Match": {etag}}, body).expect(http.StatusPreconditionFailed)
+	}},
+	{"patch", func(s *suite) {
+		f, etag := s.create(s.run+" patch", "freshwater", 7)
+		header := http.Header{"If-Match": {etag}, "Content-Type": {"application/merge-patch+json"}}
+		var patched struct{ Data fish }
+		s.do("PATCH", "/fishes/"+f.ID+"?envelope=true", header, `{"max_length_cm":99}`).expect(http.StatusOK).expectJSON(&patched)
+		if patched.Data.MaxLength != 99 || patched.Data.Name != f.Name {
+			fail("PATCH gave %+v, want only max_length_cm changed to 99", patched.Data)
+		}
+	}},
+	{"methods", func(s *suite) {
+		s.do("DELETE", "/fishes", nil, "").expectError(http.StatusMethodNotAllowed)
+		s.do("POST", "/fishes/"+url.PathEscape(s.run), nil, "{}").expectError(http.StatusMethodNotAllowed)
+	}},
+	{"delete", func(s *suite) {
+		f, _ := s.create(s.run+" delete", "freshwater", 7)
+		s.do("DELETE", "/fishes/"+f.ID, nil, "").expect(http.StatusNoContent)
+		s.do("GET", "/fishes/"+f.ID, nil, "").expect(http.StatusNotFound)
+		s.do("DELETE", "/fishes/"+f.ID, nil, "").expect(http.StatusNotFound)
+	}},
+	{"environments", func(s *suite) {
+		var envs []map[string]string
+		s.do("GET", "/environments", nil, "").expect(http.StatusOK).expectJSON(&envs)
+		values := map[string]bool{}
+		for _, e := range envs {
+			values[e["value"]] = true
+		}
+		for _, want := range []string{"freshwater", "saltwater", "brackish"} {
+			if !values[want] {
+				fail("/environments lacks %s", want)
+			}
+		}
+	}},
+}
+
+func (s *suite) runCheck(c check) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			f, ok := r.(failure)
+			if !ok {
+				panic(r)
+			}
+			err = fmt.Errorf("%s", string(f))
+		}
+	}()
+	c.run(s)
+	return nil
+}
+
+func main() {
+	base := flag.String("url", "http://localhost:8080", "base URL of the server or proxy to check")
+	only := flag.String("run", "", "only run the checks whose name matches this regular expression")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout of each request")
+	flag.Parse()
+
+	filter, err := regexp.Compile(*only)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-run: %s\n", err)
+		os.Exit(2)
+	}
+	s := &suite{
+		base:   strings.TrimRight(*base, "/"),
+		client: &http.Client{Timeout: *timeout, CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }},
+		run:    fmt.Sprintf("fishconform %d", rand.New(rand.NewSource(time.Now().UnixNano())).Int63()),
+	}
+
+	failed, ran := 0, 0
+	for _, c := range checks {
+		if !filter.MatchString(c.name) {
+			continue
+		}
+		ran++
+		start := time.Now()
+		if err := s.runCheck(c); err != nil {
+			failed++
+			fmt.Printf("FAIL %-26s %s\n", c.name, err)
+			continue
+		}
+		fmt.Printf("ok   %-26s %s\n", c.name, time.Since(start).Round(time.Millisecond))
+	}
+
+	for _, id := range s.created {
+		if req, err := http.NewRequest("DELETE", s.base+"/fishes/"+id, nil); err == nil {
+			if resp, err := s.client.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}
+	fmt.Printf("%d of %d checks passed against %s\n", ran-failed, ran, s.base)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,377 @@
+// Command fishctl manages the fishes of a server from the command line.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"namnguyen191.github.com/no-dep-rest-api/fishclient"
+)
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, c *fishclient.Client, out *output, args []string) error
+}
+
+var commands = map[string]command{
+	"list":   {"list [-name text] [-environment env] [-min-length cm] [-max-length cm] [-sort key] [-limit n] [-all]", list},
+	"get":    {"get <id or slug>...", get},
+	"create": {"create -f <file.json, or - for stdin>", create},
+	"delete": {"delete [-if-match etag] <id>...", remove},
+	"export": {"export [-f file.tar.gz]", export},
+	"import": {"import -f <file.tar.gz> [-dry-run]", importArchive},
+	"watch":  {"watch [-wait seconds]", watch},
+}
+
+// output prints fishes as a table, or as JSON for scripts.
+type output struct {
+	json bool
+	w    io.Writer
+}
+
+func (o *output) fishes(fishes []fishclient.Fish) error {
+	if o.json {
+		return o.value(fishes)
+	}
+	tw := tabwriter.NewWriter(o.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSCIENTIFIC NAME\tENVIRONMENT\tLENGTH\tVERSION")
+	for _, f := range fishes {
+		length := ""
+		if f.MaxLength > 0 {
+			length = strconv.Itoa(f.MaxLength) + " cm"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\n", f.ID, f.Name, f.ScientificName, f.Environment, length, f.Version)
+	}
+	return tw.Flush()
+}
+
+func (o *output) value(v interface{}) error {
+	enc := json.NewEncoder(o.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func list(ctx context.Context, c *fishclient.Client, out *output, args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	q := &fishclient.Query{}
+	flags.StringVar(&q.Name, "name", "", "only fishes whose name contains this")
+	env := flags.String("environment", "", "only fishes of this environment")
+	flags.IntVar(&q.MinLength, "min-length", 0, "only fishes at least this long, in cm")
+	flags.IntVar(&q.MaxLength, "max-length", 0, "only fishes at most this long, in cm")
+	flags.StringVar(&q.Sort, "sort", "", "id, name or max_length_cm, - in front reverses")
+	flags.IntVar(&q.Limit, "limit", 0, "fishes per page")
+	flags.IntVar(&q.Offset, "offset", 0, "fishes to skip")
+	all := flags.Bool("all", false, "follow the pages to the end")
+	flags.Parse(args)
+	q.Environment = fishclient.Environment(*env)
+
+	var fishes []fishclient.Fish
+	for {
+		page, err := c.Search(ctx, q)
+		if err != nil {
+			return err
+		}
+		fishes = append(fishes, page.Fishes...)
+		if !*all || !page.More() || len(page.Fishes) == 0 {
+			break
+		}
+		q.Offset = page.Offset + len(page.Fishes)
+	}
+	return out.fishes(fishes)
+}
+
+func get(ctx context.Context, c *fishclient.Client, out *output, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	var fishes []fishclient.Fish
+	for _, key := range args {
+		fish, _, err := c.Get(ctx, key)
+		if err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+		fishes = append(fishes, *fish)
+	}
+	if out.json && len(fishes) == 1 {
+		return out.value(fishes[0])
+	}
+	return out.fishes(fishes)
+}
+
+// create reads a fish, or an array of them, and creates each in turn.
+func create(ctx context.Context, c *fishclient.Client, out *output, args []string) error {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	file := flags.String("f", "", "JSON file with a fish or an array of fishes, - for stdin")
+	flags.Parse(args)
+	if *file == "" {
+		return errUsage
+	}
+	data, err := readInput(*file)
+	if err != nil {
+		return err
+	}
+	var batch []fishclient.Fish
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "[") {
+		err = json.Unmarshal(data, &batch)
+	} else {
+		batch = make([]fishclient.Fish, 1)
+		err = json.Unmarshal(data, &batch[0])
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", *file, err)
+	}
+	var created []fishclient.Fish
+	for i, fish := range batch {
+		stored, err := c.Create(ctx, fish)
+		if err != nil {
+			out.fishes(created)
+			return fmt.Errorf("fish %d of %d: %s", i+1, len(batch), err)
+		}
+		created = append(created, *stored)
+	}
+	if out.json && len(created) == 1 {
+		return out.value(created[0])
+	}
+	return out.fishes(created)
+}
+
+func remove(ctx context.Context, c *fishclient.Client, out *output, args []string) error {
+	flags := flag.NewFlagSet("delete", flag.ExitOnError)
+	etag := flags.String("if-match", "", "only delete while the fish has this ETag")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return errUsage
+	}
+	for _, id := range flags.Args() {
+		if err := c.Delete(ctx, id, *etag); err != nil {
+			return fmt.Errorf("%s: %s", id, err)
+		}
+		if !out.json {
+			fmt.Fprintf(out.w, "moved %s to the trash\n", id)
+		}
+	}
+	return nil
+}
+
+func export(ctx context.Context, c *fishclient.Client, out *output, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	file := flags.String("f", "", "file to write, stdout when not set")
+	flags.Parse(args)
+	archive, err := c.Export(ctx)
+	if err != nil {
+		return err
+	}
+	if *file == "" {
+		_, err = os.Stdout.Write(archive)
+		return err
+	}
+	return ioutil.WriteFile(*file, archive, 0600)
+}
+
+func importArchive(ctx context.Context, c *fishclient.Client, out *output, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	file := flags.String("f", "", "export archive to import, - for stdin")
+	dryRun := flags.Bool("dry-run", false, "only report what would change")
+	flags.Parse(args)
+	if *file == "" {
+		return errUsage
+	}
+	archive, err := readInput(*file)
+	if err != nil {
+		return err
+	}
+	report, err := c.Import(ctx, archive, *dryRun)
+	if report == nil {
+		return err
+	}
+	if out.json {
+		if werr := out.value(report); werr != nil {
+			return werr
+		}
+		return err
+	}
+	for _, problem := range report.Problems {
+		fmt.Fprintf(out.w, "problem: %s\n", problem)
+	}
+	if len(report.Problems) > 0 {
+		return errors.New("the archive was not imported")
+	}
+	verb := "imported"
+	if report.DryRun {
+		verb = "would import"
+	}
+	fmt.Fprintf(out.w, "%s %d fishes: %d added, %d changed, %d removed\n", verb, report.Records,
+		len(report.Changes.Added), len(report.Changes.Changed), len(report.Changes.Removed))
+	return err
+}
+
+// watch follows the operation log from now on and prints every write.
+func watch(ctx context.Context, c *fishclient.Client, out *output, args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	wait := flags.Int("wait", 30, "seconds each poll waits for a write")
+	flags.Parse(args)
+
+	var epoch time.Time
+	var after uint64
+	now := func() error {
+		changes, err := c.Changes(ctx, 0, 0)
+		if err == nil {
+			epoch, after = changes.Epoch, changes.Seq
+		}
+		return err
+	}
+	if err := now(); err != nil {
+		return err
+	}
+	for {
+		changes, err := c.Changes(ctx, after, time.Duration(*wait)*time.Second)
+		if e, ok := err.(*fishclient.Error); ok && e.StatusCode == http.StatusConflict {
+			// The log was started over and is shorter than what was seen.
+			fmt.Fprintln(os.Stderr, "the operation log was started over")
+			if err = now(); err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if !changes.Epoch.Equal(epoch) && !epoch.IsZero() {
+			fmt.Fprintln(os.Stderr, "the operation log was started over")
+		}
+		epoch = changes.Epoch
+		for _, change := range changes.Changes {
+			if change.Seq <= after {
+				continue
+			}
+			if err := out.change(change); err != nil {
+				return err
+			}
+		}
+		after = changes.Seq
+	}
+}
+
+func (o *output) change(change fishclient.Change) error {
+	if o.json {
+		enc := json.NewEncoder(o.w)
+		return enc.Encode(change)
+	}
+	line := fmt.Sprintf("%s  %-6s", change.At.Local().Format("15:04:05"), change.Op)
+	switch {
+	case change.Fish != nil:
+		line += fmt.Sprintf("  %s  %s (version %d)", change.Fish.ID, change.Fish.Name, change.Fish.Version)
+	case change.ID != "":
+		line += "  " + change.ID
+	case change.Op == "reset":
+		line += fmt.Sprintf("  %d fishes", len(change.Fishes))
+	}
+	_, err := fmt.Fprintln(o.w, line)
+	return err
+}
+
+func readInput(file string) ([]byte, error) {
+	if file == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(file)
+}
+
+var errUsage = errors.New("usage")
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: fishctl [flags] <command> [arguments]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	base := flag.String("url", envOr("FISH_URL", "http://localhost:8080"), "base URL of the server, or $FISH_URL")
+	format := flag.String("o", "table", "output format, table or json")
+	password := flag.String("password", "", "admin password, or $FISH_ADMIN_PASSWORD")
+	key := flag.String("key", "", "API key as id=secret to sign requests with, or $FISH_API_KEY")
+	timeout := flag.Duration("timeout", 10*time.Second, "how long a command may take, not counting watch")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	if *format != "table" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "invalid output format '%s', must be table or json\n", *format)
+		os.Exit(2)
+	}
+
+	c := fishclient.New(*base)
+	if *key == "" {
+		*key = os.Getenv("FISH_API_KEY")
+	}
+	if *password == "" {
+		*password = os.Getenv("FISH_ADMIN_PASSWORD")
+	}
+	if *key != "" {
+		kv := strings.SplitN(*key, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			fmt.Fprintln(os.Stderr, "the API key must be id=secret")
+			os.Exit(2)
+		}
+		c.Auth = fishclient.SignedRequests(kv[0], kv[1])
+	} else if *password != "" {
+		c.Auth = fishclient.BasicAuth("admin", *password)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if flag.Arg(0) != "watch" {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	err := cmd.run(ctx, c, &output{json: *format == "json", w: os.Stdout}, flag.Args()[1:])
+	if err == errUsage {
+		fmt.Fprintf(os.Stderr, "usage: fishctl %s\n", cmd.usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fishctl:", err)
+		os.Exit(1)
+	}
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,9 @@
+// Command fishes is the fishes server. Its settings come from a config file,
+// the environment and flags; -print-config lists them.
+package main
+
+import fishes "namnguyen191.github.com/no-dep-rest-api"
+
+func main() {
+	fishes.Main()
+}
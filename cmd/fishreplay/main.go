@@ -0,0 +1,197 @@
+// Command fishreplay sends the requests a server recorded to record_file to
+// another server, keeping their original spacing or a multiple of it.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recorded is a line of the recording, see record.go.
+type recorded struct {
+	At        time.Time   `json:"at"`
+	Method    string      `json:"method"`
+	URI       string      `json:"uri"`
+	Host      string      `json:"host"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body"`
+	Truncated bool        `json:"truncated"`
+}
+
+func readRecording(r io.Reader) ([]recorded, error) {
+	var requests []recorded
+	scanner := bufio.NewScanner(r)
+	// A line holds a body of up to 1MiB, base64 encoded.
+	scanner.Buffer(nil, 4<<20)
+	for n := 1; scanner.Scan(); n++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var req recorded
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		requests = append(requests, req)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(requests, func(i, j int) bool { return requests[i].At.Before(requests[j].At) })
+	return requests, nil
+}
+
+type result struct {
+	req     recorded
+	status  int
+	latency time.Duration
+	err     error
+}
+
+func main() {
+	base := flag.String("url", "http://localhost:8080", "base URL of the server the requests are sent to")
+	file := flag.String("f", "-", "recording to replay, - for stdin")
+	speed := flag.Float64("speed", 1, "how many times faster than recorded to send the requests, 0 to send each once the one before is answered")
+	user := flag.String("user", "admin", "user of the basic auth sent with every request when -password is set")
+	password := flag.String("password", os.Getenv("ADMIN_PASSWORD"), "password sent with every request; the recording has no credentials")
+	keepHost := flag.Bool("keep-host", false, "send the recorded Host header instead of the one of -url")
+	verbose := flag.Bool("v", false, "print every request with its status")
+	flag.Parse()
+	if *speed < 0 {
+		fmt.Fprintln(os.Stderr, "-speed must not be negative")
+		os.Exit(2)
+	}
+
+	in := os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		in = f
+	}
+	requests, err := readRecording(in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *file, err)
+		os.Exit(1)
+	}
+	if len(requests) == 0 {
+		fmt.Fprintln(os.Stderr, "the recording is empty")
+		os.Exit(1)
+	}
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	send := func(rec recorded) result {
+		req, err := http.NewRequest(rec.Method, strings.TrimRight(*base, "/")+rec.URI, bytes.NewReader(rec.Body))
+		if err != nil {
+			return result{req: rec, err: err}
+		}
+		req.Header = rec.Header
+		if req.Header == nil {
+			req.Header = http.Header{}
+		}
+		// The length is the one of the body as recorded, which may be cut.
+		req.Header.Del("Content-Length")
+		if *keepHost {
+			req.Host = rec.Host
+		}
+		if *password != "" {
+			req.SetBasicAuth(*user, *password)
+		}
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			return result{req: rec, err: err}
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return result{req: rec, status: resp.StatusCode, latency: time.Since(start)}
+	}
+
+	results := make(chan result, 64)
+	start := time.Now()
+	go func() {
+		defer close(results)
+		if *speed == 0 {
+			for _, rec := range requests {
+				results <- send(rec)
+			}
+			return
+		}
+		// Each request goes out at its offset in the recording, whether the
+		// ones before are answered or not, so the load has the same shape.
+		var wg sync.WaitGroup
+		first := requests[0].At
+		for _, rec := range requests {
+			offset := time.Duration(float64(rec.At.Sub(first)) / *speed)
+			time.Sleep(time.Until(start.Add(offset)))
+			wg.Add(1)
+			go func(rec recorded) {
+				defer wg.Done()
+				results <- send(rec)
+			}(rec)
+		}
+		wg.Wait()
+	}()
+
+	statuses := map[int]int{}
+	failures, truncated := 0, 0
+	var latencies []time.Duration
+	for res := range results {
+		if res.req.Truncated {
+			truncated++
+		}
+		if res.err != nil {
+			failures++
+			fmt.Fprintf(os.Stderr, "%s %s: %s\n", res.req.Method, res.req.URI, res.err)
+			continue
+		}
+		statuses[res.status]++
+		latencies = append(latencies, res.latency)
+		if *verbose {
+			fmt.Printf("%s %s %d %s\n", res.req.Method, res.req.URI, res.status, res.latency.Round(time.Microsecond))
+		}
+	}
+
+	elapsed := time.Since(start)
+	fmt.Printf("%d requests in %s, recorded over %s\n", len(requests), elapsed.Round(time.Millisecond),
+		requests[len(requests)-1].At.Sub(requests[0].At).Round(time.Millisecond))
+	var codes []int
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Printf("  %d %s: %d\n", code, http.StatusText(code), statuses[code])
+	}
+	if failures > 0 {
+		fmt.Printf("  not answered: %d\n", failures)
+	}
+	if truncated > 0 {
+		fmt.Printf("  sent with a truncated body: %d\n", truncated)
+	}
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		fmt.Printf("latency p50 %s, p99 %s\n", latencies[len(latencies)/2], latencies[(len(latencies)-1)*99/100])
+	}
+	if failures > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,332 @@
+package fishes
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const identityCoding = "identity"
+
+// contentCodings are the codings responses can be compressed with, by their
+// Accept-Encoding name.
+var contentCodings = map[string]func(io.Writer) io.WriteCloser{
+	"br":   func(w io.Writer) io.WriteCloser { return newBrotliWriter(w) },
+	"zstd": func(w io.Writer) io.WriteCloser { return newZstdWriter(w) },
+	"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+}
+
+var (
+	acceptedCodings   = newCounterVec("fishes_accept_encoding_requests_total", "Requests by the content codings their Accept-Encoding accepts.", "encoding")
+	responseCodings   = newCounterVec("fishes_response_encodings_total", "Responses by the content coding they were sent with, identity when they were not compressed.", "encoding")
+	compressionInput  = newCounterVec("fishes_compression_input_bytes_total", "Bytes of response bodies before compression, by content coding.", "encoding")
+	compressionOutput = newCounterVec("fishes_compression_output_bytes_total", "Bytes of response bodies after compression, by content coding.", "encoding")
+)
+
+// compressor compresses the responses whose Accept-Encoding takes one of
+// the codings of the compression setting.
+type compressor struct {
+	fishes *fishesHandler
+}
+
+func newCompressor(h *fishesHandler) *compressor {
+	return &compressor{fishes: h}
+}
+
+// parseAcceptEncoding gives the weight of each coding of an Accept-Encoding
+// header; * weighs those it does not name.
+func parseAcceptEncoding(header string) map[string]float64 {
+	weights := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		if name == "x-gzip" {
+			name = "gzip"
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 && kv[0] == "q" {
+				var err error
+				if q, err = strconv.ParseFloat(kv[1], 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		weights[name] = q
+	}
+	return weights
+}
+
+func codingWeight(weights map[string]float64, coding string) (float64, bool) {
+	if q, ok := weights[coding]; ok {
+		return q, true
+	}
+	q, ok := weights["*"]
+	return q, ok
+}
+
+// negotiateCoding picks the offered coding weighed highest, the first one
+// offered among equals. It takes identity only when that is weighed higher,
+// and when no coding is acceptable.
+func negotiateCoding(weights map[string]float64, offered []string) string {
+	best, bestQ := identityCoding, 0.0
+	if q, ok := codingWeight(weights, identityCoding); ok {
+		bestQ = q
+	}
+	for _, coding := range offered {
+		q, ok := codingWeight(weights, coding)
+		if ok && q > 0 && (q > bestQ || best == identityCoding && q == bestQ) {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// compressibleType reports whether content of mediaType shrinks with
+// compression, which text does and images and archives do not.
+func compressibleType(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	for _, suffix := range []string{"json", "xml", "javascript", "yaml"} {
+		if strings.HasSuffix(mediaType, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// withCoding gives the ETag of a representation compressed with coding,
+// which may not be the one of the uncompressed one.
+func withCoding(etag, coding string) string {
+	if !strings.HasSuffix(etag, `"`) || len(etag) < 2 {
+		return etag
+	}
+	return etag[:len(etag)-1] + "-" + coding + `"`
+}
+
+// stripCodings takes the coding suffixes off the ETags of a validator,
+// giving the last coding it found.
+func stripCodings(value string) (string, string) {
+	tags := strings.Split(value, ",")
+	found := ""
+	for i, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		for coding := range contentCodings {
+			if suffix := "-" + coding + `"`; strings.HasSuffix(tag, suffix) {
+				tags[i], found = tag[:len(tag)-len(suffix)]+`"`, coding
+			}
+		}
+	}
+	return strings.Join(tags, ", "), found
+}
+
+// withoutCodings takes the coding suffixes off the validators of r, so the
+// handlers compare the ETags they gave. It also gives the coding of the
+// If-None-Match, which a 304 comes back with.
+func withoutCodings(r *http.Request) (*http.Request, string) {
+	var header http.Header
+	notModifiedCoding := ""
+	for _, name := range []string{"If-None-Match", "If-Match", "If-Range"} {
+		value, coding := stripCodings(r.Header.Get(name))
+		if coding == "" {
+			continue
+		}
+		if header == nil {
+			header = r.Header.Clone()
+		}
+		header.Set(name, value)
+		if name == "If-None-Match" {
+			notModifiedCoding = coding
+		}
+	}
+	if header == nil {
+		return r, ""
+	}
+	r = r.WithContext(r.Context())
+	r.Header = header
+	return r, notModifiedCoding
+}
+
+// wrap compresses the responses of next with the coding negotiated from
+// Accept-Encoding. Bodies are held back until compression_min_bytes of
+// them decide whether they are worth it.
+func (c *compressor) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, notModifiedCoding := withoutCodings(r)
+		cfg := c.fishes.config()
+		if len(cfg.Compression) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		weights := parseAcceptEncoding(strings.Join(r.Header.Values("Accept-Encoding"), ","))
+		for _, coding := range []string{"br", "gzip", "zstd"} {
+			if q, ok := codingWeight(weights, coding); ok && q > 0 {
+				acceptedCodings.inc(coding)
+			}
+		}
+		cw := &compressWriter{
+			ResponseWriter:    w,
+			header:            w.Header().Clone(),
+			coding:            negotiateCoding(weights, cfg.Compression),
+			notModifiedCoding: notModifiedCoding,
+			minBytes:          cfg.CompressionMinBytes,
+			head:              r.Method == "HEAD",
+		}
+		next.ServeHTTP(cw, r)
+		cw.finish()
+	})
+}
+
+// compressWriter buffers the start of a body until it knows whether to
+// compress it, then writes on through the encoder or as it is. The handlers
+// get headers of their own, which the response cache keeps, and compression
+// changes those it sends.
+type compressWriter struct {
+	http.ResponseWriter
+	header            http.Header
+	coding            string
+	notModifiedCoding string
+	minBytes          int
+	head              bool
+
+	status  int
+	decided bool
+	buf     []byte
+	encoder io.WriteCloser
+	in      int
+	out     countingWriter
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += n
+	return n, err
+}
+
+func (cw *compressWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if informational(status) {
+		h := cw.ResponseWriter.Header()
+		for name, values := range cw.header {
+			h[name] = append([]string(nil), values...)
+		}
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if cw.status != 0 {
+		return
+	}
+	cw.status = status
+	contentType := cw.header.Get("Content-Type")
+	if cw.head || status == http.StatusSwitchingProtocols || status == http.StatusNoContent || status == http.StatusNotModified ||
+		cw.header.Get("Content-Encoding") != "" || contentType != "" && !compressibleType(contentType) {
+		cw.send(false, false)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.decided {
+		return cw.write(b)
+	}
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= cw.minBytes {
+		cw.decide()
+	}
+	return len(b), nil
+}
+
+func (cw *compressWriter) write(b []byte) (int, error) {
+	cw.in += len(b)
+	if cw.encoder != nil {
+		return cw.encoder.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// decide compresses the body held back when it is long enough and of a
+// type worth it.
+func (cw *compressWriter) decide() {
+	if cw.header.Get("Content-Type") == "" {
+		cw.header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if !compressibleType(cw.header.Get("Content-Type")) {
+		cw.send(false, false)
+		return
+	}
+	cw.send(true, cw.coding != identityCoding && len(cw.buf) > 0 && len(cw.buf) >= cw.minBytes)
+}
+
+// send writes the headers of the handler, varying on Accept-Encoding for
+// the types that are compressed, then what was held back of the body.
+func (cw *compressWriter) send(vary, compress bool) {
+	cw.decided = true
+	h := cw.ResponseWriter.Header()
+	for name, values := range cw.header {
+		h[name] = append([]string(nil), values...)
+	}
+	if vary {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if compress {
+		h.Set("Content-Encoding", cw.coding)
+		h.Del("Content-Length")
+		cw.out.w = cw.ResponseWriter
+		cw.encoder = contentCodings[cw.coding](&cw.out)
+	}
+	if etag := h.Get("ETag"); etag != "" && (compress || cw.status == http.StatusNotModified && cw.notModifiedCoding == cw.coding) {
+		h.Set("ETag", withCoding(etag, cw.coding))
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) > 0 {
+		cw.write(cw.buf)
+		cw.buf = nil
+	}
+}
+
+// finish sends what is still held back and the trailers the handler
+// declared.
+func (cw *compressWriter) finish() {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.decide()
+	}
+	h := cw.ResponseWriter.Header()
+	for _, declared := range cw.header.Values("Trailer") {
+		for _, name := range strings.Split(declared, ",") {
+			if values, ok := cw.header[http.CanonicalHeaderKey(strings.TrimSpace(name))]; ok {
+				h[http.CanonicalHeaderKey(strings.TrimSpace(name))] = values
+			}
+		}
+	}
+
+	if cw.encoder == nil {
+		responseCodings.inc(identityCoding)
+		return
+	}
+	cw.encoder.Close()
+	responseCodings.inc(cw.coding)
+	compressionInput.add(float64(cw.in), cw.coding)
+	compressionOutput.add(float64(cw.out.n), cw.coding)
+}
@@ -0,0 +1,979 @@
+package fishes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the fully resolved server configuration. Each field is settable,
+// in increasing order of precedence, from its default, the config file, the
+// environment variable named after its key and the command-line flag.
+type Config struct {
+	Addr                 string        `config:"addr" help:"address to listen on when listen is not set"`
+	Listen               []string      `config:"listen" help:"listeners as [tcp://|unix://]address[#profile], profiles: default, public, admin, metrics"`
+	RecordFile           string        `config:"record_file" help:"file every request received is appended to as a JSON line, without credentials, for fishreplay to send again; empty disables recording"`
+	MockScenario         string        `config:"mock_scenario" flag:"mock" help:"JSON scenario file of fishes and fault rules to serve from memory for client development; nothing is read from or written to data_dir"`
+	RPCListen            string        `config:"rpc_listen" help:"[tcp://|unix://]address to serve the fish operations on with net/rpc and gob, empty disables it"`
+	Hosts                []string      `config:"hosts" help:"virtual hosts as host=profile, host may start with *. and * matches any other host"`
+	TrustedProxies       []string      `config:"trusted_proxies" help:"CIDRs (or \"unix\") of proxies whose X-Forwarded-For and X-Real-IP headers are trusted"`
+	AdminPassword        string        `config:"admin_password" secret:"true" help:"password for the admin portal"`
+	AdminAllow           []string      `config:"admin_allow" help:"CIDRs allowed to reach the admin portal, empty allows every address"`
+	AdminDeny            []string      `config:"admin_deny" help:"CIDRs refused by the admin portal even when admin_allow matches"`
+	APIKeys              []string      `config:"api_keys" secret:"true" help:"keys for signed requests to the admin portal as id=secret, comma separated"`
+	APIKeyRoles          []string      `config:"api_key_roles" help:"roles of the API keys as id=role, a key listed once per role; redaction policies apply to roles"`
+	RequestSigningWindow time.Duration `config:"request_signing_window" help:"how far the X-Fish-Date of a signed request may be from the server time"`
+	URLSigningKey        string        `config:"url_signing_key" secret:"true" help:"key for signed links issued by /admin/signed-urls, empty disables them"`
+	SignedURLMaxTTL      time.Duration `config:"signed_url_max_ttl" help:"longest validity a signed link can be issued with"`
+	ReplicaOf            string        `config:"replica_of" help:"URL of the primary to replicate from; writes are forwarded to it, empty runs as a primary"`
+	ReplicationKey       string        `config:"replication_key" secret:"true" help:"api_keys entry of the primary or the peers this node signs its requests with, as id=secret"`
+	Peers                []string      `config:"peers" help:"URLs of the other nodes of the cluster, comma separated; empty runs a single node"`
+	AdvertiseURL         string        `config:"advertise_url" help:"URL the peers reach this node at"`
+	ElectionTimeout      time.Duration `config:"election_timeout" help:"how long followers wait for the leader's heartbeat before electing a new one"`
+	SyncPeers            []string      `config:"sync_peers" help:"URLs of nodes that all accept writes and merge them with this one, comma separated; each needs its own node_id"`
+	SyncInterval         time.Duration `config:"sync_interval" help:"how often changes are exchanged with sync_peers"`
+	ClusterMode          string        `config:"cluster_mode" help:"how the nodes found through seeds work together: election, multi-writer or partitioned; empty takes it from peers or sync_peers"`
+	Seeds                []string      `config:"seeds" help:"URLs of nodes to join the cluster through, comma separated; the other members are found by gossip"`
+	GossipInterval       time.Duration `config:"gossip_interval" help:"how often the membership is gossiped to other members"`
+	MemberTimeout        time.Duration `config:"member_timeout" help:"silence after which a member is suspect; after twice as long it is dead"`
+	PartitionVnodes      int           `config:"partition_vnodes" help:"points each node takes on the hash ring that spreads fishes in partitioned mode"`
+	MirrorTo             string        `config:"mirror_to" help:"URL of a standby the operation log is pushed to, usually in another region; empty disables mirroring"`
+	MirrorInterval       time.Duration `config:"mirror_interval" help:"how often changes are pushed to mirror_to"`
+	MirrorConflict       string        `config:"mirror_conflict" help:"which copy /mirror keeps when a mirrored fish also changed here: source, local, or version for the higher version"`
+	MQTTBroker           string        `config:"mqtt_broker" secret:"true" help:"broker fish changes are published to with QoS 1, as mqtt:// or mqtts://[user:password@]host[:port]; empty disables publishing"`
+	MQTTTopic            string        `config:"mqtt_topic" help:"topic of each change, where {op}, {id} and {environment} are replaced by those of the change, or _ when it has none"`
+	MQTTClientID         string        `config:"mqtt_client_id" help:"client identifier sent to mqtt_broker, empty for fishes-<hostname>"`
+	RemoteWriteURL       string        `config:"metrics_remote_write_url" secret:"true" help:"Prometheus remote-write endpoint the metrics are pushed to, for setups that do not scrape /metrics; empty disables pushing"`
+	RemoteWriteInterval  time.Duration `config:"metrics_remote_write_interval" help:"how often the metrics are read and pushed to metrics_remote_write_url"`
+	RemoteWriteToken     string        `config:"metrics_remote_write_token" secret:"true" help:"bearer token sent to metrics_remote_write_url; basic auth goes in its user info instead"`
+	ShadowURL            string        `config:"shadow_url" help:"URL of an instance under test that a share of the requests is sent to as well, its answers compared with the real ones under /admin/shadow; empty disables shadowing"`
+	ShadowPercent        float64       `config:"shadow_percent" help:"percentage of the requests sent to shadow_url"`
+	ShadowMethods        []string      `config:"shadow_methods" help:"methods shadowed; writes change the shadow's data too, so only add them when it started from a copy of this one"`
+	ShadowIgnore         []string      `config:"shadow_ignore" help:"JSON fields left out of the comparison, as dotted paths through arrays such as data.updated_at"`
+	Quotas               []string      `config:"quotas" help:"limits as tenant:<id>:<limit>=<n> or key:<id>:<limit>=<n>, * as the id for those without their own; limits are requests_per_day, and for tenants records and storage_bytes"`
+	FeatureFlags         []string      `config:"feature_flags" help:"feature flags turned on or off, as name=true|false, or name@key=true|false for the requests signed by one API key; /admin/flags lists them"`
+	DefaultLocale        string        `config:"default_locale" help:"language of the answers to requests whose Accept-Language no catalog serves, such as es or fr"`
+	LocalesDir           string        `config:"locales_dir" help:"directory of message catalogs, {language}.json like those of locales/, adding languages or replacing the built-in ones; read again on reload"`
+	Compression          []string      `config:"compression" help:"content codings responses are compressed with, br, zstd or gzip, in order of preference when Accept-Encoding weighs them equally; empty disables compression"`
+	CompressionMinBytes  int           `config:"compression_min_bytes" help:"smallest response body that is compressed"`
+	SLOTargets           []string      `config:"slo_targets" help:"objectives as route=percent[@latency], comma separated, such as /fishes/{id}=99.9@250ms: that share of the requests answer without a 5xx, and within latency when given"`
+	SLOWindow            time.Duration `config:"slo_window" help:"period the error budgets of slo_targets are counted over, from 1h to 168h"`
+	ConsistencyWait      time.Duration `config:"consistency_wait" help:"longest a read sending X-Fish-Consistency-Token waits for a replica to apply that write"`
+	ReplicationMaxLag    time.Duration `config:"replication_max_lag" help:"lag after which a replica reports itself unhealthy on /healthz"`
+	AuthAuditWindow      time.Duration `config:"auth_audit_window" help:"how long authentication events stay queryable under /admin/audit/auth"`
+	AuthAlertThreshold   int           `config:"auth_alert_threshold" help:"failed logins from one address within auth_alert_window that raise an alert, 0 disables alerts"`
+	AuthAlertWindow      time.Duration `config:"auth_alert_window" help:"window in which failed logins are counted towards auth_alert_threshold"`
+	AuthAlertWebhook     string        `config:"auth_alert_webhook" help:"URL alerts are POSTed to as JSON in addition to the log, empty to only log them"`
+	NodeID               int64         `config:"node_id" help:"node number used by the sequence ID generator (0-1023)"`
+	IDGenerator          string        `config:"id_generator" help:"ID generator: sequence or uuid"`
+	ResponseEnvelope     bool          `config:"response_envelope" help:"wrap responses in a data/meta envelope"`
+	CacheTTLs            routeTTLs     `config:"cache_ttls" help:"per-route response cache TTLs as route=duration,..."`
+	IdempotencyTTL       time.Duration `config:"idempotency_ttl" help:"how long Idempotency-Key responses are replayed"`
+	DrainTimeout         time.Duration `config:"drain_timeout" help:"how long to wait for in-flight requests on shutdown"`
+	MaxHeaderBytes       int           `config:"max_header_bytes" help:"largest request line and headers read, larger ones get 431"`
+	IdleTimeout          time.Duration `config:"idle_timeout" help:"how long a keep-alive connection waits for its next request before it is closed, 0 for no limit"`
+	MaxIdleConnections   int           `config:"max_idle_connections" help:"most keep-alive connections left open between requests, more are closed as they go idle; 0 for no limit"`
+	MaxConnectionAge     time.Duration `config:"max_connection_age" help:"age past which a connection is closed after its next response, so clients reconnect and spread over the servers behind a load balancer; 0 for no limit"`
+	DataDir              string        `config:"data_dir" help:"directory for the data snapshot, empty to keep data in memory only"`
+	SnapshotInterval     time.Duration `config:"snapshot_interval" help:"how often pending changes are written to the snapshot"`
+	TrashRetention       time.Duration `config:"trash_retention" help:"how long deleted fishes stay in the trash before they are purged"`
+	ExpirySweepInterval  time.Duration `config:"expiry_sweep_interval" help:"how often fishes past their expires_at are moved to the trash"`
+	EncryptionKey        string        `config:"encryption_key" secret:"true" help:"AES-256 keys for the files in data_dir as base64 or hex, comma separated; the first encrypts and all of them decrypt"`
+	EncryptionKeyFile    string        `config:"encryption_key_file" help:"file holding the encryption keys, one per line, instead of encryption_key; key rotation rewrites it"`
+	ArchiveAfter         time.Duration `config:"archive_after" help:"how long a fish goes unread and unwritten before it moves to the on-disk archive in data_dir, 0 keeps every fish in memory"`
+	MemoryBudgetBytes    int64         `config:"memory_budget_bytes" help:"bytes the fishes of a store, the main one or a tenant's, may take in memory, as they are served, before writes to /fishes are refused or cold fishes evicted; 0 for no budget"`
+	MemoryBudgetPolicy   string        `config:"memory_budget_policy" help:"what happens past memory_budget_bytes: reject answers writes with 507, evict moves the fishes read or written least recently to the archive in data_dir first"`
+	AsyncWorkers         int           `config:"async_workers" help:"workers applying writes sent with Prefer: respond-async"`
+	AsyncQueue           int           `config:"async_queue" help:"how many async writes may wait for a worker before new ones get 503"`
+	AsyncJobTTL          time.Duration `config:"async_job_ttl" help:"how long finished async jobs stay visible under /jobs/{id}"`
+	JobSchedules         []string      `config:"job_schedules" help:"override background job schedules as name=spec, spec is @every <duration>, @hourly, @daily or a 5-field cron expression"`
+	SeedFile             string        `config:"seed_file" flag:"seed" help:"JSON or CSV file of fishes loaded on first boot, skipped when the store already has data"`
+	BackupDir            string        `config:"backup_dir" help:"directory for scheduled backup archives, empty to disable backups"`
+	BackupInterval       time.Duration `config:"backup_interval" help:"how often a backup is written"`
+	BackupRetain         int           `config:"backup_retain" help:"number of most recent backups to keep"`
+	BackupMaxAge         time.Duration `config:"backup_max_age" help:"delete backups older than this, 0 keeps them regardless of age"`
+	BackupS3Endpoint     string        `config:"backup_s3_endpoint" help:"S3-compatible endpoint URL that backups are pushed to, empty to keep them local only"`
+	BackupS3Bucket       string        `config:"backup_s3_bucket" help:"bucket for pushed backups"`
+	BackupS3Prefix       string        `config:"backup_s3_prefix" help:"key prefix for pushed backups, e.g. fishes/"`
+	BackupS3Region       string        `config:"backup_s3_region" help:"region used to sign S3 requests"`
+	BackupS3AccessKey    string        `config:"backup_s3_access_key" help:"access key ID for the S3 bucket"`
+	BackupS3SecretKey    string        `config:"backup_s3_secret_key" secret:"true" help:"secret access key for the S3 bucket"`
+	ReportDir            string        `config:"report_dir" help:"directory the weekly reports are kept in, made Mondays at 08:00 unless job_schedules names weekly-report; empty disables them, they need data_dir"`
+	ReportRetain         int           `config:"report_retain" help:"number of most recent weekly reports to keep"`
+	ReportRecipients     []string      `config:"report_recipients" help:"addresses the weekly report is mailed to, comma separated; empty only keeps it in report_dir"`
+	ReportFrom           string        `config:"report_from" help:"sender address of the weekly report mails"`
+	ReportSMTPAddr       string        `config:"report_smtp_addr" help:"host:port of the SMTP server the weekly report is sent through, with STARTTLS when it offers it"`
+	ReportSMTPUsername   string        `config:"report_smtp_username" help:"user to authenticate to the SMTP server as, empty to send without authenticating"`
+	ReportSMTPPassword   string        `config:"report_smtp_password" secret:"true" help:"password of report_smtp_username"`
+	TLSCert              string        `config:"tls_cert" help:"path to the TLS certificate, enables HTTPS together with tls_key"`
+	TLSKey               string        `config:"tls_key" help:"path to the TLS private key"`
+	TLSReload            time.Duration `config:"tls_reload" help:"how often the certificate files are checked for changes"`
+	TLSRedirectAddr      string        `config:"tls_redirect_addr" help:"optional plain HTTP address that redirects to HTTPS and answers ACME challenges"`
+	ACMEDomain           string        `config:"acme_domain" help:"domain to obtain a certificate for via ACME HTTP-01"`
+	ACMEEmail            string        `config:"acme_email" help:"contact email for the ACME account"`
+	ACMEDirectory        string        `config:"acme_directory" help:"ACME directory URL"`
+	ACMECacheDir         string        `config:"acme_cache_dir" help:"where the ACME account key and certificates are stored, defaults to data_dir/acme"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Addr:                 ":8080",
+		IDGenerator:          "sequence",
+		CacheTTLs:            parseRouteTTLsOrDefault(""),
+		IdempotencyTTL:       24 * time.Hour,
+		DrainTimeout:         30 * time.Second,
+		MaxHeaderBytes:       1 << 20,
+		SignedURLMaxTTL:      7 * 24 * time.Hour,
+		ReplicationMaxLag:    time.Minute,
+		ConsistencyWait:      5 * time.Second,
+		MirrorInterval:       2 * time.Second,
+		MirrorConflict:       mirrorConflictSource,
+		MQTTTopic:            "fishes/{environment}/{op}",
+		RemoteWriteInterval:  30 * time.Second,
+		SLOWindow:            24 * time.Hour,
+		ShadowPercent:        10,
+		ShadowMethods:        []string{"GET", "HEAD"},
+		ShadowIgnore:         []string{"meta.version"},
+		ElectionTimeout:      3 * time.Second,
+		SyncInterval:         5 * time.Second,
+		GossipInterval:       time.Second,
+		MemberTimeout:        5 * time.Second,
+		PartitionVnodes:      64,
+		RequestSigningWindow: 5 * time.Minute,
+		AuthAuditWindow:      24 * time.Hour,
+		AuthAlertThreshold:   10,
+		AuthAlertWindow:      5 * time.Minute,
+		DataDir:              "data",
+		SnapshotInterval:     time.Second,
+		TrashRetention:       30 * 24 * time.Hour,
+		ExpirySweepInterval:  time.Minute,
+		AsyncWorkers:         4,
+		AsyncQueue:           1000,
+		AsyncJobTTL:          time.Hour,
+		BackupInterval:       time.Hour,
+		BackupRetain:         24,
+		BackupS3Region:       "us-east-1",
+		ReportRetain:         52,
+		TLSReload:            time.Minute,
+		ACMEDirectory:        letsEncryptDirectory,
+		DefaultLocale:        sourceLanguage,
+		Compression:          []string{"br", "zstd", "gzip"},
+		CompressionMinBytes:  1024,
+		MemoryBudgetPolicy:   memoryPolicyReject,
+	}
+}
+
+func (c *Config) validate() error {
+	if problems := c.problems(); len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// problems lists everything wrong with c that can be told without touching
+// the network or file system.
+func (c *Config) problems() []string {
+	var problems []string
+	if c.AdminPassword == "" {
+		problems = append(problems, "admin_password is required (set ADMIN_PASSWORD, ADMIN_PASSWORD_FILE or ADMIN_PASSWORD_COMMAND)")
+	}
+	if len(c.Listen) == 0 && c.Addr == "" {
+		problems = append(problems, "addr or listen must be set")
+	}
+	if _, err := c.listenerSpecs(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.RPCListen != "" {
+		if spec, err := parseListenSpec(c.RPCListen); err != nil {
+			problems = append(problems, "rpc_listen: "+err.Error())
+		} else if spec.profile != "" {
+			problems = append(problems, "rpc_listen takes no profile")
+		}
+	}
+	if _, err := parseHostRouter(c.Hosts); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := parseAdminAccess(c.AdminAllow, c.AdminDeny); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if keys, err := parseAPIKeys(c.APIKeys); err != nil {
+		problems = append(problems, err.Error())
+	} else if _, err := parseAPIKeyRoles(c.APIKeyRoles, keys); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.RequestSigningWindow <= 0 {
+		problems = append(problems, "request_signing_window must be positive")
+	}
+	if c.SignedURLMaxTTL <= 0 {
+		problems = append(problems, "signed_url_max_ttl must be positive")
+	}
+	if c.ReplicaOf != "" {
+		if u, err := url.Parse(c.ReplicaOf); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, "replica_of must be an http or https URL")
+		}
+		if !strings.Contains(c.ReplicationKey, "=") {
+			problems = append(problems, "replica_of requires replication_key as id=secret")
+		}
+	}
+	switch c.ClusterMode {
+	case "", clusterModeElection, clusterModeMultiWriter, clusterModePartitioned:
+	default:
+		problems = append(problems, "cluster_mode must be election, multi-writer or partitioned")
+	}
+	if (c.ClusterMode == clusterModeElection && len(c.SyncPeers) > 0) || (c.ClusterMode == clusterModeMultiWriter && len(c.Peers) > 0) ||
+		(c.ClusterMode == clusterModePartitioned && (len(c.Peers) > 0 || len(c.SyncPeers) > 0)) {
+		problems = append(problems, "cluster_mode does not match peers or sync_peers")
+	}
+	if c.ClusterMode == clusterModePartitioned {
+		if len(c.Seeds) == 0 {
+			problems = append(problems, "cluster_mode partitioned requires seeds")
+		}
+		if c.ReplicaOf != "" {
+			problems = append(problems, "cluster_mode partitioned and replica_of cannot both be set")
+		}
+		if c.PartitionVnodes < 1 || c.PartitionVnodes > 1024 {
+			problems = append(problems, "partition_vnodes must be between 1 and 1024")
+		}
+	}
+	if len(c.Seeds) > 0 {
+		if c.clusterMode() == "" {
+			problems = append(problems, "seeds requires cluster_mode")
+		}
+		for _, seed := range append([]string{c.AdvertiseURL}, c.Seeds...) {
+			if u, err := url.Parse(seed); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				problems = append(problems, fmt.Sprintf("seeds and advertise_url must be http or https URLs, got '%s'", seed))
+			}
+		}
+		if !strings.Contains(c.ReplicationKey, "=") {
+			problems = append(problems, "seeds requires replication_key as id=secret")
+		}
+		if c.GossipInterval <= 0 {
+			problems = append(problems, "gossip_interval must be positive")
+		}
+		if c.MemberTimeout <= 0 {
+			problems = append(problems, "member_timeout must be positive")
+		}
+	}
+	if c.electionEnabled() {
+		if c.ReplicaOf != "" {
+			problems = append(problems, "peers and replica_of cannot both be set")
+		}
+		if c.DataDir == "" {
+			problems = append(problems, "peers requires data_dir")
+		}
+		for _, peer := range append([]string{c.AdvertiseURL}, c.Peers...) {
+			if u, err := url.Parse(peer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				problems = append(problems, fmt.Sprintf("peers and advertise_url must be http or https URLs, got '%s'", peer))
+			}
+		}
+		if !strings.Contains(c.ReplicationKey, "=") {
+			problems = append(problems, "peers requires replication_key as id=secret")
+		}
+		if c.ElectionTimeout < 100*time.Millisecond {
+			problems = append(problems, "election_timeout must be at least 100ms")
+		}
+	}
+	if c.multiWriter() {
+		if c.ReplicaOf != "" || len(c.Peers) > 0 {
+			problems = append(problems, "sync_peers cannot be combined with replica_of or peers")
+		}
+		for _, peer := range c.SyncPeers {
+			if u, err := url.Parse(peer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				problems = append(problems, fmt.Sprintf("sync_peers must be http or https URLs, got '%s'", peer))
+			}
+		}
+		if !strings.Contains(c.ReplicationKey, "=") {
+			problems = append(problems, "sync_peers requires replication_key as id=secret")
+		}
+		if c.SyncInterval <= 0 {
+			problems = append(problems, "sync_interval must be positive")
+		}
+	}
+	if c.MockScenario != "" && (c.ReplicaOf != "" || len(c.Peers) > 0 || len(c.SyncPeers) > 0 || len(c.Seeds) > 0 || c.MirrorTo != "" || c.MQTTBroker != "" || c.SeedFile != "") {
+		problems = append(problems, "mock_scenario cannot be combined with replica_of, peers, sync_peers, seeds, mirror_to, mqtt_broker or seed_file")
+	}
+	if c.ReplicationMaxLag <= 0 {
+		problems = append(problems, "replication_max_lag must be positive")
+	}
+	if c.MirrorTo != "" {
+		if u, err := url.Parse(c.MirrorTo); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, "mirror_to must be an http or https URL")
+		}
+		if c.DataDir == "" {
+			problems = append(problems, "mirror_to requires data_dir")
+		}
+		if !strings.Contains(c.ReplicationKey, "=") {
+			problems = append(problems, "mirror_to requires replication_key as id=secret")
+		}
+		if c.MirrorInterval <= 0 {
+			problems = append(problems, "mirror_interval must be positive")
+		}
+	}
+	switch c.MirrorConflict {
+	case mirrorConflictSource, mirrorConflictLocal, mirrorConflictVersion:
+	default:
+		problems = append(problems, "mirror_conflict must be source, local or version")
+	}
+	if c.MQTTBroker != "" {
+		if u, err := url.Parse(c.MQTTBroker); err != nil || (u.Scheme != "mqtt" && u.Scheme != "mqtts") || u.Hostname() == "" {
+			problems = append(problems, "mqtt_broker must be an mqtt or mqtts URL")
+		}
+		if c.DataDir == "" {
+			problems = append(problems, "mqtt_broker requires data_dir")
+		}
+	}
+	if c.MQTTTopic == "" || strings.ContainsAny(c.MQTTTopic, "+#") {
+		problems = append(problems, "mqtt_topic must be set and cannot contain the wildcards + and #")
+	}
+	if c.RemoteWriteURL != "" {
+		if u, err := url.Parse(c.RemoteWriteURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, "metrics_remote_write_url must be an http or https URL")
+		}
+	}
+	if c.RemoteWriteInterval <= 0 {
+		problems = append(problems, "metrics_remote_write_interval must be positive")
+	}
+	if c.ShadowURL != "" {
+		if u, err := url.Parse(c.ShadowURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, "shadow_url must be an http or https URL")
+		}
+	}
+	if c.ShadowPercent < 0 || c.ShadowPercent > 100 {
+		problems = append(problems, "shadow_percent must be between 0 and 100")
+	}
+	if _, err := parseQuotas(c.Quotas); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := parseFeatureFlags(c.FeatureFlags); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if !languageTagPattern.MatchString(strings.ToLower(c.DefaultLocale)) {
+		problems = append(problems, fmt.Sprintf("default_locale '%s' must be a language tag, such as en or pt-BR", c.DefaultLocale))
+	}
+	seenCodings := map[string]bool{}
+	for _, coding := range c.Compression {
+		if _, ok := contentCodings[coding]; !ok {
+			problems = append(problems, fmt.Sprintf("compression '%s' must be br, zstd or gzip", coding))
+		} else if seenCodings[coding] {
+			problems = append(problems, fmt.Sprintf("compression lists '%s' twice", coding))
+		}
+		seenCodings[coding] = true
+	}
+	if c.MaxHeaderBytes <= 0 {
+		problems = append(problems, "max_header_bytes must be positive")
+	}
+	if c.IdleTimeout < 0 || c.MaxConnectionAge < 0 {
+		problems = append(problems, "idle_timeout and max_connection_age must not be negative")
+	}
+	if c.MaxIdleConnections < 0 {
+		problems = append(problems, "max_idle_connections must not be negative")
+	}
+	if c.CompressionMinBytes < 0 {
+		problems = append(problems, "compression_min_bytes must not be negative")
+	}
+	if _, err := parseSLOTargets(c.SLOTargets); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.SLOWindow < time.Hour || c.SLOWindow > 7*24*time.Hour {
+		problems = append(problems, "slo_window must be between 1h and 168h")
+	}
+	if c.ConsistencyWait < 0 {
+		problems = append(problems, "consistency_wait must not be negative")
+	}
+	if c.AuthAuditWindow <= 0 {
+		problems = append(problems, "auth_audit_window must be positive")
+	}
+	if c.AuthAlertThreshold < 0 {
+		problems = append(problems, "auth_alert_threshold cannot be negative")
+	}
+	if c.AuthAlertWindow <= 0 || c.AuthAlertWindow > c.AuthAuditWindow {
+		problems = append(problems, "auth_alert_window must be positive and no longer than auth_audit_window")
+	}
+	if c.AuthAlertWebhook != "" {
+		if u, err := url.Parse(c.AuthAlertWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, "auth_alert_webhook must be an http or https URL")
+		}
+	}
+	if c.NodeID < 0 || c.NodeID > maxSequenceNode {
+		problems = append(problems, fmt.Sprintf("node_id must be between 0 and %d", maxSequenceNode))
+	}
+	if c.IDGenerator != "sequence" && c.IDGenerator != "uuid" {
+		problems = append(problems, "id_generator must be 'sequence' or 'uuid'")
+	}
+	if c.IdempotencyTTL <= 0 {
+		problems = append(problems, "idempotency_ttl must be positive")
+	}
+	if c.DrainTimeout <= 0 {
+		problems = append(problems, "drain_timeout must be positive")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		problems = append(problems, "tls_cert and tls_key must be set together")
+	}
+	if c.TLSRedirectAddr != "" && c.TLSCert == "" && c.ACMEDomain == "" {
+		problems = append(problems, "tls_redirect_addr requires tls_cert and tls_key or acme_domain")
+	}
+	if c.ACMEDomain != "" {
+		if c.TLSCert != "" {
+			problems = append(problems, "acme_domain cannot be combined with tls_cert and tls_key")
+		}
+		if c.TLSRedirectAddr == "" {
+			problems = append(problems, "acme_domain requires tls_redirect_addr (usually :80) to answer HTTP-01 challenges")
+		}
+		if c.ACMECacheDir == "" && c.DataDir == "" {
+			problems = append(problems, "acme_domain requires acme_cache_dir or data_dir")
+		}
+	}
+	if c.TLSReload <= 0 {
+		problems = append(problems, "tls_reload must be positive")
+	}
+	if c.SnapshotInterval <= 0 {
+		problems = append(problems, "snapshot_interval must be positive")
+	}
+	if c.TrashRetention <= 0 {
+		problems = append(problems, "trash_retention must be positive")
+	}
+	if c.ExpirySweepInterval <= 0 {
+		problems = append(problems, "expiry_sweep_interval must be positive")
+	}
+	if c.EncryptionKey != "" && c.EncryptionKeyFile != "" {
+		problems = append(problems, "set either encryption_key or encryption_key_file, not both")
+	}
+	if _, err := parseKeys(c.EncryptionKey); err != nil {
+		problems = append(problems, "encryption_key: "+err.Error())
+	}
+	if c.ArchiveAfter < 0 {
+		problems = append(problems, "archive_after must not be negative")
+	}
+	if c.ArchiveAfter > 0 && c.DataDir == "" {
+		problems = append(problems, "archive_after needs data_dir to hold the archive")
+	}
+	if c.MemoryBudgetBytes < 0 {
+		problems = append(problems, "memory_budget_bytes must not be negative")
+	}
+	switch c.MemoryBudgetPolicy {
+	case memoryPolicyReject:
+	case memoryPolicyEvict:
+		if c.DataDir == "" {
+			problems = append(problems, "memory_budget_policy evict needs data_dir to hold the archive")
+		}
+	default:
+		problems = append(problems, "memory_budget_policy must be reject or evict")
+	}
+	if c.AsyncWorkers < 1 {
+		problems = append(problems, "async_workers must be at least 1")
+	}
+	if c.AsyncQueue < 1 {
+		problems = append(problems, "async_queue must be at least 1")
+	}
+	if c.AsyncJobTTL <= 0 {
+		problems = append(problems, "async_job_ttl must be positive")
+	}
+	if _, err := parseJobSchedules(c.JobSchedules); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.BackupDir != "" {
+		if c.BackupInterval <= 0 {
+			problems = append(problems, "backup_interval must be positive")
+		}
+		if c.BackupRetain < 1 {
+			problems = append(problems, "backup_retain must be at least 1")
+		}
+		if c.BackupMaxAge < 0 {
+			problems = append(problems, "backup_max_age cannot be negative")
+		}
+	}
+	if c.BackupS3Endpoint != "" {
+		if c.BackupDir == "" {
+			problems = append(problems, "backup_s3_endpoint requires backup_dir")
+		}
+		if _, err := parseS3Endpoint(c.BackupS3Endpoint); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if c.BackupS3Bucket == "" {
+			problems = append(problems, "backup_s3_endpoint requires backup_s3_bucket")
+		}
+		if c.BackupS3AccessKey == "" || c.BackupS3SecretKey == "" {
+			problems = append(problems, "backup_s3_endpoint requires backup_s3_access_key and backup_s3_secret_key")
+		}
+	}
+	if c.ReportDir != "" {
+		if c.DataDir == "" {
+			problems = append(problems, "report_dir requires data_dir, the reports are made from its operation log")
+		}
+		if c.ReportRetain < 1 {
+			problems = append(problems, "report_retain must be at least 1")
+		}
+	}
+	if len(c.ReportRecipients) > 0 {
+		if c.ReportDir == "" {
+			problems = append(problems, "report_recipients requires report_dir")
+		}
+		if c.ReportFrom == "" {
+			problems = append(problems, "report_recipients requires report_from")
+		}
+		if _, _, err := net.SplitHostPort(c.ReportSMTPAddr); err != nil {
+			problems = append(problems, "report_recipients requires report_smtp_addr as host:port")
+		}
+		addrs := c.ReportRecipients
+		if c.ReportFrom != "" {
+			addrs = append([]string{c.ReportFrom}, addrs...)
+		}
+		for _, addr := range addrs {
+			if _, err := mail.ParseAddress(addr); err != nil {
+				problems = append(problems, fmt.Sprintf("report address %q is invalid: %s", addr, err))
+			}
+		}
+	}
+
+	return problems
+}
+
+type routeTTLs map[string]time.Duration
+
+func parseRouteTTLsOrDefault(spec string) routeTTLs {
+	ttls, err := parseCacheTTLs(spec)
+	if err != nil {
+		return routeTTLs(defaultCacheTTLs)
+	}
+	return routeTTLs(ttls)
+}
+
+func (t *routeTTLs) Set(spec string) error {
+	ttls, err := parseCacheTTLs(spec)
+	if err != nil {
+		return err
+	}
+	*t = ttls
+	return nil
+}
+
+func (t routeTTLs) String() string {
+	routes := make([]string, 0, len(t))
+	for route := range t {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	parts := make([]string, len(routes))
+	for i, route := range routes {
+		parts[i] = route + "=" + t[route].String()
+	}
+	return strings.Join(parts, ",")
+}
+
+type configField struct {
+	key    string
+	flag   string
+	help   string
+	secret bool
+	value  reflect.Value
+}
+
+func (f configField) envName() string {
+	return strings.ToUpper(f.key)
+}
+
+func (f configField) flagName() string {
+	if f.flag != "" {
+		return f.flag
+	}
+	return strings.Replace(f.key, "_", "-", -1)
+}
+
+func (f configField) isBool() bool {
+	return f.value.Kind() == reflect.Bool
+}
+
+func configFields(c *Config) []configField {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+
+	var fields []configField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		key := sf.Tag.Get("config")
+		if key == "" {
+			continue
+		}
+		fields = append(fields, configField{
+			key:    key,
+			flag:   sf.Tag.Get("flag"),
+			help:   sf.Tag.Get("help"),
+			secret: sf.Tag.Get("secret") == "true",
+			value:  v.Field(i),
+		})
+	}
+	return fields
+}
+
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "t", "true", "y", "yes", "on":
+		return true, nil
+	case "0", "f", "false", "n", "no", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean '%s'", s)
+}
+
+func (f configField) set(raw string) error {
+	if setter, ok := f.value.Addr().Interface().(flag.Value); ok {
+		return setter.Set(raw)
+	}
+
+	switch f.value.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(int64(d))
+		return nil
+	case []string:
+		var items []string
+		for _, item := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == '\n' }) {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		f.value.Set(reflect.ValueOf(items))
+		return nil
+	}
+
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(raw)
+	case reflect.Bool:
+		b, err := parseBool(raw)
+		if err != nil {
+			return err
+		}
+		f.value.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil {
+			return err
+		}
+		f.value.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported config type %s", f.value.Type())
+	}
+	return nil
+}
+
+func (f configField) display() interface{} {
+	if f.secret {
+		if f.value.IsZero() {
+			return ""
+		}
+		return "******"
+	}
+	if s, ok := f.value.Interface().(fmt.Stringer); ok {
+		return s.String()
+	}
+	return f.value.Interface()
+}
+
+// flagValue records a command-line value so it can be applied after the
+// file and environment layers.
+type flagValue struct {
+	field configField
+	raw   *string
+}
+
+func (v flagValue) String() string {
+	if v.raw == nil {
+		return ""
+	}
+	return *v.raw
+}
+
+func (v flagValue) Set(s string) error {
+	*v.raw = s
+	return nil
+}
+
+func (v flagValue) IsBoolFlag() bool {
+	return v.field.isBool()
+}
+
+type loadedConfig struct {
+	*Config
+	path        string
+	printConfig bool
+	checkOnly   bool
+}
+
+// loadConfig resolves the configuration from defaults, the config file given
+// by -config or CONFIG_FILE, the environment and finally args. Secrets can
+// also be read from files or commands, see secretSources.
+func loadConfig(args []string, getenv func(string) string) (*loadedConfig, error) {
+	cfg := defaultConfig()
+	fields := configFields(cfg)
+
+	fs := flag.NewFlagSet("fishes", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	configPath := fs.String("config", getenv("CONFIG_FILE"), "path to a JSON or TOML config file")
+	printConfig := fs.Bool("print-config", false, "print the resolved configuration and exit")
+	checkOnly := fs.Bool("check", false, "run the startup checks, print the report and exit")
+
+	flagged := map[string]*string{}
+	for _, f := range fields {
+		raw := new(string)
+		fs.Var(flagValue{field: f, raw: raw}, f.flagName(), f.help)
+		flagged[f.key] = raw
+	}
+
+	if err := fs.Parse(args); err != nil {
+		var usage bytes.Buffer
+		fs.SetOutput(&usage)
+		fs.PrintDefaults()
+		return nil, fmt.Errorf("%s\n%s", err, usage.String())
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if *configPath != "" {
+		values, err := readConfigFile(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		known := map[string]bool{}
+		for key := range secretSourceKeys(fields) {
+			known[key] = true
+		}
+		for _, f := range fields {
+			known[f.key] = true
+			if raw, ok := values[f.key]; ok {
+				if err := f.set(raw); err != nil {
+					return nil, fmt.Errorf("%s: %s: %s", *configPath, f.key, err)
+				}
+			}
+		}
+		for key := range values {
+			if !known[key] {
+				return nil, fmt.Errorf("%s: unknown setting '%s'", *configPath, key)
+			}
+		}
+		lookup := func(key string) (string, bool) {
+			raw, ok := values[key]
+			return raw, ok
+		}
+		if err := setSecrets(fields, lookup, func(key string) string { return key }); err != nil {
+			return nil, fmt.Errorf("%s: %s", *configPath, err)
+		}
+	}
+
+	for _, f := range fields {
+		if raw := getenv(f.envName()); raw != "" {
+			if err := f.set(raw); err != nil {
+				return nil, fmt.Errorf("%s: %s", f.envName(), err)
+			}
+		}
+	}
+	lookupEnv := func(key string) (string, bool) {
+		raw := getenv(strings.ToUpper(key))
+		return raw, raw != ""
+	}
+	if err := setSecrets(fields, lookupEnv, strings.ToUpper); err != nil {
+		return nil, err
+	}
+
+	for _, f := range fields {
+		if set[f.flagName()] {
+			if err := f.set(*flagged[f.key]); err != nil {
+				return nil, fmt.Errorf("-%s: %s", f.flagName(), err)
+			}
+		}
+	}
+
+	if cfg.MockScenario != "" {
+		// A mock serves its scenario and keeps nothing of what it is sent.
+		cfg.DataDir, cfg.BackupDir, cfg.ReportDir, cfg.ArchiveAfter, cfg.MemoryBudgetPolicy = "", "", "", 0, memoryPolicyReject
+		cfg.ReportRecipients = nil
+	}
+
+	return &loadedConfig{Config: cfg, path: *configPath, printConfig: *printConfig, checkOnly: *checkOnly}, nil
+}
+
+func (c *Config) print(w io.Writer) error {
+	out := map[string]interface{}{}
+	for _, f := range configFields(c) {
+		out[f.key] = f.display()
+	}
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// readConfigFile flattens a JSON or TOML-subset file into key/value strings.
+// Nested JSON objects and TOML tables are joined to their keys with "_".
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if filepath.Ext(path) == ".json" || bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var doc map[string]interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		values := map[string]string{}
+		flattenJSON("", doc, values)
+		return values, nil
+	}
+
+	return parseTOML(path, data)
+}
+
+func flattenJSON(prefix string, doc map[string]interface{}, values map[string]string) {
+	for key, v := range doc {
+		if prefix != "" {
+			key = prefix + "_" + key
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			flattenJSON(key, v, values)
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[key] = strings.Join(items, ",")
+		case string:
+			values[key] = v
+		case float64:
+			values[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case nil:
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+}
+
+// parseTOML understands "key = value" pairs, [table] headers, # comments,
+// quoted strings, bare numbers and booleans, and single-line string arrays.
+func parseTOML(path string, data []byte) (map[string]string, error) {
+	values := map[string]string{}
+	table := ""
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(stripTOMLComment(line))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, i+1)
+		}
+		key := strings.TrimSpace(kv[0])
+		if table != "" {
+			key = table + "_" + key
+		}
+
+		value, err := parseTOMLValue(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, i+1, err)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+func stripTOMLComment(line string) string {
+	inString := false
+	for i, c := range line {
+		switch {
+		case c == '"':
+			inString = !inString
+		case c == '#' && !inString:
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseTOMLValue(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		return strconv.Unquote(raw)
+	case strings.HasPrefix(raw, "["):
+		if !strings.HasSuffix(raw, "]") {
+			return "", errors.New("arrays must be on a single line")
+		}
+		var items []string
+		for _, item := range strings.Split(raw[1:len(raw)-1], ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			v, err := parseTOMLValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, v)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return raw, nil
+}
+
+func mustLoadConfig() *Config {
+	loaded, err := loadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if loaded.printConfig {
+		if err := loaded.print(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	report := preflight(loaded.Config)
+	if loaded.checkOnly || report.failed() {
+		report.print(os.Stderr)
+		if report.failed() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	return loaded.Config
+}
@@ -0,0 +1,142 @@
+package fishes
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	connClosedByPeer = "closed"
+	connIdleLimit    = "idle_limit"
+	connMaxAge       = "max_age"
+	connHijacked     = "hijacked"
+)
+
+var (
+	connectionsAccepted = newCounterVec("fishes_connections_accepted_total", "Connections accepted by the listeners.")
+	connectionsClosed   = newCounterVec("fishes_connections_closed_total", "Connections closed, by reason: closed by the client or idle_timeout, by this server for max_idle_connections or max_connection_age, or hijacked.", "reason")
+	connectionRequests  = newHistogramVec("fishes_connection_requests", "Requests served per connection, observed as it closes; an HTTP/2 connection counts once.", []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000})
+	connectionDuration  = newHistogramVec("fishes_connection_duration_seconds", "How long connections stayed open, observed as they close.", []float64{0.1, 1, 5, 15, 30, 60, 300, 900, 3600})
+)
+
+// connTracker follows the connections of the servers through their
+// ConnState, for the connection metrics. Those going idle beyond
+// max_idle_connections are closed, and those older than max_connection_age
+// answer their next request with Connection: close.
+type connTracker struct {
+	sync.Mutex
+	fishes *fishesHandler
+	conns  map[net.Conn]*trackedConn
+	idle   int
+}
+
+type trackedConn struct {
+	opened   time.Time
+	requests int
+	idle     bool
+	reason   string
+}
+
+func newConnTracker(h *fishesHandler) *connTracker {
+	t := &connTracker{fishes: h, conns: map[net.Conn]*trackedConn{}}
+	metrics.register(t)
+	return t
+}
+
+func (t *connTracker) track(c net.Conn, state http.ConnState) {
+	cfg := t.fishes.config()
+	now := time.Now()
+
+	t.Lock()
+	conn := t.conns[c]
+	if conn == nil && state != http.StateNew {
+		t.Unlock()
+		return
+	}
+	if conn != nil && conn.idle && state != http.StateIdle {
+		conn.idle = false
+		t.idle--
+	}
+	var closing bool
+	switch state {
+	case http.StateNew:
+		t.conns[c] = &trackedConn{opened: now}
+		connectionsAccepted.inc()
+	case http.StateActive:
+		conn.requests++
+	case http.StateIdle:
+		if cfg.MaxIdleConnections > 0 && t.idle >= cfg.MaxIdleConnections {
+			closing, conn.reason = true, connIdleLimit
+		} else {
+			conn.idle = true
+			t.idle++
+		}
+	case http.StateHijacked, http.StateClosed:
+		delete(t.conns, c)
+		reason := conn.reason
+		if state == http.StateHijacked {
+			reason = connHijacked
+		} else if reason == "" {
+			reason = connClosedByPeer
+		}
+		connectionsClosed.inc(reason)
+		connectionRequests.observe(float64(conn.requests))
+		connectionDuration.observe(now.Sub(conn.opened).Seconds())
+	}
+	t.Unlock()
+
+	// The server reads the next request off the closed connection, fails
+	// and moves it to StateClosed.
+	if closing {
+		c.Close()
+	}
+}
+
+type connKey struct{}
+
+// connContext gives the requests of a connection its net.Conn, for wrap.
+func (t *connTracker) connContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// wrap closes the connections past max_connection_age after the request,
+// so that clients reconnect and spread again over the servers behind a
+// load balancer. Over HTTP/2 it sends a GOAWAY.
+func (t *connTracker) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maxAge := t.fishes.config().MaxConnectionAge; maxAge > 0 {
+			c, _ := r.Context().Value(connKey{}).(net.Conn)
+			t.Lock()
+			if conn := t.conns[c]; conn != nil && time.Since(conn.opened) >= maxAge {
+				conn.reason = connMaxAge
+				w.Header().Set("Connection", "close")
+			}
+			t.Unlock()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (t *connTracker) gauges() (open, idle float64) {
+	t.Lock()
+	defer t.Unlock()
+	return float64(len(t.conns)), float64(t.idle)
+}
+
+func (t *connTracker) writeTo(w io.Writer) {
+	open, idle := t.gauges()
+	writeSamples(w, "fishes_connections_open", "Connections open, active or idle.", "gauge", nil, map[string]float64{"": open})
+	writeSamples(w, "fishes_connections_idle", "Keep-alive connections waiting for their next request.", "gauge", nil, map[string]float64{"": idle})
+}
+
+func (t *connTracker) samples() []metricSample {
+	open, idle := t.gauges()
+	return []metricSample{
+		{name: "fishes_connections_open", value: open},
+		{name: "fishes_connections_idle", value: idle},
+	}
+}
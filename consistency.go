@@ -0,0 +1,107 @@
+package fishes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// consistencyTokenHeader carries the position in the operation log a write
+// reached. Reads that send it back are only answered by a replica once it
+// applied the log that far.
+const consistencyTokenHeader = "X-Fish-Consistency-Token"
+
+// consistencyToken is the epoch of the log and a sequence number in it.
+func consistencyToken(epoch time.Time, seq uint64) string {
+	return strconv.FormatInt(epoch.UnixNano(), 36) + "." + strconv.FormatUint(seq, 10)
+}
+
+func parseConsistencyToken(token string) (epoch int64, seq uint64, err error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) == 2 {
+		if epoch, err = strconv.ParseInt(parts[0], 36, 64); err == nil {
+			if seq, err = strconv.ParseUint(parts[1], 10, 64); err == nil {
+				return epoch, seq, nil
+			}
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid %s '%s'", consistencyTokenHeader, token)
+}
+
+// tokenWriter adds the consistency token once the status is written, by
+// which time the handler applied its write.
+type tokenWriter struct {
+	http.ResponseWriter
+	log   *opLog
+	wrote bool
+}
+
+func (tw *tokenWriter) WriteHeader(status int) {
+	if !tw.wrote && !informational(status) {
+		tw.wrote = true
+		if token, ok := tw.log.token.Load().(string); ok && status < 400 {
+			tw.Header().Set(consistencyTokenHeader, token)
+		}
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *tokenWriter) Write(b []byte) (int, error) {
+	if !tw.wrote {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+// withConsistencyTokens returns the consistency token on the writes served
+// here. It needs the operation log, which is opened before serving starts.
+func (h *fishesHandler) withConsistencyTokens(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.oplog == nil || r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&tokenWriter{ResponseWriter: w, log: h.oplog}, r)
+	})
+}
+
+// awaitToken holds a read with a consistency token until the replica applied
+// the log that far, for at most consistency_wait. A token from another log
+// than the one followed is taken as met, since the replica starts that log
+// over from a snapshot anyway. It answers the request itself and returns
+// false when the read cannot go ahead.
+func (rep *replica) awaitToken(w http.ResponseWriter, r *http.Request) bool {
+	token := r.Header.Get(consistencyTokenHeader)
+	if token == "" {
+		return true
+	}
+	epoch, seq, err := parseConsistencyToken(token)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return false
+	}
+	timeout := time.NewTimer(rep.fishes.config().ConsistencyWait)
+	defer timeout.Stop()
+	for {
+		rep.Lock()
+		met := !rep.epoch.IsZero() && (rep.epoch.UnixNano() != epoch || rep.applied >= seq)
+		advanced := rep.advanced
+		rep.Unlock()
+		if met {
+			return true
+		}
+		select {
+		case <-advanced:
+		case <-timeout.C:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("this replica has not caught up with the consistency token yet"))
+			return false
+		case <-r.Context().Done():
+			return false
+		}
+	}
+}
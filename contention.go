@@ -0,0 +1,166 @@
+package fishes
+
+import (
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// storeLock is the lock of a store. It records how long every acquisition
+// waited for the lock and then held it, by the place taking it, for the
+// contention report of /admin/contention. The records are guarded by the
+// lock itself.
+type storeLock struct {
+	mu sync.Mutex
+
+	since    time.Time
+	sites    map[uintptr]*lockSite
+	holder   uintptr
+	acquired time.Time
+}
+
+// lockSite is the record of one place the lock is taken from.
+type lockSite struct {
+	acquisitions uint64
+	wait         time.Duration
+	maxWait      time.Duration
+	held         time.Duration
+	maxHeld      time.Duration
+}
+
+func (l *storeLock) Lock() {
+	var pc [1]uintptr
+	runtime.Callers(2, pc[:])
+	start := time.Now()
+	l.mu.Lock()
+	l.acquired = time.Now()
+	l.holder = pc[0]
+
+	if l.sites == nil {
+		l.since, l.sites = start, map[uintptr]*lockSite{}
+	}
+	site := l.sites[l.holder]
+	if site == nil {
+		site = &lockSite{}
+		l.sites[l.holder] = site
+	}
+	wait := l.acquired.Sub(start)
+	site.acquisitions++
+	site.wait += wait
+	if wait > site.maxWait {
+		site.maxWait = wait
+	}
+}
+
+func (l *storeLock) Unlock() {
+	if site := l.sites[l.holder]; site != nil {
+		held := time.Since(l.acquired)
+		site.held += held
+		if held > site.maxHeld {
+			site.maxHeld = held
+		}
+	}
+	l.mu.Unlock()
+}
+
+type lockContention struct {
+	Operation        string  `json:"operation"`
+	Acquisitions     uint64  `json:"acquisitions"`
+	TotalWaitSeconds float64 `json:"total_wait_seconds"`
+	AvgWaitSeconds   float64 `json:"avg_wait_seconds"`
+	MaxWaitSeconds   float64 `json:"max_wait_seconds"`
+	AvgHoldSeconds   float64 `json:"avg_hold_seconds"`
+	MaxHoldSeconds   float64 `json:"max_hold_seconds"`
+}
+
+type contentionReport struct {
+	Since      time.Time        `json:"since"`
+	Operations []lockContention `json:"operations"`
+}
+
+// lockOperation names the function a lock is taken in, closures by the
+// function they are in.
+func lockOperation(pc uintptr) string {
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	name := strings.TrimPrefix(frame.Function, "main.")
+	for {
+		i := strings.LastIndex(name, ".func")
+		if i < 0 || strings.Trim(name[i+len(".func"):], "0123456789.") != "" {
+			return name
+		}
+		name = name[:i]
+	}
+}
+
+// report sums up the acquisitions by operation, those that waited the
+// longest in all first. reset starts the counts over.
+func (l *storeLock) report(reset bool) contentionReport {
+	l.mu.Lock()
+	since := l.since
+	sites := make(map[uintptr]lockSite, len(l.sites))
+	for pc, site := range l.sites {
+		sites[pc] = *site
+	}
+	if reset {
+		l.since, l.sites = time.Now(), map[uintptr]*lockSite{}
+	}
+	l.mu.Unlock()
+
+	ops := map[string]*lockSite{}
+	for pc, site := range sites {
+		name := lockOperation(pc)
+		op := ops[name]
+		if op == nil {
+			op = &lockSite{}
+			ops[name] = op
+		}
+		op.acquisitions += site.acquisitions
+		op.wait += site.wait
+		op.held += site.held
+		if site.maxWait > op.maxWait {
+			op.maxWait = site.maxWait
+		}
+		if site.maxHeld > op.maxHeld {
+			op.maxHeld = site.maxHeld
+		}
+	}
+
+	report := contentionReport{Since: since.UTC(), Operations: []lockContention{}}
+	for name, op := range ops {
+		report.Operations = append(report.Operations, lockContention{
+			Operation:        name,
+			Acquisitions:     op.acquisitions,
+			TotalWaitSeconds: op.wait.Seconds(),
+			AvgWaitSeconds:   op.wait.Seconds() / float64(op.acquisitions),
+			MaxWaitSeconds:   op.maxWait.Seconds(),
+			AvgHoldSeconds:   op.held.Seconds() / float64(op.acquisitions),
+			MaxHoldSeconds:   op.maxHeld.Seconds(),
+		})
+	}
+	sort.Slice(report.Operations, func(i, j int) bool {
+		a, b := report.Operations[i], report.Operations[j]
+		if a.TotalWaitSeconds != b.TotalWaitSeconds {
+			return a.TotalWaitSeconds > b.TotalWaitSeconds
+		}
+		return a.Operation < b.Operation
+	})
+	return report
+}
+
+// contention reports how long the operations of the main store wait for its
+// lock and hold it, telling whether they would gain from a read-write lock
+// or sharding. DELETE gives the counts so far and starts them over.
+func (a *adminPortal) contention(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, a.fishes.storeLock.report(false))
+	case "DELETE":
+		writeJSON(w, http.StatusOK, a.fishes.storeLock.report(true))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+	}
+}
@@ -0,0 +1,531 @@
+package fishes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const syncStateFileName = "sync.json"
+
+// lwwStamp orders writes across nodes: by time, then by node to break ties.
+// A node's clock never goes backwards and moves past every stamp it merges,
+// so a write made after seeing another is always ordered after it.
+type lwwStamp struct {
+	At   int64  `json:"at"`
+	Node string `json:"node"`
+}
+
+func (s lwwStamp) after(o lwwStamp) bool {
+	return s.At > o.At || (s.At == o.At && s.Node > o.Node)
+}
+
+// lwwRegister holds one field of a fish. Seq is the local sequence number of
+// the last change and selects what a delta carries; it means nothing to
+// other nodes.
+type lwwRegister struct {
+	Value json.RawMessage `json:"value"`
+	Stamp lwwStamp        `json:"stamp"`
+	Seq   uint64          `json:"seq"`
+}
+
+// lwwElement is one fish as a register per JSON field. Purged hides every
+// field written before it, which is how a fish is dropped for good; the
+// trash is just deleted_at being set.
+type lwwElement struct {
+	Fields map[string]*lwwRegister `json:"fields,omitempty"`
+	Purged *lwwRegister            `json:"purged,omitempty"`
+}
+
+// visible reports whether reg survives the purge of e.
+func (e *lwwElement) visible(reg *lwwRegister) bool {
+	return e.Purged == nil || reg.Stamp.after(e.Purged.Stamp)
+}
+
+// lwwMap is the dataset as a last-writer-wins element map. Every node applies
+// its own writes and merges those of its sync_peers field by field, newest
+// stamp winning, so all nodes converge on the same state in any order and
+// without a leader. Callers must hold the handler lock.
+type lwwMap struct {
+	Node     string                 `json:"node"`
+	Clock    int64                  `json:"clock"`
+	Seq      uint64                 `json:"seq"`
+	Elements map[string]*lwwElement `json:"elements"`
+
+	path string
+	keys *keyring
+	// merging is set while merged changes are applied to the handler, so
+	// they are not stamped again as local writes.
+	merging bool
+	dirty   bool
+}
+
+func newLWWMap(cfg *Config, keys *keyring) (*lwwMap, error) {
+	m := &lwwMap{Node: strconv.FormatInt(cfg.NodeID, 10), Elements: map[string]*lwwElement{}, keys: keys}
+	if cfg.DataDir == "" {
+		return m, nil
+	}
+	m.path = filepath.Join(cfg.DataDir, syncStateFileName)
+	data, err := ioutil.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err == nil {
+		data, err = keys.open(data)
+	}
+	if err == nil {
+		err = json.Unmarshal(data, m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", m.path, err)
+	}
+	if m.Node != strconv.FormatInt(cfg.NodeID, 10) {
+		return nil, fmt.Errorf("%s belongs to node %s, not node_id %d", m.path, m.Node, cfg.NodeID)
+	}
+	if m.Elements == nil {
+		m.Elements = map[string]*lwwElement{}
+	}
+	return m, nil
+}
+
+func (m *lwwMap) save() error {
+	if m.path == "" || !m.dirty {
+		return nil
+	}
+	data, err := json.Marshal(m)
+	if err == nil {
+		data, err = m.keys.seal(data)
+	}
+	if err == nil {
+		err = writeFileAtomic(m.path, data)
+	}
+	if err == nil {
+		m.dirty = false
+	}
+	return err
+}
+
+func (m *lwwMap) stamp() lwwStamp {
+	now := time.Now().UnixNano()
+	if now <= m.Clock {
+		now = m.Clock + 1
+	}
+	m.Clock = now
+	return lwwStamp{At: now, Node: m.Node}
+}
+
+func (m *lwwMap) element(id string) *lwwElement {
+	e, ok := m.Elements[id]
+	if !ok {
+		e = &lwwElement{}
+		m.Elements[id] = e
+	}
+	if e.Fields == nil {
+		e.Fields = map[string]*lwwRegister{}
+	}
+	return e
+}
+
+// touch records a local write of fish, live or in the trash. Only the fields
+// that changed get a new stamp.
+func (m *lwwMap) touch(fish Fish) {
+	if m.merging {
+		return
+	}
+	data, err := json.Marshal(fish)
+	if err != nil {
+		return
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return
+	}
+
+	e := m.element(fish.ID)
+	var stamp *lwwStamp
+	set := func(name string, value json.RawMessage) {
+		if stamp == nil {
+			s := m.stamp()
+			stamp = &s
+			m.Seq++
+		}
+		e.Fields[name] = &lwwRegister{Value: value, Stamp: *stamp, Seq: m.Seq}
+		m.dirty = true
+	}
+	for name, value := range fields {
+		if reg, ok := e.Fields[name]; !ok || !e.visible(reg) || string(reg.Value) != string(value) {
+			set(name, value)
+		}
+	}
+	for name, reg := range e.Fields {
+		if _, ok := fields[name]; !ok && e.visible(reg) && string(reg.Value) != "null" {
+			set(name, json.RawMessage("null"))
+		}
+	}
+}
+
+// purge records that a fish was dropped for good.
+func (m *lwwMap) purge(id string) {
+	if m.merging {
+		return
+	}
+	m.Seq++
+	m.element(id).Purged = &lwwRegister{Value: json.RawMessage("null"), Stamp: m.stamp(), Seq: m.Seq}
+	m.dirty = true
+}
+
+// reconcile stamps whatever differs between the map and snap, as happens
+// after an import or restore, on a first start and when the process stopped
+// before the map was saved.
+func (m *lwwMap) reconcile(snap *snapshot) {
+	present := map[string]bool{}
+	for _, list := range [][]Fish{snap.Fishes, snap.Trash} {
+		for _, fish := range list {
+			present[fish.ID] = true
+			m.touch(fish)
+		}
+	}
+	for id := range m.Elements {
+		if _, ok := m.materialize(id); ok && !present[id] {
+			m.purge(id)
+		}
+	}
+}
+
+// materialize builds a fish from the visible fields of its element.
+func (m *lwwMap) materialize(id string) (Fish, bool) {
+	e, ok := m.Elements[id]
+	if !ok {
+		return Fish{}, false
+	}
+	fields := map[string]json.RawMessage{}
+	for name, reg := range e.Fields {
+		if e.visible(reg) && string(reg.Value) != "null" {
+			fields[name] = reg.Value
+		}
+	}
+	if _, ok := fields["id"]; !ok {
+		return Fish{}, false
+	}
+	var fish Fish
+	data, err := json.Marshal(fields)
+	if err == nil {
+		err = json.Unmarshal(data, &fish)
+	}
+	return fish, err == nil
+}
+
+// delta returns the registers changed locally after seq.
+func (m *lwwMap) delta(after uint64) map[string]*lwwElement {
+	delta := map[string]*lwwElement{}
+	for id, e := range m.Elements {
+		var d *lwwElement
+		for name, reg := range e.Fields {
+			if reg.Seq > after {
+				if d == nil {
+					d = &lwwElement{Fields: map[string]*lwwRegister{}}
+				}
+				d.Fields[name] = reg
+			}
+		}
+		if e.Purged != nil && e.Purged.Seq > after {
+			if d == nil {
+				d = &lwwElement{}
+			}
+			d.Purged = e.Purged
+		}
+		if d != nil {
+			delta[id] = d
+		}
+	}
+	return delta
+}
+
+// merge takes the registers of delta that are newer than the local ones and
+// returns the ids that changed.
+func (m *lwwMap) merge(delta map[string]*lwwElement) []string {
+	var changed []string
+	adopt := func(reg *lwwRegister) *lwwRegister {
+		if reg.Stamp.At > m.Clock {
+			m.Clock = reg.Stamp.At
+		}
+		m.Seq++
+		m.dirty = true
+		return &lwwRegister{Value: reg.Value, Stamp: reg.Stamp, Seq: m.Seq}
+	}
+	for id, d := range delta {
+		e := m.element(id)
+		updated := false
+		for name, reg := range d.Fields {
+			if reg == nil {
+				continue
+			}
+			if local, ok := e.Fields[name]; !ok || reg.Stamp.after(local.Stamp) {
+				e.Fields[name] = adopt(reg)
+				updated = true
+			}
+		}
+		if d.Purged != nil && (e.Purged == nil || d.Purged.Stamp.after(e.Purged.Stamp)) {
+			e.Purged = adopt(d.Purged)
+			updated = true
+		}
+		if updated {
+			changed = append(changed, id)
+		}
+	}
+	return changed
+}
+
+// applyMerged brings the handler in line with the map for the given ids.
+// Callers must hold the lock.
+func (h *fishesHandler) applyMerged(ids []string) error {
+	m := h.crdt
+	m.merging = true
+	defer func() { m.merging = false }()
+
+	for _, id := range ids {
+		if err := h.rehydrate(id); err != nil {
+			return err
+		}
+		fish, exists := m.materialize(id)
+		_, live := h.db[id]
+		_, trashed := h.trash[id]
+		switch {
+		case !exists:
+			if live {
+				now := time.Now().UTC()
+				gone := h.db[id]
+				gone.DeletedAt = &now
+				if err := h.moveToTrash(gone); err != nil {
+					return err
+				}
+				trashed = true
+			}
+			if trashed {
+				if err := h.dropFromTrash(id); err != nil {
+					return err
+				}
+				h.bumpVersion()
+				h.dirty = true
+			}
+		case fish.DeletedAt != nil:
+			if err := h.moveToTrash(fish); err != nil {
+				return err
+			}
+		default:
+			delete(h.trash, id)
+			if fish.Slug != "" {
+				h.slugs[fish.Slug] = fish.ID
+			}
+			if _, err := h.put(fish); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type syncRequest struct {
+	Node  string                 `json:"node"`
+	After uint64                 `json:"after"`
+	Delta map[string]*lwwElement `json:"delta"`
+}
+
+type syncResponse struct {
+	Node  string                 `json:"node"`
+	Seq   uint64                 `json:"seq"`
+	Delta map[string]*lwwElement `json:"delta"`
+}
+
+// syncPeer is what this node knows of one of its sync_peers.
+type syncPeer struct {
+	URL string `json:"url"`
+	// Received is the peer's sequence number up to which its changes are
+	// merged here, Sent the local one up to which the peer has ours.
+	Received uint64     `json:"received"`
+	Sent     uint64     `json:"sent"`
+	LastSync *time.Time `json:"last_sync,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// syncer exchanges deltas with sync_peers, and the multi-writer members
+// found by gossip, on every sync_interval.
+type syncer struct {
+	fishes  *fishesHandler
+	client  *http.Client
+	static  []string
+	members *membership
+
+	sync.Mutex
+	peers []*syncPeer
+}
+
+// newSyncer attaches an lwwMap to h, stamping whatever changed while the
+// map was not kept.
+func newSyncer(h *fishesHandler) (*syncer, error) {
+	m, err := newLWWMap(h.config(), h.keys)
+	if err != nil {
+		return nil, err
+	}
+	h.Lock()
+	defer h.Unlock()
+	full, err := h.fullSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	m.reconcile(full)
+	if err := m.save(); err != nil {
+		return nil, err
+	}
+	h.crdt = m
+
+	s := &syncer{fishes: h, client: &http.Client{Timeout: 30 * time.Second}}
+	for _, peer := range h.config().SyncPeers {
+		s.static = append(s.static, strings.TrimSuffix(peer, "/"))
+	}
+	return s, nil
+}
+
+// currentPeers adds the members found since the last round to s.peers and
+// returns the ones to sync with now.
+func (s *syncer) currentPeers() []*syncPeer {
+	urls := s.static
+	if s.members != nil {
+		urls = unionPeers(s.static, s.members.peers(clusterModeMultiWriter))
+	}
+	s.Lock()
+	defer s.Unlock()
+	known := map[string]*syncPeer{}
+	for _, peer := range s.peers {
+		known[peer.URL] = peer
+	}
+	var current []*syncPeer
+	for _, url := range urls {
+		peer, ok := known[url]
+		if !ok {
+			peer = &syncPeer{URL: url}
+			s.peers = append(s.peers, peer)
+		}
+		current = append(current, peer)
+	}
+	return current
+}
+
+func (s *syncer) save() error {
+	s.fishes.Lock()
+	defer s.fishes.Unlock()
+	return s.fishes.crdt.save()
+}
+
+// syncNow runs one round with every peer.
+func (s *syncer) syncNow() error {
+	var failed error
+	for _, peer := range s.currentPeers() {
+		err := s.syncWith(peer)
+		s.Lock()
+		if err != nil {
+			peer.Error = err.Error()
+			failed = err
+		} else {
+			now := time.Now().UTC()
+			peer.LastSync, peer.Error = &now, ""
+		}
+		s.Unlock()
+	}
+
+	if err := s.save(); err != nil {
+		return err
+	}
+	return failed
+}
+
+func (s *syncer) syncWith(peer *syncPeer) error {
+	h := s.fishes
+	s.Lock()
+	received, sent := peer.Received, peer.Sent
+	s.Unlock()
+
+	h.Lock()
+	seq := h.crdt.Seq
+	req := syncRequest{Node: h.crdt.Node, After: received, Delta: h.crdt.delta(sent)}
+	h.Unlock()
+
+	var resp syncResponse
+	if err := postPeer(context.Background(), s.client, h.config().ReplicationKey, peer.URL, "/admin/sync", req, &resp); err != nil {
+		return err
+	}
+	if resp.Node == req.Node {
+		return fmt.Errorf("%s has the same node_id %s as this node", peer.URL, resp.Node)
+	}
+
+	h.Lock()
+	changed := h.crdt.merge(resp.Delta)
+	err := h.applyMerged(changed)
+	h.Unlock()
+	if err != nil {
+		return err
+	}
+	if len(changed) > 0 {
+		log.Printf("sync: merged %d fishes from %s", len(changed), peer.URL)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	peer.Sent = seq
+	peer.Received = resp.Seq
+	if resp.Seq < received {
+		// The peer lost its state; take everything it has again.
+		peer.Received = 0
+	}
+	return nil
+}
+
+// sync merges a peer's delta and answers with the local changes it has not
+// seen. GET shows the state of the exchanges with the sync_peers.
+func (s *syncer) sync(w http.ResponseWriter, r *http.Request) {
+	h := s.fishes
+	switch r.Method {
+	case "GET":
+		h.Lock()
+		node, seq := h.crdt.Node, h.crdt.Seq
+		h.Unlock()
+		s.Lock()
+		defer s.Unlock()
+		writeJSON(w, http.StatusOK, map[string]interface{}{"node": node, "seq": seq, "peers": s.peers})
+	case "POST":
+		var req syncRequest
+		if !readMessage(w, r, &req) {
+			return
+		}
+		h.Lock()
+		defer h.Unlock()
+		if req.Node == h.crdt.Node {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(fmt.Sprintf("node_id %s is already taken by this node", req.Node)))
+			return
+		}
+		resp := syncResponse{Node: h.crdt.Node, Seq: h.crdt.Seq, Delta: h.crdt.delta(req.After)}
+		changed := h.crdt.merge(req.Delta)
+		if err := h.applyMerged(changed); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if len(changed) > 0 {
+			log.Printf("sync: merged %d fishes from node %s", len(changed), req.Node)
+		}
+		writeJSON(w, http.StatusOK, resp)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+	}
+}
@@ -0,0 +1,396 @@
+package fishes
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// sealedMagic starts every encrypted file so plain files written before
+// encryption was turned on can still be told apart and read.
+var sealedMagic = []byte("fishenc1")
+
+const keyIDBytes = 4
+
+type dataKey struct {
+	id   string
+	raw  []byte
+	aead cipher.AEAD
+}
+
+// keyring holds the AES-256-GCM keys for the files in data_dir. New data is
+// sealed with the first key; every key is tried by id when opening, so data
+// sealed before a rotation stays readable. A nil or empty keyring leaves
+// data in plain text.
+type keyring struct {
+	sync.Mutex
+	keys []*dataKey
+}
+
+func parseKey(spec string) ([]byte, error) {
+	spec = strings.TrimSpace(spec)
+	raw, err := hex.DecodeString(spec)
+	if err != nil || len(spec) != 64 {
+		raw, err = base64.StdEncoding.DecodeString(spec)
+	}
+	if err != nil || len(raw) != 32 {
+		return nil, errors.New("encryption keys must be 32 bytes, given as base64 or 64 hex characters")
+	}
+	return raw, nil
+}
+
+// parseKeys reads a comma or newline separated list of keys, current first.
+func parseKeys(spec string) ([][]byte, error) {
+	var keys [][]byte
+	for _, field := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		raw, err := parseKey(field)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, raw)
+	}
+	return keys, nil
+}
+
+func newDataKey(raw []byte) (*dataKey, error) {
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	return &dataKey{id: hex.EncodeToString(sum[:keyIDBytes]), raw: raw, aead: aead}, nil
+}
+
+func newKeyring(cfg *Config) (*keyring, error) {
+	spec := cfg.EncryptionKey
+	if cfg.EncryptionKeyFile != "" {
+		data, err := ioutil.ReadFile(cfg.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		spec = string(data)
+	}
+	raws, err := parseKeys(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &keyring{}
+	for _, raw := range raws {
+		key, err := newDataKey(raw)
+		if err != nil {
+			return nil, err
+		}
+		k.keys = append(k.keys, key)
+	}
+	return k, nil
+}
+
+func (k *keyring) current() *dataKey {
+	if k == nil {
+		return nil
+	}
+	k.Lock()
+	defer k.Unlock()
+	if len(k.keys) == 0 {
+		return nil
+	}
+	return k.keys[0]
+}
+
+func (k *keyring) find(id string) *dataKey {
+	k.Lock()
+	defer k.Unlock()
+	for _, key := range k.keys {
+		if key.id == id {
+			return key
+		}
+	}
+	return nil
+}
+
+func (k *keyring) ids() []string {
+	ids := []string{}
+	if k == nil {
+		return ids
+	}
+	k.Lock()
+	defer k.Unlock()
+	for _, key := range k.keys {
+		ids = append(ids, key.id)
+	}
+	return ids
+}
+
+// rotate makes raw the key new data is sealed with, keeping the older keys
+// for reading.
+func (k *keyring) rotate(raw []byte) (*dataKey, error) {
+	key, err := newDataKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	k.Lock()
+	defer k.Unlock()
+	if len(k.keys) > 0 && k.keys[0].id == key.id {
+		return nil, errors.New("that key is already the current key")
+	}
+	keys := []*dataKey{key}
+	for _, old := range k.keys {
+		if old.id != key.id {
+			keys = append(keys, old)
+		}
+	}
+	k.keys = keys
+	return key, nil
+}
+
+// keyFile renders the current key, and the older ones when all is set, in
+// the format encryption_key_file is read in.
+func (k *keyring) keyFile(all bool) []byte {
+	k.Lock()
+	defer k.Unlock()
+	var buf bytes.Buffer
+	for i, key := range k.keys {
+		if i > 0 && !all {
+			break
+		}
+		buf.WriteString(base64.StdEncoding.EncodeToString(key.raw))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func (k *keyring) seal(plain []byte) ([]byte, error) {
+	key := k.current()
+	if key == nil {
+		return plain, nil
+	}
+	id, _ := hex.DecodeString(key.id)
+	header := append(append([]byte{}, sealedMagic...), id...)
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out := append(append([]byte{}, header...), nonce...)
+	return key.aead.Seal(out, nonce, plain, header), nil
+}
+
+// open decrypts data sealed by seal and passes plain data through.
+func (k *keyring) open(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, sealedMagic) {
+		return data, nil
+	}
+	headerLen := len(sealedMagic) + keyIDBytes
+	if len(data) < headerLen {
+		return nil, errors.New("encrypted data is truncated")
+	}
+	id := hex.EncodeToString(data[len(sealedMagic):headerLen])
+	if k == nil {
+		return nil, fmt.Errorf("data is encrypted with key %s but no encryption_key is configured", id)
+	}
+	key := k.find(id)
+	if key == nil {
+		return nil, fmt.Errorf("data is encrypted with key %s which is not among the configured keys", id)
+	}
+	if len(data) < headerLen+key.aead.NonceSize() {
+		return nil, errors.New("encrypted data is truncated")
+	}
+	nonce := data[headerLen : headerLen+key.aead.NonceSize()]
+	plain, err := key.aead.Open(nil, nonce, data[headerLen+len(nonce):], data[:headerLen])
+	if err != nil {
+		return nil, fmt.Errorf("decrypting with key %s failed: the data was modified or the key is wrong", id)
+	}
+	return plain, nil
+}
+
+// sealLine encrypts one line of the operation log. Sealed lines are base64
+// so the log stays line oriented.
+func (k *keyring) sealLine(line []byte) ([]byte, error) {
+	if k.current() == nil {
+		return line, nil
+	}
+	sealed, err := k.seal(line)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(out, sealed)
+	return out, nil
+}
+
+func (k *keyring) openLine(line []byte) ([]byte, error) {
+	if len(line) == 0 || line[0] == '{' {
+		return line, nil
+	}
+	sealed := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+	n, err := base64.StdEncoding.Decode(sealed, line)
+	if err != nil {
+		return nil, err
+	}
+	return k.open(sealed[:n])
+}
+
+// reseal rewrites the operation log, the archive segments and the snapshot
+// under the current key. Callers must hold the lock and the persister's
+// write lock.
+func (h *fishesHandler) reseal(p *persister) error {
+	if h.oplog != nil {
+		if err := h.oplog.rewrite(); err != nil {
+			return err
+		}
+	}
+	if h.archive != nil {
+		if err := h.archive.reseal(); err != nil {
+			return err
+		}
+	}
+	if err := writeSnapshot(p.path, h.snapshot(), h.keys); err != nil {
+		return err
+	}
+	h.dirty = false
+	return nil
+}
+
+// reseal rewrites what store keeps in data_dir under the current key.
+func (store *fishStore) reseal() error {
+	p := store.persister
+	if p == nil {
+		return nil
+	}
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	store.h.Lock()
+	defer store.h.Unlock()
+	return store.h.reseal(p)
+}
+
+type encryptionStatus struct {
+	Enabled       bool     `json:"enabled"`
+	KeyID         string   `json:"key_id,omitempty"`
+	Keys          []string `json:"keys"`
+	KeyFile       string   `json:"key_file,omitempty"`
+	PreviousKeyID string   `json:"previous_key_id,omitempty"`
+	Note          string   `json:"note,omitempty"`
+}
+
+func (a *adminPortal) encryptionStatus() *encryptionStatus {
+	keys := a.fishes.keys
+	status := &encryptionStatus{Keys: keys.ids(), KeyFile: a.fishes.config().EncryptionKeyFile}
+	if key := keys.current(); key != nil {
+		status.Enabled = true
+		status.KeyID = key.id
+	}
+	return status
+}
+
+func (a *adminPortal) encryption(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	writeJSON(w, http.StatusOK, a.encryptionStatus())
+}
+
+// rotateKey re-encrypts everything in data_dir under a new key, taken from
+// the body or generated when encryption_key_file can hold it. The key file
+// lists the old key as well until re-encryption finished, so a crash
+// half way leaves data the next start can still read.
+func (a *adminPortal) rotateKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	if a.persister == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("encryption covers the files in data_dir, set it to enable encryption"))
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 4096))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	keyFile := a.fishes.config().EncryptionKeyFile
+	var raw []byte
+	if len(bytes.TrimSpace(body)) == 0 {
+		if keyFile == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("send the new key in the body, without encryption_key_file there is nowhere to keep a generated one"))
+			return
+		}
+		raw = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	} else if raw, err = parseKey(string(body)); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	h := a.fishes
+	previous := h.keys.current()
+	if _, err := h.keys.rotate(raw); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if keyFile != "" {
+		if err := writeFileAtomic(keyFile, h.keys.keyFile(true)); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf("writing %s failed, nothing was re-encrypted: %s", keyFile, err)))
+			return
+		}
+	}
+	// The stores of the tenants and namespaces share the keys of the main
+	// store, the previous key stays in the key file until all of them are
+	// rewritten.
+	stores := []*fishStore{{h: h, persister: a.persister}}
+	if a.tenants != nil {
+		stores = append(stores, a.tenants.fishStores()...)
+	}
+	for _, store := range stores {
+		if err := store.reseal(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf("re-encrypting %s failed, the previous key still reads what was not rewritten: %s", store.name(), err)))
+			return
+		}
+	}
+
+	status := a.encryptionStatus()
+	if previous != nil {
+		status.PreviousKeyID = previous.id
+	}
+	if keyFile != "" {
+		if err := writeFileAtomic(keyFile, h.keys.keyFile(false)); err != nil {
+			status.Note = fmt.Sprintf("dropping the previous key from %s failed: %s", keyFile, err)
+		}
+	} else {
+		status.Note = "set encryption_key to the new key before the next restart"
+	}
+	writeJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,165 @@
+package fishes
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// After a rotation every store reads with the new key alone, the tenants
+// included, so the next start needs nothing else from the key file.
+func TestRotateKeyResealsTenants(t *testing.T) {
+	dataDir := t.TempDir()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	if err := ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	settings := map[string]string{"ADMIN_PASSWORD": "test", "DATA_DIR": dataDir, "ENCRYPTION_KEY_FILE": keyFile}
+
+	h, close, err := NewHandler(func(key string) string { return settings[key] }, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		method, target, body string
+		want                 int
+	}{
+		{"POST", "/admin/tenants", `{"id":"acme"}`, http.StatusCreated},
+		{"POST", "/t/acme/fishes", `{"name":"Nemo","environment":"saltwater"}`, http.StatusCreated},
+		{"POST", "/fishes", `{"name":"Dory","environment":"saltwater"}`, http.StatusCreated},
+		{"POST", "/admin/encryption/rotate", "", http.StatusOK},
+	}
+	for _, step := range steps {
+		if res := serveAdmin(h, step.method, step.target, "application/json", []byte(step.body)); res.Code != step.want {
+			t.Fatalf("%s %s: %d %s", step.method, step.target, res.Code, res.Body)
+		}
+	}
+	if err := close(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Fields(string(keys)); len(lines) != 1 || lines[0] == base64.StdEncoding.EncodeToString(key) {
+		t.Fatalf("the key file holds %d keys after the rotation, want the new one alone", len(lines))
+	}
+
+	restarted := newTestServer(t, false, settings)
+	for target, name := range map[string]string{"/t/acme/fishes": "Nemo", "/fishes": "Dory"} {
+		res := serveTest(restarted, "GET", target, "", nil)
+		if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), name) {
+			t.Errorf("GET %s after the restart: %d %s, want %s", target, res.Code, res.Body, name)
+		}
+	}
+}
+
+func testKeyring(t *testing.T, keys ...[]byte) *keyring {
+	t.Helper()
+	var specs []string
+	for _, key := range keys {
+		specs = append(specs, base64.StdEncoding.EncodeToString(key))
+	}
+	cfg := defaultConfig()
+	cfg.EncryptionKey = strings.Join(specs, ",")
+	k, err := newKeyring(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestKeyringSealAndOpen(t *testing.T) {
+	oldKey, newKey, otherKey := make([]byte, 32), make([]byte, 32), make([]byte, 32)
+	for _, key := range [][]byte{oldKey, newKey, otherKey} {
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	plain := []byte(`{"name":"Nemo"}`)
+	sealedOld, err := testKeyring(t, oldKey).seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := testKeyring(t, oldKey)
+	if _, err := rotated.rotate(newKey); err != nil {
+		t.Fatal(err)
+	}
+	sealedNew, err := rotated.seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte{}, sealedNew...)
+	tampered[len(tampered)-1] ^= 1
+
+	for _, tc := range []struct {
+		name    string
+		keys    *keyring
+		data    []byte
+		wantErr string
+	}{
+		{"sealed with the current key", testKeyring(t, oldKey), sealedOld, ""},
+		{"sealed before the rotation", rotated, sealedOld, ""},
+		{"sealed after the rotation", rotated, sealedNew, ""},
+		{"plain text", rotated, plain, ""},
+		{"plain text without keys", nil, plain, ""},
+		{"without the new key", testKeyring(t, oldKey), sealedNew, "not among the configured keys"},
+		{"with another key", testKeyring(t, otherKey), sealedOld, "not among the configured keys"},
+		{"without keys", nil, sealedOld, "no encryption_key is configured"},
+		{"modified", rotated, tampered, "the data was modified"},
+		{"truncated", rotated, sealedNew[:len(sealedMagic)+2], "truncated"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.keys.open(tc.data)
+			if tc.wantErr == "" {
+				if err != nil || string(got) != string(plain) {
+					t.Errorf("open = %q, %v; want %q", got, err, plain)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("open error = %v, want one saying %q", err, tc.wantErr)
+			}
+		})
+	}
+
+	if string(sealedNew[:len(sealedMagic)]) != string(sealedMagic) || strings.Contains(string(sealedNew), "Nemo") {
+		t.Errorf("sealed data is not encrypted: %q", sealedNew)
+	}
+	if _, err := rotated.rotate(newKey); err == nil {
+		t.Error("rotating to the current key again was accepted")
+	}
+	if got := rotated.ids(); len(got) != 2 {
+		t.Errorf("the rotated keyring holds %v, want the new key then the old one", got)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	key := make([]byte, 32)
+	for _, tc := range []struct {
+		spec string
+		want int
+		ok   bool
+	}{
+		{"", 0, true},
+		{base64.StdEncoding.EncodeToString(key), 1, true},
+		{strings.Repeat("ab", 32), 1, true},
+		{base64.StdEncoding.EncodeToString(key) + ",\n" + strings.Repeat("ab", 32) + "\n", 2, true},
+		{base64.StdEncoding.EncodeToString(key[:16]), 0, false},
+		{strings.Repeat("ab", 31), 0, false},
+		{"not a key", 0, false},
+	} {
+		keys, err := parseKeys(tc.spec)
+		if (err == nil) != tc.ok || len(keys) != tc.want {
+			t.Errorf("parseKeys(%q) = %d keys, %v; want %d, accepted %v", tc.spec, len(keys), err, tc.want, tc.ok)
+		}
+	}
+}
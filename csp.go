@@ -0,0 +1,80 @@
+package fishes
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// adminTemplates are the admin portal pages. Each is executed with an
+// adminView. Styles and scripts belong in assets/, listed in
+// adminPageAssets to be hinted early; inline <script> and <style> elements
+// must carry nonce="{{.Nonce}}" or the browser refuses to run them.
+var adminTemplates = template.Must(template.New("index").Parse(`<html><h1>Super secret admin portal </h1></html>
+{{- define "cluster-status"}}<!DOCTYPE html>
+<html>
+<head>
+<title>Cluster status</title>
+<link rel="stylesheet" href="/assets/admin.css">
+</head>
+<body>
+<h1>Cluster status</h1>
+<p>As of {{.Data.GeneratedAt.Format "2006-01-02 15:04:05 MST"}}</p>
+<table>
+<tr><th>Node</th><th>Status</th><th>Role</th><th>Term</th><th>Leader or primary</th><th>Seq</th><th>Lag (ops)</th><th>Lag (s)</th><th>Last heartbeat</th><th>Last contact</th><th>Data version</th><th>Error</th></tr>
+{{- range .Data.Nodes}}
+{{- if .Unreachable}}
+<tr class="down"><td>{{.URL}}{{if .Self}} (this node){{end}}</td><td colspan="11">unreachable: {{.Unreachable}}</td></tr>
+{{- else}}
+<tr class="{{.Status}}"><td>{{.URL}}{{if .Self}} (this node){{end}}</td><td>{{.Status}}</td><td>{{.Role}}</td><td>{{.Term}}</td><td>{{if .Leader}}{{.Leader}}{{else}}{{.Primary}}{{end}}</td><td>{{.Seq}}</td><td>{{.LagOps}}</td><td>{{printf "%.1f" .LagSeconds}}</td><td>{{with .LastHeartbeat}}{{.Format "15:04:05"}}{{end}}</td><td>{{with .LastContact}}{{.Format "15:04:05"}}{{end}}</td><td>{{.DataVersion}}</td><td>{{.Error}}</td></tr>
+{{- end}}
+{{- end}}
+</table>
+</body>
+</html>
+{{- end}}`))
+
+type adminView struct {
+	Nonce string
+	Data  interface{}
+}
+
+func cspNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// contentSecurityPolicy only allows scripts and styles from this origin or
+// inline with the nonce of the response.
+func contentSecurityPolicy(nonce string) string {
+	return fmt.Sprintf("default-src 'self'; script-src 'self' 'nonce-%[1]s'; style-src 'self' 'nonce-%[1]s'; object-src 'none'; base-uri 'none'; frame-ancestors 'none'", nonce)
+}
+
+// renderAdmin executes the named admin template with a fresh nonce and sets
+// the matching Content-Security-Policy.
+func renderAdmin(w http.ResponseWriter, name string, data interface{}) {
+	nonce, err := cspNonce()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("could not render the page"))
+		return
+	}
+	var page bytes.Buffer
+	if err := adminTemplates.ExecuteTemplate(&page, name, adminView{Nonce: nonce, Data: data}); err != nil {
+		log.Printf("rendering admin page %s failed: %s", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("could not render the page"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", contentSecurityPolicy(nonce))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(page.Bytes())
+}
@@ -0,0 +1,228 @@
+package fishes
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var importFishesParams = []paramSpec{
+	{name: "on_error", kind: paramEnum, values: []string{"abort", "skip"}, def: "abort"},
+	{name: "map", kind: paramString},
+}
+
+// csvFields are the fish fields a CSV column can map to. Columns named after
+// a field, or after a deprecated alias of one, map to it without a mapping.
+var csvFields = map[string]func(fish *Fish, value string) error{
+	"name": func(fish *Fish, value string) error {
+		fish.Name = value
+		return nil
+	},
+	"scientific_name": func(fish *Fish, value string) error {
+		fish.ScientificName = value
+		return nil
+	},
+	"environment": func(fish *Fish, value string) error {
+		fish.Environment = Environment(strings.ToLower(value))
+		return validateEnvironment(fish.Environment)
+	},
+	"max_length_cm": func(fish *Fish, value string) error {
+		if value == "" {
+			return nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("max_length_cm must be a non-negative whole number, got %q", value)
+		}
+		fish.MaxLength = n
+		return nil
+	},
+}
+
+type csvRowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+type csvImportResult struct {
+	Created        int           `json:"created"`
+	Failed         int           `json:"failed"`
+	IDs            []string      `json:"ids"`
+	Errors         []csvRowError `json:"errors"`
+	IgnoredColumns []string      `json:"ignored_columns,omitempty"`
+}
+
+// csvColumnFields resolves which field each column feeds. mapping is a
+// comma-separated list of column=field pairs that override the defaults.
+func csvColumnFields(header []string, mapping string) ([]string, []string, error) {
+	overrides := map[string]string{}
+	if mapping != "" {
+		for _, pair := range strings.Split(mapping, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				return nil, nil, fmt.Errorf("map entry %q must be column=field", pair)
+			}
+			column, field := strings.ToLower(strings.TrimSpace(parts[0])), strings.TrimSpace(parts[1])
+			if _, ok := csvFields[field]; !ok {
+				return nil, nil, fmt.Errorf("map entry %q names unknown field %q", pair, field)
+			}
+			overrides[column] = field
+		}
+	}
+
+	fields := make([]string, len(header))
+	seen := map[string]bool{}
+	var ignored []string
+	for i, column := range header {
+		key := strings.ToLower(strings.TrimSpace(column))
+		field, ok := overrides[key]
+		if !ok {
+			field = key
+			for _, alias := range fishFieldAliases {
+				if field == alias.deprecated {
+					field = alias.current
+				}
+			}
+		}
+		if _, ok := csvFields[field]; !ok {
+			ignored = append(ignored, column)
+			continue
+		}
+		if seen[field] {
+			return nil, nil, fmt.Errorf("more than one column maps to %s", field)
+		}
+		seen[field] = true
+		fields[i] = field
+	}
+	if !seen["name"] {
+		return nil, nil, fmt.Errorf("no column maps to name")
+	}
+	return fields, ignored, nil
+}
+
+func blankRecord(record []string) bool {
+	for _, value := range record {
+		if strings.TrimSpace(value) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// parseFishCSV turns each CSV row into a fish. Rows are numbered as a
+// spreadsheet shows them, with the header as row 1. An error is returned
+// only when the file as a whole is unusable; bad rows are reported.
+func parseFishCSV(body []byte, mapping string) ([]Fish, []csvRowError, []string, error) {
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("could not read the CSV header: %s", err)
+	}
+	fields, ignored, err := csvColumnFields(header, mapping)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var fishes []Fish
+	rowErrors := []csvRowError{}
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); !ok {
+				return nil, nil, nil, err
+			}
+			rowErrors = append(rowErrors, csvRowError{Row: row, Error: err.Error()})
+			continue
+		}
+		if blankRecord(record) {
+			continue
+		}
+
+		var fish Fish
+		var problems []string
+		for i, value := range record {
+			if i >= len(fields) || fields[i] == "" {
+				continue
+			}
+			if err := csvFields[fields[i]](&fish, strings.TrimSpace(value)); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+		if fish.Name == "" {
+			problems = append(problems, "name is required")
+		}
+		if len(problems) > 0 {
+			rowErrors = append(rowErrors, csvRowError{Row: row, Error: strings.Join(problems, "; ")})
+			continue
+		}
+		fishes = append(fishes, fish)
+	}
+	return fishes, rowErrors, ignored, nil
+}
+
+// importCSV creates a fish per valid CSV row. With on_error=abort nothing is
+// created unless every row is valid; with on_error=skip the valid rows are
+// created and the others reported.
+func (h *fishesHandler) importCSV(w http.ResponseWriter, r *http.Request, q queryValues) {
+	body, ok := readJSONBody(w, r, "text/csv")
+	if !ok {
+		return
+	}
+
+	fishes, rowErrors, ignored, err := parseFishCSV(body, q.str("map"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	result := csvImportResult{IDs: []string{}, Errors: rowErrors, IgnoredColumns: ignored, Failed: len(rowErrors)}
+	if result.Failed > 0 && q.str("on_error") == "abort" {
+		writeJSON(w, http.StatusUnprocessableEntity, result)
+		return
+	}
+
+	h.Lock()
+	if err := h.overQuota(len(fishes)); err != nil {
+		h.Unlock()
+		w.Header().Set("X-Quota-Exceeded", "records")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	for _, fish := range fishes {
+		fish.ID = h.ids.NewID()
+		fish.Version = 1
+		h.assignSlug(&fish)
+		h.stampUpdated(&fish)
+		if _, err := h.put(fish); err != nil {
+			h.Unlock()
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		result.IDs = append(result.IDs, fish.ID)
+	}
+	h.Unlock()
+
+	result.Created = len(result.IDs)
+	setSchemaHeaders(w, r, nil)
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (h *fishesHandler) importFishes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	h.idempotency.wrap(h.clock, h.principal, validateQuery(importFishesParams, h.importCSV))(w, r)
+}
@@ -0,0 +1,180 @@
+package fishes
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// customFieldsFileName is the section of an export archive holding the
+// custom fields of the store, which imports leave out.
+const customFieldsFileName = "custom_fields.json"
+
+var customFieldPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,62}$`)
+
+// customFieldTypes are the types a custom field takes, with how a value of
+// each is described in errors.
+var customFieldTypes = map[string]string{
+	"string": "a string",
+	"int":    "an integer",
+	"number": "a number",
+	"bool":   "a boolean",
+	"time":   "an RFC 3339 time",
+}
+
+// Extensions are the values of the custom fields of a fish, by field name.
+type Extensions map[string]interface{}
+
+// customFields are the fields a tenant adds to its fishes, by name, each
+// with its type. The main store has none.
+type customFields map[string]string
+
+type customFieldSchema struct {
+	Fields customFields `json:"fields"`
+}
+
+func (fields customFields) check() error {
+	for _, name := range fields.names() {
+		if !customFieldPattern.MatchString(name) {
+			return fmt.Errorf("custom field '%s' must be a lowercase letter followed by up to 62 lowercase letters, digits and underscores", name)
+		}
+		if _, ok := customFieldTypes[fields[name]]; !ok {
+			return fmt.Errorf("custom field '%s': type must be one of string, int, number, bool or time", name)
+		}
+	}
+	return nil
+}
+
+func (fields customFields) names() []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func customValueFits(kind string, v interface{}) bool {
+	switch kind {
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "int":
+		n, ok := v.(float64)
+		return ok && n == math.Trunc(n) && math.Abs(n) <= 1<<53
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "bool":
+		_, ok := v.(bool)
+		return ok
+	case "time":
+		s, ok := v.(string)
+		if !ok {
+			return false
+		}
+		_, err := time.Parse(time.RFC3339, s)
+		return err == nil
+	}
+	return false
+}
+
+// validate refuses values of ext that are not custom fields of the store or
+// not of their type. Null values are dropped, as if they were not sent.
+func (fields customFields) validate(ext Extensions) error {
+	names := make([]string, 0, len(ext))
+	for name := range ext {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if ext[name] == nil {
+			delete(ext, name)
+			continue
+		}
+		kind, ok := fields[name]
+		if !ok {
+			if len(fields) == 0 {
+				return fmt.Errorf("this store has no custom fields, extensions cannot be set")
+			}
+			return fmt.Errorf("'%s' is not a custom field of this store, which has %s", name, strings.Join(fields.names(), ", "))
+		}
+		if !customValueFits(kind, ext[name]) {
+			return fmt.Errorf("custom field '%s' must be %s", name, customFieldTypes[kind])
+		}
+	}
+	return nil
+}
+
+// listParams are the query parameters filtering the list on the custom
+// fields, ext.<name> for each.
+func (fields customFields) listParams() []paramSpec {
+	var params []paramSpec
+	for _, name := range fields.names() {
+		p := paramSpec{name: "ext." + name, kind: paramString}
+		switch fields[name] {
+		case "int":
+			p.kind, p.min, p.max = paramInt, math.MinInt32, math.MaxInt32
+		case "number":
+			p.kind = paramNumber
+		case "bool":
+			p.kind = paramBool
+		}
+		params = append(params, p)
+	}
+	return params
+}
+
+// matches is whether fish holds the values of the ext.<name> parameters of
+// q. Times match the same instant whatever the zone.
+func (fields customFields) matches(fish Fish, q queryValues) bool {
+	for name, kind := range fields {
+		param := "ext." + name
+		if !q.has(param) {
+			continue
+		}
+		v, ok := fish.Extensions[name]
+		if !ok {
+			return false
+		}
+		switch kind {
+		case "int", "number":
+			want, _ := strconv.ParseFloat(q.str(param), 64)
+			if n, _ := v.(float64); n != want {
+				return false
+			}
+		case "bool":
+			if b, _ := v.(bool); b != q.bool(param) {
+				return false
+			}
+		case "time":
+			want, err := time.Parse(time.RFC3339, q.str(param))
+			s, _ := v.(string)
+			got, _ := time.Parse(time.RFC3339, s)
+			if err != nil || !got.Equal(want) {
+				return false
+			}
+		default:
+			if s, _ := v.(string); s != q.str(param) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// listParams are the query parameters of the list of h, those of every store
+// and the ones of its custom fields.
+func (h *fishesHandler) listParams() []paramSpec {
+	h.Lock()
+	fields := h.fields
+	h.Unlock()
+	if len(fields) == 0 {
+		return listFishesParams
+	}
+	return append(append([]paramSpec{}, listFishesParams...), fields.listParams()...)
+}
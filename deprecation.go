@@ -0,0 +1,91 @@
+package fishes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var deprecatedRequests = newCounterVec("fishes_deprecated_requests_total", "Requests using a deprecated route, query parameter or body field, by kind and name.", "kind", "name")
+
+// deprecation marks a route of apiDocs, one of its query parameters or a
+// field alias as going away. Responses using it carry the Deprecation and
+// Sunset headers, and a Link to the successor.
+type deprecation struct {
+	// since is when it was deprecated; zero sends Deprecation: true.
+	since time.Time
+	// sunset is when it stops being served, zero while that is not decided.
+	sunset time.Time
+	// successor is the path to use instead, if there is one.
+	successor string
+}
+
+// announce sets the headers of d on w and counts the use of name. When a
+// request uses several deprecated surfaces, the first sets Deprecation and
+// Sunset and each adds its Link.
+func (d deprecation) announce(w http.ResponseWriter, r *http.Request, kind, name string) {
+	deprecatedRequests.inc(kind, name)
+	header := w.Header()
+	if header.Get("Deprecation") == "" {
+		if d.since.IsZero() {
+			header.Set("Deprecation", "true")
+		} else {
+			header.Set("Deprecation", "@"+strconv.FormatInt(d.since.Unix(), 10))
+		}
+	}
+	if !d.sunset.IsZero() && header.Get("Sunset") == "" {
+		header.Set("Sunset", d.sunset.UTC().Format(http.TimeFormat))
+	}
+	if strings.HasPrefix(d.successor, "/") {
+		header.Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, clientPath(r, d.successor)))
+	}
+}
+
+var (
+	documentedOpsOnce sync.Once
+	documentedOps     map[string]map[string]apiOperation
+)
+
+// documentedOp finds the operation of apiDocs serving r, by the route
+// template matchRoute gives.
+func documentedOp(r *http.Request) (string, apiOperation, bool) {
+	documentedOpsOnce.Do(func() {
+		documentedOps = map[string]map[string]apiOperation{}
+		for _, paths := range apiDocs {
+			for _, p := range paths {
+				documentedOps[p.path] = p.ops
+			}
+		}
+	})
+	route := matchRoute(r.URL.Path)
+	op, ok := documentedOps[route][strings.ToLower(r.Method)]
+	return route, op, ok
+}
+
+// withDeprecations announces the deprecated routes and query parameters of
+// apiDocs on the requests using them. Deprecated field aliases are announced
+// as the body is decoded, by setSchemaHeaders.
+func withDeprecations(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, op, ok := documentedOp(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if op.deprecated != nil {
+			op.deprecated.announce(w, r, "route", r.Method+" "+route)
+		}
+		if r.URL.RawQuery != "" {
+			query := r.URL.Query()
+			for _, p := range op.query {
+				if _, used := query[p.name]; used && p.deprecated != nil {
+					p.deprecated.announce(w, r, "query", p.name)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,37 @@
+package fishes
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// docsTemplate is the API explorer. Everything it shows comes from
+// /openapi.json, fetched by assets/docs.js, so it needs nothing from
+// elsewhere and follows the routes as they are added.
+var docsTemplate = template.Must(adminTemplates.New("docs").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Fishes API explorer</title>
+<link rel="stylesheet" href="/assets/docs.css">
+</head>
+<body>
+<h1 id="title">Fishes API explorer</h1>
+<p id="subtitle">Loading /openapi.json ...</p>
+<div id="auth">Admin routes, marked &#128274;, sign in as <code>admin</code>
+<label>password<input type="password" id="password" autocomplete="off"></label></div>
+<div id="paths"></div>
+<script src="/assets/docs.js"></script>
+</body>
+</html>`))
+
+// apiExplorer serves the page to try the API from a browser.
+func apiExplorer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	sendEarlyHints(w, r, "docs")
+	renderAdmin(w, "docs", nil)
+}
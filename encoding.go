@@ -0,0 +1,215 @@
+package fishes
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	jsonContentType    = []string{"application/json"}
+	cacheControlHeader = []string{cacheControlRevalidate}
+	// privateCacheControlHeader keeps shared caches from storing responses
+	// that show sensitive fields.
+	privateCacheControlHeader = []string{"private, " + cacheControlRevalidate}
+	schemaVersionHeader       = []string{strconv.Itoa(fishSchemaVersion)}
+)
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// The representations a fish is sent in, indexing encodedFish.bodies.
+const (
+	bareBody = iota
+	envelopedBody
+	// legacyBody is the JSON /v1 sends, with max_length too.
+	legacyBody
+	legacyEnvelopedBody
+	fishBodies
+)
+
+// fishBody is a fish encoded as one representation, with an ETag of its own.
+type fishBody struct {
+	bytes      []byte
+	etag       string
+	etagHeader []string
+}
+
+// encodedFish holds the serialized forms of a fish so reads don't marshal.
+// Entries are replaced, never mutated, when the fish changes.
+type encodedFish struct {
+	json   []byte
+	bodies [fishBodies]fishBody
+	// etag covers the full fish, it is what writes are checked against.
+	etag    string
+	expires time.Time
+	// modified is the updated_at of the fish, zero when it has none or when
+	// it is hidden from the view.
+	modified       time.Time
+	modifiedHeader []string
+	// private is the encoding with the sensitive fields, nil when the fish
+	// has none.
+	private *encodedFish
+}
+
+// tag sets etag as the ETag of the full fish, and tags each body from it and
+// the bytes of the body, so a body changes its ETag whenever the fish does.
+func (enc *encodedFish) tag(etag string) {
+	enc.etag = etag
+	for i := range enc.bodies {
+		body := &enc.bodies[i]
+		body.etag = representationETag(etag, body.bytes)
+		body.etagHeader = []string{body.etag}
+	}
+}
+
+// matches reports whether ifMatch names enc as a write expects: its full
+// ETag, or that of any body of view, the encoding the writer may see of it.
+func (enc *encodedFish) matches(ifMatch string, view *encodedFish) bool {
+	if etagMatches(ifMatch, enc.etag, false) {
+		return true
+	}
+	for _, body := range view.bodies {
+		if etagMatches(ifMatch, body.etag, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeFish encodes the public view of fish, without sensitive fields. The
+// ETags always cover the full fish so conditional writes see every change.
+func encodeFish(fish Fish) (*encodedFish, error) {
+	enc, err := encodeFishView(fish.redacted())
+	if err != nil || !fish.hasSensitive() {
+		return enc, err
+	}
+	private, err := encodeFishView(fish)
+	if err != nil {
+		return nil, err
+	}
+	enc.tag(private.etag)
+	enc.private = private
+	return enc, nil
+}
+
+// view picks the encoding r is allowed to see. Fields a redaction policy
+// hides from r are taken out of it, its bodies tagged from what is left of
+// them and the full fish.
+func (h *fishesHandler) view(r *http.Request, enc *encodedFish) *encodedFish {
+	if enc.private != nil && h.revealSensitive(r) {
+		enc = enc.private
+	}
+	hidden := h.redactions.hidden(r)
+	if hidden == nil {
+		return enc
+	}
+	var fish Fish
+	if err := json.Unmarshal(enc.json, &fish); err != nil {
+		return enc
+	}
+	redacted, err := encodeFishView(hideFields(fish, hidden))
+	if err != nil {
+		return enc
+	}
+	redacted.tag(enc.etag)
+	redacted.expires = enc.expires
+	return redacted
+}
+
+func encodeFishView(fish Fish) (*encodedFish, error) {
+	jsonBytes, err := json.Marshal(fish)
+	if err != nil {
+		return nil, err
+	}
+
+	enc := &encodedFish{json: jsonBytes}
+	enc.bodies[bareBody].bytes = jsonBytes
+	enc.bodies[envelopedBody].bytes = envelope(jsonBytes)
+	enc.bodies[legacyBody] = enc.bodies[bareBody]
+	enc.bodies[legacyEnvelopedBody] = enc.bodies[envelopedBody]
+	if fish.MaxLength > 0 {
+		legacy, err := json.Marshal(v1Fish{Fish: fish, LegacyMaxLength: fish.MaxLength})
+		if err != nil {
+			return nil, err
+		}
+		enc.bodies[legacyBody].bytes = legacy
+		enc.bodies[legacyEnvelopedBody].bytes = envelope(legacy)
+	}
+	enc.tag(contentETag(jsonBytes))
+	if fish.ExpiresAt != nil {
+		enc.expires = *fish.ExpiresAt
+	}
+	if fish.UpdatedAt != nil {
+		enc.modified = *fish.UpdatedAt
+		enc.modifiedHeader = []string{fish.UpdatedAt.UTC().Format(http.TimeFormat)}
+	}
+	return enc, nil
+}
+
+func envelope(jsonBytes []byte) []byte {
+	enveloped := make([]byte, 0, len(jsonBytes)+9)
+	enveloped = append(enveloped, `{"data":`...)
+	enveloped = append(enveloped, jsonBytes...)
+	return append(enveloped, '}')
+}
+
+// put stores fish and refreshes its cached encoding. Callers must hold the lock.
+func (h *fishesHandler) put(fish Fish) (*encodedFish, error) {
+	enc, err := encodeFish(fish)
+	if err != nil {
+		return nil, err
+	}
+	if h.oplog != nil {
+		if err := h.oplog.put(fish); err != nil {
+			return nil, err
+		}
+	}
+
+	if h.crdt != nil {
+		h.crdt.touch(fish)
+	}
+	h.db[fish.ID] = fish
+	h.setEncoded(fish.ID, enc)
+	if h.archive != nil {
+		h.archive.touch(fish.ID, h.clock.Now())
+	}
+	h.bumpVersion()
+	h.dirty = true
+	h.cache.invalidate("fishes")
+	return enc, nil
+}
+
+// fishPath splits /fishes/{id}[/{sub}] into the id and the optional
+// sub-resource path.
+func fishPath(path string) (string, string, bool) {
+	id := strings.TrimPrefix(path, "/fishes/")
+	if len(id) == len(path) {
+		return "", "", false
+	}
+	sub := ""
+	if i := strings.IndexByte(id, '/'); i >= 0 {
+		id, sub = id[:i], id[i+1:]
+		if sub == "" {
+			return "", "", false
+		}
+	}
+	if id == "" {
+		return "", "", false
+	}
+	return id, sub, true
+}
@@ -0,0 +1,99 @@
+package fishes
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+type listMeta struct {
+	Total   int    `json:"total"`
+	Limit   int    `json:"limit"`
+	Offset  int    `json:"offset"`
+	Version uint64 `json:"version"`
+}
+
+type listLinks struct {
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+type listEnvelope struct {
+	Data  interface{} `json:"data"`
+	Meta  listMeta    `json:"meta"`
+	Links listLinks   `json:"links"`
+}
+
+func (h *fishesHandler) wantsEnvelope(r *http.Request) bool {
+	if apiVersion(r) >= 2 {
+		return true
+	}
+	if r.URL.RawQuery == "" {
+		return h.config().ResponseEnvelope
+	}
+	if v := r.URL.Query().Get("envelope"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err == nil {
+			return enabled
+		}
+	}
+	return h.config().ResponseEnvelope
+}
+
+func pageLink(r *http.Request, limit, offset int) string {
+	q := r.URL.Query()
+	q.Set("limit", strconv.Itoa(limit))
+	q.Set("offset", strconv.Itoa(offset))
+	link := url.URL{Path: clientPath(r, r.URL.Path), RawQuery: q.Encode()}
+	return link.String()
+}
+
+func newListEnvelope(r *http.Request, data interface{}, meta listMeta) listEnvelope {
+	var links listLinks
+	if meta.Offset+meta.Limit < meta.Total {
+		links.Next = pageLink(r, meta.Limit, meta.Offset+meta.Limit)
+	}
+	if meta.Offset > 0 {
+		prev := meta.Offset - meta.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		links.Prev = pageLink(r, meta.Limit, prev)
+	}
+	return listEnvelope{Data: data, Meta: meta, Links: links}
+}
+
+// itemBody gives what r is sent of a fish: its JSON as the API version of r
+// shows it, in the envelope when r wants one.
+func (h *fishesHandler) itemBody(r *http.Request, enc *encodedFish) *fishBody {
+	enveloped := h.wantsEnvelope(r)
+	switch {
+	case apiVersion(r) >= 2 && enveloped:
+		return &enc.bodies[envelopedBody]
+	case apiVersion(r) >= 2:
+		return &enc.bodies[bareBody]
+	case enveloped:
+		return &enc.bodies[legacyEnvelopedBody]
+	}
+	return &enc.bodies[legacyBody]
+}
+
+func marshalListBody(buf *bytes.Buffer, r *http.Request, enveloped bool, data interface{}, meta listMeta) error {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+
+	var err error
+	if enveloped {
+		err = enc.Encode(newListEnvelope(r, data, meta))
+	} else {
+		err = enc.Encode(data)
+	}
+	if err != nil {
+		return err
+	}
+
+	buf.Truncate(buf.Len() - 1)
+	return nil
+}
@@ -0,0 +1,76 @@
+package fishes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type Environment string
+
+const (
+	Freshwater Environment = "freshwater"
+	Saltwater  Environment = "saltwater"
+	Brackish   Environment = "brackish"
+)
+
+var environments = []Environment{Freshwater, Saltwater, Brackish}
+
+var environmentLabels = map[Environment]string{
+	Freshwater: "Freshwater",
+	Saltwater:  "Saltwater",
+	Brackish:   "Brackish",
+}
+
+func (e Environment) valid() bool {
+	_, ok := environmentLabels[e]
+	return ok
+}
+
+func environmentNames() []string {
+	names := make([]string, len(environments))
+	for i, env := range environments {
+		names[i] = string(env)
+	}
+	return names
+}
+
+func validateEnvironment(e Environment) error {
+	if e == "" || e.valid() {
+		return nil
+	}
+	return fmt.Errorf("invalid environment '%s', must be one of: %s", e, strings.Join(environmentNames(), ", "))
+}
+
+type environmentOption struct {
+	Value Environment `json:"value"`
+	Label string      `json:"label"`
+}
+
+func getEnvironments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+
+	loc := localeOf(r)
+	options := make([]environmentOption, len(environments))
+	for i, env := range environments {
+		options[i] = environmentOption{Value: env, Label: loc.environmentLabel(env)}
+	}
+
+	jsonBytes, err := json.Marshal(options)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Add("content-type", "application/json")
+	w.Header().Set("Content-Language", loc.language())
+	w.Header().Add("Vary", "Accept-Language")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
@@ -0,0 +1,112 @@
+package fishes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const cacheControlRevalidate = "no-cache"
+
+func contentETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// representationETag tags body, one of the ways a fish whose full encoding
+// is tagged etag is sent, apart from the others.
+func representationETag(etag string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(etag))
+	h.Write(body)
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// collectionETag tags a list at version, apart for each query and each
+// representation of the list, the API version and the envelope.
+func collectionETag(version uint64, rawQuery string, api int, enveloped bool) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d %t %s", api, enveloped, rawQuery)))
+	return fmt.Sprintf(`"c%d-%s"`, version, hex.EncodeToString(sum[:8]))
+}
+
+// bumpVersion marks the collection changed, for its ETag and its
+// Last-Modified. Callers must hold the lock.
+func (h *fishesHandler) bumpVersion() {
+	h.version++
+	h.modified = h.clock.Now().UTC()
+}
+
+// stampUpdated sets the updated_at of a fish written by a client.
+func (h *fishesHandler) stampUpdated(fish *Fish) {
+	now := h.clock.Now().UTC()
+	fish.UpdatedAt = &now
+}
+
+// etagMatches reports whether etag is listed in an If-None-Match or If-Match
+// header value. Weak comparison ignores the W/ prefix.
+func etagMatches(header, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		} else if strings.HasPrefix(candidate, "W/") {
+			continue
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControlRevalidate)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	inm := r.Header.Get("If-None-Match")
+	if inm != "" && etagMatches(inm, etag, true) || notModifiedSince(r, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// setLastModified gives the response the updated_at of enc.
+func setLastModified(w http.ResponseWriter, enc *encodedFish) {
+	if enc.modifiedHeader != nil {
+		w.Header()["Last-Modified"] = enc.modifiedHeader
+	}
+}
+
+// notModifiedSince reports whether the If-Modified-Since of a GET holds for
+// modified, which Last-Modified gives to the second. It is ignored along
+// with an If-None-Match, and for what has no modification time.
+func notModifiedSince(r *http.Request, modified time.Time) bool {
+	raw := r.Header.Get("If-Modified-Since")
+	if raw == "" || modified.IsZero() || r.Header.Get("If-None-Match") != "" || (r.Method != "GET" && r.Method != "HEAD") {
+		return false
+	}
+	since, err := http.ParseTime(raw)
+	return err == nil && !modified.Truncate(time.Second).After(since)
+}
+
+// modifiedSince reports whether a write fails its If-Unmodified-Since for
+// modified. It is ignored along with an If-Match, and for what has no
+// modification time.
+func modifiedSince(r *http.Request, modified time.Time) bool {
+	raw := r.Header.Get("If-Unmodified-Since")
+	if raw == "" || modified.IsZero() || r.Header.Get("If-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(raw)
+	return err == nil && modified.Truncate(time.Second).After(since)
+}
@@ -0,0 +1,36 @@
+package fishes
+
+import (
+	"log"
+	"time"
+)
+
+func (f Fish) expired(now time.Time) bool {
+	return f.ExpiresAt != nil && !now.Before(*f.ExpiresAt)
+}
+
+// sweepExpired moves every fish past its expires_at to the trash, which
+// records a delete in the operation log. Callers must hold the lock.
+func (h *fishesHandler) sweepExpired(now time.Time) (int, error) {
+	swept := 0
+	for id, fish := range h.db {
+		if !fish.expired(now) {
+			continue
+		}
+		if err := h.remove(id, now); err != nil {
+			return swept, err
+		}
+		swept++
+	}
+	return swept, nil
+}
+
+func (h *fishesHandler) sweepExpiredNow() error {
+	h.Lock()
+	n, err := h.sweepExpired(h.clock.Now().UTC())
+	h.Unlock()
+	if n > 0 {
+		log.Printf("moved %d expired fishes to the trash", n)
+	}
+	return err
+}
@@ -0,0 +1,237 @@
+package fishes
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// explorerResources are the collections of the main store the data
+// explorer queries: the fishes in memory, those in the cold archive, and
+// those in the trash.
+var explorerResources = []string{"fishes", "archive", "trash"}
+
+// explorerColumns are the columns of the results, in the CSV as on the
+// page. /fishes/import takes the CSV back.
+var explorerColumns = []string{"id", "name", "slug", "scientific_name", "environment", "max_length_cm", "owner_contact", "version", "updated_at", "expires_at", "deleted_at"}
+
+// explorerParams filter and sort as list, those of the list of a store, do
+// over any of the resources. format=csv downloads every match, not only a
+// page of them.
+func explorerParams(list []paramSpec) []paramSpec {
+	params := []paramSpec{
+		{name: "resource", kind: paramEnum, values: explorerResources, def: "fishes"},
+		{name: "format", kind: paramEnum, values: []string{"json", "csv"}, def: "json"},
+	}
+	for _, p := range list {
+		if p.name != "envelope" {
+			params = append(params, p)
+		}
+	}
+	return params
+}
+
+type explorerResult struct {
+	Resource string     `json:"resource"`
+	Total    int        `json:"total"`
+	Limit    int        `json:"limit"`
+	Offset   int        `json:"offset"`
+	Columns  []string   `json:"columns"`
+	Rows     [][]string `json:"rows"`
+}
+
+// explorerPage is what the explorer page shows of a query.
+type explorerPage struct {
+	explorerResult
+	Query        queryValues
+	Resources    []string
+	Environments []string
+	Sorts        []string
+	CSV          string
+	Previous     string
+	Next         string
+}
+
+func explorerRow(fish Fish) []string {
+	times := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+	maxLength := ""
+	if fish.MaxLength > 0 {
+		maxLength = strconv.Itoa(fish.MaxLength)
+	}
+	return []string{fish.ID, fish.Name, fish.Slug, fish.ScientificName, string(fish.Environment), maxLength, fish.OwnerContact,
+		strconv.Itoa(fish.Version), times(fish.UpdatedAt), times(fish.ExpiresAt), times(fish.DeletedAt)}
+}
+
+// spreadsheetSafe quotes the cells of a CSV row that spreadsheets would
+// take for formulas, those starting with =, +, -, @, a tab or a carriage
+// return, with a leading '.
+func spreadsheetSafe(row []string) []string {
+	for i, cell := range row {
+		if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+			row[i] = "'" + cell
+		}
+	}
+	return row
+}
+
+// explorerFishes gives the fishes of resource matching q, sorted.
+func (h *fishesHandler) explorerFishes(resource string, q queryValues) ([]Fish, error) {
+	now := h.clock.Now()
+	h.Lock()
+	var fishes []Fish
+	var err error
+	switch resource {
+	case "fishes":
+		for _, fish := range h.db {
+			fishes = append(fishes, fish)
+		}
+	case "archive":
+		if h.archive != nil {
+			fishes, err = h.archive.fishes()
+		}
+	case "trash":
+		for _, fish := range h.trash {
+			fishes = append(fishes, fish)
+		}
+	}
+	h.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	matching := []Fish{}
+	for _, fish := range fishes {
+		if resource != "trash" && !q.bool("include_expired") && fish.expired(now) {
+			continue
+		}
+		if matchesFishFilter(fish, q) && h.fields.matches(fish, q) {
+			matching = append(matching, fish)
+		}
+	}
+	sortFishes(matching, q.str("sort"))
+	return matching, nil
+}
+
+// explore runs ad-hoc queries over the resources of the main store, for
+// operators. It answers JSON, the results as CSV with format=csv, checksum
+// trailers after them, and to browsers a page with a form for the query. The fields the form leaves
+// empty are not taken as parameters.
+func (a *adminPortal) explore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	query := r.URL.Query()
+	for name, values := range query {
+		if len(values) == 1 && values[0] == "" {
+			query.Del(name)
+		}
+	}
+	r2 := r.Clone(r.Context())
+	r2.URL.RawQuery = query.Encode()
+	validateQuery(explorerParams(a.fishes.listParams()), a.fishes.explore)(w, r2)
+}
+
+func (h *fishesHandler) explore(w http.ResponseWriter, r *http.Request, q queryValues) {
+	resource := q.str("resource")
+	fishes, err := h.explorerFishes(resource, q)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	h.visibleFishes(r, fishes)
+
+	if q.str("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.csv"`, resource, time.Now().UTC().Format("20060102T150405Z")))
+		body, finish := withChecksumTrailers(w)
+		cw := csv.NewWriter(body)
+		cw.Write(explorerColumns)
+		for _, fish := range fishes {
+			cw.Write(spreadsheetSafe(explorerRow(fish)))
+		}
+		cw.Flush()
+		finish(len(fishes))
+		return
+	}
+
+	result := explorerResult{Resource: resource, Total: len(fishes), Limit: q.int("limit"), Offset: q.int("offset"), Columns: explorerColumns, Rows: [][]string{}}
+	for _, fish := range paginateFishes(fishes, result.Limit, result.Offset) {
+		result.Rows = append(result.Rows, explorerRow(fish))
+	}
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+
+	page := explorerPage{explorerResult: result, Query: q, Resources: explorerResources, Environments: environmentNames()}
+	for _, p := range h.listParams() {
+		if p.name == "sort" {
+			page.Sorts = p.values
+		}
+	}
+	link := func(change func(url.Values)) string {
+		values := r.URL.Query()
+		change(values)
+		return "/admin/explorer?" + values.Encode()
+	}
+	page.CSV = link(func(v url.Values) { v.Set("format", "csv"); v.Del("limit"); v.Del("offset") })
+	if result.Offset > 0 {
+		previous := result.Offset - result.Limit
+		if previous < 0 {
+			previous = 0
+		}
+		page.Previous = link(func(v url.Values) { v.Set("offset", strconv.Itoa(previous)) })
+	}
+	if result.Offset+result.Limit < result.Total {
+		page.Next = link(func(v url.Values) { v.Set("offset", strconv.Itoa(result.Offset+result.Limit)) })
+	}
+	sendEarlyHints(w, r, "explorer")
+	renderAdmin(w, "explorer", page)
+}
+
+var explorerTemplate = template.Must(adminTemplates.New("explorer").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Data explorer</title>
+<link rel="stylesheet" href="/assets/admin.css">
+</head>
+<body>
+<h1>Data explorer</h1>
+<form method="get" action="/admin/explorer">
+<label>Resource <select name="resource">{{range .Data.Resources}}<option{{if eq . $.Data.Resource}} selected{{end}}>{{.}}</option>{{end}}</select></label>
+<label>Environment <select name="environment"><option value="">any</option>{{range .Data.Environments}}<option{{if eq . (index $.Data.Query "environment")}} selected{{end}}>{{.}}</option>{{end}}</select></label>
+<label>Name contains <input name="name" value="{{index .Data.Query "name"}}"></label>
+<label>Length from <input name="min_length" size="5" value="{{index .Data.Query "min_length"}}"></label>
+<label>to <input name="max_length" size="5" value="{{index .Data.Query "max_length"}}"> cm</label>
+<label><input type="checkbox" name="include_expired" value="true"{{if eq (index .Data.Query "include_expired") "true"}} checked{{end}}> expired too</label>
+<label>Sort by <select name="sort">{{range .Data.Sorts}}<option{{if eq . (index $.Data.Query "sort")}} selected{{end}}>{{.}}</option>{{end}}</select></label>
+<label>Per page <input name="limit" size="5" value="{{.Data.Limit}}"></label>
+<button type="submit">Query</button>
+</form>
+<p>{{.Data.Total}} {{.Data.Resource}} match{{if .Data.Total}}, showing {{len .Data.Rows}} from {{.Data.Offset}}{{end}}.
+<a href="{{.Data.CSV}}">Download them all as CSV</a>
+{{- with .Data.Previous}} <a href="{{.}}">Previous</a>{{end}}
+{{- with .Data.Next}} <a href="{{.}}">Next</a>{{end}}</p>
+{{- if .Data.Rows}}
+<table>
+<tr>{{range .Data.Columns}}<th>{{.}}</th>{{end}}</tr>
+{{- range .Data.Rows}}
+<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{- end}}
+</table>
+{{- end}}
+</body>
+</html>`))
@@ -0,0 +1,371 @@
+package fishes
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	exportFormat        = "fishes-export"
+	exportFormatVersion = 1
+	exportManifestName  = "manifest.json"
+)
+
+type exportFile struct {
+	Name    string `json:"name"`
+	SHA256  string `json:"sha256"`
+	Bytes   int    `json:"bytes"`
+	Records int    `json:"records"`
+}
+
+type exportManifest struct {
+	Format         string       `json:"format"`
+	FormatVersion  int          `json:"format_version"`
+	SchemaVersion  int          `json:"schema_version"`
+	DatasetVersion uint64       `json:"dataset_version"`
+	CreatedAt      time.Time    `json:"created_at"`
+	Files          []exportFile `json:"files"`
+}
+
+type exportSection struct {
+	name    string
+	data    []byte
+	records int
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// exportSections serializes every dataset so the archive reflects a single
+// consistent version of the store.
+func (h *fishesHandler) exportSections() ([]exportSection, uint64, error) {
+	h.Lock()
+	snap, err := h.fullSnapshot()
+	fields := h.fields
+	h.Unlock()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if snap.Fishes, err = h.keys.sealFishes(snap.Fishes); err != nil {
+		return nil, 0, err
+	}
+	if snap.Trash, err = h.keys.sealFishes(snap.Trash); err != nil {
+		return nil, 0, err
+	}
+
+	fishes, err := json.MarshalIndent(snap.Fishes, "", "  ")
+	if err != nil {
+		return nil, 0, err
+	}
+	trash, err := json.MarshalIndent(snap.Trash, "", "  ")
+	if err != nil {
+		return nil, 0, err
+	}
+	slugs, err := json.MarshalIndent(snap.Slugs, "", "  ")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sections := []exportSection{
+		{name: "fishes.json", data: fishes, records: len(snap.Fishes)},
+		{name: "trash.json", data: trash, records: len(snap.Trash)},
+		{name: "slugs.json", data: slugs, records: len(snap.Slugs)},
+	}
+	if len(fields) > 0 {
+		schema, err := json.MarshalIndent(customFieldSchema{Fields: fields}, "", "  ")
+		if err != nil {
+			return nil, 0, err
+		}
+		sections = append(sections, exportSection{name: customFieldsFileName, data: schema, records: len(fields)})
+	}
+	return sections, snap.Version, nil
+}
+
+func newExportManifest(sections []exportSection, version uint64, now time.Time) exportManifest {
+	manifest := exportManifest{
+		Format:         exportFormat,
+		FormatVersion:  exportFormatVersion,
+		SchemaVersion:  fishSchemaVersion,
+		DatasetVersion: version,
+		CreatedAt:      now,
+	}
+	for _, section := range sections {
+		manifest.Files = append(manifest.Files, exportFile{
+			Name:    section.name,
+			SHA256:  checksum(section.data),
+			Bytes:   len(section.data),
+			Records: section.records,
+		})
+	}
+	return manifest
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// writeExportArchive writes the manifest followed by every section as a
+// gzipped tar stream.
+func writeExportArchive(w io.Writer, sections []exportSection, version uint64, now time.Time) error {
+	manifest, err := json.MarshalIndent(newExportManifest(sections, version, now), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := writeTarFile(tw, exportManifestName, manifest, now); err != nil {
+		return err
+	}
+	for _, section := range sections {
+		if err := writeTarFile(tw, section.name, section.data, now); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// exportArtifact is an export archive written out once, so that a download
+// cut short resumes with a Range against the same bytes. It is a file of
+// data_dir/exports, sealed as the rest of data_dir when encryption is on,
+// and kept in memory without a data_dir.
+type exportArtifact struct {
+	key     string
+	path    string
+	data    []byte
+	sealed  bool
+	etag    string
+	created time.Time
+
+	// readers are the downloads of the artifact in flight. A replaced one
+	// is removed once the last of them is done.
+	readers  int
+	replaced bool
+}
+
+// exportArtifacts keeps the archive of the latest version of a store, and
+// writes another once the store has changed.
+type exportArtifacts struct {
+	sync.Mutex
+	latest *exportArtifact
+}
+
+// exportKey tells the versions of a store apart, custom fields included,
+// which change without a new dataset version.
+func (h *fishesHandler) exportKey() (string, error) {
+	h.Lock()
+	version, fields := h.version, h.fields
+	h.Unlock()
+	schema, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%s", version, checksum(schema)), nil
+}
+
+// writeExportArtifact writes the archive of the store as it is.
+func (h *fishesHandler) writeExportArtifact(key string) (*exportArtifact, error) {
+	sections, version, err := h.exportSections()
+	if err != nil {
+		return nil, err
+	}
+	artifact := &exportArtifact{key: key, created: time.Now().UTC()}
+	var buf bytes.Buffer
+	if err := writeExportArchive(&buf, sections, version, artifact.created); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	artifact.etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	dataDir := h.config().DataDir
+	if dataDir == "" {
+		artifact.data = buf.Bytes()
+		return artifact, nil
+	}
+	data, err := h.keys.seal(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	artifact.sealed = h.keys.current() != nil
+
+	dir := filepath.Join(dataDir, "exports")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile(dir, "fishes-export-*.tar.gz")
+	if err != nil {
+		return nil, err
+	}
+	artifact.path = file.Name()
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(artifact.path)
+		return nil, err
+	}
+	return artifact, nil
+}
+
+// acquireExport gives the archive of the store as it is, written once per
+// version, for a download to read until it releases it.
+func (h *fishesHandler) acquireExport() (*exportArtifact, error) {
+	h.exports.Lock()
+	defer h.exports.Unlock()
+
+	key, err := h.exportKey()
+	if err != nil {
+		return nil, err
+	}
+	latest := h.exports.latest
+	if latest != nil && latest.key == key && latest.exists() {
+		latest.readers++
+		return latest, nil
+	}
+
+	artifact, err := h.writeExportArtifact(key)
+	if err != nil {
+		return nil, err
+	}
+	if latest != nil {
+		latest.replaced = true
+		latest.remove()
+	}
+	artifact.readers++
+	h.exports.latest = artifact
+	return artifact, nil
+}
+
+func (h *fishesHandler) releaseExport(artifact *exportArtifact) {
+	h.exports.Lock()
+	defer h.exports.Unlock()
+	artifact.readers--
+	artifact.remove()
+}
+
+func (a *exportArtifact) exists() bool {
+	if a.path == "" {
+		return true
+	}
+	_, err := os.Stat(a.path)
+	return err == nil
+}
+
+// remove deletes the file of a replaced artifact nobody reads any more.
+// Callers must hold the lock of the exportArtifacts.
+func (a *exportArtifact) remove() error {
+	if !a.replaced || a.readers > 0 || a.path == "" {
+		return nil
+	}
+	err := os.Remove(a.path)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+// content opens the archive for reading, unsealed.
+func (a *exportArtifact) content(keys *keyring) (io.ReadSeeker, error) {
+	if a.path == "" {
+		return bytes.NewReader(a.data), nil
+	}
+	if !a.sealed {
+		return os.Open(a.path)
+	}
+	data, err := ioutil.ReadFile(a.path)
+	if err == nil {
+		data, err = keys.open(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// removeExportArtifact deletes the file of the latest archive, as the
+// server shuts down.
+func (h *fishesHandler) removeExportArtifact() error {
+	h.exports.Lock()
+	defer h.exports.Unlock()
+	latest := h.exports.latest
+	if latest == nil {
+		return nil
+	}
+	h.exports.latest = nil
+	latest.replaced, latest.readers = true, 0
+	return latest.remove()
+}
+
+// serveExport sends the fishes of a store as an export archive, named after
+// the store unless it is the main one, which /admin/import takes alike. The
+// archive has a strong ETag and honors Range and If-Range, so a download
+// cut short resumes where it stopped as long as the store has not changed.
+func (h *fishesHandler) serveExport(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+
+	artifact, err := h.acquireExport()
+	var content io.ReadSeeker
+	if err == nil {
+		defer h.releaseExport(artifact)
+		content, err = artifact.content(h.keys)
+	}
+	if err != nil {
+		if name == "" {
+			log.Printf("export failed: %s", err)
+		} else {
+			log.Printf("export of %s failed: %s", name, err)
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if file, ok := content.(*os.File); ok {
+		defer file.Close()
+	}
+
+	filename := "fishes-export-" + artifact.created.Format("20060102T150405Z") + ".tar.gz"
+	if name != "" {
+		filename = "fishes-export-" + name + "-" + artifact.created.Format("20060102T150405Z") + ".tar.gz"
+	}
+	w.Header().Set("content-type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Header().Set("ETag", artifact.etag)
+	http.ServeContent(w, r, "", artifact.created, content)
+}
+
+func (a *adminPortal) export(w http.ResponseWriter, r *http.Request) {
+	a.fishes.serveExport(w, r, "")
+}
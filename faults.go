@@ -0,0 +1,209 @@
+package fishes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var injectedFaults = newCounterVec("fishes_injected_faults_total", "Faults injected by /admin/faults rules by kind.", "kind")
+
+// faultRule slows down, fails or corrupts a share of the requests to a
+// route, for client teams to try their retries and timeouts against.
+type faultRule struct {
+	// Route is a path, matching itself and everything under it; empty
+	// matches every route but the admin portal, which is never touched.
+	Route   string   `json:"route"`
+	Methods []string `json:"methods,omitempty"`
+	// Latency is added before the request is handled, plus up to Jitter
+	// more. Both are durations such as 250ms.
+	Latency string `json:"latency,omitempty"`
+	Jitter  string `json:"jitter,omitempty"`
+	// ErrorRate is the share of requests, from 0 to 1, answered with
+	// ErrorStatus, 500 by default, without being handled.
+	ErrorRate   float64 `json:"error_rate,omitempty"`
+	ErrorStatus int     `json:"error_status,omitempty"`
+	// ErrorMessage is the body of those answers.
+	ErrorMessage string `json:"error_message,omitempty"`
+	// CorruptRate is the share of responses whose body is cut short and
+	// has a byte flipped.
+	CorruptRate float64 `json:"corrupt_rate,omitempty"`
+
+	latency, jitter time.Duration
+}
+
+func (rule *faultRule) parse() error {
+	if rule.Route != "" && !strings.HasPrefix(rule.Route, "/") {
+		return fmt.Errorf("route '%s' must start with /", rule.Route)
+	}
+	if strings.HasPrefix(rule.Route, "/admin") {
+		return fmt.Errorf("route '%s' is in the admin portal, which faults are not injected into", rule.Route)
+	}
+	for i, m := range rule.Methods {
+		rule.Methods[i] = strings.ToUpper(m)
+	}
+	var err error
+	if rule.Latency != "" {
+		if rule.latency, err = time.ParseDuration(rule.Latency); err != nil || rule.latency < 0 {
+			return fmt.Errorf("latency '%s' is not a duration such as 250ms", rule.Latency)
+		}
+	}
+	if rule.Jitter != "" {
+		if rule.jitter, err = time.ParseDuration(rule.Jitter); err != nil || rule.jitter < 0 {
+			return fmt.Errorf("jitter '%s' is not a duration such as 250ms", rule.Jitter)
+		}
+	}
+	if rule.ErrorRate < 0 || rule.ErrorRate > 1 || rule.CorruptRate < 0 || rule.CorruptRate > 1 {
+		return fmt.Errorf("error_rate and corrupt_rate must be between 0 and 1")
+	}
+	if rule.ErrorStatus == 0 {
+		rule.ErrorStatus = http.StatusInternalServerError
+	}
+	if rule.ErrorStatus < 400 || rule.ErrorStatus > 599 {
+		return fmt.Errorf("error_status must be a 4xx or 5xx status, got %d", rule.ErrorStatus)
+	}
+	return nil
+}
+
+func (rule *faultRule) matches(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/admin") {
+		return false
+	}
+	route := strings.TrimSuffix(rule.Route, "/")
+	if route != "" && r.URL.Path != route && !strings.HasPrefix(r.URL.Path, route+"/") {
+		return false
+	}
+	if len(rule.Methods) == 0 {
+		return true
+	}
+	for _, m := range rule.Methods {
+		if m == r.Method {
+			return true
+		}
+	}
+	return false
+}
+
+// faultInjector applies the first rule matching each request. There are no
+// rules until /admin/faults sets some, and they are forgotten on restart.
+type faultInjector struct {
+	random RandSource
+
+	sync.Mutex
+	rules []faultRule
+}
+
+func (f *faultInjector) chance(rate float64) bool {
+	return rate > 0 && float64(f.random.Intn(1000000)) < rate*1000000
+}
+
+func (f *faultInjector) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.Lock()
+		var rule *faultRule
+		for i := range f.rules {
+			if f.rules[i].matches(r) {
+				matched := f.rules[i]
+				rule = &matched
+				break
+			}
+		}
+		f.Unlock()
+		if rule == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if delay := rule.latency; delay > 0 || rule.jitter > 0 {
+			if rule.jitter > 0 {
+				delay += time.Duration(f.random.Intn(int(rule.jitter) + 1))
+			}
+			injectedFaults.inc("latency")
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if f.chance(rule.ErrorRate) {
+			injectedFaults.inc("error")
+			w.Header().Set("X-Fish-Fault", "error")
+			w.WriteHeader(rule.ErrorStatus)
+			if rule.ErrorMessage != "" {
+				w.Write([]byte(rule.ErrorMessage))
+			} else {
+				w.Write([]byte("fault injected by /admin/faults"))
+			}
+			return
+		}
+		if !f.chance(rule.CorruptRate) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		res := &jobResponse{header: w.Header()}
+		next.ServeHTTP(res, r)
+		body := res.body.Bytes()
+		if len(body) > 0 {
+			injectedFaults.inc("corrupt")
+			body = body[:1+f.random.Intn(len(body))]
+			body[f.random.Intn(len(body))] ^= 0xff
+			w.Header().Set("X-Fish-Fault", "corrupt")
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		if res.status == 0 {
+			res.status = http.StatusOK
+		}
+		w.WriteHeader(res.status)
+		w.Write(body)
+	})
+}
+
+type faultRules struct {
+	Rules []faultRule `json:"rules"`
+}
+
+// serve shows the rules on GET, replaces them on PUT and removes them all
+// on DELETE.
+func (f *faultInjector) serve(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		body, ok := readJSONBody(w, r)
+		if !ok {
+			return
+		}
+		var next faultRules
+		if err := json.Unmarshal(body, &next); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		for i := range next.Rules {
+			if err := next.Rules[i].parse(); err != nil {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.Write([]byte(fmt.Sprintf("rule %d: %s", i, err)))
+				return
+			}
+		}
+		f.Lock()
+		f.rules = next.Rules
+		f.Unlock()
+	case "DELETE":
+		f.Lock()
+		f.rules = nil
+		f.Unlock()
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	f.Lock()
+	current := faultRules{Rules: append([]faultRule{}, f.rules...)}
+	f.Unlock()
+	writeJSON(w, http.StatusOK, current)
+}
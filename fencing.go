@@ -0,0 +1,139 @@
+package fishes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var errFenced = errors.New("this node is no longer the cluster leader")
+
+// fencingToken is the term writes are made in while this node leads under a
+// running lease. It is checked again as every write enters the operation
+// log, so a leader deposed while a request was under way does not write.
+func (c *clusterNode) fencingToken() (uint64, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.role != roleLeader || !time.Now().Before(c.leaseUntil) {
+		return 0, errFenced
+	}
+	return c.Term, nil
+}
+
+// fenceWrites makes the operation log refuse writes unless this node leads.
+// Seeding happens before, since every node starts as a follower.
+func (c *clusterNode) fenceWrites() {
+	h := c.fishes
+	h.Lock()
+	h.oplog.fence = c.fencingToken
+	h.Unlock()
+}
+
+// fencedWriter turns the server error of a write refused by the fence into
+// a 503, so clients retry against the new leader.
+type fencedWriter struct {
+	http.ResponseWriter
+	c       *clusterNode
+	fenced  bool
+	written bool
+}
+
+func (fw *fencedWriter) WriteHeader(status int) {
+	if informational(status) {
+		fw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if fw.written {
+		return
+	}
+	fw.written = true
+	if status >= 500 {
+		if _, err := fw.c.fencingToken(); err != nil {
+			fw.fenced = true
+			fw.Header().Del("Content-Length")
+			fw.Header().Set("Retry-After", "1")
+			fw.ResponseWriter.WriteHeader(http.StatusServiceUnavailable)
+			fw.ResponseWriter.Write([]byte(errFenced.Error()))
+			return
+		}
+	}
+	fw.ResponseWriter.WriteHeader(status)
+}
+
+func (fw *fencedWriter) Write(b []byte) (int, error) {
+	if !fw.written {
+		fw.WriteHeader(http.StatusOK)
+	}
+	if fw.fenced {
+		return len(b), nil
+	}
+	return fw.ResponseWriter.Write(b)
+}
+
+// getPeer sends a signed GET to a peer under ctx and decodes the answer.
+func getPeer(ctx context.Context, client *http.Client, key, peer, path string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", peer+path, nil)
+	if err != nil {
+		return err
+	}
+	if err := signPeerRequest(req, key, nil); err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	answer, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s: %s", peer, resp.Status, strings.TrimSpace(string(answer)))
+	}
+	return json.Unmarshal(answer, out)
+}
+
+type clusterNodeStatus struct {
+	URL     string `json:"url"`
+	Role    string `json:"role,omitempty"`
+	Term    uint64 `json:"term"`
+	Leader  string `json:"leader,omitempty"`
+	Applied uint64 `json:"applied"`
+	Error   string `json:"error,omitempty"`
+}
+
+// nodes asks every node for its term and the last sequence it applied, so
+// a node that disagrees about the leader stands out.
+func (c *clusterNode) nodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	self := c.localStatus()
+	nodes := []clusterNodeStatus{{URL: c.self, Role: self.Role, Term: self.Term, Leader: self.Leader, Applied: self.Applied}}
+	peers := c.peerList()
+	answers := make([]clusterNodeStatus, len(peers))
+	index := map[string]int{}
+	for i, peer := range peers {
+		index[peer] = i
+	}
+	key := c.fishes.config().ReplicationKey
+	broadcast(peers, func(peer string) {
+		node := clusterNodeStatus{URL: peer}
+		var status clusterStatus
+		if err := getPeer(r.Context(), c.client, key, peer, "/admin/cluster", &status); err != nil {
+			node.Error = err.Error()
+		} else {
+			node.Role, node.Term, node.Leader, node.Applied = status.Role, status.Term, status.Leader, status.Applied
+		}
+		answers[index[peer]] = node
+	})
+	writeJSON(w, http.StatusOK, append(nodes, answers...))
+}
@@ -0,0 +1,75 @@
+package fishes
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// maxListLimit is the most fishes a page of the list holds.
+const maxListLimit = 1000
+
+var listFishesParams = []paramSpec{
+	{name: "environment", kind: paramEnum, values: environmentNames()},
+	{name: "name", kind: paramString},
+	{name: "min_length", kind: paramInt, min: 0, max: math.MaxInt32},
+	{name: "max_length", kind: paramInt, min: 0, max: math.MaxInt32},
+	{name: "sort", kind: paramEnum, values: []string{"id", "-id", "name", "-name", "max_length_cm", "-max_length_cm"}, def: "id"},
+	{name: "limit", kind: paramInt, min: 1, max: maxListLimit, def: "100"},
+	{name: "offset", kind: paramInt, min: 0, max: math.MaxInt32, def: "0"},
+	{name: "envelope", kind: paramBool},
+	{name: "include_expired", kind: paramBool},
+}
+
+func matchesFishFilter(fish Fish, q queryValues) bool {
+	if q.has("environment") && string(fish.Environment) != q.str("environment") {
+		return false
+	}
+	if q.has("name") && !strings.Contains(strings.ToLower(fish.Name), strings.ToLower(q.str("name"))) {
+		return false
+	}
+	if q.has("min_length") && fish.MaxLength < q.int("min_length") {
+		return false
+	}
+	if q.has("max_length") && fish.MaxLength > q.int("max_length") {
+		return false
+	}
+	return true
+}
+
+func sortFishes(fishes []Fish, key string) {
+	desc := strings.HasPrefix(key, "-")
+	key = strings.TrimPrefix(key, "-")
+
+	less := func(a, b Fish) bool {
+		switch key {
+		case "name":
+			if a.Name != b.Name {
+				return a.Name < b.Name
+			}
+		case "max_length_cm":
+			if a.MaxLength != b.MaxLength {
+				return a.MaxLength < b.MaxLength
+			}
+		}
+		return a.ID < b.ID
+	}
+
+	sort.SliceStable(fishes, func(i, j int) bool {
+		if desc {
+			return less(fishes[j], fishes[i])
+		}
+		return less(fishes[i], fishes[j])
+	})
+}
+
+func paginateFishes(fishes []Fish, limit, offset int) []Fish {
+	if offset >= len(fishes) {
+		return fishes[:0]
+	}
+	end := offset + limit
+	if end > len(fishes) {
+		end = len(fishes)
+	}
+	return fishes[offset:end]
+}
@@ -0,0 +1,79 @@
+package fishclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ImportReport is what the server found in an imported archive.
+type ImportReport struct {
+	DryRun   bool     `json:"dry_run"`
+	Applied  bool     `json:"applied"`
+	Records  int      `json:"records"`
+	Problems []string `json:"problems"`
+	Changes  struct {
+		Added   []string `json:"added"`
+		Removed []string `json:"removed"`
+		Changed []string `json:"changed"`
+	} `json:"changes"`
+}
+
+// Export returns an export archive of every fish, a .tar.gz. Export, Import
+// and Changes are admin endpoints and need Auth.
+func (c *Client) Export(ctx context.Context) ([]byte, error) {
+	_, archive, err := c.do(ctx, "GET", "/admin/export", http.Header{"Accept": {"application/gzip"}}, nil)
+	return archive, err
+}
+
+// Import replaces every fish with those in an export archive. With dryRun
+// the server only reports what would change. An archive the server refuses
+// comes back with its problems in the report and an *Error.
+func (c *Client) Import(ctx context.Context, archive []byte, dryRun bool) (*ImportReport, error) {
+	path := "/admin/import?dry_run=" + strconv.FormatBool(dryRun)
+	_, answer, err := c.do(ctx, "POST", path, http.Header{"Content-Type": {"application/gzip"}}, archive)
+	var report ImportReport
+	if e, ok := err.(*Error); ok && e.StatusCode == http.StatusUnprocessableEntity {
+		if json.Unmarshal([]byte(e.Message), &report) == nil {
+			return &report, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &report, json.Unmarshal(answer, &report)
+}
+
+// Change is one write in the server's operation log. Op is put, delete,
+// purge or reset; a reset replaces every fish with Fishes.
+type Change struct {
+	Seq    uint64    `json:"seq"`
+	At     time.Time `json:"at"`
+	Op     string    `json:"op"`
+	ID     string    `json:"id,omitempty"`
+	Fish   *Fish     `json:"fish,omitempty"`
+	Fishes []Fish    `json:"fishes,omitempty"`
+}
+
+// Changes is a run of the operation log. When Epoch changes the log was
+// started over and sequence numbers count from the start again.
+type Changes struct {
+	Epoch   time.Time `json:"epoch"`
+	Seq     uint64    `json:"seq"`
+	Changes []Change  `json:"ops"`
+}
+
+// Changes returns the writes after sequence number after. With none yet it
+// waits up to wait, at most a minute, for the next one.
+func (c *Client) Changes(ctx context.Context, after uint64, wait time.Duration) (*Changes, error) {
+	v := url.Values{"after": {strconv.FormatUint(after, 10)}, "wait": {strconv.Itoa(int(wait / time.Second))}}
+	_, answer, err := c.do(ctx, "GET", "/admin/replication?"+v.Encode(), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var changes Changes
+	return &changes, json.Unmarshal(answer, &changes)
+}
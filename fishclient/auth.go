@@ -0,0 +1,60 @@
+package fishclient
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Authenticator adds credentials to a request before each attempt. body is
+// what the request sends, nil when it has none.
+type Authenticator interface {
+	Authenticate(req *http.Request, body []byte) error
+}
+
+// AuthenticatorFunc lets a function be an Authenticator.
+type AuthenticatorFunc func(req *http.Request, body []byte) error
+
+func (f AuthenticatorFunc) Authenticate(req *http.Request, body []byte) error {
+	return f(req, body)
+}
+
+// BasicAuth sends the admin password.
+func BasicAuth(user, password string) Authenticator {
+	return AuthenticatorFunc(func(req *http.Request, body []byte) error {
+		req.SetBasicAuth(user, password)
+		return nil
+	})
+}
+
+// SignedRequests signs every request with one of the server's api_keys,
+// the way FISH-HMAC-SHA256 expects. Each attempt gets a new nonce.
+func SignedRequests(keyID, secret string) Authenticator {
+	return AuthenticatorFunc(func(req *http.Request, body []byte) error {
+		nonce, err := randomHex(16)
+		if err != nil {
+			return err
+		}
+		date := time.Now().UTC().Format(time.RFC3339)
+		req.Header.Set("X-Fish-Date", date)
+		req.Header.Set("X-Fish-Nonce", nonce)
+		sum := sha256.Sum256(body)
+		toSign := strings.Join([]string{
+			"FISH-HMAC-SHA256",
+			date,
+			nonce,
+			req.Method,
+			req.URL.EscapedPath(),
+			req.URL.Query().Encode(),
+			hex.EncodeToString(sum[:]),
+		}, "\n")
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(toSign))
+		req.Header.Set("Authorization", fmt.Sprintf("FISH-HMAC-SHA256 Credential=%s, Signature=%s", keyID, hex.EncodeToString(mac.Sum(nil))))
+		return nil
+	})
+}
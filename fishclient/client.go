@@ -0,0 +1,345 @@
+// Package fishclient is a Go client of the fishes API. Fish is generated from
+// the server's own struct, see cmd/fishclientgen.
+package fishclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to one server. The zero values of its fields are usable
+// defaults, except BaseURL.
+type Client struct {
+	// BaseURL is where the server is, such as http://localhost:8080.
+	BaseURL string
+	// HTTPClient sends the requests, http.DefaultClient when nil.
+	HTTPClient *http.Client
+	// Auth adds credentials to every request when set.
+	Auth Authenticator
+	// MaxRetries is how often a request is retried after a network error, a
+	// 429 or a 502, 503 or 504. Zero means 3, negative disables retries.
+	MaxRetries int
+	// Backoff is the wait before the first retry, doubled after each one up
+	// to MaxBackoff. They default to 200ms and 5s. A Retry-After sent by the
+	// server takes precedence.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// New returns a client of the server at baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: baseURL}
+}
+
+// Error is a response the server refused a request with.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("fishclient: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("fishclient: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from the server.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// ListOptions pages and orders a listing. Sort is one of id, name and
+// max_length_cm, with a leading - to reverse it.
+type ListOptions struct {
+	Limit  int
+	Offset int
+	Sort   string
+}
+
+// Query narrows a search. Name matches a part of the name, ignoring case.
+type Query struct {
+	ListOptions
+	Name        string
+	Environment Environment
+	MinLength   int
+	MaxLength   int
+}
+
+// Page is one page of a listing.
+type Page struct {
+	Fishes []Fish
+	Total  int
+	Limit  int
+	Offset int
+	// Version is the data version the page was read at.
+	Version uint64
+}
+
+// More reports whether there are fishes after this page.
+func (p *Page) More() bool {
+	return p.Offset+len(p.Fishes) < p.Total
+}
+
+// List returns a page of all fishes.
+func (c *Client) List(ctx context.Context, opts *ListOptions) (*Page, error) {
+	q := &Query{}
+	if opts != nil {
+		q.ListOptions = *opts
+	}
+	return c.Search(ctx, q)
+}
+
+// Search returns a page of the fishes matching q.
+func (c *Client) Search(ctx context.Context, q *Query) (*Page, error) {
+	v := url.Values{"envelope": {"true"}}
+	if q != nil {
+		if q.Name != "" {
+			v.Set("name", q.Name)
+		}
+		if q.Environment != "" {
+			v.Set("environment", string(q.Environment))
+		}
+		if q.MinLength > 0 {
+			v.Set("min_length", strconv.Itoa(q.MinLength))
+		}
+		if q.MaxLength > 0 {
+			v.Set("max_length", strconv.Itoa(q.MaxLength))
+		}
+		if q.Limit > 0 {
+			v.Set("limit", strconv.Itoa(q.Limit))
+		}
+		if q.Offset > 0 {
+			v.Set("offset", strconv.Itoa(q.Offset))
+		}
+		if q.Sort != "" {
+			v.Set("sort", q.Sort)
+		}
+	}
+	var list struct {
+		Data []Fish `json:"data"`
+		Meta struct {
+			Total   int    `json:"total"`
+			Limit   int    `json:"limit"`
+			Offset  int    `json:"offset"`
+			Version uint64 `json:"version"`
+		} `json:"meta"`
+	}
+	if _, answer, err := c.do(ctx, "GET", "/fishes?"+v.Encode(), nil, nil); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(answer, &list); err != nil {
+		return nil, err
+	}
+	return &Page{Fishes: list.Data, Total: list.Meta.Total, Limit: list.Meta.Limit, Offset: list.Meta.Offset, Version: list.Meta.Version}, nil
+}
+
+// Get returns the fish with id or slug key and its ETag, which Update and
+// Delete take to make sure nobody changed the fish in between.
+func (c *Client) Get(ctx context.Context, key string) (*Fish, string, error) {
+	var fish Fish
+	resp, answer, err := c.do(ctx, "GET", fishPath(key), nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := decodeData(answer, &fish); err != nil {
+		return nil, "", err
+	}
+	return &fish, resp.Header.Get("ETag"), nil
+}
+
+// Create adds a fish and returns it as stored, with its ID. Retries reuse an
+// Idempotency-Key, so the fish is not created twice.
+func (c *Client) Create(ctx context.Context, fish Fish) (*Fish, error) {
+	body, err := json.Marshal(fish)
+	if err != nil {
+		return nil, err
+	}
+	key, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	_, answer, err := c.do(ctx, "POST", "/fishes", http.Header{"Idempotency-Key": {key}}, body)
+	if err != nil {
+		return nil, err
+	}
+	var created Fish
+	return &created, decodeData(answer, &created)
+}
+
+// Update replaces the fish with fish.ID. etag is the one Get returned, the
+// update fails with a 412 once the fish changed since. An empty etag
+// updates whatever is stored.
+func (c *Client) Update(ctx context.Context, fish Fish, etag string) (*Fish, error) {
+	if fish.ID == "" {
+		return nil, fmt.Errorf("fishclient: updating a fish needs its ID")
+	}
+	body, err := json.Marshal(fish)
+	if err != nil {
+		return nil, err
+	}
+	_, answer, err := c.do(ctx, "PUT", fishPath(fish.ID), ifMatch(etag), body)
+	if err != nil {
+		return nil, err
+	}
+	var updated Fish
+	return &updated, decodeData(answer, &updated)
+}
+
+// Delete moves the fish with id to the trash. An empty etag deletes whatever
+// is stored.
+func (c *Client) Delete(ctx context.Context, id, etag string) error {
+	_, _, err := c.do(ctx, "DELETE", fishPath(id), ifMatch(etag), nil)
+	return err
+}
+
+func fishPath(key string) string {
+	return "/fishes/" + url.PathEscape(key) + "?envelope=true"
+}
+
+func ifMatch(etag string) http.Header {
+	if etag == "" {
+		etag = "*"
+	}
+	return http.Header{"If-Match": {etag}}
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// do sends a request, retrying it as the Client says, and returns the
+// answer to the last attempt.
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, body []byte) (*http.Response, []byte, error) {
+	retries := c.MaxRetries
+	if retries == 0 {
+		retries = 3
+	}
+	wait, maxWait := c.Backoff, c.MaxBackoff
+	if wait <= 0 {
+		wait = 200 * time.Millisecond
+	}
+	if maxWait <= 0 {
+		maxWait = 5 * time.Second
+	}
+	for attempt := 0; ; attempt++ {
+		resp, answer, err := c.send(ctx, method, path, header, body)
+		if err == nil && resp.StatusCode < 400 {
+			return resp, answer, nil
+		}
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		if err == nil {
+			err = &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(answer))}
+		}
+		if attempt >= retries || !retryable(resp) {
+			return resp, nil, err
+		}
+		delay := wait + time.Duration(mathrand.Int63n(int64(wait)/2+1))
+		if after := retryAfter(resp); after > 0 {
+			delay = after
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, ctx.Err()
+		}
+		if wait *= 2; wait > maxWait {
+			wait = maxWait
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, path string, header http.Header, body []byte) (*http.Response, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.BaseURL, "/")+path, reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", "application/json")
+	}
+	if body != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Auth != nil {
+		if err := c.Auth.Authenticate(req, body); err != nil {
+			return nil, nil, err
+		}
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	answer, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, answer, nil
+}
+
+// retryable is true for network errors, which come without a response, and
+// for answers that say to come back later.
+func retryable(resp *http.Response) bool {
+	if resp == nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// decodeData decodes an answer in its {"data": ...} envelope, or bare when
+// the server answered without one.
+func decodeData(answer []byte, out interface{}) error {
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(answer, &envelope); err == nil && len(envelope.Data) > 0 {
+		answer = envelope.Data
+	}
+	return json.Unmarshal(answer, out)
+}
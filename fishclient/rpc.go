@@ -0,0 +1,187 @@
+package fishclient
+
+import (
+	"context"
+	"net/rpc"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RPCClient talks to the net/rpc listener a server opens on rpc_listen,
+// which skips HTTP for Go programs next to the server. It reads its own
+// writes: every call carries the consistency token of the last write.
+type RPCClient struct {
+	// Password is the admin password, which reveals sensitive fields.
+	Password string
+
+	client *rpc.Client
+	mu     sync.Mutex
+	token  string
+}
+
+// DialRPC connects to address, on network "tcp" or "unix".
+func DialRPC(network, address string) (*RPCClient, error) {
+	client, err := rpc.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &RPCClient{client: client}, nil
+}
+
+func (c *RPCClient) Close() error {
+	return c.client.Close()
+}
+
+// The gob counterparts of the server's argument and reply types; gob matches
+// them by field name.
+type rpcCredentials struct {
+	Password         string
+	ConsistencyToken string
+}
+
+type rpcListArgs struct {
+	Credentials rpcCredentials
+	Name        string
+	Environment string
+	MinLength   int
+	MaxLength   int
+	Sort        string
+	Limit       int
+	Offset      int
+}
+
+type rpcFishArgs struct {
+	Credentials    rpcCredentials
+	ID             string
+	ETag           string
+	IdempotencyKey string
+	Fish           Fish
+}
+
+type rpcFishReply struct {
+	Fish             Fish
+	ETag             string
+	ConsistencyToken string
+}
+
+type rpcPageReply struct {
+	Fishes  []Fish
+	Total   int
+	Limit   int
+	Offset  int
+	Version uint64
+}
+
+func (c *RPCClient) credentials() rpcCredentials {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return rpcCredentials{Password: c.Password, ConsistencyToken: c.token}
+}
+
+// Search returns a page of the fishes matching q, all of them when q is nil.
+func (c *RPCClient) Search(ctx context.Context, q *Query) (*Page, error) {
+	args := rpcListArgs{Credentials: c.credentials()}
+	if q != nil {
+		args.Name, args.Environment = q.Name, string(q.Environment)
+		args.MinLength, args.MaxLength = q.MinLength, q.MaxLength
+		args.Sort, args.Limit, args.Offset = q.Sort, q.Limit, q.Offset
+	}
+	var reply rpcPageReply
+	if err := c.call(ctx, "Fishes.List", args, &reply); err != nil {
+		return nil, err
+	}
+	return &Page{Fishes: reply.Fishes, Total: reply.Total, Limit: reply.Limit, Offset: reply.Offset, Version: reply.Version}, nil
+}
+
+// Get returns the fish with id or slug key and its ETag.
+func (c *RPCClient) Get(ctx context.Context, key string) (*Fish, string, error) {
+	reply, err := c.fish(ctx, "Fishes.Get", rpcFishArgs{ID: key})
+	if err != nil {
+		return nil, "", err
+	}
+	return &reply.Fish, reply.ETag, nil
+}
+
+// Create adds a fish and returns it as stored, with its ID.
+func (c *RPCClient) Create(ctx context.Context, fish Fish) (*Fish, error) {
+	key, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.fish(ctx, "Fishes.Create", rpcFishArgs{IdempotencyKey: key, Fish: fish})
+	if err != nil {
+		return nil, err
+	}
+	return &reply.Fish, nil
+}
+
+// Update replaces the fish with fish.ID if it still has etag, whatever is
+// stored when etag is empty.
+func (c *RPCClient) Update(ctx context.Context, fish Fish, etag string) (*Fish, error) {
+	reply, err := c.fish(ctx, "Fishes.Update", rpcFishArgs{ID: fish.ID, ETag: etag, Fish: fish})
+	if err != nil {
+		return nil, err
+	}
+	return &reply.Fish, nil
+}
+
+// Delete moves the fish with id to the trash.
+func (c *RPCClient) Delete(ctx context.Context, id, etag string) error {
+	_, err := c.fish(ctx, "Fishes.Delete", rpcFishArgs{ID: id, ETag: etag})
+	return err
+}
+
+// Restore takes the fish with id back out of the trash.
+func (c *RPCClient) Restore(ctx context.Context, id string) (*Fish, error) {
+	reply, err := c.fish(ctx, "Fishes.Restore", rpcFishArgs{ID: id})
+	if err != nil {
+		return nil, err
+	}
+	return &reply.Fish, nil
+}
+
+func (c *RPCClient) fish(ctx context.Context, method string, args rpcFishArgs) (*rpcFishReply, error) {
+	args.Credentials = c.credentials()
+	var reply rpcFishReply
+	if err := c.call(ctx, method, args, &reply); err != nil {
+		return nil, err
+	}
+	if reply.ConsistencyToken != "" {
+		c.mu.Lock()
+		c.token = reply.ConsistencyToken
+		c.mu.Unlock()
+	}
+	return &reply, nil
+}
+
+// call waits for the answer until ctx is done. The server still finishes a
+// call given up on.
+func (c *RPCClient) call(ctx context.Context, method string, args, reply interface{}) error {
+	done := c.client.Go(method, args, reply, make(chan *rpc.Call, 1)).Done
+	select {
+	case call := <-done:
+		return rpcError(call.Error)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rpcError turns the "404 Not Found: message" the server refuses a call with
+// into an *Error.
+func rpcError(err error) error {
+	serverErr, ok := err.(rpc.ServerError)
+	if !ok {
+		return err
+	}
+	parts := strings.SplitN(string(serverErr), " ", 2)
+	status, convErr := strconv.Atoi(parts[0])
+	if convErr != nil || len(parts) < 2 {
+		return err
+	}
+	message := ""
+	if i := strings.Index(parts[1], ": "); i >= 0 {
+		message = parts[1][i+2:]
+	}
+	return &Error{StatusCode: status, Message: message}
+}
@@ -0,0 +1,325 @@
+// Package fishestest runs a real fishes server for the integration tests of
+// services that talk to it.
+//
+// NewTestServer builds the server in the test binary and serves it on an
+// httptest.Server, one per test on a free loopback port with its own store
+// in a temporary directory.
+package fishestest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	fishes "namnguyen191.github.com/no-dep-rest-api"
+	"namnguyen191.github.com/no-dep-rest-api/fishclient"
+)
+
+// AdminPassword is the admin password of every test server.
+const AdminPassword = "fishestest"
+
+// Server is a running server. It is stopped when the test that started it
+// ends, and what it logged is added to the test's output if the test failed.
+type Server struct {
+	// URL is where the server listens, such as http://127.0.0.1:41234.
+	URL string
+	// Client is authenticated as the admin.
+	Client *fishclient.Client
+
+	http  *httptest.Server
+	close func() error
+	log   *syncBuffer
+}
+
+// NewTestServer starts a server. settings are extra configuration as
+// key=value with the keys of a config file, such as
+// "response_envelope=true"; everything else keeps its default, as the
+// environment of the test is not passed on.
+func NewTestServer(t testing.TB, settings ...string) *Server {
+	t.Helper()
+	return start(t, false, settings)
+}
+
+// NewDeterministicServer starts a server like NewTestServer, but one whose
+// clock stands at 2020-01-01T00:00:00Z and whose random source is seeded
+// with 1, so it gives the same ids and picks the same random fishes on every
+// run. SetClock, AdvanceClock and SeedRand change them.
+func NewDeterministicServer(t testing.TB, settings ...string) *Server {
+	t.Helper()
+	return start(t, true, settings)
+}
+
+func start(t testing.TB, deterministic bool, settings []string) *Server {
+	t.Helper()
+	env := map[string]string{
+		"ADMIN_PASSWORD": AdminPassword,
+		"DATA_DIR":       t.TempDir(),
+	}
+	for _, setting := range settings {
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			t.Fatalf("fishestest: setting %q is not key=value", setting)
+		}
+		// The server reads every key from the environment variable of its
+		// name in upper case.
+		env[strings.ToUpper(kv[0])] = kv[1]
+	}
+
+	s := &Server{log: &syncBuffer{}}
+	logs.add(s.log)
+	handler, close, err := fishes.NewHandler(func(key string) string { return env[key] }, deterministic)
+	if err != nil {
+		logs.remove(s.log)
+		t.Fatalf("fishestest: %s\n%s", err, s.Log())
+	}
+	s.http, s.close = httptest.NewServer(handler), close
+	s.URL = s.http.URL
+	t.Cleanup(func() {
+		s.stop()
+		if t.Failed() {
+			t.Logf("fishestest: server log:\n%s", s.Log())
+		}
+	})
+
+	s.Client = fishclient.New(s.URL)
+	s.Client.Auth = fishclient.BasicAuth("admin", AdminPassword)
+	s.Client.MaxRetries = -1
+	return s
+}
+
+// stop waits for the requests under way and shuts the server down.
+func (s *Server) stop() {
+	s.http.Close()
+	if err := s.close(); err != nil {
+		log.Printf("fishestest: shutting down: %s", err)
+	}
+	logs.remove(s.log)
+}
+
+// SetClock sets the clock of a server from NewDeterministicServer.
+func (s *Server) SetClock(t testing.TB, now time.Time) {
+	t.Helper()
+	s.control(t, "/admin/test/clock", map[string]time.Time{"now": now})
+}
+
+// AdvanceClock moves the clock of a server from NewDeterministicServer on
+// by d.
+func (s *Server) AdvanceClock(t testing.TB, d time.Duration) {
+	t.Helper()
+	s.control(t, "/admin/test/clock", map[string]string{"advance": d.String()})
+}
+
+// SeedRand restarts the random source of a server from
+// NewDeterministicServer with seed.
+func (s *Server) SeedRand(t testing.TB, seed int64) {
+	t.Helper()
+	s.control(t, "/admin/test/rand", map[string]int64{"seed": seed})
+}
+
+func (s *Server) control(t testing.TB, path string, body interface{}) {
+	t.Helper()
+	resp, answer := s.Do(t, "POST", path, body)
+	if resp.StatusCode == http.StatusNotFound {
+		t.Fatalf("fishestest: %s: the server is not deterministic, start it with NewDeterministicServer", path)
+	}
+	if resp.StatusCode/100 != 2 {
+		t.Fatalf("fishestest: %s: %s: %s", path, resp.Status, answer)
+	}
+}
+
+// Log returns what the server logged so far.
+func (s *Server) Log() string {
+	return s.log.String()
+}
+
+// Anonymous returns a client without credentials, which sees what the
+// public does.
+func (s *Server) Anonymous() *fishclient.Client {
+	c := fishclient.New(s.URL)
+	c.MaxRetries = -1
+	return c
+}
+
+// Fish returns a valid fish to create, named name; change its fields before
+// passing it to Seed to test something more specific.
+func Fish(name string) fishclient.Fish {
+	return fishclient.Fish{
+		Name:           name,
+		ScientificName: name + " fishestest",
+		Environment:    fishclient.Freshwater,
+		MaxLength:      10,
+	}
+}
+
+// Seed creates fishes and returns them as stored, ids and versions set.
+func (s *Server) Seed(t testing.TB, fishes ...fishclient.Fish) []fishclient.Fish {
+	t.Helper()
+	created := make([]fishclient.Fish, 0, len(fishes))
+	for _, fish := range fishes {
+		f, err := s.Client.Create(context.Background(), fish)
+		if err != nil {
+			t.Fatalf("fishestest: seeding %q: %s", fish.Name, err)
+		}
+		created = append(created, *f)
+	}
+	return created
+}
+
+// Do sends a request as the admin, body encoded as JSON unless it is nil
+// or already a []byte, and returns the response with its body read.
+func (s *Server) Do(t testing.TB, method, path string, body interface{}) (*http.Response, []byte) {
+	t.Helper()
+	var raw []byte
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		raw = b
+	default:
+		var err error
+		if raw, err = json.Marshal(b); err != nil {
+			t.Fatalf("fishestest: encoding the body of %s %s: %s", method, path, err)
+		}
+	}
+	req, err := http.NewRequest(method, s.URL+path, bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("fishestest: %s", err)
+	}
+	if raw != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.SetBasicAuth("admin", AdminPassword)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("fishestest: %s %s: %s", method, path, err)
+	}
+	defer resp.Body.Close()
+	answer, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("fishestest: reading %s %s: %s", method, path, err)
+	}
+	return resp, answer
+}
+
+// AssertStatus fails the test unless resp has the status want.
+func AssertStatus(t testing.TB, resp *http.Response, want int) {
+	t.Helper()
+	if resp.StatusCode != want {
+		t.Errorf("%s %s: status %d, want %d", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, want)
+	}
+}
+
+// AssertNotFound fails the test unless err is a 404 from the server.
+func AssertNotFound(t testing.TB, err error) {
+	t.Helper()
+	if !fishclient.IsNotFound(err) {
+		t.Errorf("got %v, want a 404", err)
+	}
+}
+
+// AssertFishCount fails the test unless the server stores want fishes.
+func (s *Server) AssertFishCount(t testing.TB, want int) {
+	t.Helper()
+	page, err := s.Client.List(context.Background(), &fishclient.ListOptions{Limit: 1})
+	if err != nil {
+		t.Fatalf("fishestest: listing fishes: %s", err)
+	}
+	if page.Total != want {
+		t.Errorf("%d fishes stored, want %d", page.Total, want)
+	}
+}
+
+// AssertFish fails the test unless the fish key names, an id or a slug,
+// has the fields want sets; fields left at their zero value are not
+// compared.
+func (s *Server) AssertFish(t testing.TB, key string, want fishclient.Fish) {
+	t.Helper()
+	got, _, err := s.Client.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("fishestest: getting fish %s: %s", key, err)
+	}
+	g, w := reflect.ValueOf(*got), reflect.ValueOf(want)
+	for i := 0; i < w.NumField(); i++ {
+		if reflect.DeepEqual(w.Field(i).Interface(), reflect.Zero(w.Field(i).Type()).Interface()) {
+			continue
+		}
+		if !reflect.DeepEqual(g.Field(i).Interface(), w.Field(i).Interface()) {
+			t.Errorf("fish %s: %s is %v, want %v", key, w.Type().Field(i).Name, show(g.Field(i)), show(w.Field(i)))
+		}
+	}
+}
+
+func show(v reflect.Value) interface{} {
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		return v.Elem().Interface()
+	}
+	return v.Interface()
+}
+
+// syncBuffer collects what a server logs.
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+// logs takes the output of the log package while servers run, the servers
+// being in the test binary, and copies it to the log of each. Servers of
+// parallel tests each get the lines of the others too.
+var logs = &logFanout{}
+
+type logFanout struct {
+	sync.Mutex
+	buffers  map[*syncBuffer]bool
+	previous io.Writer
+}
+
+func (f *logFanout) add(b *syncBuffer) {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.buffers) == 0 {
+		f.buffers = map[*syncBuffer]bool{}
+		f.previous = log.Writer()
+		log.SetOutput(f)
+	}
+	f.buffers[b] = true
+}
+
+func (f *logFanout) remove(b *syncBuffer) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.buffers, b)
+	if len(f.buffers) == 0 && f.previous != nil {
+		log.SetOutput(f.previous)
+		f.previous = nil
+	}
+}
+
+func (f *logFanout) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	for b := range f.buffers {
+		b.Write(p)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,103 @@
+package fishestest
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"namnguyen191.github.com/no-dep-rest-api/fishclient"
+)
+
+func TestNewTestServer(t *testing.T) {
+	s := NewTestServer(t)
+	s.AssertFishCount(t, 0)
+	nemo := Fish("Nemo")
+	nemo.Environment = fishclient.Saltwater
+	seeded := s.Seed(t, nemo, Fish("Guppy"))
+	if len(seeded) != 2 || seeded[0].ID == "" || seeded[0].Version == 0 {
+		t.Fatalf("seeded %+v", seeded)
+	}
+	s.AssertFishCount(t, 2)
+	s.AssertFish(t, seeded[0].ID, fishclient.Fish{Name: "Nemo", Environment: fishclient.Saltwater, MaxLength: 10})
+
+	if err := s.Client.Delete(context.Background(), seeded[0].ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := s.Anonymous().Get(context.Background(), seeded[0].ID)
+	AssertNotFound(t, err)
+
+	resp, _ := s.Do(t, "GET", "/admin/integrity", nil)
+	AssertStatus(t, resp, http.StatusOK)
+	resp, _ = s.Do(t, "POST", "/fishes", []byte(`{"name":`))
+	AssertStatus(t, resp, http.StatusBadRequest)
+
+	// Each server has a store of its own.
+	NewTestServer(t).AssertFishCount(t, 0)
+}
+
+func TestNewTestServerSettings(t *testing.T) {
+	s := NewTestServer(t, "response_envelope=true")
+	resp, body := s.Do(t, "GET", "/fishes", nil)
+	AssertStatus(t, resp, http.StatusOK)
+	if !strings.HasPrefix(string(body), `{"data":`) {
+		t.Errorf("response_envelope=true was not applied: %s", body)
+	}
+}
+
+// Two deterministic servers give the same ids, and the clock moves only
+// when told to.
+func TestDeterministicServer(t *testing.T) {
+	a, b := NewDeterministicServer(t), NewDeterministicServer(t)
+	first, second := a.Seed(t, Fish("Nemo"))[0], b.Seed(t, Fish("Nemo"))[0]
+	if first.ID != second.ID {
+		t.Errorf("ids %s and %s, want the same", first.ID, second.ID)
+	}
+	epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if first.UpdatedAt == nil || !first.UpdatedAt.Equal(epoch) {
+		t.Errorf("updated_at %v, want %s", first.UpdatedAt, epoch)
+	}
+
+	a.SetClock(t, epoch.Add(24*time.Hour))
+	a.AdvanceClock(t, time.Hour)
+	a.SeedRand(t, 7)
+	if moved := a.Seed(t, Fish("Dory"))[0]; !moved.UpdatedAt.Equal(epoch.Add(25 * time.Hour)) {
+		t.Errorf("updated_at %v after moving the clock, want %s", moved.UpdatedAt, epoch.Add(25*time.Hour))
+	}
+}
+
+func TestControls(t *testing.T) {
+	s := NewDeterministicServer(t)
+	for _, tc := range []struct {
+		method, path, body string
+		wantStatus         int
+	}{
+		{"GET", "/admin/test/clock", "", http.StatusOK},
+		{"POST", "/admin/test/clock", `{"now":"2021-06-01T00:00:00Z"}`, http.StatusOK},
+		{"POST", "/admin/test/clock", `{"advance":"90m"}`, http.StatusOK},
+		{"POST", "/admin/test/clock", `{"advance":"-1s"}`, http.StatusBadRequest},
+		{"POST", "/admin/test/clock", `{"advance":"soon"}`, http.StatusBadRequest},
+		{"POST", "/admin/test/clock", `{"now":"tomorrow"}`, http.StatusBadRequest},
+		{"DELETE", "/admin/test/clock", "", http.StatusMethodNotAllowed},
+		{"POST", "/admin/test/rand", `{"seed":7}`, http.StatusNoContent},
+		{"POST", "/admin/test/rand", `{}`, http.StatusBadRequest},
+		{"GET", "/admin/test/rand", "", http.StatusMethodNotAllowed},
+	} {
+		var body interface{}
+		if tc.body != "" {
+			body = []byte(tc.body)
+		}
+		resp, answer := s.Do(t, tc.method, tc.path, body)
+		if resp.StatusCode != tc.wantStatus {
+			t.Errorf("%s %s %s: %d %s, want %d", tc.method, tc.path, tc.body, resp.StatusCode, answer, tc.wantStatus)
+		}
+	}
+	if resp, answer := s.Do(t, "GET", "/admin/test/clock", nil); !strings.Contains(string(answer), "2021-06-01T01:30:00Z") {
+		t.Errorf("the clock reads %d %s, want 2021-06-01T01:30:00Z", resp.StatusCode, answer)
+	}
+
+	// A server that is not deterministic has no controls.
+	resp, _ := NewTestServer(t).Do(t, "POST", "/admin/test/clock", []byte(`{"advance":"1s"}`))
+	AssertStatus(t, resp, http.StatusNotFound)
+}
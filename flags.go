@@ -0,0 +1,283 @@
+package fishes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	featureFlagsKey contextKey = "feature-flags"
+	// flagsFileName holds the flags set from /admin/flags, which outlive a
+	// restart and a reload.
+	flagsFileName = "flags.json"
+)
+
+type featureFlagSpec struct {
+	name        string
+	description string
+	def         bool
+}
+
+// featureFlagSpecs are the behaviours that can be turned off, or on for some
+// API keys only, while they are new.
+var featureFlagSpecs = []featureFlagSpec{
+	{name: "v2_api", description: "Serve the /v2 route tree, always enveloped and with JSON errors", def: true},
+	{name: "async_writes", description: "Queue the writes sent with Prefer: respond-async instead of serving them right away", def: true},
+	{name: "namespaces", description: "Serve /namespaces and the fishes in them", def: true},
+}
+
+func featureFlagSpecFor(name string) (featureFlagSpec, bool) {
+	for _, spec := range featureFlagSpecs {
+		if spec.name == name {
+			return spec, true
+		}
+	}
+	return featureFlagSpec{}, false
+}
+
+// parseFeatureFlags reads feature_flags entries, name=true|false or
+// name@key=true|false for the requests signed by one API key, keyed by
+// name or name@key.
+func parseFeatureFlags(entries []string) (map[string]bool, error) {
+	flags := map[string]bool{}
+	for _, entry := range entries {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid feature flag '%s', expected name=true|false or name@key=true|false", entry)
+		}
+		on, err := strconv.ParseBool(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("feature flag '%s': the value must be true or false", entry)
+		}
+		name := strings.TrimSpace(strings.SplitN(kv[0], "@", 2)[0])
+		if _, ok := featureFlagSpecFor(name); !ok {
+			return nil, fmt.Errorf("unknown feature flag '%s'", name)
+		}
+		flags[strings.TrimSpace(kv[0])] = on
+	}
+	return flags, nil
+}
+
+// featureFlags works out which flags are on for a request. From the least to
+// the most specific: the default, feature_flags, /admin/flags, then the same
+// two for the API key that signed the request.
+type featureFlags struct {
+	fishes *fishesHandler
+
+	sync.Mutex
+	runtime map[string]bool
+}
+
+func newFeatureFlags(h *fishesHandler) *featureFlags {
+	return &featureFlags{fishes: h, runtime: map[string]bool{}}
+}
+
+// load reads the flags set from /admin/flags before the restart.
+func (f *featureFlags) load() error {
+	dataDir := f.fishes.config().DataDir
+	if dataDir == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, flagsFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var runtime map[string]bool
+	if err := json.Unmarshal(data, &runtime); err != nil {
+		return fmt.Errorf("%s: %s", flagsFileName, err)
+	}
+	f.Lock()
+	defer f.Unlock()
+	for name, on := range runtime {
+		if _, ok := featureFlagSpecFor(strings.SplitN(name, "@", 2)[0]); ok {
+			f.runtime[name] = on
+		}
+	}
+	return nil
+}
+
+// save writes the runtime flags to data_dir. Callers must hold the lock.
+func (f *featureFlags) save() error {
+	dataDir := f.fishes.config().DataDir
+	if dataDir == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(f.runtime, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dataDir, flagsFileName), data)
+}
+
+// flagSource is a flag as one request sees it, and where that comes from:
+// default, config or runtime.
+type flagSource struct {
+	Enabled bool   `json:"enabled"`
+	Source  string `json:"source"`
+}
+
+// lookup gives the state of name for requests signed by keyID, "" for the
+// others.
+func (f *featureFlags) lookup(configured map[string]bool, spec featureFlagSpec, keyID string) flagSource {
+	state := flagSource{Enabled: spec.def, Source: "default"}
+	subjects := []string{spec.name}
+	if keyID != "" {
+		subjects = append(subjects, spec.name+"@"+keyID)
+	}
+	for _, subject := range subjects {
+		if on, ok := configured[subject]; ok {
+			state = flagSource{Enabled: on, Source: "config"}
+		}
+		if on, ok := f.runtime[subject]; ok {
+			state = flagSource{Enabled: on, Source: "runtime"}
+		}
+	}
+	return state
+}
+
+func (f *featureFlags) resolve(keyID string) map[string]bool {
+	configured, _ := parseFeatureFlags(f.fishes.config().FeatureFlags)
+	f.Lock()
+	defer f.Unlock()
+	flags := make(map[string]bool, len(featureFlagSpecs))
+	for _, spec := range featureFlagSpecs {
+		flags[spec.name] = f.lookup(configured, spec, keyID).Enabled
+	}
+	return flags
+}
+
+// wrap puts the flags of each request in its context, where enabled reads
+// them.
+func (f *featureFlags) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A bad signature is refused further in; here it only gets the flags
+		// of requests without a key.
+		r, keyID, err := f.fishes.withSignatureCheck(r)
+		if err != nil {
+			keyID = ""
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), featureFlagsKey, f.resolve(keyID))))
+	})
+}
+
+// enabled is whether the flag name is on for r. Requests that did not come
+// through wrap, such as those of rpc_listen, get the flags of no key.
+func (f *featureFlags) enabled(r *http.Request, name string) bool {
+	if flags, ok := r.Context().Value(featureFlagsKey).(map[string]bool); ok {
+		return flags[name]
+	}
+	return f.resolve("")[name]
+}
+
+type featureFlagView struct {
+	Name        string                `json:"name"`
+	Description string                `json:"description"`
+	Default     bool                  `json:"default"`
+	Enabled     bool                  `json:"enabled"`
+	Source      string                `json:"source"`
+	Keys        map[string]flagSource `json:"keys,omitempty"`
+}
+
+type featureFlagChange struct {
+	Name string `json:"name"`
+	// Key limits the change to the requests signed by one API key.
+	Key string `json:"key"`
+	// Enabled turns the flag on or off; null drops what /admin/flags set,
+	// going back to feature_flags and the default.
+	Enabled *bool `json:"enabled"`
+}
+
+func (f *featureFlags) views() []featureFlagView {
+	configured, _ := parseFeatureFlags(f.fishes.config().FeatureFlags)
+	f.Lock()
+	defer f.Unlock()
+	keys := map[string]map[string]bool{}
+	for _, set := range []map[string]bool{configured, f.runtime} {
+		for subject := range set {
+			if parts := strings.SplitN(subject, "@", 2); len(parts) == 2 {
+				if keys[parts[0]] == nil {
+					keys[parts[0]] = map[string]bool{}
+				}
+				keys[parts[0]][parts[1]] = true
+			}
+		}
+	}
+	views := make([]featureFlagView, 0, len(featureFlagSpecs))
+	for _, spec := range featureFlagSpecs {
+		state := f.lookup(configured, spec, "")
+		view := featureFlagView{Name: spec.name, Description: spec.description, Default: spec.def, Enabled: state.Enabled, Source: state.Source}
+		for key := range keys[spec.name] {
+			if view.Keys == nil {
+				view.Keys = map[string]flagSource{}
+			}
+			view.Keys[key] = f.lookup(configured, spec, key)
+		}
+		views = append(views, view)
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].Name < views[j].Name })
+	return views
+}
+
+// serve lists the flags on GET and turns one on or off on PATCH, for every
+// request or those of one API key.
+func (f *featureFlags) serve(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PATCH":
+		body, ok := readJSONBody(w, r)
+		if !ok {
+			return
+		}
+		var change featureFlagChange
+		if err := json.Unmarshal(body, &change); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if _, ok := featureFlagSpecFor(change.Name); !ok {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(fmt.Sprintf("unknown feature flag '%s'", change.Name)))
+			return
+		}
+		subject := change.Name
+		if change.Key != "" {
+			subject += "@" + change.Key
+		}
+		f.Lock()
+		if change.Enabled == nil {
+			delete(f.runtime, subject)
+		} else {
+			f.runtime[subject] = *change.Enabled
+		}
+		err := f.save()
+		f.Unlock()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if change.Enabled == nil {
+			log.Printf("feature flag %s: back to feature_flags and the default", subject)
+		} else {
+			log.Printf("feature flag %s: enabled=%t", subject, *change.Enabled)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	writeJSON(w, http.StatusOK, f.views())
+}
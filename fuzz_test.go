@@ -0,0 +1,191 @@
+//go:build go1.18
+// +build go1.18
+
+// Fuzz targets for what parses requests, run against the handlers in
+// process:
+//
+//	go test -run '^$' -fuzz FuzzCreateFish
+//
+// Without -fuzz, go test runs the seeds below and the corpus under
+// testdata/fuzz with the other tests. The constraint only keeps toolchains
+// from before testing.F, which go.mod still allows, off this file.
+
+package fishes
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newFuzzHandler starts from a store holding one fish, Nemo, at the path it
+// returns.
+func newFuzzHandler(t testing.TB) (http.Handler, string) {
+	mux := newTestHandler(t, systemClock{}, systemRand{})
+	res := serveTest(mux, "POST", "/fishes", "application/json", []byte(`{"name":"Nemo","environment":"saltwater","max_length_cm":11}`))
+	if res.Code != http.StatusCreated {
+		t.Fatalf("creating the first fish: %d %s", res.Code, res.Body)
+	}
+	return mux, res.Header().Get("Location")
+}
+
+// checkAnswer fails on what no input should get: a server error, or a
+// refusal that does not say why.
+func checkAnswer(t *testing.T, res *httptest.ResponseRecorder, input string) {
+	if res.Code >= 500 {
+		t.Fatalf("%q: %d %s", input, res.Code, res.Body)
+	}
+	if res.Code >= 400 && res.Code != http.StatusNotFound && res.Code != http.StatusMethodNotAllowed && res.Body.Len() == 0 {
+		t.Fatalf("%q: %d without a message", input, res.Code)
+	}
+}
+
+func FuzzCreateFish(f *testing.F) {
+	for _, seed := range []string{
+		`{"name":"Dory","environment":"saltwater","max_length_cm":30}`,
+		`{"name":"Dory","environment":"saltwater","max_length":30}`,
+		`{"name":"Dory","environment":"saltwater","max_length":30,"max_length_cm":31}`,
+		`{"name":"","environment":"lava"}`,
+		`{"name":"\u0000\ud800","environment":"freshwater"}`,
+		`{"max_length_cm":1e400}`,
+		`{"max_length_cm":-1,"environment":"brackish"}`,
+		`{"expires_at":"not a time","environment":"freshwater"}`,
+		`{"id":"nemo","slug":"nemo","version":99,"environment":"freshwater"}`,
+		`[]`,
+		`null`,
+		`{"name":{"nested":[1,2,{}]}}`,
+		`{"name":"a"}{"name":"b"}`,
+		`{"name":"Dory",}`,
+	} {
+		f.Add([]byte(seed))
+	}
+	h, _ := newFuzzHandler(f)
+	f.Fuzz(func(t *testing.T, body []byte) {
+		res := serveTest(h, "POST", "/fishes", "application/json", body)
+		checkAnswer(t, res, string(body))
+		if res.Code == http.StatusCreated {
+			loc := res.Header().Get("Location")
+			if !strings.HasPrefix(loc, "/fishes/") {
+				t.Fatalf("%q: created without a Location", body)
+			}
+			got := serveTest(h, "GET", loc, "", nil)
+			if got.Code != http.StatusOK {
+				t.Fatalf("%q: created %s, then GET answered %d", body, loc, got.Code)
+			}
+		}
+	})
+}
+
+func FuzzPatchFish(f *testing.F) {
+	for _, seed := range []string{
+		`{"max_length_cm":12}`,
+		`{"name":null}`,
+		`{"environment":null}`,
+		`{"environment":"lava"}`,
+		`{"max_length":5,"max_length_cm":null}`,
+		`{"deleted_at":"2020-01-01T00:00:00Z"}`,
+		`"just a string"`,
+		`{}`,
+	} {
+		f.Add([]byte(seed))
+	}
+	h, nemo := newFuzzHandler(f)
+	f.Fuzz(func(t *testing.T, body []byte) {
+		req := httptest.NewRequest("PATCH", "http://fishes"+nemo, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+		req.Header.Set("If-Match", "*")
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		checkAnswer(t, res, string(body))
+	})
+}
+
+func FuzzListQuery(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"limit=1&offset=0&sort=-name",
+		"limit=0",
+		"limit=1001",
+		"limit=99999999999999999999",
+		"offset=2147483648",
+		"min_length=-1&max_length=abc",
+		"environment=saltwater&environment=freshwater",
+		"name=%ZZ",
+		"name=%00%ff",
+		"envelope=maybe",
+		"include_expired=1&envelope=0",
+		";;&&==",
+		"sort=",
+	} {
+		f.Add(seed)
+	}
+	h, _ := newFuzzHandler(f)
+	f.Fuzz(func(t *testing.T, rawQuery string) {
+		u := &url.URL{Path: "/fishes", RawQuery: rawQuery}
+		req := httptest.NewRequest("GET", "http://fishes/", nil)
+		req.URL = u
+		req.RequestURI = u.RequestURI()
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		checkAnswer(t, res, rawQuery)
+		if res.Code != http.StatusOK && res.Code != http.StatusBadRequest {
+			t.Fatalf("%q: list answered %d", rawQuery, res.Code)
+		}
+
+		// The parser on its own agrees with the handler.
+		_, problems := parseQuery(listFishesParams, req)
+		if (len(problems) > 0) != (res.Code == http.StatusBadRequest) {
+			t.Fatalf("%q: parseQuery found %q but the handler answered %d", rawQuery, problems, res.Code)
+		}
+	})
+}
+
+func FuzzFishPath(f *testing.F) {
+	for _, seed := range []string{
+		"/fishes/nemo",
+		"/fishes/nemo/",
+		"/fishes/nemo/revisions",
+		"/fishes/nemo/revisions/1",
+		"/fishes/nemo/restore",
+		"/fishes/random",
+		"/fishes//",
+		"/fishes/../admin",
+		"/fishes/%2e%2e",
+		"/fishes/" + strings.Repeat("a", 4096),
+		"/fishes/nemo\x00",
+	} {
+		f.Add("GET", seed)
+		f.Add("DELETE", seed)
+	}
+	f.Add("POST", "/fishes/nemo/restore")
+	f.Add("PUT", "/fishes/nemo")
+	h, nemo := newFuzzHandler(f)
+	f.Add("PATCH", nemo)
+	f.Add("GET", nemo+"/revisions")
+	f.Fuzz(func(t *testing.T, method, path string) {
+		if !strings.HasPrefix(path, "/fishes/") {
+			path = "/fishes/" + path
+		}
+		if key, sub, ok := fishPath(path); ok && (key == "" || strings.Contains(key, "/") || strings.HasSuffix(path, "/") && sub == "") {
+			t.Fatalf("fishPath(%q) = %q, %q", path, key, sub)
+		}
+		switch method {
+		case "GET", "HEAD", "PUT", "PATCH", "DELETE", "POST":
+		default:
+			method = "GET"
+		}
+		req, err := http.NewRequest(method, "http://fishes/", strings.NewReader("{}"))
+		if err != nil {
+			t.Skip()
+		}
+		req.URL.Path = path
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("If-Match", "*")
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		checkAnswer(t, res, method+" "+path)
+	})
+}
@@ -0,0 +1,142 @@
+package fishes
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const maxGenerateCount = 10000
+
+var (
+	fishNamePrefixes = []string{
+		"Blue", "Golden", "Spotted", "Striped", "Silver", "Red", "Dwarf", "Giant",
+		"Zebra", "Tiger", "Leopard", "Royal", "Ghost", "Harlequin", "Emerald", "Black",
+	}
+	fishNameBases = []string{
+		"Tetra", "Goby", "Cichlid", "Barb", "Danio", "Rasbora", "Catfish", "Pleco",
+		"Angelfish", "Damselfish", "Wrasse", "Tang", "Grouper", "Snapper", "Puffer", "Killifish",
+	}
+	scientificGenera = []string{
+		"Paracheirodon", "Betta", "Danio", "Corydoras", "Pterophyllum", "Amphiprion",
+		"Chromis", "Zebrasoma", "Epinephelus", "Lutjanus", "Tetraodon", "Aphyosemion",
+	}
+	scientificEpithets = []string{
+		"innesi", "splendens", "rerio", "paleatus", "scalare", "ocellaris",
+		"viridis", "flavescens", "marginatus", "campechanus", "nigroviridis", "australe",
+	}
+)
+
+// generatedEnvironments mirrors roughly how common each environment is in
+// the hobby, so generated data looks like a real collection.
+var generatedEnvironments = []struct {
+	env    Environment
+	weight int
+	minCM  int
+	maxCM  int
+}{
+	{Freshwater, 60, 2, 60},
+	{Saltwater, 30, 4, 120},
+	{Brackish, 10, 3, 40},
+}
+
+type fishGenerator struct {
+	rnd *rand.Rand
+}
+
+func newFishGenerator(seed int64) *fishGenerator {
+	return &fishGenerator{rnd: rand.New(rand.NewSource(seed))}
+}
+
+func (g *fishGenerator) pick(words []string) string {
+	return words[g.rnd.Intn(len(words))]
+}
+
+func (g *fishGenerator) fish() Fish {
+	total := 0
+	for _, e := range generatedEnvironments {
+		total += e.weight
+	}
+	n := g.rnd.Intn(total)
+	env := generatedEnvironments[0]
+	for _, e := range generatedEnvironments {
+		if n < e.weight {
+			env = e
+			break
+		}
+		n -= e.weight
+	}
+
+	return Fish{
+		Name:           g.pick(fishNamePrefixes) + " " + g.pick(fishNameBases),
+		ScientificName: g.pick(scientificGenera) + " " + g.pick(scientificEpithets),
+		Environment:    env.env,
+		MaxLength:      env.minCM + g.rnd.Intn(env.maxCM-env.minCM+1),
+	}
+}
+
+// generate creates count random fishes. A seed makes the output repeatable.
+func (a *adminPortal) generate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil || count < 1 || count > maxGenerateCount {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("count must be a number between 1 and " + strconv.Itoa(maxGenerateCount)))
+		return
+	}
+	seed := time.Now().UnixNano()
+	if raw := r.URL.Query().Get("seed"); raw != "" {
+		seed, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("seed must be an integer"))
+			return
+		}
+	}
+
+	if !a.guard.admit(w) {
+		return
+	}
+	h := a.fishes
+	// The ids are made before taking the lock, as making thousands can
+	// wait on the clock.
+	ids, err := newIDs(h.ids, count)
+	if err != nil {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	g := newFishGenerator(seed)
+	h.Lock()
+	if err := h.overQuota(count); err != nil {
+		h.Unlock()
+		w.Header().Set("X-Quota-Exceeded", "records")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	for _, id := range ids {
+		fish := g.fish()
+		fish.ID = id
+		fish.Version = 1
+		h.assignSlug(&fish)
+		h.stampUpdated(&fish)
+		if _, err := h.put(fish); err != nil {
+			h.Unlock()
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	h.Unlock()
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"created": len(ids), "seed": seed, "ids": ids})
+}
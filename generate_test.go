@@ -0,0 +1,41 @@
+package fishes
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		settings map[string]string
+		target   string
+		// wantStatus is that of the second request, the first creating
+		// 100 fishes.
+		wantStatus int
+		wantTotal  int
+	}{
+		{"more", nil, "/admin/generate?count=50&seed=1", http.StatusCreated, 150},
+		{"no count", nil, "/admin/generate", http.StatusBadRequest, 100},
+		{"too many", nil, "/admin/generate?count=10001", http.StatusBadRequest, 100},
+		{"bad seed", nil, "/admin/generate?count=1&seed=x", http.StatusBadRequest, 100},
+		// A stopped clock makes 4096 sequence ids a millisecond.
+		{"past the ids of a stopped clock", nil, "/admin/generate?count=5000", http.StatusServiceUnavailable, 100},
+		{"over the memory budget", map[string]string{"MEMORY_BUDGET_BYTES": "2000"}, "/admin/generate?count=1", http.StatusInsufficientStorage, 100},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestServer(t, true, tc.settings)
+			if res := serveAdmin(h, "POST", "/admin/generate?count=100&seed=1", "", nil); res.Code != http.StatusCreated {
+				t.Fatalf("generating 100 fishes: %d %s", res.Code, res.Body)
+			}
+			if res := serveAdmin(h, "POST", tc.target, "", nil); res.Code != tc.wantStatus {
+				t.Errorf("POST %s: %d %s, want %d", tc.target, res.Code, res.Body, tc.wantStatus)
+			}
+			res := serveTest(h, "GET", "/fishes?limit=1", "", nil)
+			if total := res.Header().Get("X-Total-Count"); total != strconv.Itoa(tc.wantTotal) {
+				t.Errorf("%s fishes stored, want %d", total, tc.wantTotal)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package fishes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The net/rpc service registered on rpc_listen as "Fishes". gob matches
+// fields by name, so fishclient declares the same types for Go consumers.
+
+// Credentials go with every call. Password is the admin password, which
+// reveals sensitive fields the way basic auth does over HTTP.
+// ConsistencyToken is one a write answered with, so that a read on a replica
+// waits for that write.
+type Credentials struct {
+	Password         string
+	ConsistencyToken string
+}
+
+// ListArgs filter, order and page Fishes.List like the query of GET /fishes.
+type ListArgs struct {
+	Credentials
+	Name        string
+	Environment string
+	MinLength   int
+	MaxLength   int
+	Sort        string
+	Limit       int
+	Offset      int
+}
+
+// FishArgs name the fish, by id or slug, and carry the fish to write. ETag is
+// the If-Match of updates and deletes, any version when empty.
+type FishArgs struct {
+	Credentials
+	ID             string
+	ETag           string
+	IdempotencyKey string
+	Fish           Fish
+}
+
+// FishReply is the fish a call answered with, empty after a delete.
+type FishReply struct {
+	Fish             Fish
+	ETag             string
+	ConsistencyToken string
+}
+
+type PageReply struct {
+	Fishes  []Fish
+	Total   int
+	Limit   int
+	Offset  int
+	Version uint64
+}
+
+// gobService runs each call as its REST request through the rpcEndpoint, so
+// it is authorized, validated and replicated like one.
+type gobService struct {
+	endpoint *rpcEndpoint
+	remote   string
+	draining <-chan struct{}
+}
+
+func (s *gobService) List(args ListArgs, reply *PageReply) error {
+	q := url.Values{"envelope": {"true"}}
+	set := func(name, value string) {
+		if value != "" {
+			q.Set(name, value)
+		}
+	}
+	setInt := func(name string, n int) {
+		if n != 0 {
+			q.Set(name, strconv.Itoa(n))
+		}
+	}
+	set("name", args.Name)
+	set("environment", args.Environment)
+	setInt("min_length", args.MinLength)
+	setInt("max_length", args.MaxLength)
+	set("sort", args.Sort)
+	setInt("limit", args.Limit)
+	setInt("offset", args.Offset)
+
+	res, err := s.run(args.Credentials, &rpcCall{method: "GET", path: "/fishes", query: q})
+	if err != nil {
+		return err
+	}
+	var list struct {
+		Data []Fish `json:"data"`
+		Meta struct {
+			Total   int    `json:"total"`
+			Limit   int    `json:"limit"`
+			Offset  int    `json:"offset"`
+			Version uint64 `json:"version"`
+		} `json:"meta"`
+	}
+	if err := json.Unmarshal(res.body.Bytes(), &list); err != nil {
+		return err
+	}
+	*reply = PageReply{Fishes: list.Data, Total: list.Meta.Total, Limit: list.Meta.Limit, Offset: list.Meta.Offset, Version: list.Meta.Version}
+	return nil
+}
+
+func (s *gobService) Get(args FishArgs, reply *FishReply) error {
+	return s.fish(args, &rpcCall{method: "GET"}, reply)
+}
+
+func (s *gobService) Create(args FishArgs, reply *FishReply) error {
+	body, err := json.Marshal(args.Fish)
+	if err != nil {
+		return err
+	}
+	c := &rpcCall{method: "POST", path: "/fishes", body: body}
+	if args.IdempotencyKey != "" {
+		c.header = http.Header{"Idempotency-Key": {args.IdempotencyKey}}
+	}
+	return s.fish(args, c, reply)
+}
+
+func (s *gobService) Update(args FishArgs, reply *FishReply) error {
+	body, err := json.Marshal(args.Fish)
+	if err != nil {
+		return err
+	}
+	return s.fish(args, &rpcCall{method: "PUT", header: ifMatch(args.ETag), body: body}, reply)
+}
+
+func (s *gobService) Delete(args FishArgs, reply *FishReply) error {
+	return s.fish(args, &rpcCall{method: "DELETE", header: ifMatch(args.ETag)}, reply)
+}
+
+func (s *gobService) Restore(args FishArgs, reply *FishReply) error {
+	return s.fish(args, &rpcCall{method: "POST", path: "/fishes/" + url.PathEscape(args.ID) + "/restore"}, reply)
+}
+
+func ifMatch(etag string) http.Header {
+	if etag == "" {
+		etag = "*"
+	}
+	return http.Header{"If-Match": {etag}}
+}
+
+// fish runs c on the fish args name, unless c has a path already, and
+// decodes the fish it answers with.
+func (s *gobService) fish(args FishArgs, c *rpcCall, reply *FishReply) error {
+	if c.path == "" {
+		if args.ID == "" {
+			return errors.New("400 Bad Request: ID is required")
+		}
+		c.path = "/fishes/" + url.PathEscape(args.ID)
+	}
+	res, err := s.run(args.Credentials, c)
+	if err != nil {
+		return err
+	}
+	*reply = FishReply{ETag: res.header.Get("ETag"), ConsistencyToken: res.header.Get(consistencyTokenHeader)}
+	if c.method == "DELETE" {
+		return nil
+	}
+	fish, err := fishOf(res)
+	if err != nil {
+		return err
+	}
+	reply.Fish = *fish
+	return nil
+}
+
+// run sends c through the handler chain as if it came over HTTP from the
+// connection's address. A refusal comes back as an error starting with the
+// HTTP status, such as "404 Not Found: fish not found".
+func (s *gobService) run(creds Credentials, c *rpcCall) (*jobResponse, error) {
+	select {
+	case <-s.draining:
+		return nil, errors.New("503 Service Unavailable: server is shutting down")
+	default:
+	}
+	r, err := http.NewRequest("POST", "/", nil)
+	if err != nil {
+		return nil, err
+	}
+	r.RemoteAddr = s.remote
+	if creds.Password != "" {
+		r.SetBasicAuth("admin", creds.Password)
+	}
+	if creds.ConsistencyToken != "" {
+		r.Header.Set(consistencyTokenHeader, creds.ConsistencyToken)
+	}
+	res, err := s.endpoint.run(r, c)
+	if err != nil {
+		return nil, err
+	}
+	if res.status >= 300 {
+		message := strings.TrimSpace(res.body.String())
+		if message == "" || strings.HasPrefix(message, "{") {
+			return nil, fmt.Errorf("%d %s", res.status, http.StatusText(res.status))
+		}
+		return nil, fmt.Errorf("%d %s: %s", res.status, http.StatusText(res.status), message)
+	}
+	return res, nil
+}
+
+// gobListener serves the Fishes service with net/rpc's gob encoding on its
+// own listener, next to the HTTP ones.
+type gobListener struct {
+	spec     listenerSpec
+	endpoint *rpcEndpoint
+	draining <-chan struct{}
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+}
+
+func newGobListener(spec listenerSpec, endpoint *rpcEndpoint, draining <-chan struct{}) *gobListener {
+	return &gobListener{spec: spec, endpoint: endpoint, draining: draining, conns: map[net.Conn]struct{}{}}
+}
+
+func (g *gobListener) listen() error {
+	l, err := g.spec.listen()
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	g.listener = l
+	g.mu.Unlock()
+	log.Printf("serving net/rpc on %s", g.spec)
+	go g.serve(l)
+	return nil
+}
+
+func (g *gobListener) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		// A server per connection, so that calls know the address they came
+		// from for admin_allow and the audit log.
+		srv := rpc.NewServer()
+		if err := srv.RegisterName("Fishes", &gobService{endpoint: g.endpoint, remote: conn.RemoteAddr().String(), draining: g.draining}); err != nil {
+			log.Printf("net/rpc: %s", err)
+			conn.Close()
+			continue
+		}
+		g.mu.Lock()
+		g.conns[conn] = struct{}{}
+		g.mu.Unlock()
+		go func() {
+			srv.ServeConn(conn)
+			g.mu.Lock()
+			delete(g.conns, conn)
+			g.mu.Unlock()
+		}()
+	}
+}
+
+// close stops accepting connections and closes the open ones. It runs
+// before a handoff too, so that the new process can bind the address.
+func (g *gobListener) close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var err error
+	if g.listener != nil {
+		err = g.listener.Close()
+		g.listener = nil
+	}
+	for conn := range g.conns {
+		conn.Close()
+	}
+	return err
+}
@@ -0,0 +1,223 @@
+// Snapshot tests of the responses clients parse, each compared with its file
+// under testdata/golden. They run against the server NewHandler assembles,
+// deterministic, so the middleware in front of the routes is snapshotted too:
+//
+//	go test -run Golden
+//	go test -run Golden -update    # after meaning to change one
+//
+// The files are named after the schema version, so a new version starts a
+// new set next to the one clients of the old version still see.
+
+package fishes
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files with the responses of this run")
+
+// volatileHeaders change from run to run whatever the serializers do.
+var volatileHeaders = map[string]bool{"Date": true, "X-Fish-Consistency-Token": true}
+
+// canonicalResponse is the form of a response: the status, the headers in
+// order, and the body, JSON indented.
+func canonicalResponse(method, target string, res *httptest.ResponseRecorder) []byte {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "%s %s\n%d %s\n", method, target, res.Code, http.StatusText(res.Code))
+	var names []string
+	for name := range res.Header() {
+		if !volatileHeaders[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range res.Header()[name] {
+			fmt.Fprintf(&out, "%s: %s\n", name, v)
+		}
+	}
+	out.WriteString("\n")
+	body := res.Body.Bytes()
+	if strings.HasPrefix(res.Header().Get("Content-Type"), "application/json") {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, body, "", "  "); err == nil {
+			body = indented.Bytes()
+		}
+	}
+	out.Write(body)
+	if len(body) > 0 && body[len(body)-1] != '\n' {
+		out.WriteString("\n")
+	}
+	return out.Bytes()
+}
+
+// assertGolden compares got with the golden file of name, or writes it with
+// -update.
+func assertGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", "golden", fmt.Sprintf("schema-%d", fishSchemaVersion), name+".golden")
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		t.Fatalf("%s does not exist, run with -update to write it", path)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("the response differs from %s (- golden, + now), run with -update if that is meant:\n%s", path, lineDiff(string(want), string(got)))
+	}
+}
+
+// lineDiff lists the lines of a and b around where they differ, by a longest
+// common subsequence; golden files are small enough for its n*m table.
+func lineDiff(a, b string) string {
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	type line struct {
+		op   byte
+		text string
+	}
+	var lines []line
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			lines = append(lines, line{' ', x[i]})
+			i, j = i+1, j+1
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, line{'-', x[i]})
+			i++
+		default:
+			lines = append(lines, line{'+', y[j]})
+			j++
+		}
+	}
+	// Keep two lines of context around each change.
+	var out strings.Builder
+	shown := -1
+	for k, l := range lines {
+		if l.op == ' ' {
+			continue
+		}
+		for c := k - 2; c < k; c++ {
+			if c > shown && c >= 0 {
+				if c > shown+1 && shown >= 0 {
+					out.WriteString("  ...\n")
+				}
+				fmt.Fprintf(&out, "%c %s\n", lines[c].op, lines[c].text)
+				shown = c
+			}
+		}
+		fmt.Fprintf(&out, "%c %s\n", l.op, l.text)
+		shown = k
+		for c := k + 1; c <= k+2 && c < len(lines) && lines[c].op == ' '; c++ {
+			fmt.Fprintf(&out, "%c %s\n", lines[c].op, lines[c].text)
+			shown = c
+		}
+	}
+	return out.String()
+}
+
+func TestGoldenResponses(t *testing.T) {
+	h := newTestServer(t, true, nil)
+	jsonType := "application/json"
+	for _, body := range []string{
+		`{"name":"Nemo","scientific_name":"Amphiprion ocellaris","environment":"saltwater","max_length_cm":11}`,
+		`{"name":"Molly","environment":"brackish","max_length_cm":12}`,
+		`{"name":"Guppy","environment":"freshwater","max_length_cm":6}`,
+	} {
+		if res := serveTest(h, "POST", "/fishes", jsonType, []byte(body)); res.Code != http.StatusCreated {
+			t.Fatalf("seeding: %d %s", res.Code, res.Body)
+		}
+	}
+	nemo := serveTest(h, "GET", "/fishes/nemo", "", nil).Header().Get("Location")
+	etag := serveTest(h, "GET", nemo, "", nil).Header().Get("ETag")
+
+	cases := []struct {
+		name, method, target, contentType, body string
+		header                                  http.Header
+	}{
+		{name: "list", method: "GET", target: "/fishes"},
+		{name: "list-enveloped", method: "GET", target: "/fishes?envelope=true"},
+		{name: "list-page", method: "GET", target: "/fishes?limit=1&offset=1&sort=-name"},
+		{name: "list-filtered-empty", method: "GET", target: "/fishes?environment=freshwater&min_length=100"},
+		{name: "get", method: "GET", target: nemo},
+		{name: "get-enveloped", method: "GET", target: nemo + "?envelope=true"},
+		{name: "get-by-slug", method: "GET", target: "/fishes/nemo"},
+		{name: "get-not-modified", method: "GET", target: nemo, header: http.Header{"If-None-Match": {etag}}},
+		{name: "create", method: "POST", target: "/fishes", contentType: jsonType, body: `{"name":"Tetra","environment":"freshwater","max_length_cm":4}`},
+		{name: "create-deprecated-field", method: "POST", target: "/fishes", contentType: jsonType, body: `{"name":"Betta","environment":"freshwater","max_length":7}`},
+		{name: "environments", method: "GET", target: "/environments"},
+		{name: "import-csv", method: "POST", target: "/fishes/import?on_error=skip", contentType: "text/csv", body: "name,environment,max_length_cm\nOscar,freshwater,35\nBad,lava,1\n"},
+		{name: "error-precondition-failed", method: "PUT", target: nemo, contentType: jsonType, body: `{"name":"Nemo","environment":"saltwater"}`, header: http.Header{"If-Match": {`"stale"`}}},
+		{name: "error-precondition-required", method: "PUT", target: nemo, contentType: jsonType, body: `{"name":"Nemo","environment":"saltwater"}`},
+		{name: "error-invalid-environment", method: "POST", target: "/fishes", contentType: jsonType, body: `{"name":"X","environment":"lava"}`},
+		{name: "error-invalid-json", method: "POST", target: "/fishes", contentType: jsonType, body: `{"name":`},
+		{name: "error-media-type", method: "POST", target: "/fishes", contentType: "text/plain", body: `{}`},
+		{name: "error-query", method: "GET", target: "/fishes?limit=0&colour=red"},
+		{name: "error-not-found", method: "GET", target: "/fishes/no-such-fish"},
+		{name: "error-method", method: "DELETE", target: "/fishes"},
+		{name: "error-invalid-environment-es", method: "POST", target: "/fishes", contentType: jsonType, body: `{"name":"X","environment":"lava"}`, header: http.Header{"Accept-Language": {"es"}}},
+		{name: "error-query-fr", method: "GET", target: "/fishes?limit=0&colour=red", header: http.Header{"Accept-Language": {"fr-CA, fr;q=0.9"}}},
+		{name: "v2-list", method: "GET", target: "/v2/fishes"},
+		{name: "v2-list-page", method: "GET", target: "/v2/fishes?limit=1&offset=1&sort=-name"},
+		{name: "v2-get", method: "GET", target: "/v2" + nemo},
+		{name: "v2-create", method: "POST", target: "/v2/fishes", contentType: jsonType, body: `{"name":"Platy","environment":"freshwater","max_length_cm":5}`},
+		{name: "v2-environments", method: "GET", target: "/v2/environments"},
+		{name: "v2-error-invalid-environment", method: "POST", target: "/v2/fishes", contentType: jsonType, body: `{"name":"X","environment":"lava"}`},
+		{name: "v2-error-invalid-json", method: "POST", target: "/v2/fishes", contentType: jsonType, body: `{"name":`},
+		{name: "v2-error-query", method: "GET", target: "/v2/fishes?limit=0&colour=red"},
+		{name: "v2-error-not-found", method: "GET", target: "/v2/fishes/no-such-fish"},
+		{name: "v2-error-method", method: "DELETE", target: "/v2/fishes"},
+		{name: "v2-error-invalid-environment-es", method: "POST", target: "/v2/fishes", contentType: jsonType, body: `{"name":"X","environment":"lava"}`, header: http.Header{"Accept-Language": {"es"}}},
+		{name: "v2-error-query-fr", method: "GET", target: "/v2/fishes?limit=0&colour=red", header: http.Header{"Accept-Language": {"fr"}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(c.method, "http://fishes"+c.target, strings.NewReader(c.body))
+			for name, values := range c.header {
+				req.Header[name] = values
+			}
+			if c.contentType != "" {
+				req.Header.Set("Content-Type", c.contentType)
+			}
+			res := httptest.NewRecorder()
+			h.ServeHTTP(res, req)
+			assertGolden(t, c.name, canonicalResponse(c.method, c.target, res))
+		})
+	}
+}
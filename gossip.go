@@ -0,0 +1,249 @@
+package fishes
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	clusterModeElection    = "election"
+	clusterModeMultiWriter = "multi-writer"
+	clusterModePartitioned = "partitioned"
+)
+
+func (c *Config) electionEnabled() bool {
+	return c.ClusterMode == clusterModeElection || len(c.Peers) > 0
+}
+
+func (c *Config) multiWriter() bool {
+	return c.ClusterMode == clusterModeMultiWriter || len(c.SyncPeers) > 0
+}
+
+// clusterMode is the mode this node gossips, so members only pick peers of
+// their own kind.
+func (c *Config) clusterMode() string {
+	switch {
+	case c.ClusterMode == clusterModePartitioned:
+		return clusterModePartitioned
+	case c.electionEnabled():
+		return clusterModeElection
+	case c.multiWriter():
+		return clusterModeMultiWriter
+	}
+	return ""
+}
+
+// gossipFanout is how many members each round is sent to.
+const gossipFanout = 3
+
+const (
+	memberAlive   = "alive"
+	memberSuspect = "suspect"
+	memberDead    = "dead"
+)
+
+// member is one node as known through gossip. Each node bumps its own
+// heartbeat every round; the others only keep the highest they heard of, and
+// LastSeen is when that last grew here. Incarnation is when the node started,
+// so a restarted node is not ignored for counting from zero again.
+type member struct {
+	URL         string    `json:"url"`
+	Node        string    `json:"node"`
+	Mode        string    `json:"mode"`
+	Incarnation int64     `json:"incarnation"`
+	Heartbeat   uint64    `json:"heartbeat"`
+	State       string    `json:"state,omitempty"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+type gossipMessage struct {
+	Members []member `json:"members"`
+}
+
+// membership finds the nodes of the cluster by gossip, starting from seeds.
+// A member not heard of for member_timeout is suspect, after twice that it
+// is dead and no longer used as a peer, and after ten times it is forgotten.
+type membership struct {
+	self    string
+	seeds   []string
+	fishes  *fishesHandler
+	client  *http.Client
+	rnd     *rand.Rand
+	started time.Time
+
+	sync.Mutex
+	members map[string]*member
+}
+
+func newMembership(h *fishesHandler) *membership {
+	cfg := h.config()
+	self := strings.TrimSuffix(cfg.AdvertiseURL, "/")
+	m := &membership{
+		self:    self,
+		fishes:  h,
+		client:  &http.Client{Timeout: cfg.GossipInterval},
+		rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		started: time.Now(),
+		members: map[string]*member{},
+	}
+	for _, seed := range cfg.Seeds {
+		if seed = strings.TrimSuffix(seed, "/"); seed != self {
+			m.seeds = append(m.seeds, seed)
+		}
+	}
+	m.members[self] = &member{URL: self, Node: strconv.FormatInt(cfg.NodeID, 10), Mode: cfg.clusterMode(), Incarnation: time.Now().UnixNano(), State: memberAlive, LastSeen: time.Now()}
+	return m
+}
+
+// updateStates ages the members. Callers must hold the lock.
+func (m *membership) updateStates(now time.Time) {
+	timeout := m.fishes.config().MemberTimeout
+	for url, mem := range m.members {
+		if url == m.self {
+			continue
+		}
+		switch silent := now.Sub(mem.LastSeen); {
+		case silent > 10*timeout:
+			delete(m.members, url)
+		case silent > 2*timeout:
+			if mem.State != memberDead {
+				log.Printf("gossip: %s is dead", url)
+			}
+			mem.State = memberDead
+		case silent > timeout:
+			mem.State = memberSuspect
+		default:
+			mem.State = memberAlive
+		}
+	}
+}
+
+// merge takes the heartbeats in members that are newer than the known ones.
+// Callers must hold the lock.
+func (m *membership) merge(members []member, now time.Time) {
+	for _, mem := range members {
+		if mem.URL == m.self || mem.URL == "" {
+			continue
+		}
+		known, ok := m.members[mem.URL]
+		if !ok {
+			log.Printf("gossip: %s joined (node %s, %s)", mem.URL, mem.Node, mem.Mode)
+			known = &member{URL: mem.URL}
+			m.members[mem.URL] = known
+		} else if mem.Incarnation < known.Incarnation || (mem.Incarnation == known.Incarnation && mem.Heartbeat <= known.Heartbeat) {
+			continue
+		}
+		known.Node, known.Mode, known.Incarnation, known.Heartbeat = mem.Node, mem.Mode, mem.Incarnation, mem.Heartbeat
+		known.LastSeen = now
+		known.State = memberAlive
+	}
+}
+
+// list copies the members, sorted by URL. Callers must hold the lock.
+func (m *membership) list() []member {
+	members := make([]member, 0, len(m.members))
+	for _, mem := range m.members {
+		members = append(members, *mem)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].URL < members[j].URL })
+	return members
+}
+
+// peers returns the other members running mode that are not dead.
+func (m *membership) peers(mode string) []string {
+	m.Lock()
+	defer m.Unlock()
+	var peers []string
+	for _, mem := range m.list() {
+		if mem.URL != m.self && mem.Mode == mode && mem.State != memberDead {
+			peers = append(peers, mem.URL)
+		}
+	}
+	return peers
+}
+
+// gossipNow runs one round: it sends the membership to a few random live
+// members and to one seed or dead member, so nodes that come back are found
+// again, and merges the answers.
+func (m *membership) gossipNow() error {
+	now := time.Now()
+	m.Lock()
+	self := m.members[m.self]
+	self.Heartbeat++
+	self.LastSeen = now
+	m.updateStates(now)
+	var targets, probes []string
+	for _, mem := range m.list() {
+		switch {
+		case mem.URL == m.self:
+		case mem.State == memberDead:
+			probes = append(probes, mem.URL)
+		default:
+			targets = append(targets, mem.URL)
+		}
+	}
+	m.rnd.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+	if len(targets) > gossipFanout {
+		targets = targets[:gossipFanout]
+	}
+	for _, seed := range m.seeds {
+		if _, known := m.members[seed]; !known {
+			probes = append(probes, seed)
+		}
+	}
+	if len(probes) > 0 {
+		targets = append(targets, probes[m.rnd.Intn(len(probes))])
+	}
+	msg := gossipMessage{Members: m.list()}
+	m.Unlock()
+
+	key := m.fishes.config().ReplicationKey
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			var resp gossipMessage
+			if err := postPeer(context.Background(), m.client, key, target, "/admin/gossip", msg, &resp); err != nil {
+				return
+			}
+			m.Lock()
+			m.merge(resp.Members, time.Now())
+			m.Unlock()
+		}(target)
+	}
+	wg.Wait()
+	return nil
+}
+
+// gossip merges a member's view and answers with this one.
+func (m *membership) gossip(w http.ResponseWriter, r *http.Request) {
+	var msg gossipMessage
+	if !readMessage(w, r, &msg) {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.merge(msg.Members, time.Now())
+	writeJSON(w, http.StatusOK, gossipMessage{Members: m.list()})
+}
+
+// membersList serves /cluster/members.
+func (m *membership) membersList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.updateStates(time.Now())
+	writeJSON(w, http.StatusOK, m.list())
+}
@@ -0,0 +1,723 @@
+package fishes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// POST /graphql answers queries of a subset of GraphQL over this schema:
+//
+//	type Query {
+//	  fishes(name, environment, min_length, max_length, sort, limit, offset, include_expired): [Fish]
+//	  fish(id: String!): Fish
+//	  environments: [Environment]
+//	}
+//	type Environment { value label fishes(...same as Query.fishes but environment): [Fish] }
+//	type Fish { the fields of a fish by their JSON names }
+//
+// Aliases, variables with defaults and __typename are understood; fragments,
+// directives, mutations and introspection are not. Every fishes and fish
+// field is run as a REST request through the handler chain, like /rpc does.
+
+// maxGraphQLCalls bounds the REST requests one query may cost, which
+// aliases could otherwise multiply.
+const maxGraphQLCalls = 100
+
+// gqlSchema maps each type to the type of its fields, [T] for lists and
+// empty for scalars. Fish has the JSON names of its struct's fields.
+var gqlSchema = map[string]map[string]string{
+	"Query":       {"fishes": "[Fish]", "fish": "Fish", "environments": "[Environment]"},
+	"Environment": {"value": "", "label": "", "fishes": "[Fish]"},
+	"Fish": func() map[string]string {
+		fields := map[string]string{}
+		t := reflect.TypeOf(Fish{})
+		for i := 0; i < t.NumField(); i++ {
+			if name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+				fields[name] = ""
+			}
+		}
+		return fields
+	}(),
+}
+
+// gqlArgs lists the arguments of the fields that take some. The fishes of
+// an environment take the filters of all fishes but environment.
+var gqlArgs = map[string][]string{
+	"Query.fishes":       gqlParamNames(listFishesParams, "envelope"),
+	"Query.fish":         {"id"},
+	"Environment.fishes": gqlParamNames(listFishesParams, "envelope", "environment"),
+}
+
+func gqlParamNames(specs []paramSpec, except ...string) []string {
+	var names []string
+	for _, spec := range specs {
+		excluded := false
+		for _, e := range except {
+			excluded = excluded || spec.name == e
+		}
+		if !excluded {
+			names = append(names, spec.name)
+		}
+	}
+	return names
+}
+
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+type graphQLLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+type graphQLError struct {
+	Message   string            `json:"message"`
+	Locations []graphQLLocation `json:"locations,omitempty"`
+	Path      []interface{}     `json:"path,omitempty"`
+}
+
+type graphQLResponse struct {
+	Data   interface{}     `json:"data,omitempty"`
+	Errors []*graphQLError `json:"errors,omitempty"`
+}
+
+// gqlObject is a result object, which keeps its keys in the order they were
+// selected in.
+type gqlObject []gqlEntry
+
+type gqlEntry struct {
+	key   string
+	value interface{}
+}
+
+func (o gqlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, e := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(e.key)
+		value, err := json.Marshal(e.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// The parsed query.
+
+type gqlField struct {
+	alias      string
+	name       string
+	args       map[string]interface{}
+	selections []*gqlField
+	pos        int
+}
+
+func (f *gqlField) key() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+// gqlVariable is a $name in an argument.
+type gqlVariable string
+
+type gqlOperation struct {
+	name       string
+	defaults   map[string]interface{}
+	selections []*gqlField
+}
+
+type gqlSyntaxError struct {
+	message string
+	pos     int
+}
+
+func (e *gqlSyntaxError) Error() string {
+	return e.message
+}
+
+// gqlParser reads the query a token at a time; the current token is
+// kind and text at pos.
+type gqlParser struct {
+	src  string
+	pos  int
+	kind byte // 'n' name, 'i' int, 'f' float, 's' string, 'p' punctuator, 0 end
+	text string
+	next int
+}
+
+func (p *gqlParser) fail(format string, args ...interface{}) {
+	panic(&gqlSyntaxError{message: fmt.Sprintf(format, args...), pos: p.pos})
+}
+
+// advance moves to the next token, skipping whitespace, commas and comments.
+func (p *gqlParser) advance() {
+	i := p.next
+	for i < len(p.src) {
+		c := p.src[i]
+		if c == '#' {
+			for i < len(p.src) && p.src[i] != '\n' {
+				i++
+			}
+		} else if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			i++
+		} else {
+			break
+		}
+	}
+	p.pos = i
+	if i == len(p.src) {
+		p.kind, p.text, p.next = 0, "", i
+		return
+	}
+	c := p.src[i]
+	switch {
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		j := i + 1
+		for j < len(p.src) && (p.src[j] == '_' || p.src[j] >= 'a' && p.src[j] <= 'z' || p.src[j] >= 'A' && p.src[j] <= 'Z' || p.src[j] >= '0' && p.src[j] <= '9') {
+			j++
+		}
+		p.kind, p.text, p.next = 'n', p.src[i:j], j
+	case c == '-' || c >= '0' && c <= '9':
+		j, kind := i+1, byte('i')
+		for j < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[j]) >= 0 {
+			if strings.IndexByte(".eE", p.src[j]) >= 0 {
+				kind = 'f'
+			}
+			j++
+		}
+		p.kind, p.text, p.next = kind, p.src[i:j], j
+	case c == '"':
+		if strings.HasPrefix(p.src[i:], `"""`) {
+			p.fail("block strings are not supported")
+		}
+		j := i + 1
+		for j < len(p.src) && p.src[j] != '"' && p.src[j] != '\n' {
+			if p.src[j] == '\\' {
+				j++
+			}
+			j++
+		}
+		if j >= len(p.src) || p.src[j] != '"' {
+			p.fail("unterminated string")
+		}
+		var s string
+		if err := json.Unmarshal([]byte(p.src[i:j+1]), &s); err != nil {
+			p.fail("invalid string %s", p.src[i:j+1])
+		}
+		p.kind, p.text, p.next = 's', s, j+1
+	case strings.HasPrefix(p.src[i:], "..."):
+		p.fail("fragments are not supported")
+	case strings.IndexByte("{}()[]:$!=@|&", c) >= 0:
+		p.kind, p.text, p.next = 'p', p.src[i:i+1], i+1
+	default:
+		r, _ := utf8.DecodeRuneInString(p.src[i:])
+		p.fail("unexpected character %q", r)
+	}
+}
+
+func (p *gqlParser) is(text string) bool {
+	return (p.kind == 'p' || p.kind == 'n') && p.text == text
+}
+
+func (p *gqlParser) expect(text string) {
+	if !p.is(text) {
+		p.fail("expected %s, found %s", text, p.describe())
+	}
+	p.advance()
+}
+
+func (p *gqlParser) name() string {
+	if p.kind != 'n' {
+		p.fail("expected a name, found %s", p.describe())
+	}
+	name := p.text
+	p.advance()
+	return name
+}
+
+func (p *gqlParser) describe() string {
+	switch p.kind {
+	case 0:
+		return "the end of the query"
+	case 's':
+		return strconv.Quote(p.text)
+	}
+	return "'" + p.text + "'"
+}
+
+// parseGraphQL reads the operation named operationName out of query, the
+// only one when operationName is empty.
+func parseGraphQL(query, operationName string) (op *gqlOperation, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			syntax, ok := r.(*gqlSyntaxError)
+			if !ok {
+				panic(r)
+			}
+			op, err = nil, syntax
+		}
+	}()
+	p := &gqlParser{src: query}
+	p.advance()
+	var ops []*gqlOperation
+	for p.kind != 0 {
+		ops = append(ops, p.operation())
+	}
+	if len(ops) == 0 {
+		return nil, &gqlSyntaxError{message: "the query is empty", pos: -1}
+	}
+	if len(ops) == 1 && operationName == "" {
+		return ops[0], nil
+	}
+	for _, candidate := range ops {
+		if candidate.name == operationName && operationName != "" {
+			return candidate, nil
+		}
+	}
+	if operationName == "" {
+		return nil, &gqlSyntaxError{message: "the document holds several operations, operationName must pick one", pos: -1}
+	}
+	return nil, &gqlSyntaxError{message: fmt.Sprintf("no operation named '%s'", operationName), pos: -1}
+}
+
+func (p *gqlParser) operation() *gqlOperation {
+	op := &gqlOperation{defaults: map[string]interface{}{}}
+	if p.kind == 'n' {
+		switch p.text {
+		case "query":
+		case "mutation", "subscription":
+			p.fail("only queries are supported, %ss are not", p.text)
+		default:
+			p.fail("expected query or {, found %s", p.describe())
+		}
+		p.advance()
+		if p.kind == 'n' {
+			op.name = p.name()
+		}
+		if p.is("(") {
+			p.advance()
+			for !p.is(")") {
+				p.expect("$")
+				name := p.name()
+				p.expect(":")
+				p.typeRef()
+				op.defaults[name] = nil
+				if p.is("=") {
+					p.advance()
+					op.defaults[name] = p.value(true)
+				}
+			}
+			p.advance()
+		}
+	}
+	if p.is("@") {
+		p.fail("directives are not supported")
+	}
+	op.selections = p.selectionSet()
+	return op
+}
+
+// typeRef skips a variable's type; the arguments are checked where used.
+func (p *gqlParser) typeRef() {
+	if p.is("[") {
+		p.advance()
+		p.typeRef()
+		p.expect("]")
+	} else {
+		p.name()
+	}
+	if p.is("!") {
+		p.advance()
+	}
+}
+
+func (p *gqlParser) selectionSet() []*gqlField {
+	p.expect("{")
+	var fields []*gqlField
+	for !p.is("}") {
+		fields = append(fields, p.field())
+	}
+	p.advance()
+	return fields
+}
+
+func (p *gqlParser) field() *gqlField {
+	f := &gqlField{pos: p.pos, name: p.name()}
+	if p.is(":") {
+		p.advance()
+		f.alias, f.name = f.name, p.name()
+	}
+	if p.is("(") {
+		p.advance()
+		f.args = map[string]interface{}{}
+		for !p.is(")") {
+			name := p.name()
+			p.expect(":")
+			if _, dup := f.args[name]; dup {
+				p.fail("argument '%s' is given twice", name)
+			}
+			f.args[name] = p.value(false)
+		}
+		p.advance()
+	}
+	if p.is("@") {
+		p.fail("directives are not supported")
+	}
+	if p.is("{") {
+		f.selections = p.selectionSet()
+	}
+	return f
+}
+
+// value reads a literal, or a variable unless constant.
+func (p *gqlParser) value(constant bool) interface{} {
+	var v interface{}
+	switch p.kind {
+	case 'i':
+		n, err := strconv.ParseInt(p.text, 10, 64)
+		if err != nil {
+			p.fail("invalid integer %s", p.text)
+		}
+		v = n
+	case 'f':
+		f, err := strconv.ParseFloat(p.text, 64)
+		if err != nil {
+			p.fail("invalid number %s", p.text)
+		}
+		v = f
+	case 's':
+		v = p.text
+	case 'n':
+		switch p.text {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		default:
+			// An enum value, such as freshwater.
+			v = p.text
+		}
+	case 'p':
+		switch p.text {
+		case "$":
+			if constant {
+				p.fail("a default value cannot use a variable")
+			}
+			p.advance()
+			return gqlVariable(p.name())
+		case "[":
+			p.advance()
+			list := []interface{}{}
+			for !p.is("]") {
+				list = append(list, p.value(constant))
+			}
+			p.advance()
+			return list
+		case "{":
+			p.advance()
+			object := map[string]interface{}{}
+			for !p.is("}") {
+				name := p.name()
+				p.expect(":")
+				object[name] = p.value(constant)
+			}
+			p.advance()
+			return object
+		}
+		p.fail("expected a value, found %s", p.describe())
+	default:
+		p.fail("expected a value, found %s", p.describe())
+	}
+	p.advance()
+	return v
+}
+
+// graphQLEndpoint serves POST /graphql, resolving fishes through the same
+// handler chain as /rpc.
+type graphQLEndpoint struct {
+	calls *rpcEndpoint
+}
+
+func (e *graphQLEndpoint) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	body, ok := readJSONBody(w, r, "application/json", "application/json; charset=utf-8")
+	if !ok {
+		return
+	}
+	var req graphQLRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, graphQLResponse{Errors: []*graphQLError{{Message: "invalid request: " + err.Error()}}})
+		return
+	}
+	op, err := parseGraphQL(req.Query, req.OperationName)
+	if err != nil {
+		gqlErr := &graphQLError{Message: "syntax error: " + err.Error()}
+		if syntax := err.(*gqlSyntaxError); syntax.pos >= 0 {
+			gqlErr.Locations = []graphQLLocation{location(req.Query, syntax.pos)}
+		}
+		writeJSON(w, http.StatusBadRequest, graphQLResponse{Errors: []*graphQLError{gqlErr}})
+		return
+	}
+
+	x := &gqlExecution{endpoint: e, r: r, query: req.Query, variables: map[string]interface{}{}}
+	for name, def := range op.defaults {
+		x.variables[name] = def
+	}
+	for name, value := range req.Variables {
+		if _, declared := op.defaults[name]; !declared {
+			x.errors = append(x.errors, &graphQLError{Message: fmt.Sprintf("variable '$%s' is not declared by the operation", name)})
+		}
+		x.variables[name] = value
+	}
+	x.validate("Query", op.selections)
+	if len(x.errors) > 0 {
+		writeJSON(w, http.StatusBadRequest, graphQLResponse{Errors: x.errors})
+		return
+	}
+	data := x.object("Query", op.selections, nil, []interface{}{})
+	writeJSON(w, http.StatusOK, graphQLResponse{Data: data, Errors: x.errors})
+}
+
+func location(src string, pos int) graphQLLocation {
+	before := src[:pos]
+	line := strings.Count(before, "\n") + 1
+	column := utf8.RuneCountInString(before[strings.LastIndex(before, "\n")+1:]) + 1
+	return graphQLLocation{Line: line, Column: column}
+}
+
+// gqlExecution resolves one query. A field whose lookup fails is null in the
+// data and explained in errors, the rest of the query still resolves.
+type gqlExecution struct {
+	endpoint  *graphQLEndpoint
+	r         *http.Request
+	query     string
+	variables map[string]interface{}
+	calls     int
+	errors    []*graphQLError
+}
+
+// fail reports an error on f, at path in the data unless path is nil, as
+// it is while validating.
+func (x *gqlExecution) fail(f *gqlField, path []interface{}, format string, args ...interface{}) {
+	gqlErr := &graphQLError{Message: fmt.Sprintf(format, args...), Locations: []graphQLLocation{location(x.query, f.pos)}}
+	if path != nil {
+		gqlErr.Path = append(append([]interface{}{}, path...), f.key())
+	}
+	x.errors = append(x.errors, gqlErr)
+}
+
+// validate checks selections against the schema before anything runs, so
+// that a mistake is reported once rather than for every fish.
+func (x *gqlExecution) validate(typeName string, selections []*gqlField) {
+	seen := map[string]bool{}
+	for _, f := range selections {
+		if seen[f.key()] {
+			x.fail(f, nil, "'%s' is selected twice, give one an alias", f.key())
+		}
+		seen[f.key()] = true
+		if f.name == "__typename" {
+			x.validateLeaf(f, "")
+			continue
+		}
+		fieldType, ok := gqlSchema[typeName][f.name]
+		if !ok {
+			x.fail(f, nil, "%s has no field '%s'", typeName, f.name)
+			continue
+		}
+		x.validateLeaf(f, fieldType)
+		allowed := map[string]bool{}
+		for _, name := range gqlArgs[typeName+"."+f.name] {
+			allowed[name] = true
+		}
+		for name, value := range f.args {
+			if !allowed[name] {
+				x.fail(f, nil, "'%s' takes no argument '%s'", f.name, name)
+			}
+			if v, ok := value.(gqlVariable); ok {
+				if _, declared := x.variables[string(v)]; !declared {
+					x.fail(f, nil, "variable '$%s' is not declared", v)
+				}
+			}
+		}
+		if typeName+"."+f.name == "Query.fish" && f.args["id"] == nil {
+			x.fail(f, nil, "fish needs an id")
+		}
+		if fieldType != "" && f.selections != nil {
+			x.validate(strings.Trim(fieldType, "[]"), f.selections)
+		}
+	}
+}
+
+func (x *gqlExecution) validateLeaf(f *gqlField, fieldType string) {
+	if fieldType == "" && f.selections != nil {
+		x.fail(f, nil, "'%s' has no subfields to select", f.name)
+	}
+	if fieldType != "" && len(f.selections) == 0 {
+		x.fail(f, nil, "'%s' needs a selection of subfields", f.name)
+	}
+}
+
+// object resolves selections on a value of typeName; source is the fish or
+// environment it stands for, nil for the Query.
+func (x *gqlExecution) object(typeName string, selections []*gqlField, source map[string]interface{}, path []interface{}) gqlObject {
+	out := gqlObject{}
+	for _, f := range selections {
+		out = append(out, gqlEntry{key: f.key(), value: x.field(typeName, f, source, path)})
+	}
+	return out
+}
+
+func (x *gqlExecution) field(typeName string, f *gqlField, source map[string]interface{}, path []interface{}) interface{} {
+	fieldPath := append(append([]interface{}{}, path...), f.key())
+	switch typeName + "." + f.name {
+	case "Query.fishes":
+		args, ok := x.args(f, path)
+		if !ok {
+			return nil
+		}
+		return x.fishes(f, args, fieldPath, path)
+	case "Environment.fishes":
+		args, ok := x.args(f, path)
+		if !ok {
+			return nil
+		}
+		args.Set("environment", source["value"].(string))
+		return x.fishes(f, args, fieldPath, path)
+	case "Query.fish":
+		args, ok := x.args(f, path)
+		if !ok {
+			return nil
+		}
+		if args.Get("id") == "" {
+			x.fail(f, path, "fish needs an id")
+			return nil
+		}
+		return x.fish(f, args.Get("id"), fieldPath, path)
+	case "Query.environments":
+		list := []interface{}{}
+		loc := localeOf(x.r)
+		for i, env := range environments {
+			source := map[string]interface{}{"value": string(env), "label": loc.environmentLabel(env)}
+			list = append(list, x.object("Environment", f.selections, source, append(fieldPath, i)))
+		}
+		return list
+	}
+	if f.name == "__typename" {
+		return typeName
+	}
+	return source[f.name]
+}
+
+// args resolves the variables of f's arguments and turns them into the
+// query parameters the REST handlers validate.
+func (x *gqlExecution) args(f *gqlField, path []interface{}) (url.Values, bool) {
+	q := url.Values{}
+	for name, value := range f.args {
+		if v, ok := value.(gqlVariable); ok {
+			value = x.variables[string(v)]
+		}
+		switch v := value.(type) {
+		case nil:
+			continue
+		case string:
+			q.Set(name, v)
+		case bool:
+			q.Set(name, strconv.FormatBool(v))
+		case int64:
+			q.Set(name, strconv.FormatInt(v, 10))
+		case float64:
+			// Integers come as float64 from JSON variables.
+			q.Set(name, strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			x.fail(f, path, "argument '%s' must be a string, a number or a boolean", name)
+			return nil, false
+		}
+	}
+	return q, true
+}
+
+// fetch runs a REST GET, reporting a failure on f. A 404 is one only when
+// notFoundFails.
+func (x *gqlExecution) fetch(f *gqlField, path []interface{}, c *rpcCall, notFoundFails bool) (*jobResponse, bool) {
+	if x.calls++; x.calls > maxGraphQLCalls {
+		x.fail(f, path, "the query needs more than %d lookups", maxGraphQLCalls)
+		return nil, false
+	}
+	res, err := x.endpoint.calls.run(x.r, c)
+	if err != nil {
+		x.fail(f, path, "%s", err)
+		return nil, false
+	}
+	if res.status >= 300 && (res.status != http.StatusNotFound || notFoundFails) {
+		message := strings.TrimSpace(res.body.String())
+		if message == "" || strings.HasPrefix(message, "{") {
+			message = http.StatusText(res.status)
+		}
+		x.fail(f, path, "%s", message)
+		return nil, false
+	}
+	return res, true
+}
+
+func (x *gqlExecution) fishes(f *gqlField, args url.Values, fieldPath, path []interface{}) interface{} {
+	args.Set("envelope", "true")
+	res, ok := x.fetch(f, path, &rpcCall{method: "GET", path: "/fishes", query: args}, true)
+	if !ok {
+		return nil
+	}
+	var list struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(res.body.Bytes(), &list); err != nil {
+		x.fail(f, path, "%s", err)
+		return nil
+	}
+	out := []interface{}{}
+	for i, fish := range list.Data {
+		out = append(out, x.object("Fish", f.selections, fish, append(fieldPath, i)))
+	}
+	return out
+}
+
+// fish is null for an id nothing is stored under.
+func (x *gqlExecution) fish(f *gqlField, id string, fieldPath, path []interface{}) interface{} {
+	res, ok := x.fetch(f, path, &rpcCall{method: "GET", path: "/fishes/" + url.PathEscape(id), query: url.Values{"envelope": {"true"}}}, false)
+	if !ok || res.status == http.StatusNotFound {
+		return nil
+	}
+	var answer struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(res.body.Bytes(), &answer); err != nil {
+		x.fail(f, path, "%s", err)
+		return nil
+	}
+	return x.object("Fish", f.selections, answer.Data, fieldPath)
+}
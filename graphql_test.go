@@ -0,0 +1,79 @@
+package fishes
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGraphQL(t *testing.T) {
+	h := newTestServer(t, false, nil)
+	var nemo Fish
+	for _, body := range []string{
+		`{"name":"Nemo","environment":"saltwater","max_length_cm":11}`,
+		`{"name":"Guppy","environment":"freshwater","max_length_cm":6}`,
+	} {
+		res := serveTest(h, "POST", "/fishes", "application/json", []byte(body))
+		if res.Code != http.StatusCreated {
+			t.Fatalf("seeding: %d %s", res.Code, res.Body)
+		}
+		if nemo.ID == "" {
+			json.Unmarshal(res.Body.Bytes(), &nemo)
+		}
+	}
+
+	query := func(q string, variables map[string]interface{}) string {
+		body, _ := json.Marshal(graphQLRequest{Query: q, Variables: variables})
+		return string(body)
+	}
+	for _, tc := range []struct {
+		name, body string
+		wantStatus int
+		// wantData is the data answered, wantError part of the first error.
+		wantData, wantError string
+	}{
+		{"fishes", query(`{ fishes(sort: "name") { name } }`, nil), http.StatusOK,
+			`{"fishes":[{"name":"Guppy"},{"name":"Nemo"}]}`, ""},
+		{"fish by variable", query(`query One($id: String!) { fish(id: $id) { name environment } }`, map[string]interface{}{"id": nemo.ID}), http.StatusOK,
+			`{"fish":{"name":"Nemo","environment":"saltwater"}}`, ""},
+		{"aliases", query(`{ small: fishes(max_length: 10) { name } big: fishes(min_length: 10) { name } }`, nil), http.StatusOK,
+			`{"small":[{"name":"Guppy"}],"big":[{"name":"Nemo"}]}`, ""},
+		{"environments", query(`{ environments { value fishes { name __typename } } }`, nil), http.StatusOK,
+			`{"environments":[{"value":"freshwater","fishes":[{"name":"Guppy","__typename":"Fish"}]},{"value":"saltwater","fishes":[{"name":"Nemo","__typename":"Fish"}]},{"value":"brackish","fishes":[]}]}`, ""},
+		{"missing fish", query(`{ fish(id: "no-such-fish") { name } }`, nil), http.StatusOK,
+			`{"fish":null}`, ""},
+		{"syntax error", query(`{ fishes { name `, nil), http.StatusBadRequest,
+			"", "syntax error"},
+		{"unknown field", query(`{ fishes { fins } }`, nil), http.StatusBadRequest,
+			"", "fins"},
+		{"unknown argument", query(`{ fishes(colour: "red") { name } }`, nil), http.StatusBadRequest,
+			"", "colour"},
+		{"undeclared variable", query(`{ fishes { name } }`, map[string]interface{}{"id": "x"}), http.StatusBadRequest,
+			"", "not declared"},
+		{"mutation", query(`mutation { fishes { name } }`, nil), http.StatusBadRequest,
+			"", "syntax error"},
+		{"not JSON", `{"query":`, http.StatusBadRequest,
+			"", "invalid request"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res := serveTest(h, "POST", "/graphql", "application/json", []byte(tc.body))
+			if res.Code != tc.wantStatus {
+				t.Fatalf("%d %s, want %d", res.Code, res.Body, tc.wantStatus)
+			}
+			var answer struct {
+				Data   json.RawMessage `json:"data"`
+				Errors []graphQLError  `json:"errors"`
+			}
+			if err := json.Unmarshal(res.Body.Bytes(), &answer); err != nil {
+				t.Fatalf("%s: %s", err, res.Body)
+			}
+			if string(answer.Data) != tc.wantData {
+				t.Errorf("data %s, want %s", answer.Data, tc.wantData)
+			}
+			if tc.wantError == "" && len(answer.Errors) > 0 || tc.wantError != "" && (len(answer.Errors) == 0 || !strings.Contains(answer.Errors[0].Message, tc.wantError)) {
+				t.Errorf("errors %+v, want one saying %q", answer.Errors, tc.wantError)
+			}
+		})
+	}
+}
@@ -0,0 +1,447 @@
+package fishes
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grpcService is the path prefix of the fish.v1.Fishes service of
+// fishes.proto.
+const grpcService = "/fish.v1.Fishes/"
+
+// gRPC status codes.
+const (
+	grpcOK                 = 0
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcAborted            = 10
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// grpcCodeOf is the code of a refusal of the REST handlers.
+func grpcCodeOf(status int) int {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity, http.StatusRequestEntityTooLarge:
+		return grpcInvalidArgument
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound, http.StatusGone:
+		return grpcNotFound
+	case http.StatusConflict:
+		return grpcAborted
+	case http.StatusPreconditionFailed, http.StatusPreconditionRequired:
+		return grpcFailedPrecondition
+	case http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusNotImplemented:
+		return grpcUnimplemented
+	case http.StatusServiceUnavailable, http.StatusBadGateway:
+		return grpcUnavailable
+	case http.StatusGatewayTimeout:
+		return grpcDeadlineExceeded
+	}
+	if status >= 500 {
+		return grpcInternal
+	}
+	return grpcUnknown
+}
+
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return e.message
+}
+
+func grpcErrorf(code int, format string, args ...interface{}) *grpcError {
+	return &grpcError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+func encodeFishProto(f *Fish) []byte {
+	var p protoBuffer
+	p.str(1, f.ID)
+	p.str(2, f.Name)
+	p.str(3, f.Slug)
+	p.str(4, f.ScientificName)
+	p.str(5, string(f.Environment))
+	p.int(6, int64(f.MaxLength))
+	p.str(7, f.OwnerContact)
+	p.int(8, int64(f.Version))
+	if f.ExpiresAt != nil {
+		p.str(9, f.ExpiresAt.Format(time.RFC3339Nano))
+	}
+	if f.DeletedAt != nil {
+		p.str(10, f.DeletedAt.Format(time.RFC3339Nano))
+	}
+	if f.UpdatedAt != nil {
+		p.str(11, f.UpdatedAt.Format(time.RFC3339Nano))
+	}
+	return p.Bytes()
+}
+
+func decodeFishProto(b []byte) (Fish, error) {
+	var fish Fish
+	fields, err := protoFields(b)
+	if err != nil {
+		return fish, err
+	}
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			fish.ID = f.str()
+		case 2:
+			fish.Name = f.str()
+		case 3:
+			fish.Slug = f.str()
+		case 4:
+			fish.ScientificName = f.str()
+		case 5:
+			fish.Environment = Environment(f.str())
+		case 6:
+			fish.MaxLength = f.int()
+		case 7:
+			fish.OwnerContact = f.str()
+		case 8:
+			fish.Version = f.int()
+		case 9, 10, 11:
+			if f.str() == "" {
+				continue
+			}
+			at, err := time.Parse(time.RFC3339Nano, f.str())
+			if err != nil {
+				return fish, fmt.Errorf("field %d must be an RFC 3339 time", f.number)
+			}
+			switch f.number {
+			case 9:
+				fish.ExpiresAt = &at
+			case 10:
+				fish.DeletedAt = &at
+			default:
+				fish.UpdatedAt = &at
+			}
+		}
+	}
+	return fish, nil
+}
+
+// fishResponse encodes a FishResponse out of the REST answer.
+func fishResponse(res *jobResponse) (interface{}, error) {
+	fish, err := fishOf(res)
+	if err != nil {
+		return nil, err
+	}
+	var p protoBuffer
+	p.bytes(1, encodeFishProto(fish))
+	p.str(2, res.header.Get("ETag"))
+	return p.Bytes(), nil
+}
+
+// grpcMethods turn a request message into the REST call it stands for,
+// whose result encodes the response message.
+var grpcMethods = map[string]func(fields []protoField) (*rpcCall, error){
+	"ListFishes": func(fields []protoField) (*rpcCall, error) {
+		q := url.Values{"envelope": {"true"}}
+		names := map[int]string{1: "name", 2: "environment", 3: "min_length", 4: "max_length", 5: "sort", 6: "limit", 7: "offset"}
+		for _, f := range fields {
+			switch f.number {
+			case 1, 2, 5:
+				q.Set(names[f.number], f.str())
+			case 3, 4, 6, 7:
+				q.Set(names[f.number], strconv.Itoa(f.int()))
+			}
+		}
+		return &rpcCall{method: "GET", path: "/fishes", query: q, result: func(res *jobResponse) (interface{}, error) {
+			var list struct {
+				Data []Fish `json:"data"`
+				Meta struct {
+					Total   int    `json:"total"`
+					Limit   int    `json:"limit"`
+					Offset  int    `json:"offset"`
+					Version uint64 `json:"version"`
+				} `json:"meta"`
+			}
+			if err := json.Unmarshal(res.body.Bytes(), &list); err != nil {
+				return nil, err
+			}
+			var p protoBuffer
+			for i := range list.Data {
+				p.bytes(1, encodeFishProto(&list.Data[i]))
+			}
+			p.int(2, int64(list.Meta.Total))
+			p.int(3, int64(list.Meta.Limit))
+			p.int(4, int64(list.Meta.Offset))
+			p.int(5, int64(list.Meta.Version))
+			return p.Bytes(), nil
+		}}, nil
+	},
+	"GetFish": func(fields []protoField) (*rpcCall, error) {
+		path, err := grpcFishPath(fields, "")
+		return &rpcCall{method: "GET", path: path, result: fishResponse}, err
+	},
+	"CreateFish": func(fields []protoField) (*rpcCall, error) {
+		c := &rpcCall{method: "POST", path: "/fishes", result: fishResponse}
+		for _, f := range fields {
+			if f.number == 2 && f.str() != "" {
+				c.header = http.Header{"Idempotency-Key": {f.str()}}
+			}
+		}
+		body, _, err := grpcFishBody(fields)
+		c.body = body
+		return c, err
+	},
+	"UpdateFish": func(fields []protoField) (*rpcCall, error) {
+		body, fish, err := grpcFishBody(fields)
+		if err != nil {
+			return nil, err
+		}
+		if fish.ID == "" {
+			return nil, errors.New("fish.id is required")
+		}
+		etag := ""
+		for _, f := range fields {
+			if f.number == 2 {
+				etag = f.str()
+			}
+		}
+		return &rpcCall{method: "PUT", path: "/fishes/" + url.PathEscape(fish.ID), header: ifMatch(etag), body: body, result: fishResponse}, nil
+	},
+	"DeleteFish": func(fields []protoField) (*rpcCall, error) {
+		path, err := grpcFishPath(fields, "")
+		etag := ""
+		for _, f := range fields {
+			if f.number == 2 {
+				etag = f.str()
+			}
+		}
+		return &rpcCall{method: "DELETE", path: path, header: ifMatch(etag), result: func(*jobResponse) (interface{}, error) { return []byte{}, nil }}, err
+	},
+	"RestoreFish": func(fields []protoField) (*rpcCall, error) {
+		path, err := grpcFishPath(fields, "/restore")
+		return &rpcCall{method: "POST", path: path, result: fishResponse}, err
+	},
+}
+
+// grpcFishPath is the path of the fish whose id is field 1.
+func grpcFishPath(fields []protoField, sub string) (string, error) {
+	id := ""
+	for _, f := range fields {
+		if f.number == 1 {
+			id = f.str()
+		}
+	}
+	if id == "" {
+		return "", errors.New("id is required")
+	}
+	return "/fishes/" + url.PathEscape(id) + sub, nil
+}
+
+// grpcFishBody is the JSON of the fish in field 1.
+func grpcFishBody(fields []protoField) (json.RawMessage, Fish, error) {
+	var fish Fish
+	found := false
+	for _, f := range fields {
+		if f.number == 1 {
+			var err error
+			if fish, err = decodeFishProto(f.data); err != nil {
+				return nil, fish, fmt.Errorf("fish: %s", err)
+			}
+			found = true
+		}
+	}
+	if !found {
+		return nil, fish, errors.New("fish is required")
+	}
+	body, err := json.Marshal(fish)
+	return body, fish, err
+}
+
+// grpcEndpoint answers unary calls of fish.v1.Fishes with the gRPC framing
+// over HTTP/2. Like /rpc, each call runs as its REST request through the
+// handler chain; the endpoint sits in front of it so that a replica forwards
+// those requests, which are plain JSON, and not the gRPC one.
+type grpcEndpoint struct {
+	calls *rpcEndpoint
+}
+
+func (g *grpcEndpoint) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, grpcService) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		g.serve(w, r)
+	})
+}
+
+func (g *grpcEndpoint) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/grpc" && ct != "application/grpc+proto" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		w.Write([]byte(fmt.Sprintf("need content-type 'application/grpc' but got '%s'", ct)))
+		return
+	}
+	if r.ProtoMajor != 2 {
+		w.WriteHeader(http.StatusHTTPVersionNotSupported)
+		w.Write([]byte("gRPC needs HTTP/2"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	message, err := g.call(w, r)
+	if err != nil {
+		gerr, ok := err.(*grpcError)
+		if !ok {
+			gerr = grpcErrorf(grpcInternal, "%s", err)
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Grpc-Status", strconv.Itoa(gerr.code))
+		w.Header().Set("Grpc-Message", grpcEscape(gerr.message))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(message)))
+	w.Write(prefix[:])
+	w.Write(message)
+	w.Header().Set("Grpc-Status", strconv.Itoa(grpcOK))
+}
+
+func (g *grpcEndpoint) call(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	method, ok := grpcMethods[strings.TrimPrefix(r.URL.Path, grpcService)]
+	if !ok {
+		return nil, grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path)
+	}
+	if timeout := r.Header.Get("Grpc-Timeout"); timeout != "" {
+		d, err := parseGRPCTimeout(timeout)
+		if err != nil {
+			return nil, grpcErrorf(grpcInvalidArgument, "%s", err)
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	request, err := readGRPCMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := protoFields(request)
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "invalid request message: %s", err)
+	}
+	c, err := method(fields)
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	res, err := g.calls.run(r, c)
+	if err != nil {
+		return nil, err
+	}
+	if r.Context().Err() == context.DeadlineExceeded {
+		return nil, grpcErrorf(grpcDeadlineExceeded, "deadline exceeded")
+	}
+	if res.status >= 300 {
+		message := strings.TrimSpace(res.body.String())
+		if message == "" || strings.HasPrefix(message, "{") {
+			message = http.StatusText(res.status)
+		}
+		return nil, grpcErrorf(grpcCodeOf(res.status), "%s", message)
+	}
+	// Sent as response metadata, to pass on to reads on a replica.
+	if token := res.header.Get(consistencyTokenHeader); token != "" {
+		w.Header().Set(consistencyTokenHeader, token)
+	}
+	answer, err := c.result(res)
+	if err != nil {
+		return nil, err
+	}
+	return answer.([]byte), nil
+}
+
+// readGRPCMessage reads the one message of a unary call, gunzipping it when
+// the client compressed it.
+func readGRPCMessage(r *http.Request) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r.Body, prefix[:]); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading the request message: %s", err)
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxImportBytes {
+		return nil, grpcErrorf(grpcResourceExhausted, "the request message is larger than %d bytes", maxImportBytes)
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(r.Body, message); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading the request message: %s", err)
+	}
+	if prefix[0] == 0 {
+		return message, nil
+	}
+	if encoding := r.Header.Get("Grpc-Encoding"); encoding != "gzip" {
+		return nil, grpcErrorf(grpcUnimplemented, "unsupported grpc-encoding '%s'", encoding)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(message))
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	message, err = ioutil.ReadAll(io.LimitReader(zr, maxImportBytes))
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	return message, nil
+}
+
+// parseGRPCTimeout reads a grpc-timeout such as 500m or 10S.
+func parseGRPCTimeout(raw string) (time.Duration, error) {
+	units := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second, 'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}
+	if len(raw) < 2 || len(raw) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout '%s'", raw)
+	}
+	unit, ok := units[raw[len(raw)-1]]
+	n, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+	if !ok || err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid grpc-timeout '%s'", raw)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// grpcEscape percent-encodes a grpc-message.
+func grpcEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
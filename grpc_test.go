@@ -0,0 +1,139 @@
+package fishes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// grpcFrame is message with the length prefix of an uncompressed message.
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+// serveGRPC sends a unary call to h over HTTP/2 and returns the answer with
+// its grpc-status, from the trailers.
+func serveGRPC(h http.Handler, method string, body []byte, header http.Header) (*httptest.ResponseRecorder, int) {
+	req := httptest.NewRequest("POST", "http://fishes"+grpcService+method, bytes.NewReader(body))
+	req.ProtoMajor, req.ProtoMinor = 2, 0
+	req.Header.Set("Content-Type", "application/grpc")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	status, err := strconv.Atoi(res.Result().Trailer.Get("Grpc-Status"))
+	if err != nil {
+		status = -1
+	}
+	return res, status
+}
+
+func TestGRPC(t *testing.T) {
+	h := newTestServer(t, false, nil)
+
+	var create protoBuffer
+	create.bytes(1, encodeFishProto(&Fish{Name: "Nemo", Environment: "saltwater", MaxLength: 11}))
+	res, status := serveGRPC(h, "CreateFish", grpcFrame(create.Bytes()), nil)
+	if status != grpcOK {
+		t.Fatalf("CreateFish: grpc-status %d %q", status, res.Result().Trailer.Get("Grpc-Message"))
+	}
+	fields, err := protoFields(res.Body.Bytes()[5:])
+	if err != nil || len(fields) == 0 {
+		t.Fatalf("CreateFish answered %x: %v", res.Body.Bytes(), err)
+	}
+	nemo, err := decodeFishProto(fields[0].data)
+	if err != nil || nemo.ID == "" || nemo.Name != "Nemo" || nemo.MaxLength != 11 {
+		t.Fatalf("CreateFish answered %+v, %v", nemo, err)
+	}
+
+	message := func(fields ...string) []byte {
+		var p protoBuffer
+		for i, value := range fields {
+			p.str(i+1, value)
+		}
+		return grpcFrame(p.Bytes())
+	}
+	var invalid protoBuffer
+	invalid.bytes(1, encodeFishProto(&Fish{Name: "X", Environment: "lava"}))
+	for _, tc := range []struct {
+		name, method string
+		body         []byte
+		header       http.Header
+		wantStatus   int
+	}{
+		{"get", "GetFish", message(nemo.ID), nil, grpcOK},
+		{"list", "ListFishes", message(), nil, grpcOK},
+		{"not found", "GetFish", message("no-such-fish"), nil, grpcNotFound},
+		{"no id", "GetFish", message(), nil, grpcInvalidArgument},
+		{"invalid fish", "CreateFish", grpcFrame(invalid.Bytes()), nil, grpcInvalidArgument},
+		{"stale etag", "DeleteFish", message(nemo.ID, `"stale"`), nil, grpcFailedPrecondition},
+		{"unknown method", "FryFish", message(), nil, grpcUnimplemented},
+		{"malformed message", "GetFish", grpcFrame([]byte{0x0a, 0x10, 'x'}), nil, grpcInvalidArgument},
+		{"truncated frame", "GetFish", []byte{0, 0, 0}, nil, grpcInvalidArgument},
+		{"compressed without an encoding", "GetFish", append([]byte{1}, message(nemo.ID)[1:]...), nil, grpcUnimplemented},
+		{"bad timeout", "GetFish", message(nemo.ID), http.Header{"Grpc-Timeout": {"soon"}}, grpcInvalidArgument},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res, status := serveGRPC(h, tc.method, tc.body, tc.header)
+			if status != tc.wantStatus {
+				t.Errorf("grpc-status %d %q, want %d", status, res.Result().Trailer.Get("Grpc-Message"), tc.wantStatus)
+			}
+		})
+	}
+
+	req := httptest.NewRequest("POST", "http://fishes"+grpcService+"GetFish", bytes.NewReader(message(nemo.ID)))
+	req.Header.Set("Content-Type", "application/grpc")
+	plain := httptest.NewRecorder()
+	h.ServeHTTP(plain, req)
+	if plain.Code != http.StatusHTTPVersionNotSupported {
+		t.Errorf("a call over HTTP/1.1: %d %s", plain.Code, plain.Body)
+	}
+}
+
+func TestParseGRPCTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		raw  string
+		want time.Duration
+		ok   bool
+	}{
+		{"500m", 500 * time.Millisecond, true},
+		{"10S", 10 * time.Second, true},
+		{"1H", time.Hour, true},
+		{"250u", 250 * time.Microsecond, true},
+		{"5", 0, false},
+		{"5s", 0, false},
+		{"-1S", 0, false},
+		{"1234567890S", 0, false},
+	} {
+		got, err := parseGRPCTimeout(tc.raw)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("parseGRPCTimeout(%q) = %s, %v; want %s, accepted %v", tc.raw, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestFishProtoRoundTrip(t *testing.T) {
+	at := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, fish := range []Fish{
+		{},
+		{ID: "1", Name: "Nemo", Slug: "nemo", ScientificName: "Amphiprion ocellaris", Environment: "saltwater", MaxLength: 11, Version: 3},
+		{ID: "2", Name: "Dory", ExpiresAt: &at, DeletedAt: &at, UpdatedAt: &at},
+	} {
+		got, err := decodeFishProto(encodeFishProto(&fish))
+		if err != nil || string(encodeFishProto(&got)) != string(encodeFishProto(&fish)) {
+			t.Errorf("%+v came back as %+v, %v", fish, got, err)
+		}
+	}
+	var bad protoBuffer
+	bad.str(9, "tomorrow")
+	if _, err := decodeFishProto(bad.Bytes()); err == nil {
+		t.Error("an expires_at that is not a time was accepted")
+	}
+}
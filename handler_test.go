@@ -0,0 +1,83 @@
+package fishes
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestHandler is the fish routes of a server without data_dir, on a mux
+// of its own, with an empty store.
+func newTestHandler(t testing.TB, clock Clock, random RandSource) http.Handler {
+	return testRoutes(newTestFishes(t, clock, random))
+}
+
+// newTestFishes is the store of newTestHandler.
+func newTestFishes(t testing.TB, clock Clock, random RandSource) *fishesHandler {
+	cfg := defaultConfig()
+	cfg.AdminPassword = "test"
+	ids, err := newIDGenerator(cfg.IDGenerator, cfg.NodeID, clock, random)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newFishesHander(cfg, ids, newResponseCache())
+	h.clock, h.random = clock, random
+	if h.keys, err = newKeyring(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// testRoutes are the fish routes of h on a mux of their own.
+func testRoutes(h *fishesHandler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/environments", getEnvironments)
+	mux.HandleFunc("/fishes", h.fishes)
+	mux.HandleFunc("/fishes/", h.fish)
+	mux.HandleFunc("/fishes/import", h.importFishes)
+	mux.HandleFunc("/fishes/trash", validateQuery(listTrashParams, h.getTrash))
+	return mux
+}
+
+func serveTest(h http.Handler, method, target, contentType string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "http://fishes"+target, bytes.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	return res
+}
+
+// newTestServer is the whole server NewHandler builds, every middleware
+// included, configured by settings as environment variables over a data_dir
+// of its own. It is shut down when the test ends.
+func newTestServer(t testing.TB, deterministic bool, settings map[string]string) http.Handler {
+	env := map[string]string{"ADMIN_PASSWORD": "test", "DATA_DIR": t.TempDir()}
+	for key, value := range settings {
+		env[key] = value
+	}
+	handler, close, err := NewHandler(func(key string) string { return env[key] }, deterministic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return handler
+}
+
+// serveAdmin is serveTest with the admin credentials of newTestServer.
+func serveAdmin(h http.Handler, method, target, contentType string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "http://fishes"+target, bytes.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.SetBasicAuth("admin", "test")
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	return res
+}
@@ -0,0 +1,85 @@
+package fishes
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type hostRoute struct {
+	pattern string
+	allowed func(path string) bool
+}
+
+// hostRouter restricts each virtual host to the routes of its profile.
+type hostRouter struct {
+	routes   []hostRoute
+	fallback func(path string) bool
+}
+
+func parseHostRouter(entries []string) (*hostRouter, error) {
+	h := &hostRouter{}
+	for _, entry := range entries {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid host '%s', expected host=profile", entry)
+		}
+		host := strings.ToLower(strings.TrimSpace(kv[0]))
+		allowed, ok := routeProfiles[strings.TrimSpace(kv[1])]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile '%s' for host '%s'", kv[1], host)
+		}
+
+		if host == "*" {
+			h.fallback = allowed
+			continue
+		}
+		h.routes = append(h.routes, hostRoute{pattern: host, allowed: allowed})
+	}
+	return h, nil
+}
+
+func (route hostRoute) matches(host string) bool {
+	if strings.HasPrefix(route.pattern, "*.") {
+		return strings.HasSuffix(host, route.pattern[1:])
+	}
+	return host == route.pattern
+}
+
+func (h *hostRouter) lookup(host string) (func(path string) bool, bool) {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	for _, route := range h.routes {
+		if route.matches(host) {
+			return route.allowed, true
+		}
+	}
+	if h.fallback != nil {
+		return h.fallback, true
+	}
+	return nil, false
+}
+
+func (h *hostRouter) wrap(next http.Handler) http.Handler {
+	if len(h.routes) == 0 && h.fallback == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, ok := h.lookup(r.Host)
+		if !ok {
+			w.WriteHeader(http.StatusMisdirectedRequest)
+			w.Write([]byte(fmt.Sprintf("host '%s' is not served here", r.Host)))
+			return
+		}
+		if !allowed(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,150 @@
+package fishes
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const maxIdempotencyKeyLength = 255
+
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 && !informational(status) {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+type idempotencyEntry struct {
+	done        chan struct{}
+	fingerprint [sha256.Size]byte
+	status      int
+	header      http.Header
+	body        []byte
+	expires     time.Time
+}
+
+type idempotencyCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]*idempotencyEntry
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:     ttl,
+		entries: map[string]*idempotencyEntry{},
+	}
+}
+
+func (c *idempotencyCache) setTTL(ttl time.Duration) {
+	c.Lock()
+	c.ttl = ttl
+	c.Unlock()
+}
+
+func (c *idempotencyCache) purgeExpired(now time.Time) {
+	for key, entry := range c.entries {
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// wrap replays the answer to a request repeated with the same
+// Idempotency-Key. Keys are scoped to the route as the client sent it,
+// tenant prefix included, and to who sent it, so one caller cannot replay
+// another's answer by guessing its key.
+func (c *idempotencyCache) wrap(clock Clock, principal func(*http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Idempotency-Key must be at most 255 characters"))
+			return
+		}
+
+		bodyBytes, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+		fingerprint := sha256.Sum256(bodyBytes)
+		scopedKey := fmt.Sprintf("%s %s %q %s", r.Method, clientPath(r, r.URL.Path), principal(r), key)
+
+		c.Lock()
+		c.purgeExpired(clock.Now())
+		entry, ok := c.entries[scopedKey]
+		if !ok {
+			entry = &idempotencyEntry{done: make(chan struct{}), fingerprint: fingerprint}
+			c.entries[scopedKey] = entry
+		}
+		c.Unlock()
+
+		if ok {
+			<-entry.done
+			if entry.fingerprint != fingerprint {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.Write([]byte("Idempotency-Key was already used with a different request body"))
+				return
+			}
+			if entry.status == 0 {
+				// the first attempt failed and was discarded, treat this one as new
+				c.wrap(clock, principal, next)(w, r)
+				return
+			}
+			for name, values := range entry.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(entry.status)
+			w.Write(entry.body)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		finished := false
+		// Deferred so that the requests waiting on done are let go, and the
+		// key freed, when next panics.
+		defer func() {
+			c.Lock()
+			if !finished || rec.status == 0 || rec.status >= http.StatusInternalServerError {
+				delete(c.entries, scopedKey)
+			} else {
+				entry.status = rec.status
+				entry.header = w.Header().Clone()
+				entry.body = rec.body.Bytes()
+				entry.expires = clock.Now().Add(c.ttl)
+			}
+			c.Unlock()
+			close(entry.done)
+		}()
+		next(rec, r)
+		finished = true
+	}
+}
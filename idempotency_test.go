@@ -0,0 +1,89 @@
+package fishes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeyScope(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		first, second  string
+		path           string
+		wantReplayed   bool
+		wantSecondCall bool
+	}{
+		{"same caller", "alice", "alice", "/fishes", true, false},
+		{"other caller", "alice", "bob", "/fishes", false, true},
+		{"other tenant", "alice", "alice", "/t/acme/fishes", false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newIdempotencyCache(time.Minute)
+			calls := 0
+			handler := c.wrap(systemClock{}, func(r *http.Request) string { return r.Header.Get("X-Principal") }, func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				w.WriteHeader(http.StatusCreated)
+			})
+			send := func(principal, path string) *httptest.ResponseRecorder {
+				r := httptest.NewRequest("POST", "http://fishes/fishes", strings.NewReader(`{"name":"Nemo"}`))
+				if path != "/fishes" {
+					r = r.WithContext(context.WithValue(r.Context(), pathPrefixKey, strings.TrimSuffix(path, "/fishes")))
+				}
+				r.Header.Set("Idempotency-Key", "k1")
+				r.Header.Set("X-Principal", principal)
+				res := httptest.NewRecorder()
+				handler(res, r)
+				return res
+			}
+
+			send(tc.first, "/fishes")
+			res := send(tc.second, tc.path)
+			if got := res.Header().Get("Idempotent-Replayed") == "true"; got != tc.wantReplayed {
+				t.Errorf("replayed = %v, want %v", got, tc.wantReplayed)
+			}
+			if got := calls == 2; got != tc.wantSecondCall {
+				t.Errorf("handler ran %d times", calls)
+			}
+		})
+	}
+}
+
+// A handler that panics frees its key, so a retry is served instead of
+// waiting forever on the first attempt.
+func TestIdempotencyKeyFreedOnPanic(t *testing.T) {
+	c := newIdempotencyCache(time.Minute)
+	panicking := true
+	handler := c.wrap(systemClock{}, func(*http.Request) string { return "" }, func(w http.ResponseWriter, r *http.Request) {
+		if panicking {
+			panic(http.ErrAbortHandler)
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	send := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "http://fishes/fishes", strings.NewReader(`{}`))
+		r.Header.Set("Idempotency-Key", "k1")
+		res := httptest.NewRecorder()
+		handler(res, r)
+		return res
+	}
+
+	func() {
+		defer func() { recover() }()
+		send()
+	}()
+	panicking = false
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- send() }()
+	select {
+	case res := <-done:
+		if res.Code != http.StatusCreated || res.Header().Get("Idempotent-Replayed") != "" {
+			t.Errorf("retry after the panic: %d replayed=%q", res.Code, res.Header().Get("Idempotent-Replayed"))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the retry is still waiting on the attempt that panicked")
+	}
+}
@@ -0,0 +1,142 @@
+package fishes
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type IDGenerator interface {
+	NewID() string
+}
+
+type uuidGenerator struct {
+	random RandSource
+}
+
+func (g uuidGenerator) NewID() string {
+	var b [16]byte
+	if _, err := g.random.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+const (
+	sequenceNodeBits = 10
+	sequenceSeqBits  = 12
+	maxSequenceNode  = 1<<sequenceNodeBits - 1
+	maxSequenceSeq   = 1<<sequenceSeqBits - 1
+)
+
+// sequenceGenerator produces time-ordered 63-bit IDs made of a millisecond
+// timestamp, the node number and a per-millisecond sequence.
+type sequenceGenerator struct {
+	sync.Mutex
+	clock  Clock
+	node   int64
+	lastMS int64
+	seq    int64
+}
+
+func newSequenceGenerator(node int64, clock Clock) (*sequenceGenerator, error) {
+	if node < 0 || node > maxSequenceNode {
+		return nil, fmt.Errorf("node must be between 0 and %d, got %d", maxSequenceNode, node)
+	}
+	return &sequenceGenerator{clock: clock, node: node}, nil
+}
+
+// sequenceClockWait is how long NewIDs waits for the clock to move on once
+// a millisecond ran out of sequence numbers.
+const sequenceClockWait = 10 * time.Millisecond
+
+var errClockStopped = errors.New("the clock does not move on, so no more ids can be made this millisecond")
+
+func (g *sequenceGenerator) NewID() string {
+	g.Lock()
+	defer g.Unlock()
+	// A stopped test clock has to be advanced for this to return.
+	id, _ := g.next(-1)
+	return id
+}
+
+// NewIDs makes n ids, failing with errClockStopped instead of waiting on a
+// clock that stands still.
+func (g *sequenceGenerator) NewIDs(n int) ([]string, error) {
+	g.Lock()
+	defer g.Unlock()
+	ids := make([]string, n)
+	for i := range ids {
+		id, err := g.next(sequenceClockWait)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+// next makes an id, waiting at most wait, or for as long as it takes when it
+// is negative, for the clock to move on once the millisecond ran out of
+// sequence numbers. Callers must hold the lock.
+func (g *sequenceGenerator) next(wait time.Duration) (string, error) {
+	now := g.clock.Now().UnixNano() / int64(time.Millisecond)
+	if now < g.lastMS {
+		now = g.lastMS
+	}
+
+	if now == g.lastMS {
+		g.seq++
+		if g.seq > maxSequenceSeq {
+			deadline := time.Now().Add(wait)
+			for now <= g.lastMS {
+				if wait >= 0 && time.Now().After(deadline) {
+					g.seq = maxSequenceSeq
+					return "", errClockStopped
+				}
+				time.Sleep(time.Millisecond - time.Duration(g.clock.Now().UnixNano()%int64(time.Millisecond)))
+				now = g.clock.Now().UnixNano() / int64(time.Millisecond)
+			}
+			g.seq = 0
+		}
+	} else {
+		g.seq = 0
+	}
+	g.lastMS = now
+
+	id := now<<(sequenceNodeBits+sequenceSeqBits) | g.node<<sequenceSeqBits | g.seq
+	return strconv.FormatInt(id, 10), nil
+}
+
+// idBatcher is an IDGenerator that makes many ids at once and can fail
+// rather than block.
+type idBatcher interface {
+	NewIDs(n int) ([]string, error)
+}
+
+// newIDs makes n ids with g, at once when it is an idBatcher.
+func newIDs(g IDGenerator, n int) ([]string, error) {
+	if b, ok := g.(idBatcher); ok {
+		return b.NewIDs(n)
+	}
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = g.NewID()
+	}
+	return ids, nil
+}
+
+func newIDGenerator(kind string, node int64, clock Clock, random RandSource) (IDGenerator, error) {
+	switch kind {
+	case "", "sequence":
+		return newSequenceGenerator(node, clock)
+	case "uuid":
+		return uuidGenerator{random: random}, nil
+	default:
+		return nil, fmt.Errorf("unknown id generator '%s', must be 'sequence' or 'uuid'", kind)
+	}
+}
@@ -0,0 +1,39 @@
+package fishes
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSequenceNewIDs(t *testing.T) {
+	clock := &testClock{now: testEpoch}
+	g, err := newSequenceGenerator(1, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := g.NewIDs(maxSequenceSeq + 1)
+	if err != nil || len(ids) != maxSequenceSeq+1 {
+		t.Fatalf("the ids of one millisecond: %d, %v", len(ids), err)
+	}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if seen[id] {
+			t.Fatalf("id %s was made twice", id)
+		}
+		seen[id] = true
+	}
+
+	started := time.Now()
+	if _, err := g.NewIDs(1); err != errClockStopped {
+		t.Fatalf("an id past the millisecond on a stopped clock: %v, want errClockStopped", err)
+	}
+	if waited := time.Since(started); waited > time.Second {
+		t.Errorf("failing took %s", waited)
+	}
+
+	clock.now = clock.now.Add(time.Millisecond)
+	more, err := g.NewIDs(2)
+	if err != nil || len(more) != 2 || seen[more[0]] || more[0] <= ids[len(ids)-1] {
+		t.Errorf("once the clock moved: %v, %v", more, err)
+	}
+}
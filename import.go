@@ -0,0 +1,260 @@
+package fishes
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+)
+
+const maxImportBytes = 64 << 20
+
+type importChanges struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+type importReport struct {
+	DryRun   bool          `json:"dry_run"`
+	Applied  bool          `json:"applied"`
+	Records  int           `json:"records"`
+	Problems []string      `json:"problems"`
+	Changes  importChanges `json:"changes"`
+}
+
+func readArchive(data []byte) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[hdr.Name] = content
+	}
+}
+
+// parseExport checks the archive against its manifest and the current schema
+// and returns the snapshot it describes. Every record is checked so a single
+// report lists all problems.
+func parseExport(files map[string][]byte) (*snapshot, []string) {
+	var problems []string
+
+	var manifest exportManifest
+	data, ok := files[exportManifestName]
+	if !ok {
+		return nil, []string{"archive has no " + exportManifestName}
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, []string{fmt.Sprintf("%s: %s", exportManifestName, err)}
+	}
+	if manifest.Format != exportFormat {
+		return nil, []string{fmt.Sprintf("unknown archive format %q", manifest.Format)}
+	}
+	if manifest.FormatVersion > exportFormatVersion {
+		return nil, []string{fmt.Sprintf("archive format version %d is newer than supported version %d", manifest.FormatVersion, exportFormatVersion)}
+	}
+	if manifest.SchemaVersion > fishSchemaVersion {
+		return nil, []string{fmt.Sprintf("archive schema version %d is newer than supported version %d", manifest.SchemaVersion, fishSchemaVersion)}
+	}
+
+	for _, file := range manifest.Files {
+		content, ok := files[file.Name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s: listed in manifest but missing", file.Name))
+		case len(content) != file.Bytes || checksum(content) != file.SHA256:
+			problems = append(problems, fmt.Sprintf("%s: checksum mismatch", file.Name))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	snap := &snapshot{SchemaVersion: fishSchemaVersion, Slugs: map[string]string{}}
+	seen := map[string]bool{}
+	fishes, fishProblems := parseExportRecords("fishes.json", files["fishes.json"], seen)
+	problems = append(problems, fishProblems...)
+	snap.Fishes = fishes
+	if data, ok := files["trash.json"]; ok {
+		trash, trashProblems := parseExportRecords("trash.json", data, seen)
+		problems = append(problems, trashProblems...)
+		now := time.Now().UTC()
+		for i := range trash {
+			if trash[i].DeletedAt == nil {
+				trash[i].DeletedAt = &now
+			}
+		}
+		snap.Trash = trash
+	}
+
+	if data, ok := files["slugs.json"]; ok {
+		if err := json.Unmarshal(data, &snap.Slugs); err != nil {
+			problems = append(problems, fmt.Sprintf("slugs.json: %s", err))
+		}
+		for slug, id := range snap.Slugs {
+			if !seen[id] {
+				problems = append(problems, fmt.Sprintf("slugs.json: slug %q points to unknown id %q", slug, id))
+			}
+		}
+	}
+
+	return snap, problems
+}
+
+// parseExportRecords decodes and validates the fishes in one archive file.
+// seen collects ids across files so duplicates are caught.
+func parseExportRecords(name string, data []byte, seen map[string]bool) ([]Fish, []string) {
+	var records []json.RawMessage
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, []string{fmt.Sprintf("%s: %s", name, err)}
+	}
+
+	var fishes []Fish
+	var problems []string
+	for i, record := range records {
+		fish, _, err := decodeFish(record)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s[%d]: %s", name, i, err))
+			continue
+		}
+		if fish.ID == "" {
+			problems = append(problems, fmt.Sprintf("%s[%d]: missing id", name, i))
+			continue
+		}
+		if seen[fish.ID] {
+			problems = append(problems, fmt.Sprintf("%s[%d]: duplicate id %q", name, i, fish.ID))
+			continue
+		}
+		seen[fish.ID] = true
+		if err := validateEnvironment(fish.Environment); err != nil {
+			problems = append(problems, fmt.Sprintf("%s[%d]: %s", name, i, err))
+		}
+		if fish.Version == 0 {
+			fish.Version = 1
+		}
+		fishes = append(fishes, fish)
+	}
+	return fishes, problems
+}
+
+func newImportChanges() importChanges {
+	return importChanges{Added: []string{}, Removed: []string{}, Changed: []string{}}
+}
+
+func diffFishIDs(old, updated *snapshot) importChanges {
+	changes := newImportChanges()
+	before := make(map[string]Fish, len(old.Fishes))
+	for _, fish := range old.Fishes {
+		before[fish.ID] = fish
+	}
+	for _, fish := range updated.Fishes {
+		prev, ok := before[fish.ID]
+		if !ok {
+			changes.Added = append(changes.Added, fish.ID)
+		} else if !reflect.DeepEqual(prev, fish) {
+			changes.Changed = append(changes.Changed, fish.ID)
+		}
+		delete(before, fish.ID)
+	}
+	for id := range before {
+		changes.Removed = append(changes.Removed, id)
+	}
+	sort.Strings(changes.Removed)
+	return changes
+}
+
+func (a *adminPortal) importArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+
+	dryRun := false
+	switch r.URL.Query().Get("dry_run") {
+	case "", "false":
+	case "true":
+		dryRun = true
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("dry_run must be true or false"))
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	body, ok := readJSONBody(w, r, "application/gzip", "application/x-gzip")
+	if !ok {
+		return
+	}
+
+	files, err := readArchive(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("invalid archive: %s", err)))
+		return
+	}
+
+	snap, problems := parseExport(files)
+	if snap != nil {
+		problems = append(problems, a.fishes.openImported(snap)...)
+	}
+	report := &importReport{DryRun: dryRun, Problems: problems, Changes: newImportChanges()}
+	if snap != nil {
+		report.Records = len(snap.Fishes)
+	}
+	if report.Problems == nil {
+		report.Problems = []string{}
+	}
+	if len(problems) > 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, report)
+		return
+	}
+
+	h := a.fishes
+	h.Lock()
+	current, err := h.fullSnapshot()
+	if err != nil {
+		h.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	report.Changes = diffFishIDs(current, snap)
+	if !dryRun {
+		if err := h.replaceAll(snap); err != nil {
+			h.Unlock()
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		report.Applied = true
+	}
+	h.Unlock()
+
+	writeJSON(w, http.StatusOK, report)
+}
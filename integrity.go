@@ -0,0 +1,168 @@
+package fishes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const quarantineDirName = "quarantine"
+
+type corruptRecord struct {
+	section string
+	index   int
+	reason  string
+	data    []byte
+}
+
+type quarantinedRecord struct {
+	Section string `json:"section"`
+	Index   int    `json:"index"`
+	Reason  string `json:"reason"`
+	File    string `json:"file,omitempty"`
+}
+
+type integrityReport struct {
+	File       string              `json:"file"`
+	CheckedAt  time.Time           `json:"checked_at"`
+	ChecksumOK bool                `json:"checksum_ok"`
+	Records    int                 `json:"records"`
+	Corrupt    []quarantinedRecord `json:"corrupt"`
+}
+
+// recordChecksum hashes a record in canonical form: compact JSON with
+// sorted keys, so formatting changes to the file do not matter.
+func recordChecksum(record map[string]json.RawMessage) string {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return ""
+	}
+	return checksum(data)
+}
+
+func fishChecksum(fish Fish) (string, error) {
+	data, err := json.Marshal(fish)
+	if err != nil {
+		return "", err
+	}
+	var record map[string]json.RawMessage
+	if err := json.Unmarshal(data, &record); err != nil {
+		return "", err
+	}
+	return recordChecksum(record), nil
+}
+
+// fileChecksum covers the header and every record checksum. It is
+// independent of the record encoding so it can be checked before migrating.
+func fileChecksum(snap *snapshot) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n%d\n%d\n", snap.SchemaVersion, snap.DataVersion, snap.Version)
+	for _, sum := range snap.Checksums {
+		fmt.Fprintf(h, "%s\n", sum)
+	}
+	for _, sum := range snap.TrashChecksums {
+		fmt.Fprintf(h, "trash %s\n", sum)
+	}
+	// Slugs is omitted when empty, so a file written with no slugs reads
+	// back with a nil map; both hash the same.
+	slugs := []byte("{}")
+	if len(snap.Slugs) > 0 {
+		slugs, _ = json.Marshal(snap.Slugs)
+	}
+	h.Write(slugs)
+	if len(snap.Archived) > 0 {
+		archived, _ := json.Marshal(snap.Archived)
+		h.Write(archived)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func fishChecksums(fishes []Fish) ([]string, error) {
+	sums := make([]string, len(fishes))
+	for i, fish := range fishes {
+		sum, err := fishChecksum(fish)
+		if err != nil {
+			return nil, err
+		}
+		sums[i] = sum
+	}
+	return sums, nil
+}
+
+func (snap *snapshot) sign() error {
+	var err error
+	if snap.Checksums, err = fishChecksums(snap.Fishes); err != nil {
+		return err
+	}
+	if len(snap.Trash) > 0 {
+		if snap.TrashChecksums, err = fishChecksums(snap.Trash); err != nil {
+			return err
+		}
+	}
+	snap.Checksum = fileChecksum(snap)
+	return nil
+}
+
+func newIntegrityReport(path string, snap *snapshot, now time.Time) *integrityReport {
+	report := &integrityReport{
+		File:       path,
+		CheckedAt:  now.UTC(),
+		ChecksumOK: snap.checksumOK,
+		Records:    len(snap.Fishes) + len(snap.Trash) + len(snap.corrupt),
+		Corrupt:    []quarantinedRecord{},
+	}
+	for _, c := range snap.corrupt {
+		report.Corrupt = append(report.Corrupt, quarantinedRecord{Section: c.section, Index: c.index, Reason: c.reason})
+	}
+	return report
+}
+
+// quarantine moves corrupt records into their own files next to the data
+// file so they can be inspected and repaired by hand.
+func quarantine(dataDir string, report *integrityReport, corrupt []corruptRecord) error {
+	if len(corrupt) == 0 {
+		return nil
+	}
+	dir := filepath.Join(dataDir, quarantineDirName)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	stamp := report.CheckedAt.Format("20060102T150405Z")
+	for i, c := range corrupt {
+		path := filepath.Join(dir, fmt.Sprintf("%s-%s-%d.json", c.section, stamp, c.index))
+		if err := writeFileAtomic(path, c.data); err != nil {
+			return err
+		}
+		report.Corrupt[i].File = path
+	}
+	return nil
+}
+
+// integrity reports what was quarantined when the data file was loaded and
+// the result of checking the file as it is on disk now.
+func (a *adminPortal) integrity(w http.ResponseWriter, r *http.Request) {
+	if a.persister == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("persistence is disabled, set data_dir to enable it"))
+		return
+	}
+
+	snap, err := readSnapshot(a.persister.path, a.fishes.keys)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	current := newIntegrityReport(a.persister.path, snap, a.fishes.clock.Now())
+
+	status := http.StatusOK
+	if !current.ChecksumOK || len(current.Corrupt) > 0 {
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, map[string]*integrityReport{"loaded": a.persister.loaded, "current": current})
+}
@@ -0,0 +1,140 @@
+package fishes
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+func isAdminPath(path string) bool {
+	return path == "/admin" || strings.HasPrefix(path, "/admin/")
+}
+
+// routeProfiles decide which routes a listener or virtual host exposes.
+// Requests for other routes get a 404 as if the route did not exist.
+var routeProfiles = map[string]func(path string) bool{
+	"default": func(path string) bool { return true },
+	"public": func(path string) bool {
+		return path != "/metrics" && !isAdminPath(path)
+	},
+	"admin":   isAdminPath,
+	"metrics": func(path string) bool { return path == "/metrics" },
+}
+
+type listenerSpec struct {
+	network string
+	address string
+	profile string
+}
+
+// parseListenSpec accepts [tcp://|unix://]address[#profile].
+func parseListenSpec(raw string) (listenerSpec, error) {
+	spec := listenerSpec{network: "tcp", address: raw}
+
+	if i := strings.LastIndex(spec.address, "#"); i >= 0 {
+		spec.profile = spec.address[i+1:]
+		spec.address = spec.address[:i]
+	}
+	if _, ok := routeProfiles[spec.profileName()]; !ok {
+		return spec, fmt.Errorf("unknown listener profile '%s' in '%s'", spec.profile, raw)
+	}
+
+	switch {
+	case strings.HasPrefix(spec.address, "unix://"):
+		spec.network = "unix"
+		spec.address = strings.TrimPrefix(spec.address, "unix://")
+	case strings.HasPrefix(spec.address, "unix:"):
+		spec.network = "unix"
+		spec.address = strings.TrimPrefix(spec.address, "unix:")
+	case strings.HasPrefix(spec.address, "tcp://"):
+		spec.address = strings.TrimPrefix(spec.address, "tcp://")
+	}
+
+	if spec.address == "" {
+		return spec, fmt.Errorf("missing address in listener '%s'", raw)
+	}
+	if spec.network == "tcp" {
+		if _, _, err := net.SplitHostPort(spec.address); err != nil {
+			return spec, fmt.Errorf("invalid listener '%s': %s", raw, err)
+		}
+	}
+	return spec, nil
+}
+
+func (s listenerSpec) String() string {
+	return s.network + "://" + s.address
+}
+
+func (s listenerSpec) raw() string {
+	if s.profile == "" {
+		return s.String()
+	}
+	return s.String() + "#" + s.profile
+}
+
+func (s listenerSpec) profileName() string {
+	if s.profile == "" {
+		return "default"
+	}
+	return s.profile
+}
+
+func (s listenerSpec) listen() (net.Listener, error) {
+	if s.network == "unix" {
+		if info, err := os.Stat(s.address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.Dial("unix", s.address); err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("%s is already in use", s.address)
+			}
+			os.Remove(s.address)
+		}
+	}
+	return net.Listen(s.network, s.address)
+}
+
+func (s listenerSpec) wrap(next http.Handler) (http.Handler, error) {
+	allowed, ok := routeProfiles[s.profileName()]
+	if !ok {
+		return nil, fmt.Errorf("unknown listener profile '%s'", s.profile)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowed(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}), nil
+}
+
+// listenerSpecs returns the configured listeners, falling back to addr.
+func (c *Config) listenerSpecs() ([]listenerSpec, error) {
+	if len(c.Listen) == 0 {
+		return []listenerSpec{{network: "tcp", address: c.Addr}}, nil
+	}
+
+	specs := make([]listenerSpec, 0, len(c.Listen))
+	for _, raw := range c.Listen {
+		spec, err := parseListenSpec(raw)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// httpsAddr is the first TCP listener, used to build HTTP to HTTPS redirects.
+func (c *Config) httpsAddr() string {
+	specs, err := c.listenerSpecs()
+	if err != nil {
+		return c.Addr
+	}
+	for _, spec := range specs {
+		if spec.network == "tcp" {
+			return spec.address
+		}
+	}
+	return c.Addr
+}
@@ -0,0 +1,384 @@
+package fishes
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const localeKey contextKey = "locale"
+
+// sourceLanguage is the language the messages are written in, which needs
+// no translation.
+const sourceLanguage = "en"
+
+// builtinCatalogs are the catalogs of locales/, built into the binary.
+//
+//go:embed locales/*.json
+var builtinCatalogs embed.FS
+
+var (
+	languageTagPattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{1,8})*$`)
+	messageVerbs       = regexp.MustCompile(`%[sdqv]`)
+	translationVerbs   = regexp.MustCompile(`%(\[\d+\])?[sdqv]`)
+)
+
+// catalogFile is a {language}.json catalog. Messages are keyed by the
+// English text, with the verbs of its fmt format standing for the values
+// the message names, as in "there is no tenant '%s'". A translation takes
+// them in order, or by position as %[2]s.
+type catalogFile struct {
+	Environments map[Environment]string `json:"environments"`
+	Messages     map[string]string      `json:"messages"`
+}
+
+type messageTranslation struct {
+	pattern *regexp.Regexp
+	format  string
+}
+
+type catalog struct {
+	language     string
+	environments map[Environment]string
+	exact        map[string]string
+	formats      []messageTranslation
+}
+
+func parseCatalog(language string, data []byte) (*catalog, error) {
+	var file catalogFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	c := &catalog{language: language, environments: file.Environments, exact: map[string]string{}}
+	keys := make([]string, 0, len(file.Messages))
+	for key := range file.Messages {
+		keys = append(keys, key)
+	}
+	// The longest formats are tried first, so "%s" does not take a message
+	// a more specific one was written for.
+	sort.Slice(keys, func(i, j int) bool { return len(keys[i]) > len(keys[j]) })
+	for _, key := range keys {
+		translated := file.Messages[key]
+		verbs := len(messageVerbs.FindAllString(key, -1))
+		if verbs == 0 {
+			c.exact[key] = translated
+			continue
+		}
+		format := translationVerbs.ReplaceAllString(translated, "%${1}s")
+		sample := make([]interface{}, verbs)
+		for i := range sample {
+			sample[i] = "x"
+		}
+		if strings.Contains(fmt.Sprintf(format, sample...), "%!") {
+			return nil, fmt.Errorf("message %q: the translation must use the %d values of the message", key, verbs)
+		}
+		expr := "^" + messageVerbs.ReplaceAllStringFunc(regexp.QuoteMeta(key), func(verb string) string {
+			if verb == "%d" {
+				return `(-?\d+)`
+			}
+			return `(.+?)`
+		}) + "$"
+		c.formats = append(c.formats, messageTranslation{pattern: regexp.MustCompile(expr), format: format})
+	}
+	return c, nil
+}
+
+func (c *catalog) translate(message string) (string, bool) {
+	if translated, ok := c.exact[message]; ok {
+		return translated, true
+	}
+	for _, t := range c.formats {
+		match := t.pattern.FindStringSubmatch(message)
+		if match == nil {
+			continue
+		}
+		values := make([]interface{}, len(match)-1)
+		for i, v := range match[1:] {
+			values[i] = v
+		}
+		return fmt.Sprintf(t.format, values...), true
+	}
+	return "", false
+}
+
+// loadCatalogs reads the built-in catalogs, then those of dir, which add
+// languages or replace built-in ones.
+func loadCatalogs(dir string) (map[string]*catalog, error) {
+	catalogs := map[string]*catalog{}
+	builtin, err := fs.Glob(builtinCatalogs, "locales/*.json")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range builtin {
+		data, err := builtinCatalogs.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		language := strings.TrimSuffix(path.Base(name), ".json")
+		if catalogs[language], err = parseCatalog(language, data); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	if dir == "" {
+		return catalogs, nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range files {
+		language := strings.ToLower(strings.TrimSuffix(filepath.Base(name), ".json"))
+		if !languageTagPattern.MatchString(language) {
+			return nil, fmt.Errorf("%s: the file name must be a language tag, such as es or pt-br", name)
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if catalogs[language], err = parseCatalog(language, data); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return catalogs, nil
+}
+
+// locale is the catalogs a request is answered from, by preference: the
+// languages of its Accept-Language, each followed by the ones it narrows,
+// then default_locale and English.
+type locale []*catalog
+
+func (loc locale) language() string {
+	if len(loc) == 0 {
+		return sourceLanguage
+	}
+	return loc[0].language
+}
+
+func (loc locale) translate(message string) (string, bool) {
+	for _, c := range loc {
+		if c.language == sourceLanguage {
+			break
+		}
+		if translated, ok := c.translate(message); ok {
+			return translated, true
+		}
+	}
+	return message, false
+}
+
+func (loc locale) environmentLabel(env Environment) string {
+	for _, c := range loc {
+		if label, ok := c.environments[env]; ok {
+			return label
+		}
+	}
+	return environmentLabels[env]
+}
+
+// localeOf is the locale of r, English for requests that did not come
+// through localizer.wrap.
+func localeOf(r *http.Request) locale {
+	loc, _ := r.Context().Value(localeKey).(locale)
+	return loc
+}
+
+// localizer answers requests in the languages they accept, from the
+// built-in catalogs and those of locales_dir, which a reload reads again.
+type localizer struct {
+	fishes *fishesHandler
+
+	sync.Mutex
+	cfg      *Config
+	catalogs map[string]*catalog
+}
+
+func newLocalizer(h *fishesHandler) *localizer {
+	return &localizer{fishes: h}
+}
+
+// load reads the catalogs of the current config.
+func (l *localizer) load() error {
+	cfg := l.fishes.config()
+	catalogs, err := loadCatalogs(cfg.LocalesDir)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	l.cfg, l.catalogs = cfg, catalogs
+	l.Unlock()
+	if _, ok := catalogs[strings.ToLower(cfg.DefaultLocale)]; !ok {
+		log.Printf("default_locale %s has no catalog, answering in %s", cfg.DefaultLocale, sourceLanguage)
+	}
+	return nil
+}
+
+func (l *localizer) current() (*Config, map[string]*catalog) {
+	cfg := l.fishes.config()
+	l.Lock()
+	defer l.Unlock()
+	if cfg != l.cfg {
+		catalogs, err := loadCatalogs(cfg.LocalesDir)
+		if err != nil {
+			log.Printf("locales_dir: %s, keeping the catalogs loaded before", err)
+		} else {
+			l.catalogs = catalogs
+		}
+		l.cfg = cfg
+	}
+	return cfg, l.catalogs
+}
+
+type languageRange struct {
+	tag string
+	q   float64
+}
+
+// negotiate picks the locale of an Accept-Language header.
+func (l *localizer) negotiate(header string) locale {
+	cfg, catalogs := l.current()
+	var ranges []languageRange
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		lr := languageRange{tag: strings.ToLower(strings.TrimSpace(fields[0])), q: 1}
+		for _, param := range fields[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 && kv[0] == "q" {
+				lr.q, _ = strconv.ParseFloat(kv[1], 64)
+			}
+		}
+		if lr.tag != "" && lr.tag != "*" && lr.q > 0 {
+			ranges = append(ranges, lr)
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	var tags []string
+	for _, lr := range ranges {
+		for tag := lr.tag; tag != ""; {
+			tags = append(tags, tag)
+			i := strings.LastIndex(tag, "-")
+			if i < 0 {
+				break
+			}
+			tag = tag[:i]
+		}
+	}
+	tags = append(tags, strings.ToLower(cfg.DefaultLocale), sourceLanguage)
+
+	var loc locale
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		if c, ok := catalogs[tag]; ok && !seen[tag] {
+			seen[tag] = true
+			loc = append(loc, c)
+		}
+	}
+	return loc
+}
+
+// wrap puts the locale of each request in its context and translates the
+// errors answered in a language other than English, plain text or the
+// message of a /v2 JSON error, line by line.
+func (l *localizer) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loc := l.negotiate(r.Header.Get("Accept-Language"))
+		r = r.WithContext(context.WithValue(r.Context(), localeKey, loc))
+		if loc.language() == sourceLanguage {
+			next.ServeHTTP(w, r)
+			return
+		}
+		lw := &localeWriter{ResponseWriter: w, locale: loc}
+		next.ServeHTTP(lw, r)
+		lw.finish()
+	})
+}
+
+// localeWriter holds back the errors of the handlers until finish has
+// translated them.
+type localeWriter struct {
+	http.ResponseWriter
+	locale locale
+	status int
+	failed bool
+	body   bytes.Buffer
+}
+
+func (lw *localeWriter) WriteHeader(status int) {
+	if informational(status) {
+		lw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if lw.status != 0 {
+		return
+	}
+	lw.status = status
+	if status >= 400 {
+		lw.failed = true
+		return
+	}
+	lw.ResponseWriter.WriteHeader(status)
+}
+
+func (lw *localeWriter) Write(b []byte) (int, error) {
+	if lw.status == 0 {
+		lw.WriteHeader(http.StatusOK)
+	}
+	if lw.failed {
+		return lw.body.Write(b)
+	}
+	return lw.ResponseWriter.Write(b)
+}
+
+func (lw *localeWriter) finish() {
+	if !lw.failed {
+		return
+	}
+	body, translated := lw.body.Bytes(), false
+	if strings.Contains(lw.Header().Get("Content-Type"), "json") {
+		var e apiErrorBody
+		if err := json.Unmarshal(body, &e); err == nil && e.Error.Message != "" {
+			if e.Error.Message, translated = lw.translateLines(e.Error.Message); translated {
+				body, _ = json.Marshal(e)
+			}
+		}
+	} else {
+		var text string
+		if text, translated = lw.translateLines(string(body)); translated {
+			body = []byte(text)
+		}
+	}
+	if translated {
+		lw.Header().Del("Content-Length")
+		lw.Header().Set("Content-Language", lw.locale.language())
+	}
+	lw.Header().Add("Vary", "Accept-Language")
+	lw.ResponseWriter.WriteHeader(lw.status)
+	lw.ResponseWriter.Write(body)
+}
+
+func (lw *localeWriter) translateLines(text string) (string, bool) {
+	lines := strings.Split(text, "\n")
+	translated := false
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+		var ok bool
+		if lines[i], ok = lw.locale.translate(line); ok {
+			translated = true
+		}
+	}
+	return strings.Join(lines, "\n"), translated
+}
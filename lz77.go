@@ -0,0 +1,98 @@
+package fishes
+
+import "encoding/binary"
+
+// lzSequence is one step of an LZ77 parse: litLen bytes copied as they are,
+// then matchLen bytes repeated from offset bytes back.
+type lzSequence struct {
+	litLen, matchLen, offset int
+}
+
+const (
+	lzHashLog  = 15
+	lzMinMatch = 4
+	lzMaxChain = 32
+	lzNiceLen  = 128
+)
+
+// lzMatcher finds repeats with hash chains over four byte prefixes, one
+// block at a time.
+type lzMatcher struct {
+	src  []byte
+	head []int32
+	prev []int32
+}
+
+func lzHash(b []byte) uint32 {
+	return binary.LittleEndian.Uint32(b) * 2654435761 >> (32 - lzHashLog)
+}
+
+func (m *lzMatcher) insert(pos int) {
+	h := lzHash(m.src[pos:])
+	m.prev[pos] = m.head[h]
+	m.head[h] = int32(pos + 1)
+}
+
+// longest looks for the longest earlier match of the bytes at pos within
+// maxOffset of it, and no longer than maxLen.
+func (m *lzMatcher) longest(pos, maxOffset, maxLen int) (length, offset int) {
+	limit := len(m.src) - pos
+	if limit > maxLen {
+		limit = maxLen
+	}
+	cand := int(m.head[lzHash(m.src[pos:])]) - 1
+	for depth := 0; cand >= 0 && depth < lzMaxChain; depth++ {
+		if pos-cand > maxOffset {
+			break
+		}
+		if length < limit && m.src[cand+length] == m.src[pos+length] {
+			n := 0
+			for n < limit && m.src[cand+n] == m.src[pos+n] {
+				n++
+			}
+			if n > length {
+				length, offset = n, pos-cand
+				if n >= lzNiceLen || n == limit {
+					break
+				}
+			}
+		}
+		cand = int(m.prev[cand]) - 1
+	}
+	return length, offset
+}
+
+// lzParse splits src into sequences with a greedy parse that looks one byte
+// ahead for a longer match. The bytes after the last sequence are literals.
+func lzParse(src []byte, maxOffset, maxLen int) []lzSequence {
+	if len(src) < lzMinMatch {
+		return nil
+	}
+	m := &lzMatcher{src: src, head: make([]int32, 1<<lzHashLog), prev: make([]int32, len(src))}
+	var seqs []lzSequence
+	anchor, pos := 0, 0
+	for pos+lzMinMatch <= len(src) {
+		length, offset := m.longest(pos, maxOffset, maxLen)
+		m.insert(pos)
+		if length < lzMinMatch {
+			pos++
+			continue
+		}
+		if pos+1+lzMinMatch <= len(src) {
+			if next, _ := m.longest(pos+1, maxOffset, maxLen); next > length {
+				pos++
+				continue
+			}
+		}
+		seqs = append(seqs, lzSequence{litLen: pos - anchor, matchLen: length, offset: offset})
+		for end := pos + length; pos+1 < end; {
+			pos++
+			if pos+lzMinMatch <= len(src) {
+				m.insert(pos)
+			}
+		}
+		pos++
+		anchor = pos
+	}
+	return seqs
+}
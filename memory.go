@@ -0,0 +1,117 @@
+package fishes
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	memoryPolicyReject = "reject"
+	memoryPolicyEvict  = "evict"
+
+	// memoryEvictTarget is the share of memory_budget_bytes eviction brings
+	// the store down to, so that not every write makes an archive segment.
+	memoryEvictTarget = 0.9
+)
+
+var (
+	memoryEvictions  = newCounterVec("fishes_memory_evicted_total", "Fishes moved to the archive to keep within memory_budget_bytes.")
+	memoryRejections = newCounterVec("fishes_memory_rejected_writes_total", "Writes answered 507 as the store was over memory_budget_bytes.")
+)
+
+// setEncoded caches the encoding of a hot fish, nil dropping it, and counts
+// the bytes it takes towards memory_budget_bytes. Callers must hold the
+// lock.
+func (h *fishesHandler) setEncoded(id string, enc *encodedFish) {
+	if old := h.encoded[id]; old != nil {
+		h.memoryBytes -= int64(len(old.json))
+	}
+	if enc == nil {
+		delete(h.encoded, id)
+		return
+	}
+	h.encoded[id] = enc
+	h.memoryBytes += int64(len(enc.json))
+}
+
+// memoryGuard keeps the fishes a store holds in memory, as they are served,
+// within memory_budget_bytes; each tenant store has a budget of its own. Once the store is over it, writes to
+// /fishes get 507 Insufficient Storage. With the evict policy the fishes
+// read or written least recently move to the archive first, and writes are
+// only refused when none are left to move.
+type memoryGuard struct {
+	fishes *fishesHandler
+}
+
+func newMemoryGuard(h *fishesHandler) *memoryGuard {
+	g := &memoryGuard{fishes: h}
+	metrics.register(g)
+	return g
+}
+
+func (g *memoryGuard) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writing := r.Method == "POST" || r.Method == "PUT" || r.Method == "PATCH"
+		if !writing || r.URL.Path != "/fishes" && !strings.HasPrefix(r.URL.Path, "/fishes/") || g.admit(w) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// admit reports whether the store may take more fishes, answering 507
+// itself when it may not.
+func (g *memoryGuard) admit(w http.ResponseWriter) bool {
+	budget := g.fishes.config().MemoryBudgetBytes
+	if budget == 0 || g.makeRoom(budget) {
+		return true
+	}
+	memoryRejections.inc()
+	w.WriteHeader(http.StatusInsufficientStorage)
+	w.Write([]byte(fmt.Sprintf("the store is over its memory budget of %d bytes, delete some fishes before writing more", budget)))
+	return false
+}
+
+// makeRoom reports whether the store is within budget, evicting cold
+// fishes to get there with the evict policy.
+func (g *memoryGuard) makeRoom(budget int64) bool {
+	h := g.fishes
+	h.Lock()
+	defer h.Unlock()
+	if h.memoryBytes < budget {
+		return true
+	}
+	if h.config().MemoryBudgetPolicy != memoryPolicyEvict || h.archive == nil {
+		return false
+	}
+	n, err := h.archiveColdest(int64(float64(budget)*memoryEvictTarget), h.clock.Now())
+	if err != nil {
+		log.Printf("evicting fishes for memory_budget_bytes failed: %s", err)
+		return false
+	}
+	if n > 0 {
+		memoryEvictions.add(float64(n))
+		log.Printf("archived %d fishes to keep within memory_budget_bytes", n)
+	}
+	return h.memoryBytes < budget
+}
+
+func (g *memoryGuard) gauges() (used, budget float64) {
+	return float64(g.fishes.storageBytes()), float64(g.fishes.config().MemoryBudgetBytes)
+}
+
+func (g *memoryGuard) writeTo(w io.Writer) {
+	used, budget := g.gauges()
+	writeSamples(w, "fishes_memory_bytes", "Bytes the fishes of the main store take in memory, as they are served.", "gauge", nil, map[string]float64{"": used})
+	writeSamples(w, "fishes_memory_budget_bytes", "The memory_budget_bytes setting, 0 for no budget.", "gauge", nil, map[string]float64{"": budget})
+}
+
+func (g *memoryGuard) samples() []metricSample {
+	used, budget := g.gauges()
+	return []metricSample{
+		{name: "fishes_memory_bytes", value: used},
+		{name: "fishes_memory_budget_bytes", value: budget},
+	}
+}
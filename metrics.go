@@ -0,0 +1,254 @@
+package fishes
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type collector interface {
+	writeTo(w io.Writer)
+	samples() []metricSample
+}
+
+// metricSample is one value of a collector, labels in the collector's
+// order.
+type metricSample struct {
+	name   string
+	labels [][2]string
+	value  float64
+}
+
+type metricsRegistry struct {
+	sync.Mutex
+	collectors []collector
+}
+
+var metrics = &metricsRegistry{}
+
+func (m *metricsRegistry) register(c collector) {
+	m.Lock()
+	m.collectors = append(m.collectors, c)
+	m.Unlock()
+}
+
+// unregister drops c, the collector of a server that is shut down while the
+// process goes on.
+func (m *metricsRegistry) unregister(c collector) {
+	m.Lock()
+	defer m.Unlock()
+	for i, registered := range m.collectors {
+		if registered == c {
+			m.collectors = append(m.collectors[:i:i], m.collectors[i+1:]...)
+			return
+		}
+	}
+}
+
+// samples reads every collector.
+func (m *metricsRegistry) samples() []metricSample {
+	m.Lock()
+	collectors := append([]collector(nil), m.collectors...)
+	m.Unlock()
+
+	var samples []metricSample
+	for _, c := range collectors {
+		samples = append(samples, c.samples()...)
+	}
+	return samples
+}
+
+func (m *metricsRegistry) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+
+	m.Lock()
+	collectors := append([]collector(nil), m.collectors...)
+	m.Unlock()
+
+	w.Header().Add("content-type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	for _, c := range collectors {
+		c.writeTo(w)
+	}
+}
+
+type counterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	metrics.register(c)
+	return c
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.Lock()
+	c.values[key] += v
+	c.Unlock()
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func formatLabels(names []string, key string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	values := strings.Split(key, "\xff")
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func writeSamples(w io.Writer, name, help, kind string, labels []string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %g\n", name, formatLabels(labels, key), values[key])
+	}
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	writeSamples(w, c.name, c.help, "counter", c.labels, c.values)
+}
+
+func (c *counterVec) samples() []metricSample {
+	c.Lock()
+	defer c.Unlock()
+	samples := make([]metricSample, 0, len(c.values))
+	for key, v := range c.values {
+		samples = append(samples, metricSample{name: c.name, labels: splitLabels(c.labels, key), value: v})
+	}
+	return samples
+}
+
+// splitLabels pairs the label names with the values joined in key.
+func splitLabels(names []string, key string) [][2]string {
+	values := strings.Split(key, "\xff")
+	labels := make([][2]string, len(names))
+	for i, name := range names {
+		labels[i][0] = name
+		if i < len(values) {
+			labels[i][1] = values[i]
+		}
+	}
+	return labels
+}
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histograms.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []float64
+	sum    float64
+	count  float64
+}
+
+type histogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogram{}}
+	metrics.register(h)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.Lock()
+	defer h.Unlock()
+	values := h.values[key]
+	if values == nil {
+		values = &histogram{counts: make([]float64, len(h.buckets))}
+		h.values[key] = values
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			values.counts[i]++
+		}
+	}
+	values.sum += v
+	values.count++
+}
+
+func (h *histogramVec) keys() []string {
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// each calls fn with the _bucket, _sum and _count series of every
+// histogram, buckets cumulative and in order.
+func (h *histogramVec) each(fn func(name string, labels [][2]string, v float64)) {
+	for _, key := range h.keys() {
+		values := h.values[key]
+		labels := splitLabels(h.labels, key)
+		for i, le := range h.buckets {
+			fn(h.name+"_bucket", append(labels, [2]string{"le", strconv.FormatFloat(le, 'g', -1, 64)}), values.counts[i])
+		}
+		fn(h.name+"_bucket", append(labels, [2]string{"le", "+Inf"}), values.count)
+		fn(h.name+"_sum", labels, values.sum)
+		fn(h.name+"_count", labels, values.count)
+	}
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.each(func(name string, labels [][2]string, v float64) {
+		names := make([]string, len(labels))
+		values := make([]string, len(labels))
+		for i, l := range labels {
+			names[i], values[i] = l[0], l[1]
+		}
+		fmt.Fprintf(w, "%s%s %g\n", name, formatLabels(names, strings.Join(values, "\xff")), v)
+	})
+}
+
+func (h *histogramVec) samples() []metricSample {
+	h.Lock()
+	defer h.Unlock()
+	var samples []metricSample
+	h.each(func(name string, labels [][2]string, v float64) {
+		samples = append(samples, metricSample{name: name, labels: labels, value: v})
+	})
+	return samples
+}
@@ -0,0 +1,49 @@
+package fishes
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// migration upgrades one stored fish record in place. Records are handled
+// as raw JSON so a migration can read fields the Fish type no longer has.
+type migration struct {
+	version int
+	name    string
+	up      func(record map[string]json.RawMessage) error
+}
+
+// migrations are applied in order to data files whose data_version is lower
+// than the migration's version. Append new migrations, never edit old ones.
+var migrations = []migration{
+	{version: 1, name: "rename deprecated fields", up: func(record map[string]json.RawMessage) error {
+		normalizeFishFields(record)
+		return nil
+	}},
+}
+
+func currentDataVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// migrateRecords runs every migration newer than from and returns the names
+// of the ones applied.
+func migrateRecords(from int, records []map[string]json.RawMessage) ([]string, error) {
+	if from > currentDataVersion() {
+		return nil, fmt.Errorf("data version %d is newer than this server supports (%d)", from, currentDataVersion())
+	}
+
+	var applied []string
+	for _, m := range migrations {
+		if m.version <= from {
+			continue
+		}
+		for i, record := range records {
+			if err := m.up(record); err != nil {
+				return nil, fmt.Errorf("migration %d (%s): record %d: %s", m.version, m.name, i, err)
+			}
+		}
+		applied = append(applied, fmt.Sprintf("%d (%s)", m.version, m.name))
+	}
+	return applied, nil
+}
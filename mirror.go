@@ -0,0 +1,447 @@
+package fishes
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const mirrorStateFileName = "mirror.json"
+
+// maxMirrorConflicts is how many conflicts /admin/mirror keeps.
+const maxMirrorConflicts = 100
+
+const (
+	mirrorConflictSource  = "source"
+	mirrorConflictLocal   = "local"
+	mirrorConflictVersion = "version"
+)
+
+// mirrorBatch is what a source pushes to /mirror: entries of its operation
+// log, which Epoch tells apart from the logs it had before.
+type mirrorBatch struct {
+	Source string    `json:"source"`
+	Epoch  time.Time `json:"epoch"`
+	Ops    []opEntry `json:"ops"`
+}
+
+// mirrorAck is the last sequence the standby applied from the source, which
+// the source carries on from.
+type mirrorAck struct {
+	Seq       uint64 `json:"seq"`
+	Conflicts int    `json:"conflicts"`
+}
+
+// mirror pushes the operation log to the mirror_to standby, batched and
+// gzipped, on every mirror_interval. Failed pushes are retried with a
+// growing delay, and the standby's answer says where to resume, so a push
+// that failed halfway is not applied twice.
+type mirror struct {
+	fishes *fishesHandler
+	target string
+	source string
+	client *http.Client
+
+	sync.Mutex
+	epoch     time.Time
+	cursor    uint64
+	known     bool
+	lastPush  time.Time
+	lastError string
+	failures  int
+	retryAt   time.Time
+}
+
+func newMirror(h *fishesHandler) *mirror {
+	cfg := h.config()
+	source := strings.TrimSuffix(cfg.AdvertiseURL, "/")
+	if source == "" {
+		source, _ = os.Hostname()
+	}
+	return &mirror{
+		fishes: h,
+		target: strings.TrimSuffix(cfg.MirrorTo, "/"),
+		source: source,
+		client: &http.Client{Timeout: time.Minute},
+	}
+}
+
+// pushNow sends batches until the standby caught up, unless a failed push
+// is still waiting for its retry.
+func (m *mirror) pushNow() error {
+	m.Lock()
+	wait := time.Now().Before(m.retryAt)
+	m.Unlock()
+	if wait {
+		return nil
+	}
+	for {
+		more, err := m.push()
+		m.Lock()
+		if err != nil {
+			m.failures++
+			backoff := m.fishes.config().MirrorInterval << uint(m.failures)
+			if m.failures > 8 || backoff > 5*time.Minute {
+				backoff = 5 * time.Minute
+			}
+			m.retryAt = time.Now().Add(backoff)
+			m.lastError = err.Error()
+			m.Unlock()
+			return err
+		}
+		m.failures, m.lastError = 0, ""
+		m.lastPush = time.Now()
+		m.Unlock()
+		if !more {
+			return nil
+		}
+	}
+}
+
+// push sends the next batch. While the standby's position in the current
+// log is not known it sends none, and the answer tells it.
+func (m *mirror) push() (more bool, err error) {
+	h := m.fishes
+	h.Lock()
+	l := h.oplog
+	epoch, head := l.epoch, l.seq
+	h.Unlock()
+
+	m.Lock()
+	known, cursor := m.known && m.epoch.Equal(epoch), m.cursor
+	m.Unlock()
+	batch := mirrorBatch{Source: m.source, Epoch: epoch, Ops: []opEntry{}}
+	if known && cursor < head {
+		h.Lock()
+		ops, err := l.read(context.Background())
+		h.Unlock()
+		if err != nil {
+			return false, err
+		}
+		for _, op := range ops {
+			if op.Seq > cursor && len(batch.Ops) < maxReplicationBatch {
+				batch.Ops = append(batch.Ops, op)
+			}
+		}
+	}
+
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return false, err
+	}
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	gz.Write(data)
+	if err := gz.Close(); err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest("POST", m.target+"/mirror", bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	if err := signPeerRequest(req, h.config().ReplicationKey, body.Bytes()); err != nil {
+		return false, err
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	answer, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s answered %s: %s", m.target, resp.Status, strings.TrimSpace(string(answer)))
+	}
+	var ack mirrorAck
+	if err := json.Unmarshal(answer, &ack); err != nil {
+		return false, err
+	}
+	if ack.Conflicts > 0 {
+		log.Printf("mirror: %s reported %d conflicts", m.target, ack.Conflicts)
+	}
+
+	m.Lock()
+	m.epoch, m.cursor, m.known = epoch, ack.Seq, true
+	m.Unlock()
+	return ack.Seq < head && (ack.Seq > cursor || !known), nil
+}
+
+type mirrorSource struct {
+	Epoch     time.Time `json:"epoch"`
+	Seq       uint64    `json:"seq"`
+	Conflicts int       `json:"conflicts"`
+	LastPush  time.Time `json:"last_push"`
+}
+
+type mirrorConflict struct {
+	Source     string    `json:"source"`
+	Seq        uint64    `json:"seq"`
+	ID         string    `json:"id"`
+	At         time.Time `json:"at"`
+	Resolution string    `json:"resolution"`
+}
+
+type mirrorState struct {
+	Sources map[string]*mirrorSource `json:"sources"`
+}
+
+// mirrorReceiver applies what sources push to /mirror. A change to a fish
+// that is here at the same or a higher version conflicts, and
+// mirror_conflict decides which copy stays.
+type mirrorReceiver struct {
+	fishes *fishesHandler
+	path   string
+
+	sync.Mutex
+	mirrorState
+	conflicts []mirrorConflict
+}
+
+func newMirrorReceiver(h *fishesHandler) (*mirrorReceiver, error) {
+	m := &mirrorReceiver{fishes: h, mirrorState: mirrorState{Sources: map[string]*mirrorSource{}}}
+	if dir := h.config().DataDir; dir != "" {
+		m.path = filepath.Join(dir, mirrorStateFileName)
+		data, err := ioutil.ReadFile(m.path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &m.mirrorState); err != nil {
+				return nil, fmt.Errorf("%s: %s", m.path, err)
+			}
+		}
+	}
+	return m, nil
+}
+
+// save persists where every source is. Callers must hold the lock.
+func (m *mirrorReceiver) save() error {
+	if m.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(m.mirrorState)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.path, data)
+}
+
+func (m *mirrorReceiver) receive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	var body io.Reader = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		body = io.LimitReader(gz, maxImportBytes)
+	}
+	var batch mirrorBatch
+	if err := json.NewDecoder(body).Decode(&batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if batch.Source == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("the batch has no source"))
+		return
+	}
+
+	policy := m.fishes.config().MirrorConflict
+	m.Lock()
+	defer m.Unlock()
+	src := m.Sources[batch.Source]
+	if src == nil || !src.Epoch.Equal(batch.Epoch) {
+		if src != nil {
+			log.Printf("mirror: %s started a new operation log, taking it from the beginning", batch.Source)
+		}
+		src = &mirrorSource{Epoch: batch.Epoch}
+		m.Sources[batch.Source] = src
+	}
+	src.LastPush = time.Now().UTC()
+
+	h := m.fishes
+	conflicts := 0
+	h.Lock()
+	var err error
+	for _, op := range batch.Ops {
+		if op.Seq <= src.Seq {
+			continue
+		}
+		if op.Seq != src.Seq+1 {
+			break
+		}
+		err = h.applyMirrored(op, policy, func(id, resolution string) {
+			conflicts++
+			log.Printf("mirror: conflict on %s at %s seq %d, %s", id, batch.Source, op.Seq, resolution)
+			m.conflicts = append(m.conflicts, mirrorConflict{Source: batch.Source, Seq: op.Seq, ID: id, At: time.Now().UTC(), Resolution: resolution})
+			if len(m.conflicts) > maxMirrorConflicts {
+				m.conflicts = m.conflicts[len(m.conflicts)-maxMirrorConflicts:]
+			}
+		})
+		if err != nil {
+			break
+		}
+		src.Seq = op.Seq
+	}
+	h.Unlock()
+	src.Conflicts += conflicts
+	if saveErr := m.save(); err == nil {
+		err = saveErr
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeJSON(w, http.StatusOK, mirrorAck{Seq: src.Seq, Conflicts: conflicts})
+}
+
+// applyMirrored applies an entry of a source's log. A reset is taken fish by
+// fish, so fishes only the standby has stay. Callers must hold the lock.
+func (h *fishesHandler) applyMirrored(op opEntry, policy string, conflict func(id, resolution string)) error {
+	switch op.Op {
+	case opPut, opDelete:
+		return h.mirrorFish(*op.Fish, op.Op == opDelete, policy, conflict)
+	case opPurge:
+		if _, trashed := h.trash[op.ID]; !trashed {
+			return nil
+		}
+		if err := h.dropFromTrash(op.ID); err != nil {
+			return err
+		}
+		h.bumpVersion()
+		h.dirty = true
+		return nil
+	case opReset:
+		for _, fish := range op.Fishes {
+			if err := h.mirrorFish(fish, false, policy, conflict); err != nil {
+				return err
+			}
+		}
+		for _, fish := range op.Trash {
+			if err := h.mirrorFish(fish, true, policy, conflict); err != nil {
+				return err
+			}
+		}
+		for slug, id := range op.Slugs {
+			if _, taken := h.slugs[slug]; !taken {
+				h.slugs[slug] = id
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown operation %q at seq %d", op.Op, op.Seq)
+}
+
+func (h *fishesHandler) mirrorFish(fish Fish, deleted bool, policy string, conflict func(id, resolution string)) error {
+	if err := h.rehydrate(fish.ID); err != nil {
+		return err
+	}
+	local, exists := h.db[fish.ID]
+	if !exists {
+		local, exists = h.trash[fish.ID]
+	}
+	if exists && reflect.DeepEqual(local, fish) {
+		return nil
+	}
+	if exists && local.Version >= fish.Version {
+		switch {
+		case policy == mirrorConflictLocal:
+			conflict(fish.ID, "kept the local copy")
+			return nil
+		case policy == mirrorConflictVersion && local.Version > fish.Version:
+			conflict(fish.ID, fmt.Sprintf("kept the local copy at version %d", local.Version))
+			return nil
+		}
+		conflict(fish.ID, "took the mirrored copy")
+	}
+	if deleted {
+		return h.moveToTrash(fish)
+	}
+	delete(h.trash, fish.ID)
+	if fish.Slug != "" {
+		h.slugs[fish.Slug] = fish.ID
+	}
+	_, err := h.put(fish)
+	return err
+}
+
+type mirrorSendingStatus struct {
+	Target    string     `json:"target"`
+	Seq       uint64     `json:"seq"`
+	Acked     uint64     `json:"acked"`
+	LagOps    uint64     `json:"lag_ops"`
+	LastPush  *time.Time `json:"last_push,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Failures  int        `json:"failures,omitempty"`
+	NextRetry *time.Time `json:"next_retry,omitempty"`
+}
+
+type mirrorStatusReport struct {
+	Sending   *mirrorSendingStatus     `json:"sending,omitempty"`
+	Sources   map[string]*mirrorSource `json:"sources"`
+	Conflicts []mirrorConflict         `json:"conflicts"`
+}
+
+// mirrorStatus shows how far the standby is behind and, on a standby, where
+// every source is and the latest conflicts.
+func mirrorStatus(sender *mirror, receiver *mirrorReceiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("method not allowed"))
+			return
+		}
+		var report mirrorStatusReport
+		if sender != nil {
+			h := sender.fishes
+			h.Lock()
+			head := h.oplog.seq
+			h.Unlock()
+			sender.Lock()
+			sending := &mirrorSendingStatus{Target: sender.target, Seq: head, Acked: sender.cursor, Error: sender.lastError, Failures: sender.failures}
+			if head > sender.cursor {
+				sending.LagOps = head - sender.cursor
+			}
+			if !sender.lastPush.IsZero() {
+				last := sender.lastPush.UTC()
+				sending.LastPush = &last
+			}
+			if sender.failures > 0 {
+				retry := sender.retryAt.UTC()
+				sending.NextRetry = &retry
+			}
+			sender.Unlock()
+			report.Sending = sending
+		}
+		receiver.Lock()
+		report.Sources = receiver.Sources
+		report.Conflicts = append([]mirrorConflict{}, receiver.conflicts...)
+		writeJSON(w, http.StatusOK, report)
+		receiver.Unlock()
+	}
+}
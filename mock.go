@@ -0,0 +1,104 @@
+package fishes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+// mockScenario is what -mock serves: the fishes the store starts with, and
+// fault rules, such as /fishes/{id} with an error_rate of 1 to make one fish
+// always fail, or a latency on /fishes to make the listing slow.
+type mockScenario struct {
+	Fishes []json.RawMessage `json:"fishes"`
+	Faults []faultRule       `json:"faults"`
+}
+
+// mockServer keeps the store and the fault rules of a server started with
+// -mock to those of its scenario file. Nothing is written to disk: the
+// changes clients make last until the scenario is loaded again.
+type mockServer struct {
+	path   string
+	h      *fishesHandler
+	faults *faultInjector
+}
+
+func (m *mockServer) load() (int, error) {
+	data, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		return 0, err
+	}
+	var scenario mockScenario
+	if err := json.Unmarshal(data, &scenario); err != nil {
+		return 0, fmt.Errorf("%s: %s", m.path, err)
+	}
+	fishes, err := decodeFishRecords(m.path, scenario.Fishes)
+	if err != nil {
+		return 0, err
+	}
+	for i := range scenario.Faults {
+		if err := scenario.Faults[i].parse(); err != nil {
+			return 0, fmt.Errorf("%s: fault %d: %s", m.path, i, err)
+		}
+	}
+
+	m.h.Lock()
+	defer m.h.Unlock()
+	if err := m.h.restore(&snapshot{}); err != nil {
+		return 0, err
+	}
+	for _, fish := range fishes {
+		if fish.ID == "" {
+			fish.ID = m.h.ids.NewID()
+		}
+		if fish.Version == 0 {
+			fish.Version = 1
+		}
+		fish.Slug = ""
+		fish.DeletedAt = nil
+		m.h.assignSlug(&fish)
+		m.h.stampUpdated(&fish)
+		if _, err := m.h.put(fish); err != nil {
+			return 0, err
+		}
+	}
+	m.faults.Lock()
+	m.faults.rules = scenario.Faults
+	m.faults.Unlock()
+	return len(fishes), nil
+}
+
+type mockStatus struct {
+	Scenario string      `json:"scenario"`
+	Fishes   int         `json:"fishes"`
+	Faults   []faultRule `json:"faults"`
+}
+
+// serve shows the scenario on GET and loads it again on POST, putting back
+// its fishes and rules.
+func (m *mockServer) serve(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		n, err := m.load()
+		if err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		log.Printf("mock: reloaded %d fishes from %s", n, m.path)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	m.h.Lock()
+	status := mockStatus{Scenario: m.path, Fishes: len(m.h.db)}
+	m.h.Unlock()
+	m.faults.Lock()
+	status.Faults = append([]faultRule{}, m.faults.rules...)
+	m.faults.Unlock()
+	writeJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,475 @@
+package fishes
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const mqttStateFileName = "mqtt.json"
+
+const (
+	mqttKeepAlive = 60 * time.Second
+	mqttTimeout   = 10 * time.Second
+)
+
+// MQTT 3.1.1 packet types, shifted into the first byte of the fixed header.
+const (
+	mqttConnect    = 1 << 4
+	mqttConnack    = 2 << 4
+	mqttPublish    = 3 << 4
+	mqttPuback     = 4 << 4
+	mqttPingreq    = 12 << 4
+	mqttPingresp   = 13 << 4
+	mqttDisconnect = 14 << 4
+)
+
+// mqttConn is a connection to a broker, which publishes with QoS 1 one
+// message at a time: publish returns once the broker acknowledged it.
+type mqttConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	nextID uint16
+}
+
+func dialMQTT(broker *url.URL, clientID string) (*mqttConn, error) {
+	host := broker.Host
+	if broker.Port() == "" {
+		if broker.Scheme == "mqtts" {
+			host = net.JoinHostPort(broker.Hostname(), "8883")
+		} else {
+			host = net.JoinHostPort(broker.Hostname(), "1883")
+		}
+	}
+	dialer := &net.Dialer{Timeout: mqttTimeout}
+	var conn net.Conn
+	var err error
+	if broker.Scheme == "mqtts" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: broker.Hostname(), MinVersion: tls.VersionTLS12})
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &mqttConn{conn: conn, r: bufio.NewReader(conn)}
+
+	// A clean session: what was not acknowledged is published again from
+	// the operation log after a reconnect.
+	var body []byte
+	body = mqttString(body, "MQTT")
+	flags := byte(0x02)
+	if broker.User != nil {
+		flags |= 0x80
+		if _, ok := broker.User.Password(); ok {
+			flags |= 0x40
+		}
+	}
+	body = append(body, 4, flags, byte(mqttKeepAlive/time.Second>>8), byte(mqttKeepAlive/time.Second))
+	body = mqttString(body, clientID)
+	if broker.User != nil {
+		body = mqttString(body, broker.User.Username())
+		if password, ok := broker.User.Password(); ok {
+			body = mqttString(body, password)
+		}
+	}
+	if err := c.write(mqttConnect, body); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	kind, answer, err := c.read()
+	if err == nil && (kind != mqttConnack || len(answer) != 2) {
+		err = fmt.Errorf("expected CONNACK, got packet type %d", kind>>4)
+	}
+	if err == nil && answer[1] != 0 {
+		reasons := map[byte]string{1: "unacceptable protocol version", 2: "client id rejected", 3: "server unavailable", 4: "bad user name or password", 5: "not authorized"}
+		err = fmt.Errorf("broker refused the connection: %s", reasons[answer[1]])
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func mqttString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func (c *mqttConn) write(header byte, body []byte) error {
+	packet := []byte{header}
+	// The remaining length, 7 bits a byte.
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		if n /= 128; n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(mqttTimeout))
+	_, err := c.conn.Write(append(packet, body...))
+	return err
+}
+
+func (c *mqttConn) read() (byte, []byte, error) {
+	c.conn.SetReadDeadline(time.Now().Add(mqttTimeout))
+	header, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, uint(0)
+	for i := 0; ; i++ {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; i == 3 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return header & 0xf0, body, nil
+}
+
+// publish sends payload to topic with QoS 1 and waits for the PUBACK.
+func (c *mqttConn) publish(topic string, payload []byte) error {
+	if c.nextID++; c.nextID == 0 {
+		c.nextID = 1
+	}
+	id := c.nextID
+	body := mqttString(nil, topic)
+	body = append(body, byte(id>>8), byte(id))
+	if err := c.write(mqttPublish|0x02, append(body, payload...)); err != nil {
+		return err
+	}
+	for {
+		kind, answer, err := c.read()
+		if err != nil {
+			return err
+		}
+		if kind == mqttPuback && len(answer) == 2 && binary.BigEndian.Uint16(answer) == id {
+			return nil
+		}
+	}
+}
+
+func (c *mqttConn) ping() error {
+	if err := c.write(mqttPingreq, nil); err != nil {
+		return err
+	}
+	kind, _, err := c.read()
+	if err == nil && kind != mqttPingresp {
+		err = fmt.Errorf("expected PINGRESP, got packet type %d", kind>>4)
+	}
+	return err
+}
+
+func (c *mqttConn) close() {
+	c.write(mqttDisconnect, nil)
+	c.conn.Close()
+}
+
+// mqttEvent is the payload published for an entry of the operation log.
+// Count is the number of fishes a reset left.
+type mqttEvent struct {
+	Seq   uint64    `json:"seq"`
+	At    time.Time `json:"at"`
+	Op    string    `json:"op"`
+	ID    string    `json:"id,omitempty"`
+	Fish  *Fish     `json:"fish,omitempty"`
+	Count *int      `json:"count,omitempty"`
+}
+
+// mqttTopic fills the {op}, {id} and {environment} of the mqtt_topic
+// template. A value an event lacks, and the characters MQTT reserves,
+// become _.
+func mqttTopic(template string, op opEntry) string {
+	clean := func(s string) string {
+		if s == "" {
+			return "_"
+		}
+		return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(s)
+	}
+	environment := ""
+	if op.Fish != nil {
+		environment = string(op.Fish.Environment)
+	}
+	return strings.NewReplacer("{op}", clean(op.Op), "{id}", clean(op.ID), "{environment}", clean(environment)).Replace(template)
+}
+
+type mqttState struct {
+	Epoch time.Time `json:"epoch"`
+	Seq   uint64    `json:"seq"`
+}
+
+// mqttPublisher follows the operation log and publishes every write to
+// mqtt_broker as it happens. Where it got to is kept in data_dir, so events
+// that were not acknowledged before a restart or a lost connection are
+// published again: delivery is at least once.
+type mqttPublisher struct {
+	fishes   *fishesHandler
+	broker   *url.URL
+	clientID string
+	path     string
+	stop     chan struct{}
+	done     chan struct{}
+
+	sync.Mutex
+	state       mqttState
+	known       bool
+	connected   bool
+	lastPublish time.Time
+	lastError   string
+}
+
+func newMQTTPublisher(h *fishesHandler) (*mqttPublisher, error) {
+	cfg := h.config()
+	broker, err := url.Parse(cfg.MQTTBroker)
+	if err != nil {
+		return nil, err
+	}
+	clientID := cfg.MQTTClientID
+	if clientID == "" {
+		hostname, _ := os.Hostname()
+		clientID = "fishes-" + hostname
+	}
+	p := &mqttPublisher{
+		fishes:   h,
+		broker:   broker,
+		clientID: clientID,
+		path:     filepath.Join(cfg.DataDir, mqttStateFileName),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &p.state); err != nil {
+			return nil, fmt.Errorf("%s: %s", p.path, err)
+		}
+		p.known = true
+	}
+	return p, nil
+}
+
+func (p *mqttPublisher) run() {
+	defer close(p.done)
+	var conn *mqttConn
+	defer func() {
+		if conn != nil {
+			conn.close()
+		}
+	}()
+	backoff := time.Second
+	for {
+		h := p.fishes
+		h.Lock()
+		l := h.oplog
+		changed := l.changed
+		h.Unlock()
+
+		if conn == nil {
+			c, err := dialMQTT(p.broker, p.clientID)
+			if err != nil {
+				p.failed(err)
+				select {
+				case <-time.After(backoff):
+				case <-p.stop:
+					return
+				}
+				if backoff *= 2; backoff > time.Minute {
+					backoff = time.Minute
+				}
+				continue
+			}
+			conn, backoff = c, time.Second
+			p.Lock()
+			p.connected = true
+			p.Unlock()
+			log.Printf("mqtt: connected to %s", p.broker.Redacted())
+		}
+
+		err := p.publishPending(conn)
+		if err == nil {
+			select {
+			case <-changed:
+				continue
+			case <-time.After(mqttKeepAlive / 2):
+				err = conn.ping()
+			case <-p.stop:
+				return
+			}
+		}
+		if err != nil {
+			p.failed(err)
+			conn.conn.Close()
+			conn = nil
+		}
+	}
+}
+
+func (p *mqttPublisher) failed(err error) {
+	p.Lock()
+	if p.connected || p.lastError != err.Error() {
+		log.Printf("mqtt: %s: %s", p.broker.Redacted(), err)
+	}
+	p.connected = false
+	p.lastError = err.Error()
+	p.Unlock()
+}
+
+// publishPending publishes the entries after the last one acknowledged. A
+// publisher starting without a state, or on a log that was started over,
+// begins at its end.
+func (p *mqttPublisher) publishPending(conn *mqttConn) error {
+	h := p.fishes
+	h.Lock()
+	l := h.oplog
+	epoch, head := l.epoch, l.seq
+	h.Unlock()
+
+	p.Lock()
+	if !p.known || !p.state.Epoch.Equal(epoch) || p.state.Seq > head {
+		if p.known {
+			log.Printf("mqtt: the operation log was started over, publishing from seq %d", head)
+		}
+		p.state, p.known = mqttState{Epoch: epoch, Seq: head}, true
+		p.save()
+	}
+	cursor := p.state.Seq
+	p.Unlock()
+	if cursor == head {
+		return nil
+	}
+
+	h.Lock()
+	ops, err := l.read(context.Background())
+	h.Unlock()
+	if err != nil {
+		return err
+	}
+	template := h.config().MQTTTopic
+	defer func() {
+		p.Lock()
+		p.save()
+		p.Unlock()
+	}()
+	for _, op := range ops {
+		if op.Seq <= cursor {
+			continue
+		}
+		event := mqttEvent{Seq: op.Seq, At: op.At, Op: op.Op, ID: op.ID}
+		if op.Fish != nil {
+			fish := op.Fish.redacted()
+			event.Fish = &fish
+		}
+		if op.Op == opReset {
+			count := len(op.Fishes)
+			event.Count = &count
+		}
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if err := conn.publish(mqttTopic(template, op), payload); err != nil {
+			return err
+		}
+		p.Lock()
+		p.state.Seq = op.Seq
+		p.lastPublish = h.clock.Now()
+		p.lastError = ""
+		p.Unlock()
+	}
+	return nil
+}
+
+// save persists where the publisher is. Callers must hold the lock.
+func (p *mqttPublisher) save() {
+	data, err := json.Marshal(p.state)
+	if err == nil {
+		err = writeFileAtomic(p.path, data)
+	}
+	if err != nil {
+		log.Printf("mqtt: saving %s: %s", p.path, err)
+	}
+}
+
+// close disconnects from the broker once the event being published was
+// acknowledged.
+func (p *mqttPublisher) close() error {
+	close(p.stop)
+	<-p.done
+	return nil
+}
+
+type mqttStatusReport struct {
+	Broker      string     `json:"broker"`
+	ClientID    string     `json:"client_id"`
+	Connected   bool       `json:"connected"`
+	Seq         uint64     `json:"seq"`
+	Published   uint64     `json:"published"`
+	LagOps      uint64     `json:"lag_ops"`
+	LastPublish *time.Time `json:"last_publish,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// mqttStatus reports how far the publisher got, 404 when mqtt_broker is not
+// set.
+func mqttStatus(p *mqttPublisher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("method not allowed"))
+			return
+		}
+		if p == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("mqtt_broker is not set"))
+			return
+		}
+		h := p.fishes
+		h.Lock()
+		head := h.oplog.seq
+		h.Unlock()
+		p.Lock()
+		report := mqttStatusReport{Broker: p.broker.Redacted(), ClientID: p.clientID, Connected: p.connected, Seq: head, Published: p.state.Seq, Error: p.lastError}
+		if head > p.state.Seq {
+			report.LagOps = head - p.state.Seq
+		}
+		if !p.lastPublish.IsZero() {
+			last := p.lastPublish.UTC()
+			report.LastPublish = &last
+		}
+		p.Unlock()
+		writeJSON(w, http.StatusOK, report)
+	}
+}
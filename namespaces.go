@@ -0,0 +1,334 @@
+package fishes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// namespacesFileName holds the namespaces of a store, next to its own
+// snapshot; the fishes of each are under namespaces/{name}.
+const namespacesFileName = "namespaces.json"
+
+// fishStore is a store of fishes apart from the main one, with the fish
+// routes served on a mux of its own and, in data_dir, files of its own.
+type fishStore struct {
+	h         *fishesHandler
+	mux       *http.ServeMux
+	persister *persister
+	dir       string
+}
+
+// openFishStore gives a store sharing the ids, clock, keys and redaction
+// policies of main, loading what dir holds; a dir of "" keeps it in memory.
+func openFishStore(main *fishesHandler, dir string) (*fishStore, error) {
+	h := newFishesHander(main.config(), main.ids, newResponseCache())
+	h.clock, h.random, h.keys, h.redactions = main.clock, main.random, main.keys, main.redactions
+	store := &fishStore{h: h, mux: http.NewServeMux(), dir: dir}
+	store.mux.HandleFunc("/environments", getEnvironments)
+	store.mux.HandleFunc("/fishes", h.fishes)
+	store.mux.HandleFunc("/fishes/", h.fish)
+	store.mux.HandleFunc("/fishes/import", h.importFishes)
+	store.mux.HandleFunc("/fishes/trash", validateQuery(listTrashParams, h.getTrash))
+
+	if dir != "" {
+		var err error
+		if store.persister, err = newPersister(dir, h); err != nil {
+			return nil, err
+		}
+		if _, err := openOpLog(dir, h); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// name is the directory of store, or the main store for the one without.
+func (store *fishStore) name() string {
+	if store.dir == "" {
+		return "the main store"
+	}
+	return store.dir
+}
+
+// servesPath is whether path is one of the fish routes of a store.
+func servesPath(path string) bool {
+	return path == "/environments" || path == "/fishes" || strings.HasPrefix(path, "/fishes/")
+}
+
+// remove closes the store and deletes its files.
+func (store *fishStore) remove() error {
+	store.h.Lock()
+	if store.h.oplog != nil {
+		store.h.oplog.file.Close()
+	}
+	store.h.Unlock()
+	if store.dir == "" {
+		return nil
+	}
+	return os.RemoveAll(store.dir)
+}
+
+type namespace struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type namespaceStore struct {
+	namespace
+	*fishStore
+}
+
+// namespaceSet is the namespaces of a store, the main one or a tenant's,
+// such as a staging and a production dataset kept side by side. They are
+// served under /namespaces/{name} and limited by the quota of their owner,
+// each on its own.
+type namespaceSet struct {
+	owner *fishesHandler
+	main  *fishesHandler
+	flags *featureFlags
+	dir   string
+
+	sync.Mutex
+	namespaces map[string]*namespaceStore
+}
+
+func newNamespaceSet(owner, main *fishesHandler, flags *featureFlags, dir string) *namespaceSet {
+	return &namespaceSet{owner: owner, main: main, flags: flags, dir: dir, namespaces: map[string]*namespaceStore{}}
+}
+
+// load opens the namespaces saved in the directory of the set.
+func (s *namespaceSet) load() error {
+	if s.dir == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, namespacesFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []namespace
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("%s: %s", namespacesFileName, err)
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, ns := range saved {
+		store, err := s.open(ns)
+		if err != nil {
+			return fmt.Errorf("namespace %s: %s", ns.Name, err)
+		}
+		s.namespaces[ns.Name] = store
+	}
+	return nil
+}
+
+func (s *namespaceSet) open(ns namespace) (*namespaceStore, error) {
+	dir := ""
+	if s.dir != "" {
+		dir = filepath.Join(s.dir, "namespaces", ns.Name)
+	}
+	store, err := openFishStore(s.main, dir)
+	if err != nil {
+		return nil, err
+	}
+	return &namespaceStore{namespace: ns, fishStore: store}, nil
+}
+
+// save writes the namespace list. Callers must hold the lock.
+func (s *namespaceSet) save() error {
+	if s.dir == "" {
+		return nil
+	}
+	namespaces := make([]namespace, 0, len(s.namespaces))
+	for _, store := range s.namespaces {
+		namespaces = append(namespaces, store.namespace)
+	}
+	sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].Name < namespaces[j].Name })
+	data, err := json.MarshalIndent(namespaces, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir, namespacesFileName), data)
+}
+
+func (s *namespaceSet) stores() []*fishStore {
+	s.Lock()
+	defer s.Unlock()
+	stores := make([]*fishStore, 0, len(s.namespaces))
+	for _, store := range s.namespaces {
+		stores = append(stores, store.fishStore)
+	}
+	return stores
+}
+
+// remove deletes every namespace with its files, as its owner is deleted.
+func (s *namespaceSet) remove() {
+	for _, store := range s.stores() {
+		store.remove()
+	}
+}
+
+type namespaceView struct {
+	namespace
+	Fishes int `json:"fishes"`
+}
+
+func (store *namespaceStore) view() namespaceView {
+	store.h.Lock()
+	defer store.h.Unlock()
+	return namespaceView{namespace: store.namespace, Fishes: len(store.h.db)}
+}
+
+type namespaceChange struct {
+	Name string `json:"name"`
+}
+
+// serve lists and creates namespaces on /namespaces, shows or deletes one on
+// /namespaces/{name}, exports one on /namespaces/{name}/export, and serves
+// its fish routes under /namespaces/{name}.
+func (s *namespaceSet) serve(w http.ResponseWriter, r *http.Request) {
+	cfg := s.main.config()
+	if cfg.ReplicaOf != "" || len(cfg.Peers) > 0 || len(cfg.SyncPeers) > 0 || cfg.ClusterMode != "" {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("namespaces are only served by a single primary"))
+		return
+	}
+	if !s.flags.enabled(r, "namespaces") {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("namespaces are not enabled"))
+		return
+	}
+	rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/namespaces"), "/")
+	if rest == "" {
+		switch r.Method {
+		case "GET":
+			s.Lock()
+			views := make([]namespaceView, 0, len(s.namespaces))
+			for _, store := range s.namespaces {
+				views = append(views, store.view())
+			}
+			s.Unlock()
+			sort.Slice(views, func(i, j int) bool { return views[i].Name < views[j].Name })
+			writeJSON(w, http.StatusOK, views)
+		case "POST":
+			s.create(w, r)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("method not allowed"))
+		}
+		return
+	}
+
+	name, path := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		name, path = rest[:i], rest[i:]
+	}
+	s.Lock()
+	store := s.namespaces[name]
+	s.Unlock()
+	if store == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("there is no namespace '%s'", name)))
+		return
+	}
+
+	switch {
+	case path == "":
+		switch r.Method {
+		case "GET":
+			writeJSON(w, http.StatusOK, store.view())
+		case "DELETE":
+			s.Lock()
+			delete(s.namespaces, name)
+			err := s.save()
+			s.Unlock()
+			if err == nil {
+				err = store.remove()
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			log.Printf("deleted namespace %s and its %d fishes", clientPath(r, "/namespaces/"+name), store.view().Fishes)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("method not allowed"))
+		}
+	case path == "/export":
+		store.h.serveExport(w, r, store.Name)
+	case servesPath(path):
+		// A reload swaps the config of the main store only.
+		if store.h.config() != cfg {
+			store.h.settings.Store(cfg)
+		}
+		s.owner.Lock()
+		quota, fields := s.owner.quota, s.owner.fields
+		s.owner.Unlock()
+		store.h.Lock()
+		store.h.quota, store.h.fields = quota, fields
+		store.h.Unlock()
+
+		prefix := "/namespaces/" + name
+		r2 := r.Clone(context.WithValue(r.Context(), pathPrefixKey, clientPath(r, prefix)))
+		r2.URL.Path, r2.URL.RawPath = path, ""
+		store.mux.ServeHTTP(&prefixedWriter{ResponseWriter: w, prefix: prefix}, r2)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("namespaces are served the /fishes and /environments routes and /export only"))
+	}
+}
+
+func (s *namespaceSet) create(w http.ResponseWriter, r *http.Request) {
+	body, ok := readJSONBody(w, r)
+	if !ok {
+		return
+	}
+	var change namespaceChange
+	if err := json.Unmarshal(body, &change); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !tenantIDPattern.MatchString(change.Name) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte("name must be 1 to 63 lowercase letters, digits and dashes, starting and ending with a letter or digit"))
+		return
+	}
+	ns := namespace{Name: change.Name, CreatedAt: s.main.clock.Now().UTC()}
+
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.namespaces[ns.Name]; ok {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(fmt.Sprintf("namespace '%s' already exists", ns.Name)))
+		return
+	}
+	store, err := s.open(ns)
+	if err == nil {
+		s.namespaces[ns.Name] = store
+		if err = s.save(); err != nil {
+			delete(s.namespaces, ns.Name)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Location", "/namespaces/"+ns.Name)
+	writeJSON(w, http.StatusCreated, namespaceView{namespace: ns})
+}
@@ -0,0 +1,475 @@
+package fishes
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// routeRegistry is the mux of a server. It records the patterns registered
+// through handle and adminPortal.handle, so /openapi.json lists every route
+// without a second list to keep up to date.
+type routeRegistry struct {
+	sync.Mutex
+	mux   *http.ServeMux
+	admin map[string]bool
+}
+
+func newRouteRegistry() *routeRegistry {
+	return &routeRegistry{mux: http.NewServeMux(), admin: map[string]bool{}}
+}
+
+func (reg *routeRegistry) handle(pattern string, h http.HandlerFunc) {
+	reg.add(pattern, false)
+	reg.mux.HandleFunc(pattern, h)
+}
+
+// handle registers an admin route behind protect.
+func (a *adminPortal) handle(pattern string, h http.HandlerFunc) {
+	a.routes.add(pattern, true)
+	a.routes.mux.HandleFunc(pattern, a.protect(h))
+}
+
+func (reg *routeRegistry) add(pattern string, admin bool) {
+	reg.Lock()
+	reg.admin[pattern] = admin
+	reg.Unlock()
+}
+
+// apiOperation documents one method of a path. body and response are values
+// of the Go types sent and answered, whose schemas come from their json
+// tags. enveloped answers are wrapped in {"data": ...} where the
+// response_envelope setting or ?envelope=true asks for it.
+type apiOperation struct {
+	summary      string
+	query        []paramSpec
+	body         interface{}
+	bodyType     string
+	status       int
+	response     interface{}
+	responseType string
+	enveloped    bool
+	list         bool
+	deprecated   *deprecation
+}
+
+// apiPath is one path of a route. A pattern ending in / covers several.
+type apiPath struct {
+	path string
+	ops  map[string]apiOperation
+}
+
+var (
+	seqParam  = []paramSpec{{name: "seq", kind: paramInt, min: 1, max: math.MaxInt32}}
+	fishPaths = []apiPath{
+		{"/fishes/{id}", map[string]apiOperation{
+			"get":    {summary: "Get a fish by ID; a slug redirects to its ID", response: Fish{}, enveloped: true},
+			"put":    {summary: "Replace a fish, If-Match with its current ETag or If-Unmodified-Since is required", body: Fish{}, response: Fish{}, enveloped: true},
+			"patch":  {summary: "Update a fish with a JSON merge patch, If-Match with its current ETag or If-Unmodified-Since is required", body: Fish{}, bodyType: "application/merge-patch+json", response: Fish{}, enveloped: true},
+			"delete": {summary: "Move a fish to the trash", status: http.StatusNoContent},
+		}},
+		{"/fishes/random", map[string]apiOperation{
+			"get": {summary: "Redirect to a random fish", status: http.StatusFound},
+		}},
+		{"/fishes/{id}/restore", map[string]apiOperation{
+			"post": {summary: "Restore a fish from the trash", response: Fish{}, enveloped: true},
+		}},
+		{"/fishes/{id}/undo", map[string]apiOperation{
+			"post": {summary: "Revert the latest change of a fish", response: undoResult{}},
+		}},
+		{"/fishes/{id}/revisions", map[string]apiOperation{
+			"get": {summary: "List the revisions of a fish", response: []revision{}},
+		}},
+		{"/fishes/{id}/revisions/{n}", map[string]apiOperation{
+			"get": {summary: "Get one revision of a fish", response: revision{}},
+		}},
+		{"/fishes/{id}/revisions/diff", map[string]apiOperation{
+			"get": {summary: "Compare two revisions of a fish", query: []paramSpec{{name: "from", kind: paramInt, min: 1, max: math.MaxInt32}, {name: "to", kind: paramInt, min: 1, max: math.MaxInt32}}, response: revisionDiff{}},
+		}},
+	}
+)
+
+// apiDocs documents the routes by the pattern they are registered with.
+// Routes without an entry are still listed, as undocumented.
+var apiDocs = map[string][]apiPath{
+	"/fishes": {{"/fishes", map[string]apiOperation{
+		"get":  {summary: "List fishes; a Range of items=first-last answers a page of them with 206", query: listFishesParams, response: []Fish{}, list: true},
+		"post": {summary: "Create a fish; an Idempotency-Key makes retries safe", body: Fish{}, status: http.StatusCreated, response: Fish{}, enveloped: true},
+	}}},
+	"/fishes/":       fishPaths,
+	"/fishes/import": {{"/fishes/import", map[string]apiOperation{"post": {summary: "Import fishes from CSV", query: importFishesParams, body: "", bodyType: "text/csv", response: csvImportResult{}}}}},
+	"/fishes/trash":  {{"/fishes/trash", map[string]apiOperation{"get": {summary: "List the fishes in the trash", query: listTrashParams, response: []Fish{}, list: true}}}},
+	"/environments":  {{"/environments", map[string]apiOperation{"get": {summary: "List the environments a fish can live in", response: []environmentOption{}}}}},
+	"/healthz":       {{"/healthz", map[string]apiOperation{"get": {summary: "Health of this node, 503 while it cannot serve", response: healthStatus{}}}}},
+	"/metrics":       {{"/metrics", map[string]apiOperation{"get": {summary: "Prometheus metrics", response: "", responseType: "text/plain"}}}},
+	"/jobs/":         {{"/jobs/{id}", map[string]apiOperation{"get": {summary: "Status of an asynchronous write", response: asyncJob{}}}}},
+	"/openapi.json":  {{"/openapi.json", map[string]apiOperation{"get": {summary: "This document"}}}},
+	"/rpc":           {{"/rpc", map[string]apiOperation{"post": {summary: "JSON-RPC 2.0 calls of the fishes operations, one or a batch", body: rpcRequest{}, response: rpcResponse{}}}}},
+	"/graphql":       {{"/graphql", map[string]apiOperation{"post": {summary: "GraphQL queries of fishes and environments, with field selection, arguments, aliases and variables", body: graphQLRequest{}, response: graphQLResponse{}}}}},
+	"/usage":         {{"/usage", map[string]apiOperation{"get": {summary: "Usage and quotas of the tenant and API key of the request", response: []quotaUsage{}}}}},
+	"/docs":          {{"/docs", map[string]apiOperation{"get": {summary: "Explore and try this API from a browser", response: "", responseType: "text/html"}}}},
+	"/assets/":       {{"/assets/{name}", map[string]apiOperation{"get": {summary: "A stylesheet or script of the API explorer and the admin pages", response: "", responseType: "text/css"}}}},
+	"/namespaces": {{"/namespaces", map[string]apiOperation{
+		"get":  {summary: "List the namespaces, whose fishes are served under /namespaces/{namespace}", response: []namespaceView{}},
+		"post": {summary: "Create a namespace with an empty store", body: namespaceChange{}, status: http.StatusCreated, response: namespaceView{}},
+	}}},
+	"/namespaces/": {
+		{"/namespaces/{namespace}", map[string]apiOperation{"get": {summary: "A namespace and how many fishes it has", response: namespaceView{}}, "delete": {summary: "Delete a namespace with all its fishes", status: http.StatusNoContent}}},
+		{"/namespaces/{namespace}/export", map[string]apiOperation{"get": {summary: "Download an export archive of a namespace; a byte Range resumes a download cut short", response: []byte{}, responseType: "application/gzip"}}},
+	},
+
+	"/admin":                      {{"/admin", map[string]apiOperation{"get": {summary: "The admin portal", response: "", responseType: "text/html"}}}},
+	"/admin/export":               {{"/admin/export", map[string]apiOperation{"get": {summary: "Download an export archive; a byte Range resumes a download cut short", response: []byte{}, responseType: "application/gzip"}}}},
+	"/admin/import":               {{"/admin/import", map[string]apiOperation{"post": {summary: "Replace every fish with an export archive", query: []paramSpec{{name: "dry_run", kind: paramBool}}, body: []byte{}, bodyType: "application/gzip", response: importReport{}}}}},
+	"/admin/backups":              {{"/admin/backups", map[string]apiOperation{"get": {summary: "Backup status", response: backupStatus{}}, "post": {summary: "Take a backup now", status: http.StatusCreated, response: backupInfo{}}}}},
+	"/admin/restore":              {{"/admin/restore", map[string]apiOperation{"post": {summary: "Preview, then with confirm apply, a rollback to a point in the operation log", query: []paramSpec{{name: "seq", kind: paramInt, min: 0, max: math.MaxInt32}, {name: "at", kind: paramString}, {name: "confirm", kind: paramString}}, response: restorePreview{}}}}},
+	"/admin/generate":             {{"/admin/generate", map[string]apiOperation{"post": {summary: "Create random fishes", query: []paramSpec{{name: "count", kind: paramInt, min: 1, max: maxGenerateCount}, {name: "seed", kind: paramInt, min: math.MinInt32, max: math.MaxInt32}}, status: http.StatusCreated}}}},
+	"/admin/integrity":            {{"/admin/integrity", map[string]apiOperation{"get": {summary: "Check the data file, 409 when it is damaged", response: map[string]*integrityReport{}}}}},
+	"/admin/encryption":           {{"/admin/encryption", map[string]apiOperation{"get": {summary: "Encryption status", response: encryptionStatus{}}}}},
+	"/admin/encryption/rotate":    {{"/admin/encryption/rotate", map[string]apiOperation{"post": {summary: "Re-encrypt data_dir under a new key", body: "", bodyType: "text/plain"}}}},
+	"/admin/archive":              {{"/admin/archive", map[string]apiOperation{"get": {summary: "Cold archive statistics", response: archiveStats{}}}}},
+	"/admin/explorer":             {{"/admin/explorer", map[string]apiOperation{"get": {summary: "Query the fishes, the archive or the trash with the filters and sorts of the list, as CSV with format=csv or as an admin page to browsers", query: explorerParams(listFishesParams), response: explorerResult{}}}}},
+	"/admin/reports":              {{"/admin/reports", map[string]apiOperation{"get": {summary: "List the weekly reports kept", response: []reportInfo{}}, "post": {summary: "Make the weekly report now, mailing it to report_recipients", status: http.StatusCreated, response: weeklyReport{}}}}},
+	"/admin/reports/":             {{"/admin/reports/{name}", map[string]apiOperation{"get": {summary: "A weekly report, as CSV with format=csv or as a page to browsers", query: reportParams, response: weeklyReport{}}}}},
+	"/admin/contention":           {{"/admin/contention", map[string]apiOperation{"get": {summary: "How long each operation waits for the store lock and holds it", response: contentionReport{}}, "delete": {summary: "The lock contention so far, starting the counts over", response: contentionReport{}}}}},
+	"/admin/audit/auth":           {{"/admin/audit/auth", map[string]apiOperation{"get": {summary: "Authentication attempts", query: authAuditParams, response: []authEvent{}}}}},
+	"/admin/signed-urls":          {{"/admin/signed-urls", map[string]apiOperation{"post": {summary: "Issue a signed link for a GET", body: signedURLRequest{}, status: http.StatusCreated, response: signedURL{}}}}},
+	"/admin/access":               {{"/admin/access", map[string]apiOperation{"get": {summary: "The admin_allow and admin_deny lists", response: adminAccessLists{}}, "put": {summary: "Replace the admin_allow and admin_deny lists", body: adminAccessLists{}, response: adminAccessLists{}}}}},
+	"/admin/undo":                 {{"/admin/undo", map[string]apiOperation{"post": {summary: "Revert an operation, the latest one without seq", query: seqParam, response: undoResult{}}}}},
+	"/admin/jobs":                 {{"/admin/jobs", map[string]apiOperation{"get": {summary: "List the background jobs", response: []jobStatus{}}}}},
+	"/admin/jobs/":                {{"/admin/jobs/{name}/{action}", map[string]apiOperation{"post": {summary: "Run, pause or resume a background job"}}}},
+	"/admin/replication":          {{"/admin/replication", map[string]apiOperation{"get": {summary: "The operation log after a sequence number, long-polled with wait", query: replicationFeedParams, response: replicationBatch{}}}}},
+	"/admin/replication/snapshot": {{"/admin/replication/snapshot", map[string]apiOperation{"get": {summary: "A gzipped snapshot replicas bootstrap from", response: replicationSnapshot{}, responseType: "application/gzip"}}}},
+	"/admin/gossip":               {{"/admin/gossip", map[string]apiOperation{"post": {summary: "Exchange the member list with a peer", body: gossipMessage{}, response: gossipMessage{}}}}},
+	"/cluster/members":            {{"/cluster/members", map[string]apiOperation{"get": {summary: "The gossip members", response: []member{}}}}},
+	"/admin/cluster":              {{"/admin/cluster", map[string]apiOperation{"get": {summary: "Election state of this node", response: clusterStatus{}}}}},
+	"/admin/cluster/vote":         {{"/admin/cluster/vote", map[string]apiOperation{"post": {summary: "Ask this node for its vote", body: voteRequest{}, response: voteResponse{}}}}},
+	"/admin/cluster/heartbeat":    {{"/admin/cluster/heartbeat", map[string]apiOperation{"post": {summary: "Leader heartbeat", body: heartbeat{}, response: heartbeatResponse{}}}}},
+	"/admin/cluster/nodes":        {{"/admin/cluster/nodes", map[string]apiOperation{"get": {summary: "Term and applied sequence of every node", response: []clusterNodeStatus{}}}}},
+	"/admin/partition":            {{"/admin/partition", map[string]apiOperation{"get": {summary: "Partition ownership of this node", response: partitionStatus{}}}}},
+	"/admin/partition/handoff":    {{"/admin/partition/handoff", map[string]apiOperation{"post": {summary: "Hand fishes over to their new owner", body: handoffMessage{}, response: handoffResponse{}}}}},
+	"/cluster/status":             {{"/cluster/status", map[string]apiOperation{"get": {summary: "Health of every known node", response: topologyReport{}}}}},
+	"/admin/sync":                 {{"/admin/sync", map[string]apiOperation{"get": {summary: "State of the exchanges with sync_peers"}, "post": {summary: "Merge a peer's delta", body: syncRequest{}, response: syncResponse{}}}}},
+	"/mirror":                     {{"/mirror", map[string]apiOperation{"post": {summary: "Receive a gzipped batch of mirrored operations", body: mirrorBatch{}, bodyType: "application/gzip", response: mirrorAck{}}}}},
+	"/admin/mirror":               {{"/admin/mirror", map[string]apiOperation{"get": {summary: "Mirroring status", response: mirrorStatusReport{}}}}},
+	"/admin/mqtt":                 {{"/admin/mqtt", map[string]apiOperation{"get": {summary: "MQTT publishing status, 404 when mqtt_broker is not set", response: mqttStatusReport{}}}}},
+	"/admin/faults":               {{"/admin/faults", map[string]apiOperation{"get": {summary: "The fault injection rules", response: faultRules{}}, "put": {summary: "Replace the fault injection rules", body: faultRules{}, response: faultRules{}}, "delete": {summary: "Remove every fault injection rule", response: faultRules{}}}}},
+	"/admin/mock":                 {{"/admin/mock", map[string]apiOperation{"get": {summary: "The scenario served with -mock", response: mockStatus{}}, "post": {summary: "Load the -mock scenario again, putting back its fishes and fault rules", response: mockStatus{}}}}},
+	"/admin/slo":                  {{"/admin/slo", map[string]apiOperation{"get": {summary: "Burn rates and error budgets of slo_targets, as an admin page to browsers", response: sloStatus{}}}}},
+	"/admin/shadow":               {{"/admin/shadow", map[string]apiOperation{"get": {summary: "Results of shadowing to shadow_url and its latest divergences, 404 when it is not set", response: shadowStatusReport{}}}}},
+	"/admin/flags":                {{"/admin/flags", map[string]apiOperation{"get": {summary: "The feature flags and whether each is on, for every request and for the API keys with their own", response: []featureFlagView{}}, "patch": {summary: "Turn a feature flag on or off, for every request or one API key", body: featureFlagChange{}, response: []featureFlagView{}}}}},
+	"/admin/redactions":           {{"/admin/redactions", map[string]apiOperation{"get": {summary: "List the redaction policies, which hide fields of the fishes from some API keys or roles", response: []redactionPolicy{}}, "post": {summary: "Create a redaction policy", body: redactionPolicy{}, status: http.StatusCreated, response: redactionPolicy{}}}}},
+	"/admin/redactions/":          {{"/admin/redactions/{name}", map[string]apiOperation{"get": {summary: "A redaction policy", response: redactionPolicy{}}, "put": {summary: "Replace a redaction policy", body: redactionPolicy{}, response: redactionPolicy{}}, "delete": {summary: "Delete a redaction policy", status: http.StatusNoContent}}}},
+	"/admin/tenants":              {{"/admin/tenants", map[string]apiOperation{"get": {summary: "List the tenants, whose fishes are served under /t/{tenant} or with X-Fish-Tenant", response: []tenantView{}}, "post": {summary: "Create a tenant with an empty store", body: tenantChange{}, status: http.StatusCreated, response: tenantView{}}}}},
+	"/admin/tenants/": {
+		{"/admin/tenants/{id}", map[string]apiOperation{"get": {summary: "A tenant and how many fishes it has", response: tenantView{}}, "patch": {summary: "Change the quota of a tenant", body: tenantChange{}, response: tenantView{}}, "delete": {summary: "Delete a tenant with all its fishes", status: http.StatusNoContent}}},
+		{"/admin/tenants/{id}/schema", map[string]apiOperation{"get": {summary: "The custom fields of the fishes of a tenant", response: customFieldSchema{}}, "put": {summary: "Replace the custom fields of a tenant, which its fishes must fit", body: customFieldSchema{}, response: customFieldSchema{}}}},
+		{"/admin/tenants/{id}/export", map[string]apiOperation{"get": {summary: "Download an export archive of a tenant; a byte Range resumes a download cut short", response: []byte{}, responseType: "application/gzip"}}},
+	},
+}
+
+// schemaEnums lists the values of string types that only take a few.
+var schemaEnums = map[reflect.Type]func() []string{
+	reflect.TypeOf(Environment("")): environmentNames,
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaBuilder turns Go types into JSON schemas, named struct types going
+// to components so they are described once.
+type schemaBuilder struct {
+	components map[string]interface{}
+	// version is that of the API described; from 2 on, answers are always
+	// enveloped and errors are JSON.
+	version int
+}
+
+func componentName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	if values, ok := schemaEnums[t]; ok {
+		return map[string]interface{}{"type": "string", "enum": values()}
+	}
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case rawType:
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return b.schema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		name := componentName(t)
+		if _, ok := b.components[name]; !ok {
+			b.components[name] = nil
+			b.components[name] = b.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+func (b *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	var required []string
+	b.fields(t, props, &required)
+	schema := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+// fields adds the properties of t as encoding/json sees them, embedded
+// structs without a name of their own inlined.
+func (b *schemaBuilder) fields(t reflect.Type, props map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		if f.Anonymous && tag[0] == "" {
+			embedded := f.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				b.fields(embedded, props, required)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = f.Name
+		}
+		omitempty := false
+		asString := false
+		for _, opt := range tag[1:] {
+			omitempty = omitempty || opt == "omitempty"
+			asString = asString || opt == "string"
+		}
+		if asString {
+			props[name] = map[string]interface{}{"type": "string"}
+		} else {
+			props[name] = b.schema(f.Type)
+		}
+		if !omitempty && f.Type.Kind() != reflect.Ptr {
+			*required = append(*required, name)
+		}
+	}
+}
+
+func paramSchema(p paramSpec) map[string]interface{} {
+	schema := map[string]interface{}{}
+	switch p.kind {
+	case paramInt:
+		schema["type"] = "integer"
+		schema["minimum"] = p.min
+		schema["maximum"] = p.max
+		if p.def != "" {
+			if n, err := strconv.Atoi(p.def); err == nil {
+				schema["default"] = n
+			}
+		}
+	case paramBool:
+		schema["type"] = "boolean"
+	case paramNumber:
+		schema["type"] = "number"
+	case paramEnum:
+		schema["type"] = "string"
+		schema["enum"] = p.values
+		if p.def != "" {
+			schema["default"] = p.def
+		}
+	default:
+		schema["type"] = "string"
+	}
+	return schema
+}
+
+var pathParams = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+func (b *schemaBuilder) content(mediaType string, v interface{}, wrap func(map[string]interface{}) map[string]interface{}) map[string]interface{} {
+	if mediaType == "" {
+		mediaType = "application/json"
+	}
+	schema := b.schema(reflect.TypeOf(v))
+	if wrap != nil {
+		schema = wrap(schema)
+	}
+	return map[string]interface{}{mediaType: map[string]interface{}{"schema": schema}}
+}
+
+func (b *schemaBuilder) operation(path string, op apiOperation, admin bool) map[string]interface{} {
+	var params []interface{}
+	for _, m := range pathParams.FindAllStringSubmatch(path, -1) {
+		params = append(params, map[string]interface{}{"name": m[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"}})
+	}
+	for _, p := range op.query {
+		param := map[string]interface{}{"name": p.name, "in": "query", "schema": paramSchema(p)}
+		if p.deprecated != nil {
+			param["deprecated"] = true
+		}
+		params = append(params, param)
+	}
+
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	ok := map[string]interface{}{"description": http.StatusText(status)}
+	if op.response != nil {
+		var wrap func(map[string]interface{}) map[string]interface{}
+		switch {
+		case op.list:
+			wrap = func(items map[string]interface{}) map[string]interface{} {
+				envelope := map[string]interface{}{"type": "object", "properties": map[string]interface{}{
+					"data":  items,
+					"meta":  b.schema(reflect.TypeOf(listMeta{})),
+					"links": b.schema(reflect.TypeOf(listLinks{})),
+				}}
+				if b.version >= 2 {
+					return envelope
+				}
+				return map[string]interface{}{"oneOf": []interface{}{items, envelope}}
+			}
+		case op.enveloped:
+			wrap = func(item map[string]interface{}) map[string]interface{} {
+				envelope := map[string]interface{}{"type": "object", "properties": map[string]interface{}{"data": item}}
+				if b.version >= 2 {
+					return envelope
+				}
+				return map[string]interface{}{"oneOf": []interface{}{item, envelope}}
+			}
+		}
+		ok["content"] = b.content(op.responseType, op.response, wrap)
+	}
+
+	failed := map[string]interface{}{
+		"description": "The error, as plain text",
+		"content":     map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}},
+	}
+	if b.version >= 2 {
+		failed = map[string]interface{}{"description": "The error", "content": b.content("", apiErrorBody{}, nil)}
+	}
+	doc := map[string]interface{}{
+		"summary":   op.summary,
+		"responses": map[string]interface{}{strconv.Itoa(status): ok, "default": failed},
+	}
+	if len(params) > 0 {
+		doc["parameters"] = params
+	}
+	if op.deprecated != nil {
+		doc["deprecated"] = true
+	}
+	if op.body != nil {
+		doc["requestBody"] = map[string]interface{}{"required": true, "content": b.content(op.bodyType, op.body, nil)}
+	}
+	if admin {
+		doc["security"] = []interface{}{map[string]interface{}{"basic": []string{}}, map[string]interface{}{"signed": []string{}}}
+	}
+	return doc
+}
+
+// openAPIDocument describes the routes registered so far on routes as served
+// under prefix, the /v1 or /v2 of version, or without one, which also lists
+// the admin portal.
+func openAPIDocument(cfg *Config, routes *routeRegistry, version int, prefix string) map[string]interface{} {
+	routes.Lock()
+	patterns := make(map[string]bool, len(routes.admin))
+	for pattern, admin := range routes.admin {
+		patterns[pattern] = admin
+	}
+	routes.Unlock()
+
+	b := &schemaBuilder{components: map[string]interface{}{}, version: version}
+	paths := map[string]interface{}{}
+	for pattern, admin := range patterns {
+		if admin && prefix != "" {
+			continue
+		}
+		docs, ok := apiDocs[pattern]
+		if !ok {
+			paths[pattern] = map[string]interface{}{"description": "Registered without API documentation."}
+			continue
+		}
+		for _, p := range docs {
+			item := map[string]interface{}{}
+			for method, op := range p.ops {
+				item[method] = b.operation(p.path, op, admin)
+			}
+			paths[p.path] = item
+		}
+	}
+
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Fishes API",
+			"version": strconv.Itoa(fishSchemaVersion),
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": b.components,
+			"securitySchemes": map[string]interface{}{
+				"basic":  map[string]interface{}{"type": "http", "scheme": "basic", "description": "The user admin with admin_password"},
+				"signed": map[string]interface{}{"type": "apiKey", "in": "header", "name": "Authorization", "description": signatureScheme + " signature with one of api_keys"},
+			},
+		},
+	}
+	if cfg.AdvertiseURL != "" || prefix != "" {
+		doc["servers"] = []interface{}{map[string]interface{}{"url": strings.TrimSuffix(cfg.AdvertiseURL, "/") + prefix}}
+	}
+	return doc
+}
+
+func openAPI(config func() *Config, routes *routeRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("method not allowed"))
+			return
+		}
+		prefix, _ := r.Context().Value(pathPrefixKey).(string)
+		writeJSON(w, http.StatusOK, openAPIDocument(config(), routes, apiVersion(r), prefix))
+	}
+}
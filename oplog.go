@@ -0,0 +1,330 @@
+package fishes
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+const opLogFileName = "oplog.jsonl"
+
+const (
+	opPut    = "put"
+	opDelete = "delete"
+	opPurge  = "purge"
+	opReset  = "reset"
+)
+
+// opEntry is one line of the operation log. A put carries the fish as
+// written and a delete the fish as moved to the trash; a purge drops a fish
+// from the trash for good. A reset replaces the whole dataset, which is how
+// imports, restores and reloads are recorded. In a cluster, Term is the term
+// of the leader that made the write.
+type opEntry struct {
+	Seq    uint64            `json:"seq"`
+	At     time.Time         `json:"at"`
+	Term   uint64            `json:"term,omitempty"`
+	Op     string            `json:"op"`
+	ID     string            `json:"id,omitempty"`
+	Fish   *Fish             `json:"fish,omitempty"`
+	Fishes []Fish            `json:"fishes,omitempty"`
+	Trash  []Fish            `json:"trash,omitempty"`
+	Slugs  map[string]string `json:"slugs,omitempty"`
+}
+
+// opLog is an append-only record of every write. Appends happen with the
+// handler lock held so the log order matches the order writes were applied.
+type opLog struct {
+	path  string
+	file  *os.File
+	seq   uint64
+	keys  *keyring
+	clock Clock
+	// epoch is the time of the first entry.
+	epoch time.Time
+	// token is the consistency token of the last entry, read without the
+	// handler lock.
+	token atomic.Value
+	// fence, set on cluster nodes, gives the term of new entries and fails
+	// when this node may no longer write.
+	fence func() (uint64, error)
+	// replicating is set while entries of the primary are applied; they keep
+	// the term of the primary and are not fenced.
+	replicating    bool
+	replicatedTerm uint64
+	// changed is closed and replaced on every append, which wakes the
+	// replication feed.
+	changed chan struct{}
+}
+
+// readOps reads the log at path, giving up with the error of ctx once it is
+// done, so a request that went away does not keep decoding a long log.
+func readOps(ctx context.Context, path string, keys *keyring) ([]opEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ops []opEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxImportBytes)
+	for line := 1; scanner.Scan(); line++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		data, err := keys.openLine(scanner.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		var op opEntry
+		if err := json.Unmarshal(data, &op); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		if op.Fish != nil {
+			fish, err := keys.openFish(*op.Fish)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+			}
+			op.Fish = &fish
+		}
+		if err := keys.openFishes(op.Fishes); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		if err := keys.openFishes(op.Trash); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		ops = append(ops, op)
+	}
+	return ops, scanner.Err()
+}
+
+// openOpLog opens the log in dataDir and attaches it to h. A new log starts
+// with a reset holding the current data so it can always be replayed from
+// the beginning.
+func openOpLog(dataDir string, h *fishesHandler) (*opLog, error) {
+	path := filepath.Join(dataDir, opLogFileName)
+	ops, err := readOps(context.Background(), path, h.keys)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	l := &opLog{path: path, file: file, keys: h.keys, clock: h.clock, changed: make(chan struct{})}
+	if len(ops) > 0 {
+		l.seq = ops[len(ops)-1].Seq
+		l.epoch = ops[0].At
+		l.token.Store(consistencyToken(l.epoch, l.seq))
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if len(ops) == 0 {
+		snap, err := h.fullSnapshot()
+		if err == nil {
+			err = l.reset(snap)
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	h.oplog = l
+	return l, nil
+}
+
+// marshal encodes op with the sensitive fields of its fishes sealed.
+func (l *opLog) marshal(op opEntry) ([]byte, error) {
+	if op.Fish != nil {
+		fish, err := l.keys.sealFish(*op.Fish)
+		if err != nil {
+			return nil, err
+		}
+		op.Fish = &fish
+	}
+	var err error
+	if op.Fishes, err = l.keys.sealFishes(op.Fishes); err != nil {
+		return nil, err
+	}
+	if op.Trash, err = l.keys.sealFishes(op.Trash); err != nil {
+		return nil, err
+	}
+	return json.Marshal(op)
+}
+
+func (l *opLog) read(ctx context.Context) ([]opEntry, error) {
+	return readOps(ctx, l.path, l.keys)
+}
+
+func (l *opLog) append(op opEntry) error {
+	if l.replicating {
+		op.Term = l.replicatedTerm
+	} else if l.fence != nil {
+		term, err := l.fence()
+		if err != nil {
+			return err
+		}
+		op.Term = term
+	}
+	op.Seq = l.seq + 1
+	op.At = l.clock.Now().UTC()
+	line, err := l.marshal(op)
+	if err == nil {
+		line, err = l.keys.sealLine(line)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	l.seq = op.Seq
+	if l.epoch.IsZero() {
+		l.epoch = op.At
+	}
+	l.token.Store(consistencyToken(l.epoch, l.seq))
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return nil
+}
+
+// rewrite seals every entry again under the current key. Callers must hold
+// the handler lock.
+func (l *opLog) rewrite() error {
+	ops, err := l.read(context.Background())
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, op := range ops {
+		line, err := l.marshal(op)
+		if err == nil {
+			line, err = l.keys.sealLine(line)
+		}
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if err := writeFileAtomic(l.path, buf.Bytes()); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	l.file.Close()
+	l.file = file
+	return nil
+}
+
+func (l *opLog) put(fish Fish) error {
+	return l.append(opEntry{Op: opPut, Fish: &fish})
+}
+
+func (l *opLog) remove(fish Fish) error {
+	return l.append(opEntry{Op: opDelete, Fish: &fish})
+}
+
+func (l *opLog) purge(id string) error {
+	return l.append(opEntry{Op: opPurge, ID: id})
+}
+
+func (l *opLog) reset(snap *snapshot) error {
+	return l.append(opEntry{Op: opReset, Fishes: snap.Fishes, Trash: snap.Trash, Slugs: snap.Slugs})
+}
+
+// replicate runs apply as the replication of entries made in term.
+// Callers must hold the handler lock.
+func (h *fishesHandler) replicate(term uint64, apply func() error) error {
+	if h.oplog == nil {
+		return apply()
+	}
+	h.oplog.replicating, h.oplog.replicatedTerm = true, term
+	defer func() { h.oplog.replicating = false }()
+	return apply()
+}
+
+// replayOps rebuilds the dataset as it was right after the operation with
+// sequence number seq.
+func replayOps(ops []opEntry, seq uint64) *snapshot {
+	db := map[string]Fish{}
+	trash := map[string]Fish{}
+	slugs := map[string]string{}
+	for _, op := range ops {
+		if op.Seq > seq {
+			break
+		}
+		switch op.Op {
+		case opPut:
+			db[op.Fish.ID] = *op.Fish
+			delete(trash, op.Fish.ID)
+		case opDelete:
+			delete(db, op.Fish.ID)
+			trash[op.Fish.ID] = *op.Fish
+		case opPurge:
+			delete(trash, op.ID)
+		case opReset:
+			db = map[string]Fish{}
+			for _, fish := range op.Fishes {
+				db[fish.ID] = fish
+			}
+			trash = map[string]Fish{}
+			for _, fish := range op.Trash {
+				trash[fish.ID] = fish
+			}
+			slugs = map[string]string{}
+			for slug, id := range op.Slugs {
+				slugs[slug] = id
+			}
+		}
+	}
+
+	snap := &snapshot{SchemaVersion: fishSchemaVersion, Slugs: slugs}
+	for _, fish := range db {
+		snap.Fishes = append(snap.Fishes, fish)
+	}
+	for _, fish := range trash {
+		snap.Trash = append(snap.Trash, fish)
+	}
+	sortFishes(snap.Fishes, "id")
+	sortFishes(snap.Trash, "id")
+	return snap
+}
+
+// replaceAll swaps in snap as the whole dataset and records it in the log.
+// Callers must hold the lock.
+func (h *fishesHandler) replaceAll(snap *snapshot) error {
+	if err := h.restore(snap); err != nil {
+		return err
+	}
+	h.dirty = true
+	if h.oplog == nil && h.crdt == nil {
+		return nil
+	}
+	full, err := h.fullSnapshot()
+	if err != nil {
+		return err
+	}
+	if h.crdt != nil {
+		h.crdt.reconcile(full)
+	}
+	if h.oplog == nil {
+		return nil
+	}
+	return h.oplog.reset(full)
+}
@@ -0,0 +1,464 @@
+package fishes
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// partitionHopHeader marks requests one node passed on to another, which
+// serve them from their own partition instead of routing them again.
+const partitionHopHeader = "X-Fish-Partition-Hop"
+
+// maxHandoffBatch is the most fishes sent to a node in one handoff.
+const maxHandoffBatch = 500
+
+// partitionRing places every node at partition_vnodes points of a hash ring;
+// a key belongs to the first node point at or after its own hash.
+type partitionRing struct {
+	nodes  []string
+	points []uint64
+	owners []string
+}
+
+// ringHash takes the first bytes of SHA-256, since faster hashes spread the
+// nearby sequence IDs poorly.
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func newPartitionRing(nodes []string, vnodes int) *partitionRing {
+	ring := &partitionRing{nodes: nodes}
+	type point struct {
+		hash  uint64
+		owner string
+	}
+	points := make([]point, 0, len(nodes)*vnodes)
+	for _, node := range nodes {
+		for i := 0; i < vnodes; i++ {
+			points = append(points, point{ringHash(node + "#" + strconv.Itoa(i)), node})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	for _, p := range points {
+		ring.points = append(ring.points, p.hash)
+		ring.owners = append(ring.owners, p.owner)
+	}
+	return ring
+}
+
+func (ring *partitionRing) owner(key string) string {
+	if len(ring.points) == 0 {
+		return ""
+	}
+	hash := ringHash(key)
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= hash })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.owners[i]
+}
+
+// partitioner spreads the fishes over the partitioned members found by
+// gossip. Requests for a fish this node does not hold go to its owner, and
+// fishes are handed off to their new owner when the membership changes.
+type partitioner struct {
+	self    string
+	members *membership
+	fishes  *fishesHandler
+	client  *http.Client
+
+	sync.Mutex
+	ring        *partitionRing
+	signature   string
+	balancedFor string
+}
+
+func newPartitioner(h *fishesHandler, members *membership) *partitioner {
+	return &partitioner{
+		self:    members.self,
+		members: members,
+		fishes:  h,
+		client: &http.Client{
+			Timeout:       30 * time.Second,
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+}
+
+// currentRing is the ring of this node and the live partitioned members,
+// rebuilt only when they change.
+func (p *partitioner) currentRing() (*partitionRing, string) {
+	nodes := append([]string{p.self}, p.members.peers(clusterModePartitioned)...)
+	sort.Strings(nodes)
+	signature := strings.Join(nodes, ",")
+	p.Lock()
+	defer p.Unlock()
+	if p.ring == nil || p.signature != signature {
+		p.ring = newPartitionRing(nodes, p.fishes.config().PartitionVnodes)
+		p.signature = signature
+	}
+	return p.ring, signature
+}
+
+func (p *partitioner) owns(key string) bool {
+	ring, _ := p.currentRing()
+	return ring.owner(key) == p.self
+}
+
+// holds reports whether key is the id or slug of a fish stored here.
+func (p *partitioner) holds(key string) bool {
+	h := p.fishes
+	h.Lock()
+	defer h.Unlock()
+	if _, ok := h.db[key]; ok {
+		return true
+	}
+	if _, ok := h.trash[key]; ok {
+		return true
+	}
+	if _, ok := h.slugs[key]; ok {
+		return true
+	}
+	if h.archive != nil {
+		if _, ok := h.archive.index[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ownedIDs only hands out IDs that land on this node, so new fishes never
+// need to move.
+type ownedIDs struct {
+	IDGenerator
+	p *partitioner
+}
+
+func (g ownedIDs) NewID() string {
+	id := g.IDGenerator.NewID()
+	for i := 0; i < 64 && !g.p.owns(id); i++ {
+		id = g.IDGenerator.NewID()
+	}
+	return id
+}
+
+// NewIDs makes n ids as NewID does, the last round taking what it gets.
+func (g ownedIDs) NewIDs(n int) ([]string, error) {
+	ids := make([]string, 0, n)
+	for i := 0; len(ids) < n; i++ {
+		batch, err := newIDs(g.IDGenerator, n-len(ids))
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range batch {
+			if i == 64 || g.p.owns(id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// wrap passes requests for a single fish that is not stored here on to its
+// owner. Slugs hash apart from the ID of their fish, so when the owner does
+// not know the key the other nodes are asked in turn. Lists only cover the
+// partition of the node asked.
+func (p *partitioner) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, _, ok := fishPath(r.URL.Path)
+		if !ok || reservedSlugs[key] || r.Header.Get(partitionHopHeader) != "" || p.holds(key) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ring, _ := p.currentRing()
+		var candidates []string
+		if owner := ring.owner(key); owner != p.self {
+			candidates = append(candidates, owner)
+		}
+		for _, node := range ring.nodes {
+			if node != p.self && (len(candidates) == 0 || node != candidates[0]) {
+				candidates = append(candidates, node)
+			}
+		}
+		if len(candidates) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBytes))
+		if err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		var last *http.Response
+		for _, node := range candidates {
+			if r.Context().Err() != nil {
+				break
+			}
+			resp, err := p.forward(r, body, node)
+			if err != nil {
+				log.Printf("partition: forwarding %s %s to %s failed: %s", r.Method, r.URL.Path, node, err)
+				continue
+			}
+			if last != nil {
+				last.Body.Close()
+			}
+			last = resp
+			if resp.StatusCode != http.StatusNotFound {
+				break
+			}
+		}
+		if last == nil {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("the node holding this fish cannot be reached"))
+			return
+		}
+		defer last.Body.Close()
+		for name, values := range last.Header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(last.StatusCode)
+		io.Copy(w, last.Body)
+	})
+}
+
+// forward passes r on to node under the context of r, so the forwarded
+// request is abandoned along with r.
+func (p *partitioner) forward(r *http.Request, body []byte, node string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, node+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Del("Connection")
+	req.Header.Set(partitionHopHeader, p.self)
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		req.Header.Add("X-Forwarded-For", ip)
+	}
+	return p.client.Do(req)
+}
+
+type handoffFish struct {
+	Fish  Fish     `json:"fish"`
+	Slugs []string `json:"slugs,omitempty"`
+}
+
+type handoffMessage struct {
+	Fishes []handoffFish `json:"fishes"`
+}
+
+type handoffResponse struct {
+	Accepted int `json:"accepted"`
+}
+
+// rebalanceNow hands off the fishes owned by other nodes, once for every
+// change of the ring. It runs again on the next round if a handoff failed.
+func (p *partitioner) rebalanceNow() error {
+	ring, signature := p.currentRing()
+	p.Lock()
+	done := p.balancedFor == signature
+	p.Unlock()
+	if done {
+		return nil
+	}
+
+	h := p.fishes
+	h.Lock()
+	var archived []string
+	if h.archive != nil {
+		for id := range h.archive.index {
+			if ring.owner(id) != p.self {
+				archived = append(archived, id)
+			}
+		}
+	}
+	for _, id := range archived {
+		if err := h.rehydrate(id); err != nil {
+			h.Unlock()
+			return err
+		}
+	}
+	slugs := map[string][]string{}
+	for slug, id := range h.slugs {
+		slugs[id] = append(slugs[id], slug)
+	}
+	batches := map[string][]handoffFish{}
+	for _, set := range []map[string]Fish{h.db, h.trash} {
+		for id, fish := range set {
+			if owner := ring.owner(id); owner != p.self {
+				batches[owner] = append(batches[owner], handoffFish{Fish: fish, Slugs: slugs[id]})
+			}
+		}
+	}
+	h.Unlock()
+
+	moved := 0
+	var failed error
+	for owner, fishes := range batches {
+		for len(fishes) > 0 {
+			n := len(fishes)
+			if n > maxHandoffBatch {
+				n = maxHandoffBatch
+			}
+			batch := fishes[:n]
+			fishes = fishes[n:]
+			var resp handoffResponse
+			if err := postPeer(context.Background(), p.client, h.config().ReplicationKey, owner, "/admin/partition/handoff", handoffMessage{Fishes: batch}, &resp); err != nil {
+				failed = fmt.Errorf("handing off to %s: %s", owner, err)
+				break
+			}
+			n, err := p.dropHandedOff(batch)
+			moved += n
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if moved > 0 {
+		log.Printf("partition: handed off %d fishes", moved)
+	}
+	if failed != nil {
+		return failed
+	}
+	p.Lock()
+	p.balancedFor = signature
+	p.Unlock()
+	return nil
+}
+
+// dropHandedOff forgets the fishes of a handoff, except for the ones
+// changed here since they were sent, which go out with the next round.
+func (p *partitioner) dropHandedOff(batch []handoffFish) (int, error) {
+	h := p.fishes
+	h.Lock()
+	defer h.Unlock()
+	dropped := 0
+	for _, sent := range batch {
+		id := sent.Fish.ID
+		if fish, live := h.db[id]; live {
+			if fish.Version != sent.Fish.Version {
+				p.unbalance()
+				continue
+			}
+			if err := h.moveToTrash(fish); err != nil {
+				return dropped, err
+			}
+		} else if fish, trashed := h.trash[id]; !trashed || fish.Version != sent.Fish.Version {
+			p.unbalance()
+			continue
+		}
+		if err := h.dropFromTrash(id); err != nil {
+			return dropped, err
+		}
+		dropped++
+	}
+	if dropped > 0 {
+		h.bumpVersion()
+		h.dirty = true
+	}
+	return dropped, nil
+}
+
+func (p *partitioner) unbalance() {
+	p.Lock()
+	p.balancedFor = ""
+	p.Unlock()
+}
+
+// handoff takes the fishes another node no longer owns. A copy here that is
+// newer wins.
+func (p *partitioner) handoff(w http.ResponseWriter, r *http.Request) {
+	var msg handoffMessage
+	if !readMessage(w, r, &msg) {
+		return
+	}
+	h := p.fishes
+	h.Lock()
+	defer h.Unlock()
+	accepted := 0
+	for _, in := range msg.Fishes {
+		fish := in.Fish
+		if err := h.rehydrate(fish.ID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if local, ok := h.db[fish.ID]; ok && local.Version > fish.Version {
+			continue
+		}
+		if local, ok := h.trash[fish.ID]; ok && local.Version > fish.Version {
+			continue
+		}
+		for _, slug := range in.Slugs {
+			h.slugs[slug] = fish.ID
+		}
+		var err error
+		if fish.DeletedAt != nil {
+			err = h.moveToTrash(fish)
+		} else {
+			delete(h.trash, fish.ID)
+			_, err = h.put(fish)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if !p.owns(fish.ID) {
+			p.unbalance()
+		}
+		accepted++
+	}
+	writeJSON(w, http.StatusOK, handoffResponse{Accepted: accepted})
+}
+
+type partitionStatus struct {
+	Self      string   `json:"self"`
+	Nodes     []string `json:"nodes"`
+	Owned     int      `json:"owned"`
+	Misplaced int      `json:"misplaced"`
+	Balanced  bool     `json:"balanced"`
+}
+
+// status shows the ring as this node sees it and how many of its fishes
+// still have to move.
+func (p *partitioner) status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	ring, signature := p.currentRing()
+	status := partitionStatus{Self: p.self, Nodes: ring.nodes}
+	h := p.fishes
+	h.Lock()
+	for _, set := range []map[string]Fish{h.db, h.trash} {
+		for id := range set {
+			if ring.owner(id) == p.self {
+				status.Owned++
+			} else {
+				status.Misplaced++
+			}
+		}
+	}
+	h.Unlock()
+	p.Lock()
+	status.Balanced = p.balancedFor == signature
+	p.Unlock()
+	writeJSON(w, http.StatusOK, status)
+}
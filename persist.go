@@ -0,0 +1,326 @@
+package fishes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const snapshotFileName = "fishes.json"
+
+type snapshot struct {
+	SchemaVersion  int               `json:"schema_version"`
+	DataVersion    int               `json:"data_version"`
+	SavedAt        time.Time         `json:"saved_at"`
+	Version        uint64            `json:"version"`
+	Modified       *time.Time        `json:"modified,omitempty"`
+	Checksum       string            `json:"checksum,omitempty"`
+	Fishes         []Fish            `json:"fishes"`
+	Checksums      []string          `json:"checksums,omitempty"`
+	Trash          []Fish            `json:"trash,omitempty"`
+	TrashChecksums []string          `json:"trash_checksums,omitempty"`
+	Slugs          map[string]string `json:"slugs,omitempty"`
+	Archived       map[string]string `json:"archived,omitempty"`
+
+	// migrated lists the migrations applied while reading the file.
+	migrated []string
+	// checksumOK is false when the file checksum does not match its
+	// contents; corrupt holds the records that could not be trusted.
+	checksumOK bool
+	corrupt    []corruptRecord
+}
+
+// decodeRecords verifies, migrates and decodes the records of one section
+// of the data file. Records that fail are returned as corrupt.
+func decodeRecords(section string, raw []json.RawMessage, sums []string, from int) ([]Fish, []corruptRecord, []string, error) {
+	var corrupt []corruptRecord
+	var records []map[string]json.RawMessage
+	var indexes []int
+	for i, data := range raw {
+		var record map[string]json.RawMessage
+		if err := json.Unmarshal(data, &record); err != nil {
+			corrupt = append(corrupt, corruptRecord{section: section, index: i, reason: err.Error(), data: data})
+			continue
+		}
+		if i < len(sums) && recordChecksum(record) != sums[i] {
+			corrupt = append(corrupt, corruptRecord{section: section, index: i, reason: "checksum mismatch", data: data})
+			continue
+		}
+		records = append(records, record)
+		indexes = append(indexes, i)
+	}
+
+	migrated, err := migrateRecords(from, records)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	fishes := make([]Fish, 0, len(records))
+	for i, record := range records {
+		var fish Fish
+		data, err := json.Marshal(record)
+		if err == nil {
+			err = json.Unmarshal(data, &fish)
+		}
+		if err != nil {
+			corrupt = append(corrupt, corruptRecord{section: section, index: indexes[i], reason: err.Error(), data: raw[indexes[i]]})
+			continue
+		}
+		fishes = append(fishes, fish)
+	}
+	return fishes, corrupt, migrated, nil
+}
+
+// readSnapshot loads the data file, verifying checksums and applying
+// migrations. Records that fail verification or decoding are left out and
+// returned in corrupt instead of failing the whole load.
+func readSnapshot(path string, keys *keyring) (*snapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &snapshot{SchemaVersion: fishSchemaVersion, DataVersion: currentDataVersion(), checksumOK: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data, err = keys.open(data); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	var raw struct {
+		snapshot
+		Fishes []json.RawMessage `json:"fishes"`
+		Trash  []json.RawMessage `json:"trash"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	snap := raw.snapshot
+	snap.checksumOK = snap.Checksum == "" || snap.Checksum == fileChecksum(&snap)
+
+	var corrupt []corruptRecord
+	snap.Fishes, snap.corrupt, snap.migrated, err = decodeRecords("fishes", raw.Fishes, snap.Checksums, snap.DataVersion)
+	if err == nil {
+		snap.Trash, corrupt, _, err = decodeRecords("trash", raw.Trash, snap.TrashChecksums, snap.DataVersion)
+	}
+	if err == nil {
+		err = keys.openFishes(snap.Fishes)
+	}
+	if err == nil {
+		err = keys.openFishes(snap.Trash)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	snap.corrupt = append(snap.corrupt, corrupt...)
+	snap.DataVersion = currentDataVersion()
+	snap.Checksum = ""
+	snap.Checksums = nil
+	snap.TrashChecksums = nil
+	return &snap, nil
+}
+
+// writeFileAtomic replaces path with data so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func writeSnapshot(path string, snap *snapshot, keys *keyring) error {
+	sealed := *snap
+	var err error
+	if sealed.Fishes, err = keys.sealFishes(snap.Fishes); err != nil {
+		return err
+	}
+	if sealed.Trash, err = keys.sealFishes(snap.Trash); err != nil {
+		return err
+	}
+	if err := sealed.sign(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(&sealed, "", "  ")
+	if err == nil {
+		data, err = keys.seal(data)
+	}
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// snapshot copies the current state. Callers must hold the lock.
+func (h *fishesHandler) snapshot() *snapshot {
+	fishes := make([]Fish, 0, len(h.db))
+	for _, fish := range h.db {
+		fishes = append(fishes, fish)
+	}
+	sortFishes(fishes, "id")
+
+	trash := make([]Fish, 0, len(h.trash))
+	for _, fish := range h.trash {
+		trash = append(trash, fish)
+	}
+	sortFishes(trash, "id")
+
+	slugs := make(map[string]string, len(h.slugs))
+	for slug, id := range h.slugs {
+		slugs[slug] = id
+	}
+
+	snap := &snapshot{
+		SchemaVersion: fishSchemaVersion,
+		DataVersion:   currentDataVersion(),
+		SavedAt:       h.clock.Now().UTC(),
+		Version:       h.version,
+		Fishes:        fishes,
+		Trash:         trash,
+		Slugs:         slugs,
+	}
+	if !h.modified.IsZero() {
+		modified := h.modified
+		snap.Modified = &modified
+	}
+	if h.archive != nil && len(h.archive.index) > 0 {
+		snap.Archived = make(map[string]string, len(h.archive.index))
+		for id, segment := range h.archive.index {
+			snap.Archived[id] = segment
+		}
+	}
+	return snap
+}
+
+// restore replaces the current state with snap. Callers must hold the lock.
+func (h *fishesHandler) restore(snap *snapshot) error {
+	db := make(map[string]Fish, len(snap.Fishes))
+	encoded := make(map[string]*encodedFish, len(snap.Fishes))
+	var memoryBytes int64
+	for _, fish := range snap.Fishes {
+		enc, err := encodeFish(fish)
+		if err != nil {
+			return err
+		}
+		db[fish.ID] = fish
+		encoded[fish.ID] = enc
+		memoryBytes += int64(len(enc.json))
+	}
+
+	trash := make(map[string]Fish, len(snap.Trash))
+	for _, fish := range snap.Trash {
+		trash[fish.ID] = fish
+	}
+
+	slugs := map[string]string{}
+	for slug, id := range snap.Slugs {
+		slugs[slug] = id
+	}
+	for _, fish := range snap.Fishes {
+		if fish.Slug != "" {
+			slugs[fish.Slug] = fish.ID
+		}
+	}
+
+	h.db = db
+	h.encoded, h.memoryBytes = encoded, memoryBytes
+	h.trash = trash
+	h.slugs = slugs
+	if h.archive != nil {
+		h.archive.reindex(snap.Archived, db)
+	}
+	if snap.Version > h.version {
+		h.version = snap.Version
+		h.modified = h.clock.Now().UTC()
+		if snap.Modified != nil {
+			h.modified = *snap.Modified
+		}
+	} else {
+		h.bumpVersion()
+	}
+	h.cache.invalidate("fishes")
+	return nil
+}
+
+type persister struct {
+	path   string
+	h      *fishesHandler
+	loaded *integrityReport
+	// writeMu keeps a flush from writing a snapshot sealed with a key that
+	// was rotated out while it ran.
+	writeMu sync.Mutex
+}
+
+func newPersister(dataDir string, h *fishesHandler) (*persister, error) {
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	p := &persister{path: filepath.Join(dataDir, snapshotFileName), h: h}
+	snap, err := readSnapshot(p.path, h.keys)
+	if err != nil {
+		return nil, err
+	}
+
+	p.loaded = newIntegrityReport(p.path, snap, h.clock.Now())
+	if err := quarantine(dataDir, p.loaded, snap.corrupt); err != nil {
+		return nil, err
+	}
+	for _, c := range p.loaded.Corrupt {
+		log.Printf("quarantined corrupt %s record %d of %s to %s: %s", c.Section, c.Index, p.path, c.File, c.Reason)
+	}
+	if !snap.checksumOK {
+		log.Printf("checksum of %s does not match its contents", p.path)
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if err := h.restore(snap); err != nil {
+		return nil, err
+	}
+	h.dirty = len(snap.migrated) > 0 || len(snap.corrupt) > 0
+	for _, m := range snap.migrated {
+		log.Printf("applied data migration %s to %s", m, p.path)
+	}
+	return p, nil
+}
+
+func (p *persister) flush() error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	p.h.Lock()
+	if !p.h.dirty {
+		p.h.Unlock()
+		return nil
+	}
+	snap := p.h.snapshot()
+	p.h.dirty = false
+	p.h.Unlock()
+
+	if err := writeSnapshot(p.path, snap, p.h.keys); err != nil {
+		p.h.Lock()
+		p.h.dirty = true
+		p.h.Unlock()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package fishes
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+type preflightCheck struct {
+	name string
+	err  error
+	hint string
+}
+
+type preflightReport struct {
+	checks []preflightCheck
+}
+
+func (r *preflightReport) add(name string, err error, hint string) {
+	r.checks = append(r.checks, preflightCheck{name: name, err: err, hint: hint})
+}
+
+func (r *preflightReport) failed() bool {
+	for _, c := range r.checks {
+		if c.err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *preflightReport) print(w io.Writer) {
+	failures := 0
+	for _, c := range r.checks {
+		if c.err != nil {
+			failures++
+		}
+	}
+
+	if failures == 0 {
+		fmt.Fprintf(w, "all %d startup checks passed\n", len(r.checks))
+	} else {
+		fmt.Fprintf(w, "%d of %d startup checks failed:\n", failures, len(r.checks))
+	}
+	for _, c := range r.checks {
+		if c.err == nil {
+			fmt.Fprintf(w, "  ok    %s\n", c.name)
+			continue
+		}
+		fmt.Fprintf(w, "  FAIL  %s: %s\n", c.name, c.err)
+		if c.hint != "" {
+			fmt.Fprintf(w, "        hint: %s\n", c.hint)
+		}
+	}
+}
+
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".preflight")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func checkAddrFree(network, addr string) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
+
+// preflight checks everything the server needs before it starts so that
+// all problems are reported together instead of one panic at a time.
+func preflight(cfg *Config) *preflightReport {
+	report := &preflightReport{}
+
+	problems := cfg.problems()
+	for _, problem := range problems {
+		report.add("config", fmt.Errorf("%s", problem), "set it in the config file, as an environment variable or as a flag; see -h")
+	}
+	if len(problems) == 0 {
+		report.add("config", nil, "")
+	}
+
+	if cfg.DataDir != "" {
+		report.add("data_dir "+cfg.DataDir+" is writable", checkWritableDir(cfg.DataDir),
+			"create the directory and give the server user write access, or set data_dir")
+
+		keys, err := newKeyring(cfg)
+		if cfg.EncryptionKeyFile != "" {
+			report.add("encryption_key_file "+cfg.EncryptionKeyFile+" is readable", err,
+				"create the file with one base64 key per line, or unset encryption_key_file")
+		}
+
+		snapshotPath := filepath.Join(cfg.DataDir, snapshotFileName)
+		_, err = readSnapshot(snapshotPath, keys)
+		report.add("snapshot "+snapshotPath+" is readable", err,
+			"restore the file from a backup or move it aside to start empty; encrypted files need the key they were written with")
+	}
+
+	if cfg.SeedFile != "" {
+		_, err := readSeedFile(cfg.SeedFile)
+		report.add("seed_file "+cfg.SeedFile+" is valid", err, "fix the reported record or unset seed_file")
+	}
+
+	if cfg.BackupDir != "" {
+		report.add("backup_dir "+cfg.BackupDir+" is writable", checkWritableDir(cfg.BackupDir),
+			"create the directory and give the server user write access, or set backup_dir")
+	}
+
+	if cfg.TLSCert != "" && cfg.TLSKey != "" {
+		_, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		report.add("tls certificate "+cfg.TLSCert+" loads", err, "check tls_cert and tls_key point at a matching PEM pair")
+	}
+	if cfg.ACMEDomain != "" {
+		dir := cfg.ACMECacheDir
+		if dir == "" {
+			dir = filepath.Join(cfg.DataDir, "acme")
+		}
+		report.add("acme_cache_dir "+dir+" is writable", checkWritableDir(dir), "set acme_cache_dir to a writable directory")
+	}
+
+	// Inherited sockets are already bound by systemd or the previous process.
+	if os.Getenv("LISTEN_FDS") == "" {
+		specs, err := cfg.listenerSpecs()
+		if err == nil {
+			for _, spec := range specs {
+				err := checkAddrFree(spec.network, spec.address)
+				if spec.network == "unix" {
+					err = checkWritableDir(filepath.Dir(spec.address))
+				}
+				report.add("listen "+spec.String()+" is available", err,
+					"stop whatever else is bound there or choose another address with addr or listen")
+			}
+		}
+		if cfg.TLSRedirectAddr != "" {
+			report.add("tls_redirect_addr "+cfg.TLSRedirectAddr+" is available", checkAddrFree("tcp", cfg.TLSRedirectAddr),
+				"ports below 1024 need CAP_NET_BIND_SERVICE or root")
+		}
+	}
+
+	return report
+}
@@ -0,0 +1,106 @@
+package fishes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// protoBuffer encodes a protobuf message. Fields at their zero value are
+// left out, as proto3 does.
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+func (p *protoBuffer) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	p.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (p *protoBuffer) str(field int, s string) {
+	if s != "" {
+		p.bytes(field, []byte(s))
+	}
+}
+
+func (p *protoBuffer) int(field int, n int64) {
+	if n != 0 {
+		p.varint(uint64(field)<<3 | 0)
+		p.varint(uint64(n))
+	}
+}
+
+func (p *protoBuffer) double(field int, v float64) {
+	if v != 0 {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+		p.varint(uint64(field)<<3 | 1)
+		p.Write(b[:])
+	}
+}
+
+// bytes writes a length-delimited field, which embedded messages are too.
+func (p *protoBuffer) bytes(field int, b []byte) {
+	p.varint(uint64(field)<<3 | 2)
+	p.varint(uint64(len(b)))
+	p.Write(b)
+}
+
+// protoField is one field read out of a message: n for varints and fixed
+// sizes, data for length-delimited ones.
+type protoField struct {
+	number int
+	n      uint64
+	data   []byte
+}
+
+func (f protoField) str() string {
+	return string(f.data)
+}
+
+func (f protoField) int() int {
+	return int(int32(f.n))
+}
+
+// protoFields splits a message into its fields, in the order they were
+// written; a later one replaces an earlier one of the same number.
+func protoFields(b []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("malformed field key")
+		}
+		b = b[n:]
+		f := protoField{number: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			if f.n, n = binary.Uvarint(b); n <= 0 {
+				return nil, errors.New("malformed varint")
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return nil, errors.New("truncated fixed64")
+			}
+			f.n, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return nil, errors.New("truncated length-delimited field")
+			}
+			f.data, b = b[n:n+int(size)], b[n+int(size):]
+		case 5:
+			if len(b) < 4 {
+				return nil, errors.New("truncated fixed32")
+			}
+			f.n, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d", key&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
@@ -0,0 +1,134 @@
+package fishes
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type contextKey string
+
+const peerAddrKey contextKey = "peer-addr"
+
+// trustedProxies holds the networks whose forwarding headers are believed.
+// The special entry "unix" trusts peers connected over a Unix socket.
+type trustedProxies struct {
+	nets []*net.IPNet
+	unix bool
+}
+
+func parseTrustedProxies(entries []string) (*trustedProxies, error) {
+	t := &trustedProxies{}
+	for _, entry := range entries {
+		if entry == "unix" {
+			t.unix = true
+			continue
+		}
+		ipnet, err := parseIPNet(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s': %s", entry, err)
+		}
+		t.nets = append(t.nets, ipnet)
+	}
+	return t, nil
+}
+
+// parseIPNet parses a CIDR, treating a bare address as a single host.
+func parseIPNet(entry string) (*net.IPNet, error) {
+	if !strings.Contains(entry, "/") {
+		if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+			entry += "/32"
+		} else {
+			entry += "/128"
+		}
+	}
+	_, ipnet, err := net.ParseCIDR(entry)
+	return ipnet, err
+}
+
+func (t *trustedProxies) trusts(ip net.IP) bool {
+	for _, n := range t.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func hostIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
+
+// realIP returns the client address for r, consulting X-Forwarded-For and
+// X-Real-IP only when the connecting peer is a trusted proxy.
+func (t *trustedProxies) realIP(r *http.Request) (net.IP, bool) {
+	peer := hostIP(r.RemoteAddr)
+	if peer == nil && !t.unix {
+		return nil, false
+	}
+	if peer != nil && !t.trusts(peer) {
+		return peer, false
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		var leftmost net.IP
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+			leftmost = ip
+			if !t.trusts(ip) {
+				return ip, true
+			}
+		}
+		if leftmost != nil {
+			return leftmost, true
+		}
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip, true
+	}
+	return peer, false
+}
+
+// wrap rewrites RemoteAddr to the real client address so everything
+// downstream sees the client rather than the proxy. The original peer address
+// stays available through peerAddr.
+func (t *trustedProxies) wrap(next http.Handler) http.Handler {
+	if len(t.nets) == 0 && !t.unix {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, forwarded := t.realIP(r)
+		if forwarded {
+			ctx := context.WithValue(r.Context(), peerAddrKey, r.RemoteAddr)
+			r = r.WithContext(ctx)
+			r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func peerAddr(r *http.Request) string {
+	if addr, ok := r.Context().Value(peerAddrKey).(string); ok {
+		return addr
+	}
+	return r.RemoteAddr
+}
+
+func clientIP(r *http.Request) string {
+	if ip := hostIP(r.RemoteAddr); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
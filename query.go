@@ -0,0 +1,131 @@
+package fishes
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type paramKind int
+
+const (
+	paramString paramKind = iota
+	paramInt
+	paramBool
+	paramEnum
+	paramNumber
+)
+
+type paramSpec struct {
+	name       string
+	kind       paramKind
+	min        int
+	max        int
+	values     []string
+	def        string
+	deprecated *deprecation
+}
+
+type queryValues map[string]string
+
+func (q queryValues) has(name string) bool {
+	_, ok := q[name]
+	return ok
+}
+
+func (q queryValues) str(name string) string {
+	return q[name]
+}
+
+func (q queryValues) int(name string) int {
+	n, _ := strconv.Atoi(q[name])
+	return n
+}
+
+func (q queryValues) bool(name string) bool {
+	b, _ := strconv.ParseBool(q[name])
+	return b
+}
+
+type queryHandler func(w http.ResponseWriter, r *http.Request, q queryValues)
+
+func (s paramSpec) check(raw string) error {
+	switch s.kind {
+	case paramInt:
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < s.min || n > s.max {
+			return fmt.Errorf("parameter '%s' must be an integer between %d and %d", s.name, s.min, s.max)
+		}
+	case paramBool:
+		if _, err := strconv.ParseBool(raw); err != nil {
+			return fmt.Errorf("parameter '%s' must be a boolean", s.name)
+		}
+	case paramNumber:
+		if _, err := strconv.ParseFloat(raw, 64); err != nil {
+			return fmt.Errorf("parameter '%s' must be a number", s.name)
+		}
+	case paramEnum:
+		for _, v := range s.values {
+			if raw == v {
+				return nil
+			}
+		}
+		return fmt.Errorf("parameter '%s' must be one of: %s", s.name, strings.Join(s.values, ", "))
+	}
+	return nil
+}
+
+func parseQuery(specs []paramSpec, r *http.Request) (queryValues, []string) {
+	values := queryValues{}
+	var problems []string
+
+	raw := r.URL.Query()
+	known := map[string]bool{}
+	for _, spec := range specs {
+		known[spec.name] = true
+
+		vs, ok := raw[spec.name]
+		if !ok {
+			if spec.def != "" {
+				values[spec.name] = spec.def
+			}
+			continue
+		}
+		if len(vs) > 1 {
+			problems = append(problems, fmt.Sprintf("parameter '%s' given more than once", spec.name))
+			continue
+		}
+		if err := spec.check(vs[0]); err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		values[spec.name] = vs[0]
+	}
+
+	var unknown []string
+	for name := range raw {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		problems = append(problems, fmt.Sprintf("unrecognized parameter '%s'", name))
+	}
+
+	return values, problems
+}
+
+func validateQuery(specs []paramSpec, next queryHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		values, problems := parseQuery(specs, r)
+		if len(problems) > 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("invalid query parameters:\n" + strings.Join(problems, "\n")))
+			return
+		}
+		next(w, r, values)
+	}
+}
@@ -0,0 +1,266 @@
+package fishes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const quotaSubjectsKey contextKey = "quota-subjects"
+
+// quotaLimits are the limits of a tenant or API key; 0 is no limit. Records
+// and storage bytes only apply to tenants, since fishes belong to a store
+// and not to the key that created them.
+type quotaLimits struct {
+	Records        int64 `json:"records,omitempty"`
+	RequestsPerDay int64 `json:"requests_per_day,omitempty"`
+	StorageBytes   int64 `json:"storage_bytes,omitempty"`
+}
+
+// parseQuotas reads quotas entries, tenant:<id>:<limit>=<n> or
+// key:<id>:<limit>=<n>, where an id of * sets the limit of those without
+// their own, keyed by kind:id.
+func parseQuotas(entries []string) (map[string]quotaLimits, error) {
+	quotas := map[string]quotaLimits{}
+	for _, entry := range entries {
+		kv := strings.SplitN(entry, "=", 2)
+		parts := strings.Split(kv[0], ":")
+		if len(kv) != 2 || len(parts) != 3 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid quota '%s', expected tenant:<id>:<limit>=<n> or key:<id>:<limit>=<n>", entry)
+		}
+		n, err := strconv.ParseInt(kv[1], 10, 64)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("quota '%s': the limit must be a positive integer", entry)
+		}
+		kind, limit := parts[0], parts[2]
+		if kind != "tenant" && kind != "key" {
+			return nil, fmt.Errorf("quota '%s': quotas are set for a tenant or a key", entry)
+		}
+		subject := kind + ":" + parts[1]
+		limits := quotas[subject]
+		switch {
+		case limit == "requests_per_day":
+			limits.RequestsPerDay = n
+		case limit == "records" && kind == "tenant":
+			limits.Records = n
+		case limit == "storage_bytes" && kind == "tenant":
+			limits.StorageBytes = n
+		case kind == "tenant":
+			return nil, fmt.Errorf("quota '%s': tenants take records, requests_per_day and storage_bytes", entry)
+		default:
+			return nil, fmt.Errorf("quota '%s': keys take requests_per_day only", entry)
+		}
+		quotas[subject] = limits
+	}
+	return quotas, nil
+}
+
+func limitsFor(quotas map[string]quotaLimits, kind, id string) quotaLimits {
+	limits, fallback := quotas[kind+":"+id], quotas[kind+":*"]
+	if limits.Records == 0 {
+		limits.Records = fallback.Records
+	}
+	if limits.RequestsPerDay == 0 {
+		limits.RequestsPerDay = fallback.RequestsPerDay
+	}
+	if limits.StorageBytes == 0 {
+		limits.StorageBytes = fallback.StorageBytes
+	}
+	return limits
+}
+
+// storageBytes is the size of the fishes of the store, as they are served.
+func (h *fishesHandler) storageBytes() int64 {
+	h.Lock()
+	defer h.Unlock()
+	return h.memoryBytes
+}
+
+type quotaSubject struct {
+	kind, id string
+	limits   quotaLimits
+	store    *tenantStore
+}
+
+func (s quotaSubject) name() string {
+	return s.kind + ":" + s.id
+}
+
+// quotaTracker counts the requests of each tenant and API key per UTC day
+// and refuses those past their quotas. Counts start over on restart.
+type quotaTracker struct {
+	fishes  *fishesHandler
+	tenants *tenantRouter
+
+	sync.Mutex
+	day      string
+	requests map[string]int64
+}
+
+func newQuotaTracker(h *fishesHandler, tenants *tenantRouter) *quotaTracker {
+	return &quotaTracker{fishes: h, tenants: tenants, requests: map[string]int64{}}
+}
+
+// subjects finds the tenant and the key of r, which are counted and
+// limited, either, both or neither. The key is that of a valid signature by
+// one of api_keys; replication_key is not counted.
+func (q *quotaTracker) subjects(r *http.Request, keyID string) []quotaSubject {
+	quotas, _ := parseQuotas(q.fishes.config().Quotas)
+	var subjects []quotaSubject
+	if id, _, _ := tenantOf(r); id != "" {
+		q.tenants.Lock()
+		store := q.tenants.tenants[id]
+		q.tenants.Unlock()
+		if store != nil {
+			limits := limitsFor(quotas, "tenant", id)
+			if store.Quota > 0 {
+				limits.Records = int64(store.Quota)
+			}
+			subjects = append(subjects, quotaSubject{kind: "tenant", id: id, limits: limits, store: store})
+		}
+	}
+	if keyID != "" && keyID != strings.SplitN(q.fishes.config().ReplicationKey, "=", 2)[0] {
+		subjects = append(subjects, quotaSubject{kind: "key", id: keyID, limits: limitsFor(quotas, "key", keyID)})
+	}
+	return subjects
+}
+
+// resetsAt is when the daily counts start over.
+func (q *quotaTracker) resetsAt(now time.Time) time.Time {
+	y, m, d := now.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+// count adds a request to those of the day of each subject, unless one of
+// them is out of requests, which it returns without counting any.
+func (q *quotaTracker) count(now time.Time, subjects []quotaSubject) (exceeded *quotaSubject, remaining int64) {
+	day := now.UTC().Format("2006-01-02")
+	q.Lock()
+	defer q.Unlock()
+	if day != q.day {
+		q.day, q.requests = day, map[string]int64{}
+	}
+	remaining = -1
+	for i, s := range subjects {
+		if limit := s.limits.RequestsPerDay; limit > 0 {
+			left := limit - q.requests[s.name()]
+			if left <= 0 {
+				return &subjects[i], 0
+			}
+			if remaining < 0 || left-1 < remaining {
+				remaining = left - 1
+			}
+		}
+	}
+	for _, s := range subjects {
+		q.requests[s.name()]++
+	}
+	return nil, remaining
+}
+
+func (q *quotaTracker) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The admin portal checks its own credentials and has no quotas.
+		if strings.HasPrefix(r.URL.Path, "/admin") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r, keyID, err := q.fishes.withSignatureCheck(r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		subjects := q.subjects(r, keyID)
+		r = r.WithContext(context.WithValue(r.Context(), quotaSubjectsKey, subjects))
+		_, _, path := tenantOf(r)
+		if len(subjects) == 0 || path == "/usage" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := q.fishes.clock.Now()
+		resets := q.resetsAt(now)
+		exceeded, remaining := q.count(now, subjects)
+		if exceeded != nil || remaining >= 0 {
+			limit := int64(0)
+			for _, s := range subjects {
+				if l := s.limits.RequestsPerDay; l > 0 && (limit == 0 || l < limit) {
+					limit = l
+				}
+			}
+			w.Header().Set("X-Quota-Limit", strconv.FormatInt(limit, 10))
+			w.Header().Set("X-Quota-Remaining", strconv.FormatInt(remaining, 10))
+			w.Header().Set("X-Quota-Reset", strconv.FormatInt(resets.Unix(), 10))
+		}
+		if exceeded != nil {
+			w.Header().Set("X-Quota-Exceeded", "requests_per_day")
+			w.Header().Set("Retry-After", strconv.Itoa(int(resets.Sub(now).Seconds())+1))
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(fmt.Sprintf("%s has made its %d requests of the day", exceeded.name(), exceeded.limits.RequestsPerDay)))
+			return
+		}
+		if r.Method == "POST" || r.Method == "PUT" || r.Method == "PATCH" {
+			for _, s := range subjects {
+				if s.store != nil && s.limits.StorageBytes > 0 && s.store.h.storageBytes() >= s.limits.StorageBytes {
+					w.Header().Set("X-Quota-Exceeded", "storage_bytes")
+					w.WriteHeader(http.StatusForbidden)
+					w.Write([]byte(fmt.Sprintf("%s holds its %d bytes of fishes, delete some before writing more", s.name(), s.limits.StorageBytes)))
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type quotaUsage struct {
+	Subject         string      `json:"subject"`
+	Limits          quotaLimits `json:"limits"`
+	RequestsToday   int64       `json:"requests_today"`
+	Records         *int64      `json:"records,omitempty"`
+	StorageBytes    *int64      `json:"storage_bytes,omitempty"`
+	RequestsResetAt time.Time   `json:"requests_reset_at"`
+}
+
+// usage serves /usage, the usage and limits of the tenant and key of the
+// request.
+func (q *quotaTracker) usage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	subjects, _ := r.Context().Value(quotaSubjectsKey).([]quotaSubject)
+	if len(subjects) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("usage is kept for tenants and API keys: send X-Fish-Tenant, use /t/{tenant}/usage or sign the request"))
+		return
+	}
+	now := q.fishes.clock.Now()
+	day := now.UTC().Format("2006-01-02")
+	usage := make([]quotaUsage, 0, len(subjects))
+	for _, s := range subjects {
+		u := quotaUsage{Subject: s.name(), Limits: s.limits, RequestsResetAt: q.resetsAt(now)}
+		q.Lock()
+		if q.day == day {
+			u.RequestsToday = q.requests[s.name()]
+		}
+		q.Unlock()
+		if s.store != nil {
+			s.store.h.Lock()
+			records := int64(len(s.store.h.db))
+			s.store.h.Unlock()
+			storage := s.store.h.storageBytes()
+			u.Records, u.StorageBytes = &records, &storage
+		}
+		usage = append(usage, u)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Subject < usage[j].Subject })
+	writeJSON(w, http.StatusOK, usage)
+}
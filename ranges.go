@@ -0,0 +1,80 @@
+package fishes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// itemsUnit is the range unit of the lists, as in Range: items=0-49.
+const itemsUnit = "items"
+
+// itemRange is an items=first-last range of a list; last is -1 for a range
+// running to the end of the list.
+type itemRange struct {
+	first, last int
+}
+
+// requestedItems reads the items range of r. ok is false without a Range in
+// items, another unit being ignored, and when an If-Range no longer matches
+// the list, which is then answered whole. An error means a range that is not
+// a single first-last or first- one.
+func requestedItems(r *http.Request, etag string, modified time.Time) (rng itemRange, ok bool, err error) {
+	header := strings.TrimSpace(r.Header.Get("Range"))
+	spec := strings.TrimPrefix(header, itemsUnit+"=")
+	if spec == header {
+		return rng, false, nil
+	}
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && !ifRangeMatches(ifRange, etag, modified) {
+		return rng, false, nil
+	}
+
+	bounds := strings.SplitN(strings.TrimSpace(spec), "-", 2)
+	if len(bounds) != 2 || strings.Contains(spec, ",") {
+		return rng, false, fmt.Errorf("range must be a single items=first-last or items=first-")
+	}
+	if rng.first, err = strconv.Atoi(bounds[0]); err != nil || rng.first < 0 {
+		return rng, false, fmt.Errorf("range must be a single items=first-last or items=first-")
+	}
+	rng.last = -1
+	if bounds[1] != "" {
+		if rng.last, err = strconv.Atoi(bounds[1]); err != nil || rng.last < rng.first {
+			return rng, false, fmt.Errorf("the last item of a range cannot come before its first")
+		}
+	}
+	return rng, true, nil
+}
+
+// ifRangeMatches compares an If-Range to the ETag of the list, strongly, or
+// to its Last-Modified.
+func ifRangeMatches(ifRange, etag string, modified time.Time) bool {
+	if strings.HasPrefix(ifRange, `"`) {
+		return ifRange == etag
+	}
+	at, err := http.ParseTime(ifRange)
+	return err == nil && !modified.IsZero() && modified.Truncate(time.Second).Equal(at)
+}
+
+// page gives the limit and offset of the range over total items, at most
+// maxLimit of them.
+func (rng itemRange) page(total, maxLimit int) (limit, offset int) {
+	last := rng.last
+	if last < 0 || last >= total {
+		last = total - 1
+	}
+	limit = last - rng.first + 1
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	return limit, rng.first
+}
+
+// writeRangeNotSatisfiable answers a range starting past the end of a list
+// of total items.
+func writeRangeNotSatisfiable(w http.ResponseWriter, total int, message string) {
+	w.Header().Set("Content-Range", fmt.Sprintf("%s */%d", itemsUnit, total))
+	w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+	w.Write([]byte(message))
+}
@@ -0,0 +1,101 @@
+package fishes
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxRecordedBody is how much of a request body is recorded; longer ones
+// are cut and marked truncated.
+const maxRecordedBody = 1 << 20
+
+// unrecordedHeaders are not written to the recording, which is easier to
+// pass around without credentials in it. The replay sends its own.
+var unrecordedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// recordedRequest is one line of a recording, read by cmd/fishreplay.
+type recordedRequest struct {
+	At        time.Time   `json:"at"`
+	Method    string      `json:"method"`
+	URI       string      `json:"uri"`
+	Host      string      `json:"host"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// recorder appends every request the server receives to record_file as a
+// JSON line, for cmd/fishreplay to send to another instance.
+type recorder struct {
+	sync.Mutex
+	file *os.File
+}
+
+func newRecorder(path string) (*recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{file: file}, nil
+}
+
+func (rec *recorder) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := recordedRequest{At: time.Now().UTC(), Method: r.Method, URI: r.RequestURI, Host: r.Host, Header: r.Header.Clone()}
+		for _, name := range unrecordedHeaders {
+			entry.Header.Del(name)
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRecordedBody+1))
+			if len(body) > maxRecordedBody {
+				entry.Body, entry.Truncated = body[:maxRecordedBody], true
+			} else {
+				entry.Body = body
+			}
+			// The handler reads the body as if nothing had, the error of a
+			// broken one included.
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), errReader{err}, r.Body), r.Body}
+		}
+		rec.write(entry)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (rec *recorder) write(entry recordedRequest) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("recording %s %s: %s", entry.Method, entry.URI, err)
+		return
+	}
+	rec.Lock()
+	defer rec.Unlock()
+	if _, err := rec.file.Write(append(line, '\n')); err != nil {
+		log.Printf("recording %s %s: %s", entry.Method, entry.URI, err)
+	}
+}
+
+func (rec *recorder) close() error {
+	rec.Lock()
+	defer rec.Unlock()
+	return rec.file.Close()
+}
+
+// errReader returns err once it is reached, or io.EOF when err is nil.
+type errReader struct{ err error }
+
+func (e errReader) Read([]byte) (int, error) {
+	if e.err == nil {
+		return 0, io.EOF
+	}
+	return 0, e.err
+}
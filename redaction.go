@@ -0,0 +1,357 @@
+package fishes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// redactionsFileName holds the redaction policies set on /admin/redactions.
+const redactionsFileName = "redactions.json"
+
+// parseAPIKeyRoles reads api_key_roles entries, id=role, a key taking every
+// role it is listed with, keyed by key id.
+func parseAPIKeyRoles(entries []string, keys map[string]string) (map[string][]string, error) {
+	roles := map[string][]string{}
+	for _, entry := range entries {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || !tenantIDPattern.MatchString(kv[1]) {
+			return nil, fmt.Errorf("invalid api_key_roles entry '%s', expected id=role, the role in lowercase letters, digits and dashes", entry)
+		}
+		if _, ok := keys[kv[0]]; !ok {
+			return nil, fmt.Errorf("api_key_roles: there is no API key '%s'", kv[0])
+		}
+		roles[kv[0]] = append(roles[kv[0]], kv[1])
+	}
+	return roles, nil
+}
+
+// fishFieldIndexes are the Fish fields by JSON name.
+var fishFieldIndexes = func() map[string]int {
+	indexes := map[string]int{}
+	t := reflect.TypeOf(Fish{})
+	for i := 0; i < t.NumField(); i++ {
+		indexes[strings.Split(t.Field(i).Tag.Get("json"), ",")[0]] = i
+	}
+	return indexes
+}()
+
+// redactionPolicy hides fields of the fishes from the clients signing with
+// some API keys, or with keys of some roles; a key of * is every client.
+// Fields are named as in the JSON of a fish, extensions.<name> for a custom
+// field.
+type redactionPolicy struct {
+	Name   string   `json:"name"`
+	Fields []string `json:"fields"`
+	Keys   []string `json:"keys,omitempty"`
+	Roles  []string `json:"roles,omitempty"`
+}
+
+func (p redactionPolicy) check() error {
+	if !tenantIDPattern.MatchString(p.Name) {
+		return fmt.Errorf("name must be 1 to 63 lowercase letters, digits and dashes, starting and ending with a letter or digit")
+	}
+	if len(p.Fields) == 0 {
+		return fmt.Errorf("a policy hides at least one field")
+	}
+	for _, field := range p.Fields {
+		if custom := strings.TrimPrefix(field, "extensions."); custom != field {
+			if !customFieldPattern.MatchString(custom) {
+				return fmt.Errorf("'%s' does not name a custom field", field)
+			}
+			continue
+		}
+		if _, ok := fishFieldIndexes[field]; !ok || field == "id" {
+			return fmt.Errorf("'%s' is not a field of a fish that can be hidden", field)
+		}
+	}
+	if len(p.Keys) == 0 && len(p.Roles) == 0 {
+		return fmt.Errorf("a policy applies to keys or roles, * as the key for every client")
+	}
+	return nil
+}
+
+func (p redactionPolicy) appliesTo(keyID string, roles []string) bool {
+	for _, key := range p.Keys {
+		if key == "*" || (key == keyID && keyID != "") {
+			return true
+		}
+	}
+	for _, role := range p.Roles {
+		for _, held := range roles {
+			if role == held {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redactionSet is the redaction policies of the server, applied to every
+// store as the fishes are serialized for a request. Admin credentials see
+// every field.
+type redactionSet struct {
+	fishes *fishesHandler
+
+	sync.Mutex
+	policies map[string]redactionPolicy
+}
+
+func newRedactionSet(h *fishesHandler) *redactionSet {
+	return &redactionSet{fishes: h, policies: map[string]redactionPolicy{}}
+}
+
+// load reads the policies saved before the restart.
+func (s *redactionSet) load() error {
+	dataDir := s.fishes.config().DataDir
+	if dataDir == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, redactionsFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []redactionPolicy
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("%s: %s", redactionsFileName, err)
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, p := range saved {
+		s.policies[p.Name] = p
+	}
+	return nil
+}
+
+// save writes the policies to data_dir. Callers must hold the lock.
+func (s *redactionSet) save() error {
+	dataDir := s.fishes.config().DataDir
+	if dataDir == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dataDir, redactionsFileName), data)
+}
+
+// list gives the policies by name. Callers must hold the lock.
+func (s *redactionSet) list() []redactionPolicy {
+	policies := make([]redactionPolicy, 0, len(s.policies))
+	for _, p := range s.policies {
+		policies = append(policies, p)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Name < policies[j].Name })
+	return policies
+}
+
+// hidden gives the fields the policies hide from r, nil when none do.
+func (s *redactionSet) hidden(r *http.Request) map[string]bool {
+	if s == nil {
+		return nil
+	}
+	cfg := s.fishes.config()
+	if adminCredentials(r, cfg.AdminPassword) {
+		return nil
+	}
+	keyID := ""
+	if check, ok := r.Context().Value(signatureCheckKey).(*signatureCheck); ok && check.err == nil {
+		keyID = check.credential
+	}
+	keys, _ := parseAPIKeys(cfg.APIKeys)
+	roles, _ := parseAPIKeyRoles(cfg.APIKeyRoles, keys)
+
+	s.Lock()
+	defer s.Unlock()
+	var hidden map[string]bool
+	for _, p := range s.policies {
+		if !p.appliesTo(keyID, roles[keyID]) {
+			continue
+		}
+		if hidden == nil {
+			hidden = map[string]bool{}
+		}
+		for _, field := range p.Fields {
+			hidden[field] = true
+		}
+	}
+	return hidden
+}
+
+// hideFields gives f without the hidden fields, which its JSON then leaves
+// out; the extensions of f are copied, not changed.
+func hideFields(f Fish, hidden map[string]bool) Fish {
+	v := reflect.ValueOf(&f).Elem()
+	var ext Extensions
+	for field := range hidden {
+		if custom := strings.TrimPrefix(field, "extensions."); custom != field {
+			if _, ok := f.Extensions[custom]; !ok {
+				continue
+			}
+			if ext == nil {
+				ext = make(Extensions, len(f.Extensions))
+				for name, value := range f.Extensions {
+					ext[name] = value
+				}
+			}
+			delete(ext, custom)
+			continue
+		}
+		fv := v.Field(fishFieldIndexes[field])
+		fv.Set(reflect.Zero(fv.Type()))
+	}
+	if ext != nil {
+		f.Extensions = ext
+		if len(ext) == 0 {
+			f.Extensions = nil
+		}
+	}
+	return f
+}
+
+// visibleFishes takes out of fishes what r may not see: the sensitive fields
+// without admin credentials or a signature, and the fields the redaction
+// policies hide from it. Every list of fishes answered goes through it.
+func (h *fishesHandler) visibleFishes(r *http.Request, fishes []Fish) {
+	if !h.revealSensitive(r) {
+		redactFishes(fishes)
+	}
+	if hidden := h.redactions.hidden(r); hidden != nil {
+		for i := range fishes {
+			fishes[i] = hideFields(fishes[i], hidden)
+		}
+	}
+}
+
+// serve lists and creates the policies on /admin/redactions, and shows,
+// replaces or deletes one on /admin/redactions/{name}.
+func (s *redactionSet) serve(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/redactions"), "/")
+	if name == "" {
+		switch r.Method {
+		case "GET":
+			s.Lock()
+			policies := s.list()
+			s.Unlock()
+			writeJSON(w, http.StatusOK, policies)
+		case "POST":
+			p, ok := readRedactionPolicy(w, r)
+			if !ok {
+				return
+			}
+			s.Lock()
+			if _, ok := s.policies[p.Name]; ok {
+				s.Unlock()
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(fmt.Sprintf("redaction policy '%s' already exists", p.Name)))
+				return
+			}
+			s.change(w, p.Name, &p, http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("method not allowed"))
+		}
+		return
+	}
+
+	s.Lock()
+	p, ok := s.policies[name]
+	s.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("there is no redaction policy '%s'", name)))
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, p)
+	case "PUT":
+		p, ok := readRedactionPolicy(w, r)
+		if !ok {
+			return
+		}
+		if p.Name != name {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte("the name of a policy cannot be changed"))
+			return
+		}
+		s.Lock()
+		s.change(w, name, &p, http.StatusOK)
+	case "DELETE":
+		s.Lock()
+		s.change(w, name, nil, http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+	}
+}
+
+// change sets the policy name to p, or deletes it for a nil p, and answers
+// with status. Callers must hold the lock, which change releases.
+func (s *redactionSet) change(w http.ResponseWriter, name string, p *redactionPolicy, status int) {
+	prev, existed := s.policies[name]
+	if p == nil {
+		delete(s.policies, name)
+	} else {
+		s.policies[name] = *p
+	}
+	err := s.save()
+	if err != nil {
+		if existed {
+			s.policies[name] = prev
+		} else {
+			delete(s.policies, name)
+		}
+	}
+	s.Unlock()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	// Cached lists may show what the policy now hides; those of the other
+	// stores than the main one expire within their TTL.
+	s.fishes.cache.invalidate("fishes")
+
+	if p == nil {
+		log.Printf("deleted redaction policy %s", name)
+		w.WriteHeader(status)
+		return
+	}
+	log.Printf("redaction policy %s hides %s", name, strings.Join(p.Fields, ", "))
+	if status == http.StatusCreated {
+		w.Header().Set("Location", "/admin/redactions/"+name)
+	}
+	writeJSON(w, status, p)
+}
+
+func readRedactionPolicy(w http.ResponseWriter, r *http.Request) (redactionPolicy, bool) {
+	var p redactionPolicy
+	body, ok := readJSONBody(w, r)
+	if !ok {
+		return p, false
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return p, false
+	}
+	if err := p.check(); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(err.Error()))
+		return p, false
+	}
+	return p, true
+}
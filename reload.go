@@ -0,0 +1,209 @@
+package fishes
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+)
+
+var restartOnlySettings = map[string]bool{
+	"addr":             true,
+	"listen":           true,
+	"max_header_bytes": true,
+	"idle_timeout":     true,
+
+	"trusted_proxies":     true,
+	"hosts":               true,
+	"node_id":             true,
+	"id_generator":        true,
+	"data_dir":            true,
+	"encryption_key":      true,
+	"encryption_key_file": true,
+	"job_schedules":       true,
+	"async_workers":       true,
+	"async_queue":         true,
+	"replica_of":          true,
+	"peers":               true,
+	"advertise_url":       true,
+	"election_timeout":    true,
+	"sync_peers":          true,
+	"cluster_mode":        true,
+	"seeds":               true,
+	"gossip_interval":     true,
+	"partition_vnodes":    true,
+	"mirror_to":           true,
+	"rpc_listen":          true,
+	"record_file":         true,
+	"mock_scenario":       true,
+	"mqtt_broker":         true,
+	"mqtt_client_id":      true,
+
+	"metrics_remote_write_url": true,
+	"slo_window":               true,
+	"shadow_url":               true,
+
+	"backup_dir":      true,
+	"backup_interval": true,
+	"backup_retain":   true,
+	"backup_max_age":  true,
+
+	"backup_s3_endpoint":   true,
+	"backup_s3_bucket":     true,
+	"backup_s3_prefix":     true,
+	"backup_s3_region":     true,
+	"backup_s3_access_key": true,
+	"backup_s3_secret_key": true,
+
+	"report_dir":    true,
+	"report_retain": true,
+
+	"tls_cert":          true,
+	"tls_key":           true,
+	"tls_reload":        true,
+	"tls_redirect_addr": true,
+
+	"acme_domain":    true,
+	"acme_email":     true,
+	"acme_directory": true,
+	"acme_cache_dir": true,
+}
+
+func watchReload(reload func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		reload()
+	}
+}
+
+func diffConfig(old, updated *Config) []string {
+	var changes []string
+	oldFields := configFields(old)
+	for i, f := range configFields(updated) {
+		before, after := fmt.Sprint(oldFields[i].display()), fmt.Sprint(f.display())
+		if f.secret && !oldFields[i].value.IsZero() {
+			before, after = "******", "******"
+			if !reflect.DeepEqual(oldFields[i].value.Interface(), f.value.Interface()) {
+				after = "****** (changed)"
+			}
+		}
+		if before == after {
+			continue
+		}
+
+		change := fmt.Sprintf("%s: %s -> %s", f.key, before, after)
+		if restartOnlySettings[f.key] {
+			change += " (requires restart, ignored)"
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+func diffSnapshots(old, updated *snapshot) (added, removed, changed int) {
+	before := make(map[string]Fish, len(old.Fishes))
+	for _, fish := range old.Fishes {
+		before[fish.ID] = fish
+	}
+	for _, fish := range updated.Fishes {
+		prev, ok := before[fish.ID]
+		if !ok {
+			added++
+		} else if !reflect.DeepEqual(prev, fish) {
+			changed++
+		}
+		delete(before, fish.ID)
+	}
+	return added, len(before), changed
+}
+
+// keepRestartOnly gives next the restart-only settings of current, which a
+// reload leaves as the server started with.
+func keepRestartOnly(current, next *Config) {
+	currentFields := configFields(current)
+	for i, f := range configFields(next) {
+		if restartOnlySettings[f.key] {
+			f.value.Set(currentFields[i].value)
+		}
+	}
+}
+
+// applyConfig swaps in the reloadable settings of loaded.
+func applyConfig(h *fishesHandler, server *gracefulServer, loaded *Config) {
+	next := *loaded
+	keepRestartOnly(h.config(), &next)
+
+	h.idempotency.setTTL(next.IdempotencyTTL)
+	server.setDrainTimeout(next.DrainTimeout)
+	h.settings.Store(&next)
+	h.cache.invalidate("fishes")
+	h.cache.invalidate("environments")
+}
+
+// reload re-reads the config file and data snapshot. Reloadable settings
+// and data are swapped in atomically; requests in flight finish against the
+// state they started with.
+func reload(h *fishesHandler, p *persister, server *gracefulServer) {
+	log.Printf("received SIGHUP, reloading")
+
+	current := h.config()
+	loaded, err := loadConfig(os.Args[1:], os.Getenv)
+	if err == nil {
+		err = loaded.validate()
+	}
+	if err != nil {
+		log.Printf("config reload failed, keeping current config: %s", err)
+	} else {
+		for _, change := range diffConfig(current, loaded.Config) {
+			log.Printf("config changed: %s", change)
+		}
+		applyConfig(h, server, loaded.Config)
+	}
+
+	if p != nil {
+		reloadData(h, p)
+	}
+}
+
+// reloadData swaps in the data snapshot on disk. While there are writes the
+// persister has not flushed yet the snapshot is older than the data served,
+// so the reload is refused rather than dropping them; send SIGHUP again once
+// they are flushed.
+func reloadData(h *fishesHandler, p *persister) {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	snap, err := readSnapshot(p.path, h.keys)
+	if err == nil && (len(snap.corrupt) > 0 || !snap.checksumOK) {
+		err = fmt.Errorf("%s failed its integrity check, see /admin/integrity", p.path)
+	}
+	if err != nil {
+		log.Printf("data reload failed, keeping current data: %s", err)
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if h.dirty {
+		log.Printf("data reload skipped, keeping current data: there are changes not yet flushed to %s", p.path)
+		return
+	}
+	added, removed, changed := diffSnapshots(h.snapshot(), snap)
+	if err := h.restore(snap); err != nil {
+		log.Printf("data reload failed, keeping current data: %s", err)
+		return
+	}
+	if h.oplog != nil {
+		full, err := h.fullSnapshot()
+		if err == nil {
+			err = h.oplog.reset(full)
+		}
+		if err != nil {
+			log.Printf("recording the data reload in the operation log failed: %s", err)
+		}
+	}
+	log.Printf("data reloaded from %s: %d added, %d removed, %d changed", p.path, added, removed, changed)
+}
@@ -0,0 +1,111 @@
+package fishes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A reload that names peers leaves the server a single primary until it is
+// restarted, so its tenants are still served.
+func TestReloadKeepsRestartOnlySettings(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AdminPassword = "test"
+	cfg.DataDir = ""
+	ids, err := newIDGenerator(cfg.IDGenerator, cfg.NodeID, systemClock{}, systemRand{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newFishesHander(cfg, ids, newResponseCache())
+	if h.keys, err = newKeyring(cfg); err != nil {
+		t.Fatal(err)
+	}
+	tenants := newTenantRouter(h, newFeatureFlags(h))
+	routes := tenants.wrap(http.NotFoundHandler())
+
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "http://fishes/admin/tenants", strings.NewReader(`{"id":"acme"}`))
+	req.Header.Set("Content-Type", "application/json")
+	tenants.serve(res, req)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("creating the tenant: %d %s", res.Code, res.Body)
+	}
+
+	reloaded := *cfg
+	reloaded.Peers = []string{"http://10.0.0.2:8080"}
+	reloaded.ClusterMode = clusterModeElection
+	reloaded.IdempotencyTTL = 3 * time.Minute
+	applyConfig(h, &gracefulServer{}, &reloaded)
+
+	if got := h.config(); len(got.Peers) != 0 || got.ClusterMode != "" {
+		t.Errorf("peers and cluster_mode were applied without a restart: %v %q", got.Peers, got.ClusterMode)
+	}
+	if got := h.config().IdempotencyTTL; got != 3*time.Minute {
+		t.Errorf("idempotency_ttl is %s after the reload, want 3m", got)
+	}
+
+	res = httptest.NewRecorder()
+	routes.ServeHTTP(res, httptest.NewRequest("GET", "http://fishes/t/acme/fishes", nil))
+	if res.Code != http.StatusOK {
+		t.Errorf("GET /t/acme/fishes after the reload: %d %s", res.Code, res.Body)
+	}
+}
+
+// A SIGHUP before the snapshot job has run leaves the unflushed writes
+// alone; once they are flushed the snapshot on disk is swapped in.
+func TestReloadDataKeepsUnflushedWrites(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		flush bool
+		want  []string
+	}{
+		{"unflushed", false, []string{"Nemo"}},
+		{"flushed", true, []string{"Dory"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestFishes(t, systemClock{}, systemRand{})
+			p, err := newPersister(t.TempDir(), h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.Lock()
+			_, err = h.put(Fish{ID: "1", Name: "Nemo"})
+			h.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.flush {
+				if err := p.flush(); err != nil {
+					t.Fatal(err)
+				}
+				// The file is replaced out of band, as an operator restoring
+				// a backup would.
+				other := newTestFishes(t, systemClock{}, systemRand{})
+				other.Lock()
+				if _, err := other.put(Fish{ID: "2", Name: "Dory"}); err != nil {
+					t.Fatal(err)
+				}
+				edited := other.snapshot()
+				other.Unlock()
+				if err := writeSnapshot(p.path, edited, h.keys); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			reloadData(h, p)
+
+			h.Lock()
+			defer h.Unlock()
+			var got []string
+			for _, fish := range h.snapshot().Fishes {
+				got = append(got, fish.Name)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("fishes after the reload: %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
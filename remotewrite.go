@@ -0,0 +1,235 @@
+package fishes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRemoteWriteBatches is how many unsent samplings are kept while the
+// endpoint is down; older ones are dropped.
+const maxRemoteWriteBatches = 60
+
+// remoteSampling is every metric read at one time.
+type remoteSampling struct {
+	at      time.Time
+	samples []metricSample
+}
+
+// remoteWriter pushes the metrics to metrics_remote_write_url in the
+// Prometheus remote-write format, for setups nothing scrapes /metrics in.
+// The metrics are read on every metrics_remote_write_interval and sent
+// with the samplings a failed push left behind.
+type remoteWriter struct {
+	fishes *fishesHandler
+	client *http.Client
+	labels [][2]string
+
+	sync.Mutex
+	pending []remoteSampling
+	dropped int
+}
+
+func newRemoteWriter(h *fishesHandler) *remoteWriter {
+	cfg := h.config()
+	instance := cfg.AdvertiseURL
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	return &remoteWriter{
+		fishes: h,
+		client: &http.Client{Timeout: 30 * time.Second},
+		labels: [][2]string{{"instance", instance}, {"job", "fishes"}},
+	}
+}
+
+func (w *remoteWriter) pushNow() error {
+	sampling := remoteSampling{at: time.Now(), samples: metrics.samples()}
+	w.Lock()
+	w.pending = append(w.pending, sampling)
+	if n := len(w.pending) - maxRemoteWriteBatches; n > 0 {
+		w.pending = w.pending[n:]
+		w.dropped += n
+		log.Printf("metrics remote write: dropped %d samplings the endpoint did not take", w.dropped)
+	}
+	pending := w.pending
+	w.Unlock()
+
+	retry, err := w.send(pending)
+	w.Lock()
+	defer w.Unlock()
+	if err == nil || !retry {
+		// Sent, or refused for good, which sending again cannot change.
+		w.pending = w.pending[len(pending):]
+		w.dropped = 0
+	}
+	return err
+}
+
+// send posts samplings as one WriteRequest. retry tells whether a failure
+// is worth trying again: a network error, a 429 or a 5xx.
+func (w *remoteWriter) send(samplings []remoteSampling) (retry bool, err error) {
+	cfg := w.fishes.config()
+	body := snappyEncode(w.writeRequest(samplings))
+	req, err := http.NewRequest("POST", cfg.RemoteWriteURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "fishes")
+	if cfg.RemoteWriteToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.RemoteWriteToken)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	answer, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	err = fmt.Errorf("%s answered %s: %s", req.URL.Redacted(), resp.Status, strings.TrimSpace(string(answer)))
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+// writeRequest encodes the prometheus.WriteRequest message: a TimeSeries
+// per series, with its labels sorted by name and its samples in time order.
+func (w *remoteWriter) writeRequest(samplings []remoteSampling) []byte {
+	type series struct {
+		labels [][2]string
+		times  []int64
+		values []float64
+	}
+	bySeries := map[string]*series{}
+	var keys []string
+	for _, sampling := range samplings {
+		ms := sampling.at.UnixNano() / int64(time.Millisecond)
+		for _, sample := range sampling.samples {
+			labels := append([][2]string{{"__name__", sample.name}}, w.labels...)
+			labels = append(labels, sample.labels...)
+			sort.SliceStable(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+			var key strings.Builder
+			for _, l := range labels {
+				key.WriteString(l[0] + "\xff" + l[1] + "\xff")
+			}
+			s, ok := bySeries[key.String()]
+			if !ok {
+				s = &series{labels: labels}
+				bySeries[key.String()] = s
+				keys = append(keys, key.String())
+			}
+			s.times = append(s.times, ms)
+			s.values = append(s.values, sample.value)
+		}
+	}
+	sort.Strings(keys)
+
+	var req protoBuffer
+	for _, key := range keys {
+		s := bySeries[key]
+		var ts protoBuffer
+		for i, l := range s.labels {
+			// A label of the sample replaces an external one of the same
+			// name, which sorts before it.
+			if i+1 < len(s.labels) && s.labels[i+1][0] == l[0] {
+				continue
+			}
+			var label protoBuffer
+			label.str(1, l[0])
+			label.str(2, l[1])
+			ts.bytes(1, label.Bytes())
+		}
+		for i := range s.times {
+			var sample protoBuffer
+			sample.double(1, s.values[i])
+			sample.int(2, s.times[i])
+			ts.bytes(2, sample.Bytes())
+		}
+		req.bytes(1, ts.Bytes())
+	}
+	return req.Bytes()
+}
+
+// snappyEncode compresses src in the snappy block format remote write
+// expects, matching four bytes at a time within 64KiB blocks.
+func snappyEncode(src []byte) []byte {
+	var dst bytes.Buffer
+	var n [binary.MaxVarintLen64]byte
+	dst.Write(n[:binary.PutUvarint(n[:], uint64(len(src)))])
+	for len(src) > 0 {
+		block := src
+		if len(block) > 1<<16 {
+			block = block[:1<<16]
+		}
+		snappyBlock(&dst, block)
+		src = src[len(block):]
+	}
+	return dst.Bytes()
+}
+
+func snappyBlock(dst *bytes.Buffer, src []byte) {
+	var table [1 << 14]int32
+	hash := func(i int) uint32 {
+		return (binary.LittleEndian.Uint32(src[i:]) * 0x1e35a7bd) >> 18
+	}
+	literal := 0
+	for i := 0; i+4 <= len(src); {
+		h := hash(i)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != binary.LittleEndian.Uint32(src[i:]) {
+			i++
+			continue
+		}
+		snappyLiteral(dst, src[literal:i])
+		length := 4
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		offset := i - candidate
+		for remaining := length; remaining > 0; {
+			chunk := remaining
+			if chunk > 64 {
+				chunk = 64
+			}
+			dst.WriteByte(byte(chunk-1)<<2 | 2)
+			dst.WriteByte(byte(offset))
+			dst.WriteByte(byte(offset >> 8))
+			remaining -= chunk
+		}
+		i += length
+		literal = i
+	}
+	snappyLiteral(dst, src[literal:])
+}
+
+func snappyLiteral(dst *bytes.Buffer, lit []byte) {
+	if len(lit) == 0 {
+		return
+	}
+	switch n := len(lit) - 1; {
+	case n < 60:
+		dst.WriteByte(byte(n) << 2)
+	case n < 1<<8:
+		dst.WriteByte(60 << 2)
+		dst.WriteByte(byte(n))
+	default:
+		dst.WriteByte(61 << 2)
+		dst.WriteByte(byte(n))
+		dst.WriteByte(byte(n >> 8))
+	}
+	dst.Write(lit)
+}
@@ -0,0 +1,640 @@
+package fishes
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxReplicationBatch = 1000
+	// replicationPollWait is how long replicas ask the primary to hold a poll
+	// open when there is nothing new.
+	replicationPollWait = 20 * time.Second
+	// replicationSnapshotTimeout bounds the download of a snapshot.
+	replicationSnapshotTimeout = 10 * time.Minute
+)
+
+var replicationFeedParams = []paramSpec{
+	{name: "after", kind: paramInt, min: 0, max: math.MaxInt32, def: "0"},
+	{name: "wait", kind: paramInt, min: 0, max: 60, def: "0"},
+}
+
+// replicationBatch is one answer of the replication feed. Epoch is the time
+// of the first entry of the operation log; when it changes the log was
+// started over and replicas must replay it from the beginning.
+type replicationBatch struct {
+	Epoch time.Time `json:"epoch"`
+	Seq   uint64    `json:"seq"`
+	Term  uint64    `json:"term,omitempty"`
+	Ops   []opEntry `json:"ops"`
+}
+
+// replicationFeed serves the operation log after the given sequence number.
+// With nothing new it waits up to wait seconds for the next write, so
+// replicas can long-poll it. Sensitive fields are sent opened.
+func (a *adminPortal) replicationFeed(w http.ResponseWriter, r *http.Request, q queryValues) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	h := a.fishes
+	h.Lock()
+	l := h.oplog
+	h.Unlock()
+	if l == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("replication needs data_dir on the primary"))
+		return
+	}
+
+	after := uint64(q.int("after"))
+	timeout := time.NewTimer(time.Duration(q.int("wait")) * time.Second)
+	defer timeout.Stop()
+	for {
+		h.Lock()
+		seq, changed := l.seq, l.changed
+		h.Unlock()
+		if seq != after {
+			break
+		}
+		select {
+		case <-changed:
+			continue
+		case <-timeout.C:
+		case <-a.draining:
+		case <-r.Context().Done():
+			return
+		}
+		break
+	}
+
+	h.Lock()
+	ops, err := l.read(r.Context())
+	h.Unlock()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	batch := replicationBatch{Ops: []opEntry{}}
+	if batch.Term, err = feedTerm(l); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if len(ops) > 0 {
+		batch.Epoch = ops[0].At
+		batch.Seq = ops[len(ops)-1].Seq
+	}
+	if after > batch.Seq {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(fmt.Sprintf("the operation log ends at seq %d, start over from /admin/replication/snapshot", batch.Seq)))
+		return
+	}
+	for _, op := range ops {
+		if op.Seq > after && len(batch.Ops) < maxReplicationBatch {
+			batch.Ops = append(batch.Ops, op)
+		}
+	}
+	writeJSON(w, http.StatusOK, batch)
+}
+
+// feedTerm is the term the feed is served in; a cluster node that no longer
+// leads refuses to serve it.
+func feedTerm(l *opLog) (uint64, error) {
+	if l.fence == nil {
+		return 0, nil
+	}
+	return l.fence()
+}
+
+// replicationSnapshot is the whole dataset as of Seq in the log of Epoch.
+type replicationSnapshot struct {
+	Epoch time.Time `json:"epoch"`
+	Seq   uint64    `json:"seq"`
+	Term  uint64    `json:"term,omitempty"`
+	Data  *snapshot `json:"data"`
+}
+
+// replicationSnapshot serves the dataset as gzipped JSON, so a new replica
+// can start from it and follow the feed after its seq instead of replaying
+// the whole log.
+func (a *adminPortal) replicationSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	h := a.fishes
+	h.Lock()
+	if h.oplog == nil {
+		h.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("replication needs data_dir on the primary"))
+		return
+	}
+	term, err := feedTerm(h.oplog)
+	if err != nil {
+		h.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	full, err := h.fullSnapshot()
+	snap := replicationSnapshot{Epoch: h.oplog.epoch, Seq: h.oplog.seq, Term: term, Data: full}
+	h.Unlock()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("content-type", "application/gzip")
+	gz := gzip.NewWriter(w)
+	if err := json.NewEncoder(gz).Encode(snap); err != nil {
+		log.Printf("sending the replication snapshot failed: %s", err)
+		return
+	}
+	if err := gz.Close(); err != nil {
+		log.Printf("sending the replication snapshot failed: %s", err)
+	}
+}
+
+// applyReplicated applies an operation from the primary's log. Callers must
+// hold the lock.
+func (h *fishesHandler) applyReplicated(op opEntry) error {
+	switch op.Op {
+	case opPut:
+		if err := h.rehydrate(op.Fish.ID); err != nil {
+			return err
+		}
+		delete(h.trash, op.Fish.ID)
+		if op.Fish.Slug != "" {
+			h.slugs[op.Fish.Slug] = op.Fish.ID
+		}
+		_, err := h.put(*op.Fish)
+		return err
+	case opDelete:
+		if err := h.rehydrate(op.Fish.ID); err != nil {
+			return err
+		}
+		return h.moveToTrash(*op.Fish)
+	case opPurge:
+		if err := h.dropFromTrash(op.ID); err != nil {
+			return err
+		}
+		h.bumpVersion()
+		h.dirty = true
+		return nil
+	case opReset:
+		return h.replaceAll(&snapshot{SchemaVersion: fishSchemaVersion, Fishes: op.Fishes, Trash: op.Trash, Slugs: op.Slugs})
+	}
+	return fmt.Errorf("unknown operation %q at seq %d", op.Op, op.Seq)
+}
+
+// replica follows a primary, given by replica_of or the cluster leader. It
+// long-polls the primary's replication feed and applies what it gets, serves
+// reads from its own copy and passes every other request on to the primary.
+type replica struct {
+	fishes    *fishesHandler
+	client    *http.Client
+	snapshots *http.Client
+	proxy     *httputil.ReverseProxy
+
+	sync.Mutex
+	primary    *url.URL
+	epoch      time.Time
+	applied    uint64
+	primarySeq uint64
+	// noSnapshot is set for primaries without a snapshot endpoint, which are
+	// replayed from the beginning instead.
+	noSnapshot bool
+	// term, set for cluster followers, is the latest term the node knows of.
+	// Batches of a primary at an earlier term are refused.
+	term func() uint64
+	// advanced is closed and replaced whenever applied moves, which wakes
+	// reads waiting for a consistency token.
+	advanced   chan struct{}
+	caughtUp   bool
+	caughtUpAt time.Time
+	polling    time.Time
+	contact    time.Time
+	lastError  string
+	// cancelPoll abandons the request to the primary under way, which
+	// setPrimary does when the primary changes.
+	cancelPoll context.CancelFunc
+}
+
+// newReplica follows primary, or nobody until setPrimary when it is empty.
+func newReplica(h *fishesHandler, primary string) *replica {
+	rep := &replica{
+		fishes:     h,
+		client:     &http.Client{Timeout: replicationPollWait + 10*time.Second},
+		snapshots:  &http.Client{Timeout: replicationSnapshotTimeout},
+		advanced:   make(chan struct{}),
+		caughtUpAt: time.Now(),
+	}
+	if primary != "" {
+		rep.setPrimary(primary)
+	}
+	return rep
+}
+
+// newReplicaOf follows the replica_of primary and forwards writes to it.
+func newReplicaOf(h *fishesHandler) (*replica, error) {
+	primary, err := url.Parse(h.config().ReplicaOf)
+	if err != nil {
+		return nil, err
+	}
+	rep := newReplica(h, "")
+	rep.primary = primary
+	proxy := httputil.NewSingleHostReverseProxy(primary)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Host = primary.Host
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("forwarding %s %s to the primary failed: %s", r.Method, r.URL.Path, err)
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("the primary could not be reached"))
+	}
+	rep.proxy = proxy
+	return rep, nil
+}
+
+// setPrimary switches to another primary; an empty one stops replicating.
+// Its log has another epoch, so the replica replays it from the start.
+func (rep *replica) setPrimary(primary string) {
+	u, err := url.Parse(primary)
+	if primary == "" || err != nil {
+		u = nil
+	}
+	rep.Lock()
+	defer rep.Unlock()
+	if u == nil || rep.primary == nil || u.String() != rep.primary.String() {
+		rep.primary = u
+		rep.caughtUp = false
+		if rep.cancelPoll != nil {
+			rep.cancelPoll()
+		}
+	}
+}
+
+// wrap forwards writes to the primary. Reads are answered locally, except
+// for /jobs/, since asynchronous writes run on the primary.
+func (rep *replica) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS") && !strings.HasPrefix(r.URL.Path, "/jobs/") {
+			if rep.awaitToken(w, r) {
+				next.ServeHTTP(w, r)
+			}
+			return
+		}
+		rep.proxy.ServeHTTP(w, r)
+	})
+}
+
+// run polls the primary until the process exits, backing off while it
+// cannot be reached.
+func (rep *replica) run() {
+	backoff := time.Second
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		rep.Lock()
+		primary := rep.primary
+		rep.cancelPoll = cancel
+		rep.Unlock()
+		if primary == nil {
+			cancel()
+			time.Sleep(250 * time.Millisecond)
+			continue
+		}
+		err := rep.poll(ctx, primary)
+		abandoned := ctx.Err() != nil
+		cancel()
+		rep.Lock()
+		rep.cancelPoll = nil
+		rep.Unlock()
+		if abandoned {
+			// The primary changed while it was polled.
+			continue
+		}
+		if err != nil {
+			rep.Lock()
+			rep.lastError = err.Error()
+			rep.Unlock()
+			log.Printf("replication from %s failed: %s", primary, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > 30*time.Second {
+				backoff = 30 * time.Second
+			}
+			continue
+		}
+		backoff = time.Second
+	}
+}
+
+func (rep *replica) poll(ctx context.Context, primary *url.URL) error {
+	rep.Lock()
+	after, noSnapshot := rep.applied, rep.noSnapshot
+	rep.Unlock()
+	if after == 0 && !noSnapshot {
+		return rep.bootstrap(ctx, primary)
+	}
+	rep.Lock()
+	rep.polling = time.Now()
+	rep.Unlock()
+	defer func() {
+		rep.Lock()
+		rep.polling = time.Time{}
+		rep.Unlock()
+	}()
+
+	feed := *primary
+	feed.Path = strings.TrimSuffix(feed.Path, "/") + "/admin/replication"
+	feed.RawQuery = url.Values{
+		"after": {strconv.FormatUint(after, 10)},
+		"wait":  {strconv.Itoa(int(replicationPollWait / time.Second))},
+	}.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", feed.String(), nil)
+	if err != nil {
+		return err
+	}
+	if err := signPeerRequest(req, rep.fishes.config().ReplicationKey, nil); err != nil {
+		return err
+	}
+
+	resp, err := rep.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusConflict {
+		log.Printf("the primary's operation log is behind this replica, starting over")
+		rep.Lock()
+		rep.applied = 0
+		rep.Unlock()
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the primary answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var batch replicationBatch
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return err
+	}
+
+	rep.Lock()
+	defer rep.Unlock()
+	if rep.primary == nil || rep.primary.String() != primary.String() {
+		return nil
+	}
+	now := time.Now()
+	rep.contact = now
+	if !rep.epoch.IsZero() && !batch.Epoch.Equal(rep.epoch) && after > 0 {
+		log.Printf("the primary started a new operation log, starting over")
+		rep.epoch = batch.Epoch
+		rep.applied = 0
+		return nil
+	}
+	if err := rep.checkTerm(batch.Term); err != nil {
+		return err
+	}
+	rep.epoch = batch.Epoch
+	rep.primarySeq = batch.Seq
+
+	h := rep.fishes
+	h.Lock()
+	defer h.Unlock()
+	for _, op := range batch.Ops {
+		if op.Seq <= rep.applied {
+			continue
+		}
+		if err := h.replicate(op.Term, func() error { return h.applyReplicated(op) }); err != nil {
+			return fmt.Errorf("applying seq %d: %s", op.Seq, err)
+		}
+		rep.applied = op.Seq
+	}
+	if rep.applied != after {
+		rep.notifyAdvanced()
+	}
+	rep.caughtUp = rep.applied == rep.primarySeq
+	if rep.caughtUp {
+		rep.caughtUpAt = now
+	}
+	rep.lastError = ""
+	return nil
+}
+
+// checkTerm refuses data from a primary deposed by a later term, which
+// must not be applied even though it still answers.
+func (rep *replica) checkTerm(term uint64) error {
+	if rep.term == nil {
+		return nil
+	}
+	if current := rep.term(); term < current {
+		return fmt.Errorf("fenced: the primary is at term %d but the cluster is at term %d", term, current)
+	}
+	return nil
+}
+
+// notifyAdvanced wakes the reads waiting for applied to move. Callers must
+// hold the lock.
+func (rep *replica) notifyAdvanced() {
+	close(rep.advanced)
+	rep.advanced = make(chan struct{})
+}
+
+// bootstrap replaces the data with the primary's snapshot and resumes the
+// feed after its seq.
+func (rep *replica) bootstrap(ctx context.Context, primary *url.URL) error {
+	u := *primary
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/admin/replication/snapshot"
+	u.RawQuery = ""
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if err := signPeerRequest(req, rep.fishes.config().ReplicationKey, nil); err != nil {
+		return err
+	}
+	resp, err := rep.snapshots.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		log.Printf("the primary has no replication snapshot, replaying its operation log from the beginning")
+		rep.Lock()
+		rep.noSnapshot = true
+		rep.Unlock()
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("the primary answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return err
+	}
+	var snap replicationSnapshot
+	if err := json.NewDecoder(gz).Decode(&snap); err != nil {
+		return fmt.Errorf("reading the snapshot: %s", err)
+	}
+	if snap.Data == nil {
+		return errors.New("the snapshot holds no data")
+	}
+
+	rep.Lock()
+	defer rep.Unlock()
+	if rep.primary == nil || rep.primary.String() != primary.String() {
+		return nil
+	}
+	if err := rep.checkTerm(snap.Term); err != nil {
+		return err
+	}
+	h := rep.fishes
+	h.Lock()
+	err = h.replicate(snap.Term, func() error { return h.replaceAll(snap.Data) })
+	h.Unlock()
+	if err != nil {
+		return fmt.Errorf("loading the snapshot: %s", err)
+	}
+	log.Printf("loaded the primary's snapshot at seq %d with %d fishes", snap.Seq, len(snap.Data.Fishes))
+	rep.epoch = snap.Epoch
+	rep.applied = snap.Seq
+	rep.primarySeq = snap.Seq
+	rep.notifyAdvanced()
+	rep.contact = time.Now()
+	rep.caughtUp = true
+	rep.caughtUpAt = rep.contact
+	rep.lastError = ""
+	return nil
+}
+
+// signPeerRequest signs req with replication_key, an id=secret pair that
+// must be among the api_keys of the primary or peer it goes to.
+func signPeerRequest(req *http.Request, key string, body []byte) error {
+	kv := strings.SplitN(key, "=", 2)
+	if len(kv) != 2 {
+		return errors.New("replication_key must be id=secret")
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	date, nonce := time.Now().UTC().Format(time.RFC3339), hex.EncodeToString(b)
+	req.Header.Set("X-Fish-Date", date)
+	req.Header.Set("X-Fish-Nonce", nonce)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s, Signature=%s", signatureScheme, kv[0], signRequest(kv[1], req, date, nonce, body)))
+	return nil
+}
+
+// lag is how long the replica has not been known to be caught up. A poll in
+// flight that started caught up counts as caught up, since the primary
+// answers it as soon as there is a write.
+func (rep *replica) lag(now time.Time) time.Duration {
+	if rep.caughtUp && !rep.polling.IsZero() && now.Sub(rep.polling) < replicationPollWait+5*time.Second {
+		return 0
+	}
+	return now.Sub(rep.caughtUpAt)
+}
+
+type healthStatus struct {
+	Status        string     `json:"status"`
+	Role          string     `json:"role"`
+	Seq           uint64     `json:"seq"`
+	DataVersion   uint64     `json:"data_version"`
+	Term          uint64     `json:"term,omitempty"`
+	Leader        string     `json:"leader,omitempty"`
+	Primary       string     `json:"primary,omitempty"`
+	PrimarySeq    uint64     `json:"primary_seq,omitempty"`
+	LagOps        uint64     `json:"lag_ops"`
+	LagSeconds    float64    `json:"lag_seconds"`
+	LastContact   *time.Time `json:"last_contact,omitempty"`
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// healthz answers 200 while the server can serve. A replica or cluster
+// follower answers 503 when it has lagged behind the primary for longer than
+// replication_max_lag, and a cluster node when there is no leader.
+func healthz(h *fishesHandler, rep *replica, cluster *clusterNode) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, code := nodeHealth(h, rep, cluster)
+		writeJSON(w, code, status)
+	}
+}
+
+func nodeHealth(h *fishesHandler, rep *replica, cluster *clusterNode) (healthStatus, int) {
+	status := healthStatus{Status: "ok", Role: "primary"}
+	h.Lock()
+	status.DataVersion = h.version
+	if h.oplog != nil {
+		status.Seq = h.oplog.seq
+	}
+	h.Unlock()
+	if cluster != nil {
+		rep = cluster.follow
+		local := cluster.localStatus()
+		status.Term, status.Leader, status.Role = local.Term, local.Leader, local.Role
+		status.LastHeartbeat = local.LastHeardAt
+		if status.Leader == "" {
+			status.Status = "no_leader"
+			return status, http.StatusServiceUnavailable
+		}
+	}
+	if rep == nil || status.Role == roleLeader {
+		return status, http.StatusOK
+	}
+
+	now := time.Now()
+	rep.Lock()
+	if cluster == nil {
+		status.Role = "replica"
+	}
+	if rep.primary != nil {
+		status.Primary = rep.primary.String()
+	}
+	status.Seq = rep.applied
+	status.PrimarySeq = rep.primarySeq
+	if rep.primarySeq > rep.applied {
+		status.LagOps = rep.primarySeq - rep.applied
+	}
+	lag := rep.lag(now)
+	status.LagSeconds = lag.Seconds()
+	if !rep.contact.IsZero() {
+		contact := rep.contact.UTC()
+		status.LastContact = &contact
+	}
+	status.Error = rep.lastError
+	rep.Unlock()
+
+	if lag > h.config().ReplicationMaxLag {
+		status.Status = "lagging"
+		return status, http.StatusServiceUnavailable
+	}
+	return status, http.StatusOK
+}
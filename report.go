@@ -0,0 +1,572 @@
+package fishes
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	reportPrefix = "fishes-report-"
+	reportSuffix = ".json"
+
+	// reportJob is the name of the job making the weekly report, which
+	// job_schedules can move from reportSchedule.
+	reportJob      = "weekly-report"
+	reportSchedule = "0 8 * * 1"
+	reportPeriod   = 7 * 24 * time.Hour
+
+	reportTopEnvironments = 5
+	reportSMTPTimeout     = 30 * time.Second
+)
+
+var reportParams = []paramSpec{
+	{name: "format", kind: paramEnum, values: []string{"json", "csv"}, def: "json"},
+}
+
+type reportFish struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Environment string    `json:"environment"`
+	At          time.Time `json:"at"`
+}
+
+type reportEnvironment struct {
+	Environment string `json:"environment"`
+	Fishes      int    `json:"fishes"`
+	NewFishes   int    `json:"new_fishes"`
+}
+
+// weeklyReport sums up the week of the main store to To: the fishes added
+// and those deleted, from the operation log, and the environments with the
+// most fishes at To.
+type weeklyReport struct {
+	Name            string              `json:"name"`
+	From            time.Time           `json:"from"`
+	To              time.Time           `json:"to"`
+	Fishes          int                 `json:"fishes"`
+	NewFishes       []reportFish        `json:"new_fishes"`
+	Deletions       []reportFish        `json:"deletions"`
+	TopEnvironments []reportEnvironment `json:"top_environments"`
+	Recipients      []string            `json:"recipients,omitempty"`
+	DeliveredAt     *time.Time          `json:"delivered_at,omitempty"`
+	DeliveryError   string              `json:"delivery_error,omitempty"`
+}
+
+type reportInfo struct {
+	Name          string     `json:"name"`
+	From          time.Time  `json:"from"`
+	To            time.Time  `json:"to"`
+	NewFishes     int        `json:"new_fishes"`
+	Deletions     int        `json:"deletions"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+	DeliveryError string     `json:"delivery_error,omitempty"`
+}
+
+// reporter makes the weekly reports into dir, keeping the retain newest,
+// and mails them to report_recipients.
+type reporter struct {
+	sync.Mutex
+	dir    string
+	retain int
+	h      *fishesHandler
+}
+
+func newReporter(cfg *Config, h *fishesHandler) (*reporter, error) {
+	if err := os.MkdirAll(cfg.ReportDir, 0o755); err != nil {
+		return nil, err
+	}
+	return &reporter{dir: cfg.ReportDir, retain: cfg.ReportRetain, h: h}, nil
+}
+
+// summarize makes the report of the week to now.
+func (rep *reporter) summarize(ctx context.Context, now time.Time) (*weeklyReport, error) {
+	h := rep.h
+	h.Lock()
+	oplog := h.oplog
+	var fishes []Fish
+	for _, fish := range h.db {
+		fishes = append(fishes, fish)
+	}
+	var err error
+	if h.archive != nil {
+		var archived []Fish
+		archived, err = h.archive.fishes()
+		fishes = append(fishes, archived...)
+	}
+	h.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if oplog == nil {
+		return nil, errors.New("the weekly report is made from the operation log, set data_dir to enable it")
+	}
+	ops, err := oplog.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &weeklyReport{
+		Name:            reportPrefix + now.Format(backupTimeLayout) + reportSuffix,
+		From:            now.Add(-reportPeriod),
+		To:              now,
+		Fishes:          len(fishes),
+		NewFishes:       []reportFish{},
+		Deletions:       []reportFish{},
+		TopEnvironments: []reportEnvironment{},
+	}
+	environments := map[string]*reportEnvironment{}
+	environment := func(name string) *reportEnvironment {
+		env := environments[name]
+		if env == nil {
+			env = &reportEnvironment{Environment: name}
+			environments[name] = env
+		}
+		return env
+	}
+	for _, op := range ops {
+		if op.Fish == nil || op.At.Before(report.From) || op.At.After(now) {
+			continue
+		}
+		fish := reportFish{ID: op.Fish.ID, Name: op.Fish.Name, Environment: string(op.Fish.Environment), At: op.At}
+		switch {
+		case op.Op == opPut && op.Fish.Version == 1:
+			report.NewFishes = append(report.NewFishes, fish)
+			environment(fish.Environment).NewFishes++
+		case op.Op == opDelete:
+			report.Deletions = append(report.Deletions, fish)
+		}
+	}
+	for _, fish := range fishes {
+		environment(string(fish.Environment)).Fishes++
+	}
+
+	for _, env := range environments {
+		report.TopEnvironments = append(report.TopEnvironments, *env)
+	}
+	sort.Slice(report.TopEnvironments, func(i, j int) bool {
+		a, b := report.TopEnvironments[i], report.TopEnvironments[j]
+		if a.Fishes != b.Fishes {
+			return a.Fishes > b.Fishes
+		}
+		if a.NewFishes != b.NewFishes {
+			return a.NewFishes > b.NewFishes
+		}
+		return a.Environment < b.Environment
+	})
+	if len(report.TopEnvironments) > reportTopEnvironments {
+		report.TopEnvironments = report.TopEnvironments[:reportTopEnvironments]
+	}
+	return report, nil
+}
+
+// writeCSV writes the report as one table, each row in a section: new,
+// deleted or environment.
+func (r *weeklyReport) writeCSV(w *csv.Writer) error {
+	w.Write([]string{"section", "id", "name", "environment", "at", "fishes", "new_fishes"})
+	for _, fish := range r.NewFishes {
+		w.Write([]string{"new", fish.ID, fish.Name, fish.Environment, fish.At.Format(time.RFC3339), "", ""})
+	}
+	for _, fish := range r.Deletions {
+		w.Write([]string{"deleted", fish.ID, fish.Name, fish.Environment, fish.At.Format(time.RFC3339), "", ""})
+	}
+	for _, env := range r.TopEnvironments {
+		w.Write([]string{"environment", "", "", env.Environment, "", strconv.Itoa(env.Fishes), strconv.Itoa(env.NewFishes)})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func (r *weeklyReport) csvName() string {
+	return strings.TrimSuffix(r.Name, reportSuffix) + ".csv"
+}
+
+func (r *weeklyReport) subject() string {
+	return fmt.Sprintf("Fishes weekly report, %s to %s", r.From.Format("2006-01-02"), r.To.Format("2006-01-02"))
+}
+
+// reportView is what the report page shows; CSV links the download, which
+// the mail attaches instead.
+type reportView struct {
+	*weeklyReport
+	Subject string
+	CSV     string
+}
+
+// message puts the report together as a mail, the page in HTML with the
+// CSV attached.
+func (r *weeklyReport) message(from string, to []string) ([]byte, error) {
+	var page bytes.Buffer
+	if err := adminTemplates.ExecuteTemplate(&page, "report", adminView{Data: reportView{weeklyReport: r, Subject: r.subject()}}); err != nil {
+		return nil, err
+	}
+	var table bytes.Buffer
+	if err := r.writeCSV(csv.NewWriter(&table)); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	mw := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%s\r\n\r\n",
+		from, strings.Join(to, ", "), mime.QEncoding.Encode("utf-8", r.subject()), r.To.Format(time.RFC1123Z), mw.Boundary())
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	qp := quotedprintable.NewWriter(part)
+	qp.Write(page.Bytes())
+	qp.Close()
+
+	part, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType("text/csv", map[string]string{"charset": "utf-8", "name": r.csvName()})},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": r.csvName()})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(table.Bytes())
+	for len(encoded) > 76 {
+		fmt.Fprintf(part, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	fmt.Fprintf(part, "%s\r\n", encoded)
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+// sendMail hands msg to the SMTP server at addr as smtp.SendMail does, with
+// a deadline so that a server that stops answering does not hold up the
+// job.
+func sendMail(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", addr, reportSMTPTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(reportSMTPTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(msg); err != nil {
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (rep *reporter) deliver(report *weeklyReport) error {
+	cfg := rep.h.config()
+	msg, err := report.message(cfg.ReportFrom, cfg.ReportRecipients)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if cfg.ReportSMTPUsername != "" {
+		host, _, _ := net.SplitHostPort(cfg.ReportSMTPAddr)
+		auth = smtp.PlainAuth("", cfg.ReportSMTPUsername, cfg.ReportSMTPPassword, host)
+	}
+	// The envelope takes the bare addresses, the headers them with names.
+	from, err := mail.ParseAddress(cfg.ReportFrom)
+	if err != nil {
+		return err
+	}
+	var to []string
+	for _, recipient := range cfg.ReportRecipients {
+		addr, err := mail.ParseAddress(recipient)
+		if err != nil {
+			return err
+		}
+		to = append(to, addr.Address)
+	}
+	return sendMail(cfg.ReportSMTPAddr, auth, from.Address, to, msg)
+}
+
+// generate makes the report of the week to now, mails it and keeps it in
+// dir. A failed delivery is kept in the report, which is stored all the
+// same, and does not fail it.
+func (rep *reporter) generate(ctx context.Context) (*weeklyReport, error) {
+	rep.Lock()
+	defer rep.Unlock()
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	report, err := rep.summarize(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	if recipients := rep.h.config().ReportRecipients; len(recipients) > 0 {
+		report.Recipients = recipients
+		if err := rep.deliver(report); err != nil {
+			log.Printf("mailing the weekly report to %s failed: %s", strings.Join(recipients, ", "), err)
+			report.DeliveryError = err.Error()
+		} else {
+			delivered := time.Now().UTC()
+			report.DeliveredAt = &delivered
+		}
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(rep.dir, report.Name), data); err != nil {
+		return nil, err
+	}
+	return report, rep.prune()
+}
+
+// scheduled makes the report for the job, which fails when the mail did
+// not go out.
+func (rep *reporter) scheduled() error {
+	report, err := rep.generate(context.Background())
+	if err == nil && report.DeliveryError != "" {
+		err = errors.New("the report was kept but not delivered: " + report.DeliveryError)
+	}
+	return err
+}
+
+// names gives the reports in dir, newest first.
+func (rep *reporter) names() ([]string, error) {
+	entries, err := ioutil.ReadDir(rep.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if name := entry.Name(); !entry.IsDir() && strings.HasPrefix(name, reportPrefix) && strings.HasSuffix(name, reportSuffix) {
+			names = append(names, name)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names, nil
+}
+
+func (rep *reporter) prune() error {
+	names, err := rep.names()
+	if err != nil {
+		return err
+	}
+	for i := rep.retain; i < len(names); i++ {
+		if err := os.Remove(filepath.Join(rep.dir, names[i])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// load reads the report stored as name, nil when there is none.
+func (rep *reporter) load(name string) (*weeklyReport, error) {
+	if name != filepath.Base(name) || !strings.HasPrefix(name, reportPrefix) || !strings.HasSuffix(name, reportSuffix) {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(rep.dir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var report weeklyReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+func (rep *reporter) list() ([]reportInfo, error) {
+	names, err := rep.names()
+	if err != nil {
+		return nil, err
+	}
+	reports := []reportInfo{}
+	for _, name := range names {
+		report, err := rep.load(name)
+		if err != nil {
+			return nil, err
+		}
+		if report == nil {
+			continue
+		}
+		reports = append(reports, reportInfo{
+			Name:          report.Name,
+			From:          report.From,
+			To:            report.To,
+			NewFishes:     len(report.NewFishes),
+			Deletions:     len(report.Deletions),
+			DeliveredAt:   report.DeliveredAt,
+			DeliveryError: report.DeliveryError,
+		})
+	}
+	return reports, nil
+}
+
+// reports lists the weekly reports kept on GET and makes one right away on
+// POST, mailing it as the scheduled ones are. /admin/reports/{name} gives a
+// report, as CSV with format=csv and as a page to browsers.
+func (a *adminPortal) reports(w http.ResponseWriter, r *http.Request) {
+	if a.reporter == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("weekly reports are disabled, set report_dir to enable them"))
+		return
+	}
+
+	if name := strings.TrimPrefix(r.URL.Path, "/admin/reports/"); name != r.URL.Path {
+		validateQuery(reportParams, func(w http.ResponseWriter, r *http.Request, q queryValues) { a.report(w, r, q, name) })(w, r)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		reports, err := a.reporter.list()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		writeJSON(w, http.StatusOK, reports)
+	case "POST":
+		report, err := a.reporter.generate(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		writeJSON(w, http.StatusCreated, report)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+	}
+}
+
+func (a *adminPortal) report(w http.ResponseWriter, r *http.Request, q queryValues, name string) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	report, err := a.reporter.load(name)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if report == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("no report named " + name))
+		return
+	}
+
+	switch {
+	case q.str("format") == "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, report.csvName()))
+		body, finish := withChecksumTrailers(w)
+		report.writeCSV(csv.NewWriter(body))
+		finish(len(report.NewFishes) + len(report.Deletions) + len(report.TopEnvironments))
+	case strings.Contains(r.Header.Get("Accept"), "text/html"):
+		renderAdmin(w, "report", reportView{weeklyReport: report, Subject: report.subject(), CSV: "/admin/reports/" + report.Name + "?format=csv"})
+	default:
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// The report page is also the body of the mail, so it keeps its styles
+// inline.
+var reportTemplate = template.Must(adminTemplates.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>{{.Data.Subject}}</title>
+<style nonce="{{.Nonce}}">
+table { border-collapse: collapse; font-family: monospace; }
+th, td { border: 1px solid #999; padding: 4px 8px; text-align: left; }
+</style>
+</head>
+<body>
+<h1>{{.Data.Subject}}</h1>
+<p>From {{.Data.From.Format "2006-01-02 15:04 MST"}} to {{.Data.To.Format "2006-01-02 15:04 MST"}}: {{len .Data.NewFishes}} new fishes and {{len .Data.Deletions}} deleted, {{.Data.Fishes}} in the store at the end.
+{{- with .Data.CSV}} <a href="{{.}}">Download as CSV</a>{{end}}</p>
+<h2>Top environments</h2>
+<table>
+<tr><th>Environment</th><th>Fishes</th><th>New this week</th></tr>
+{{- range .Data.TopEnvironments}}
+<tr><td>{{.Environment}}</td><td>{{.Fishes}}</td><td>{{.NewFishes}}</td></tr>
+{{- end}}
+</table>
+<h2>New fishes</h2>
+{{- template "report-fishes" .Data.NewFishes}}
+<h2>Deleted fishes</h2>
+{{- template "report-fishes" .Data.Deletions}}
+</body>
+</html>
+{{- define "report-fishes"}}
+{{- if .}}
+<table>
+<tr><th>ID</th><th>Name</th><th>Environment</th><th>At</th></tr>
+{{- range .}}
+<tr><td>{{.ID}}</td><td>{{.Name}}</td><td>{{.Environment}}</td><td>{{.At.Format "2006-01-02 15:04"}}</td></tr>
+{{- end}}
+</table>
+{{- else}}
+<p>None.</p>
+{{- end}}
+{{- end}}`))
@@ -0,0 +1,234 @@
+package fishes
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signatureScheme is the Authorization scheme of signed requests:
+//
+//	Authorization: FISH-HMAC-SHA256 Credential=<key id>, Signature=<hex>
+//
+// The signature is the HMAC-SHA256, keyed by the API key's secret, of
+// requestStringToSign. X-Fish-Date and X-Fish-Nonce are required.
+const signatureScheme = "FISH-HMAC-SHA256"
+
+var errBadSignature = errors.New("request signature does not match")
+
+func parseAPIKeys(entries []string) (map[string]string, error) {
+	keys := map[string]string{}
+	for i, entry := range entries {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			// Without the '=' the entry may be all secret, so only its
+			// position is reported.
+			return nil, fmt.Errorf("api_keys entry %d is invalid, expected id=secret", i+1)
+		}
+		keys[kv[0]] = kv[1]
+	}
+	return keys, nil
+}
+
+// requestStringToSign covers the method, path, query, date, nonce and a hash
+// of the body, one per line.
+func requestStringToSign(r *http.Request, date, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return strings.Join([]string{
+		signatureScheme,
+		date,
+		nonce,
+		r.Method,
+		clientPath(r, r.URL.EscapedPath()),
+		r.URL.Query().Encode(),
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+}
+
+func signRequest(secret string, r *http.Request, date, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(requestStringToSign(r, date, nonce, body)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// requestVerifier checks signed requests. Nonces seen within the date window
+// are remembered so a captured request cannot be replayed.
+type requestVerifier struct {
+	sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+func newRequestVerifier() *requestVerifier {
+	return &requestVerifier{nonces: map[string]time.Time{}}
+}
+
+func signedAuthorization(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), signatureScheme+" ")
+}
+
+func parseSignatureHeader(header string) (credential, signature string) {
+	for _, part := range strings.Split(strings.TrimPrefix(header, signatureScheme+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "Credential":
+			credential = kv[1]
+		case "Signature":
+			signature = kv[1]
+		}
+	}
+	return credential, signature
+}
+
+// verify returns the key id that signed r at now. The body is read and put
+// back.
+func (v *requestVerifier) verify(cfg *Config, r *http.Request, now time.Time) (string, error) {
+	credential, signature := parseSignatureHeader(r.Header.Get("Authorization"))
+	if credential == "" || signature == "" {
+		return credential, errors.New("the Authorization header needs Credential and Signature")
+	}
+	keys, _ := parseAPIKeys(cfg.APIKeys)
+	secret, ok := keys[credential]
+	if !ok {
+		return credential, errBadSignature
+	}
+
+	date, nonce := r.Header.Get("X-Fish-Date"), r.Header.Get("X-Fish-Nonce")
+	if nonce == "" {
+		return credential, errors.New("signed requests need an X-Fish-Nonce header")
+	}
+	at, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return credential, errors.New("signed requests need an X-Fish-Date header in RFC 3339")
+	}
+	if skew := now.Sub(at); skew > cfg.RequestSigningWindow || skew < -cfg.RequestSigningWindow {
+		return credential, fmt.Errorf("X-Fish-Date is more than %s away from the server time", cfg.RequestSigningWindow)
+	}
+
+	var body []byte
+	if r.Body != nil {
+		if body, err = ioutil.ReadAll(io.LimitReader(r.Body, maxImportBytes+1)); err != nil {
+			return credential, err
+		}
+		if len(body) > maxImportBytes {
+			return credential, errors.New("the body is too large to sign")
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if !hmac.Equal([]byte(signature), []byte(signRequest(secret, r, date, nonce, body))) {
+		return credential, errBadSignature
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	if now.Sub(v.lastSweep) > cfg.RequestSigningWindow {
+		for seen, expires := range v.nonces {
+			if now.After(expires) {
+				delete(v.nonces, seen)
+			}
+		}
+		v.lastSweep = now
+	}
+	key := credential + "\n" + nonce
+	if _, seen := v.nonces[key]; seen {
+		return credential, errors.New("this request was already received, sign each request with a new nonce")
+	}
+	// A request is accepted while its date is within the window either side
+	// of now, so the nonce must be kept until the window has passed.
+	v.nonces[key] = at.Add(cfg.RequestSigningWindow)
+	return credential, nil
+}
+
+const signatureCheckKey contextKey = "signature-check"
+
+type signatureCheck struct {
+	credential string
+	err        error
+}
+
+// withSignatureCheck verifies the signature of r, if it has one, and keeps
+// the outcome in the context of the request it returns, so that the nonce
+// is only spent once however many times the request is checked.
+func (h *fishesHandler) withSignatureCheck(r *http.Request) (*http.Request, string, error) {
+	if !signedAuthorization(r) {
+		return r, "", nil
+	}
+	credential, err := h.verifySignature(h.config(), r)
+	r = r.WithContext(context.WithValue(r.Context(), signatureCheckKey, &signatureCheck{credential, err}))
+	return r, credential, err
+}
+
+func (h *fishesHandler) verifySignature(cfg *Config, r *http.Request) (string, error) {
+	if check, ok := r.Context().Value(signatureCheckKey).(*signatureCheck); ok {
+		return check.credential, check.err
+	}
+	return h.verifier.verify(cfg, r, h.clock.Now())
+}
+
+// authenticate checks the admin credentials on r, basic auth or a request
+// signature, and records the attempt. present is false when r carries no
+// credentials at all, err explains a rejected signature. Successful requests
+// from peers and replicas, signed with replication_key, come several times a
+// second and are not recorded.
+func (h *fishesHandler) authenticate(r *http.Request) (ok, present bool, err error) {
+	cfg := h.config()
+	if signedAuthorization(r) {
+		credential, err := h.verifySignature(cfg, r)
+		if err != nil || credential != strings.SplitN(cfg.ReplicationKey, "=", 2)[0] {
+			h.audit.record(cfg, r, credential, err == nil, h.clock.Now())
+		}
+		return err == nil, true, err
+	}
+	principal, _, present := r.BasicAuth()
+	if !present {
+		return false, false, nil
+	}
+	ok = adminCredentials(r, cfg.AdminPassword)
+	h.audit.record(cfg, r, principal, ok, h.clock.Now())
+	return ok, true, nil
+}
+
+// authorized checks the admin credentials on r as authenticate does, without
+// recording the attempt. It is for the checks a request goes through after it
+// was let in, such as which fields of the fishes it may see, so that one
+// request is audited once however often its credentials are looked at.
+func (h *fishesHandler) authorized(r *http.Request) bool {
+	cfg := h.config()
+	if signedAuthorization(r) {
+		_, err := h.verifySignature(cfg, r)
+		return err == nil
+	}
+	return adminCredentials(r, cfg.AdminPassword)
+}
+
+// principal names who r is authenticated as, the credential it was signed
+// with or the basic auth user, and is empty when its credentials do not check
+// out or it has none. Like authorized it records nothing.
+func (h *fishesHandler) principal(r *http.Request) string {
+	cfg := h.config()
+	if signedAuthorization(r) {
+		credential, err := h.verifySignature(cfg, r)
+		if err != nil {
+			return ""
+		}
+		return credential
+	}
+	if user, _, ok := r.BasicAuth(); ok && adminCredentials(r, cfg.AdminPassword) {
+		return user
+	}
+	return ""
+}
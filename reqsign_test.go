@@ -0,0 +1,112 @@
+package fishes
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedTestRequest is a request to target signed as key id k1 with secret,
+// dated at and carrying nonce.
+func signedTestRequest(secret, method, target, body string, at time.Time, nonce string) *http.Request {
+	r := httptest.NewRequest(method, "http://fishes"+target, strings.NewReader(body))
+	date := at.UTC().Format(time.RFC3339)
+	r.Header.Set("X-Fish-Date", date)
+	r.Header.Set("X-Fish-Nonce", nonce)
+	signature := signRequest(secret, r, date, nonce, []byte(body))
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=k1, Signature=%s", signatureScheme, signature))
+	return r
+}
+
+func TestRequestSignatures(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.APIKeys = []string{"k1=s3cret"}
+	now := time.Now()
+
+	for _, tc := range []struct {
+		name    string
+		request func() *http.Request
+		wantErr string
+	}{
+		{"signed", func() *http.Request {
+			return signedTestRequest("s3cret", "POST", "/admin/flush", `{}`, now, "n1")
+		}, ""},
+		{"wrong secret", func() *http.Request {
+			return signedTestRequest("guess", "POST", "/admin/flush", `{}`, now, "n2")
+		}, "does not match"},
+		{"unknown key", func() *http.Request {
+			r := signedTestRequest("s3cret", "POST", "/admin/flush", `{}`, now, "n3")
+			r.Header.Set("Authorization", strings.Replace(r.Header.Get("Authorization"), "Credential=k1", "Credential=k2", 1))
+			return r
+		}, "does not match"},
+		{"body changed", func() *http.Request {
+			r := signedTestRequest("s3cret", "POST", "/admin/flush", `{}`, now, "n4")
+			r.Body = httptest.NewRequest("POST", "/", strings.NewReader(`{"all":true}`)).Body
+			return r
+		}, "does not match"},
+		{"path changed", func() *http.Request {
+			r := signedTestRequest("s3cret", "POST", "/admin/flush", `{}`, now, "n5")
+			r.URL.Path = "/admin/restore"
+			return r
+		}, "does not match"},
+		{"no nonce", func() *http.Request {
+			r := signedTestRequest("s3cret", "POST", "/admin/flush", `{}`, now, "n6")
+			r.Header.Del("X-Fish-Nonce")
+			return r
+		}, "X-Fish-Nonce"},
+		{"no date", func() *http.Request {
+			r := signedTestRequest("s3cret", "POST", "/admin/flush", `{}`, now, "n7")
+			r.Header.Del("X-Fish-Date")
+			return r
+		}, "X-Fish-Date"},
+		{"outside the window", func() *http.Request {
+			return signedTestRequest("s3cret", "POST", "/admin/flush", `{}`, now.Add(-cfg.RequestSigningWindow-time.Minute), "n8")
+		}, "away from the server time"},
+		{"no signature", func() *http.Request {
+			r := signedTestRequest("s3cret", "POST", "/admin/flush", `{}`, now, "n9")
+			r.Header.Set("Authorization", signatureScheme+" Credential=k1")
+			return r
+		}, "needs Credential and Signature"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			credential, err := newRequestVerifier().verify(cfg, tc.request(), time.Now())
+			if tc.wantErr == "" {
+				if err != nil || credential != "k1" {
+					t.Errorf("verify = %q, %v; want k1 accepted", credential, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("verify error = %v, want one saying %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// A nonce is spent by the first request using it, however the replay is
+// timed within the window.
+func TestRequestSignatureNonceReplay(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.APIKeys = []string{"k1=s3cret"}
+	v := newRequestVerifier()
+	now := time.Now()
+
+	for i, tc := range []struct {
+		nonce  string
+		at     time.Time
+		accept bool
+	}{
+		{"n1", now, true},
+		{"n1", now, false},
+		{"n1", now.Add(time.Minute), false},
+		{"n2", now, true},
+	} {
+		_, err := v.verify(cfg, signedTestRequest("s3cret", "GET", "/admin/stats", "", tc.at, tc.nonce), time.Now())
+		if (err == nil) != tc.accept {
+			t.Errorf("request %d with nonce %s: err = %v, want accepted %v", i+1, tc.nonce, err, tc.accept)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package fishes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type restorePreview struct {
+	Seq      uint64        `json:"seq"`
+	At       time.Time     `json:"at"`
+	Records  int           `json:"records"`
+	Changes  importChanges `json:"changes"`
+	Confirm  string        `json:"confirm,omitempty"`
+	Applied  bool          `json:"applied"`
+	Problems []string      `json:"problems,omitempty"`
+}
+
+// restoreToken ties a confirmation to the previewed target and the dataset
+// version it was previewed against, so a preview goes stale as soon as
+// anything else is written.
+func restoreToken(seq, version uint64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("restore:%d:%d", seq, version)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// restoreTarget picks the operation to restore to from either seq or at,
+// which selects the last operation at or before that time.
+func restoreTarget(r *http.Request, ops []opEntry) (opEntry, error) {
+	q := r.URL.Query()
+	switch {
+	case q.Get("seq") != "" && q.Get("at") != "":
+		return opEntry{}, fmt.Errorf("set either seq or at, not both")
+	case q.Get("seq") != "":
+		seq, err := strconv.ParseUint(q.Get("seq"), 10, 64)
+		if err != nil {
+			return opEntry{}, fmt.Errorf("seq must be a positive integer")
+		}
+		for _, op := range ops {
+			if op.Seq == seq {
+				return op, nil
+			}
+		}
+		return opEntry{}, fmt.Errorf("no operation with seq %d", seq)
+	case q.Get("at") != "":
+		at, err := time.Parse(time.RFC3339Nano, q.Get("at"))
+		if err != nil {
+			return opEntry{}, fmt.Errorf("at must be an RFC 3339 timestamp")
+		}
+		var target *opEntry
+		for i := range ops {
+			if ops[i].At.After(at) {
+				break
+			}
+			target = &ops[i]
+		}
+		if target == nil {
+			return opEntry{}, fmt.Errorf("the operation log starts after %s", at.Format(time.RFC3339))
+		}
+		return *target, nil
+	}
+	return opEntry{}, fmt.Errorf("seq or at is required")
+}
+
+// restore rolls the dataset back to a point in the operation log. Without
+// confirm it only previews the changes; repeating the request with the
+// returned confirm token applies them.
+func (a *adminPortal) restore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+
+	h := a.fishes
+	h.Lock()
+	defer h.Unlock()
+	if h.oplog == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("the operation log is disabled, set data_dir to enable it"))
+		return
+	}
+
+	ops, err := h.oplog.read(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	target, err := restoreTarget(r, ops)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	current, err := h.fullSnapshot()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	snap := replayOps(ops, target.Seq)
+	preview := &restorePreview{
+		Seq:     target.Seq,
+		At:      target.At,
+		Records: len(snap.Fishes),
+		Changes: diffFishIDs(current, snap),
+		Confirm: restoreToken(target.Seq, h.version),
+	}
+
+	confirm := r.URL.Query().Get("confirm")
+	if confirm == "" {
+		writeJSON(w, http.StatusOK, preview)
+		return
+	}
+	if confirm != preview.Confirm {
+		preview.Problems = []string{"the dataset changed since the preview or the token is wrong, review this preview and confirm again"}
+		writeJSON(w, http.StatusConflict, preview)
+		return
+	}
+
+	if err := h.replaceAll(snap); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	preview.Applied = true
+	preview.Confirm = ""
+	writeJSON(w, http.StatusOK, preview)
+}
@@ -0,0 +1,171 @@
+package fishes
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type revision struct {
+	Revision int       `json:"revision"`
+	Seq      uint64    `json:"seq"`
+	At       time.Time `json:"at"`
+	Op       string    `json:"op"`
+	Fish     Fish      `json:"fish"`
+}
+
+// revisionView is a revision as the API version of the request shows it.
+type revisionView struct {
+	revision
+	Fish interface{} `json:"fish"`
+}
+
+type fieldChange struct {
+	Field string          `json:"field"`
+	From  json.RawMessage `json:"from"`
+	To    json.RawMessage `json:"to"`
+}
+
+type revisionDiff struct {
+	From    int           `json:"from"`
+	To      int           `json:"to"`
+	Changes []fieldChange `json:"changes"`
+}
+
+// fishRevisions collects every state of one fish recorded in the operation
+// log, oldest first. Resets only count when they changed the fish.
+func fishRevisions(ops []opEntry, id string) []revision {
+	var revisions []revision
+	var last *Fish
+	add := func(op opEntry, fish Fish) {
+		if last != nil && reflect.DeepEqual(*last, fish) {
+			return
+		}
+		revisions = append(revisions, revision{Revision: len(revisions) + 1, Seq: op.Seq, At: op.At, Op: op.Op, Fish: fish})
+		last = &revisions[len(revisions)-1].Fish
+	}
+
+	for _, op := range ops {
+		switch op.Op {
+		case opPut, opDelete:
+			if op.Fish.ID == id {
+				add(op, *op.Fish)
+			}
+		case opReset:
+			for _, fish := range append(op.Fishes, op.Trash...) {
+				if fish.ID == id {
+					add(op, fish)
+				}
+			}
+		}
+	}
+	return revisions
+}
+
+func diffFish(from, to interface{}) []fieldChange {
+	var before, after map[string]json.RawMessage
+	a, _ := json.Marshal(from)
+	b, _ := json.Marshal(to)
+	json.Unmarshal(a, &before)
+	json.Unmarshal(b, &after)
+
+	fields := map[string]bool{}
+	for field := range before {
+		fields[field] = true
+	}
+	for field := range after {
+		fields[field] = true
+	}
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	changes := []fieldChange{}
+	for _, field := range names {
+		if string(before[field]) == string(after[field]) {
+			continue
+		}
+		change := fieldChange{Field: field, From: before[field], To: after[field]}
+		if change.From == nil {
+			change.From = json.RawMessage("null")
+		}
+		if change.To == nil {
+			change.To = json.RawMessage("null")
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+func revisionNumber(raw string, count int) (int, bool) {
+	n, err := strconv.Atoi(raw)
+	return n, err == nil && n >= 1 && n <= count
+}
+
+// revisions serves /fishes/{id}/revisions, /fishes/{id}/revisions/{n} and
+// /fishes/{id}/revisions/diff?from=n&to=m. sub is the path after the id.
+func (h *fishesHandler) revisions(w http.ResponseWriter, r *http.Request, id, sub string) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+
+	h.Lock()
+	oplog := h.oplog
+	h.Unlock()
+	if oplog == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("revision history is kept in the operation log, set data_dir to enable it"))
+		return
+	}
+
+	ops, err := oplog.read(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	revisions := fishRevisions(ops, id)
+	if len(revisions) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	fishes := make([]Fish, len(revisions))
+	for i := range revisions {
+		fishes[i] = revisions[i].Fish
+	}
+	h.visibleFishes(r, fishes)
+	views := make([]revisionView, len(revisions))
+	for i := range revisions {
+		views[i] = revisionView{revision: revisions[i], Fish: versionedFish(r, fishes[i])}
+	}
+
+	rest := strings.TrimPrefix(strings.TrimPrefix(sub, "revisions"), "/")
+	switch rest {
+	case "":
+		writeJSON(w, http.StatusOK, views)
+	case "diff":
+		from, okFrom := revisionNumber(r.URL.Query().Get("from"), len(revisions))
+		to, okTo := revisionNumber(r.URL.Query().Get("to"), len(revisions))
+		if !okFrom || !okTo {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("from and to must be revision numbers between 1 and " + strconv.Itoa(len(revisions))))
+			return
+		}
+		writeJSON(w, http.StatusOK, revisionDiff{From: from, To: to, Changes: diffFish(views[from-1].Fish, views[to-1].Fish)})
+	default:
+		n, ok := revisionNumber(rest, len(revisions))
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, views[n-1])
+	}
+}
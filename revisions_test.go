@@ -0,0 +1,42 @@
+package fishes
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// Revisions and undo answer with fishes as the API version shows them,
+// max_length included on /v1.
+func TestRevisionsAndUndoAreVersioned(t *testing.T) {
+	h := newTestServer(t, false, nil)
+	res := serveTest(h, "POST", "/fishes", "application/json", []byte(`{"name":"Nemo","max_length_cm":11}`))
+	if res.Code != 201 {
+		t.Fatalf("creating the fish: %d %s", res.Code, res.Body)
+	}
+	var fish Fish
+	if err := json.Unmarshal(res.Body.Bytes(), &fish); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		method, path string
+	}{
+		{"GET", "/fishes/" + fish.ID + "/revisions"},
+		{"GET", "/fishes/" + fish.ID + "/revisions/1"},
+		{"POST", "/fishes/" + fish.ID + "/undo"},
+	} {
+		for _, version := range []string{"/v1", "/v2"} {
+			t.Run(tc.method+" "+version+tc.path, func(t *testing.T) {
+				res := serveTest(h, tc.method, version+tc.path, "", nil)
+				if res.Code != 200 {
+					t.Fatalf("%d %s", res.Code, res.Body)
+				}
+				legacy := strings.Contains(res.Body.String(), `"max_length":11`)
+				if legacy != (version == "/v1") {
+					t.Errorf("max_length shown = %v on %s: %s", legacy, version, res.Body)
+				}
+			})
+		}
+	}
+}
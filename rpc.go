@@ -0,0 +1,398 @@
+package fishes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// JSON-RPC 2.0 error codes. Refusals of the REST handlers that are not
+// about the params come back as rpcServerError with the HTTP status in data.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	rpcServerError    = -32000
+)
+
+const maxRPCBatch = 100
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// rpcCall is the REST request a method stands for.
+type rpcCall struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	body   json.RawMessage
+	// result shapes a successful answer.
+	result func(res *jobResponse) (interface{}, error)
+}
+
+// rpcParams are the by-name params of a call.
+type rpcParams map[string]json.RawMessage
+
+func (p rpcParams) str(name string) (string, error) {
+	raw, ok := p[name]
+	if !ok {
+		return "", nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", fmt.Errorf("param '%s' must be a string", name)
+	}
+	return s, nil
+}
+
+func (p rpcParams) required(name string) (string, error) {
+	s, err := p.str(name)
+	if err == nil && s == "" {
+		err = fmt.Errorf("param '%s' is required", name)
+	}
+	return s, err
+}
+
+// query copies the named params into a query string, as the REST handlers
+// validate them.
+func (p rpcParams) query(specs []paramSpec) url.Values {
+	q := url.Values{}
+	for _, spec := range specs {
+		raw, ok := p[spec.name]
+		if !ok {
+			continue
+		}
+		var s string
+		if json.Unmarshal(raw, &s) != nil {
+			s = string(raw)
+		}
+		q.Set(spec.name, s)
+	}
+	return q
+}
+
+func (p rpcParams) object(name string) (json.RawMessage, error) {
+	raw := p[name]
+	if len(raw) == 0 || raw[0] != '{' {
+		return nil, fmt.Errorf("param '%s' must be an object", name)
+	}
+	return raw, nil
+}
+
+// ifMatch is the etag param, or any version when there is none; RPC
+// clients rarely keep ETags.
+func (p rpcParams) ifMatch() (http.Header, error) {
+	etag, err := p.str("etag")
+	if etag == "" {
+		etag = "*"
+	}
+	return http.Header{"If-Match": {etag}}, err
+}
+
+// fishOf takes the fish out of its envelope when response_envelope put
+// it in one.
+func fishOf(res *jobResponse) (*Fish, error) {
+	var answer struct {
+		Data *Fish `json:"data"`
+	}
+	if err := json.Unmarshal(res.body.Bytes(), &answer); err != nil {
+		return nil, err
+	}
+	fish := answer.Data
+	if fish == nil {
+		fish = &Fish{}
+		if err := json.Unmarshal(res.body.Bytes(), fish); err != nil {
+			return nil, err
+		}
+	}
+	return fish, nil
+}
+
+func fishWithETag(res *jobResponse) (interface{}, error) {
+	fish, err := fishOf(res)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"fish": fish, "etag": res.header.Get("ETag")}, nil
+}
+
+func rawResult(res *jobResponse) (interface{}, error) {
+	return json.RawMessage(res.body.Bytes()), nil
+}
+
+func fishParamPath(p rpcParams, sub string) (string, error) {
+	id, err := p.required("id")
+	return "/fishes/" + url.PathEscape(id) + sub, err
+}
+
+var rpcMethods = map[string]func(p rpcParams) (*rpcCall, error){
+	"fishes.list": func(p rpcParams) (*rpcCall, error) {
+		q := p.query(listFishesParams)
+		q.Set("envelope", "true")
+		return &rpcCall{method: "GET", path: "/fishes", query: q, result: rawResult}, nil
+	},
+	"fishes.get": func(p rpcParams) (*rpcCall, error) {
+		path, err := fishParamPath(p, "")
+		return &rpcCall{method: "GET", path: path, result: fishWithETag}, err
+	},
+	"fishes.create": func(p rpcParams) (*rpcCall, error) {
+		var header http.Header
+		key, err := p.str("idempotency_key")
+		if key != "" {
+			header = http.Header{"Idempotency-Key": {key}}
+		}
+		if err != nil {
+			return nil, err
+		}
+		fish, err := p.object("fish")
+		return &rpcCall{method: "POST", path: "/fishes", header: header, body: fish, result: fishWithETag}, err
+	},
+	"fishes.update": func(p rpcParams) (*rpcCall, error) {
+		path, err := fishParamPath(p, "")
+		if err != nil {
+			return nil, err
+		}
+		header, err := p.ifMatch()
+		if err != nil {
+			return nil, err
+		}
+		fish, err := p.object("fish")
+		return &rpcCall{method: "PUT", path: path, header: header, body: fish, result: fishWithETag}, err
+	},
+	"fishes.patch": func(p rpcParams) (*rpcCall, error) {
+		path, err := fishParamPath(p, "")
+		if err != nil {
+			return nil, err
+		}
+		header, err := p.ifMatch()
+		if err != nil {
+			return nil, err
+		}
+		header.Set("Content-Type", "application/merge-patch+json")
+		patch, err := p.object("patch")
+		return &rpcCall{method: "PATCH", path: path, header: header, body: patch, result: fishWithETag}, err
+	},
+	"fishes.delete": func(p rpcParams) (*rpcCall, error) {
+		path, err := fishParamPath(p, "")
+		if err != nil {
+			return nil, err
+		}
+		header, err := p.ifMatch()
+		return &rpcCall{method: "DELETE", path: path, header: header, result: func(*jobResponse) (interface{}, error) { return true, nil }}, err
+	},
+	"fishes.restore": func(p rpcParams) (*rpcCall, error) {
+		path, err := fishParamPath(p, "/restore")
+		return &rpcCall{method: "POST", path: path, result: fishWithETag}, err
+	},
+	"fishes.trash": func(p rpcParams) (*rpcCall, error) {
+		q := p.query(listTrashParams)
+		q.Set("envelope", "true")
+		return &rpcCall{method: "GET", path: "/fishes/trash", query: q, result: rawResult}, nil
+	},
+	"environments.list": func(p rpcParams) (*rpcCall, error) {
+		return &rpcCall{method: "GET", path: "/environments", result: rawResult}, nil
+	},
+}
+
+// rpcEndpoint serves POST /rpc. Each call is run as the REST request it
+// stands for through next, the same handler chain the REST API is served
+// by, so it is routed, authorized and validated the same way.
+type rpcEndpoint struct {
+	next http.Handler
+}
+
+func (e *rpcEndpoint) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	body, ok := readJSONBody(w, r, "application/json", "application/json; charset=utf-8")
+	if !ok {
+		return
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		var req rpcRequest
+		if err := json.Unmarshal(trimmed, &req); err != nil {
+			if json.Valid(trimmed) {
+				writeJSON(w, http.StatusOK, rpcFailure(nil, rpcInvalidRequest, "invalid request", nil))
+			} else {
+				writeJSON(w, http.StatusOK, rpcFailure(nil, rpcParseError, "parse error: "+err.Error(), nil))
+			}
+			return
+		}
+		if res := e.call(r, req); res != nil {
+			writeJSON(w, http.StatusOK, res)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(trimmed, &batch); err != nil {
+		writeJSON(w, http.StatusOK, rpcFailure(nil, rpcParseError, "parse error: "+err.Error(), nil))
+		return
+	}
+	if len(batch) == 0 {
+		writeJSON(w, http.StatusOK, rpcFailure(nil, rpcInvalidRequest, "the batch is empty", nil))
+		return
+	}
+	if len(batch) > maxRPCBatch {
+		writeJSON(w, http.StatusOK, rpcFailure(nil, rpcInvalidRequest, fmt.Sprintf("a batch holds at most %d calls", maxRPCBatch), nil))
+		return
+	}
+	// Calls run in order, so a batch can read what it wrote.
+	responses := []*rpcResponse{}
+	for _, raw := range batch {
+		var req rpcRequest
+		if err := json.Unmarshal(raw, &req); err != nil {
+			responses = append(responses, rpcFailure(nil, rpcInvalidRequest, "invalid request", nil))
+			continue
+		}
+		if res := e.call(r, req); res != nil {
+			responses = append(responses, res)
+		}
+	}
+	if len(responses) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, responses)
+}
+
+func rpcFailure(id json.RawMessage, code int, message string, data interface{}) *rpcResponse {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return &rpcResponse{JSONRPC: "2.0", Error: &rpcError{Code: code, Message: message, Data: data}, ID: id}
+}
+
+func validRPCID(id json.RawMessage) bool {
+	if len(id) == 0 || string(id) == "null" {
+		return true
+	}
+	switch id[0] {
+	case '"', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return true
+	}
+	return false
+}
+
+// call runs one request. Notifications, without an id, get no response.
+func (e *rpcEndpoint) call(r *http.Request, req rpcRequest) *rpcResponse {
+	notification := len(req.ID) == 0
+	if req.JSONRPC != "2.0" || req.Method == "" || !validRPCID(req.ID) {
+		return rpcFailure(req.ID, rpcInvalidRequest, "invalid request, jsonrpc must be \"2.0\" and method set", nil)
+	}
+	respond := func(res *rpcResponse) *rpcResponse {
+		if notification {
+			return nil
+		}
+		return res
+	}
+
+	method, ok := rpcMethods[req.Method]
+	if !ok {
+		return respond(rpcFailure(req.ID, rpcMethodNotFound, fmt.Sprintf("method '%s' not found", req.Method), nil))
+	}
+	params := rpcParams{}
+	if len(req.Params) > 0 && string(req.Params) != "null" {
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return respond(rpcFailure(req.ID, rpcInvalidParams, "params must be an object", nil))
+		}
+	}
+	c, err := method(params)
+	if err != nil {
+		return respond(rpcFailure(req.ID, rpcInvalidParams, err.Error(), nil))
+	}
+
+	res, err := e.run(r, c)
+	if err != nil {
+		return respond(rpcFailure(req.ID, rpcInternalError, err.Error(), nil))
+	}
+	if res.status >= 300 {
+		code := rpcServerError
+		if res.status == http.StatusBadRequest || res.status == http.StatusUnprocessableEntity {
+			code = rpcInvalidParams
+		}
+		message := strings.TrimSpace(res.body.String())
+		if message == "" || strings.HasPrefix(message, "{") {
+			message = http.StatusText(res.status)
+		}
+		data := map[string]interface{}{"status": res.status}
+		if location := res.header.Get("Location"); location != "" {
+			data["location"] = location
+		}
+		return respond(rpcFailure(req.ID, code, message, data))
+	}
+	result, err := c.result(res)
+	if err != nil {
+		return respond(rpcFailure(req.ID, rpcInternalError, err.Error(), nil))
+	}
+	return respond(&rpcResponse{JSONRPC: "2.0", Result: result, ID: req.ID})
+}
+
+// run sends c through the handler chain on behalf of r, whose credentials it
+// carries, following the redirect a slug answers with.
+func (e *rpcEndpoint) run(r *http.Request, c *rpcCall) (*jobResponse, error) {
+	body := []byte(c.body)
+	target := &url.URL{Path: c.path, RawQuery: c.query.Encode()}
+	for hops := 0; ; hops++ {
+		req, err := http.NewRequest(c.method, target.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(r.Context())
+		req.RemoteAddr, req.Host, req.TLS = r.RemoteAddr, r.Host, r.TLS
+		// A signature covers the /rpc request only, basic credentials carry
+		// over.
+		if !signedAuthorization(r) {
+			req.Header.Set("Authorization", r.Header.Get("Authorization"))
+		}
+		if token := r.Header.Get(consistencyTokenHeader); token != "" {
+			req.Header.Set(consistencyTokenHeader, token)
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for name, values := range c.header {
+			req.Header[name] = values
+		}
+
+		res := &jobResponse{header: http.Header{}}
+		e.next.ServeHTTP(res, req)
+		// Only redirects within this server are followed, like a slug's.
+		next, err := target.Parse(res.header.Get("Location"))
+		if res.status/100 != 3 || err != nil || next.Host != "" || hops == 3 {
+			return res, nil
+		}
+		target = next
+	}
+}
@@ -0,0 +1,103 @@
+package fishes
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestJSONRPC(t *testing.T) {
+	h := newTestServer(t, false, nil)
+	res := serveTest(h, "POST", "/fishes", "application/json", []byte(`{"name":"Nemo","environment":"saltwater"}`))
+	if res.Code != http.StatusCreated {
+		t.Fatalf("creating the fish: %d %s", res.Code, res.Body)
+	}
+	var nemo Fish
+	if err := json.Unmarshal(res.Body.Bytes(), &nemo); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name, body string
+		// wantCode is the JSON-RPC error code, 0 for a result holding
+		// wantResult.
+		wantCode   int
+		wantResult string
+	}{
+		{"get", `{"jsonrpc":"2.0","method":"fishes.get","params":{"id":"` + nemo.ID + `"},"id":1}`, 0, `"name":"Nemo"`},
+		{"create", `{"jsonrpc":"2.0","method":"fishes.create","params":{"fish":{"name":"Dory","environment":"saltwater"}},"id":"a"}`, 0, `"name":"Dory"`},
+		{"list", `{"jsonrpc":"2.0","method":"fishes.list","params":{"sort":"name"},"id":2}`, 0, `"total":2`},
+		{"environments", `{"jsonrpc":"2.0","method":"environments.list","id":3}`, 0, `saltwater`},
+		{"parse error", `{"jsonrpc":`, rpcParseError, ""},
+		{"no version", `{"method":"fishes.list","id":4}`, rpcInvalidRequest, ""},
+		{"object id", `{"jsonrpc":"2.0","method":"fishes.list","id":{}}`, rpcInvalidRequest, ""},
+		{"unknown method", `{"jsonrpc":"2.0","method":"fishes.fry","id":5}`, rpcMethodNotFound, ""},
+		{"params not an object", `{"jsonrpc":"2.0","method":"fishes.get","params":["x"],"id":6}`, rpcInvalidParams, ""},
+		{"missing id param", `{"jsonrpc":"2.0","method":"fishes.get","params":{},"id":7}`, rpcInvalidParams, ""},
+		{"invalid fish", `{"jsonrpc":"2.0","method":"fishes.create","params":{"fish":{"name":"X","environment":"lava"}},"id":8}`, rpcInvalidParams, ""},
+		{"not found", `{"jsonrpc":"2.0","method":"fishes.get","params":{"id":"no-such-fish"},"id":9}`, rpcServerError, ""},
+		{"stale etag", `{"jsonrpc":"2.0","method":"fishes.delete","params":{"id":"` + nemo.ID + `","etag":"\"stale\""},"id":10}`, rpcServerError, ""},
+		{"empty batch", `[]`, rpcInvalidRequest, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res := serveTest(h, "POST", "/rpc", "application/json", []byte(tc.body))
+			if res.Code != http.StatusOK {
+				t.Fatalf("%d %s", res.Code, res.Body)
+			}
+			var answer struct {
+				Result json.RawMessage `json:"result"`
+				Error  *rpcError       `json:"error"`
+			}
+			if err := json.Unmarshal(res.Body.Bytes(), &answer); err != nil {
+				t.Fatalf("%s: %s", err, res.Body)
+			}
+			if tc.wantCode == 0 {
+				if answer.Error != nil || !strings.Contains(string(answer.Result), tc.wantResult) {
+					t.Errorf("got %s, want a result with %s", res.Body, tc.wantResult)
+				}
+				return
+			}
+			if answer.Error == nil || answer.Error.Code != tc.wantCode {
+				t.Errorf("got %s, want error %d", res.Body, tc.wantCode)
+			}
+		})
+	}
+}
+
+// A batch answers its calls in order, leaving out the notifications, and one
+// of notifications only gets no body.
+func TestJSONRPCBatch(t *testing.T) {
+	h := newTestServer(t, false, nil)
+	res := serveTest(h, "POST", "/rpc", "application/json", []byte(`[
+		{"jsonrpc":"2.0","method":"fishes.create","params":{"fish":{"name":"Nemo","environment":"saltwater"}}},
+		{"jsonrpc":"2.0","method":"fishes.list","id":1},
+		{"jsonrpc":"2.0","method":"fishes.fry","id":2},
+		1
+	]`))
+	var answers []struct {
+		ID     json.RawMessage `json:"id"`
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &answers); err != nil {
+		t.Fatalf("%d %s: %s", res.Code, res.Body, err)
+	}
+	if len(answers) != 3 {
+		t.Fatalf("got %d answers, want 3: %s", len(answers), res.Body)
+	}
+	if string(answers[0].ID) != "1" || !strings.Contains(string(answers[0].Result), `"name":"Nemo"`) {
+		t.Errorf("the list does not see the fish the notification before it created: %s", res.Body)
+	}
+	if answers[1].Error == nil || answers[1].Error.Code != rpcMethodNotFound {
+		t.Errorf("second answer: %s", res.Body)
+	}
+	if answers[2].Error == nil || answers[2].Error.Code != rpcInvalidRequest || string(answers[2].ID) != "null" {
+		t.Errorf("third answer: %s", res.Body)
+	}
+
+	res = serveTest(h, "POST", "/rpc", "application/json", []byte(`[{"jsonrpc":"2.0","method":"fishes.list"}]`))
+	if res.Code != http.StatusNoContent || res.Body.Len() != 0 {
+		t.Errorf("a batch of notifications: %d %s", res.Code, res.Body)
+	}
+}
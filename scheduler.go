@@ -0,0 +1,370 @@
+package fishes
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// schedule yields the next time a job is due after a given time.
+type schedule interface {
+	next(after time.Time) time.Time
+	String() string
+}
+
+// everySchedule runs at a fixed interval. The interval is looked up on every
+// run so settings changed by a reload apply from the next run on.
+type everySchedule struct {
+	interval func() time.Duration
+}
+
+func every(interval func() time.Duration) schedule {
+	return everySchedule{interval: interval}
+}
+
+func (s everySchedule) next(after time.Time) time.Time {
+	return after.Add(s.interval())
+}
+
+func (s everySchedule) String() string {
+	return "@every " + s.interval().String()
+}
+
+// cronSchedule is a classic five field cron expression: minute, hour, day of
+// month, month and day of week. Each field accepts *, */n, a, a-b, a-b/n and
+// comma-separated lists of those.
+type cronSchedule struct {
+	spec                          string
+	minute, hour, dom, month, dow map[int]bool
+}
+
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			step, part = n, part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron spec %q must have 5 fields", spec)
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+	parsed := make([]map[int]bool, 5)
+	for i, field := range fields {
+		values, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron spec %q: %s", spec, err)
+		}
+		parsed[i] = values
+	}
+	return &cronSchedule{spec: spec, minute: parsed[0], hour: parsed[1], dom: parsed[2], month: parsed[3], dow: parsed[4]}, nil
+}
+
+func (s *cronSchedule) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	// Every schedule matches at least once in four years (Feb 29).
+	for limit := t.AddDate(4, 0, 0); t.Before(limit); t = t.Add(time.Minute) {
+		if s.minute[t.Minute()] && s.hour[t.Hour()] && s.dom[t.Day()] && s.month[int(t.Month())] && s.dow[int(t.Weekday())] {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) String() string {
+	return s.spec
+}
+
+// parseSchedule understands @every <duration>, @hourly, @daily and five
+// field cron expressions.
+func parseSchedule(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	switch {
+	case strings.HasPrefix(spec, "@every "):
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid schedule %q: @every needs a positive duration", spec)
+		}
+		return every(func() time.Duration { return d }), nil
+	case spec == "@hourly":
+		return parseCron("0 * * * *")
+	case spec == "@daily":
+		return parseCron("0 0 * * *")
+	}
+	return parseCron(spec)
+}
+
+// parseJobSchedules reads name=spec overrides.
+func parseJobSchedules(specs []string) (map[string]schedule, error) {
+	schedules := map[string]schedule{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("job schedule %q must be name=spec", spec)
+		}
+		s, err := parseSchedule(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		schedules[strings.TrimSpace(parts[0])] = s
+	}
+	return schedules, nil
+}
+
+type job struct {
+	name     string
+	schedule schedule
+	jitter   time.Duration
+	fn       func() error
+	trigger  chan struct{}
+
+	paused       bool
+	running      bool
+	runs         int
+	failures     int
+	lastRun      time.Time
+	lastDuration time.Duration
+	lastErr      error
+	nextRun      time.Time
+}
+
+type jobStatus struct {
+	Name         string     `json:"name"`
+	Schedule     string     `json:"schedule"`
+	Jitter       string     `json:"jitter,omitempty"`
+	Paused       bool       `json:"paused"`
+	Running      bool       `json:"running"`
+	Runs         int        `json:"runs"`
+	Failures     int        `json:"failures"`
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	LastDuration string     `json:"last_duration,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	NextRun      *time.Time `json:"next_run,omitempty"`
+}
+
+// scheduler runs named recurring jobs in the background. A job never runs
+// concurrently with itself; a run that is due while the previous one is
+// still going is skipped.
+type scheduler struct {
+	sync.Mutex
+	jobs      map[string]*job
+	overrides map[string]schedule
+	stopped   chan struct{}
+}
+
+func newScheduler(overrides map[string]schedule) *scheduler {
+	return &scheduler{jobs: map[string]*job{}, overrides: overrides, stopped: make(chan struct{})}
+}
+
+// stop ends the loops of the jobs; a run under way finishes first.
+func (s *scheduler) stop() error {
+	close(s.stopped)
+	return nil
+}
+
+// add registers and starts a job. A schedule from job_schedules replaces
+// the default one.
+func (s *scheduler) add(name string, sched schedule, jitter time.Duration, fn func() error) {
+	if override, ok := s.overrides[name]; ok {
+		sched = override
+	}
+	j := &job{name: name, schedule: sched, jitter: jitter, fn: fn, trigger: make(chan struct{}, 1)}
+
+	s.Lock()
+	s.jobs[name] = j
+	s.Unlock()
+	go s.loop(j)
+}
+
+func (s *scheduler) loop(j *job) {
+	for {
+		now := time.Now()
+		next := j.schedule.next(now)
+		if j.jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(j.jitter))))
+		}
+		s.Lock()
+		j.nextRun = next
+		s.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(next.Sub(now))
+			timeout = timer.C
+		}
+
+		manual, stopped := false, false
+		select {
+		case <-timeout:
+		case <-j.trigger:
+			manual = true
+		case <-s.stopped:
+			stopped = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if stopped {
+			return
+		}
+
+		s.Lock()
+		skip := j.paused && !manual
+		s.Unlock()
+		if !skip {
+			s.run(j)
+		}
+	}
+}
+
+func (s *scheduler) run(j *job) {
+	s.Lock()
+	j.running = true
+	s.Unlock()
+
+	start := time.Now()
+	err := j.fn()
+	if err != nil {
+		log.Printf("job %s failed: %s", j.name, err)
+	}
+
+	s.Lock()
+	j.running = false
+	j.runs++
+	if err != nil {
+		j.failures++
+	}
+	j.lastRun = start.UTC()
+	j.lastDuration = time.Since(start)
+	j.lastErr = err
+	s.Unlock()
+}
+
+func (s *scheduler) status() []jobStatus {
+	s.Lock()
+	defer s.Unlock()
+
+	statuses := make([]jobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		status := jobStatus{
+			Name:     j.name,
+			Schedule: j.schedule.String(),
+			Paused:   j.paused,
+			Running:  j.running,
+			Runs:     j.runs,
+			Failures: j.failures,
+		}
+		if j.jitter > 0 {
+			status.Jitter = j.jitter.String()
+		}
+		if !j.lastRun.IsZero() {
+			lastRun := j.lastRun
+			status.LastRun = &lastRun
+			status.LastDuration = j.lastDuration.String()
+		}
+		if j.lastErr != nil {
+			status.LastError = j.lastErr.Error()
+		}
+		if !j.nextRun.IsZero() && !j.paused {
+			nextRun := j.nextRun.UTC()
+			status.NextRun = &nextRun
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, k int) bool { return statuses[i].Name < statuses[k].Name })
+	return statuses
+}
+
+// jobs lists the jobs on GET /admin/jobs and controls one with
+// POST /admin/jobs/{name}/run, /pause or /resume.
+func (a *adminPortal) jobs(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/jobs"), "/")
+	if rest == "" {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("method not allowed"))
+			return
+		}
+		writeJSON(w, http.StatusOK, a.scheduler.status())
+		return
+	}
+
+	parts := strings.Split(rest, "/")
+	if len(parts) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+
+	s := a.scheduler
+	s.Lock()
+	j, ok := s.jobs[parts[0]]
+	if !ok {
+		s.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("no job named " + parts[0]))
+		return
+	}
+	switch parts[1] {
+	case "run":
+		s.Unlock()
+		select {
+		case j.trigger <- struct{}{}:
+		default:
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("job " + j.name + " triggered"))
+	case "pause", "resume":
+		j.paused = parts[1] == "pause"
+		s.Unlock()
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("job " + j.name + " " + parts[1] + "d"))
+	default:
+		s.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
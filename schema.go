@@ -0,0 +1,166 @@
+package fishes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const fishSchemaVersion = 2
+
+type fieldAlias struct {
+	deprecated string
+	current    string
+	since      int
+	notice     deprecation
+}
+
+var fishFieldAliases = []fieldAlias{
+	{deprecated: "max_length", current: "max_length_cm", since: 2},
+}
+
+// v1Fish is a fish as /v1 shows it: with max_length too, for the readers
+// from before max_length_cm.
+type v1Fish struct {
+	Fish
+	LegacyMaxLength int `json:"max_length,omitempty"`
+}
+
+// versionedFish gives one fish as the API version of r shows it.
+func versionedFish(r *http.Request, fish Fish) interface{} {
+	if apiVersion(r) >= 2 {
+		return fish
+	}
+	return v1Fish{Fish: fish, LegacyMaxLength: fish.MaxLength}
+}
+
+// versionedFishes gives fishes as the API version of r shows them.
+func versionedFishes(r *http.Request, fishes []Fish) interface{} {
+	if apiVersion(r) >= 2 {
+		return fishes
+	}
+	legacy := make([]v1Fish, len(fishes))
+	for i, fish := range fishes {
+		legacy[i] = v1Fish{Fish: fish, LegacyMaxLength: fish.MaxLength}
+	}
+	return legacy
+}
+
+func decodeFish(data []byte) (Fish, []fieldAlias, error) {
+	var fish Fish
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fish, nil, err
+	}
+
+	used := normalizeFishFields(raw)
+
+	normalized, err := json.Marshal(raw)
+	if err != nil {
+		return fish, nil, err
+	}
+
+	err = json.Unmarshal(normalized, &fish)
+	return fish, used, err
+}
+
+func normalizeFishFields(raw map[string]json.RawMessage) []fieldAlias {
+	var used []fieldAlias
+	for _, alias := range fishFieldAliases {
+		value, ok := raw[alias.deprecated]
+		if !ok {
+			continue
+		}
+		used = append(used, alias)
+		delete(raw, alias.deprecated)
+		if _, ok := raw[alias.current]; !ok {
+			raw[alias.current] = value
+		}
+	}
+	return used
+}
+
+// mergeFishPatch applies a JSON merge patch (RFC 7396) on top of current.
+func mergeFishPatch(current Fish, patch []byte) (Fish, []fieldAlias, error) {
+	var fish Fish
+
+	var changes map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &changes); err != nil {
+		return fish, nil, err
+	}
+	used := normalizeFishFields(changes)
+
+	currentBytes, err := json.Marshal(current)
+	if err != nil {
+		return fish, nil, err
+	}
+	var merged map[string]json.RawMessage
+	if err := json.Unmarshal(currentBytes, &merged); err != nil {
+		return fish, nil, err
+	}
+
+	for name, value := range changes {
+		switch {
+		case string(value) == "null":
+			delete(merged, name)
+		case isJSONObject(value) && isJSONObject(merged[name]):
+			// Objects such as extensions are merged member by member.
+			if merged[name], err = mergeJSONObject(merged[name], value); err != nil {
+				return fish, nil, err
+			}
+		default:
+			merged[name] = value
+		}
+	}
+
+	mergedBytes, err := json.Marshal(merged)
+	if err != nil {
+		return fish, nil, err
+	}
+
+	err = json.Unmarshal(mergedBytes, &fish)
+	return fish, used, err
+}
+
+func isJSONObject(value json.RawMessage) bool {
+	trimmed := bytes.TrimSpace(value)
+	return len(trimmed) > 0 && trimmed[0] == '{'
+}
+
+func mergeJSONObject(current, patch json.RawMessage) (json.RawMessage, error) {
+	var members, changes map[string]json.RawMessage
+	if err := json.Unmarshal(current, &members); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &changes); err != nil {
+		return nil, err
+	}
+	for name, value := range changes {
+		if string(value) == "null" {
+			delete(members, name)
+		} else {
+			members[name] = value
+		}
+	}
+	return json.Marshal(members)
+}
+
+func setSchemaHeaders(w http.ResponseWriter, r *http.Request, used []fieldAlias) {
+	w.Header().Set("X-Schema-Version", strconv.Itoa(fishSchemaVersion))
+
+	if len(used) == 0 {
+		return
+	}
+
+	names := make([]string, len(used))
+	for i, alias := range used {
+		names[i] = alias.deprecated
+		w.Header().Add("Warning", fmt.Sprintf(`299 - "field '%s' is deprecated since schema version %d, use '%s'"`, alias.deprecated, alias.since, alias.current))
+		alias.notice.announce(w, r, "field", alias.deprecated)
+	}
+	w.Header().Set("X-Deprecated-Fields", strings.Join(names, ", "))
+}
@@ -0,0 +1,105 @@
+package fishes
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const secretCommandTimeout = 10 * time.Second
+
+// A secret setting can also be given as <key>_file, read from that path as
+// Docker and Kubernetes mount secrets, or as <key>_command, the output of a
+// shell command such as a vault client. Trailing newlines are dropped. Where
+// a setting of that name already exists, like encryption_key_file, it keeps
+// its own meaning.
+var secretSources = []string{"_file", "_command"}
+
+// secretSourceKeys maps the <key>_file and <key>_command names of the secret
+// fields to the field they fill.
+func secretSourceKeys(fields []configField) map[string]configField {
+	known := map[string]bool{}
+	for _, f := range fields {
+		known[f.key] = true
+	}
+	sources := map[string]configField{}
+	for _, f := range fields {
+		if !f.secret {
+			continue
+		}
+		for _, suffix := range secretSources {
+			if !known[f.key+suffix] {
+				sources[f.key+suffix] = f
+			}
+		}
+	}
+	return sources
+}
+
+// readSecret resolves a <key>_file or <key>_command value. Errors never
+// include what was read.
+func readSecret(key, raw string) (string, error) {
+	var out []byte
+	if strings.HasSuffix(key, "_file") {
+		var err error
+		if out, err = ioutil.ReadFile(raw); err != nil {
+			return "", err
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), secretCommandTimeout)
+		defer cancel()
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, "sh", "-c", raw)
+		cmd.Stderr = &stderr
+		var err error
+		if out, err = cmd.Output(); err != nil {
+			if ctx.Err() != nil {
+				return "", fmt.Errorf("command timed out after %s", secretCommandTimeout)
+			}
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return "", fmt.Errorf("command failed: %s: %s", err, msg)
+			}
+			return "", fmt.Errorf("command failed: %s", err)
+		}
+	}
+	secret := strings.TrimRight(string(out), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("%s gave an empty secret", key)
+	}
+	return secret, nil
+}
+
+// setSecrets applies the secret sources present in values, as returned by
+// lookup, to their fields. Giving both the setting and one of its sources in
+// the same layer is an error, since only one of them can win.
+func setSecrets(fields []configField, lookup func(key string) (string, bool), name func(key string) string) error {
+	sources := secretSourceKeys(fields)
+	for key, f := range sources {
+		raw, ok := lookup(key)
+		if !ok {
+			continue
+		}
+		if _, plain := lookup(f.key); plain {
+			return fmt.Errorf("%s: set only one of %s and %s", name(key), name(f.key), name(key))
+		}
+		for _, suffix := range secretSources {
+			if other := f.key + suffix; other != key {
+				if _, both := lookup(other); both && sources[other].key == f.key {
+					return fmt.Errorf("%s: set only one of %s and %s", name(key), name(key), name(other))
+				}
+			}
+		}
+		secret, err := readSecret(key, raw)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name(key), err)
+		}
+		if err := f.set(secret); err != nil {
+			return fmt.Errorf("%s: invalid value", name(key))
+		}
+	}
+	return nil
+}
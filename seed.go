@@ -0,0 +1,87 @@
+package fishes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// readSeedFile loads fishes from a CSV file, or from JSON holding either an
+// array of fishes or an object with a fishes array such as a snapshot.
+func readSeedFile(path string) ([]Fish, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		fishes, rowErrors, _, err := parseFishCSV(data, "")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		if len(rowErrors) > 0 {
+			return nil, fmt.Errorf("%s: row %d: %s", path, rowErrors[0].Row, rowErrors[0].Error)
+		}
+		return fishes, nil
+	}
+
+	var records []json.RawMessage
+	if err := json.Unmarshal(data, &records); err != nil {
+		var wrapped struct {
+			Fishes []json.RawMessage `json:"fishes"`
+		}
+		if json.Unmarshal(data, &wrapped) != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		records = wrapped.Fishes
+	}
+	return decodeFishRecords(path, records)
+}
+
+func decodeFishRecords(path string, records []json.RawMessage) ([]Fish, error) {
+	fishes := make([]Fish, 0, len(records))
+	for i, record := range records {
+		fish, _, err := decodeFish(record)
+		if err == nil {
+			err = validateEnvironment(fish.Environment)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: fish %d: %s", path, i, err)
+		}
+		fishes = append(fishes, fish)
+	}
+	return fishes, nil
+}
+
+// seed adds the fishes in path if the store is empty and reports how many
+// were added. Fishes keep their id when the file has one.
+func (h *fishesHandler) seed(path string) (int, error) {
+	fishes, err := readSeedFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if len(h.db) > 0 {
+		return 0, nil
+	}
+	for _, fish := range fishes {
+		if fish.ID == "" {
+			fish.ID = h.ids.NewID()
+		}
+		if fish.Version == 0 {
+			fish.Version = 1
+		}
+		fish.Slug = ""
+		fish.DeletedAt = nil
+		h.assignSlug(&fish)
+		h.stampUpdated(&fish)
+		if _, err := h.put(fish); err != nil {
+			return 0, err
+		}
+	}
+	return len(fishes), nil
+}
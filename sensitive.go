@@ -0,0 +1,186 @@
+package fishes
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// sealedFieldPrefix marks a field value that was encrypted for storage.
+const sealedFieldPrefix = "sealed:"
+
+type sensitiveField struct {
+	index int
+	name  string
+}
+
+// sensitiveFields are the Fish fields tagged `encrypted:"true"`. They are
+// sealed with the data key wherever a fish is written down, in the snapshot,
+// the operation log, the archive and exports, and only shown to admins.
+var sensitiveFields = fishSensitiveFields()
+
+func fishSensitiveFields() []sensitiveField {
+	var fields []sensitiveField
+	t := reflect.TypeOf(Fish{})
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.Tag.Get("encrypted") != "true" {
+			continue
+		}
+		if sf.Type.Kind() != reflect.String {
+			panic("only string fields can be encrypted, " + sf.Name + " is " + sf.Type.String())
+		}
+		fields = append(fields, sensitiveField{index: i, name: strings.Split(sf.Tag.Get("json"), ",")[0]})
+	}
+	return fields
+}
+
+func (f Fish) hasSensitive() bool {
+	v := reflect.ValueOf(f)
+	for _, field := range sensitiveFields {
+		if v.Field(field.index).String() != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// redacted returns f without its sensitive fields.
+func (f Fish) redacted() Fish {
+	v := reflect.ValueOf(&f).Elem()
+	for _, field := range sensitiveFields {
+		v.Field(field.index).SetString("")
+	}
+	return f
+}
+
+func redactFishes(fishes []Fish) {
+	for i := range fishes {
+		fishes[i] = fishes[i].redacted()
+	}
+}
+
+// checkSensitive refuses sensitive values when there is no key to seal them
+// with.
+func (h *fishesHandler) checkSensitive(f Fish) error {
+	v := reflect.ValueOf(f)
+	for _, field := range sensitiveFields {
+		value := v.Field(field.index).String()
+		if strings.HasPrefix(value, sealedFieldPrefix) {
+			return fmt.Errorf("%s cannot start with %q", field.name, sealedFieldPrefix)
+		}
+		if value != "" && h.keys.current() == nil {
+			return fmt.Errorf("%s is encrypted at rest, set encryption_key to store it", field.name)
+		}
+	}
+	return nil
+}
+
+// openImported opens the sealed fields of an imported dataset and checks
+// the plain ones can be sealed.
+func (h *fishesHandler) openImported(snap *snapshot) []string {
+	var problems []string
+	for section, fishes := range map[string][]Fish{"fishes.json": snap.Fishes, "trash.json": snap.Trash} {
+		for i, fish := range fishes {
+			opened, err := h.keys.openFish(fish)
+			if err == nil {
+				err = h.checkSensitive(opened)
+			}
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s[%d]: %s", section, i, err))
+			}
+			fishes[i] = opened
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// revealSensitive reports whether r may see sensitive fields, which takes
+// admin credentials or a signed request from an address the admin portal
+// accepts.
+func (h *fishesHandler) revealSensitive(r *http.Request) bool {
+	cfg := h.config()
+	if !h.authorized(r) {
+		return false
+	}
+	access, err := parseAdminAccess(cfg.AdminAllow, cfg.AdminDeny)
+	return err == nil && access.permits(hostIP(r.RemoteAddr))
+}
+
+func adminCredentials(r *http.Request, password string) bool {
+	user, pass, ok := r.BasicAuth()
+	return ok && user == "admin" && subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+}
+
+func (k *keyring) sealFish(f Fish) (Fish, error) {
+	if !f.hasSensitive() {
+		return f, nil
+	}
+	if k.current() == nil {
+		return f, fmt.Errorf("fish %s has encrypted fields but no encryption_key is configured", f.ID)
+	}
+	v := reflect.ValueOf(&f).Elem()
+	for _, field := range sensitiveFields {
+		value := v.Field(field.index).String()
+		if value == "" || strings.HasPrefix(value, sealedFieldPrefix) {
+			continue
+		}
+		sealed, err := k.seal([]byte(value))
+		if err != nil {
+			return f, err
+		}
+		v.Field(field.index).SetString(sealedFieldPrefix + base64.StdEncoding.EncodeToString(sealed))
+	}
+	return f, nil
+}
+
+func (k *keyring) openFish(f Fish) (Fish, error) {
+	v := reflect.ValueOf(&f).Elem()
+	for _, field := range sensitiveFields {
+		value := v.Field(field.index).String()
+		if !strings.HasPrefix(value, sealedFieldPrefix) {
+			continue
+		}
+		sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, sealedFieldPrefix))
+		if err != nil {
+			return f, fmt.Errorf("fish %s: %s: %s", f.ID, field.name, err)
+		}
+		plain, err := k.open(sealed)
+		if err != nil {
+			return f, fmt.Errorf("fish %s: %s: %s", f.ID, field.name, err)
+		}
+		v.Field(field.index).SetString(string(plain))
+	}
+	return f, nil
+}
+
+// sealFishes returns a copy of fishes with the sensitive fields sealed.
+func (k *keyring) sealFishes(fishes []Fish) ([]Fish, error) {
+	if fishes == nil {
+		return nil, nil
+	}
+	sealed := make([]Fish, len(fishes))
+	for i, fish := range fishes {
+		var err error
+		if sealed[i], err = k.sealFish(fish); err != nil {
+			return nil, err
+		}
+	}
+	return sealed, nil
+}
+
+// openFishes opens the sealed fields of fishes in place.
+func (k *keyring) openFishes(fishes []Fish) error {
+	for i, fish := range fishes {
+		var err error
+		if fishes[i], err = k.openFish(fish); err != nil {
+			return err
+		}
+	}
+	return nil
+}
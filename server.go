@@ -1,65 +1,190 @@
-package main
+package fishes
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
+	"log"
 	"net/http"
-	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// fishclient declares the same Fish, regenerate it after changing this one.
+//go:generate go run ./cmd/fishclientgen
+
 type Fish struct {
-	ID          string `json:"id,omitempty"`
-	Name        string `json:"name,omitempty"`
-	Environment string `json:"environment,omitempty"`
-	MaxLength   int    `json:"max_length,omitempty"`
+	ID             string      `json:"id,omitempty"`
+	Name           string      `json:"name,omitempty"`
+	Slug           string      `json:"slug,omitempty"`
+	ScientificName string      `json:"scientific_name,omitempty"`
+	Environment    Environment `json:"environment,omitempty"`
+	MaxLength      int         `json:"max_length_cm,omitempty"`
+	OwnerContact   string      `json:"owner_contact,omitempty" encrypted:"true"`
+	Extensions     Extensions  `json:"extensions,omitempty"`
+	Version        int         `json:"version,omitempty"`
+	UpdatedAt      *time.Time  `json:"updated_at,omitempty"`
+	ExpiresAt      *time.Time  `json:"expires_at,omitempty"`
+	DeletedAt      *time.Time  `json:"deleted_at,omitempty"`
 }
 
 type fishesHandler struct {
-	sync.Mutex
-	db map[string]Fish
+	storeLock
+	db          map[string]Fish
+	encoded     map[string]*encodedFish
+	slugs       map[string]string
+	trash       map[string]Fish
+	version     uint64
+	modified    time.Time
+	idempotency *idempotencyCache
+	ids         IDGenerator
+	cache       *responseCache
+	settings    atomic.Value
+	dirty       bool
+	oplog       *opLog
+	audit       *authAudit
+	verifier    *requestVerifier
+	archive     *archive
+	keys        *keyring
+	crdt        *lwwMap
+	clock       Clock
+	random      RandSource
+	quota       int
+	fields      customFields
+	redactions  *redactionSet
+	exports     exportArtifacts
+	memoryBytes int64
 }
 
-func newFishesHander() *fishesHandler {
-	return &fishesHandler{
-		db: map[string]Fish{},
+func newFishesHander(cfg *Config, ids IDGenerator, cache *responseCache) *fishesHandler {
+	h := &fishesHandler{
+		cache:       cache,
+		db:          map[string]Fish{},
+		encoded:     map[string]*encodedFish{},
+		slugs:       map[string]string{},
+		trash:       map[string]Fish{},
+		ids:         ids,
+		idempotency: newIdempotencyCache(cfg.IdempotencyTTL),
+		audit:       newAuthAudit(),
+		verifier:    newRequestVerifier(),
+		clock:       systemClock{},
+		random:      systemRand{},
 	}
+	h.settings.Store(cfg)
+	return h
+}
+
+func (h *fishesHandler) config() *Config {
+	return h.settings.Load().(*Config)
 }
 
-func (h *fishesHandler) getAllFishes(w http.ResponseWriter, r *http.Request) {
-	var fishes []Fish
+func (h *fishesHandler) getAllFishes(w http.ResponseWriter, r *http.Request, q queryValues) {
+	fishes := []Fish{}
+
+	now := h.clock.Now()
+	includeExpired := q.bool("include_expired")
 
+	w.Header().Set("Accept-Ranges", itemsUnit)
 	h.Lock()
+	version, modified := h.version, h.modified
+	etag := collectionETag(version, r.URL.RawQuery, apiVersion(r), h.wantsEnvelope(r))
+	if checkNotModified(w, r, etag, modified) {
+		h.Unlock()
+		return
+	}
+	// Archived fishes are listed from their segments and stay there.
+	archived, err := h.archivedFishes()
+	if err != nil {
+		h.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	add := func(fish Fish) {
+		if !includeExpired && fish.expired(now) {
+			return
+		}
+		if matchesFishFilter(fish, q) && h.fields.matches(fish, q) {
+			fishes = append(fishes, fish)
+		}
+	}
 	for _, fish := range h.db {
-		fishes = append(fishes, fish)
+		add(fish)
+	}
+	for _, fish := range archived {
+		add(fish)
 	}
 	h.Unlock()
 
-	jsonBytes, err := json.Marshal(fishes)
+	total := len(fishes)
+	limit, offset := q.int("limit"), q.int("offset")
+	// A Range in items pages the list in place of limit and offset.
+	rng, ranged, err := requestedItems(r, etag, modified)
+	if err != nil {
+		writeRangeNotSatisfiable(w, total, err.Error())
+		return
+	}
+	if ranged && rng.first > 0 && rng.first >= total {
+		writeRangeNotSatisfiable(w, total, fmt.Sprintf("the range starts past the end of the %d fishes", total))
+		return
+	}
+	ranged = ranged && total > 0
+	if ranged {
+		limit, offset = rng.page(total, maxListLimit)
+	}
+	sortFishes(fishes, q.str("sort"))
+	fishes = paginateFishes(fishes, limit, offset)
+	h.visibleFishes(r, fishes)
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	err = marshalListBody(buf, r, h.wantsEnvelope(r), versionedFishes(r, fishes), listMeta{
+		Total:   total,
+		Limit:   limit,
+		Offset:  offset,
+		Version: version,
+	})
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
+		return
 	}
 
+	setSchemaHeaders(w, r, nil)
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	w.Header().Set("X-Limit", strconv.Itoa(limit))
+	w.Header().Set("X-Offset", strconv.Itoa(offset))
 	w.Header().Add("content-type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(jsonBytes)
+	if ranged {
+		w.Header().Set("Content-Range", fmt.Sprintf("%s %d-%d/%d", itemsUnit, offset, offset+len(fishes)-1, total))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.Write(buf.Bytes())
 }
 
 func (h *fishesHandler) getRandomCoaster(w http.ResponseWriter, r *http.Request) {
-	ids := make([]string, len(h.db))
-
 	h.Lock()
-	i := 0
+	ids := make([]string, 0, len(h.db))
 	for id := range h.db {
-		ids[i] = id
-		i++
+		ids = append(ids, id)
+	}
+	if h.archive != nil {
+		for id := range h.archive.index {
+			ids = append(ids, id)
+		}
 	}
 	h.Unlock()
+	// In map order the same draw would name a different fish every time.
+	sort.Strings(ids)
 
 	var target string
 	if len(ids) == 0 {
@@ -68,92 +193,236 @@ func (h *fishesHandler) getRandomCoaster(w http.ResponseWriter, r *http.Request)
 	} else if len(ids) == 1 {
 		target = ids[0]
 	} else {
-		rand.Seed(time.Now().UnixNano())
-		target = ids[rand.Intn(len(ids))]
+		target = ids[h.random.Intn(len(ids))]
 	}
 
 	w.Header().Add("location", fmt.Sprintf("/fishes/%s", target))
 	w.WriteHeader(http.StatusFound)
 }
 
-func (h *fishesHandler) getFish(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(r.URL.String(), "/")
+func (h *fishesHandler) fish(w http.ResponseWriter, r *http.Request) {
+	key, sub, ok := fishPath(r.URL.Path)
 
-	if len(parts) != 3 {
+	if !ok {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	if parts[2] == "random" {
-		h.getRandomCoaster(w, r)
+	if key != "random" {
+		h.Lock()
+		if err := h.rehydrate(key); err != nil {
+			h.Unlock()
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		_, isID := h.db[key]
+		if isID && h.archive != nil {
+			h.archive.touch(key, h.clock.Now())
+		}
+		id, isSlug := "", false
+		if !isID {
+			id, isSlug = h.resolveSlug(key)
+		}
+		h.Unlock()
+
+		if !isID && isSlug {
+			status := http.StatusPermanentRedirect
+			if r.Method == "GET" {
+				status = http.StatusMovedPermanently
+			}
+			location := "/fishes/" + id
+			if sub != "" {
+				location += "/" + sub
+			}
+			w.Header().Add("location", location)
+			w.WriteHeader(status)
+			return
+		}
+	}
+
+	if sub != "" {
+		h.fishSubresource(w, r, key, sub)
 		return
 	}
 
+	switch r.Method {
+	case "GET":
+		{
+			if key == "random" {
+				h.getRandomCoaster(w, r)
+				return
+			}
+			if ttl := h.config().CacheTTLs["/fishes/{id}"]; ttl > 0 {
+				h.cache.wrap("/fishes/{id}", "fishes", ttl, func(w http.ResponseWriter, r *http.Request) {
+					h.getFish(w, r, key)
+				})(w, r)
+				return
+			}
+			h.getFish(w, r, key)
+			return
+		}
+	case "PUT":
+		{
+			h.replaceFish(w, r, key)
+			return
+		}
+	case "PATCH":
+		{
+			h.patchFish(w, r, key)
+			return
+		}
+	case "DELETE":
+		{
+			h.deleteFish(w, r, key)
+			return
+		}
+	default:
+		{
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("method not allowed"))
+			return
+		}
+	}
+}
+
+func (h *fishesHandler) getFish(w http.ResponseWriter, r *http.Request, id string) {
 	h.Lock()
-	defer h.Unlock()
-	foundFish, ok := h.db[parts[2]]
+	enc, ok := h.encoded[id]
+	h.Unlock()
 
-	if !ok {
+	if !ok || (!enc.expires.IsZero() && !h.clock.Now().Before(enc.expires)) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	jsonBytes, err := json.Marshal(foundFish)
-
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	view := h.view(r, enc)
+	body := h.itemBody(r, view)
+	header := w.Header()
+	header["Etag"] = body.etagHeader
+	header["Cache-Control"] = cacheControlHeader
+	if view != enc {
+		header["Cache-Control"] = privateCacheControlHeader
+	}
+	setLastModified(w, view)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, body.etag, true) || notModifiedSince(r, view.modified) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
-	w.Header().Add("content-type", "application/json")
+	header["X-Schema-Version"] = schemaVersionHeader
+	header["Content-Type"] = jsonContentType
 	w.WriteHeader(http.StatusOK)
-	w.Write(jsonBytes)
+	w.Write(body.bytes)
 }
 
-func (h *fishesHandler) addNewFish(w http.ResponseWriter, r *http.Request) {
+func readJSONBody(w http.ResponseWriter, r *http.Request, contentTypes ...string) ([]byte, bool) {
 	bodyBytes, err := ioutil.ReadAll(r.Body)
 	defer r.Body.Close()
 
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
-		return
+		return nil, false
+	}
+
+	if len(contentTypes) == 0 {
+		contentTypes = []string{"application/json"}
 	}
 
 	ct := r.Header.Get("content-type")
-	if ct != "application/json" {
-		w.WriteHeader(http.StatusUnsupportedMediaType)
-		w.Write([]byte(fmt.Sprintf("need content-type 'application/json' but got '%s'", ct)))
+	for _, allowed := range contentTypes {
+		if ct == allowed {
+			return bodyBytes, true
+		}
+	}
+
+	w.WriteHeader(http.StatusUnsupportedMediaType)
+	w.Write([]byte(fmt.Sprintf("need content-type '%s' but got '%s'", strings.Join(contentTypes, "' or '"), ct)))
+	return nil, false
+}
+
+func (h *fishesHandler) addNewFish(w http.ResponseWriter, r *http.Request) {
+	bodyBytes, ok := readJSONBody(w, r)
+	if !ok {
 		return
 	}
 
-	var fish Fish
-	err = json.Unmarshal(bodyBytes, &fish)
+	fish, deprecated, err := decodeFish(bodyBytes)
 
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
+		return
 	}
 
-	fish.ID = fmt.Sprintf("%d", time.Now().UnixNano())
+	if err := validateEnvironment(fish.Environment); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := h.checkSensitive(fish); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	fish.ID = h.ids.NewID()
+	fish.Version = 1
+	fish.DeletedAt = nil
+
+	setSchemaHeaders(w, r, deprecated)
 
 	h.Lock()
-	defer h.Unlock()
+	if modifiedSince(r, h.modified) {
+		h.Unlock()
+		w.WriteHeader(http.StatusPreconditionFailed)
+		w.Write([]byte("the fishes were modified after If-Unmodified-Since"))
+		return
+	}
+	if err := h.overQuota(1); err != nil {
+		h.Unlock()
+		w.Header().Set("X-Quota-Exceeded", "records")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := h.fields.validate(fish.Extensions); err != nil {
+		h.Unlock()
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	h.assignSlug(&fish)
+	h.stampUpdated(&fish)
+	enc, err := h.put(fish)
+	h.Unlock()
 
-	h.db[fish.ID] = fish
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
+	w.Header().Add("location", fmt.Sprintf("/fishes/%s", fish.ID))
+	w.Header().Add("content-type", "application/json")
+	body := h.itemBody(r, h.view(r, enc))
+	w.Header()["Etag"] = body.etagHeader
+	setLastModified(w, enc)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(body.bytes)
 }
 
 func (h *fishesHandler) fishes(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		{
-			h.getAllFishes(w, r)
+			h.cache.wrap("/fishes", "fishes", h.config().CacheTTLs["/fishes"], validateQuery(h.listParams(), h.getAllFishes))(w, r)
 			return
 		}
 	case "POST":
 		{
-			h.addNewFish(w, r)
+			h.idempotency.wrap(h.clock, h.principal, h.addNewFish)(w, r)
 			return
 		}
 	default:
@@ -166,42 +435,472 @@ func (h *fishesHandler) fishes(w http.ResponseWriter, r *http.Request) {
 }
 
 type adminPortal struct {
-	password string
+	fishes          *fishesHandler
+	routes          *routeRegistry
+	tenants         *tenantRouter
+	backupScheduler *backupScheduler
+	reporter        *reporter
+	persister       *persister
+	scheduler       *scheduler
+	signer          *urlSigner
+	guard           *memoryGuard
+	draining        <-chan struct{}
 }
 
-func newAdminPortal() *adminPortal {
-	password := os.Getenv("ADMIN_PASSWORD")
-	if password == "" {
-		panic("required env variable ADMIN_PASSWORD not set")
-	}
+func newAdminPortal(fishes *fishesHandler, routes *routeRegistry) *adminPortal {
+	return &adminPortal{fishes: fishes, routes: routes}
+}
 
-	return &adminPortal{password: password}
+func (a *adminPortal) protect(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// A signed link is meant to be shared, so it works from anywhere.
+		if signedRequest(r) {
+			next(w, r)
+			return
+		}
+		if !a.reachable(w, r) {
+			return
+		}
+		ok, _, err := a.fishes.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			if err != nil && err != errBadSignature {
+				w.Write([]byte(err.Error()))
+				return
+			}
+			w.Write([]byte("You do not have the right permission"))
+			return
+		}
+		next(w, r)
+	}
 }
 
 func (a *adminPortal) handler(w http.ResponseWriter, r *http.Request) {
-	user, pass, ok := r.BasicAuth()
-	if !ok || user != "admin" || pass != a.password {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("You do not have the right permission"))
-		return
+	renderAdmin(w, "index", nil)
+}
+
+// Main runs the server configured by the command line, the environment and
+// config_file until SIGINT or SIGTERM. It is what the fishes command does.
+func Main() {
+	cfg := mustLoadConfig()
+
+	var clock Clock = systemClock{}
+	var random RandSource = systemRand{}
+	var controls http.HandlerFunc
+	if testControls != nil {
+		clock, random, controls = testControls()
 	}
 
-	w.Write([]byte("<html><h1>Super secret admin portal </h1></html>"))
+	server, reloadConfig, err := assemble(cfg, clock, random, controls)
+	if err != nil {
+		panic(err)
+	}
+	go watchReload(reloadConfig)
+
+	if err := server.run(); err != nil {
+		panic(err)
+	}
 }
 
-func main() {
-	admin := newAdminPortal()
+// NewHandler builds a server for the caller to serve, such as fishestest on
+// an httptest.Server, configured as Main is by the environment with getenv
+// in place of os.Getenv. deterministic gives it the clock, random source and
+// /admin/test/ routes of a server built with the fishestest tag. close runs
+// what the server runs on shutdown; call it once it serves no more requests.
+func NewHandler(getenv func(string) string, deterministic bool) (handler http.Handler, close func() error, err error) {
+	loaded, err := loadConfig(nil, getenv)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The startup checks are of what Main needs, its listeners among them,
+	// but a bad setting stops either.
+	if problems := loaded.problems(); len(problems) > 0 {
+		return nil, nil, errors.New(strings.Join(problems, "; "))
+	}
 
-	fishesHandler := newFishesHander()
+	var clock Clock = systemClock{}
+	var random RandSource = systemRand{}
+	var controls http.HandlerFunc
+	if deterministic {
+		clock, random, controls = deterministicControls()
+	}
+	server, _, err := assemble(loaded.Config, clock, random, controls)
+	if err != nil {
+		return nil, nil, err
+	}
+	return server.handler, server.close, nil
+}
 
-	http.HandleFunc("/admin", admin.handler)
+// assemble puts together the server of cfg, its background jobs started, and
+// returns it with what reloads its config.
+func assemble(cfg *Config, clock Clock, random RandSource, controls http.HandlerFunc) (*gracefulServer, func(), error) {
+	ids, err := newIDGenerator(cfg.IDGenerator, cfg.NodeID, clock, random)
+	if err != nil {
+		return nil, nil, err
+	}
+	routes := newRouteRegistry()
+
+	cache := newResponseCache()
+
+	fishesHandler := newFishesHander(cfg, ids, cache)
+	fishesHandler.clock, fishesHandler.random = clock, random
+
+	admin := newAdminPortal(fishesHandler, routes)
+	signer := &urlSigner{config: fishesHandler.config, clock: clock}
+	admin.signer = signer
+
+	admin.handle("/admin", admin.handler)
+	admin.handle("/admin/export", admin.export)
+	admin.handle("/admin/import", admin.importArchive)
+	admin.handle("/admin/backups", admin.backups)
+	admin.handle("/admin/restore", admin.restore)
+	admin.handle("/admin/generate", admin.generate)
+	admin.handle("/admin/integrity", admin.integrity)
+	admin.handle("/admin/encryption", admin.encryption)
+	admin.handle("/admin/encryption/rotate", admin.rotateKey)
+	admin.handle("/admin/archive", admin.archive)
+	admin.handle("/admin/contention", admin.contention)
+	admin.handle("/admin/explorer", admin.explore)
+	admin.handle("/admin/reports", admin.reports)
+	admin.handle("/admin/reports/", admin.reports)
+	admin.handle("/admin/audit/auth", validateQuery(authAuditParams, admin.auditAuth))
+	admin.handle("/admin/signed-urls", admin.signURL)
+	admin.handle("/admin/access", admin.access)
+	admin.handle("/admin/undo", admin.undo)
+	admin.handle("/admin/jobs", admin.jobs)
+	admin.handle("/admin/jobs/", admin.jobs)
+	admin.handle("/admin/replication", validateQuery(replicationFeedParams, admin.replicationFeed))
+	admin.handle("/admin/replication/snapshot", admin.replicationSnapshot)
+	if controls != nil {
+		admin.handle("/admin/test/", controls)
+	}
 
-	http.HandleFunc("/fishes", fishesHandler.fishes)
-	http.HandleFunc("/fishes/", fishesHandler.getFish)
+	routes.handle("/environments", cache.wrap("/environments", "environments", cfg.CacheTTLs["/environments"], getEnvironments))
 
-	err := http.ListenAndServe(":8080", nil)
+	routes.handle("/metrics", metrics.handler)
 
+	routes.handle("/fishes", fishesHandler.fishes)
+	routes.handle("/fishes/", fishesHandler.fish)
+	routes.handle("/fishes/import", fishesHandler.importFishes)
+	routes.handle("/fishes/trash", validateQuery(listTrashParams, fishesHandler.getTrash))
+
+	listeners, err := cfg.listenerSpecs()
 	if err != nil {
-		panic(err)
+		return nil, nil, err
+	}
+	proxies, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, nil, err
+	}
+	hosts, err := parseHostRouter(cfg.Hosts)
+	if err != nil {
+		return nil, nil, err
+	}
+	schedules, err := parseJobSchedules(cfg.JobSchedules)
+	if err != nil {
+		return nil, nil, err
+	}
+	var replication *replica
+	if cfg.ReplicaOf != "" {
+		if replication, err = newReplicaOf(fishesHandler); err != nil {
+			return nil, nil, err
+		}
+	}
+	var members *membership
+	if len(cfg.Seeds) > 0 {
+		members = newMembership(fishesHandler)
+		admin.handle("/admin/gossip", members.gossip)
+		admin.handle("/cluster/members", members.membersList)
+	}
+	var cluster *clusterNode
+	if cfg.electionEnabled() {
+		if cluster, err = newClusterNode(fishesHandler); err != nil {
+			return nil, nil, err
+		}
+		cluster.members = members
+		admin.handle("/admin/cluster", cluster.status)
+		admin.handle("/admin/cluster/vote", cluster.vote)
+		admin.handle("/admin/cluster/heartbeat", cluster.heartbeat)
+		admin.handle("/admin/cluster/nodes", cluster.nodes)
+	}
+	var partitions *partitioner
+	if cfg.ClusterMode == clusterModePartitioned {
+		partitions = newPartitioner(fishesHandler, members)
+		fishesHandler.ids = ownedIDs{IDGenerator: fishesHandler.ids, p: partitions}
+		admin.handle("/admin/partition", partitions.status)
+		admin.handle("/admin/partition/handoff", partitions.handoff)
+	}
+	routes.handle("/healthz", healthz(fishesHandler, replication, cluster))
+	topo := newTopology(fishesHandler, replication, cluster, members)
+	admin.handle("/cluster/status", topo.status)
+
+	flags := newFeatureFlags(fishesHandler)
+	admin.handle("/admin/flags", flags.serve)
+	redactions := newRedactionSet(fishesHandler)
+	fishesHandler.redactions = redactions
+	admin.handle("/admin/redactions", redactions.serve)
+	admin.handle("/admin/redactions/", redactions.serve)
+	async := newAsyncWrites(clock, cfg.AsyncWorkers, cfg.AsyncQueue, func() time.Duration { return fishesHandler.config().AsyncJobTTL })
+	async.flags = flags
+	routes.handle("/jobs/", async.status)
+	routes.handle("/openapi.json", openAPI(fishesHandler.config, routes))
+	routes.handle("/docs", apiExplorer)
+	routes.handle("/assets/", serveAsset)
+	rpc := &rpcEndpoint{}
+	routes.handle("/rpc", rpc.serve)
+	routes.handle("/graphql", (&graphQLEndpoint{calls: rpc}).serve)
+	tenants := newTenantRouter(fishesHandler, flags)
+	admin.tenants = tenants
+	admin.handle("/admin/tenants", tenants.serve)
+	admin.handle("/admin/tenants/", tenants.serve)
+	routes.handle("/namespaces", tenants.namespaces.serve)
+	routes.handle("/namespaces/", tenants.namespaces.serve)
+	quotas := newQuotaTracker(fishesHandler, tenants)
+	routes.handle("/usage", quotas.usage)
+	guard := newMemoryGuard(fishesHandler)
+	admin.guard = guard
+	tenants.chain = func(fs *fishStore) http.Handler {
+		return (&memoryGuard{fishes: fs.h}).wrap(async.wrap(signer.wrap(fs.h.withConsistencyTokens(fs.mux))))
+	}
+	var handler http.Handler = hosts.wrap(quotas.wrap(tenants.wrap(guard.wrap(async.wrap(signer.wrap(fishesHandler.withConsistencyTokens(routes.mux)))))))
+	if replication != nil {
+		handler = replication.wrap(handler)
+	}
+	if cluster != nil {
+		handler = cluster.wrap(handler)
+	}
+	if partitions != nil {
+		handler = partitions.wrap(handler)
+	}
+	rpc.next = handler
+	grpc := &grpcEndpoint{calls: rpc}
+	var shadowing *shadower
+	if cfg.ShadowURL != "" {
+		if shadowing, err = newShadower(fishesHandler); err != nil {
+			return nil, nil, err
+		}
+		handler = shadowing.wrap(handler)
+	}
+	admin.handle("/admin/shadow", shadowStatus(shadowing))
+	faults := &faultInjector{random: fishesHandler.random}
+	admin.handle("/admin/faults", faults.serve)
+	var mock *mockServer
+	if cfg.MockScenario != "" {
+		mock = &mockServer{path: cfg.MockScenario, h: fishesHandler, faults: faults}
+		admin.handle("/admin/mock", mock.serve)
 	}
+	slos := newSLOTracker(fishesHandler)
+	admin.handle("/admin/slo", slos.serve)
+	locales := newLocalizer(fishesHandler)
+	handler = newCompressor(fishesHandler).wrap(locales.wrap(flags.wrap(withAPIVersions(flags, withDeprecations(slos.wrap(proxies.wrap(faults.wrap(grpc.wrap(handler)))))))))
+	var recording *recorder
+	if cfg.RecordFile != "" {
+		if recording, err = newRecorder(cfg.RecordFile); err != nil {
+			return nil, nil, err
+		}
+		handler = recording.wrap(handler)
+	}
+	conns := newConnTracker(fishesHandler)
+	handler = conns.wrap(handler)
+	server := newGracefulServer(listeners, handler, cfg.DrainTimeout)
+	server.MaxHeaderBytes, server.IdleTimeout = cfg.MaxHeaderBytes, cfg.IdleTimeout
+	server.ConnState, server.ConnContext = conns.track, conns.connContext
+	server.onShutdown(async.drain)
+	server.onShutdown(fishesHandler.removeExportArtifact)
+	server.onShutdown(func() error {
+		// The process can go on without the server, as under NewHandler.
+		for _, c := range []collector{guard, slos, conns} {
+			metrics.unregister(c)
+		}
+		return nil
+	})
+	if recording != nil {
+		server.onShutdown(recording.close)
+	}
+	if cfg.RPCListen != "" {
+		spec, err := parseListenSpec(cfg.RPCListen)
+		if err != nil {
+			return nil, nil, err
+		}
+		gobRPC := newGobListener(spec, rpc, server.drainingCh())
+		if err := gobRPC.listen(); err != nil {
+			return nil, nil, err
+		}
+		server.onShutdown(gobRPC.close)
+		server.onHandoff(gobRPC.close)
+	}
+	admin.draining = server.drainingCh()
+	jobs := newScheduler(schedules)
+	server.onShutdown(jobs.stop)
+	admin.scheduler = jobs
+
+	if cfg.TLSCert != "" {
+		certs, err := newCertReloader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		go certs.watch(cfg.TLSReload)
+		// HTTP/2 is offered for the gRPC clients, which need it.
+		server.TLSConfig = &tls.Config{GetCertificate: certs.getCertificate, MinVersion: tls.VersionTLS12, NextProtos: []string{"h2", "http/1.1"}}
+
+		if cfg.TLSRedirectAddr != "" {
+			server.serveAlongside(&http.Server{Addr: cfg.TLSRedirectAddr, Handler: redirectToHTTPS(cfg.httpsAddr())})
+		}
+	} else if cfg.ACMEDomain != "" {
+		cacheDir := cfg.ACMECacheDir
+		if cacheDir == "" {
+			cacheDir = filepath.Join(cfg.DataDir, "acme")
+		}
+		acme, err := newACMEManager(cfg.ACMEDomain, cfg.ACMEEmail, cfg.ACMEDirectory, cacheDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		go acme.run()
+		server.TLSConfig = &tls.Config{GetCertificate: acme.getCertificate, MinVersion: tls.VersionTLS12, NextProtos: []string{"h2", "http/1.1"}}
+		server.serveAlongside(&http.Server{Addr: cfg.TLSRedirectAddr, Handler: acme.challengeHandler(redirectToHTTPS(cfg.httpsAddr()))})
+	}
+
+	keys, err := newKeyring(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	fishesHandler.keys = keys
+
+	reloadConfig := func() { reload(fishesHandler, nil, server) }
+	if cfg.DataDir != "" {
+		fishesHandler.archive = newArchive(cfg.DataDir, keys)
+		persister, err := newPersister(cfg.DataDir, fishesHandler)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := openOpLog(cfg.DataDir, fishesHandler); err != nil {
+			return nil, nil, err
+		}
+		admin.persister = persister
+		jobs.add("archive-sweep", every(fishesHandler.archiveSweepInterval), 0, fishesHandler.archiveColdNow)
+		jobs.add("snapshot", every(func() time.Duration { return fishesHandler.config().SnapshotInterval }), 0, persister.flush)
+		server.onShutdown(persister.flush)
+		server.onHandoff(persister.flush)
+		reloadConfig = func() { reload(fishesHandler, persister, server) }
+	}
+
+	if err := tenants.load(); err != nil {
+		return nil, nil, err
+	}
+	if err := flags.load(); err != nil {
+		return nil, nil, err
+	}
+	if err := locales.load(); err != nil {
+		return nil, nil, err
+	}
+	if err := redactions.load(); err != nil {
+		return nil, nil, err
+	}
+	jobs.add("tenant-snapshot", every(func() time.Duration { return fishesHandler.config().SnapshotInterval }), 0, tenants.flush)
+	jobs.add("tenant-sweep", every(func() time.Duration { return fishesHandler.config().ExpirySweepInterval }), 0, tenants.sweep)
+	server.onShutdown(tenants.flush)
+	server.onShutdown(tenants.removeExportArtifacts)
+
+	if members != nil {
+		jobs.add("gossip", every(func() time.Duration { return fishesHandler.config().GossipInterval }), 0, members.gossipNow)
+	}
+	if partitions != nil {
+		jobs.add("rebalance", every(func() time.Duration { return fishesHandler.config().GossipInterval }), 0, partitions.rebalanceNow)
+	}
+	if cfg.multiWriter() {
+		syncs, err := newSyncer(fishesHandler)
+		if err != nil {
+			return nil, nil, err
+		}
+		syncs.members = members
+		topo.syncs = syncs
+		admin.handle("/admin/sync", syncs.sync)
+		jobs.add("sync", every(func() time.Duration { return fishesHandler.config().SyncInterval }), 0, syncs.syncNow)
+		server.onShutdown(syncs.save)
+	}
+	mirrors, err := newMirrorReceiver(fishesHandler)
+	if err != nil {
+		return nil, nil, err
+	}
+	var mirroring *mirror
+	if cfg.MirrorTo != "" {
+		mirroring = newMirror(fishesHandler)
+		jobs.add("mirror", every(func() time.Duration { return fishesHandler.config().MirrorInterval }), 0, mirroring.pushNow)
+	}
+	admin.handle("/mirror", mirrors.receive)
+	admin.handle("/admin/mirror", mirrorStatus(mirroring, mirrors))
+	var publisher *mqttPublisher
+	if cfg.MQTTBroker != "" {
+		if publisher, err = newMQTTPublisher(fishesHandler); err != nil {
+			return nil, nil, err
+		}
+		go publisher.run()
+		server.onShutdown(publisher.close)
+	}
+	admin.handle("/admin/mqtt", mqttStatus(publisher))
+	if cfg.RemoteWriteURL != "" {
+		writer := newRemoteWriter(fishesHandler)
+		jobs.add("metrics-push", every(func() time.Duration { return fishesHandler.config().RemoteWriteInterval }), 0, writer.pushNow)
+		server.onShutdown(writer.pushNow)
+	}
+	if cluster != nil {
+		go cluster.run()
+		go cluster.follow.run()
+	}
+	if replication != nil {
+		// A replica takes its data, seeding and expiry included, from the
+		// primary.
+		go replication.run()
+	} else if mock != nil {
+		n, err := mock.load()
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("mock: serving %d fishes from %s, nothing is kept on disk", n, cfg.MockScenario)
+	} else if cfg.SeedFile != "" {
+		n, err := fishesHandler.seed(cfg.SeedFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		if n > 0 {
+			log.Printf("seeded %d fishes from %s", n, cfg.SeedFile)
+		}
+	}
+	if cluster != nil {
+		cluster.fenceWrites()
+	}
+
+	if replication == nil {
+		jobs.add("trash-purge", every(fishesHandler.trashPurgeInterval), time.Minute, cluster.leaderOnly(fishesHandler.purgeExpiredTrash))
+		jobs.add("expiry-sweep", every(func() time.Duration { return fishesHandler.config().ExpirySweepInterval }), 0, cluster.leaderOnly(fishesHandler.sweepExpiredNow))
+	}
+	jobs.add("async-jobs-expire", every(func() time.Duration { return time.Minute }), 0, async.expire)
+
+	if cfg.BackupDir != "" {
+		backups, err := newBackupScheduler(cfg, fishesHandler)
+		if err != nil {
+			return nil, nil, err
+		}
+		admin.backupScheduler = backups
+		jobs.add("backup", every(func() time.Duration { return cfg.BackupInterval }), 0, func() error {
+			_, err := backups.backup(context.Background())
+			return err
+		})
+	}
+
+	if cfg.ReportDir != "" {
+		reports, err := newReporter(cfg, fishesHandler)
+		if err != nil {
+			return nil, nil, err
+		}
+		admin.reporter = reports
+		weekly, err := parseCron(reportSchedule)
+		if err != nil {
+			return nil, nil, err
+		}
+		jobs.add(reportJob, weekly, 0, cluster.leaderOnly(reports.scheduled))
+	}
+
+	return server, reloadConfig, nil
 }
@@ -0,0 +1,344 @@
+package fishes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// shadowQueue is how many shadowed requests may wait for a worker;
+	// past it they are dropped rather than slowing down the real ones.
+	shadowQueue   = 256
+	shadowWorkers = 4
+	// maxShadowBody is the longest request or response body shadowed and
+	// compared.
+	maxShadowBody = 1 << 20
+	// maxDivergences is how many of the latest divergences /admin/shadow
+	// lists.
+	maxDivergences = 50
+)
+
+var shadowResults = newCounterVec("fishes_shadow_requests_total", "Requests shadowed to shadow_url by result: match, status, body, error or dropped.", "result")
+
+// unshadowedHeaders are hop-by-hop, and not passed on to the shadow.
+var unshadowedHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+type shadowCall struct {
+	at        time.Time
+	method    string
+	uri       string
+	header    http.Header
+	body      []byte
+	status    int
+	response  []byte
+	truncated bool
+}
+
+type shadowDivergence struct {
+	At           time.Time `json:"at"`
+	Method       string    `json:"method"`
+	URI          string    `json:"uri"`
+	Status       int       `json:"status"`
+	ShadowStatus int       `json:"shadow_status,omitempty"`
+	Difference   string    `json:"difference"`
+}
+
+// shadower sends a share of the requests served here to shadow_url as well,
+// typically a new version under test, and compares its answers with the
+// ones the clients got. The admin portal is never shadowed.
+type shadower struct {
+	fishes *fishesHandler
+	target *url.URL
+	client *http.Client
+	queue  chan shadowCall
+
+	sync.Mutex
+	counts      map[string]uint64
+	divergences []shadowDivergence
+}
+
+func newShadower(h *fishesHandler) (*shadower, error) {
+	target, err := url.Parse(strings.TrimSuffix(h.config().ShadowURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	s := &shadower{
+		fishes: h,
+		target: target,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			// Redirects are compared, not followed.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		queue:  make(chan shadowCall, shadowQueue),
+		counts: map[string]uint64{},
+	}
+	for i := 0; i < shadowWorkers; i++ {
+		go s.run()
+	}
+	return s, nil
+}
+
+func (s *shadower) sampled(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/admin") || r.Header.Get("X-Fish-Shadow") != "" {
+		return false
+	}
+	cfg := s.fishes.config()
+	methods := false
+	for _, m := range cfg.ShadowMethods {
+		methods = methods || strings.EqualFold(m, r.Method)
+	}
+	return methods && float64(s.fishes.random.Intn(1000000)) < cfg.ShadowPercent*10000
+}
+
+// shadowWriter keeps a copy of the response the client is sent.
+type shadowWriter struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (sw *shadowWriter) WriteHeader(status int) {
+	if sw.status == 0 && !informational(status) {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *shadowWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	if room := maxShadowBody - sw.body.Len(); len(b) > room {
+		sw.body.Write(b[:room])
+		sw.truncated = true
+	} else {
+		sw.body.Write(b)
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (s *shadower) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.sampled(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		call := shadowCall{at: time.Now().UTC(), method: r.Method, uri: r.RequestURI, header: r.Header.Clone()}
+		if r.Body != nil && r.Body != http.NoBody {
+			body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxShadowBody+1))
+			r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), errReader{err}, r.Body))
+			if err != nil || len(body) > maxShadowBody {
+				next.ServeHTTP(w, r)
+				return
+			}
+			call.body = body
+		}
+		sw := &shadowWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		call.status, call.response, call.truncated = sw.status, sw.body.Bytes(), sw.truncated
+		select {
+		case s.queue <- call:
+		default:
+			s.count("dropped")
+		}
+	})
+}
+
+func (s *shadower) count(result string) {
+	shadowResults.inc(result)
+	s.Lock()
+	s.counts[result]++
+	s.Unlock()
+}
+
+func (s *shadower) run() {
+	for call := range s.queue {
+		status, difference := s.compare(call)
+		if difference == "" {
+			s.count("match")
+			continue
+		}
+		result := "body"
+		switch {
+		case status == 0:
+			result = "error"
+		case status != call.status:
+			result = "status"
+		}
+		s.count(result)
+		s.Lock()
+		s.divergences = append(s.divergences, shadowDivergence{At: call.at, Method: call.method, URI: call.uri, Status: call.status, ShadowStatus: status, Difference: difference})
+		if n := len(s.divergences) - maxDivergences; n > 0 {
+			s.divergences = s.divergences[n:]
+		}
+		s.Unlock()
+	}
+}
+
+// compare sends call to the shadow and describes how its answer differs,
+// or returns "" when it does not. A status of 0 is a failed request.
+func (s *shadower) compare(call shadowCall) (int, string) {
+	req, err := http.NewRequest(call.method, s.target.String()+call.uri, bytes.NewReader(call.body))
+	if err != nil {
+		return 0, err.Error()
+	}
+	req.Header = call.header
+	for _, name := range unshadowedHeaders {
+		req.Header.Del(name)
+	}
+	req.Header.Set("X-Fish-Shadow", "1")
+	res, err := s.client.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxShadowBody+1))
+	if err != nil {
+		return 0, err.Error()
+	}
+	if res.StatusCode != call.status {
+		return res.StatusCode, fmt.Sprintf("status %d, shadow answered %d", call.status, res.StatusCode)
+	}
+	if call.truncated || len(body) > maxShadowBody {
+		return res.StatusCode, ""
+	}
+
+	var want, got interface{}
+	if json.Unmarshal(call.response, &want) != nil || json.Unmarshal(body, &got) != nil {
+		if !bytes.Equal(call.response, body) {
+			return res.StatusCode, fmt.Sprintf("bodies of %d and %d bytes differ", len(call.response), len(body))
+		}
+		return res.StatusCode, ""
+	}
+	for _, path := range s.fishes.config().ShadowIgnore {
+		parts := strings.Split(path, ".")
+		dropJSONPath(want, parts)
+		dropJSONPath(got, parts)
+	}
+	return res.StatusCode, jsonDifference("", want, got)
+}
+
+// dropJSONPath removes the field at path from v, stepping through the
+// elements of the arrays on the way.
+func dropJSONPath(v interface{}, path []string) {
+	switch v := v.(type) {
+	case []interface{}:
+		for _, item := range v {
+			dropJSONPath(item, path)
+		}
+	case map[string]interface{}:
+		if len(path) == 1 {
+			delete(v, path[0])
+		} else if len(path) > 1 {
+			dropJSONPath(v[path[0]], path[1:])
+		}
+	}
+}
+
+// jsonDifference names the first place a and b differ, "" when they are
+// equal.
+func jsonDifference(path string, a, b interface{}) string {
+	at := path
+	if at == "" {
+		at = "the body"
+	}
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok {
+			return at + " is an object, the shadow's is not"
+		}
+		keys := make([]string, 0, len(a)+len(b))
+		for key := range a {
+			keys = append(keys, key)
+		}
+		for key := range b {
+			if _, ok := a[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			field := strings.TrimPrefix(path+"."+key, ".")
+			av, inA := a[key]
+			bv, inB := b[key]
+			switch {
+			case !inB:
+				return field + " is missing from the shadow's answer"
+			case !inA:
+				return field + " is only in the shadow's answer"
+			}
+			if d := jsonDifference(field, av, bv); d != "" {
+				return d
+			}
+		}
+		return ""
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok {
+			return at + " is an array, the shadow's is not"
+		}
+		if len(a) != len(b) {
+			return fmt.Sprintf("%s has %d items, the shadow's %d", at, len(a), len(b))
+		}
+		for i := range a {
+			if d := jsonDifference(fmt.Sprintf("%s[%d]", path, i), a[i], b[i]); d != "" {
+				return d
+			}
+		}
+		return ""
+	}
+	if !reflect.DeepEqual(a, b) {
+		want, _ := json.Marshal(a)
+		got, _ := json.Marshal(b)
+		return fmt.Sprintf("%s is %s, the shadow's %s", at, want, got)
+	}
+	return ""
+}
+
+type shadowStatusReport struct {
+	URL         string             `json:"url"`
+	Percent     float64            `json:"percent"`
+	Results     map[string]uint64  `json:"results"`
+	Divergences []shadowDivergence `json:"divergences"`
+}
+
+func shadowStatus(s *shadower) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("method not allowed"))
+			return
+		}
+		if s == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("shadow_url is not set"))
+			return
+		}
+		s.Lock()
+		report := shadowStatusReport{URL: s.target.Redacted(), Percent: s.fishes.config().ShadowPercent, Results: map[string]uint64{}, Divergences: []shadowDivergence{}}
+		for result, n := range s.counts {
+			report.Results[result] = n
+		}
+		for i := len(s.divergences) - 1; i >= 0; i-- {
+			report.Divergences = append(report.Divergences, s.divergences[i])
+		}
+		s.Unlock()
+		writeJSON(w, http.StatusOK, report)
+	}
+}
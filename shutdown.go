@@ -0,0 +1,226 @@
+package fishes
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type gracefulServer struct {
+	TLSConfig      *tls.Config
+	MaxHeaderBytes int
+	IdleTimeout    time.Duration
+	ConnState      func(net.Conn, http.ConnState)
+	ConnContext    func(context.Context, net.Conn) context.Context
+	handler        http.Handler
+	listeners      []listenerSpec
+	servers        []*http.Server
+	drainTimeout   int64
+	draining       int32
+	drainStarted   chan struct{}
+	hooks          []func() error
+	handoffHooks   []func() error
+	companions     []*http.Server
+	raw            []net.Listener
+}
+
+func newGracefulServer(listeners []listenerSpec, handler http.Handler, drainTimeout time.Duration) *gracefulServer {
+	s := &gracefulServer{listeners: listeners, drainTimeout: int64(drainTimeout), drainStarted: make(chan struct{})}
+	s.handler = s.refuseWhileDraining(handler)
+	return s
+}
+
+func (s *gracefulServer) setDrainTimeout(d time.Duration) {
+	atomic.StoreInt64(&s.drainTimeout, int64(d))
+}
+
+// serveAlongside runs companion on its own address for the lifetime of s and
+// shuts it down with s.
+func (s *gracefulServer) serveAlongside(companion *http.Server) {
+	s.companions = append(s.companions, companion)
+}
+
+// onShutdown registers fn to run after in-flight requests have drained.
+func (s *gracefulServer) onShutdown(fn func() error) {
+	s.hooks = append(s.hooks, fn)
+}
+
+// drainingCh is closed when draining starts, so long-running requests can
+// finish early instead of holding up the shutdown.
+func (s *gracefulServer) drainingCh() <-chan struct{} {
+	return s.drainStarted
+}
+
+// onHandoff registers fn to run before listeners are passed to a new process.
+func (s *gracefulServer) onHandoff(fn func() error) {
+	s.handoffHooks = append(s.handoffHooks, fn)
+}
+
+func (s *gracefulServer) refuseWhileDraining(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&s.draining) == 1 {
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("server is shutting down"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listen binds every configured listener up front so that a bad address
+// fails startup instead of surfacing later from a goroutine. Sockets passed
+// in by systemd or a previous process are reused instead of bound.
+func (s *gracefulServer) listen() ([]net.Listener, error) {
+	inherited, err := inheritedListeners()
+	if err != nil {
+		return nil, err
+	}
+	specs, adopted := adopt(s.listeners, inherited)
+	s.listeners = specs
+
+	var bound []net.Listener
+	for i, spec := range s.listeners {
+		l, ok := adopted[i]
+		if !ok {
+			l, err = spec.listen()
+			if err != nil {
+				for _, b := range s.raw {
+					b.Close()
+				}
+				return nil, err
+			}
+		}
+		s.raw = append(s.raw, l)
+
+		if s.TLSConfig != nil && spec.network == "tcp" {
+			l = tls.NewListener(l, s.TLSConfig)
+		}
+		bound = append(bound, l)
+
+		handler, err := spec.wrap(s.handler)
+		if err != nil {
+			return nil, err
+		}
+		s.servers = append(s.servers, &http.Server{
+			Handler:        handler,
+			TLSConfig:      s.TLSConfig,
+			MaxHeaderBytes: s.MaxHeaderBytes,
+			IdleTimeout:    s.IdleTimeout,
+			ConnState:      s.ConnState,
+			ConnContext:    s.ConnContext,
+		})
+
+		how := "listening on"
+		if ok {
+			how = "inherited"
+		}
+		log.Printf("%s %s (%s profile)", how, spec, spec.profileName())
+	}
+	return bound, nil
+}
+
+// runHooks runs the shutdown hooks in the order they were registered,
+// returning the first error.
+func (s *gracefulServer) runHooks() error {
+	var first error
+	for _, hook := range s.hooks {
+		if err := hook(); err != nil {
+			log.Printf("shutdown hook failed: %s", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// close shuts down a server whose handler someone else serves, such as
+// NewHandler's, once its requests are done: it refuses new ones and runs
+// the shutdown hooks.
+func (s *gracefulServer) close() error {
+	atomic.StoreInt32(&s.draining, 1)
+	close(s.drainStarted)
+	return s.runHooks()
+}
+
+// run serves until SIGINT or SIGTERM, then drains connections for up to
+// drainTimeout and runs the shutdown hooks.
+func (s *gracefulServer) run() error {
+	bound, err := s.listen()
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, len(s.servers)+len(s.companions))
+	for i, srv := range s.servers {
+		go func(srv *http.Server, l net.Listener) {
+			errs <- srv.Serve(l)
+		}(srv, bound[i])
+	}
+	for _, companion := range s.companions {
+		go func(companion *http.Server) {
+			errs <- companion.ListenAndServe()
+		}(companion)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	notifyHandoffParent()
+
+	var drainTimeout time.Duration
+wait:
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGUSR2 {
+				if err := s.handoff(); err != nil {
+					log.Printf("handoff failed, still serving: %s", err)
+				}
+				continue
+			}
+			drainTimeout = time.Duration(atomic.LoadInt64(&s.drainTimeout))
+			log.Printf("received %s, draining connections for up to %s", sig, drainTimeout)
+			break wait
+		}
+	}
+
+	atomic.StoreInt32(&s.draining, 1)
+	close(s.drainStarted)
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	var shutdownErr error
+	for _, srv := range append(s.servers, s.companions...) {
+		srv.SetKeepAlivesEnabled(false)
+		if err := srv.Shutdown(ctx); err != nil && shutdownErr == nil {
+			shutdownErr = err
+			log.Printf("drain incomplete: %s", err)
+		}
+	}
+
+	if err := s.runHooks(); err != nil && shutdownErr == nil {
+		shutdownErr = err
+	}
+
+	for i := 0; i < len(s.servers)+len(s.companions); i++ {
+		if err := <-errs; err != nil && err != http.ErrServerClosed {
+			return err
+		}
+	}
+	log.Printf("shutdown complete")
+	return shutdownErr
+}
@@ -0,0 +1,157 @@
+package fishes
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const signedURLKey contextKey = "signed-url"
+
+// urlSigner issues and checks expiring links signed with url_signing_key. A
+// link covers one GET of one path and query, so it can be handed to someone
+// without credentials, even for the admin portal.
+type urlSigner struct {
+	config func() *Config
+	clock  Clock
+}
+
+func urlSignature(key, path string, query url.Values) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "GET\n%s\n%s", path, query.Encode())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sign returns path with expires and signature added to its query.
+func (s *urlSigner) sign(path string, expires time.Time) (string, error) {
+	u, err := url.Parse(path)
+	if err != nil || u.Scheme != "" || u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		return "", fmt.Errorf("path must be an absolute path like /admin/export")
+	}
+	query := u.Query()
+	query.Del("signature")
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("signature", urlSignature(s.config().URLSigningKey, u.Path, query))
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// wrap checks requests carrying a signature. Bad or expired links get 403;
+// good ones continue without the signing parameters, marked so protect lets
+// them through.
+func (s *urlSigner) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		signature := query.Get("signature")
+		if signature == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := s.config().URLSigningKey
+		if key == "" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("signed links are disabled"))
+			return
+		}
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("signed links only allow GET"))
+			return
+		}
+		query.Del("signature")
+		if !hmac.Equal([]byte(signature), []byte(urlSignature(key, clientPath(r, r.URL.Path), query))) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("invalid signature"))
+			return
+		}
+		expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+		if err != nil || s.clock.Now().Unix() >= expires {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("this link has expired"))
+			return
+		}
+
+		query.Del("expires")
+		r = r.WithContext(context.WithValue(r.Context(), signedURLKey, true))
+		r.URL.RawQuery = query.Encode()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func signedRequest(r *http.Request) bool {
+	signed, _ := r.Context().Value(signedURLKey).(bool)
+	return signed
+}
+
+type signedURLRequest struct {
+	Path      string `json:"path"`
+	ExpiresIn string `json:"expires_in"`
+}
+
+type signedURL struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// signURL issues a signed link for a GET of the given path, valid for
+// expires_in (one hour by default, at most signed_url_max_ttl).
+func (a *adminPortal) signURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	cfg := a.fishes.config()
+	if cfg.URLSigningKey == "" {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("signed links are disabled, set url_signing_key to enable them"))
+		return
+	}
+
+	body, ok := readJSONBody(w, r)
+	if !ok {
+		return
+	}
+	var req signedURLRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	ttl := time.Hour
+	if req.ExpiresIn != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.ExpiresIn); err != nil || ttl <= 0 {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte("expires_in must be a positive duration like 30m"))
+			return
+		}
+	}
+	if ttl > cfg.SignedURLMaxTTL {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(fmt.Sprintf("expires_in cannot be longer than %s", cfg.SignedURLMaxTTL)))
+		return
+	}
+
+	expires := a.fishes.clock.Now().Add(ttl).Truncate(time.Second).UTC()
+	path, err := a.signer.sign(req.Path, expires)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	writeJSON(w, http.StatusCreated, signedURL{URL: scheme + "://" + r.Host + path, ExpiresAt: expires})
+}
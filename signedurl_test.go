@@ -0,0 +1,101 @@
+package fishes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedURLs(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.URLSigningKey = "link-key"
+	signer := &urlSigner{config: func() *Config { return cfg }, clock: systemClock{}}
+	valid, err := signer.sign("/admin/export?format=json", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := signer.sign("/admin/export?format=json", time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name, method, target string
+		key                  string
+		wantStatus           int
+		wantSigned           bool
+	}{
+		{"valid", "GET", valid, "link-key", http.StatusOK, true},
+		{"HEAD", "HEAD", valid, "link-key", http.StatusOK, true},
+		{"unsigned", "GET", "/admin/export?format=json", "link-key", http.StatusOK, false},
+		{"expired", "GET", expired, "link-key", http.StatusForbidden, false},
+		{"other path", "GET", strings.Replace(valid, "/admin/export", "/admin/backups", 1), "link-key", http.StatusForbidden, false},
+		{"other query", "GET", strings.Replace(valid, "format=json", "format=csv", 1), "link-key", http.StatusForbidden, false},
+		{"later expiry", "GET", strings.Replace(valid, "expires=", "expires=9", 1), "link-key", http.StatusForbidden, false},
+		{"other key", "GET", valid, "rotated", http.StatusForbidden, false},
+		{"disabled", "GET", valid, "", http.StatusForbidden, false},
+		{"POST", "POST", valid, "link-key", http.StatusForbidden, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg.URLSigningKey = tc.key
+			var signed bool
+			var query url.Values
+			handler := signer.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				signed, query = signedRequest(r), r.URL.Query()
+			}))
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, httptest.NewRequest(tc.method, "http://fishes"+tc.target, nil))
+			if res.Code != tc.wantStatus || signed != tc.wantSigned {
+				t.Fatalf("%d signed=%v %s, want %d signed=%v", res.Code, signed, res.Body, tc.wantStatus, tc.wantSigned)
+			}
+			if signed && (query.Get("signature") != "" || query.Get("expires") != "" || query.Get("format") != "json") {
+				t.Errorf("the signed request continued with the query %v", query)
+			}
+		})
+	}
+}
+
+// A link issued by /admin/signed-urls lets a request without credentials
+// through to the admin portal, and only to the path it was issued for.
+func TestSignedURLIssued(t *testing.T) {
+	h := newTestServer(t, false, map[string]string{"URL_SIGNING_KEY": "link-key"})
+
+	for _, tc := range []struct {
+		body       string
+		wantStatus int
+	}{
+		{`{"path":"/admin/integrity"}`, http.StatusCreated},
+		{`{"path":"/admin/integrity","expires_in":"10m"}`, http.StatusCreated},
+		{`{"path":"/admin/integrity","expires_in":"-1m"}`, http.StatusUnprocessableEntity},
+		{`{"path":"/admin/integrity","expires_in":"9000h"}`, http.StatusUnprocessableEntity},
+		{`{"path":"https://elsewhere/admin/integrity"}`, http.StatusUnprocessableEntity},
+	} {
+		res := serveAdmin(h, "POST", "/admin/signed-urls", "application/json", []byte(tc.body))
+		if res.Code != tc.wantStatus {
+			t.Errorf("issuing %s: %d %s, want %d", tc.body, res.Code, res.Body, tc.wantStatus)
+		}
+	}
+
+	res := serveAdmin(h, "POST", "/admin/signed-urls", "application/json", []byte(`{"path":"/admin/integrity"}`))
+	var link signedURL
+	if err := json.Unmarshal(res.Body.Bytes(), &link); err != nil {
+		t.Fatalf("%s: %s", err, res.Body)
+	}
+	u, err := url.Parse(link.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := serveTest(h, "GET", u.RequestURI(), "", nil); res.Code != http.StatusOK {
+		t.Errorf("GET of the signed link: %d %s", res.Code, res.Body)
+	}
+	if res := serveTest(h, "GET", strings.Replace(u.RequestURI(), "/admin/integrity", "/admin/backups", 1), "", nil); res.Code != http.StatusForbidden {
+		t.Errorf("GET of another admin path with the signature: %d %s", res.Code, res.Body)
+	}
+	if res := serveTest(h, "GET", "/admin/integrity", "", nil); res.Code != http.StatusUnauthorized {
+		t.Errorf("GET without the signature: %d %s", res.Code, res.Body)
+	}
+}
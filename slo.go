@@ -0,0 +1,361 @@
+package fishes
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	requestDuration  = newHistogramVec("fishes_http_request_duration_seconds", "Time taken to answer requests by route and method.", latencyBuckets, "route", "method")
+	requestsAnswered = newCounterVec("fishes_http_requests_total", "Requests answered by route, method and status class.", "route", "method", "code")
+)
+
+// burnWindows are the windows burn rates are reported over. A burn rate of
+// 1 spends the error budget exactly by the end of slo_window.
+var burnWindows = []struct {
+	name string
+	d    time.Duration
+}{{"5m", 5 * time.Minute}, {"1h", time.Hour}, {"6h", 6 * time.Hour}}
+
+// sloTarget is an objective of slo_targets: the share of the requests to a
+// route that answer without a 5xx, and within Latency when it is set.
+type sloTarget struct {
+	Objective float64
+	Latency   time.Duration
+}
+
+// parseSLOTargets reads route=percent[@latency] entries, such as
+// /fishes/{id}=99.9@250ms, routes written as /openapi.json lists them.
+func parseSLOTargets(specs []string) (map[string]sloTarget, error) {
+	targets := map[string]sloTarget{}
+	for _, spec := range specs {
+		kv := strings.SplitN(spec, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid slo target '%s', expected route=percent[@latency]", spec)
+		}
+		route := kv[0]
+		if matchRoute(route) != route {
+			return nil, fmt.Errorf("slo target '%s': unknown route '%s'", spec, route)
+		}
+		objective, latency := kv[1], ""
+		if at := strings.Index(objective, "@"); at >= 0 {
+			objective, latency = objective[:at], objective[at+1:]
+		}
+		var target sloTarget
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(objective, "%"), 64)
+		if err != nil || percent <= 0 || percent >= 100 {
+			return nil, fmt.Errorf("slo target '%s': the objective must be a percentage between 0 and 100, both excluded", spec)
+		}
+		target.Objective = percent / 100
+		if latency != "" {
+			if target.Latency, err = time.ParseDuration(latency); err != nil || target.Latency <= 0 {
+				return nil, fmt.Errorf("slo target '%s': latency '%s' is not a duration such as 250ms", spec, latency)
+			}
+		}
+		targets[route] = target
+	}
+	return targets, nil
+}
+
+var (
+	routeTemplatesOnce sync.Once
+	routeTemplates     [][]string
+)
+
+// matchRoute gives the documented route a path is served by, such as
+// /fishes/{id} for /fishes/123, or "other" for a path matching none. Of the
+// routes matching, the one with the fewest parameters wins, so
+// /fishes/random is not taken for a fish.
+func matchRoute(path string) string {
+	routeTemplatesOnce.Do(func() {
+		for _, paths := range apiDocs {
+			for _, p := range paths {
+				routeTemplates = append(routeTemplates, strings.Split(p.path, "/"))
+			}
+		}
+	})
+	segments := strings.Split(path, "/")
+	best, bestParams := "other", len(segments)+1
+	for _, template := range routeTemplates {
+		if len(template) != len(segments) {
+			continue
+		}
+		params := 0
+		for i, s := range template {
+			if strings.HasPrefix(s, "{") && segments[i] != "" {
+				params++
+			} else if s != segments[i] {
+				params = -1
+				break
+			}
+		}
+		if params >= 0 && params < bestParams {
+			best, bestParams = strings.Join(template, "/"), params
+		}
+	}
+	return best
+}
+
+type sloBucket struct {
+	minute     int64
+	total, bad uint64
+}
+
+// sloSeries counts the requests to a route and those missing its target, a
+// bucket per minute of slo_window.
+type sloSeries struct {
+	buckets []sloBucket
+}
+
+func (s *sloSeries) add(minute int64, bad bool) {
+	b := &s.buckets[minute%int64(len(s.buckets))]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.total++
+	if bad {
+		b.bad++
+	}
+}
+
+// sum counts the requests of the last minutes up to now.
+func (s *sloSeries) sum(now int64, minutes int) (total, bad uint64) {
+	if minutes > len(s.buckets) {
+		minutes = len(s.buckets)
+	}
+	for m := now - int64(minutes) + 1; m <= now; m++ {
+		if b := s.buckets[m%int64(len(s.buckets))]; b.minute == m {
+			total += b.total
+			bad += b.bad
+		}
+	}
+	return total, bad
+}
+
+// sloTracker times every request into requestDuration, and keeps the
+// counts the routes of slo_targets are judged on. Counts start over on
+// restart.
+type sloTracker struct {
+	fishes *fishesHandler
+	window time.Duration
+
+	sync.Mutex
+	series map[string]*sloSeries
+	// parsed holds the targets of parsedFrom, parsed again when a reload
+	// swaps the config.
+	parsedFrom *Config
+	parsed     map[string]sloTarget
+}
+
+func newSLOTracker(h *fishesHandler) *sloTracker {
+	t := &sloTracker{fishes: h, window: h.config().SLOWindow, series: map[string]*sloSeries{}}
+	metrics.register(t)
+	return t
+}
+
+// sloWriter notes the status a handler answers with.
+type sloWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *sloWriter) WriteHeader(status int) {
+	if sw.status == 0 && !informational(status) {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *sloWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (t *sloTracker) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &sloWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		t.record(matchRoute(r.URL.Path), r.Method, sw.status, time.Since(start))
+	})
+}
+
+func (t *sloTracker) record(route, method string, status int, took time.Duration) {
+	requestDuration.observe(took.Seconds(), route, method)
+	requestsAnswered.inc(route, method, fmt.Sprintf("%dxx", status/100))
+
+	target, ok := t.targets()[route]
+	if !ok {
+		return
+	}
+	bad := status >= 500 || (target.Latency > 0 && took > target.Latency)
+	t.Lock()
+	defer t.Unlock()
+	s := t.series[route]
+	if s == nil {
+		s = &sloSeries{buckets: make([]sloBucket, int(t.window/time.Minute))}
+		t.series[route] = s
+	}
+	s.add(t.fishes.clock.Now().Unix()/60, bad)
+}
+
+func (t *sloTracker) targets() map[string]sloTarget {
+	cfg := t.fishes.config()
+	t.Lock()
+	defer t.Unlock()
+	if cfg != t.parsedFrom {
+		t.parsed, _ = parseSLOTargets(cfg.SLOTargets)
+		t.parsedFrom = cfg
+	}
+	return t.parsed
+}
+
+type sloReport struct {
+	Route     string             `json:"route"`
+	Objective float64            `json:"objective"`
+	Latency   string             `json:"latency,omitempty"`
+	Requests  uint64             `json:"requests"`
+	Missed    uint64             `json:"missed"`
+	Achieved  float64            `json:"achieved"`
+	Budget    float64            `json:"error_budget_remaining"`
+	BurnRates map[string]float64 `json:"burn_rates"`
+	// Status is ok, slow-burn or fast-burn, by the multiwindow thresholds
+	// of the Google SRE workbook, or exhausted once the budget is spent.
+	Status string `json:"status"`
+}
+
+type sloStatus struct {
+	GeneratedAt time.Time   `json:"generated_at"`
+	Window      string      `json:"window"`
+	Routes      []sloReport `json:"routes"`
+}
+
+func (t *sloTracker) report() sloStatus {
+	now := t.fishes.clock.Now()
+	minute := now.Unix() / 60
+	status := sloStatus{GeneratedAt: now.UTC(), Window: t.window.String(), Routes: []sloReport{}}
+	targets := t.targets()
+	routes := make([]string, 0, len(targets))
+	for route := range targets {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	t.Lock()
+	defer t.Unlock()
+	for _, route := range routes {
+		target := targets[route]
+		report := sloReport{Route: route, Objective: target.Objective, Achieved: 1, Budget: 1, BurnRates: map[string]float64{}, Status: "ok"}
+		if target.Latency > 0 {
+			report.Latency = target.Latency.String()
+		}
+		allowed := 1 - target.Objective
+		if s := t.series[route]; s != nil {
+			report.Requests, report.Missed = s.sum(minute, len(s.buckets))
+			for _, w := range burnWindows {
+				total, bad := s.sum(minute, int(w.d/time.Minute))
+				if total > 0 {
+					report.BurnRates[w.name] = float64(bad) / float64(total) / allowed
+				}
+			}
+		}
+		if report.Requests > 0 {
+			report.Achieved = 1 - float64(report.Missed)/float64(report.Requests)
+			report.Budget = 1 - (1-report.Achieved)/allowed
+		}
+		rates := report.BurnRates
+		switch {
+		case report.Budget <= 0:
+			report.Status = "exhausted"
+		case rates["5m"] > 14.4 && rates["1h"] > 14.4:
+			report.Status = "fast-burn"
+		case rates["1h"] > 6 && rates["6h"] > 6:
+			report.Status = "slow-burn"
+		}
+		status.Routes = append(status.Routes, report)
+	}
+	return status
+}
+
+func (t *sloTracker) gauges() (objectives, budgets, burns map[string]float64) {
+	objectives, budgets, burns = map[string]float64{}, map[string]float64{}, map[string]float64{}
+	for _, r := range t.report().Routes {
+		objectives[r.Route] = r.Objective
+		budgets[r.Route] = r.Budget
+		for window, rate := range r.BurnRates {
+			burns[r.Route+"\xff"+window] = rate
+		}
+	}
+	return objectives, budgets, burns
+}
+
+func (t *sloTracker) writeTo(w io.Writer) {
+	objectives, budgets, burns := t.gauges()
+	writeSamples(w, "fishes_slo_objective", "Share of requests slo_targets expects to answer well, by route.", "gauge", []string{"route"}, objectives)
+	writeSamples(w, "fishes_slo_error_budget_remaining", "Share of the error budget of slo_window left, negative once overspent, by route.", "gauge", []string{"route"}, budgets)
+	writeSamples(w, "fishes_slo_burn_rate", "How fast the error budget is spent over the window, 1 spending it by the end of slo_window.", "gauge", []string{"route", "window"}, burns)
+}
+
+func (t *sloTracker) samples() []metricSample {
+	objectives, budgets, burns := t.gauges()
+	var samples []metricSample
+	for route, v := range objectives {
+		samples = append(samples, metricSample{name: "fishes_slo_objective", labels: [][2]string{{"route", route}}, value: v})
+	}
+	for route, v := range budgets {
+		samples = append(samples, metricSample{name: "fishes_slo_error_budget_remaining", labels: [][2]string{{"route", route}}, value: v})
+	}
+	for key, v := range burns {
+		samples = append(samples, metricSample{name: "fishes_slo_burn_rate", labels: splitLabels([]string{"route", "window"}, key), value: v})
+	}
+	return samples
+}
+
+var sloTemplate = template.Must(adminTemplates.New("slo").Funcs(template.FuncMap{"percent": func(share float64) float64 { return share * 100 }}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Service level objectives</title>
+<link rel="stylesheet" href="/assets/admin.css">
+</head>
+<body>
+<h1>Service level objectives</h1>
+<p>As of {{.Data.GeneratedAt.Format "2006-01-02 15:04:05 MST"}}, over the last {{.Data.Window}} since the server started</p>
+{{- if .Data.Routes}}
+<table>
+<tr><th>Route</th><th>Objective</th><th>Latency</th><th>Requests</th><th>Missed</th><th>Achieved</th><th>Budget left</th><th>Burn 5m</th><th>Burn 1h</th><th>Burn 6h</th><th>Status</th></tr>
+{{- range .Data.Routes}}
+<tr class="{{.Status}}"><td>{{.Route}}</td><td>{{printf "%.3f%%" (percent .Objective)}}</td><td>{{.Latency}}</td><td>{{.Requests}}</td><td>{{.Missed}}</td><td>{{printf "%.3f%%" (percent .Achieved)}}</td><td>{{printf "%.1f%%" (percent .Budget)}}</td><td>{{printf "%.2f" (index .BurnRates "5m")}}</td><td>{{printf "%.2f" (index .BurnRates "1h")}}</td><td>{{printf "%.2f" (index .BurnRates "6h")}}</td><td>{{.Status}}</td></tr>
+{{- end}}
+</table>
+{{- else}}
+<p>No slo_targets are set.</p>
+{{- end}}
+</body>
+</html>`))
+
+// serve answers /admin/slo as JSON, or as an admin page to browsers.
+func (t *sloTracker) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		sendEarlyHints(w, r, "slo")
+		renderAdmin(w, "slo", t.report())
+		return
+	}
+	writeJSON(w, http.StatusOK, t.report())
+}
@@ -0,0 +1,87 @@
+package fishes
+
+import (
+	"fmt"
+	"strings"
+)
+
+var reservedSlugs = map[string]bool{
+	"random": true,
+	"import": true,
+	"trash":  true,
+}
+
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, c := range strings.ToLower(name) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			b.WriteRune(c)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+
+	slug := strings.TrimSuffix(b.String(), "-")
+	if slug == "" {
+		slug = "fish"
+	}
+	return slug
+}
+
+// assignSlug gives fish a unique slug derived from its name. Previous slugs
+// stay in the index so old links keep resolving. Callers must hold the lock.
+func (h *fishesHandler) assignSlug(fish *Fish) {
+	base := slugify(fish.Name)
+	if fish.Slug != "" && slugHasBase(fish.Slug, base) && h.slugs[fish.Slug] == fish.ID {
+		return
+	}
+
+	slug := base
+	for n := 2; ; n++ {
+		owner, taken := h.slugs[slug]
+		_, isID := h.db[slug]
+		if (!taken || owner == fish.ID) && !isID && !reservedSlugs[slug] {
+			break
+		}
+		slug = fmt.Sprintf("%s-%d", base, n)
+	}
+
+	h.slugs[slug] = fish.ID
+	fish.Slug = slug
+}
+
+func slugHasBase(slug, base string) bool {
+	if slug == base {
+		return true
+	}
+	suffix := strings.TrimPrefix(slug, base+"-")
+	if suffix == slug || suffix == "" {
+		return false
+	}
+	for _, c := range suffix {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveSlug returns the ID a slug points at. Callers must hold the lock.
+func (h *fishesHandler) resolveSlug(slug string) (string, bool) {
+	id, ok := h.slugs[slug]
+	if !ok {
+		return "", false
+	}
+	if _, exists := h.db[id]; exists {
+		return id, true
+	}
+	if h.archive != nil {
+		if _, archived := h.archive.index[id]; archived {
+			return id, true
+		}
+	}
+	return "", false
+}
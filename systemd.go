@@ -0,0 +1,186 @@
+package fishes
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	listenFDsStart   = 3
+	handoffParentEnv = "FISHES_HANDOFF_PARENT"
+)
+
+type inheritedListener struct {
+	name     string
+	listener net.Listener
+}
+
+// inheritedListeners picks up sockets passed by systemd socket activation or
+// by a previous process during a SIGUSR2 handoff, following the sd_listen_fds
+// protocol. The variables are cleared so children don't see them twice.
+func inheritedListeners() ([]inheritedListener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	var inherited []inheritedListener
+	for i := 0; i < count; i++ {
+		fd := uintptr(listenFDsStart + i)
+		syscall.CloseOnExec(int(fd))
+
+		f := os.NewFile(fd, fmt.Sprintf("listen-fd-%d", fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited fd %d is not a listening socket: %s", fd, err)
+		}
+
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		inherited = append(inherited, inheritedListener{name: name, listener: l})
+	}
+	return inherited, nil
+}
+
+func sameAddress(spec listenerSpec, addr net.Addr) bool {
+	if spec.network != addr.Network() {
+		return false
+	}
+	if spec.network == "unix" {
+		return spec.address == addr.String()
+	}
+
+	want, err := net.ResolveTCPAddr("tcp", spec.address)
+	if err != nil {
+		return false
+	}
+	got, ok := addr.(*net.TCPAddr)
+	if !ok || want.Port != got.Port {
+		return false
+	}
+	if len(want.IP) == 0 || want.IP.IsUnspecified() {
+		return got.IP.IsUnspecified()
+	}
+	return want.IP.Equal(got.IP)
+}
+
+// adopt matches inherited sockets to configured listeners by name or address.
+// Sockets nobody claims are served with the default profile.
+func adopt(specs []listenerSpec, inherited []inheritedListener) ([]listenerSpec, map[int]net.Listener) {
+	adopted := map[int]net.Listener{}
+	claimed := make([]bool, len(inherited))
+
+	for i, spec := range specs {
+		for j, in := range inherited {
+			if claimed[j] {
+				continue
+			}
+			if in.name == spec.raw() || sameAddress(spec, in.listener.Addr()) {
+				adopted[i] = in.listener
+				claimed[j] = true
+				break
+			}
+		}
+	}
+
+	for j, in := range inherited {
+		if claimed[j] {
+			continue
+		}
+		spec, err := parseListenSpec(in.name)
+		if err != nil || in.name == "" {
+			spec = listenerSpec{network: in.listener.Addr().Network(), address: in.listener.Addr().String()}
+		}
+		adopted[len(specs)] = in.listener
+		specs = append(specs, spec)
+	}
+	return specs, adopted
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// handoff starts a copy of the running binary that inherits every listener,
+// so the new process can accept connections before this one drains. The new
+// process sends SIGTERM to this one once it is serving. Pending data is
+// flushed first; writes this process accepts while draining are not seen by
+// the new one.
+func (s *gracefulServer) handoff() error {
+	for _, hook := range s.handoffHooks {
+		if err := hook(); err != nil {
+			return err
+		}
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	var names []string
+	for i, l := range s.raw {
+		f, ok := l.(filer)
+		if !ok {
+			return fmt.Errorf("listener %s cannot be passed on", s.listeners[i])
+		}
+		file, err := f.File()
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		files = append(files, file)
+		names = append(names, s.listeners[i].raw())
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		handoffParentEnv+"="+strconv.Itoa(os.Getpid()),
+	)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	for _, l := range s.raw {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	log.Printf("handed listeners to pid %d", cmd.Process.Pid)
+	return nil
+}
+
+// notifyHandoffParent tells the process that started us that we are serving.
+func notifyHandoffParent() {
+	pid, err := strconv.Atoi(os.Getenv(handoffParentEnv))
+	os.Unsetenv(handoffParentEnv)
+	if err != nil || pid <= 1 {
+		return
+	}
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		log.Printf("could not stop previous process %d: %s", pid, err)
+	}
+}
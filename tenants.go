@@ -0,0 +1,558 @@
+package fishes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tenantHeader = "X-Fish-Tenant"
+	// tenantsFileName holds the tenants of data_dir; the fishes of each are
+	// under tenants/{id}, in a snapshot and operation log of their own.
+	tenantsFileName = "tenants.json"
+)
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+type tenant struct {
+	ID string `json:"id"`
+	// Quota is the most fishes the tenant may have, trash left out; 0 is
+	// no limit.
+	Quota int `json:"quota"`
+	// Fields are the custom fields of the fishes of the tenant, set on
+	// /admin/tenants/{id}/schema.
+	Fields    customFields `json:"fields,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+type tenantStore struct {
+	tenant
+	*fishStore
+	namespaces *namespaceSet
+	// handler serves the store through the chain of the main store.
+	handler http.Handler
+}
+
+// overQuota refuses n more fishes past the quota of a tenant's store, and
+// never refuses the main store. Callers must hold the lock.
+func (h *fishesHandler) overQuota(n int) error {
+	if h.quota > 0 && len(h.db)+n > h.quota {
+		return fmt.Errorf("the quota of %d fishes is reached", h.quota)
+	}
+	return nil
+}
+
+// tenantRouter serves the fish routes of a tenant named by the X-Fish-Tenant
+// header or a /t/{tenant} path prefix from that tenant's store. Requests
+// naming no tenant go on to the main store. Tenant stores are not
+// replicated, so a replica or cluster member refuses tenant requests.
+type tenantRouter struct {
+	main  *fishesHandler
+	flags *featureFlags
+	// namespaces are those of the main store.
+	namespaces *namespaceSet
+	// chain wraps the routes of a store in what those of the main store go
+	// through: the memory guard, async writes, signed links and
+	// consistency tokens. It serves the routes alone until assemble sets
+	// it.
+	chain func(fs *fishStore) http.Handler
+
+	sync.Mutex
+	tenants map[string]*tenantStore
+}
+
+func newTenantRouter(h *fishesHandler, flags *featureFlags) *tenantRouter {
+	return &tenantRouter{
+		main:       h,
+		flags:      flags,
+		namespaces: newNamespaceSet(h, h, flags, h.config().DataDir),
+		chain:      func(fs *fishStore) http.Handler { return fs.mux },
+		tenants:    map[string]*tenantStore{},
+	}
+}
+
+// load opens the namespaces and tenants saved in data_dir. It needs the keys
+// of the main store, which are read after the routes are set up.
+func (t *tenantRouter) load() error {
+	if err := t.namespaces.load(); err != nil {
+		return err
+	}
+	dataDir := t.main.config().DataDir
+	if dataDir == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, tenantsFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []tenant
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("%s: %s", tenantsFileName, err)
+	}
+	t.Lock()
+	defer t.Unlock()
+	for _, ten := range saved {
+		store, err := t.open(ten)
+		if err != nil {
+			return fmt.Errorf("tenant %s: %s", ten.ID, err)
+		}
+		t.tenants[ten.ID] = store
+	}
+	return nil
+}
+
+// open gives the tenant a store of its own, loading what it and its
+// namespaces have in data_dir.
+func (t *tenantRouter) open(ten tenant) (*tenantStore, error) {
+	dir := ""
+	if dataDir := t.main.config().DataDir; dataDir != "" {
+		dir = filepath.Join(dataDir, "tenants", ten.ID)
+	}
+	fs, err := openFishStore(t.main, dir)
+	if err != nil {
+		return nil, err
+	}
+	fs.h.quota, fs.h.fields = ten.Quota, ten.Fields
+	store := &tenantStore{tenant: ten, fishStore: fs, namespaces: newNamespaceSet(fs.h, t.main, t.flags, dir)}
+	store.mux.HandleFunc("/namespaces", store.namespaces.serve)
+	store.mux.HandleFunc("/namespaces/", store.namespaces.serve)
+	store.handler = t.chain(fs)
+	if err := store.namespaces.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// save writes the tenant list to data_dir. Callers must hold the lock.
+func (t *tenantRouter) save() error {
+	dataDir := t.main.config().DataDir
+	if dataDir == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(t.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dataDir, tenantsFileName), data)
+}
+
+// list gives the tenants by id. Callers must hold the lock.
+func (t *tenantRouter) list() []tenant {
+	tenants := make([]tenant, 0, len(t.tenants))
+	for _, store := range t.tenants {
+		tenants = append(tenants, store.tenant)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].ID < tenants[j].ID })
+	return tenants
+}
+
+// fishStores gives the stores of every tenant and namespace.
+func (t *tenantRouter) fishStores() []*fishStore {
+	stores := t.namespaces.stores()
+	for _, store := range t.stores() {
+		stores = append(stores, store.fishStore)
+		stores = append(stores, store.namespaces.stores()...)
+	}
+	return stores
+}
+
+func (t *tenantRouter) stores() []*tenantStore {
+	t.Lock()
+	defer t.Unlock()
+	stores := make([]*tenantStore, 0, len(t.tenants))
+	for _, store := range t.tenants {
+		stores = append(stores, store)
+	}
+	return stores
+}
+
+// tenantOf splits the tenant off r, returning "" when it names none.
+func tenantOf(r *http.Request) (id, prefix, path string) {
+	if strings.HasPrefix(r.URL.Path, "/t/") {
+		rest := strings.TrimPrefix(r.URL.Path, "/t/")
+		if i := strings.Index(rest, "/"); i > 0 {
+			return rest[:i], "/t/" + rest[:i], rest[i:]
+		}
+		return rest, "/t/" + rest, "/"
+	}
+	return r.Header.Get(tenantHeader), "", r.URL.Path
+}
+
+// prefixedWriter puts a prefix the path was sent with, such as /t/{tenant},
+// back on the Location of the answers.
+type prefixedWriter struct {
+	http.ResponseWriter
+	prefix string
+	wrote  bool
+}
+
+func (pw *prefixedWriter) WriteHeader(status int) {
+	if !pw.wrote && !informational(status) {
+		pw.wrote = true
+		if loc := pw.Header().Get("Location"); strings.HasPrefix(loc, "/") {
+			pw.Header().Set("Location", pw.prefix+loc)
+		}
+	}
+	pw.ResponseWriter.WriteHeader(status)
+}
+
+func (pw *prefixedWriter) Write(b []byte) (int, error) {
+	if !pw.wrote {
+		pw.WriteHeader(http.StatusOK)
+	}
+	return pw.ResponseWriter.Write(b)
+}
+
+func (t *tenantRouter) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, prefix, path := tenantOf(r)
+		if id == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cfg := t.main.config()
+		if cfg.ReplicaOf != "" || len(cfg.Peers) > 0 || len(cfg.SyncPeers) > 0 || cfg.ClusterMode != "" {
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte("tenants are only served by a single primary"))
+			return
+		}
+		t.Lock()
+		store := t.tenants[id]
+		t.Unlock()
+		if store == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("there is no tenant '%s'", id)))
+			return
+		}
+		shared := path == "/usage" || strings.HasPrefix(path, "/jobs/")
+		if !servesPath(path) && !shared && path != "/namespaces" && !strings.HasPrefix(path, "/namespaces/") {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("tenants are served the /fishes, /environments, /namespaces, /jobs and /usage routes only"))
+			return
+		}
+		// A reload swaps the config of the main store only.
+		if store.h.config() != cfg {
+			store.h.settings.Store(cfg)
+		}
+		quotas, _ := parseQuotas(cfg.Quotas)
+		records := int(limitsFor(quotas, "tenant", id).Records)
+		store.h.Lock()
+		if store.Quota > 0 {
+			records = store.Quota
+		}
+		store.h.quota = records
+		store.h.Unlock()
+
+		r2 := r.Clone(context.WithValue(r.Context(), pathPrefixKey, clientPath(r, prefix)))
+		r2.URL.Path, r2.URL.RawPath = path, ""
+		if prefix != "" {
+			w = &prefixedWriter{ResponseWriter: w, prefix: prefix}
+		}
+		if shared {
+			next.ServeHTTP(w, r2)
+			return
+		}
+		store.handler.ServeHTTP(w, r2)
+	})
+}
+
+// flush writes the pending changes of every tenant and namespace to
+// data_dir.
+func (t *tenantRouter) flush() error {
+	var failed error
+	for _, store := range t.fishStores() {
+		if store.persister == nil {
+			continue
+		}
+		if err := store.persister.flush(); err != nil {
+			log.Printf("%s: %s", store.dir, err)
+			failed = err
+		}
+	}
+	return failed
+}
+
+// removeExportArtifacts deletes the export archives the stores of every
+// tenant and namespace kept for resumed downloads.
+func (t *tenantRouter) removeExportArtifacts() error {
+	var failed error
+	for _, store := range t.fishStores() {
+		if err := store.h.removeExportArtifact(); err != nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+// sweep empties the trash and expires the fishes of every tenant and
+// namespace, as the trash-purge and expiry-sweep jobs do for the main store.
+func (t *tenantRouter) sweep() error {
+	for _, store := range t.fishStores() {
+		if err := store.h.purgeExpiredTrash(); err != nil {
+			return err
+		}
+		if err := store.h.sweepExpiredNow(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type tenantView struct {
+	tenant
+	Fishes int `json:"fishes"`
+}
+
+func (store *tenantStore) view() tenantView {
+	store.h.Lock()
+	defer store.h.Unlock()
+	return tenantView{tenant: store.tenant, Fishes: len(store.h.db)}
+}
+
+type tenantChange struct {
+	ID    string `json:"id"`
+	Quota *int   `json:"quota"`
+}
+
+// serve lists and creates tenants on /admin/tenants, and shows, changes the
+// quota of or deletes one with everything it holds on /admin/tenants/{id}.
+// The custom fields of a tenant are on /admin/tenants/{id}/schema, and its
+// fishes are exported on /admin/tenants/{id}/export.
+func (t *tenantRouter) serve(w http.ResponseWriter, r *http.Request) {
+	id, sub := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/tenants"), "/"), ""
+	if i := strings.Index(id, "/"); i >= 0 {
+		id, sub = id[:i], id[i:]
+	}
+	if id == "" {
+		switch r.Method {
+		case "GET":
+			views := []tenantView{}
+			for _, store := range t.stores() {
+				views = append(views, store.view())
+			}
+			sort.Slice(views, func(i, j int) bool { return views[i].ID < views[j].ID })
+			writeJSON(w, http.StatusOK, views)
+		case "POST":
+			change, ok := readTenantChange(w, r)
+			if !ok {
+				return
+			}
+			t.create(w, change)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("method not allowed"))
+		}
+		return
+	}
+
+	t.Lock()
+	store := t.tenants[id]
+	t.Unlock()
+	if store == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("there is no tenant '%s'", id)))
+		return
+	}
+	switch sub {
+	case "":
+	case "/schema":
+		t.serveSchema(w, r, store)
+		return
+	case "/export":
+		store.h.serveExport(w, r, id)
+		return
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("tenants have the /schema and /export routes only"))
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, store.view())
+	case "PATCH":
+		change, ok := readTenantChange(w, r)
+		if !ok {
+			return
+		}
+		if change.Quota != nil {
+			t.Lock()
+			store.h.Lock()
+			store.Quota = *change.Quota
+			store.h.Unlock()
+			err := t.save()
+			t.Unlock()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, store.view())
+	case "DELETE":
+		t.Lock()
+		delete(t.tenants, id)
+		err := t.save()
+		t.Unlock()
+		if err == nil {
+			store.namespaces.remove()
+			err = store.remove()
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		log.Printf("deleted tenant %s and its %d fishes", id, store.view().Fishes)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+	}
+}
+
+func readTenantChange(w http.ResponseWriter, r *http.Request) (tenantChange, bool) {
+	var change tenantChange
+	body, ok := readJSONBody(w, r)
+	if !ok {
+		return change, false
+	}
+	if err := json.Unmarshal(body, &change); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return change, false
+	}
+	if change.Quota != nil && *change.Quota < 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte("quota cannot be negative"))
+		return change, false
+	}
+	return change, true
+}
+
+func (t *tenantRouter) create(w http.ResponseWriter, change tenantChange) {
+	if !tenantIDPattern.MatchString(change.ID) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte("id must be 1 to 63 lowercase letters, digits and dashes, starting and ending with a letter or digit"))
+		return
+	}
+	ten := tenant{ID: change.ID, CreatedAt: t.main.clock.Now().UTC()}
+	if change.Quota != nil {
+		ten.Quota = *change.Quota
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if _, ok := t.tenants[ten.ID]; ok {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(fmt.Sprintf("tenant '%s' already exists", ten.ID)))
+		return
+	}
+	store, err := t.open(ten)
+	if err == nil {
+		t.tenants[ten.ID] = store
+		if err = t.save(); err != nil {
+			delete(t.tenants, ten.ID)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Location", "/admin/tenants/"+ten.ID)
+	writeJSON(w, http.StatusCreated, tenantView{tenant: ten})
+}
+
+// serveSchema shows the custom fields of the tenant on GET and replaces them
+// on PUT, refusing fields its fishes, or those of its namespaces, would no
+// longer fit.
+func (t *tenantRouter) serveSchema(w http.ResponseWriter, r *http.Request, store *tenantStore) {
+	switch r.Method {
+	case "GET":
+		t.Lock()
+		fields := store.Fields
+		t.Unlock()
+		if fields == nil {
+			fields = customFields{}
+		}
+		writeJSON(w, http.StatusOK, customFieldSchema{Fields: fields})
+	case "PUT":
+		body, ok := readJSONBody(w, r)
+		if !ok {
+			return
+		}
+		var schema customFieldSchema
+		if err := json.Unmarshal(body, &schema); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err := schema.Fields.check(); err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if schema.Fields == nil {
+			schema.Fields = customFields{}
+		}
+
+		t.Lock()
+		store.h.Lock()
+		err := misfit(schema.Fields, store.h)
+		for _, ns := range store.namespaces.stores() {
+			if err == nil {
+				ns.h.Lock()
+				err = misfit(schema.Fields, ns.h)
+				ns.h.Unlock()
+			}
+		}
+		if err != nil {
+			store.h.Unlock()
+			t.Unlock()
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		store.Fields, store.h.fields = schema.Fields, schema.Fields
+		store.h.Unlock()
+		err = t.save()
+		t.Unlock()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		log.Printf("tenant %s now has %d custom fields", store.ID, len(schema.Fields))
+		writeJSON(w, http.StatusOK, schema)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+	}
+}
+
+// misfit finds a fish of h, trash included, that fields do not take. Callers
+// must hold the lock of h.
+func misfit(fields customFields, h *fishesHandler) error {
+	for _, set := range []map[string]Fish{h.db, h.trash} {
+		for id, fish := range set {
+			if err := fields.validate(fish.Extensions); err != nil {
+				return fmt.Errorf("fish %s would not fit: %s", id, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package fishes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveTenant is serveTest naming the tenant in the X-Fish-Tenant header.
+func serveTenant(h http.Handler, tenant, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "http://fishes"+target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set(tenantHeader, tenant)
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	return res
+}
+
+func fishNames(t *testing.T, res *httptest.ResponseRecorder) []string {
+	t.Helper()
+	if res.Code != http.StatusOK {
+		t.Fatalf("listing: %d %s", res.Code, res.Body)
+	}
+	var fishes []Fish
+	if err := json.Unmarshal(res.Body.Bytes(), &fishes); err != nil {
+		t.Fatalf("%s: %s", err, res.Body)
+	}
+	var names []string
+	for _, fish := range fishes {
+		names = append(names, fish.Name)
+	}
+	return names
+}
+
+func TestTenants(t *testing.T) {
+	h := newTestServer(t, false, nil)
+
+	for _, tc := range []struct {
+		body       string
+		wantStatus int
+	}{
+		{`{"id":"acme"}`, http.StatusCreated},
+		{`{"id":"globex","quota":1}`, http.StatusCreated},
+		{`{"id":"acme"}`, http.StatusConflict},
+		{`{"id":"Acme Inc"}`, http.StatusUnprocessableEntity},
+		{`{"id":"-acme"}`, http.StatusUnprocessableEntity},
+		{`{"id":`, http.StatusBadRequest},
+	} {
+		if res := serveAdmin(h, "POST", "/admin/tenants", "application/json", []byte(tc.body)); res.Code != tc.wantStatus {
+			t.Errorf("POST /admin/tenants %s: %d %s, want %d", tc.body, res.Code, res.Body, tc.wantStatus)
+		}
+	}
+	if res := serveTest(h, "POST", "/admin/tenants", "application/json", []byte(`{"id":"initech"}`)); res.Code != http.StatusUnauthorized {
+		t.Errorf("creating a tenant without credentials: %d", res.Code)
+	}
+
+	for _, step := range []struct {
+		name, tenant, method, target, body string
+		wantStatus                         int
+	}{
+		{"create by prefix", "", "POST", "/t/acme/fishes", `{"name":"Nemo","environment":"saltwater"}`, http.StatusCreated},
+		{"create by header", "acme", "POST", "/fishes", `{"name":"Dory","environment":"saltwater"}`, http.StatusCreated},
+		{"create in the main store", "", "POST", "/fishes", `{"name":"Guppy","environment":"freshwater"}`, http.StatusCreated},
+		{"create within the quota", "globex", "POST", "/fishes", `{"name":"Molly","environment":"brackish"}`, http.StatusCreated},
+		{"create past the quota", "globex", "POST", "/fishes", `{"name":"Oscar","environment":"freshwater"}`, http.StatusForbidden},
+		{"unknown tenant", "initech", "GET", "/fishes", "", http.StatusNotFound},
+		{"unknown tenant by prefix", "", "GET", "/t/initech/fishes", "", http.StatusNotFound},
+		{"route tenants are not served", "acme", "GET", "/admin/integrity", "", http.StatusNotFound},
+		{"usage", "", "GET", "/t/acme/usage", "", http.StatusOK},
+	} {
+		res := serveTenant(h, step.tenant, step.method, step.target, step.body)
+		if res.Code != step.wantStatus {
+			t.Errorf("%s: %s %s: %d %s, want %d", step.name, step.method, step.target, res.Code, res.Body, step.wantStatus)
+		}
+		if step.wantStatus == http.StatusCreated && step.target == "/t/acme/fishes" && !strings.HasPrefix(res.Header().Get("Location"), "/t/acme/fishes/") {
+			t.Errorf("%s: Location %q is not under the tenant prefix", step.name, res.Header().Get("Location"))
+		}
+	}
+
+	for _, tc := range []struct {
+		tenant, target string
+		want           string
+	}{
+		{"", "/t/acme/fishes", "Dory,Nemo"},
+		{"acme", "/fishes", "Dory,Nemo"},
+		{"globex", "/fishes", "Molly"},
+		{"", "/fishes", "Guppy"},
+	} {
+		names := fishNames(t, serveTenant(h, tc.tenant, "GET", tc.target+"?sort=name", ""))
+		if got := strings.Join(names, ","); got != tc.want {
+			t.Errorf("tenant %q GET %s: %s, want %s", tc.tenant, tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestParseQuotas(t *testing.T) {
+	for _, tc := range []struct {
+		entries []string
+		want    map[string]quotaLimits
+		wantErr string
+	}{
+		{nil, map[string]quotaLimits{}, ""},
+		{[]string{"tenant:acme:records=10", "tenant:acme:requests_per_day=100", "tenant:*:storage_bytes=4096", "key:k1:requests_per_day=5"}, map[string]quotaLimits{
+			"tenant:acme": {Records: 10, RequestsPerDay: 100},
+			"tenant:*":    {StorageBytes: 4096},
+			"key:k1":      {RequestsPerDay: 5},
+		}, ""},
+		{[]string{"tenant:acme:records"}, nil, "expected tenant:<id>:<limit>=<n>"},
+		{[]string{"tenant::records=1"}, nil, "expected tenant:<id>:<limit>=<n>"},
+		{[]string{"tenant:acme:records=0"}, nil, "positive integer"},
+		{[]string{"tenant:acme:records=many"}, nil, "positive integer"},
+		{[]string{"user:bob:records=1"}, nil, "a tenant or a key"},
+		{[]string{"tenant:acme:fins=1"}, nil, "tenants take"},
+		{[]string{"key:k1:records=1"}, nil, "keys take requests_per_day only"},
+	} {
+		got, err := parseQuotas(tc.entries)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("parseQuotas(%q) error = %v, want one saying %q", tc.entries, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil || len(got) != len(tc.want) {
+			t.Errorf("parseQuotas(%q) = %v, %v; want %v", tc.entries, got, err, tc.want)
+			continue
+		}
+		for subject, limits := range tc.want {
+			if got[subject] != limits {
+				t.Errorf("parseQuotas(%q)[%s] = %+v, want %+v", tc.entries, subject, got[subject], limits)
+			}
+		}
+	}
+
+	quotas, _ := parseQuotas([]string{"tenant:*:records=3", "tenant:*:requests_per_day=9", "tenant:acme:records=1"})
+	if got := limitsFor(quotas, "tenant", "acme"); got != (quotaLimits{Records: 1, RequestsPerDay: 9}) {
+		t.Errorf("limits of acme: %+v, want its records and the default requests_per_day", got)
+	}
+}
+
+// A tenant out of requests for the day gets 429 with the quota headers, and
+// the main store and the other tenants are not counted against it.
+func TestRequestQuota(t *testing.T) {
+	h := newTestServer(t, false, map[string]string{"QUOTAS": "tenant:acme:requests_per_day=2"})
+	for _, id := range []string{"acme", "globex"} {
+		if res := serveAdmin(h, "POST", "/admin/tenants", "application/json", []byte(`{"id":"`+id+`"}`)); res.Code != http.StatusCreated {
+			t.Fatalf("creating %s: %d %s", id, res.Code, res.Body)
+		}
+	}
+
+	for i, step := range []struct {
+		tenant        string
+		wantStatus    int
+		wantRemaining string
+	}{
+		{"acme", http.StatusOK, "1"},
+		{"globex", http.StatusOK, ""},
+		{"", http.StatusOK, ""},
+		{"acme", http.StatusOK, "0"},
+		{"acme", http.StatusTooManyRequests, "0"},
+		{"globex", http.StatusOK, ""},
+	} {
+		res := serveTenant(h, step.tenant, "GET", "/fishes", "")
+		if res.Code != step.wantStatus || res.Header().Get("X-Quota-Remaining") != step.wantRemaining {
+			t.Errorf("request %d of %q: %d remaining %q, want %d remaining %q", i+1, step.tenant, res.Code, res.Header().Get("X-Quota-Remaining"), step.wantStatus, step.wantRemaining)
+		}
+		if res.Code == http.StatusTooManyRequests && (res.Header().Get("Retry-After") == "" || res.Header().Get("X-Quota-Exceeded") != "requests_per_day") {
+			t.Errorf("the refusal does not say when to retry: %v", res.Header())
+		}
+	}
+}
+
+// Tenant requests go through what main store requests do: async writes,
+// consistency tokens and the memory guard, the latter on the tenant's own
+// fishes.
+func TestTenantChain(t *testing.T) {
+	h := newTestServer(t, false, map[string]string{"MEMORY_BUDGET_BYTES": "200"})
+	if res := serveAdmin(h, "POST", "/admin/tenants", "application/json", []byte(`{"id":"acme"}`)); res.Code != http.StatusCreated {
+		t.Fatalf("creating the tenant: %d %s", res.Code, res.Body)
+	}
+
+	req := httptest.NewRequest("POST", "http://fishes/t/acme/fishes", strings.NewReader(`{"name":"Nemo","environment":"saltwater"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "respond-async")
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	if res.Code != http.StatusAccepted || !strings.HasPrefix(res.Header().Get("Location"), "/t/acme/jobs/") {
+		t.Fatalf("async create: %d Location %q %s", res.Code, res.Header().Get("Location"), res.Body)
+	}
+	var job asyncJob
+	for deadline := time.Now().Add(5 * time.Second); job.Status != jobSucceeded; time.Sleep(10 * time.Millisecond) {
+		status := serveTest(h, "GET", res.Header().Get("Location"), "", nil)
+		if err := json.Unmarshal(status.Body.Bytes(), &job); err != nil {
+			t.Fatalf("job status %d: %s", status.Code, status.Body)
+		}
+		if job.Status == jobFailed || time.Now().After(deadline) {
+			t.Fatalf("job %+v", job)
+		}
+	}
+	if !strings.HasPrefix(job.Links.Result, "/t/acme/fishes/") || job.Links.Self != res.Header().Get("Location") {
+		t.Errorf("job links %+v are not under the tenant prefix", job.Links)
+	}
+	if names := fishNames(t, serveTenant(h, "acme", "GET", "/fishes", "")); strings.Join(names, ",") != "Nemo" {
+		t.Errorf("the tenant has %v, want the fish of the job", names)
+	}
+	if names := fishNames(t, serveTenant(h, "", "GET", "/fishes", "")); len(names) != 0 {
+		t.Errorf("the main store has %v, want nothing", names)
+	}
+
+	for i := 0; ; i++ {
+		res := serveTenant(h, "acme", "POST", "/fishes", `{"name":"Dory","environment":"saltwater"}`)
+		if res.Code == http.StatusInsufficientStorage {
+			break
+		}
+		if res.Code != http.StatusCreated || res.Header().Get(consistencyTokenHeader) == "" {
+			t.Fatalf("create %d: %d token %q %s", i, res.Code, res.Header().Get(consistencyTokenHeader), res.Body)
+		}
+		if i == 10 {
+			t.Fatal("the tenant's writes are not held to memory_budget_bytes")
+		}
+	}
+	if res := serveTenant(h, "", "POST", "/fishes", `{"name":"Guppy","environment":"freshwater"}`); res.Code != http.StatusCreated {
+		t.Errorf("the main store, within its own budget: %d %s", res.Code, res.Body)
+	}
+}
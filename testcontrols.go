@@ -0,0 +1,125 @@
+package fishes
+
+import (
+	"encoding/json"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A deterministic server starts with its clock stopped at testEpoch and its
+// random source seeded with 1, so what it does is the same on every run: the
+// same ids, the same /fishes/random picks. Tests move them with
+// /admin/test/clock and /admin/test/rand.
+var testEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// deterministicControls returns the clock and the random source of a
+// deterministic server, and the handler of /admin/test/ that sets them.
+func deterministicControls() (Clock, RandSource, http.HandlerFunc) {
+	log.Printf("deterministic: the clock stands at %s until /admin/test/clock moves it", testEpoch.Format(time.RFC3339))
+	c := &testClock{now: testEpoch}
+	r := &seededRand{rand: mathrand.New(mathrand.NewSource(1))}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/test/clock", c.serve)
+	mux.HandleFunc("/admin/test/rand", r.serve)
+	return c, r, mux.ServeHTTP
+}
+
+// testClock stands still until it is set or advanced.
+type testClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+type testClockChange struct {
+	// Now sets the clock; Advance then moves it, as a Go duration.
+	Now     *time.Time `json:"now"`
+	Advance string     `json:"advance"`
+}
+
+func (c *testClock) serve(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		body, ok := readJSONBody(w, r)
+		if !ok {
+			return
+		}
+		var change testClockChange
+		if err := json.Unmarshal(body, &change); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		var advance time.Duration
+		if change.Advance != "" {
+			var err error
+			if advance, err = time.ParseDuration(change.Advance); err != nil || advance < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("advance must be a duration such as 1s or 90m; the clock does not go back"))
+				return
+			}
+		}
+		c.Lock()
+		if change.Now != nil {
+			c.now = *change.Now
+		}
+		c.now = c.now.Add(advance)
+		c.Unlock()
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]time.Time{"now": c.Now().UTC()})
+}
+
+// seededRand gives the same numbers for the same seed.
+type seededRand struct {
+	sync.Mutex
+	rand *mathrand.Rand
+}
+
+func (s *seededRand) Intn(n int) int {
+	s.Lock()
+	defer s.Unlock()
+	return s.rand.Intn(n)
+}
+
+func (s *seededRand) Read(p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.rand.Read(p)
+}
+
+func (s *seededRand) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	body, ok := readJSONBody(w, r)
+	if !ok {
+		return
+	}
+	var reseed struct {
+		Seed *int64 `json:"seed"`
+	}
+	if err := json.Unmarshal(body, &reseed); err != nil || reseed.Seed == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`expected {"seed": <integer>}`))
+		return
+	}
+	s.Lock()
+	s.rand.Seed(*reseed.Seed)
+	s.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
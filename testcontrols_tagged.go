@@ -0,0 +1,9 @@
+//go:build fishestest
+// +build fishestest
+
+package fishes
+
+// A server built with -tags fishestest is deterministic.
+func init() {
+	testControls = deterministicControls
+}
@@ -0,0 +1,112 @@
+package fishes
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the certificate at certPath/keyPath and picks up
+// replacements on disk, such as certbot renewals, without a restart.
+type certReloader struct {
+	sync.RWMutex
+	certPath string
+	keyPath  string
+	cert     *tls.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	c := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func modTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func (c *certReloader) load() error {
+	certMod, err := modTime(c.certPath)
+	if err != nil {
+		return err
+	}
+	keyMod, err := modTime(c.keyPath)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.cert = &cert
+	c.certMod = certMod
+	c.keyMod = keyMod
+	c.Unlock()
+	return nil
+}
+
+func (c *certReloader) changed() bool {
+	certMod, err := modTime(c.certPath)
+	if err != nil {
+		return false
+	}
+	keyMod, err := modTime(c.keyPath)
+	if err != nil {
+		return false
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+	return !certMod.Equal(c.certMod) || !keyMod.Equal(c.keyMod)
+}
+
+func (c *certReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !c.changed() {
+			continue
+		}
+		if err := c.load(); err != nil {
+			log.Printf("certificate reload failed, keeping current certificate: %s", err)
+			continue
+		}
+		log.Printf("reloaded certificate from %s", c.certPath)
+	}
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cert, nil
+}
+
+func redirectToHTTPS(httpsAddr string) http.Handler {
+	_, httpsPort, _ := net.SplitHostPort(httpsAddr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
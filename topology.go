@@ -0,0 +1,131 @@
+package fishes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// topology gathers the health of every node this one knows of: the cluster
+// peers, the gossip members, the sync_peers and the primary of a replica.
+type topology struct {
+	self    string
+	fishes  *fishesHandler
+	rep     *replica
+	cluster *clusterNode
+	members *membership
+	syncs   *syncer
+	client  *http.Client
+}
+
+func newTopology(h *fishesHandler, rep *replica, cluster *clusterNode, members *membership) *topology {
+	self := strings.TrimSuffix(h.config().AdvertiseURL, "/")
+	if self == "" {
+		self = "self"
+	}
+	return &topology{self: self, fishes: h, rep: rep, cluster: cluster, members: members, client: &http.Client{Timeout: 2 * time.Second}}
+}
+
+type nodeReport struct {
+	URL  string `json:"url"`
+	Self bool   `json:"self,omitempty"`
+	*healthStatus
+	// Unreachable is why the node could not be asked.
+	Unreachable string `json:"unreachable,omitempty"`
+}
+
+type topologyReport struct {
+	GeneratedAt time.Time    `json:"generated_at"`
+	Nodes       []nodeReport `json:"nodes"`
+}
+
+func (t *topology) others() []string {
+	var found []string
+	if t.cluster != nil {
+		found = append(found, t.cluster.peerList()...)
+	}
+	if t.members != nil {
+		t.members.Lock()
+		for _, mem := range t.members.list() {
+			found = append(found, mem.URL)
+		}
+		t.members.Unlock()
+	}
+	if t.syncs != nil {
+		found = append(found, t.syncs.static...)
+	}
+	if t.rep != nil {
+		t.rep.Lock()
+		if t.rep.primary != nil {
+			found = append(found, strings.TrimSuffix(t.rep.primary.String(), "/"))
+		}
+		t.rep.Unlock()
+	}
+	var others []string
+	for _, node := range unionPeers(nil, found) {
+		if node != t.self {
+			others = append(others, node)
+		}
+	}
+	sort.Strings(others)
+	return others
+}
+
+// fetch reads the /healthz of node, which answers 503 with the same body
+// while lagging.
+func (t *topology) fetch(ctx context.Context, node string) nodeReport {
+	report := nodeReport{URL: node}
+	req, err := http.NewRequestWithContext(ctx, "GET", node+"/healthz", nil)
+	if err != nil {
+		report.Unreachable = err.Error()
+		return report
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		report.Unreachable = err.Error()
+		return report
+	}
+	defer resp.Body.Close()
+	var status healthStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		report.Unreachable = resp.Status
+		return report
+	}
+	report.healthStatus = &status
+	return report
+}
+
+func (t *topology) report(ctx context.Context) topologyReport {
+	self, _ := nodeHealth(t.fishes, t.rep, t.cluster)
+	others := t.others()
+	reports := make([]nodeReport, len(others))
+	index := map[string]int{}
+	for i, node := range others {
+		index[node] = i
+	}
+	broadcast(others, func(node string) {
+		reports[index[node]] = t.fetch(ctx, node)
+	})
+	return topologyReport{
+		GeneratedAt: time.Now().UTC(),
+		Nodes:       append([]nodeReport{{URL: t.self, Self: true, healthStatus: &self}}, reports...),
+	}
+}
+
+// status serves /cluster/status as JSON, or as an admin page to browsers.
+func (t *topology) status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		sendEarlyHints(w, r, "cluster-status")
+		renderAdmin(w, "cluster-status", t.report(r.Context()))
+		return
+	}
+	writeJSON(w, http.StatusOK, t.report(r.Context()))
+}
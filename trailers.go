@@ -0,0 +1,29 @@
+package fishes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// The trailers of streamed CSV downloads, so a client can tell it got the
+// whole body unharmed: the SHA-256 of the body, in hex, and the number of
+// records in it, the header row left out.
+const (
+	contentSHA256Trailer = "X-Content-Sha256"
+	recordCountTrailer   = "X-Record-Count"
+)
+
+// withChecksumTrailers declares the checksum trailers on w. The body is to
+// be written to the writer it returns, and finish called with the number
+// of records once all of it was.
+func withChecksumTrailers(w http.ResponseWriter) (body io.Writer, finish func(records int)) {
+	w.Header().Set("Trailer", contentSHA256Trailer+", "+recordCountTrailer)
+	sum := sha256.New()
+	return io.MultiWriter(w, sum), func(records int) {
+		w.Header().Set(contentSHA256Trailer, hex.EncodeToString(sum.Sum(nil)))
+		w.Header().Set(recordCountTrailer, strconv.Itoa(records))
+	}
+}
@@ -0,0 +1,64 @@
+package fishes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// A CSV download ends with trailers holding the SHA-256 of the body as the
+// client reads it and the number of records, compressed or not.
+func TestExplorerCSVTrailers(t *testing.T) {
+	srv := httptest.NewServer(newTestServer(t, false, map[string]string{"COMPRESSION_MIN_BYTES": "1"}))
+	defer srv.Close()
+	h := srv.Config.Handler
+	for _, body := range []string{
+		`{"name":"Nemo","environment":"saltwater"}`,
+		`{"name":"Guppy","environment":"freshwater"}`,
+		`{"name":"Dory","environment":"saltwater"}`,
+	} {
+		if res := serveTest(h, "POST", "/fishes", "application/json", []byte(body)); res.Code != http.StatusCreated {
+			t.Fatalf("seeding: %d %s", res.Code, res.Body)
+		}
+	}
+
+	for _, tc := range []struct {
+		name, query, acceptEncoding string
+		wantRecords                 string
+	}{
+		{"all", "resource=fishes&format=csv", "", "3"},
+		{"filtered", "resource=fishes&format=csv&environment=saltwater", "", "2"},
+		{"none", "resource=trash&format=csv", "", "0"},
+		{"uncompressed", "resource=fishes&format=csv", "identity", "3"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", srv.URL+"/admin/explorer?"+tc.query, nil)
+			req.SetBasicAuth("admin", "test")
+			if tc.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("%d %s: %v", resp.StatusCode, body, err)
+			}
+			if compressed := tc.acceptEncoding == ""; resp.Uncompressed != compressed {
+				t.Errorf("compressed %v, want %v", resp.Uncompressed, compressed)
+			}
+			sum := sha256.Sum256(body)
+			if got := resp.Trailer.Get(contentSHA256Trailer); got != hex.EncodeToString(sum[:]) {
+				t.Errorf("%s %q, want %x", contentSHA256Trailer, got, sum)
+			}
+			if got := resp.Trailer.Get(recordCountTrailer); got != tc.wantRecords {
+				t.Errorf("%s %q, want %s", recordCountTrailer, got, tc.wantRecords)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package fishes
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var listTrashParams = []paramSpec{
+	{name: "limit", kind: paramInt, min: 1, max: 1000, def: "100"},
+	{name: "offset", kind: paramInt, min: 0, max: math.MaxInt32, def: "0"},
+	{name: "envelope", kind: paramBool},
+}
+
+// remove moves a fish to the trash. Callers must hold the lock.
+func (h *fishesHandler) remove(id string, now time.Time) error {
+	fish := h.db[id]
+	fish.DeletedAt = &now
+	fish.Version++
+	return h.moveToTrash(fish)
+}
+
+// moveToTrash replaces the live fish with its deleted version. Callers must
+// hold the lock.
+func (h *fishesHandler) moveToTrash(fish Fish) error {
+	if h.oplog != nil {
+		if err := h.oplog.remove(fish); err != nil {
+			return err
+		}
+	}
+
+	if h.crdt != nil {
+		h.crdt.touch(fish)
+	}
+	delete(h.db, fish.ID)
+	h.setEncoded(fish.ID, nil)
+	if h.archive != nil {
+		delete(h.archive.lastAccess, fish.ID)
+	}
+	h.trash[fish.ID] = fish
+	h.bumpVersion()
+	h.dirty = true
+	h.cache.invalidate("fishes")
+	return nil
+}
+
+// purgeTrash permanently drops fishes deleted before cutoff. Callers must
+// hold the lock.
+func (h *fishesHandler) purgeTrash(cutoff time.Time) (int, error) {
+	purged := 0
+	for id, fish := range h.trash {
+		if !fish.DeletedAt.Before(cutoff) {
+			continue
+		}
+		if err := h.dropFromTrash(id); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	if purged > 0 {
+		h.bumpVersion()
+		h.dirty = true
+	}
+	return purged, nil
+}
+
+// dropFromTrash forgets a trashed fish and its slugs. Callers must hold the
+// lock.
+func (h *fishesHandler) dropFromTrash(id string) error {
+	if h.oplog != nil {
+		if err := h.oplog.purge(id); err != nil {
+			return err
+		}
+	}
+	if h.crdt != nil {
+		h.crdt.purge(id)
+	}
+	delete(h.trash, id)
+	for slug, owner := range h.slugs {
+		if owner == id {
+			delete(h.slugs, slug)
+		}
+	}
+	return nil
+}
+
+// trashPurgeInterval checks at least hourly, and more often when the
+// retention is shorter than that.
+func (h *fishesHandler) trashPurgeInterval() time.Duration {
+	if retention := h.config().TrashRetention; retention < time.Hour {
+		return retention
+	}
+	return time.Hour
+}
+
+func (h *fishesHandler) purgeExpiredTrash() error {
+	h.Lock()
+	n, err := h.purgeTrash(h.clock.Now().UTC().Add(-h.config().TrashRetention))
+	h.Unlock()
+	if n > 0 {
+		log.Printf("purged %d fishes from the trash", n)
+	}
+	return err
+}
+
+func (h *fishesHandler) deleteFish(w http.ResponseWriter, r *http.Request, id string) {
+	h.Lock()
+	defer h.Unlock()
+
+	enc, ok := h.encoded[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	view := h.view(r, enc)
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !enc.matches(ifMatch, view) || modifiedSince(r, enc.modified) {
+		body := h.itemBody(r, view)
+		w.Header()["Etag"] = body.etagHeader
+		setLastModified(w, enc)
+		w.Header().Add("content-type", "application/json")
+		w.WriteHeader(http.StatusPreconditionFailed)
+		w.Write(body.bytes)
+		return
+	}
+
+	if err := h.remove(id, h.clock.Now().UTC()); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *fishesHandler) restoreFish(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	fish, ok := h.trash[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("fish is not in the trash"))
+		return
+	}
+	if err := h.overQuota(1); err != nil {
+		w.Header().Set("X-Quota-Exceeded", "records")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	fish.DeletedAt = nil
+	fish.Version++
+	h.assignSlug(&fish)
+	h.stampUpdated(&fish)
+
+	enc, err := h.put(fish)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	delete(h.trash, id)
+
+	body := h.itemBody(r, h.view(r, enc))
+	w.Header()["Etag"] = body.etagHeader
+	setLastModified(w, enc)
+	w.Header().Add("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body.bytes)
+}
+
+// getTrash lists deleted fishes, most recently deleted first.
+func (h *fishesHandler) getTrash(w http.ResponseWriter, r *http.Request, q queryValues) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+
+	h.Lock()
+	version := h.version
+	fishes := make([]Fish, 0, len(h.trash))
+	for _, fish := range h.trash {
+		fishes = append(fishes, fish)
+	}
+	h.Unlock()
+
+	sort.Slice(fishes, func(i, j int) bool {
+		if !fishes[i].DeletedAt.Equal(*fishes[j].DeletedAt) {
+			return fishes[i].DeletedAt.After(*fishes[j].DeletedAt)
+		}
+		return fishes[i].ID < fishes[j].ID
+	})
+	total := len(fishes)
+	fishes = paginateFishes(fishes, q.int("limit"), q.int("offset"))
+	h.visibleFishes(r, fishes)
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	err := marshalListBody(buf, r, h.wantsEnvelope(r), versionedFishes(r, fishes), listMeta{
+		Total:   total,
+		Limit:   q.int("limit"),
+		Offset:  q.int("offset"),
+		Version: version,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	setSchemaHeaders(w, r, nil)
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	w.Header().Add("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+func (h *fishesHandler) fishSubresource(w http.ResponseWriter, r *http.Request, id, sub string) {
+	switch {
+	case sub == "restore":
+		h.restoreFish(w, r, id)
+	case sub == "undo":
+		h.undoFish(w, r, id)
+	case sub == "revisions" || strings.HasPrefix(sub, "revisions/"):
+		h.revisions(w, r, id, sub)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,231 @@
+package fishes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type undoResult struct {
+	Reverted struct {
+		Seq uint64    `json:"seq"`
+		At  time.Time `json:"at"`
+		Op  string    `json:"op"`
+	} `json:"reverted"`
+	Action string      `json:"action"`
+	Fish   interface{} `json:"fish,omitempty"`
+}
+
+func (op opEntry) fishID() string {
+	if op.Fish != nil {
+		return op.Fish.ID
+	}
+	return op.ID
+}
+
+// stateBefore returns how the fish looked right before the operation with
+// sequence number seq: live, in the trash, or not there at all.
+func stateBefore(ops []opEntry, seq uint64, id string) (*Fish, bool) {
+	snap := replayOps(ops, seq-1)
+	for _, fish := range snap.Fishes {
+		if fish.ID == id {
+			return &fish, false
+		}
+	}
+	for _, fish := range snap.Trash {
+		if fish.ID == id {
+			return &fish, true
+		}
+	}
+	return nil, false
+}
+
+// revertFish brings a fish back to prev, a state from the operation log.
+// The revert is itself a new operation, so undoing it again redoes the
+// change. Callers must hold the lock.
+func (h *fishesHandler) revertFish(id string, prev *Fish, prevTrashed bool) (string, *Fish, error) {
+	current, live := h.db[id]
+	if !live {
+		current = h.trash[id]
+	}
+
+	if prev == nil || prevTrashed {
+		if !live {
+			return "", nil, fmt.Errorf("fish %s is already deleted", id)
+		}
+		if err := h.remove(id, h.clock.Now().UTC()); err != nil {
+			return "", nil, err
+		}
+		fish := h.trash[id]
+		return "deleted", &fish, nil
+	}
+
+	fish := *prev
+	fish.Version = current.Version + 1
+	fish.DeletedAt = nil
+	h.assignSlug(&fish)
+	h.stampUpdated(&fish)
+	if _, err := h.put(fish); err != nil {
+		return "", nil, err
+	}
+	delete(h.trash, id)
+	if live {
+		return "updated", &fish, nil
+	}
+	return "restored", &fish, nil
+}
+
+// undo reverts op, refusing when the fish changed after it.
+func (h *fishesHandler) undo(w http.ResponseWriter, r *http.Request, ops []opEntry, op opEntry) {
+	if op.Op == opReset {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("a reset replaced the whole dataset, use /admin/restore to go back past it"))
+		return
+	}
+	if op.Op == opPurge {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("the fish was purged and cannot be brought back by undo"))
+		return
+	}
+
+	id := op.fishID()
+	for _, later := range ops {
+		if later.Seq > op.Seq && (later.Op == opReset || later.fishID() == id) {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(fmt.Sprintf("fish %s changed after seq %d (at seq %d), undo that first", id, op.Seq, later.Seq)))
+			return
+		}
+	}
+
+	if err := h.rehydrate(id); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	prev, prevTrashed := stateBefore(ops, op.Seq, id)
+	action, fish, err := h.revertFish(id, prev, prevTrashed)
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	visible := []Fish{*fish}
+	h.visibleFishes(r, visible)
+	result := undoResult{Action: action, Fish: versionedFish(r, visible[0])}
+	result.Reverted.Seq = op.Seq
+	result.Reverted.At = op.At
+	result.Reverted.Op = op.Op
+	writeJSON(w, http.StatusOK, result)
+}
+
+// undoOpsRetries bounds how often lockUndoOps rereads a log that keeps
+// moving before it reads it under the lock.
+const undoOpsRetries = 3
+
+// lockUndoOps reads the operation log and returns with the lock held. The
+// read is done first without the lock so a long log does not stall every
+// other request; if operations were appended meanwhile it is read again, as
+// one of them may be a later change the undo has to see.
+func (h *fishesHandler) lockUndoOps(w http.ResponseWriter, r *http.Request) ([]opEntry, bool) {
+	if h.oplog == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("undo works from the operation log, set data_dir to enable it"))
+		return nil, false
+	}
+	for attempt := 0; ; attempt++ {
+		if attempt == undoOpsRetries {
+			h.Lock()
+		}
+		ops, err := h.oplog.read(r.Context())
+		if err != nil {
+			if attempt == undoOpsRetries {
+				h.Unlock()
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return nil, false
+		}
+		if attempt == undoOpsRetries {
+			return ops, true
+		}
+
+		var seq uint64
+		if len(ops) > 0 {
+			seq = ops[len(ops)-1].Seq
+		}
+		h.Lock()
+		if h.oplog.seq == seq {
+			return ops, true
+		}
+		h.Unlock()
+	}
+}
+
+// undoFish reverts the most recent change to one fish.
+func (h *fishesHandler) undoFish(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+
+	ops, ok := h.lockUndoOps(w, r)
+	if !ok {
+		return
+	}
+	defer h.Unlock()
+	for i := len(ops) - 1; i >= 0; i-- {
+		if ops[i].fishID() == id {
+			h.undo(w, r, ops, ops[i])
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte("no changes to undo for this fish"))
+}
+
+// undo reverts the operation given by seq, or the latest one without it.
+func (a *adminPortal) undo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+
+	h := a.fishes
+	ops, ok := h.lockUndoOps(w, r)
+	if !ok {
+		return
+	}
+	defer h.Unlock()
+	if len(ops) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("nothing to undo"))
+		return
+	}
+
+	target := ops[len(ops)-1]
+	if raw := r.URL.Query().Get("seq"); raw != "" {
+		seq, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil || seq < 1 || seq > ops[len(ops)-1].Seq {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("seq must be the number of an operation in the log"))
+			return
+		}
+		found := false
+		for _, op := range ops {
+			if op.Seq == seq {
+				target, found = op, true
+				break
+			}
+		}
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("no operation %d in the log", seq)))
+			return
+		}
+	}
+	h.undo(w, r, ops, target)
+}
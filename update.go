@@ -0,0 +1,104 @@
+package fishes
+
+import (
+	"net/http"
+)
+
+type fishUpdate func(current Fish, body []byte) (Fish, []fieldAlias, error)
+
+func (h *fishesHandler) replaceFish(w http.ResponseWriter, r *http.Request, id string) {
+	h.updateFish(w, r, id, []string{"application/json"}, func(current Fish, body []byte) (Fish, []fieldAlias, error) {
+		return decodeFish(body)
+	})
+}
+
+func (h *fishesHandler) patchFish(w http.ResponseWriter, r *http.Request, id string) {
+	h.updateFish(w, r, id, []string{"application/json", "application/merge-patch+json"}, mergeFishPatch)
+}
+
+func (h *fishesHandler) updateFish(w http.ResponseWriter, r *http.Request, id string, contentTypes []string, update fishUpdate) {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" && r.Header.Get("If-Unmodified-Since") == "" {
+		w.WriteHeader(http.StatusPreconditionRequired)
+		w.Write([]byte("updates require an If-Match header with the fish's current ETag, or If-Unmodified-Since"))
+		return
+	}
+
+	bodyBytes, ok := readJSONBody(w, r, contentTypes...)
+	if !ok {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	current, ok := h.db[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	currentEnc := h.encoded[id]
+	if ifMatch == "" && currentEnc.modified.IsZero() {
+		// Without an updated_at the fish cannot be checked against
+		// If-Unmodified-Since.
+		w.WriteHeader(http.StatusPreconditionRequired)
+		w.Write([]byte("this fish has no updated_at yet, updates require an If-Match header with its current ETag"))
+		return
+	}
+	currentView := h.view(r, currentEnc)
+	if ifMatch != "" && !currentEnc.matches(ifMatch, currentView) || modifiedSince(r, currentEnc.modified) {
+		body := h.itemBody(r, currentView)
+		w.Header()["Etag"] = body.etagHeader
+		setLastModified(w, currentEnc)
+		w.Header().Add("content-type", "application/json")
+		w.WriteHeader(http.StatusPreconditionFailed)
+		w.Write(body.bytes)
+		return
+	}
+
+	updated, deprecated, err := update(current, bodyBytes)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if err := validateEnvironment(updated.Environment); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := h.checkSensitive(updated); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := h.fields.validate(updated.Extensions); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	updated.ID = current.ID
+	updated.Slug = current.Slug
+	updated.Version = current.Version + 1
+	updated.DeletedAt = nil
+	h.assignSlug(&updated)
+	h.stampUpdated(&updated)
+
+	enc, err := h.put(updated)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	setSchemaHeaders(w, r, deprecated)
+	body := h.itemBody(r, h.view(r, enc))
+	w.Header()["Etag"] = body.etagHeader
+	setLastModified(w, enc)
+	w.Header().Add("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body.bytes)
+}
@@ -0,0 +1,153 @@
+package fishes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const (
+	pathPrefixKey contextKey = "path-prefix"
+	apiVersionKey contextKey = "api-version"
+)
+
+// apiVersions are the route trees the API is mounted under. Paths without one
+// are served as /v1, as they were before versions.
+var apiVersions = map[string]int{"/v1": 1, "/v2": 2}
+
+// clientPath gives path as the client sees it, with the prefixes it was sent
+// with if any, such as /v2 and /t/{tenant}.
+func clientPath(r *http.Request, path string) string {
+	prefix, _ := r.Context().Value(pathPrefixKey).(string)
+	return prefix + path
+}
+
+// apiVersion is the version of the API r was sent to.
+func apiVersion(r *http.Request) int {
+	if version, ok := r.Context().Value(apiVersionKey).(int); ok {
+		return version
+	}
+	return 1
+}
+
+// versionPrefix splits the version off path, returning 0 when it names none.
+func versionPrefix(path string) (version int, prefix, rest string) {
+	for prefix, version := range apiVersions {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			rest = strings.TrimPrefix(path, prefix)
+			if rest == "" {
+				rest = "/"
+			}
+			return version, prefix, rest
+		}
+	}
+	return 0, "", path
+}
+
+// withAPIVersions serves /v1/... and /v2/... with the handlers of the
+// unversioned routes. Both share the stores; /v2 always answers in the
+// envelope and reports errors as JSON, while the v2_api flag is on. The
+// admin portal is not versioned.
+func withAPIVersions(flags *featureFlags, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version, prefix, path := versionPrefix(r.URL.Path)
+		if version == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if path == "/admin" || strings.HasPrefix(path, "/admin/") {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("the admin portal is not versioned, it is served on /admin"))
+			return
+		}
+		if version == 2 && !flags.enabled(r, "v2_api") {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("the v2 API is not enabled"))
+			return
+		}
+
+		ctx := context.WithValue(context.WithValue(r.Context(), apiVersionKey, version), pathPrefixKey, prefix)
+		r2 := r.Clone(ctx)
+		r2.URL.Path, r2.URL.RawPath = path, ""
+		w = &prefixedWriter{ResponseWriter: w, prefix: prefix}
+		if version == 1 {
+			next.ServeHTTP(w, r2)
+			return
+		}
+		ew := &apiErrorWriter{ResponseWriter: w}
+		next.ServeHTTP(ew, r2)
+		ew.finish()
+	})
+}
+
+type apiError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiErrorBody is how /v2 reports errors, which /v1 sends as plain text.
+type apiErrorBody struct {
+	Error apiError `json:"error"`
+}
+
+func newAPIErrorBody(status int, message string) apiErrorBody {
+	code := strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+	if code == "" {
+		code = "error"
+	}
+	return apiErrorBody{Error: apiError{Status: status, Code: code, Message: message}}
+}
+
+// apiErrorWriter holds back the plain text errors of the handlers, which
+// finish then sends as an apiErrorBody. Errors already in JSON, such as
+// those of /rpc and /graphql, go through as they are.
+type apiErrorWriter struct {
+	http.ResponseWriter
+	status  int
+	failed  bool
+	message bytes.Buffer
+}
+
+func (ew *apiErrorWriter) WriteHeader(status int) {
+	if informational(status) {
+		ew.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if ew.status != 0 {
+		return
+	}
+	ew.status = status
+	if status >= 400 && !strings.Contains(ew.Header().Get("Content-Type"), "json") {
+		ew.failed = true
+		return
+	}
+	ew.ResponseWriter.WriteHeader(status)
+}
+
+func (ew *apiErrorWriter) Write(b []byte) (int, error) {
+	if ew.status == 0 {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.failed {
+		return ew.message.Write(b)
+	}
+	return ew.ResponseWriter.Write(b)
+}
+
+func (ew *apiErrorWriter) finish() {
+	if !ew.failed {
+		return
+	}
+	message := strings.TrimSpace(ew.message.String())
+	if message == "" {
+		message = http.StatusText(ew.status)
+	}
+	body, _ := json.Marshal(newAPIErrorBody(ew.status, message))
+	ew.Header().Del("Content-Length")
+	ew.Header().Set("content-type", "application/json")
+	ew.ResponseWriter.WriteHeader(ew.status)
+	ew.ResponseWriter.Write(body)
+}
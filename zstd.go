@@ -0,0 +1,323 @@
+package fishes
+
+import (
+	"io"
+	"math/bits"
+)
+
+// zstdWriter compresses to a Zstandard frame (RFC 8878). Blocks keep their
+// literals raw and code their sequences with the predefined FSE tables, so
+// no table is ever sent; a block that would not shrink is stored instead.
+type zstdWriter struct {
+	w           io.Writer
+	buf         []byte
+	wroteHeader bool
+	err         error
+}
+
+const (
+	zstdBlockSize = 1 << 17
+	// zstdWindowLog gives a 128 KiB window, which a block always fits in.
+	zstdWindowLog = 17
+
+	zstdBlockRaw        = 0
+	zstdBlockCompressed = 2
+)
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+func newZstdWriter(w io.Writer) *zstdWriter {
+	return &zstdWriter{w: w}
+}
+
+func (z *zstdWriter) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	z.buf = append(z.buf, p...)
+	for len(z.buf) > zstdBlockSize {
+		z.block(z.buf[:zstdBlockSize], false)
+		z.buf = append(z.buf[:0], z.buf[zstdBlockSize:]...)
+	}
+	return len(p), z.err
+}
+
+// Close writes what is left as the last block of the frame.
+func (z *zstdWriter) Close() error {
+	if z.err == nil {
+		z.block(z.buf, true)
+		z.buf = nil
+	}
+	return z.err
+}
+
+func (z *zstdWriter) block(src []byte, last bool) {
+	var out []byte
+	if !z.wroteHeader {
+		z.wroteHeader = true
+		// No content size or checksum, and a window descriptor in place of
+		// the single segment flag.
+		out = append(out, zstdMagic...)
+		out = append(out, 0, byte(zstdWindowLog-10)<<3)
+	}
+
+	kind, body := zstdBlockRaw, src
+	if compressed := zstdCompressBlock(src); compressed != nil && len(compressed) < len(src) {
+		kind, body = zstdBlockCompressed, compressed
+	}
+	header := uint32(len(body))<<3 | uint32(kind)<<1
+	if last {
+		header |= 1
+	}
+	out = append(out, byte(header), byte(header>>8), byte(header>>16))
+	out = append(out, body...)
+	_, z.err = z.w.Write(out)
+}
+
+// zstdCompressBlock gives the literals and sequences sections of src, or
+// nil when it has nothing worth matching.
+func zstdCompressBlock(src []byte) []byte {
+	seqs := lzParse(src, zstdBlockSize, zstdBlockSize)
+	if len(seqs) == 0 {
+		return nil
+	}
+
+	literals := make([]byte, 0, len(src))
+	pos := 0
+	for _, s := range seqs {
+		literals = append(literals, src[pos:pos+s.litLen]...)
+		pos += s.litLen + s.matchLen
+	}
+	literals = append(literals, src[pos:]...)
+
+	var out []byte
+	switch n := len(literals); {
+	case n < 1<<5:
+		out = append(out, byte(n<<3))
+	case n < 1<<12:
+		out = append(out, byte(1<<2|(n&0xf)<<4), byte(n>>4))
+	default:
+		out = append(out, byte(3<<2|(n&0xf)<<4), byte(n>>4), byte(n>>12))
+	}
+	out = append(out, literals...)
+
+	switch n := len(seqs); {
+	case n < 128:
+		out = append(out, byte(n))
+	case n < 0x7f00:
+		out = append(out, byte(n>>8|0x80), byte(n))
+	default:
+		out = append(out, 0xff, byte(n-0x7f00), byte((n-0x7f00)>>8))
+	}
+	// Predefined modes for the literal length, offset and match length codes.
+	out = append(out, 0)
+	return append(out, zstdEncodeSequences(seqs)...)
+}
+
+// extraCode is a length or distance split into the symbol of its prefix or
+// FSE code and the extra bits that follow it.
+type extraCode struct {
+	symbol    uint8
+	extra     uint32
+	extraBits uint
+}
+
+var (
+	zstdLitLenBaselines = []uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	zstdLitLenBits = []uint{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	zstdMatchLenBaselines = []uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	zstdMatchLenBits = []uint{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+
+	zstdLitLenTable = newFSETable([]int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}, 6)
+	zstdMatchLenTable = newFSETable([]int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}, 6)
+	zstdOffsetTable = newFSETable([]int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}, 5)
+)
+
+func lengthCode(n uint32, baselines []uint32, extraBits []uint) extraCode {
+	symbol := len(baselines) - 1
+	for baselines[symbol] > n {
+		symbol--
+	}
+	return extraCode{symbol: uint8(symbol), extra: n - baselines[symbol], extraBits: extraBits[symbol]}
+}
+
+// zstdOffsetCode codes a new offset; values 1 to 3 repeat earlier offsets,
+// which are not used.
+func zstdOffsetCode(offset int) extraCode {
+	value := uint32(offset + 3)
+	n := uint(bits.Len32(value) - 1)
+	return extraCode{symbol: uint8(n), extra: value - 1<<n, extraBits: n}
+}
+
+// zstdEncodeSequences writes the sequences backwards, last one first, as
+// the decoder reads the bitstream from its end.
+func zstdEncodeSequences(seqs []lzSequence) []byte {
+	ll := make([]extraCode, len(seqs))
+	ml := make([]extraCode, len(seqs))
+	of := make([]extraCode, len(seqs))
+	for i, s := range seqs {
+		ll[i] = lengthCode(uint32(s.litLen), zstdLitLenBaselines, zstdLitLenBits)
+		ml[i] = lengthCode(uint32(s.matchLen), zstdMatchLenBaselines, zstdMatchLenBits)
+		of[i] = zstdOffsetCode(s.offset)
+	}
+
+	var bw bitWriter
+	last := len(seqs) - 1
+	mlState := zstdMatchLenTable.start(ml[last].symbol)
+	ofState := zstdOffsetTable.start(of[last].symbol)
+	llState := zstdLitLenTable.start(ll[last].symbol)
+	bw.write(ll[last].extra, ll[last].extraBits)
+	bw.write(ml[last].extra, ml[last].extraBits)
+	bw.write(of[last].extra, of[last].extraBits)
+	for i := last - 1; i >= 0; i-- {
+		zstdOffsetTable.encode(&bw, &ofState, of[i].symbol)
+		zstdMatchLenTable.encode(&bw, &mlState, ml[i].symbol)
+		zstdLitLenTable.encode(&bw, &llState, ll[i].symbol)
+		bw.write(ll[i].extra, ll[i].extraBits)
+		bw.write(ml[i].extra, ml[i].extraBits)
+		bw.write(of[i].extra, of[i].extraBits)
+	}
+	zstdMatchLenTable.flush(&bw, mlState)
+	zstdOffsetTable.flush(&bw, ofState)
+	zstdLitLenTable.flush(&bw, llState)
+	bw.write(1, 1)
+	return bw.close()
+}
+
+// fseTable encodes symbols against the decoding table a normalized
+// distribution spreads to, as zstd builds it; -1 is a probability below
+// one in the table size.
+type fseTable struct {
+	log        uint
+	nextStates []uint16
+	deltaBits  []uint32
+	deltaState []int32
+}
+
+func newFSETable(norm []int16, tableLog uint) *fseTable {
+	size := 1 << tableLog
+	symbols := make([]int, size)
+	high := size - 1
+	cumul := make([]int, len(norm)+1)
+	for s, n := range norm {
+		if n == -1 {
+			cumul[s+1] = cumul[s] + 1
+			symbols[high] = s
+			high--
+		} else {
+			cumul[s+1] = cumul[s] + int(n)
+		}
+	}
+
+	step := size>>1 + size>>3 + 3
+	pos := 0
+	for s, n := range norm {
+		for i := 0; i < int(n); i++ {
+			symbols[pos] = s
+			pos = (pos + step) & (size - 1)
+			for pos > high {
+				pos = (pos + step) & (size - 1)
+			}
+		}
+	}
+
+	t := &fseTable{
+		log:        tableLog,
+		nextStates: make([]uint16, size),
+		deltaBits:  make([]uint32, len(norm)),
+		deltaState: make([]int32, len(norm)),
+	}
+	for u, s := range symbols {
+		t.nextStates[cumul[s]] = uint16(size + u)
+		cumul[s]++
+	}
+	total := 0
+	for s, n := range norm {
+		switch {
+		case n == -1 || n == 1:
+			t.deltaBits[s] = uint32(tableLog<<16) - uint32(size)
+			t.deltaState[s] = int32(total - 1)
+			total++
+		case n > 1:
+			maxBits := tableLog - uint(bits.Len32(uint32(n-1))-1)
+			t.deltaBits[s] = uint32(maxBits<<16) - uint32(n)<<maxBits
+			t.deltaState[s] = int32(total - int(n))
+			total += int(n)
+		}
+	}
+	return t
+}
+
+// start gives the state of the symbol coded first, which is decoded last.
+func (t *fseTable) start(symbol uint8) uint32 {
+	nbBits := (t.deltaBits[symbol] + 1<<15) >> 16
+	value := nbBits<<16 - t.deltaBits[symbol]
+	return uint32(t.nextStates[int32(value>>nbBits)+t.deltaState[symbol]])
+}
+
+func (t *fseTable) encode(bw *bitWriter, state *uint32, symbol uint8) {
+	nbBits := (*state + t.deltaBits[symbol]) >> 16
+	bw.write(*state, uint(nbBits))
+	*state = uint32(t.nextStates[int32(*state>>nbBits)+t.deltaState[symbol]])
+}
+
+func (t *fseTable) flush(bw *bitWriter, state uint32) {
+	bw.write(state, t.log)
+}
+
+// bitWriter packs bits from the least significant end of each byte, as
+// both zstd and brotli streams do.
+type bitWriter struct {
+	out  []byte
+	acc  uint64
+	used uint
+}
+
+func (bw *bitWriter) write(v uint32, n uint) {
+	bw.acc |= uint64(v&(1<<n-1)) << bw.used
+	bw.used += n
+	for bw.used >= 8 {
+		bw.out = append(bw.out, byte(bw.acc))
+		bw.acc >>= 8
+		bw.used -= 8
+	}
+}
+
+// close pads the last byte with zeros.
+func (bw *bitWriter) close() []byte {
+	if bw.used > 0 {
+		bw.out = append(bw.out, byte(bw.acc))
+		bw.acc, bw.used = 0, 0
+	}
+	return bw.out
+}